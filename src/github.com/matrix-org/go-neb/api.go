@@ -1,15 +1,24 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/subtle"
 	"database/sql"
 	"encoding/base64"
 	"encoding/json"
 	log "github.com/Sirupsen/logrus"
 	"github.com/matrix-org/go-neb/clients"
+	"github.com/matrix-org/go-neb/config"
 	"github.com/matrix-org/go-neb/database"
 	"github.com/matrix-org/go-neb/errors"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/ops"
+	"github.com/matrix-org/go-neb/server"
+	"github.com/matrix-org/go-neb/status"
+	"github.com/matrix-org/go-neb/tokens"
 	"github.com/matrix-org/go-neb/types"
 	"net/http"
+	"sort"
 	"strings"
 	"sync"
 )
@@ -50,10 +59,23 @@ func (h *requestAuthSessionHandler) OnIncomingRequest(req *http.Request) (interf
 		return nil, &errors.HTTPError{err, "Unknown RealmID", 400}
 	}
 
+	// Realms without labelled sessions would clobber the user's default session instead.
+	var cfg struct {
+		Label string
+	}
+	json.Unmarshal(body.Config, &cfg)
+	if _, ok := realm.AuthSession("", body.UserID, body.RealmID).(types.LabelledSession); cfg.Label != "" && !ok {
+		return nil, &errors.HTTPError{nil, "Realm " + body.RealmID + " does not support labelled sessions", 400}
+	}
+
 	response := realm.RequestAuthSession(body.UserID, body.Config)
 	if response == nil {
 		return nil, &errors.HTTPError{nil, "Failed to request auth session", 500}
 	}
+	// e.g. a submitted token which doesn't work
+	if err, ok := response.(error); ok {
+		return nil, &errors.HTTPError{err, err.Error(), 400}
+	}
 
 	return response, nil
 }
@@ -69,6 +91,7 @@ func (h *removeAuthSessionHandler) OnIncomingRequest(req *http.Request) (interfa
 	var body struct {
 		RealmID string
 		UserID  string
+		Label   string
 	}
 	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
 		return nil, &errors.HTTPError{err, "Error parsing request JSON", 400}
@@ -76,6 +99,7 @@ func (h *removeAuthSessionHandler) OnIncomingRequest(req *http.Request) (interfa
 	log.WithFields(log.Fields{
 		"realm_id": body.RealmID,
 		"user_id":  body.UserID,
+		"label":    body.Label,
 	}).Print("Incoming remove auth session request")
 
 	if body.UserID == "" || body.RealmID == "" {
@@ -87,15 +111,26 @@ func (h *removeAuthSessionHandler) OnIncomingRequest(req *http.Request) (interfa
 		return nil, &errors.HTTPError{err, "Unknown RealmID", 400}
 	}
 
-	if err := h.db.RemoveAuthSession(body.RealmID, body.UserID); err != nil {
+	// Revoke the tokens upstream too where possible, so that they stop working even if leaked.
+	// Without a label, all of the user's sessions in the realm are removed.
+	var revoked bool
+	if body.Label != "" {
+		revoked, err = tokens.LogoutLabel(body.RealmID, body.UserID, body.Label)
+	} else {
+		revoked, err = tokens.Logout(body.RealmID, body.UserID)
+	}
+	if err != nil && err != sql.ErrNoRows {
 		return nil, &errors.HTTPError{err, "Failed to remove auth session", 500}
 	}
 
-	return []byte(`{}`), nil
+	return &struct {
+		RevokedUpstream bool
+	}{revoked}, nil
 }
 
 type realmRedirectHandler struct {
-	db *database.ServiceDB
+	db      *database.ServiceDB
+	clients *clients.Clients
 }
 
 func (rh *realmRedirectHandler) handle(w http.ResponseWriter, req *http.Request) {
@@ -121,7 +156,11 @@ func (rh *realmRedirectHandler) handle(w http.ResponseWriter, req *http.Request)
 	log.WithFields(log.Fields{
 		"realm_id": realmID,
 	}).Print("Incoming realm redirect request")
-	realm.OnReceiveRedirect(w, req)
+	rec := server.NewStatusRecorder(w)
+	realm.OnReceiveRedirect(rec, req)
+	if rec.Code < 400 {
+		rh.clients.OnAuthRedirect(realmID, req.URL.Query())
+	}
 }
 
 type configureAuthRealmHandler struct {
@@ -129,6 +168,9 @@ type configureAuthRealmHandler struct {
 }
 
 func (h *configureAuthRealmHandler) OnIncomingRequest(req *http.Request) (interface{}, *errors.HTTPError) {
+	if req.Method == "GET" {
+		return h.listRealms(req)
+	}
 	if req.Method != "POST" {
 		return nil, &errors.HTTPError{nil, "Unsupported Method", 405}
 	}
@@ -145,7 +187,12 @@ func (h *configureAuthRealmHandler) OnIncomingRequest(req *http.Request) (interf
 		return nil, &errors.HTTPError{nil, `Must supply a "ID", a "Type" and a "Config"`, 400}
 	}
 
-	realm, err := types.CreateAuthRealm(body.ID, body.Type, body.Config)
+	config, httpErr := unredactRealmConfig(h.db, body.ID, body.Type, body.Config)
+	if httpErr != nil {
+		return nil, httpErr
+	}
+
+	realm, err := types.CreateAuthRealm(body.ID, body.Type, config)
 	if err != nil {
 		return nil, &errors.HTTPError{err, "Error parsing config JSON", 400}
 	}
@@ -158,54 +205,213 @@ func (h *configureAuthRealmHandler) OnIncomingRequest(req *http.Request) (interf
 	if err != nil {
 		return nil, &errors.HTTPError{err, "Error storing realm", 500}
 	}
+	oldConfig, newConfig, httpErr := responseConfigs(req, oldRealm, realm)
+	if httpErr != nil {
+		return nil, httpErr
+	}
 
 	return &struct {
 		ID        string
 		Type      string
-		OldConfig types.AuthRealm
-		NewConfig types.AuthRealm
-	}{body.ID, body.Type, oldRealm, realm}, nil
+		OldConfig interface{}
+		NewConfig interface{}
+	}{body.ID, body.Type, oldConfig, newConfig}, nil
+}
+
+// unredactRealmConfig restores the secrets in a realm config which was shown redacted by GET
+// /admin/configureAuthRealm from the stored realm, if there is one of the same type, so that sending
+// it back keeps the stored secrets.
+func unredactRealmConfig(db *database.ServiceDB, realmID, realmType string, config json.RawMessage) (json.RawMessage, *errors.HTTPError) {
+	var stored types.AuthRealm
+	if old, err := db.LoadAuthRealm(realmID); err == nil && old.Type() == realmType {
+		stored = old
+	} else if err != nil && err != sql.ErrNoRows {
+		return nil, &errors.HTTPError{err, "Error loading realm", 500}
+	}
+	return unredactConfig(config, stored)
+}
+
+// listRealms returns every auth realm, or the one given by ?realm_id=, with secrets redacted as
+// listServices redacts them.
+func (h *configureAuthRealmHandler) listRealms(req *http.Request) (interface{}, *errors.HTTPError) {
+	var realms []types.AuthRealm
+	if realmID := req.URL.Query().Get("realm_id"); realmID != "" {
+		realm, err := h.db.LoadAuthRealm(realmID)
+		if err == sql.ErrNoRows {
+			return nil, &errors.HTTPError{err, "Realm not found", 404}
+		} else if err != nil {
+			return nil, &errors.HTTPError{err, "Failed to load realm", 500}
+		}
+		realms = append(realms, realm)
+	} else {
+		var err error
+		if realms, err = h.db.LoadAuthRealms(); err != nil {
+			return nil, &errors.HTTPError{err, "Failed to load realms", 500}
+		}
+	}
+	type realmSummary struct {
+		ID     string
+		Type   string
+		Config interface{} // with the values of secret-looking keys redacted, unless they are references
+	}
+	res := struct {
+		Realms []realmSummary
+	}{[]realmSummary{}}
+	for _, realm := range realms {
+		config, err := redactJSON(realm)
+		if err != nil {
+			return nil, &errors.HTTPError{err, "Failed to marshal realm", 500}
+		}
+		res.Realms = append(res.Realms, realmSummary{realm.ID(), realm.Type(), config})
+	}
+	return &res, nil
+}
+
+type reloadConfigHandler struct {
+	reconciler *configReconciler
+}
+
+func (h *reloadConfigHandler) OnIncomingRequest(req *http.Request) (interface{}, *errors.HTTPError) {
+	if req.Method != "POST" {
+		return nil, &errors.HTTPError{nil, "Unsupported Method", 405}
+	}
+	if h.reconciler.configFile == "" {
+		return nil, &errors.HTTPError{nil, "Go-NEB is not running with a CONFIG_FILE", 400}
+	}
+	changes, err := h.reconciler.reload()
+	if err != nil {
+		return nil, &errors.HTTPError{err, "Failed to reload config: " + err.Error(), 500}
+	}
+	return changes, nil
 }
 
 type webhookHandler struct {
 	db      *database.ServiceDB
 	clients *clients.Clients
+	// allowlist is the networks webhook requests for any service may come from.
+	allowlist *server.Allowlist
+	// checker checks services the first time they get a webhook, if STARTUP_CHECK is lazy.
+	checker *lazyChecker
 }
 
 func (wh *webhookHandler) handle(w http.ResponseWriter, req *http.Request) {
-	log.WithField("path", req.URL.Path).Print("Incoming webhook request")
-	segments := strings.Split(req.URL.Path, "/")
-	// last path segment is the service ID which we will pass the incoming request to,
-	// but we've base64d it.
-	base64srvID := segments[len(segments)-1]
-	bytesSrvID, err := base64.RawURLEncoding.DecodeString(base64srvID)
-	srvID := string(bytesSrvID)
-	if err != nil {
-		log.WithError(err).WithField("base64_service_id", base64srvID).Print(
-			"Not a b64 encoded string",
-		)
-		w.WriteHeader(400)
+	logger := server.RequestLogger(req)
+	logger.WithFields(log.Fields{
+		"path":        req.URL.Path,
+		"remote_addr": server.ClientIP(req),
+		"scheme":      server.Scheme(req),
+	}).Print("Incoming webhook request")
+	if !wh.allowlist.AllowsRequest(req) {
+		logger.WithField("remote_addr", server.ClientIP(req)).Print("Rejected webhook request from outside WEBHOOK_ALLOWED_IPS")
+		w.WriteHeader(403)
 		return
 	}
-
-	service, err := wh.db.LoadService(srvID)
-	if err != nil {
-		log.WithError(err).WithField("service_id", srvID).Print("Failed to load service")
-		w.WriteHeader(404)
+	service, code := wh.loadService(req, logger)
+	if code != 0 {
+		w.WriteHeader(code)
+		return
+	}
+	if !serviceAllowsRequest(service, req) {
+		logger.WithFields(log.Fields{
+			"service_id":  service.ServiceID(),
+			"remote_addr": server.ClientIP(req),
+		}).Print("Rejected webhook request from outside the service's AllowedIPs")
+		w.WriteHeader(403)
 		return
 	}
 	cli, err := wh.clients.Client(service.ServiceUserID())
 	if err != nil {
-		log.WithError(err).WithField("user_id", service.ServiceUserID()).Print(
+		logger.WithError(err).WithField("user_id", service.ServiceUserID()).Print(
 			"Failed to retrieve matrix client instance")
 		w.WriteHeader(500)
 		return
 	}
-	log.WithFields(log.Fields{
+	logger.WithFields(log.Fields{
 		"service_id":  service.ServiceID(),
 		"service_typ": service.ServiceType(),
 	}).Print("Incoming webhook for service")
-	service.OnReceiveWebhook(w, req, cli)
+	if wh.checker != nil {
+		wh.checker.used(service)
+	}
+	delivery, err := captureWebhook(req, service.ServiceID())
+	if err != nil {
+		logger.WithError(err).Print("Failed to read webhook request")
+		w.WriteHeader(400)
+		return
+	}
+	var failure string
+	delivery.ResponseCode, failure = runWebhook(service, w, req, cli)
+	wh.recordDelivery(service, delivery, failure, logger)
+}
+
+// loadService loads the service the webhook request is for, checking that it was sent to the
+// service's current endpoint URL. Returns the HTTP status code to respond with if it can't be
+// loaded, or 0.
+func (wh *webhookHandler) loadService(req *http.Request, logger *log.Entry) (types.Service, int) {
+	// The path is /services/hooks/<base64 service ID>, followed by /<webhook key> once the
+	// service's endpoint has been rotated.
+	segments := strings.SplitN(req.URL.Path[strings.Index(req.URL.Path, "/services/hooks/")+len("/services/hooks/"):], "/", 2)
+	base64srvID := segments[0]
+	var webhookKey string
+	if len(segments) > 1 {
+		webhookKey = segments[1]
+	}
+	bytesSrvID, err := base64.RawURLEncoding.DecodeString(base64srvID)
+	srvID := string(bytesSrvID)
+	if err != nil {
+		logger.WithError(err).WithField("base64_service_id", base64srvID).Print(
+			"Not a b64 encoded string",
+		)
+		return nil, 400
+	}
+
+	service, err := wh.db.LoadService(srvID)
+	if err != nil {
+		logger.WithError(err).WithField("service_id", srvID).Print("Failed to load service")
+		return nil, 404
+	}
+	wantKey, err := wh.db.LoadWebhookKey(srvID)
+	if err != nil {
+		logger.WithError(err).WithField("service_id", srvID).Print("Failed to load webhook key")
+		return nil, 500
+	}
+	if subtle.ConstantTimeCompare([]byte(webhookKey), []byte(wantKey)) != 1 {
+		// The URL was rotated away from: it's as if the service doesn't exist.
+		logger.WithField("service_id", srvID).Print("Rejected webhook request to an old endpoint URL")
+		return nil, 404
+	}
+	return service, 0
+}
+
+// recordDelivery stores the delivery of a webhook request to the service, dead-lettering it if it
+// failed, and alerts the operators if the service keeps rejecting requests.
+func (wh *webhookHandler) recordDelivery(service types.Service, delivery *types.WebhookDelivery, failure string, logger *log.Entry) {
+	if delivery.ResponseCode == 401 || delivery.ResponseCode == 403 {
+		ops.RepeatedFailure("webhook_rejected "+service.ServiceID(),
+			"Service %s (%s) keeps rejecting webhook requests with HTTP %d. Check the secret configured where they are sent from.",
+			service.ServiceID(), service.ServiceType(), delivery.ResponseCode)
+	}
+	if err := wh.db.StoreWebhookDelivery(*delivery, webhookDeliveriesPerService); err != nil {
+		logger.WithError(err).WithField("service_id", service.ServiceID()).Error("Failed to store webhook delivery")
+	}
+	if failure != "" {
+		storeDeadLetter(wh.db, *delivery, failure)
+	}
+}
+
+// serviceAllowsRequest returns true if the service allows webhook requests from the request's
+// client. Services whose allowlist doesn't parse allow nothing.
+func serviceAllowsRequest(service types.Service, req *http.Request) bool {
+	allowlister, ok := service.(types.WebhookAllowlister)
+	if !ok {
+		return true
+	}
+	allowlist, err := server.ParseAllowlist(allowlister.WebhookAllowedIPs())
+	if err != nil {
+		log.WithError(err).WithField("service_id", service.ServiceID()).Error("Failed to parse service's AllowedIPs")
+		return false
+	}
+	return allowlist.AllowsRequest(req)
 }
 
 type configureClientHandler struct {
@@ -226,6 +432,9 @@ func (s *configureClientHandler) OnIncomingRequest(req *http.Request) (interface
 	if err := body.Check(); err != nil {
 		return nil, &errors.HTTPError{err, "Error parsing client config", 400}
 	}
+	if httpErr := unredactAccessToken(s.db, &body); httpErr != nil {
+		return nil, httpErr
+	}
 
 	oldClient, err := s.clients.Update(body)
 	if err != nil {
@@ -238,11 +447,31 @@ func (s *configureClientHandler) OnIncomingRequest(req *http.Request) (interface
 	}{oldClient, body}, nil
 }
 
+// unredactAccessToken replaces a client's access token with the stored one if it is redacted, as
+// /admin/exportConfig shows it, so that an exported config can be applied again. Returns an HTTP 400
+// error if no token is stored for the client, so that "<redacted>" is never stored as a token.
+func unredactAccessToken(db *database.ServiceDB, client *types.ClientConfig) *errors.HTTPError {
+	if client.AccessToken != redacted {
+		return nil
+	}
+	stored, err := db.LoadMatrixClientConfig(client.UserID)
+	if err == sql.ErrNoRows {
+		return &errors.HTTPError{nil, "Nothing is stored to replace the " + redacted + " value of: AccessToken", 400}
+	} else if err != nil {
+		return &errors.HTTPError{err, "Error loading client", 500}
+	}
+	client.AccessToken = stored.AccessToken
+	return nil
+}
+
 type configureServiceHandler struct {
 	db               *database.ServiceDB
 	clients          *clients.Clients
 	mapMutex         sync.Mutex
 	mutexByServiceID map[string]*sync.Mutex
+	// storeMutex is held whilst storing services, as services are configured concurrently at
+	// startup and SQLite fails concurrent transactions which write rather than waiting for them.
+	storeMutex sync.Mutex
 }
 
 func newConfigureServiceHandler(db *database.ServiceDB, clients *clients.Clients) *configureServiceHandler {
@@ -268,6 +497,21 @@ func (s *configureServiceHandler) getMutexForServiceID(serviceID string) *sync.M
 }
 
 func (s *configureServiceHandler) OnIncomingRequest(req *http.Request) (interface{}, *errors.HTTPError) {
+	if req.Method == "GET" {
+		return s.listServices(req)
+	}
+	if req.Method == "DELETE" {
+		serviceID := req.URL.Query().Get("service_id")
+		if serviceID == "" {
+			return nil, &errors.HTTPError{nil, `Must supply a "service_id"`, 400}
+		}
+		log.WithField("service_id", serviceID).Print("Incoming delete service request")
+		deleted, httpErr := s.deleteService(serviceID, adminActor(req))
+		if httpErr != nil {
+			return nil, httpErr
+		}
+		return deleted, nil
+	}
 	if req.Method != "POST" {
 		return nil, &errors.HTTPError{nil, "Unsupported Method", 405}
 	}
@@ -282,6 +526,346 @@ func (s *configureServiceHandler) OnIncomingRequest(req *http.Request) (interfac
 		"service_user_id": service.ServiceUserID(),
 	}).Print("Incoming configure service request")
 
+	if req.URL.Query().Get("dry_run") == "true" {
+		oldService, plan, planErr := s.planService(service)
+		if planErr != nil {
+			return nil, planErr
+		}
+		oldConfig, newConfig, planErr := responseConfigs(req, oldService, service)
+		if planErr != nil {
+			return nil, planErr
+		}
+		return &struct {
+			ID        string
+			Type      string
+			OldConfig interface{}
+			NewConfig interface{}
+			Plan      *types.RegisterPlan
+		}{service.ServiceID(), service.ServiceType(), oldConfig, newConfig, plan}, nil
+	}
+
+	oldService, httpErr := s.configureService(service, adminActor(req))
+	if httpErr != nil {
+		return nil, httpErr
+	}
+	oldConfig, newConfig, httpErr := responseConfigs(req, oldService, service)
+	if httpErr != nil {
+		return nil, httpErr
+	}
+
+	return &struct {
+		ID        string
+		Type      string
+		OldConfig interface{}
+		NewConfig interface{}
+	}{service.ServiceID(), service.ServiceType(), oldConfig, newConfig}, nil
+}
+
+// responseConfigs returns the old and new config of a realm or service to respond with. They are
+// redacted as GET /admin/configureService redacts them if the request has ?redact=true, as the web
+// UI's requests do, so that the secrets they hold aren't sent back.
+func responseConfigs(req *http.Request, oldConfig, newConfig interface{}) (interface{}, interface{}, *errors.HTTPError) {
+	if req.URL.Query().Get("redact") != "true" {
+		return oldConfig, newConfig, nil
+	}
+	oldRedacted, err := redactJSON(oldConfig)
+	if err != nil {
+		return nil, nil, &errors.HTTPError{err, "Failed to marshal config", 500}
+	}
+	newRedacted, err := redactJSON(newConfig)
+	if err != nil {
+		return nil, nil, &errors.HTTPError{err, "Failed to marshal config", 500}
+	}
+	return oldRedacted, newRedacted, nil
+}
+
+// A serviceSummary describes a configured service, with its secrets redacted.
+type serviceSummary struct {
+	ID     string
+	Type   string
+	UserID string
+	Rooms  []string    // the rooms the service sends into, if its config lists them
+	Config interface{} // with the values of secret-looking keys redacted, unless they are references
+}
+
+// listServices returns every configured service, or the one given by ?service_id=, with secrets
+// redacted, so that what is configured can be checked without exposing them.
+func (s *configureServiceHandler) listServices(req *http.Request) (interface{}, *errors.HTTPError) {
+	var srvs []types.Service
+	if serviceID := req.URL.Query().Get("service_id"); serviceID != "" {
+		srv, err := s.db.LoadService(serviceID)
+		if err == sql.ErrNoRows {
+			return nil, &errors.HTTPError{err, "Service not found", 404}
+		} else if err != nil {
+			return nil, &errors.HTTPError{err, "Failed to load service", 500}
+		}
+		srvs = append(srvs, srv)
+	} else {
+		var err error
+		if srvs, err = s.db.LoadServices(); err != nil {
+			return nil, &errors.HTTPError{err, "Failed to load services", 500}
+		}
+	}
+	res := struct {
+		Services []serviceSummary
+	}{[]serviceSummary{}}
+	for _, srv := range srvs {
+		summary, err := summarizeService(srv)
+		if err != nil {
+			return nil, &errors.HTTPError{err, "Failed to marshal service", 500}
+		}
+		res.Services = append(res.Services, summary)
+	}
+	return &res, nil
+}
+
+func summarizeService(srv types.Service) (serviceSummary, error) {
+	summary := serviceSummary{ID: srv.ServiceID(), Type: srv.ServiceType(), UserID: srv.ServiceUserID(), Rooms: []string{}}
+	configJSON, err := json.Marshal(srv)
+	if err != nil {
+		return summary, err
+	}
+	var config map[string]interface{}
+	if err = json.Unmarshal(configJSON, &config); err != nil {
+		return summary, err
+	}
+	// Services which send into rooms list them in a top-level "Rooms": either room IDs, or a map
+	// of room IDs to what to send into each.
+	switch rooms := config["Rooms"].(type) {
+	case map[string]interface{}:
+		for roomID := range rooms {
+			summary.Rooms = append(summary.Rooms, roomID)
+		}
+	case []interface{}:
+		for _, roomID := range rooms {
+			if str, ok := roomID.(string); ok {
+				summary.Rooms = append(summary.Rooms, str)
+			}
+		}
+	}
+	sort.Strings(summary.Rooms)
+	summary.Config = redactConfig("", config)
+	return summary, nil
+}
+
+// redactConfig replaces the string values of secret-looking keys in a decoded JSON config, at any
+// depth, e.g. "SecretToken", "APIKey" and "IMAPPassword". Secret references such as
+// ${env:GITHUB_SECRET} are left alone, as they don't give the secret away.
+func redactConfig(key string, v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			v[k] = redactConfig(k, child)
+		}
+	case []interface{}:
+		for i, child := range v {
+			v[i] = redactConfig(key, child)
+		}
+	case string:
+		if v != "" && !strings.HasPrefix(v, "${") && isSecretKey(key) {
+			return redacted
+		}
+	}
+	return v
+}
+
+// isSecretKey returns true if redactConfig redacts the values of config keys with this name.
+func isSecretKey(key string) bool {
+	return isSecretName(key) || strings.HasSuffix(strings.ToLower(key), "key")
+}
+
+// redactJSON returns a realm or service config with its secrets redacted, as redactConfig does.
+func redactJSON(v interface{}) (interface{}, error) {
+	configJSON, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var config interface{}
+	if err = json.Unmarshal(configJSON, &config); err != nil {
+		return nil, err
+	}
+	return redactConfig("", config), nil
+}
+
+// redactedJSON marshals a realm or service config with its secrets redacted, as redactConfig does.
+func redactedJSON(v interface{}) (json.RawMessage, error) {
+	config, err := redactJSON(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(config)
+}
+
+// restoreRedacted replaces the redacted values in a decoded JSON config with the values in the
+// same place in the stored config, so that a config which was shown redacted can be edited and sent
+// back without its secrets. Returns the config, and the keys of any redacted values which have no
+// stored value to restore.
+func restoreRedacted(key string, v, stored interface{}) (interface{}, []string) {
+	var missing []string
+	switch v := v.(type) {
+	case map[string]interface{}:
+		storedMap, _ := stored.(map[string]interface{})
+		for k, child := range v {
+			var m []string
+			v[k], m = restoreRedacted(k, child, storedMap[k])
+			missing = append(missing, m...)
+		}
+	case []interface{}:
+		storedList, _ := stored.([]interface{})
+		for i, child := range v {
+			var storedChild interface{}
+			if i < len(storedList) {
+				storedChild = storedList[i]
+			}
+			var m []string
+			v[i], m = restoreRedacted(key, child, storedChild)
+			missing = append(missing, m...)
+		}
+	case string:
+		if v != redacted {
+			return v, nil
+		}
+		if s, ok := stored.(string); ok && s != redacted {
+			return s, nil
+		}
+		return v, []string{key}
+	}
+	return v, missing
+}
+
+// unredactConfig restores the redacted values in a realm or service config from the stored realm or
+// service, which is nil if there is none. Returns an HTTP 400 error if a redacted value can't be
+// restored, so that "<redacted>" is never stored as a secret.
+func unredactConfig(config json.RawMessage, stored interface{}) (json.RawMessage, *errors.HTTPError) {
+	var v interface{}
+	if err := json.Unmarshal(config, &v); err != nil {
+		return nil, &errors.HTTPError{err, "Error parsing config JSON", 400}
+	}
+	var storedConfig interface{}
+	if stored != nil {
+		storedJSON, err := json.Marshal(stored)
+		if err != nil {
+			return nil, &errors.HTTPError{err, "Failed to marshal stored config", 500}
+		}
+		if err = json.Unmarshal(storedJSON, &storedConfig); err != nil {
+			return nil, &errors.HTTPError{err, "Failed to marshal stored config", 500}
+		}
+	}
+	v, missing := restoreRedacted("", v, storedConfig)
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return nil, &errors.HTTPError{nil, "Nothing is stored to replace the " + redacted + " value of: " + strings.Join(missing, ", "), 400}
+	}
+	restored, err := json.Marshal(v)
+	if err != nil {
+		return nil, &errors.HTTPError{err, "Failed to marshal config", 500}
+	}
+	return restored, nil
+}
+
+// deletedService is what deleteService did.
+type deletedService struct {
+	ID       string
+	Type     string
+	Cleaned  []string
+	Problems []string
+}
+
+// deleteService removes what the service set up on remote systems, e.g. webhooks, deletes it, then
+// has its client leave the rooms the service sent into, unless another of the client's services
+// uses them. Failing to clean up doesn't stop the service being deleted: the failures are returned
+// as problems, along with what was cleaned up.
+func (s *configureServiceHandler) deleteService(serviceID, actor string) (*deletedService, *errors.HTTPError) {
+	mut := s.getMutexForServiceID(serviceID)
+	mut.Lock()
+	defer mut.Unlock()
+
+	srv, err := s.db.LoadService(serviceID)
+	if err == sql.ErrNoRows {
+		return nil, &errors.HTTPError{err, "Service not found", 404}
+	} else if err != nil {
+		return nil, &errors.HTTPError{err, "Failed to load service", 500}
+	}
+	summary, err := summarizeService(srv)
+	if err != nil {
+		return nil, &errors.HTTPError{err, "Failed to marshal service", 500}
+	}
+	logger := log.WithField("service_id", serviceID)
+	res := deletedService{serviceID, srv.ServiceType(), []string{}, []string{}}
+
+	client, clientErr := s.clients.Client(srv.ServiceUserID())
+	if clientErr != nil {
+		res.Problems = append(res.Problems, "No client for "+srv.ServiceUserID()+", so nothing was cleaned up: "+clientErr.Error())
+	} else {
+		res.deregister(srv, client, logger)
+	}
+
+	if err = s.db.DeleteService(serviceID, actor); err != nil {
+		return nil, &errors.HTTPError{err, "Failed to delete service", 500}
+	}
+	status.Remove(serviceID)
+	res.Cleaned = append(res.Cleaned, "Deleted service "+serviceID)
+	if clientErr == nil {
+		s.leaveUnusedRooms(client, summary.Rooms, &res, logger)
+	}
+	return &res, nil
+}
+
+// deregister removes what the service set up on remote systems, if it sets anything up, recording
+// what was removed and any failure.
+func (res *deletedService) deregister(srv types.Service, client *matrix.Client, logger *log.Entry) {
+	d, ok := srv.(types.Deregisterer)
+	if !ok {
+		return
+	}
+	removed, err := d.Deregister(client)
+	res.Cleaned = append(res.Cleaned, removed...)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to clean up after service")
+		res.Problems = append(res.Problems, err.Error())
+	}
+}
+
+// leaveUnusedRooms has the client leave each of the rooms a deleted service sent into, unless
+// another of the client's services uses it, recording the rooms left and any failures.
+func (s *configureServiceHandler) leaveUnusedRooms(client *matrix.Client, rooms []string, res *deletedService, logger *log.Entry) {
+	// Services which don't list rooms, e.g. those with commands, work in any room the client is in,
+	// so the client stays in every room if it has any.
+	others, err := s.db.LoadServicesForUser(client.UserID)
+	if err != nil {
+		res.Problems = append(res.Problems, "Failed to load the client's other services, so no rooms were left: "+err.Error())
+		return
+	}
+	used := make(map[string]bool)
+	for _, other := range others {
+		otherSummary, summaryErr := summarizeService(other)
+		if summaryErr != nil || len(otherSummary.Rooms) == 0 {
+			return
+		}
+		for _, roomID := range otherSummary.Rooms {
+			used[roomID] = true
+		}
+	}
+	for _, roomID := range rooms {
+		if used[roomID] {
+			continue
+		}
+		if err = client.LeaveRoom(roomID); err != nil {
+			logger.WithError(err).WithField("room_id", roomID).Warn("Failed to leave room")
+			res.Problems = append(res.Problems, "Failed to leave "+roomID+": "+err.Error())
+			continue
+		}
+		res.Cleaned = append(res.Cleaned, "Left room "+roomID)
+	}
+}
+
+// configureService registers and stores the given service, returning the service it replaced, if any.
+// The change is recorded in the service's history as made by the given actor.
+func (s *configureServiceHandler) configureService(service types.Service, actor string) (types.Service, *errors.HTTPError) {
+	if httpErr := validateService(service); httpErr != nil {
+		return nil, httpErr
+	}
+
 	// Have mutexes around each service to queue up multiple requests for the same service ID
 	mut := s.getMutexForServiceID(service.ServiceID())
 	mut.Lock()
@@ -298,22 +882,56 @@ func (s *configureServiceHandler) OnIncomingRequest(req *http.Request) (interfac
 	}
 
 	if err = service.Register(old, client); err != nil {
+		ops.Alert("Failed to register service %s (%s): %s", service.ServiceID(), service.ServiceType(), err)
 		return nil, &errors.HTTPError{err, "Failed to register service: " + err.Error(), 500}
 	}
 
-	oldService, err := s.db.StoreService(service)
+	s.storeMutex.Lock()
+	oldService, err := s.db.StoreService(service, actor)
+	s.storeMutex.Unlock()
 	if err != nil {
 		return nil, &errors.HTTPError{err, "Error storing service", 500}
 	}
 
 	service.PostRegister(old)
 
-	return &struct {
-		ID        string
-		Type      string
-		OldConfig types.Service
-		NewConfig types.Service
-	}{service.ServiceID(), service.ServiceType(), oldService, service}, nil
+	return oldService, nil
+}
+
+// planService validates the given service and works out what configuring it would do, without
+// doing it. Returns the service it would replace, if any, and the plan.
+func (s *configureServiceHandler) planService(service types.Service) (types.Service, *types.RegisterPlan, *errors.HTTPError) {
+	if httpErr := validateService(service); httpErr != nil {
+		return nil, nil, httpErr
+	}
+
+	mut := s.getMutexForServiceID(service.ServiceID())
+	mut.Lock()
+	defer mut.Unlock()
+
+	old, err := s.db.LoadService(service.ServiceID())
+	if err != nil && err != sql.ErrNoRows {
+		return nil, nil, &errors.HTTPError{err, "Error loading old service", 500}
+	}
+
+	// Register may take external actions, so it is never called to find out what it would do.
+	planner, ok := service.(types.RegisterPlanner)
+	if !ok {
+		return old, &types.RegisterPlan{
+			CannotPlan: true,
+			Notes:      []string{service.ServiceType() + " services can't work out what configuring them would do: only the config was validated"},
+		}, nil
+	}
+
+	client, err := s.clients.Client(service.ServiceUserID())
+	if err != nil {
+		return nil, nil, &errors.HTTPError{err, "Unknown matrix client", 400}
+	}
+	plan, err := planner.PlanRegister(old, client)
+	if err != nil {
+		return nil, nil, &errors.HTTPError{err, "Failed to register service: " + err.Error(), 500}
+	}
+	return old, plan, nil
 }
 
 func (s *configureServiceHandler) createService(req *http.Request) (types.Service, *errors.HTTPError) {
@@ -333,13 +951,236 @@ func (s *configureServiceHandler) createService(req *http.Request) (types.Servic
 		}
 	}
 
-	service, err := types.CreateService(body.ID, body.Type, body.UserID, body.Config)
+	config, httpErr := unredactServiceConfig(s.db, body.ID, body.Type, body.Config)
+	if httpErr != nil {
+		return nil, httpErr
+	}
+
+	webhookKey, err := s.db.LoadWebhookKey(body.ID)
+	if err != nil {
+		return nil, &errors.HTTPError{err, "Error loading webhook key", 500}
+	}
+	service, err := types.CreateService(body.ID, body.Type, body.UserID, webhookKey, config)
 	if err != nil {
 		return nil, &errors.HTTPError{err, "Error parsing config JSON", 400}
 	}
 	return service, nil
 }
 
+// unredactServiceConfig restores the secrets in a service config which was shown redacted by GET
+// /admin/configureService from the stored service, if there is one of the same type, so that sending
+// it back keeps the stored secrets.
+func unredactServiceConfig(db *database.ServiceDB, serviceID, serviceType string, config json.RawMessage) (json.RawMessage, *errors.HTTPError) {
+	var stored types.Service
+	if old, err := db.LoadService(serviceID); err == nil && old.ServiceType() == serviceType {
+		stored = old
+	} else if err != nil && err != sql.ErrNoRows {
+		return nil, &errors.HTTPError{err, "Error loading service", 500}
+	}
+	return unredactConfig(config, stored)
+}
+
+// validateService returns an HTTP 400 error listing the problems with the service's config, if
+// there are any.
+func validateService(service types.Service) *errors.HTTPError {
+	configErrs := service.ValidateConfig()
+	if len(configErrs) == 0 {
+		return nil
+	}
+	msgs := make([]string, len(configErrs))
+	for i, e := range configErrs {
+		msgs[i] = e.Error()
+	}
+	return &errors.HTTPError{nil, "Invalid config: " + strings.Join(msgs, "; "), 400}
+}
+
+// validateServiceHandler checks a service's config without registering it or making any external
+// calls. It accepts the same request as configureServiceHandler.
+type validateServiceHandler struct {
+	services *configureServiceHandler
+}
+
+func (h *validateServiceHandler) OnIncomingRequest(req *http.Request) (interface{}, *errors.HTTPError) {
+	if req.Method != "POST" {
+		return nil, &errors.HTTPError{nil, "Unsupported Method", 405}
+	}
+	service, httpErr := h.services.createService(req)
+	if httpErr != nil {
+		return nil, httpErr
+	}
+	configErrs := service.ValidateConfig()
+	if configErrs == nil {
+		configErrs = []types.ConfigError{}
+	}
+	return &struct {
+		ID     string
+		Type   string
+		Valid  bool
+		Errors []types.ConfigError
+	}{service.ServiceID(), service.ServiceType(), len(configErrs) == 0, configErrs}, nil
+}
+
+// rotateWebhookHandler moves a service's webhook endpoint to a new, random URL, so that requests
+// to the old URL are rejected, e.g. because it has leaked. Services which create webhooks on
+// remote systems move them to the new URL.
+type rotateWebhookHandler struct {
+	services *configureServiceHandler
+}
+
+func (h *rotateWebhookHandler) OnIncomingRequest(req *http.Request) (interface{}, *errors.HTTPError) {
+	if req.Method != "POST" {
+		return nil, &errors.HTTPError{nil, "Unsupported Method", 405}
+	}
+	var body struct {
+		ID string
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return nil, &errors.HTTPError{err, "Error parsing request JSON", 400}
+	}
+	if body.ID == "" {
+		return nil, &errors.HTTPError{nil, `Must supply a "ID"`, 400}
+	}
+	log.WithField("service_id", body.ID).Print("Incoming rotate webhook request")
+
+	webhookURL, httpErr := h.services.rotateWebhook(body.ID)
+	if httpErr != nil {
+		return nil, httpErr
+	}
+	return &struct {
+		ID         string
+		WebhookURL string
+	}{body.ID, webhookURL}, nil
+}
+
+// rotateWebhook gives the service a new webhook key, and returns its new endpoint URL. If the
+// service's remote webhooks can't be moved to the new URL, the key is left as it was.
+func (s *configureServiceHandler) rotateWebhook(serviceID string) (string, *errors.HTTPError) {
+	mut := s.getMutexForServiceID(serviceID)
+	mut.Lock()
+	defer mut.Unlock()
+
+	old, err := s.db.LoadService(serviceID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", &errors.HTTPError{err, `Service not found`, 404}
+		}
+		return "", &errors.HTTPError{err, `Failed to load service`, 500}
+	}
+	oldKey, err := s.db.LoadWebhookKey(serviceID)
+	if err != nil {
+		return "", &errors.HTTPError{err, "Failed to load webhook key", 500}
+	}
+	key := make([]byte, 24)
+	if _, err = rand.Read(key); err != nil {
+		return "", &errors.HTTPError{err, "Failed to generate webhook key", 500}
+	}
+	newKey := base64.RawURLEncoding.EncodeToString(key)
+	serviceJSON, err := json.Marshal(old)
+	if err != nil {
+		return "", &errors.HTTPError{err, "Failed to marshal service", 500}
+	}
+	service, err := types.CreateService(serviceID, old.ServiceType(), old.ServiceUserID(), newKey, serviceJSON)
+	if err != nil {
+		return "", &errors.HTTPError{err, "Failed to create service", 500}
+	}
+	oldURL := types.WebhookEndpointURL(serviceID, oldKey)
+	newURL := types.WebhookEndpointURL(serviceID, newKey)
+
+	if rotator, ok := service.(types.WebhookRotator); ok {
+		if err = rotator.RotateWebhook(oldURL); err != nil {
+			// Move back any webhooks which were moved, so that they all keep working.
+			if undoErr := old.(types.WebhookRotator).RotateWebhook(newURL); undoErr != nil {
+				log.WithError(undoErr).WithField("service_id", serviceID).Error("Failed to move webhooks back to the old endpoint URL")
+				ops.Alert("Failed to move the webhooks of service %s (%s) back to its endpoint URL after failing to rotate it: %s",
+					serviceID, old.ServiceType(), undoErr)
+			}
+			return "", &errors.HTTPError{err, "Failed to move webhooks to the new endpoint URL: " + err.Error(), 500}
+		}
+	}
+	if err = s.db.StoreWebhookKey(serviceID, newKey); err != nil {
+		return "", &errors.HTTPError{err, "Failed to store webhook key", 500}
+	}
+	log.WithField("service_id", serviceID).Info("Rotated webhook endpoint URL")
+	return newURL, nil
+}
+
+// rotateSecretHandler changes the secret a service's remote webhooks sign their requests with, in
+// place, e.g. because it has leaked. Requests signed with the old secret are accepted for a while.
+type rotateSecretHandler struct {
+	services *configureServiceHandler
+}
+
+func (h *rotateSecretHandler) OnIncomingRequest(req *http.Request) (interface{}, *errors.HTTPError) {
+	if req.Method != "POST" {
+		return nil, &errors.HTTPError{nil, "Unsupported Method", 405}
+	}
+	var body struct {
+		ID     string
+		Secret string
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return nil, &errors.HTTPError{err, "Error parsing request JSON", 400}
+	}
+	if body.ID == "" {
+		return nil, &errors.HTTPError{nil, `Must supply a "ID"`, 400}
+	}
+	log.WithField("service_id", body.ID).Print("Incoming rotate secret request")
+
+	if httpErr := h.services.rotateSecret(body.ID, body.Secret, adminActor(req)); httpErr != nil {
+		return nil, httpErr
+	}
+	return &struct {
+		ID string
+	}{body.ID}, nil
+}
+
+// rotateSecret changes the service's secret to the given one, or a random one if it is empty, and
+// stores the service, as changed by the given actor. If the service's remote webhooks can't be
+// changed, the secret is left as it was.
+func (s *configureServiceHandler) rotateSecret(serviceID, newSecret, actor string) *errors.HTTPError {
+	mut := s.getMutexForServiceID(serviceID)
+	mut.Lock()
+	defer mut.Unlock()
+
+	old, err := s.db.LoadService(serviceID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return &errors.HTTPError{err, `Service not found`, 404}
+		}
+		return &errors.HTTPError{err, `Failed to load service`, 500}
+	}
+	if _, ok := old.(types.SecretRotator); !ok {
+		return &errors.HTTPError{nil, "Services of type " + old.ServiceType() + " don't have a secret which can be rotated", 400}
+	}
+	if newSecret == "" {
+		secret := make([]byte, 24)
+		if _, err = rand.Read(secret); err != nil {
+			return &errors.HTTPError{err, "Failed to generate secret", 500}
+		}
+		newSecret = base64.RawURLEncoding.EncodeToString(secret)
+	}
+	key, err := s.db.LoadWebhookKey(serviceID)
+	if err != nil {
+		return &errors.HTTPError{err, "Failed to load webhook key", 500}
+	}
+	serviceJSON, err := json.Marshal(old)
+	if err != nil {
+		return &errors.HTTPError{err, "Failed to marshal service", 500}
+	}
+	service, err := types.CreateService(serviceID, old.ServiceType(), old.ServiceUserID(), key, serviceJSON)
+	if err != nil {
+		return &errors.HTTPError{err, "Failed to create service", 500}
+	}
+	if err = service.(types.SecretRotator).RotateSecret(newSecret); err != nil {
+		return &errors.HTTPError{err, "Failed to change the secret of the service's webhooks: " + err.Error(), 500}
+	}
+	if _, err = s.db.StoreService(service, actor); err != nil {
+		return &errors.HTTPError{err, "Failed to store service", 500}
+	}
+	log.WithField("service_id", serviceID).Info("Rotated webhook secret")
+	return nil
+}
+
 type getServiceHandler struct {
 	db *database.ServiceDB
 }
@@ -374,6 +1215,187 @@ func (h *getServiceHandler) OnIncomingRequest(req *http.Request) (interface{}, *
 	}{srv.ServiceID(), srv.ServiceType(), srv}, nil
 }
 
+// removeServiceHandler is the older way of deleting a service, kept for existing callers. It cleans
+// up after the service in the same way as DELETE /admin/configureService.
+type removeServiceHandler struct {
+	services *configureServiceHandler
+}
+
+func (h *removeServiceHandler) OnIncomingRequest(req *http.Request) (interface{}, *errors.HTTPError) {
+	if req.Method != "POST" {
+		return nil, &errors.HTTPError{nil, "Unsupported Method", 405}
+	}
+	var body struct {
+		ID string
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return nil, &errors.HTTPError{err, "Error parsing request JSON", 400}
+	}
+	log.WithField("service_id", body.ID).Print("Incoming remove service request")
+
+	if body.ID == "" {
+		return nil, &errors.HTTPError{nil, `Must supply a "ID"`, 400}
+	}
+
+	deleted, httpErr := h.services.deleteService(body.ID, adminActor(req))
+	if httpErr != nil {
+		return nil, httpErr
+	}
+	return deleted, nil
+}
+
+type removeAuthRealmHandler struct {
+	db *database.ServiceDB
+}
+
+func (h *removeAuthRealmHandler) OnIncomingRequest(req *http.Request) (interface{}, *errors.HTTPError) {
+	if req.Method != "POST" {
+		return nil, &errors.HTTPError{nil, "Unsupported Method", 405}
+	}
+	var body struct {
+		ID string
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return nil, &errors.HTTPError{err, "Error parsing request JSON", 400}
+	}
+	log.WithField("realm_id", body.ID).Print("Incoming remove auth realm request")
+
+	if body.ID == "" {
+		return nil, &errors.HTTPError{nil, `Must supply a "ID"`, 400}
+	}
+
+	if _, err := h.db.LoadAuthRealm(body.ID); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, &errors.HTTPError{err, `Realm not found`, 404}
+		}
+		return nil, &errors.HTTPError{err, `Failed to load realm`, 500}
+	}
+
+	if err := h.db.DeleteAuthRealm(body.ID); err != nil {
+		return nil, &errors.HTTPError{err, "Failed to remove auth realm", 500}
+	}
+
+	return []byte(`{}`), nil
+}
+
+// exportConfigHandler returns every client, realm and service in the config file format, with
+// client access tokens and realm and service secrets redacted. Auth sessions are not exported as
+// they belong to individual users.
+type exportConfigHandler struct {
+	db *database.ServiceDB
+}
+
+func (h *exportConfigHandler) OnIncomingRequest(req *http.Request) (interface{}, *errors.HTTPError) {
+	if req.Method != "GET" {
+		return nil, &errors.HTTPError{nil, "Unsupported Method", 405}
+	}
+	var cfg config.Config
+	clients, err := h.db.LoadMatrixClientConfigs()
+	if err != nil {
+		return nil, &errors.HTTPError{err, "Failed to load clients", 500}
+	}
+	for _, client := range clients {
+		if client.AccessToken != "" {
+			client.AccessToken = redacted
+		}
+		cfg.Clients = append(cfg.Clients, client)
+	}
+
+	realms, err := h.db.LoadAuthRealms()
+	if err != nil {
+		return nil, &errors.HTTPError{err, "Failed to load realms", 500}
+	}
+	for _, r := range realms {
+		realmJSON, jsonErr := redactedJSON(r)
+		if jsonErr != nil {
+			return nil, &errors.HTTPError{jsonErr, "Failed to serialise realm", 500}
+		}
+		cfg.Realms = append(cfg.Realms, config.Realm{ID: r.ID(), Type: r.Type(), Config: realmJSON})
+	}
+
+	services, err := h.db.LoadServices()
+	if err != nil {
+		return nil, &errors.HTTPError{err, "Failed to load services", 500}
+	}
+	for _, srv := range services {
+		serviceJSON, jsonErr := redactedJSON(srv)
+		if jsonErr != nil {
+			return nil, &errors.HTTPError{jsonErr, "Failed to serialise service", 500}
+		}
+		cfg.Services = append(cfg.Services, config.Service{
+			ID: srv.ServiceID(), Type: srv.ServiceType(), UserID: srv.ServiceUserID(), Config: serviceJSON,
+		})
+	}
+	return &cfg, nil
+}
+
+type listRoomsHandler struct {
+	db      *database.ServiceDB
+	clients *clients.Clients
+}
+
+func (h *listRoomsHandler) OnIncomingRequest(req *http.Request) (interface{}, *errors.HTTPError) {
+	if req.Method != "GET" {
+		return nil, &errors.HTTPError{nil, "Unsupported Method", 405}
+	}
+	configs, err := h.db.LoadMatrixClientConfigs()
+	if err != nil {
+		return nil, &errors.HTTPError{err, "Failed to load clients", 500}
+	}
+	type clientRooms struct {
+		UserID string
+		Rooms  []string
+		Error  string `json:",omitempty"` // set if the rooms could not be fetched from the homeserver
+	}
+	res := struct {
+		Clients []clientRooms
+	}{[]clientRooms{}}
+	for _, cfg := range configs {
+		cr := clientRooms{UserID: cfg.UserID, Rooms: []string{}}
+		cli, cliErr := h.clients.Client(cfg.UserID)
+		if cliErr != nil {
+			cr.Error = cliErr.Error()
+		} else if rooms, roomsErr := cli.JoinedRooms(); roomsErr != nil {
+			// The error may contain the request URL, which includes the access token.
+			log.WithError(roomsErr).WithField("user_id", cfg.UserID).Warn("Failed to fetch joined rooms")
+			cr.Error = "Failed to fetch joined rooms from the homeserver"
+		} else {
+			cr.Rooms = rooms
+		}
+		res.Clients = append(res.Clients, cr)
+	}
+	return &res, nil
+}
+
+type serviceStatusHandler struct {
+	db *database.ServiceDB
+}
+
+func (h *serviceStatusHandler) OnIncomingRequest(req *http.Request) (interface{}, *errors.HTTPError) {
+	if req.Method != "GET" {
+		return nil, &errors.HTTPError{nil, "Unsupported Method", 405}
+	}
+	services, err := h.db.LoadServices()
+	if err != nil {
+		return nil, &errors.HTTPError{err, "Failed to load services", 500}
+	}
+	type serviceStatus struct {
+		ID     string
+		Type   string
+		UserID string
+		status.ServiceStatus
+	}
+	res := struct {
+		Services []serviceStatus
+	}{[]serviceStatus{}}
+	for _, srv := range services {
+		res.Services = append(res.Services, serviceStatus{
+			srv.ServiceID(), srv.ServiceType(), srv.ServiceUserID(), status.Get(srv.ServiceID()),
+		})
+	}
+	return &res, nil
+}
+
 type getSessionHandler struct {
 	db *database.ServiceDB
 }
@@ -385,6 +1407,7 @@ func (h *getSessionHandler) OnIncomingRequest(req *http.Request) (interface{}, *
 	var body struct {
 		RealmID string
 		UserID  string
+		Label   string
 	}
 	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
 		return nil, &errors.HTTPError{err, "Error parsing request JSON", 400}
@@ -394,7 +1417,7 @@ func (h *getSessionHandler) OnIncomingRequest(req *http.Request) (interface{}, *
 		return nil, &errors.HTTPError{nil, `Must supply a "RealmID" and "UserID"`, 400}
 	}
 
-	session, err := h.db.LoadAuthSessionByUser(body.RealmID, body.UserID)
+	session, err := h.db.LoadAuthSessionByLabel(body.RealmID, body.UserID, body.Label)
 	if err != nil && err != sql.ErrNoRows {
 		return nil, &errors.HTTPError{err, `Failed to load session`, 500}
 	}
@@ -408,5 +1431,32 @@ func (h *getSessionHandler) OnIncomingRequest(req *http.Request) (interface{}, *
 		ID            string
 		Authenticated bool
 		Info          interface{}
-	}{session.ID(), session.Authenticated(), session.Info()}, nil
+		Problem       *tokens.Problem `json:",omitempty"`
+	}{session.ID(), session.Authenticated(), session.Info(), tokens.SessionProblem(session)}, nil
+}
+
+// rekeyDatabaseHandler encrypts the secrets in the database with a new data key, e.g. because the
+// old one may have leaked, or to encrypt those stored before DATABASE_ENCRYPTION_KEY was set.
+type rekeyDatabaseHandler struct {
+	db *database.ServiceDB
+}
+
+func (h *rekeyDatabaseHandler) OnIncomingRequest(req *http.Request) (interface{}, *errors.HTTPError) {
+	if req.Method != "POST" {
+		return nil, &errors.HTTPError{nil, "Unsupported Method", 405}
+	}
+	log.Print("Incoming rekey database request")
+	result, err := h.db.Rekey()
+	if err == database.ErrNoEncryptionKey {
+		return nil, &errors.HTTPError{err, "Set DATABASE_ENCRYPTION_KEY to encrypt the database", 400}
+	}
+	if err != nil {
+		return nil, &errors.HTTPError{err, "Failed to rekey database: " + err.Error(), 500}
+	}
+	log.WithFields(log.Fields{
+		"key_id":      result.KeyID,
+		"reencrypted": result.Reencrypted,
+		"removed":     result.Removed,
+	}).Info("Rekeyed database")
+	return &result, nil
 }
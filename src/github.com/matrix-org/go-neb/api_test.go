@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/matrix-org/go-neb/config"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/types"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func openTestDatabase(t *testing.T) *database.ServiceDB {
+	db, err := database.Open("sqlite3", filepath.Join(t.TempDir(), "go-neb.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestExportConfigRedactsAccessTokens(t *testing.T) {
+	db := openTestDatabase(t)
+	client := types.ClientConfig{UserID: "@neb:localhost", HomeserverURL: "http://localhost:8008", AccessToken: "s3cret"}
+	if _, err := db.StoreMatrixClientConfig(client); err != nil {
+		t.Fatal(err)
+	}
+	h := &exportConfigHandler{db: db}
+	res, httpErr := h.OnIncomingRequest(httptest.NewRequest("GET", "/admin/exportConfig", nil))
+	if httpErr != nil {
+		t.Fatal(httpErr)
+	}
+	cfg := res.(*config.Config)
+	if len(cfg.Clients) != 1 || cfg.Clients[0].AccessToken != redacted {
+		t.Errorf("exportConfig => want AccessToken %s got %+v", redacted, cfg.Clients)
+	}
+
+	exported := cfg.Clients[0]
+	if httpErr = unredactAccessToken(db, &exported); httpErr != nil {
+		t.Fatal(httpErr)
+	}
+	if exported.AccessToken != client.AccessToken {
+		t.Errorf("unredactAccessToken(%s) => want %q got %q", client.UserID, client.AccessToken, exported.AccessToken)
+	}
+	unknown := types.ClientConfig{UserID: "@other:localhost", AccessToken: redacted}
+	if httpErr = unredactAccessToken(db, &unknown); httpErr == nil || httpErr.Code != 400 {
+		t.Errorf("unredactAccessToken(%s) => want 400 got %v", unknown.UserID, httpErr)
+	}
+}
+
+func TestPlanServiceNeverRegisters(t *testing.T) {
+	db := openTestDatabase(t)
+	service, err := types.CreateService("echoservice", "echo", "@neb:localhost", "", []byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without clients, planning would fail if it got as far as Register.
+	h := newConfigureServiceHandler(db, nil)
+	_, plan, httpErr := h.planService(service)
+	if httpErr != nil {
+		t.Fatalf("planService(echo) => %s", httpErr)
+	}
+	if !plan.CannotPlan || len(plan.Notes) != 1 {
+		t.Errorf("planService(echo) => want CannotPlan with a note, got %+v", plan)
+	}
+}
+
+// decodeConfig decodes the JSON config of a realm or service, failing the test if it is malformed.
+func decodeConfig(t *testing.T, raw json.RawMessage) map[string]interface{} {
+	var cfg map[string]interface{}
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// storeTestRealmAndService stores a Github realm and a webhook service, both with secrets.
+func storeTestRealmAndService(t *testing.T, db *database.ServiceDB) {
+	realm, err := types.CreateAuthRealm("githubrealm", "github", []byte(`{"ClientSecret":"s3cret","ClientID":"${env:NEB_TEST_CLIENT_ID}"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.StoreAuthRealm(realm); err != nil {
+		t.Fatal(err)
+	}
+	service, err := types.CreateService("webhookservice", "webhook", "@neb:localhost", "", []byte(`{"Token":"s3cret"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.StoreService(service, "test"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExportConfigRedactsSecrets(t *testing.T) {
+	db := openTestDatabase(t)
+	t.Setenv("NEB_TEST_CLIENT_ID", "client-id")
+	storeTestRealmAndService(t, db)
+
+	h := &exportConfigHandler{db: db}
+	res, httpErr := h.OnIncomingRequest(httptest.NewRequest("GET", "/admin/exportConfig", nil))
+	if httpErr != nil {
+		t.Fatal(httpErr)
+	}
+	cfg := res.(*config.Config)
+	if len(cfg.Realms) != 1 || len(cfg.Services) != 1 {
+		t.Fatalf("exportConfig => want 1 realm and 1 service, got %d and %d", len(cfg.Realms), len(cfg.Services))
+	}
+	realmConfig := decodeConfig(t, cfg.Realms[0].Config)
+	if realmConfig["ClientSecret"] != redacted || realmConfig["ClientID"] != "${env:NEB_TEST_CLIENT_ID}" {
+		t.Errorf("exportConfig => want ClientSecret redacted and ClientID a reference, got %v", realmConfig)
+	}
+	if serviceConfig := decodeConfig(t, cfg.Services[0].Config); serviceConfig["Token"] != redacted {
+		t.Errorf("exportConfig => want Token redacted, got %v", serviceConfig)
+	}
+
+	unredacted, httpErr := unredactRealmConfig(db, "githubrealm", "github", cfg.Realms[0].Config)
+	if httpErr != nil {
+		t.Fatal(httpErr)
+	}
+	if realmConfig = decodeConfig(t, unredacted); realmConfig["ClientSecret"] != "s3cret" {
+		t.Errorf("unredactRealmConfig => want ClientSecret restored, got %v", realmConfig)
+	}
+}
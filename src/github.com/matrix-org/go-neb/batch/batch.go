@@ -0,0 +1,292 @@
+// Package batch holds back the messages services send about the same thing for a while, so that
+// a burst of webhook events, e.g. a pull request being pushed to and commented on several times,
+// is sent into a room as one message rather than a stream of near duplicates.
+package batch
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/status"
+	"html"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MaxWindow is the longest window a service may hold messages back for.
+const MaxWindow = 10 * time.Minute
+
+// maxMessages is the most messages a batch shows. Earlier ones are left out.
+const maxMessages = 20
+
+// maxConcurrentSends is the most messages SendAll sends at once.
+const maxConcurrentSends = 8
+
+// DefaultOverloadThreshold is how many messages may be being sent at once before the homeserver is
+// treated as overloaded, unless SetOverloadThreshold is called.
+const DefaultOverloadThreshold = 64
+
+// overloadWindow is how long messages are held back for whilst overloaded, so that each service
+// sends at most one message per room and key in that time.
+const overloadWindow = 30 * time.Second
+
+// A Message is a message for SendAll to send into a room.
+type Message struct {
+	RoomID  string
+	Key     string
+	Content interface{}
+}
+
+type batch struct {
+	cli       *matrix.Client
+	serviceID string
+	roomID    string
+	contents  []interface{}
+	dropped   int // the number of earlier messages left out
+	timer     *time.Timer
+}
+
+var (
+	mu      sync.Mutex
+	pending = make(map[string]*batch) // service ID, room ID and key => batch
+
+	overloadThreshold int64 = DefaultOverloadThreshold
+	// Updated atomically.
+	inFlight  int64 // messages being sent
+	coalesced int64 // messages held back because of overload
+	shed      int64 // messages dropped because of overload
+)
+
+// Stats are counts of what the overload policy has done, for metrics.
+type Stats struct {
+	InFlight  int64 // Messages being sent now.
+	Coalesced int64 // Messages held back to be sent with others because the homeserver was overloaded.
+	Shed      int64 // Messages dropped because the homeserver was very overloaded.
+	Queued    int64 // Messages waiting to be sent again because sending them failed.
+}
+
+// GetStats returns the current counts.
+func GetStats() Stats {
+	return Stats{
+		InFlight:  atomic.LoadInt64(&inFlight),
+		Coalesced: atomic.LoadInt64(&coalesced),
+		Shed:      atomic.LoadInt64(&shed),
+		Queued:    atomic.LoadInt64(&queued),
+	}
+}
+
+// SetOverloadThreshold sets how many messages may be being sent at once before the homeserver is
+// treated as overloaded. Whilst it is, messages are held back for at least 30s and merged with
+// others about the same thing, and once twice as many are being sent, further messages are
+// dropped. 0 turns this off. Responses to commands aren't sent through this package, so are never
+// held back or dropped.
+func SetOverloadThreshold(n int) {
+	atomic.StoreInt64(&overloadThreshold, int64(n))
+}
+
+// overloaded returns how overloaded sending is: 0 if it isn't, 1 if messages should be held back
+// and 2 if they should be dropped.
+func overloaded() int {
+	threshold := atomic.LoadInt64(&overloadThreshold)
+	n := atomic.LoadInt64(&inFlight)
+	switch {
+	case threshold <= 0 || n < threshold:
+		return 0
+	case n < 2*threshold:
+		return 1
+	}
+	return 2
+}
+
+// send sends the content into the room for the services, counting it as in flight whilst it is
+// sent. If the room has messages queued to be sent again, or sending fails in a way which may work
+// later, the message is queued instead: see StartRetrying.
+func send(cli *matrix.Client, roomID string, content interface{}, serviceIDs ...string) error {
+	if queued, err := queueIfWaiting(cli, roomID, content, serviceIDs); queued || err != nil {
+		return err
+	}
+	atomic.AddInt64(&inFlight, 1)
+	_, err := cli.SendMessageEvent(roomID, "m.room.message", content)
+	atomic.AddInt64(&inFlight, -1)
+	if err != nil && queueFailed(cli, roomID, content, serviceIDs, err) {
+		return nil
+	}
+	return err
+}
+
+// ParseWindow parses a service's batching window, e.g. "30s". An empty window is 0, which means
+// messages are not held back.
+func ParseWindow(window string) (time.Duration, error) {
+	if window == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(window)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 || d > MaxWindow {
+		return 0, fmt.Errorf("must be between 0s and %s", MaxWindow)
+	}
+	return d, nil
+}
+
+// Send sends a message into the room for the service. If the window and key are set, the message
+// is held back until the window has passed since the first message with the same key, then sent
+// as one message along with the others. The content must be a matrix.HTMLMessage or a
+// matrix.TextMessage. Whether sending succeeds is recorded in the service's status when the
+// message is sent, but only returned if it is sent straight away: failures to send held back
+// messages are logged.
+//
+// If the homeserver is overloaded (see SetOverloadThreshold), the message is held back as if the
+// window were at least 30s, or dropped if it is very overloaded.
+func Send(cli *matrix.Client, serviceID, roomID, key string, window time.Duration, content interface{}) error {
+	switch overloaded() {
+	case 1:
+		if window < overloadWindow || key == "" {
+			atomic.AddInt64(&coalesced, 1)
+		}
+		if window < overloadWindow {
+			window = overloadWindow
+		}
+		if key == "" {
+			// Messages about different things are merged rather than not held back at all.
+			key = "\x00overload"
+		}
+	case 2:
+		atomic.AddInt64(&shed, 1)
+		log.WithFields(log.Fields{
+			"service_id": serviceID,
+			"room_id":    roomID,
+		}).Warn("Dropping message: too many messages are being sent")
+		return nil
+	}
+	if window <= 0 || key == "" {
+		err := send(cli, roomID, content, serviceID)
+		status.SendResult(serviceID, err)
+		return err
+	}
+	k := serviceID + "\x00" + roomID + "\x00" + key
+	mu.Lock()
+	defer mu.Unlock()
+	b := pending[k]
+	if b == nil {
+		b = &batch{cli: cli, serviceID: serviceID, roomID: roomID}
+		b.timer = time.AfterFunc(window, func() { flush(k) })
+		pending[k] = b
+	}
+	b.contents = append(b.contents, content)
+	if len(b.contents) > maxMessages {
+		b.contents = b.contents[1:]
+		b.dropped++
+	}
+	return nil
+}
+
+// SendAll sends each of the messages as Send does, several at once, so that a notification for
+// many rooms takes about as long as sending into the slowest of them rather than into each in
+// turn. Returns the error for each room which sending into failed, or nil if none did.
+func SendAll(cli *matrix.Client, serviceID string, window time.Duration, msgs []Message) map[string]error {
+	var (
+		wg     sync.WaitGroup
+		errsMu sync.Mutex
+		errs   map[string]error
+	)
+	sem := make(chan struct{}, maxConcurrentSends)
+	for _, m := range msgs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(m Message) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := Send(cli, serviceID, m.RoomID, m.Key, window, m.Content); err != nil {
+				errsMu.Lock()
+				if errs == nil {
+					errs = make(map[string]error)
+				}
+				errs[m.RoomID] = err
+				errsMu.Unlock()
+			}
+		}(m)
+	}
+	wg.Wait()
+	return errs
+}
+
+// Flush sends every held back message, digest and tally now, e.g. because Go-NEB is shutting down.
+func Flush() {
+	flushDigests()
+	flushTallies()
+	mu.Lock()
+	var keys []string
+	for k, b := range pending {
+		if b.timer.Stop() {
+			keys = append(keys, k)
+		}
+	}
+	mu.Unlock()
+	for _, k := range keys {
+		flush(k)
+	}
+}
+
+func flush(k string) {
+	mu.Lock()
+	b := pending[k]
+	delete(pending, k)
+	mu.Unlock()
+	if b == nil {
+		return
+	}
+	err := send(b.cli, b.roomID, merge(b.contents, b.dropped), b.serviceID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			log.ErrorKey: err,
+			"service_id": b.serviceID,
+			"room_id":    b.roomID,
+		}).Warn("Failed to send batched messages into room")
+	}
+	status.SendResult(b.serviceID, err)
+}
+
+// merge returns a single message with the lines of each of the contents, leaving out repeats of
+// the line before. A lone message is returned as it is.
+func merge(contents []interface{}, dropped int) interface{} {
+	if len(contents) == 1 && dropped == 0 {
+		return contents[0]
+	}
+	var msgType string
+	var bodies, htmls []string
+	if dropped > 0 {
+		bodies = append(bodies, fmt.Sprintf("(%d earlier updates)", dropped))
+		htmls = append(htmls, html.EscapeString(bodies[0]))
+	}
+	lastBody := ""
+	for _, content := range contents {
+		var body, htmlBody string
+		switch msg := content.(type) {
+		case matrix.HTMLMessage:
+			msgType, body, htmlBody = msg.MsgType, msg.Body, msg.FormattedBody
+		case matrix.TextMessage:
+			msgType, body = msg.MsgType, msg.Body
+			htmlBody = strings.Replace(html.EscapeString(msg.Body), "\n", "<br>", -1)
+		default:
+			continue
+		}
+		if body == lastBody {
+			continue
+		}
+		lastBody = body
+		bodies = append(bodies, body)
+		htmls = append(htmls, htmlBody)
+	}
+	return matrix.HTMLMessage{
+		Body:          strings.Join(bodies, "\n"),
+		MsgType:       msgType,
+		Format:        "org.matrix.custom.html",
+		FormattedBody: strings.Join(htmls, "<br>"),
+	}
+}
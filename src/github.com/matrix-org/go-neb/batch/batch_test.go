@@ -0,0 +1,312 @@
+package batch
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/matrix-org/go-neb/errors"
+	"github.com/matrix-org/go-neb/matrix"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var mergetests = []struct {
+	name     string
+	contents []interface{}
+	dropped  int
+	want     interface{}
+}{
+	{"lone message", []interface{}{matrix.TextMessage{"m.notice", "one"}}, 0, matrix.TextMessage{"m.notice", "one"}},
+	{"html", []interface{}{
+		matrix.GetHTMLMessage("m.notice", "<b>one</b>"),
+		matrix.GetHTMLMessage("m.notice", "<b>two</b>"),
+	}, 0, matrix.HTMLMessage{"one\ntwo", "m.notice", "org.matrix.custom.html", "<b>one</b><br><b>two</b>"}},
+	{"text is escaped", []interface{}{
+		matrix.TextMessage{"m.text", "a < b"},
+		matrix.TextMessage{"m.text", "c\nd"},
+	}, 0, matrix.HTMLMessage{"a < b\nc\nd", "m.text", "org.matrix.custom.html", "a &lt; b<br>c<br>d"}},
+	{"repeats", []interface{}{
+		matrix.TextMessage{"m.notice", "firing"},
+		matrix.TextMessage{"m.notice", "firing"},
+		matrix.TextMessage{"m.notice", "resolved"},
+	}, 0, matrix.HTMLMessage{"firing\nresolved", "m.notice", "org.matrix.custom.html", "firing<br>resolved"}},
+	{"dropped", []interface{}{
+		matrix.TextMessage{"m.notice", "last"},
+	}, 3, matrix.HTMLMessage{"(3 earlier updates)\nlast", "m.notice", "org.matrix.custom.html", "(3 earlier updates)<br>last"}},
+}
+
+func TestMerge(t *testing.T) {
+	for _, test := range mergetests {
+		if got := merge(test.contents, test.dropped); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: merge => want %#v got %#v", test.name, test.want, got)
+		}
+	}
+}
+
+func TestParseWindow(t *testing.T) {
+	for window, want := range map[string]time.Duration{"": 0, "30s": 30 * time.Second, "10m": MaxWindow} {
+		if got, err := ParseWindow(window); err != nil || got != want {
+			t.Errorf("ParseWindow(%q) => want %s got %s, %v", window, want, got, err)
+		}
+	}
+	for _, window := range []string{"soon", "-1s", "11m"} {
+		if _, err := ParseWindow(window); err == nil {
+			t.Errorf("ParseWindow(%q) => want error", window)
+		}
+	}
+}
+
+func TestSendAll(t *testing.T) {
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		if strings.Contains(req.URL.Path, "!bad:x") {
+			w.WriteHeader(403)
+			w.Write([]byte(`{"errcode":"M_FORBIDDEN","error":"not in room"}`))
+			return
+		}
+		w.Write([]byte(`{"event_id":"$1"}`))
+	}))
+	defer hs.Close()
+	hsURL, _ := url.Parse(hs.URL)
+	cli := matrix.NewClient(hsURL, "token", "@bot:x")
+
+	msgs := []Message{{"!bad:x", "", matrix.TextMessage{"m.notice", "hi"}}}
+	for i := 0; i < maxConcurrentSends-1; i++ {
+		msgs = append(msgs, Message{"!ok:x", "", matrix.TextMessage{"m.notice", "hi"}})
+	}
+	start := time.Now()
+	errs := SendAll(cli, "svc", 0, msgs)
+	if took := time.Since(start); took > 300*time.Millisecond {
+		t.Errorf("SendAll took %s: want the sends to happen at once", took)
+	}
+	if len(errs) != 1 || errs["!bad:x"] == nil {
+		t.Errorf("SendAll => want an error for !bad:x only, got %v", errs)
+	}
+}
+
+func TestOverload(t *testing.T) {
+	release := make(chan struct{})
+	var (
+		sentMu sync.Mutex
+		sent   []string
+	)
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.Contains(req.URL.Path, "!slow:x") {
+			<-release
+		} else {
+			sentMu.Lock()
+			sent = append(sent, req.URL.Path)
+			sentMu.Unlock()
+		}
+		w.Write([]byte(`{"event_id":"$1"}`))
+	}))
+	defer hs.Close()
+	hsURL, _ := url.Parse(hs.URL)
+	cli := matrix.NewClient(hsURL, "token", "@bot:x")
+	SetOverloadThreshold(2)
+	defer SetOverloadThreshold(DefaultOverloadThreshold)
+	before := GetStats()
+	sentCount := func() int {
+		sentMu.Lock()
+		defer sentMu.Unlock()
+		return len(sent)
+	}
+
+	var wg sync.WaitGroup
+	stick := func(n int64) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			send(cli, "!slow:x", matrix.TextMessage{"m.notice", "stuck"})
+		}()
+		for GetStats().InFlight < n {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	defer wg.Wait()
+	defer close(release)
+
+	// Two sends waiting on the homeserver: overloaded.
+	stick(1)
+	stick(2)
+	Send(cli, "svc", "!ok:x", "", 0, matrix.TextMessage{"m.notice", "one"})
+	Send(cli, "svc", "!ok:x", "", 0, matrix.TextMessage{"m.notice", "two"})
+	if n := sentCount(); n != 0 {
+		t.Errorf("Send whilst overloaded => want messages held back, but %d were sent", n)
+	}
+	if got := GetStats().Coalesced - before.Coalesced; got != 2 {
+		t.Errorf("Coalesced => want 2, got %d", got)
+	}
+
+	// Four: very overloaded.
+	stick(3)
+	stick(4)
+	Send(cli, "svc", "!ok:x", "", 0, matrix.TextMessage{"m.notice", "three"})
+	if got := GetStats().Shed - before.Shed; got != 1 {
+		t.Errorf("Shed => want 1, got %d", got)
+	}
+
+	// The held back messages are sent as one.
+	Flush()
+	if n := sentCount(); n != 1 {
+		t.Errorf("Flush => want the held back messages sent as one, got %d messages", n)
+	}
+}
+
+func TestParseDigestWindow(t *testing.T) {
+	for window, want := range map[string]time.Duration{"": 0, "5m": 5 * time.Minute, "1h": MaxDigestWindow} {
+		if got, err := ParseDigestWindow(window); err != nil || got != want {
+			t.Errorf("ParseDigestWindow(%q) => want %s got %s, %v", window, want, got, err)
+		}
+	}
+	for _, window := range []string{"soon", "-1s", "61m"} {
+		if _, err := ParseDigestWindow(window); err == nil {
+			t.Errorf("ParseDigestWindow(%q) => want error", window)
+		}
+	}
+}
+
+func TestDigestMessage(t *testing.T) {
+	one := matrix.TextMessage{"m.notice", "one"}
+	if got := digestMessage([]interface{}{one}, 0); !reflect.DeepEqual(got, one) {
+		t.Errorf("digestMessage of a lone message => want it as it is, got %#v", got)
+	}
+	got := digestMessage([]interface{}{one, matrix.GetHTMLMessage("m.notice", "<b>two</b>")}, 1)
+	want := matrix.HTMLMessage{
+		"Digest of 3 notifications\n(1 earlier updates)\none\ntwo", "m.notice", "org.matrix.custom.html",
+		"<b>Digest of 3 notifications</b><br>(1 earlier updates)<br>one<br><b>two</b>",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("digestMessage => want %#v got %#v", want, got)
+	}
+}
+
+func TestDigest(t *testing.T) {
+	sent := make(chan string, 10)
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var msg matrix.HTMLMessage
+		json.NewDecoder(req.Body).Decode(&msg)
+		sent <- req.URL.Path[:strings.Index(req.URL.Path, "/send")] + " " + msg.Body
+		w.Write([]byte(`{"event_id":"$1"}`))
+	}))
+	defer hs.Close()
+	hsURL, _ := url.Parse(hs.URL)
+	cli := matrix.NewClient(hsURL, "token", "@bot:x")
+
+	Digest(cli, "github", "!a:x", time.Minute, matrix.TextMessage{"m.notice", "pushed"})
+	Digest(cli, "travis", "!a:x", 100*time.Millisecond, matrix.TextMessage{"m.notice", "passed"})
+	Digest(cli, "github", "!b:x", time.Minute, matrix.TextMessage{"m.notice", "other room"})
+	select {
+	case got := <-sent:
+		if want := "/_matrix/client/r0/rooms/!a:x Digest of 2 notifications\npushed\npassed"; got != want {
+			t.Errorf("Digest => want %q sent after the soonest window, got %q", want, got)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Digest => want the digest sent after the soonest window")
+	}
+	select {
+	case got := <-sent:
+		t.Errorf("Digest => want the other room's digest held back, got %q", got)
+	default:
+	}
+	Flush()
+	if got, want := <-sent, "/_matrix/client/r0/rooms/!b:x other room"; got != want {
+		t.Errorf("Flush => want %q got %q", want, got)
+	}
+	if err := Digest(cli, "github", "!a:x", 0, matrix.TextMessage{"m.notice", "now"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := <-sent, "/_matrix/client/r0/rooms/!a:x now"; got != want {
+		t.Errorf("Digest without a window => want %q sent straight away, got %q", want, got)
+	}
+}
+
+func TestParseTallyWindow(t *testing.T) {
+	for window, want := range map[string]time.Duration{"": time.Hour, "1m": MinTallyWindow, "24h": MaxTallyWindow} {
+		if got, err := ParseTallyWindow(window, time.Hour); err != nil || got != want {
+			t.Errorf("ParseTallyWindow(%q) => want %s got %s, %v", window, want, got, err)
+		}
+	}
+	for _, window := range []string{"soon", "30s", "25h"} {
+		if _, err := ParseTallyWindow(window, time.Hour); err == nil {
+			t.Errorf("ParseTallyWindow(%q) => want error", window)
+		}
+	}
+}
+
+func TestTally(t *testing.T) {
+	sent := make(chan string, 10)
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var msg matrix.TextMessage
+		json.NewDecoder(req.Body).Decode(&msg)
+		sent <- msg.Body
+		w.Write([]byte(`{"event_id":"$1"}`))
+	}))
+	defer hs.Close()
+	hsURL, _ := url.Parse(hs.URL)
+	cli := matrix.NewClient(hsURL, "token", "@bot:x")
+	message := func(total int) func(int) interface{} {
+		return func(n int) interface{} {
+			return matrix.TextMessage{"m.notice", fmt.Sprintf("%d new stars, now %d total", n, total)}
+		}
+	}
+
+	for i := 1; i <= 3; i++ {
+		Tally(cli, "github", "!a:x", "owner/repo/stars", 100*time.Millisecond, 2, message(10+i))
+	}
+	Tally(cli, "github", "!a:x", "owner/other/stars", 100*time.Millisecond, 2, message(1))
+	select {
+	case got := <-sent:
+		if want := "3 new stars, now 13 total"; got != want {
+			t.Errorf("Tally => want %q got %q", want, got)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Tally => want the count sent after the window")
+	}
+	select {
+	case got := <-sent:
+		t.Errorf("Tally => want a count below the threshold dropped, got %q", got)
+	case <-time.After(200 * time.Millisecond):
+	}
+	Tally(cli, "github", "!a:x", "owner/repo/stars", time.Minute, 1, message(14))
+	Flush()
+	if got, want := <-sent, "1 new stars, now 14 total"; got != want {
+		t.Errorf("Flush => want %q got %q", want, got)
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		want bool
+	}{
+		{errors.HTTPError{Code: 502}, true},
+		{errors.HTTPError{Code: 429}, true},
+		{errors.HTTPError{Code: 403}, false},
+		{errors.HTTPError{Code: 413}, false},
+		{fmt.Errorf("connection refused"), true},
+	} {
+		if got := retryable(test.err); got != test.want {
+			t.Errorf("retryable(%v) => want %v, got %v", test.err, test.want, got)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	for attempts, want := range map[int]time.Duration{
+		1:  5 * time.Second,
+		2:  10 * time.Second,
+		4:  40 * time.Second,
+		8:  maxRetryDelay,
+		50: maxRetryDelay,
+	} {
+		if got := retryDelay(attempts); got != want {
+			t.Errorf("retryDelay(%d) => want %s, got %s", attempts, want, got)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package batch
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/status"
+	"sort"
+	"time"
+)
+
+// MaxDigestWindow is the longest window a service may hold messages back for a digest.
+const MaxDigestWindow = time.Hour
+
+// maxDigestMessages is the most messages a digest shows. Earlier ones are left out.
+const maxDigestMessages = 50
+
+// A digest is the messages held back to be sent into a room as one, from any of the services which
+// send into it as the same user.
+type digest struct {
+	cli        *matrix.Client
+	roomID     string
+	serviceIDs map[string]bool
+	contents   []interface{}
+	dropped    int // the number of earlier messages left out
+	deadline   time.Time
+	timer      *time.Timer
+}
+
+var digests = make(map[string]*digest) // user ID and room ID => digest, guarded by mu
+
+// ParseDigestWindow parses a service's digest window, e.g. "5m". An empty window is 0, which means
+// messages are not held back for a digest.
+func ParseDigestWindow(window string) (time.Duration, error) {
+	if window == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(window)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 || d > MaxDigestWindow {
+		return 0, fmt.Errorf("must be between 0s and %s", MaxDigestWindow)
+	}
+	return d, nil
+}
+
+// Digest holds back a message for the room's digest, which is sent as one message once the window
+// has passed since the first message in it. Messages from every service which sends into the room
+// as the same user share the digest, which is sent when the soonest of their windows has passed.
+// If the window is 0, the message is sent straight away, as Send does. The content must be a
+// matrix.HTMLMessage or a matrix.TextMessage.
+//
+// Services should only hold back messages which can wait, e.g. about pushes and comments, and send
+// urgent ones, e.g. alerts, with Send. Whether sending the digest succeeds is recorded in the
+// status of each service with messages in it, and failures are logged.
+func Digest(cli *matrix.Client, serviceID, roomID string, window time.Duration, content interface{}) error {
+	if window <= 0 {
+		return Send(cli, serviceID, roomID, "", 0, content)
+	}
+	k := cli.UserID + "\x00" + roomID
+	deadline := time.Now().Add(window)
+	mu.Lock()
+	defer mu.Unlock()
+	d := digests[k]
+	if d == nil {
+		d = &digest{cli: cli, roomID: roomID, serviceIDs: make(map[string]bool), deadline: deadline}
+		d.timer = time.AfterFunc(window, func() { flushDigest(k) })
+		digests[k] = d
+	} else if deadline.Before(d.deadline) && d.timer.Stop() {
+		// Another service wants the digest sooner.
+		d.deadline = deadline
+		d.timer = time.AfterFunc(window, func() { flushDigest(k) })
+	}
+	d.serviceIDs[serviceID] = true
+	d.contents = append(d.contents, content)
+	if len(d.contents) > maxDigestMessages {
+		d.contents = d.contents[1:]
+		d.dropped++
+	}
+	return nil
+}
+
+// flushDigests sends every held back digest now.
+func flushDigests() {
+	mu.Lock()
+	var keys []string
+	for k, d := range digests {
+		if d.timer.Stop() {
+			keys = append(keys, k)
+		}
+	}
+	mu.Unlock()
+	for _, k := range keys {
+		flushDigest(k)
+	}
+}
+
+func flushDigest(k string) {
+	mu.Lock()
+	d := digests[k]
+	delete(digests, k)
+	mu.Unlock()
+	if d == nil {
+		return
+	}
+	var serviceIDs []string
+	for serviceID := range d.serviceIDs {
+		serviceIDs = append(serviceIDs, serviceID)
+	}
+	sort.Strings(serviceIDs)
+	err := send(d.cli, d.roomID, digestMessage(d.contents, d.dropped), serviceIDs...)
+	if err != nil {
+		log.WithFields(log.Fields{
+			log.ErrorKey:  err,
+			"service_ids": serviceIDs,
+			"room_id":     d.roomID,
+		}).Warn("Failed to send digest into room")
+	}
+	for _, serviceID := range serviceIDs {
+		status.SendResult(serviceID, err)
+	}
+}
+
+// digestMessage returns a single message with a heading counting the contents, then the lines of
+// each of them as merge does. A lone message is returned as it is.
+func digestMessage(contents []interface{}, dropped int) interface{} {
+	if len(contents) == 1 && dropped == 0 {
+		return contents[0]
+	}
+	merged := merge(contents, dropped).(matrix.HTMLMessage)
+	heading := fmt.Sprintf("Digest of %d notifications", len(contents)+dropped)
+	merged.Body = heading + "\n" + merged.Body
+	merged.FormattedBody = "<b>" + heading + "</b><br>" + merged.FormattedBody
+	return merged
+}
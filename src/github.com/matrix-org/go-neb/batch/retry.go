@@ -0,0 +1,281 @@
+package batch
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/errors"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/ops"
+	"github.com/matrix-org/go-neb/status"
+	"github.com/matrix-org/go-neb/types"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// firstRetryDelay is how long after a message fails to send it is tried again. The delay doubles
+// with each failure, up to maxRetryDelay.
+const (
+	firstRetryDelay = 5 * time.Second
+	maxRetryDelay   = 10 * time.Minute
+)
+
+// maxQueueAge is how long a message is tried again for before it is given up on.
+const maxQueueAge = 24 * time.Hour
+
+// maxRetrySleep is the longest the queue waits before checking for due messages again.
+const maxRetrySleep = time.Minute
+
+// The queue of messages which failed to send, with a count of those waiting for each room so that
+// new messages for it are queued behind them rather than overtaking them. Guarded by queueMu.
+var (
+	queueMu      sync.Mutex
+	queueStarted bool
+	queuedRooms  = make(map[string]int) // user ID and room ID => queued messages
+	lastSeq      int64
+	queued       int64 // all queued messages, updated atomically for GetStats
+)
+
+// wakeQueue is sent to when a message is queued, so that the queue sleeps until it is due if it is
+// due before the message the queue was waiting for.
+var wakeQueue = make(chan struct{}, 1)
+
+// StartRetrying loads the messages left queued when Go-NEB last stopped, then sends queued messages
+// in the background, with clients from clientFor. Until it is called, messages which fail to send
+// aren't queued: the failure is returned, as it is for failures which won't go away by waiting,
+// e.g. not being in the room.
+//
+// Messages which fail to send because the homeserver can't be reached, is overloaded or returns a
+// server error are stored and sent again, with exponential backoff, for up to 24 hours, after
+// which an operational alert is raised. Messages for a room are sent in the order they were sent
+// in: whilst any are queued, new ones for the room are queued behind them.
+func StartRetrying(clientFor func(userID string) (*matrix.Client, error)) error {
+	msgs, err := database.GetServiceDB().LoadQueuedMessages()
+	if err != nil {
+		return err
+	}
+	queueMu.Lock()
+	for _, msg := range msgs {
+		queuedRooms[queueKey(msg.UserID, msg.RoomID)]++
+		if msg.Seq > lastSeq {
+			lastSeq = msg.Seq
+		}
+	}
+	atomic.StoreInt64(&queued, int64(len(msgs)))
+	queueStarted = true
+	queueMu.Unlock()
+	if len(msgs) > 0 {
+		log.WithField("queued", len(msgs)).Info("Sending messages left queued")
+	}
+	go func() {
+		for {
+			sleepUntil(retryDue(time.Now(), clientFor))
+		}
+	}()
+	return nil
+}
+
+func queueKey(userID, roomID string) string {
+	return userID + "\x00" + roomID
+}
+
+// retryable returns true if sending may work later: if the homeserver couldn't be reached, or
+// responded with HTTP 429 or a server error.
+func retryable(err error) bool {
+	if httpErr, ok := err.(errors.HTTPError); ok {
+		return httpErr.Code == 429 || httpErr.Code >= 500
+	}
+	return true
+}
+
+// retryDelay returns how long to wait before trying a message again after it has failed attempts
+// times.
+func retryDelay(attempts int) time.Duration {
+	d := firstRetryDelay
+	for i := 1; i < attempts && d < maxRetryDelay; i++ {
+		d *= 2
+	}
+	if d > maxRetryDelay {
+		d = maxRetryDelay
+	}
+	return d
+}
+
+// queueIfWaiting queues the message if others are queued for the room, so that it is sent after
+// them. Returns true if it was queued, or an error if it should have been but couldn't be.
+func queueIfWaiting(cli *matrix.Client, roomID string, content interface{}, serviceIDs []string) (bool, error) {
+	queueMu.Lock()
+	defer queueMu.Unlock()
+	if !queueStarted || queuedRooms[queueKey(cli.UserID, roomID)] == 0 {
+		return false, nil
+	}
+	return true, enqueueLocked(cli.UserID, roomID, content, serviceIDs, nil, time.Now())
+}
+
+// queueFailed queues the message to be sent again, if the queue is running and the error it failed
+// with may go away. Returns true if it was queued.
+func queueFailed(cli *matrix.Client, roomID string, content interface{}, serviceIDs []string, sendErr error) bool {
+	queueMu.Lock()
+	defer queueMu.Unlock()
+	if !queueStarted || !retryable(sendErr) {
+		return false
+	}
+	logger := log.WithFields(log.Fields{
+		log.ErrorKey:  sendErr,
+		"service_ids": serviceIDs,
+		"room_id":     roomID,
+	})
+	if err := enqueueLocked(cli.UserID, roomID, content, serviceIDs, sendErr, time.Now()); err != nil {
+		logger.WithField("queue_error", err).Error("Failed to send message into room, and failed to queue it")
+		return false
+	}
+	logger.Warn("Failed to send message into room: queued it to be sent again")
+	return true
+}
+
+// enqueueLocked stores the message at the back of the room's queue. A message which failed is due
+// after the first retry delay. One queued behind others is due straight away, but waits for them.
+func enqueueLocked(userID, roomID string, content interface{}, serviceIDs []string, sendErr error, now time.Time) error {
+	contentJSON, err := json.Marshal(content)
+	if err != nil {
+		return err
+	}
+	id := make([]byte, 16)
+	if _, err = rand.Read(id); err != nil {
+		return err
+	}
+	seq := now.UnixNano()
+	if seq <= lastSeq {
+		seq = lastSeq + 1
+	}
+	msg := types.QueuedMessage{
+		ID:         hex.EncodeToString(id),
+		ServiceIDs: serviceIDs,
+		UserID:     userID,
+		RoomID:     roomID,
+		Content:    contentJSON,
+		Seq:        seq,
+		QueuedMs:   now.UnixNano() / int64(time.Millisecond),
+		DueMs:      now.UnixNano() / int64(time.Millisecond),
+	}
+	if sendErr != nil {
+		msg.Attempts = 1
+		msg.LastError = sendErr.Error()
+		msg.DueMs = now.Add(firstRetryDelay).UnixNano() / int64(time.Millisecond)
+	}
+	if err = database.GetServiceDB().StoreQueuedMessage(msg); err != nil {
+		return err
+	}
+	lastSeq = seq
+	queuedRooms[queueKey(userID, roomID)]++
+	atomic.AddInt64(&queued, 1)
+	select {
+	case wakeQueue <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// dequeue deletes a message which has been sent or given up on.
+func dequeue(msg types.QueuedMessage) error {
+	queueMu.Lock()
+	defer queueMu.Unlock()
+	if err := database.GetServiceDB().DeleteQueuedMessage(msg.ID); err != nil {
+		return err
+	}
+	k := queueKey(msg.UserID, msg.RoomID)
+	if queuedRooms[k]--; queuedRooms[k] <= 0 {
+		delete(queuedRooms, k)
+	}
+	atomic.AddInt64(&queued, -1)
+	return nil
+}
+
+// retryDue sends the first queued message of each room, if it is due, then the next, until one
+// fails or isn't due. Returns when a message is next due.
+func retryDue(now time.Time, clientFor func(userID string) (*matrix.Client, error)) time.Time {
+	next := now.Add(maxRetrySleep)
+	msgs, err := database.GetServiceDB().LoadQueuedMessages()
+	if err != nil {
+		log.WithError(err).Error("Failed to load queued messages")
+		return next
+	}
+	waiting := make(map[string]bool) // rooms whose first message isn't due
+	for _, msg := range msgs {
+		k := queueKey(msg.UserID, msg.RoomID)
+		if waiting[k] {
+			continue
+		}
+		if msg.DueMs > now.UnixNano()/int64(time.Millisecond) || !retry(&msg, now, clientFor) {
+			waiting[k] = true
+			due := time.Unix(0, msg.DueMs*int64(time.Millisecond))
+			if !due.After(now) {
+				// It was sent but couldn't be deleted: don't send it again straight away.
+				due = now.Add(firstRetryDelay)
+			}
+			if due.Before(next) {
+				next = due
+			}
+		}
+	}
+	return next
+}
+
+// retry sends a queued message again. Returns true if it has left the queue, because it was sent
+// or given up on, or false if it was put back to be tried again later, with its DueMs updated.
+func retry(msg *types.QueuedMessage, now time.Time, clientFor func(userID string) (*matrix.Client, error)) bool {
+	logger := log.WithFields(log.Fields{
+		"service_ids": msg.ServiceIDs,
+		"room_id":     msg.RoomID,
+		"attempts":    msg.Attempts,
+	})
+	cli, err := clientFor(msg.UserID)
+	if err == nil {
+		atomic.AddInt64(&inFlight, 1)
+		_, err = cli.SendMessageEvent(msg.RoomID, "m.room.message", msg.Content)
+		atomic.AddInt64(&inFlight, -1)
+	}
+	if err == nil {
+		logger.Info("Sent queued message into room")
+	} else {
+		msg.Attempts++
+		msg.LastError = err.Error()
+		queuedFor := now.Sub(time.Unix(0, msg.QueuedMs*int64(time.Millisecond)))
+		if retryable(err) && queuedFor < maxQueueAge {
+			msg.DueMs = now.Add(retryDelay(msg.Attempts)).UnixNano() / int64(time.Millisecond)
+			logger.WithError(err).Warn("Failed to send queued message into room: it will be sent again")
+			if err = database.GetServiceDB().StoreQueuedMessage(*msg); err != nil {
+				logger.WithError(err).Error("Failed to store queued message")
+			}
+			return false
+		}
+		logger.WithError(err).Error("Giving up on queued message")
+		ops.Alert("Gave up sending a message into %s as %s after %d attempts: %s", msg.RoomID, msg.UserID, msg.Attempts, msg.LastError)
+	}
+	for _, serviceID := range msg.ServiceIDs {
+		status.SendResult(serviceID, err)
+	}
+	if err := dequeue(*msg); err != nil {
+		// It will be sent again, but not ahead of the room's other messages.
+		logger.WithError(err).Error("Failed to delete queued message")
+		return false
+	}
+	return true
+}
+
+// sleepUntil waits until the given time, or until a message is queued.
+func sleepUntil(t time.Time) {
+	wait := t.Sub(time.Now())
+	if wait <= 0 {
+		return
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-wakeQueue:
+	}
+}
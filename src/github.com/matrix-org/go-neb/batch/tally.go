@@ -0,0 +1,106 @@
+package batch
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/status"
+	"time"
+)
+
+// MinTallyWindow and MaxTallyWindow are the shortest and longest windows a service may count
+// events for.
+const (
+	MinTallyWindow = time.Minute
+	MaxTallyWindow = 24 * time.Hour
+)
+
+// A tally is a count of events about the same thing, e.g. new stars on a repository, to be sent
+// into a room as one message saying how many there were.
+type tally struct {
+	cli       *matrix.Client
+	serviceID string
+	roomID    string
+	threshold int
+	count     int
+	message   func(count int) interface{}
+	timer     *time.Timer
+}
+
+var tallies = make(map[string]*tally) // service ID, room ID and key => tally, guarded by mu
+
+// ParseTallyWindow parses a service's tally window, e.g. "1h". An empty window is the default.
+func ParseTallyWindow(window string, def time.Duration) (time.Duration, error) {
+	if window == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(window)
+	if err != nil {
+		return 0, err
+	}
+	if d < MinTallyWindow || d > MaxTallyWindow {
+		return 0, fmt.Errorf("must be between %s and %s", MinTallyWindow, MaxTallyWindow)
+	}
+	return d, nil
+}
+
+// Tally counts an event for the room, rather than sending a message about it. Once the window has
+// passed since the first event with the same key, the message func is called with how many there
+// were and the message it returns is sent, unless there were fewer than the threshold, in which
+// case the count is dropped. The message func of the latest event is used, so it may describe the
+// latest state of things, e.g. a repository's total stars. Its content must be a
+// matrix.HTMLMessage or a matrix.TextMessage. Whether sending succeeds is recorded in the service's
+// status, and failures are logged.
+func Tally(cli *matrix.Client, serviceID, roomID, key string, window time.Duration, threshold int, message func(count int) interface{}) {
+	k := serviceID + "\x00" + roomID + "\x00" + key
+	mu.Lock()
+	defer mu.Unlock()
+	t := tallies[k]
+	if t == nil {
+		t = &tally{cli: cli, serviceID: serviceID, roomID: roomID}
+		t.timer = time.AfterFunc(window, func() { flushTally(k) })
+		tallies[k] = t
+	}
+	t.threshold = threshold
+	t.count++
+	t.message = message
+}
+
+// flushTallies sends every tally now.
+func flushTallies() {
+	mu.Lock()
+	var keys []string
+	for k, t := range tallies {
+		if t.timer.Stop() {
+			keys = append(keys, k)
+		}
+	}
+	mu.Unlock()
+	for _, k := range keys {
+		flushTally(k)
+	}
+}
+
+func flushTally(k string) {
+	mu.Lock()
+	t := tallies[k]
+	delete(tallies, k)
+	mu.Unlock()
+	if t == nil {
+		return
+	}
+	logger := log.WithFields(log.Fields{
+		"service_id": t.serviceID,
+		"room_id":    t.roomID,
+		"count":      t.count,
+	})
+	if t.count < t.threshold {
+		logger.Print("Not sending tally below its threshold")
+		return
+	}
+	err := send(t.cli, t.roomID, t.message(t.count), t.serviceID)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to send tally into room")
+	}
+	status.SendResult(t.serviceID, err)
+}
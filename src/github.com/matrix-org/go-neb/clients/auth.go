@@ -0,0 +1,313 @@
+package clients
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/types"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// pendingAuthLifetime is how long Go-NEB waits for a user to follow an !auth link.
+const pendingAuthLifetime = 1 * time.Hour
+
+// A pendingAuth is an auth session requested with !auth, which is confirmed in the direct room
+// the link was sent to once the user has completed it.
+type pendingAuth struct {
+	botUserID string
+	userID    string
+	roomID    string
+	requested time.Time
+}
+
+// cmdAuth sends the user a link to authenticate with the given realm in a direct room, so that
+// nobody else in the room can follow it. The realm can be given by ID, or by type if there is
+// only one realm of that type.
+func (c *Clients) cmdAuth(client *matrix.Client, userID string, args []string) (interface{}, error) {
+	if len(args) == 0 {
+		realms, err := c.db.LoadAuthRealms()
+		if err != nil {
+			return nil, err
+		}
+		var realmIDs []string
+		for _, realm := range realms {
+			realmIDs = append(realmIDs, realm.ID())
+		}
+		return &matrix.TextMessage{"m.notice", "Usage: !auth <realm>. Realms: " + strings.Join(realmIDs, ", ")}, nil
+	}
+	realm, err := c.findRealm(strings.Join(args, " "))
+	if err != nil {
+		return nil, err
+	}
+	if err = c.sendAuthPrompt(client, realm, userID, ""); err != nil {
+		return nil, err
+	}
+	if _, ok := realm.(types.TokenEntryRealm); ok {
+		return &matrix.TextMessage{"m.notice", "I've sent you instructions to log in to " + realm.ID() + " in a direct message."}, nil
+	}
+	return &matrix.TextMessage{"m.notice", "I've sent you a link to log in to " + realm.ID() + " in a direct message."}, nil
+}
+
+// sendAuthPrompt sends the user a link to authenticate with the realm in a direct room, after the
+// given introduction, or instructions for sending a token if the realm takes tokens.
+func (c *Clients) sendAuthPrompt(client *matrix.Client, realm types.AuthRealm, userID, intro string) error {
+	if tokenRealm, ok := realm.(types.TokenEntryRealm); ok {
+		text := intro + "To log in to " + realm.ID() + ", reply here with: !token " + realm.ID() + " <token>\n" +
+			tokenRealm.TokenHelp() + "."
+		_, err := c.sendDirect(client, userID, text)
+		return err
+	}
+
+	// The realm shows its own success page: there is nowhere useful to redirect to.
+	res := realm.RequestAuthSession(userID, json.RawMessage(`{}`))
+	if res == nil {
+		return errors.New("Failed to start logging in to " + realm.ID())
+	}
+	var authURL struct {
+		URL string
+	}
+	if b, err := json.Marshal(res); err == nil {
+		json.Unmarshal(b, &authURL)
+	}
+	if authURL.URL == "" {
+		return errors.New("Realm " + realm.ID() + " has no link to log in with")
+	}
+	session, err := c.db.LoadAuthSessionByUser(realm.ID(), userID)
+	if err != nil {
+		return err
+	}
+
+	roomID, err := c.sendDirect(client, userID, intro+"Follow this link to log in to "+realm.ID()+" as "+userID+": "+authURL.URL)
+	if err != nil {
+		return err
+	}
+	c.authMutex.Lock()
+	for key, p := range c.pendingAuth {
+		if time.Since(p.requested) > pendingAuthLifetime {
+			delete(c.pendingAuth, key)
+		}
+	}
+	c.pendingAuth[realm.ID()+" "+session.ID()] = pendingAuth{
+		botUserID: client.UserID,
+		userID:    userID,
+		roomID:    roomID,
+		requested: time.Now(),
+	}
+	c.authMutex.Unlock()
+	return nil
+}
+
+// RequestReauth asks the user to log in to the realm again because their session has stopped
+// working, by sending them a link in a direct message. It is sent by the client which most recently
+// received a message from the user, or else one which already has a direct room with them, or else
+// the client with the lowest user ID. It implements tokens.ReauthNotifier.
+func (c *Clients) RequestReauth(realmID, userID, reason string) error {
+	realm, err := c.db.LoadAuthRealm(realmID)
+	if err != nil {
+		return err
+	}
+	botUserID, err := c.botFor(userID)
+	if err != nil {
+		return err
+	}
+	client, err := c.Client(botUserID)
+	if err != nil {
+		return err
+	}
+	return c.sendAuthPrompt(client, realm, userID, "Your login to "+realmID+" has stopped working: "+reason+". ")
+}
+
+// botFor returns the user ID of the client which should send the user direct messages.
+func (c *Clients) botFor(userID string) (string, error) {
+	c.authMutex.Lock()
+	botUserID := c.lastSeenBy[userID]
+	if botUserID == "" {
+		var keys []string
+		for key := range c.directRooms {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if strings.HasSuffix(key, " "+userID) {
+				botUserID = strings.TrimSuffix(key, " "+userID)
+				break
+			}
+		}
+	}
+	c.authMutex.Unlock()
+	if botUserID != "" {
+		return botUserID, nil
+	}
+	configs, err := c.db.LoadMatrixClientConfigs()
+	if err != nil {
+		return "", err
+	}
+	for _, cfg := range configs {
+		if botUserID == "" || cfg.UserID < botUserID {
+			botUserID = cfg.UserID
+		}
+	}
+	if botUserID == "" {
+		return "", errors.New("No clients are configured")
+	}
+	return botUserID, nil
+}
+
+// sawUser records that the client received a message from the user.
+func (c *Clients) sawUser(client *matrix.Client, userID string) {
+	c.authMutex.Lock()
+	defer c.authMutex.Unlock()
+	c.lastSeenBy[userID] = client.UserID
+}
+
+// cmdToken submits a token to a types.TokenEntryRealm. It is only accepted in a direct room, since
+// everyone else in the room could use it otherwise.
+func (c *Clients) cmdToken(client *matrix.Client, roomID, userID string, args []string) (interface{}, error) {
+	if !c.isDirectRoom(client, roomID, userID) {
+		return &matrix.TextMessage{"m.notice", "Never send tokens in a shared room: revoke that token now, " +
+			"then send !auth <realm> to get a direct message to send a new one in."}, nil
+	}
+	if len(args) != 2 && len(args) != 3 {
+		return &matrix.TextMessage{"m.notice", "Usage: !token <realm> [username] <token>"}, nil
+	}
+	realm, err := c.findRealm(args[0])
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := realm.(types.TokenEntryRealm); !ok {
+		return nil, errors.New("Realm " + realm.ID() + " does not take tokens: send !auth " + realm.ID() + " instead")
+	}
+	var cfg struct {
+		Token    string
+		Username string
+	}
+	cfg.Token = args[len(args)-1]
+	if len(args) == 3 {
+		cfg.Username = args[1]
+	}
+	cfgJSON, err := json.Marshal(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	res := realm.RequestAuthSession(userID, cfgJSON)
+	if res == nil {
+		return nil, errors.New("Failed to store your token")
+	}
+	if err, ok := res.(error); ok {
+		return nil, err
+	}
+	var login struct {
+		Login string
+	}
+	if b, err := json.Marshal(res); err == nil {
+		json.Unmarshal(b, &login)
+	}
+	return &matrix.TextMessage{"m.notice", "You have logged in to " + realm.ID() + " as " + login.Login + "."}, nil
+}
+
+// isDirectRoom returns true if the room is one sendDirect made for the user, or if the client and
+// the user are its only members.
+func (c *Clients) isDirectRoom(client *matrix.Client, roomID, userID string) bool {
+	c.authMutex.Lock()
+	made := c.directRooms[client.UserID+" "+userID] == roomID
+	c.authMutex.Unlock()
+	if made {
+		return true
+	}
+	room, ok := client.Rooms[roomID]
+	if !ok || room.GetMembershipState(userID) != "join" {
+		return false
+	}
+	for memberID := range room.State["m.room.member"] {
+		membership := room.GetMembershipState(memberID)
+		if (membership == "join" || membership == "invite") && memberID != client.UserID && memberID != userID {
+			return false
+		}
+	}
+	return true
+}
+
+// findRealm returns the realm with the given ID, or else the only realm with the given type.
+func (c *Clients) findRealm(idOrType string) (types.AuthRealm, error) {
+	realm, err := c.db.LoadAuthRealm(idOrType)
+	if err == nil {
+		return realm, nil
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+	realms, err := c.db.LoadAuthRealmsByType(idOrType)
+	if err != nil {
+		return nil, err
+	}
+	switch len(realms) {
+	case 0:
+		return nil, errors.New("Unknown realm: " + idOrType)
+	case 1:
+		return realms[0], nil
+	}
+	var realmIDs []string
+	for _, r := range realms {
+		realmIDs = append(realmIDs, r.ID())
+	}
+	return nil, errors.New("There are several " + idOrType + " realms, pick one of: " + strings.Join(realmIDs, ", "))
+}
+
+// sendDirect sends a notice to the user in a direct room with them, creating one if the client
+// doesn't have one yet. Returns the room ID.
+func (c *Clients) sendDirect(client *matrix.Client, userID, text string) (string, error) {
+	roomID, err := client.SendDirect(userID, matrix.TextMessage{"m.notice", text})
+	if roomID != "" {
+		c.authMutex.Lock()
+		c.directRooms[client.UserID+" "+userID] = roomID
+		c.authMutex.Unlock()
+	}
+	return roomID, err
+}
+
+// OnAuthRedirect confirms in the direct room that the user has logged in, if the redirect with
+// the given query completed an auth session requested with !auth. It must only be called if the
+// realm handled the redirect successfully.
+func (c *Clients) OnAuthRedirect(realmID string, query url.Values) {
+	var sessionID string
+	var pending pendingAuth
+	c.authMutex.Lock()
+	// Realms identify the session with a query parameter, but not all with the same one.
+	for _, values := range query {
+		for _, v := range values {
+			if p, ok := c.pendingAuth[realmID+" "+v]; ok {
+				sessionID, pending = v, p
+				delete(c.pendingAuth, realmID+" "+v)
+			}
+		}
+	}
+	c.authMutex.Unlock()
+	if sessionID == "" {
+		return
+	}
+	logger := log.WithFields(log.Fields{
+		"realm_id": realmID,
+		"user_id":  pending.userID,
+	})
+	session, err := c.db.LoadAuthSessionByID(realmID, sessionID)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to load session to confirm login")
+		return
+	}
+	if session.UserID() != pending.userID || !session.Authenticated() {
+		return
+	}
+	client, err := c.Client(pending.botUserID)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to load client to confirm login")
+		return
+	}
+	text := "You have logged in to " + realmID + " as " + pending.userID + "."
+	if _, err = client.SendMessageEvent(pending.roomID, "m.room.message", matrix.TextMessage{"m.notice", text}); err != nil {
+		logger.WithError(err).Warn("Failed to confirm login")
+	}
+}
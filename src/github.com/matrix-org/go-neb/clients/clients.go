@@ -1,14 +1,18 @@
 package clients
 
 import (
+	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/matrix-org/go-neb/database"
 	"github.com/matrix-org/go-neb/matrix"
 	"github.com/matrix-org/go-neb/plugin"
+	"github.com/matrix-org/go-neb/status"
 	"github.com/matrix-org/go-neb/types"
 	"net/url"
+	"runtime/debug"
 	"strings"
 	"sync"
+	"time"
 )
 
 type nextBatchStore struct {
@@ -36,23 +40,78 @@ func (s nextBatchStore) Load(userID string) string {
 	return token
 }
 
+// cryptoStore keeps the end-to-end encryption state of clients' devices in the database.
+type cryptoStore struct {
+	db *database.ServiceDB
+}
+
+func (s cryptoStore) SaveCrypto(userID, deviceID, key string, value []byte) error {
+	return s.db.StoreCryptoState(userID, deviceID, key, value)
+}
+func (s cryptoStore) LoadCrypto(userID, deviceID string) (map[string][]byte, error) {
+	return s.db.LoadCryptoState(userID, deviceID)
+}
+func (s cryptoStore) PickleKeys() [][]byte {
+	return database.PickleKeys()
+}
+
 // A Clients is a collection of clients used for bot services.
 type Clients struct {
 	db       *database.ServiceDB
 	dbMutex  sync.Mutex
 	mapMutex sync.Mutex
 	clients  map[string]clientEntry
+
+	authMutex   sync.Mutex
+	pendingAuth map[string]pendingAuth // realm ID + " " + session ID => auth requested with !auth
+	directRooms map[string]string      // bot user ID + " " + user ID => direct room ID
+	lastSeenBy  map[string]string      // user ID => bot user ID which last received a message from them
+
+	claimedMutex  sync.Mutex
+	claimedEvents map[string]time.Time // event ID => when a client claimed it
+
+	// commands runs the services' plugins for each message, so that the clients' workers can get
+	// on with the next event while commands wait for other servers.
+	commands *plugin.Pool
+	// serviceUsed is called with each service a message is passed to, if it is set.
+	serviceUsed func(types.Service)
 }
 
+// DefaultMaxConcurrentCommands is how many messages have their commands and expansions run at once,
+// unless LimitCommands is called.
+const DefaultMaxConcurrentCommands = 16
+
+// maxQueuedCommandsPerWorker is how many messages may wait for their commands to be run, for each
+// one being run. Messages which arrive when the queue is full are ignored.
+const maxQueuedCommandsPerWorker = 16
+
 // New makes a new collection of matrix clients
 func New(db *database.ServiceDB) *Clients {
 	clients := &Clients{
 		db:      db,
 		clients: make(map[string]clientEntry), // user_id => clientEntry
+
+		pendingAuth:   make(map[string]pendingAuth),
+		directRooms:   make(map[string]string),
+		lastSeenBy:    make(map[string]string),
+		claimedEvents: make(map[string]time.Time),
 	}
+	clients.LimitCommands(DefaultMaxConcurrentCommands)
 	return clients
 }
 
+// OnServiceUsed sets a function to be called with each service a message is passed to. It must be
+// called before Start.
+func (c *Clients) OnServiceUsed(fn func(types.Service)) {
+	c.serviceUsed = fn
+}
+
+// LimitCommands sets how many messages have their commands and expansions run at once. It must be
+// called before Start.
+func (c *Clients) LimitCommands(maxConcurrent int) {
+	c.commands = plugin.NewPool(maxConcurrent, maxConcurrent*maxQueuedCommandsPerWorker)
+}
+
 // Client gets a client for the userID
 func (c *Clients) Client(userID string) (*matrix.Client, error) {
 	entry := c.getClient(userID)
@@ -69,6 +128,41 @@ func (c *Clients) Update(config types.ClientConfig) (types.ClientConfig, error)
 	return old.config, err
 }
 
+// Remove stops the matrix client for the given user and deletes its config.
+func (c *Clients) Remove(userID string) error {
+	c.dbMutex.Lock()
+	defer c.dbMutex.Unlock()
+
+	if err := c.db.DeleteMatrixClientConfig(userID); err != nil {
+		return err
+	}
+
+	c.mapMutex.Lock()
+	defer c.mapMutex.Unlock()
+	if entry, ok := c.clients[userID]; ok {
+		entry.client.StopSync()
+		delete(c.clients, userID)
+	}
+	return nil
+}
+
+// Stop stops every client from syncing and waits for the events they have already received to be
+// processed, so that responses to commands are not half-sent.
+func (c *Clients) Stop() {
+	c.mapMutex.Lock()
+	var clients []*matrix.Client
+	for _, entry := range c.clients {
+		entry.client.StopSync()
+		clients = append(clients, entry.client)
+	}
+	c.mapMutex.Unlock()
+
+	for _, client := range clients {
+		client.WaitForPendingEvents()
+	}
+	c.commands.Wait()
+}
+
 // Start listening on client /sync streams
 func (c *Clients) Start() error {
 	configs, err := c.db.LoadMatrixClientConfigs()
@@ -142,10 +236,10 @@ func (c *Clients) updateClientInDB(newConfig types.ClientConfig) (new clientEntr
 
 	// set the new display name if they differ
 	if old.config.DisplayName != new.config.DisplayName {
-		if err := new.client.SetDisplayName(new.config.DisplayName); err != nil {
+		if nameErr := new.client.SetDisplayName(new.config.DisplayName); nameErr != nil {
 			// whine about it but don't stop: this isn't fatal.
 			log.WithFields(log.Fields{
-				log.ErrorKey:  err,
+				log.ErrorKey:  nameErr,
 				"displayname": new.config.DisplayName,
 				"user_id":     new.config.UserID,
 			}).Error("Failed to set display name")
@@ -159,7 +253,6 @@ func (c *Clients) updateClientInDB(newConfig types.ClientConfig) (new clientEntr
 
 	if old.client != nil {
 		old.client.StopSync()
-		return
 	}
 
 	c.setClient(new)
@@ -167,19 +260,124 @@ func (c *Clients) updateClientInDB(newConfig types.ClientConfig) (new clientEntr
 }
 
 func (c *Clients) onMessageEvent(client *matrix.Client, event *matrix.Event) {
+	c.sawUser(client, event.Sender)
+	queued := c.commands.Submit(func() {
+		c.runPlugins(client, event)
+	})
+	if !queued {
+		log.WithFields(log.Fields{
+			"event_id":        event.ID,
+			"room_id":         event.RoomID,
+			"service_user_id": client.UserID,
+		}).Warn("Too many commands waiting to run: ignoring message")
+	}
+}
+
+// runPlugins runs the plugins of every service of the client, and the client's own commands, for
+// the message. A help command lists the commands of all of them.
+func (c *Clients) runPlugins(client *matrix.Client, event *matrix.Event) {
 	services, err := c.db.LoadServicesForUser(client.UserID)
 	if err != nil {
 		log.WithFields(log.Fields{
 			log.ErrorKey:      err,
+			"event_id":        event.ID,
 			"room_id":         event.RoomID,
 			"service_user_id": client.UserID,
 		}).Warn("Error loading services")
 	}
+	// Run each service's plugin separately so that what it sends can be attributed to it.
 	var plugins []plugin.Plugin
 	for _, service := range services {
-		plugins = append(plugins, service.Plugin(client, event.RoomID))
+		if c.serviceUsed != nil {
+			c.serviceUsed(service)
+		}
+		plugins = append(plugins, c.runPlugin(service, client, event))
+	}
+	if c.claimEvent(event.ID) {
+		builtin := c.builtinPlugin(client)
+		plugin.OnMessage([]plugin.Plugin{builtin}, client, event)
+		plugins = append(plugins, builtin)
 	}
-	plugin.OnMessage(plugins, client, event)
+	plugin.OnMessage(plugin.HelpPlugins(plugins), client, event)
+}
+
+// runPlugin passes the event to the service's plugin, and to the service itself if it observes
+// messages, recovering if it panics so that one broken service can't stop the others from
+// responding. It returns the plugin, which is empty if the service panicked before returning it.
+func (c *Clients) runPlugin(service types.Service, client *matrix.Client, event *matrix.Event) (p plugin.Plugin) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.WithFields(log.Fields{
+				"service_id":   service.ServiceID(),
+				"service_type": service.ServiceType(),
+				"event_id":     event.ID,
+				"room_id":      event.RoomID,
+				"panic":        fmt.Sprint(r),
+				"stack":        string(debug.Stack()),
+			}).Error("Recovered from panic in service plugin")
+			status.Failed(service.ServiceID(), fmt.Errorf("Panic: %v", r))
+		}
+	}()
+	if observer, ok := service.(types.MessageObserver); ok {
+		observer.OnMessageEvent(client, event)
+	}
+	p = service.Plugin(client, event.RoomID)
+	sent, sendErr := plugin.OnMessage([]plugin.Plugin{p}, client, event)
+	if sent > 0 {
+		status.Sent(service.ServiceID())
+	}
+	if sendErr != nil {
+		status.Failed(service.ServiceID(), sendErr)
+	}
+	return
+}
+
+// onReactionEvent passes a reaction, or a redaction which may withdraw one, to each service of the
+// client which observes reactions.
+func (c *Clients) onReactionEvent(client *matrix.Client, event *matrix.Event) {
+	queued := c.commands.Submit(func() {
+		services, err := c.db.LoadServicesForUser(client.UserID)
+		if err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey:      err,
+				"event_id":        event.ID,
+				"room_id":         event.RoomID,
+				"service_user_id": client.UserID,
+			}).Warn("Error loading services")
+			return
+		}
+		for _, service := range services {
+			if observer, ok := service.(types.ReactionObserver); ok {
+				c.observeReaction(observer, service, client, event)
+			}
+		}
+	})
+	if !queued {
+		log.WithFields(log.Fields{
+			"event_id":        event.ID,
+			"room_id":         event.RoomID,
+			"service_user_id": client.UserID,
+		}).Warn("Too many commands waiting to run: ignoring reaction")
+	}
+}
+
+// observeReaction passes the event to the service, recovering if it panics so that one broken
+// service can't stop the others from seeing it.
+func (c *Clients) observeReaction(observer types.ReactionObserver, service types.Service, client *matrix.Client, event *matrix.Event) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.WithFields(log.Fields{
+				"service_id":   service.ServiceID(),
+				"service_type": service.ServiceType(),
+				"event_id":     event.ID,
+				"room_id":      event.RoomID,
+				"panic":        fmt.Sprint(r),
+				"stack":        string(debug.Stack()),
+			}).Error("Recovered from panic in service reaction observer")
+			status.Failed(service.ServiceID(), fmt.Errorf("Panic: %v", r))
+		}
+	}()
+	observer.OnReactionEvent(client, event)
 }
 
 func (c *Clients) onBotOptionsEvent(client *matrix.Client, event *matrix.Event) {
@@ -239,6 +437,11 @@ func (c *Clients) newClient(config types.ClientConfig) (*matrix.Client, error) {
 
 	client := matrix.NewClient(homeserverURL, config.AccessToken, config.UserID)
 	client.NextBatchStorer = nextBatchStore{c.db}
+	if config.Encryption {
+		if err = client.EnableEncryption(config.DeviceID, cryptoStore{c.db}); err != nil {
+			return nil, err
+		}
+	}
 
 	// TODO: Check that the access token is valid for the userID by peforming
 	// a request against the server.
@@ -247,6 +450,14 @@ func (c *Clients) newClient(config types.ClientConfig) (*matrix.Client, error) {
 		c.onMessageEvent(client, event)
 	})
 
+	client.Worker.OnEventType("m.reaction", func(event *matrix.Event) {
+		c.onReactionEvent(client, event)
+	})
+
+	client.Worker.OnEventType("m.room.redaction", func(event *matrix.Event) {
+		c.onReactionEvent(client, event)
+	})
+
 	client.Worker.OnEventType("m.room.bot.options", func(event *matrix.Event) {
 		c.onBotOptionsEvent(client, event)
 	})
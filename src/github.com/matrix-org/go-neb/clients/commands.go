@@ -0,0 +1,139 @@
+package clients
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/plugin"
+	"github.com/matrix-org/go-neb/silence"
+	"github.com/matrix-org/go-neb/tokens"
+	"sort"
+	"strings"
+	"time"
+)
+
+// claimedEventLifetime is how long the IDs of events handled by builtin commands are remembered.
+const claimedEventLifetime = 10 * time.Minute
+
+// builtinPlugin returns the commands every client responds to, whichever services it runs. These
+// include silencing the notifications of the services which check for silences.
+func (c *Clients) builtinPlugin(client *matrix.Client) plugin.Plugin {
+	return plugin.Plugin{
+		Commands: append([]plugin.Command{
+			plugin.Command{
+				Path:      []string{"auth"},
+				Arguments: []string{"realm"},
+				Help:      "Log in to an auth realm, e.g. github, with a link sent in a direct message",
+				Command: func(roomID, userID string, args []string) (interface{}, error) {
+					return c.cmdAuth(client, userID, args)
+				},
+			},
+			plugin.Command{
+				Path:      []string{"token"},
+				Arguments: []string{"realm", "[username]", "token"},
+				Help:      "Log in to a realm which takes personal access tokens. Only send this in a direct message",
+				Command: func(roomID, userID string, args []string) (interface{}, error) {
+					return c.cmdToken(client, roomID, userID, args)
+				},
+			},
+			plugin.Command{
+				Path:      []string{"logout"},
+				Arguments: []string{"realm"},
+				Help:      "Log out of an auth realm, revoking Go-NEB's access to your account there",
+				Command: func(roomID, userID string, args []string) (interface{}, error) {
+					return c.cmdLogout(userID, args)
+				},
+			},
+		}, silence.Commands()...),
+	}
+}
+
+// claimEvent returns true if no other client has claimed the event, so that only one of the bots
+// in a room responds to a builtin command.
+func (c *Clients) claimEvent(eventID string) bool {
+	c.claimedMutex.Lock()
+	defer c.claimedMutex.Unlock()
+	if _, ok := c.claimedEvents[eventID]; ok {
+		return false
+	}
+	for id, t := range c.claimedEvents {
+		if time.Since(t) > claimedEventLifetime {
+			delete(c.claimedEvents, id)
+		}
+	}
+	c.claimedEvents[eventID] = time.Now()
+	return true
+}
+
+// cmdLogout removes all of the sender's sessions in the given realm. With no realm, it lists the realms
+// they have sessions in.
+func (c *Clients) cmdLogout(userID string, args []string) (interface{}, error) {
+	if len(args) == 0 {
+		realms, err := c.sessionRealms(userID)
+		if err != nil {
+			return nil, err
+		}
+		if len(realms) == 0 {
+			return &matrix.TextMessage{"m.notice", "You are not logged in to any realms."}, nil
+		}
+		return &matrix.TextMessage{"m.notice",
+			"Usage: !logout <realm>. You are logged in to: " + strings.Join(realms, ", ")}, nil
+	}
+	realmID := strings.Join(args, " ")
+	if _, err := c.db.LoadAuthRealm(realmID); err == sql.ErrNoRows {
+		return nil, errors.New("Unknown realm: " + realmID)
+	} else if err != nil {
+		return nil, err
+	}
+	authenticated, err := c.hasAuthenticatedSession(realmID, userID)
+	if err != nil {
+		return nil, err
+	}
+	// Remove sessions which were never completed too, so that their links stop working.
+	revoked, err := tokens.Logout(realmID, userID)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if !authenticated {
+		return &matrix.TextMessage{"m.notice", "You are not logged in to " + realmID + "."}, nil
+	}
+	if !revoked {
+		return &matrix.TextMessage{"m.notice", "Logged out of " + realmID +
+			". Go-NEB could not revoke its access itself: you can do so in your account settings there."}, nil
+	}
+	return &matrix.TextMessage{"m.notice", "Logged out of " + realmID + " and revoked Go-NEB's access."}, nil
+}
+
+// sessionRealms returns the sorted IDs of the realms the user has authenticated sessions in.
+func (c *Clients) sessionRealms(userID string) ([]string, error) {
+	realms, err := c.db.LoadAuthRealms()
+	if err != nil {
+		return nil, err
+	}
+	var realmIDs []string
+	for _, realm := range realms {
+		authenticated, err := c.hasAuthenticatedSession(realm.ID(), userID)
+		if err != nil {
+			return nil, err
+		}
+		if authenticated {
+			realmIDs = append(realmIDs, realm.ID())
+		}
+	}
+	sort.Strings(realmIDs)
+	return realmIDs, nil
+}
+
+// hasAuthenticatedSession returns true if any of the user's sessions in the realm is authenticated.
+func (c *Clients) hasAuthenticatedSession(realmID, userID string) (bool, error) {
+	sessions, err := c.db.LoadAuthSessionsByUser(realmID, userID)
+	if err != nil {
+		return false, err
+	}
+	for _, session := range sessions {
+		if session.Authenticated() {
+			return true, nil
+		}
+	}
+	return false, nil
+}
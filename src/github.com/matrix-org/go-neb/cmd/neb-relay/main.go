@@ -0,0 +1,82 @@
+// Command neb-relay receives webhooks on behalf of a Go-NEB which can't be reached from the
+// internet, e.g. because it is behind NAT. Run it somewhere public, set Go-NEB's BASE_URL to its
+// URL, and point Go-NEB at it with WEBHOOK_RELAY_URL and WEBHOOK_RELAY_TOKEN.
+//
+// It is configured with environment variables:
+//
+//	BIND_ADDRESS            The address to listen on. Defaults to ":4051".
+//	RELAY_TOKEN             Required. The token Go-NEB authenticates with.
+//	RESPONSE_TIMEOUT        How long a webhook request waits for Go-NEB's response before it is
+//	                        answered with HTTP 202. Defaults to "10s".
+//	MAX_QUEUED              The most deliveries held for Go-NEB at once. Defaults to 1000.
+//	MAX_BODY_SIZE           The largest request body accepted, in bytes. Defaults to 26214400.
+//	TLS_CERT_FILE           Optional. Serve HTTPS with this certificate and TLS_KEY_FILE's key.
+//	TLS_KEY_FILE
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/relay"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+func main() {
+	bindAddress := os.Getenv("BIND_ADDRESS")
+	token := os.Getenv("RELAY_TOKEN")
+	tlsCertFile := os.Getenv("TLS_CERT_FILE")
+	tlsKeyFile := os.Getenv("TLS_KEY_FILE")
+
+	if bindAddress == "" {
+		bindAddress = ":4051"
+	}
+	if token == "" {
+		log.Panic("RELAY_TOKEN is required")
+	}
+	if (tlsCertFile == "") != (tlsKeyFile == "") {
+		log.Panic("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	responseTimeout := 10 * time.Second
+	if v := os.Getenv("RESPONSE_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Panicf("Bad RESPONSE_TIMEOUT: %s", err)
+		}
+		responseTimeout = d
+	}
+	maxQueued, err := intFromEnv("MAX_QUEUED", 1000)
+	if err != nil {
+		log.Panic(err)
+	}
+	maxBodySize, err := intFromEnv("MAX_BODY_SIZE", 25*1024*1024)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	log.Infof("neb-relay (BIND_ADDRESS=%s RESPONSE_TIMEOUT=%s MAX_QUEUED=%d MAX_BODY_SIZE=%d TLS_CERT_FILE=%s)",
+		bindAddress, responseTimeout, maxQueued, maxBodySize, tlsCertFile)
+	srv := relay.NewServer(token, responseTimeout, int64(maxBodySize), maxQueued)
+	if tlsCertFile != "" {
+		err = http.ListenAndServeTLS(bindAddress, tlsCertFile, tlsKeyFile, srv)
+	} else {
+		err = http.ListenAndServe(bindAddress, srv)
+	}
+	log.WithError(err).Panic("Failed to serve")
+}
+
+// intFromEnv parses the named environment variable as a positive integer. Returns def if it is
+// not set.
+func intFromEnv(name string, def int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return def, nil
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil || i <= 0 {
+		return 0, fmt.Errorf("Bad %s: must be a positive integer", name)
+	}
+	return i, nil
+}
@@ -0,0 +1,727 @@
+// Command nebctl administers a running Go-NEB via its admin HTTP API.
+//
+// Usage:
+//
+//	nebctl [-url URL] [-token TOKEN] <command> [arguments]
+//
+// The URL defaults to $NEB_URL, else http://localhost:4050. The token defaults to $ADMIN_TOKEN.
+// Files may be written in JSON or YAML. Run nebctl with no arguments for a list of commands.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/matrix-org/go-neb/config"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const usage = `Usage: nebctl [flags] <command> [arguments]
+
+Commands:
+  services list                           List all services and the rooms they send into
+  services show <id>                      Show a service's config
+  services create <file>                  Create or update a service from a file
+  services dry-run <file>                 Show what "services create" would do, without doing it
+  services validate <file>                Check a service's config for mistakes, without contacting anything
+  services delete <id>                    Delete a service, its webhooks and rooms it no longer needs
+  services check [-repair]                Check every service still works. With -repair, try to fix broken ones
+  services rotate-webhook <id>            Move a service's webhook endpoint to a new URL, printing it
+  services rotate-secret <id> [secret]    Change the secret a service's webhooks are signed with
+  services history <id> [version]        List who changed a service and when, or show one version's configs
+  services rollback <id> <version>        Configure a service as it was after the given version
+  realms list                             List all auth realms
+  realms show <id>                        Show an auth realm's config
+  realms create <file>                    Create or update an auth realm from a file
+  realms delete <id>                      Delete an auth realm
+  sessions request <realm> <user> [file]  Start an auth session for a user, printing the URL to visit
+  sessions remove <realm> <user>          Remove a user's auth session
+  export                                  Print all clients, realms and services as a config file
+  import <file>                           Create or update everything in a config file
+  errors [-f]                             Print recent warnings and errors. With -f, keep printing new ones
+  deliveries list <service>               List a service's recent webhook deliveries
+  deliveries show <id>                    Show a webhook delivery, with secrets redacted
+  deliveries replay <id>                  Pass a webhook delivery to its service again
+  deadletters list [service]              List the webhook deliveries services failed to process
+  deadletters show <id>                   Show a dead letter, with secrets redacted
+  deadletters replay <id>                 Pass a dead letter to its service again, removing it if it succeeds
+  deadletters remove <id>                 Remove a dead letter without replaying it
+  rekey                                   Encrypt the database's secrets with a new data key
+
+Flags:
+`
+
+// An adminClient makes requests to the admin API of a Go-NEB.
+type adminClient struct {
+	url   string
+	token string
+}
+
+// do sends a request to the given admin API path. If body is not nil it is sent as JSON. If
+// response is not nil the JSON response is decoded into it.
+func (c *adminClient) do(method, path string, body interface{}, response interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(c.url, "/")+path, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	resBody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		var jsonErr struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(resBody, &jsonErr) == nil && jsonErr.Message != "" {
+			return fmt.Errorf("%s %s: %d %s", method, path, res.StatusCode, jsonErr.Message)
+		}
+		return fmt.Errorf("%s %s: %d", method, path, res.StatusCode)
+	}
+	if response != nil {
+		return json.Unmarshal(resBody, response)
+	}
+	return nil
+}
+
+func (c *adminClient) export() (*config.Config, error) {
+	var cfg config.Config
+	err := c.do("GET", "/admin/exportConfig", nil, &cfg)
+	return &cfg, err
+}
+
+// readFile reads a JSON or YAML file, returning it as JSON.
+func readFile(path string) (json.RawMessage, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return config.YAMLToJSON(data)
+}
+
+func printJSON(v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
+
+func main() {
+	defaultURL := os.Getenv("NEB_URL")
+	if defaultURL == "" {
+		defaultURL = "http://localhost:4050"
+	}
+	urlFlag := flag.String("url", defaultURL, "The base URL of Go-NEB")
+	tokenFlag := flag.String("token", os.Getenv("ADMIN_TOKEN"), "The ADMIN_TOKEN of Go-NEB, if it has one")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	c := &adminClient{url: *urlFlag, token: *tokenFlag}
+	if err := run(c, flag.Args()); err != nil {
+		fmt.Fprintln(os.Stderr, "nebctl:", err)
+		os.Exit(1)
+	}
+}
+
+func run(c *adminClient, args []string) error {
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	switch args[0] {
+	case "services":
+		return runServices(c, args[1:])
+	case "realms":
+		return runRealms(c, args[1:])
+	case "sessions":
+		return runSessions(c, args[1:])
+	case "export":
+		return runExport(c)
+	case "import":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: nebctl import <file>")
+		}
+		return runImport(c, args[1])
+	case "errors":
+		return runErrors(c, args[1:])
+	case "deliveries":
+		return runDeliveries(c, args[1:])
+	case "deadletters":
+		return runDeadLetters(c, args[1:])
+	case "rekey":
+		return runRekey(c, args[1:])
+	}
+	return fmt.Errorf("unknown command %q", args[0])
+}
+
+// A subcommand is one of the commands of a group such as "services", e.g. "services list".
+type subcommand struct {
+	minArgs, maxArgs int // the number of arguments it takes after its name
+	run              func(c *adminClient, args []string) error
+}
+
+// runSubcommand runs the subcommand named by args[0] with the rest of the args. Returns an error
+// with the group's usage if there is no such subcommand or it is given the wrong number of
+// arguments.
+func runSubcommand(c *adminClient, subcommands map[string]subcommand, usage string, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: %s", usage)
+	}
+	cmd, ok := subcommands[args[0]]
+	if !ok || len(args)-1 < cmd.minArgs || len(args)-1 > cmd.maxArgs {
+		return fmt.Errorf("usage: %s", usage)
+	}
+	return cmd.run(c, args[1:])
+}
+
+const servicesUsage = "nebctl services list|show <id>|create <file>|dry-run <file>|validate <file>|delete <id>|check [-repair]|rotate-webhook <id>|rotate-secret <id> [secret]|history <id> [version]|rollback <id> <version>"
+
+var servicesCommands = map[string]subcommand{
+	"list":           {0, 0, listServices},
+	"show":           {1, 1, showService},
+	"create":         {1, 1, createService},
+	"dry-run":        {1, 1, dryRunService},
+	"validate":       {1, 1, validateService},
+	"delete":         {1, 1, deleteService},
+	"check":          {0, 1, checkServices},
+	"rotate-webhook": {1, 1, rotateWebhook},
+	"rotate-secret":  {1, 2, rotateSecret},
+	"history":        {1, 2, serviceHistory},
+	"rollback":       {2, 2, rollbackService},
+}
+
+func runServices(c *adminClient, args []string) error {
+	return runSubcommand(c, servicesCommands, servicesUsage, args)
+}
+
+func listServices(c *adminClient, args []string) error {
+	var res struct {
+		Services []struct {
+			ID     string
+			Type   string
+			UserID string
+			Rooms  []string
+		}
+	}
+	if err := c.do("GET", "/admin/configureService", nil, &res); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTYPE\tUSER ID\tROOMS")
+	for _, s := range res.Services {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", s.ID, s.Type, s.UserID, strings.Join(s.Rooms, ","))
+	}
+	return w.Flush()
+}
+
+func showService(c *adminClient, args []string) error {
+	var res json.RawMessage
+	if err := c.do("POST", "/admin/getService", map[string]string{"ID": args[0]}, &res); err != nil {
+		return err
+	}
+	return printJSON(res)
+}
+
+func createService(c *adminClient, args []string) error {
+	return configureService(c, "/admin/configureService", args[0])
+}
+
+func dryRunService(c *adminClient, args []string) error {
+	return configureService(c, "/admin/configureService?dry_run=true", args[0])
+}
+
+// configureService posts the service in the file to the given path, printing the response.
+func configureService(c *adminClient, path, file string) error {
+	service, err := readFile(file)
+	if err != nil {
+		return err
+	}
+	var res json.RawMessage
+	if err = c.do("POST", path, service, &res); err != nil {
+		return err
+	}
+	return printJSON(res)
+}
+
+func validateService(c *adminClient, args []string) error {
+	service, err := readFile(args[0])
+	if err != nil {
+		return err
+	}
+	var res struct {
+		Valid  bool
+		Errors []struct {
+			Field   string
+			Message string
+		}
+	}
+	if err = c.do("POST", "/admin/validateService", service, &res); err != nil {
+		return err
+	}
+	if res.Valid {
+		fmt.Println("OK")
+		return nil
+	}
+	for _, e := range res.Errors {
+		fmt.Printf("%s %s\n", e.Field, e.Message)
+	}
+	return fmt.Errorf("invalid config")
+}
+
+func deleteService(c *adminClient, args []string) error {
+	var res struct {
+		Cleaned  []string
+		Problems []string
+	}
+	if err := c.do("DELETE", "/admin/configureService?service_id="+url.QueryEscape(args[0]), nil, &res); err != nil {
+		return err
+	}
+	for _, s := range res.Cleaned {
+		fmt.Println(s)
+	}
+	for _, p := range res.Problems {
+		fmt.Fprintf(os.Stderr, "Problem: %s\n", p)
+	}
+	return nil
+}
+
+func checkServices(c *adminClient, args []string) error {
+	if len(args) == 1 && args[0] != "-repair" {
+		return fmt.Errorf("usage: %s", servicesUsage)
+	}
+	var res struct {
+		Services []struct {
+			ID          string
+			Type        string
+			Problems    []string
+			Repaired    bool
+			RepairError string
+		}
+	}
+	if err := c.do("POST", "/admin/checkServices", map[string]bool{"Repair": len(args) == 1}, &res); err != nil {
+		return err
+	}
+	for _, s := range res.Services {
+		if len(s.Problems) == 0 {
+			fmt.Printf("%s (%s): OK\n", s.ID, s.Type)
+			continue
+		}
+		fmt.Printf("%s (%s):\n", s.ID, s.Type)
+		for _, p := range s.Problems {
+			fmt.Printf("  %s\n", p)
+		}
+		if s.Repaired {
+			fmt.Println("  Repaired")
+		} else if s.RepairError != "" {
+			fmt.Printf("  Failed to repair: %s\n", s.RepairError)
+		}
+	}
+	return nil
+}
+
+func rotateWebhook(c *adminClient, args []string) error {
+	var res struct {
+		WebhookURL string
+	}
+	if err := c.do("POST", "/admin/rotateWebhook", map[string]string{"ID": args[0]}, &res); err != nil {
+		return err
+	}
+	fmt.Println(res.WebhookURL)
+	return nil
+}
+
+func rotateSecret(c *adminClient, args []string) error {
+	body := map[string]string{"ID": args[0]}
+	if len(args) == 2 {
+		body["Secret"] = args[1]
+	}
+	return c.do("POST", "/admin/rotateSecret", body, nil)
+}
+
+// A serviceChange is a version of a service in its history.
+type serviceChange struct {
+	Version   int64
+	Action    string
+	Actor     string
+	Type      string
+	TimeMs    int64
+	OldConfig json.RawMessage `json:",omitempty"`
+	NewConfig json.RawMessage `json:",omitempty"`
+}
+
+func serviceHistory(c *adminClient, args []string) error {
+	var res struct {
+		History []serviceChange
+	}
+	if err := c.do("GET", "/admin/services/"+url.PathEscape(args[0])+"/history", nil, &res); err != nil {
+		return err
+	}
+	if len(args) == 2 {
+		for _, change := range res.History {
+			if fmt.Sprint(change.Version) == args[1] {
+				return printJSON(change)
+			}
+		}
+		return fmt.Errorf("service %s has no version %s", args[0], args[1])
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tTIME\tACTION\tTYPE\tBY")
+	for _, change := range res.History {
+		t := time.Unix(0, change.TimeMs*int64(time.Millisecond)).Format(time.RFC3339)
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", change.Version, t, change.Action, change.Type, change.Actor)
+	}
+	return w.Flush()
+}
+
+func rollbackService(c *adminClient, args []string) error {
+	version, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad version %q", args[1])
+	}
+	var res json.RawMessage
+	if err = c.do("POST", "/admin/services/"+url.PathEscape(args[0])+"/rollback", map[string]int64{"Version": version}, &res); err != nil {
+		return err
+	}
+	return printJSON(res)
+}
+
+const realmsUsage = "nebctl realms list|show <id>|create <file>|delete <id>"
+
+var realmsCommands = map[string]subcommand{
+	"list":   {0, 0, listRealms},
+	"show":   {1, 1, showRealm},
+	"create": {1, 1, createRealm},
+	"delete": {1, 1, deleteRealm},
+}
+
+func runRealms(c *adminClient, args []string) error {
+	return runSubcommand(c, realmsCommands, realmsUsage, args)
+}
+
+func listRealms(c *adminClient, args []string) error {
+	cfg, err := c.export()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTYPE")
+	for _, r := range cfg.Realms {
+		fmt.Fprintf(w, "%s\t%s\n", r.ID, r.Type)
+	}
+	return w.Flush()
+}
+
+func showRealm(c *adminClient, args []string) error {
+	cfg, err := c.export()
+	if err != nil {
+		return err
+	}
+	for _, r := range cfg.Realms {
+		if r.ID == args[0] {
+			return printJSON(r)
+		}
+	}
+	return fmt.Errorf("realm %q not found", args[0])
+}
+
+func createRealm(c *adminClient, args []string) error {
+	realm, err := readFile(args[0])
+	if err != nil {
+		return err
+	}
+	var res json.RawMessage
+	if err = c.do("POST", "/admin/configureAuthRealm", realm, &res); err != nil {
+		return err
+	}
+	return printJSON(res)
+}
+
+func deleteRealm(c *adminClient, args []string) error {
+	return c.do("POST", "/admin/removeAuthRealm", map[string]string{"ID": args[0]}, nil)
+}
+
+const sessionsUsage = "nebctl sessions request <realm> <user> [file]|remove <realm> <user>"
+
+var sessionsCommands = map[string]subcommand{
+	"request": {2, 3, requestSession},
+	"remove":  {2, 2, removeSession},
+}
+
+func runSessions(c *adminClient, args []string) error {
+	return runSubcommand(c, sessionsCommands, sessionsUsage, args)
+}
+
+func requestSession(c *adminClient, args []string) error {
+	sessionConfig := json.RawMessage(`{}`)
+	if len(args) == 3 {
+		var err error
+		if sessionConfig, err = readFile(args[2]); err != nil {
+			return err
+		}
+	}
+	var res json.RawMessage
+	err := c.do("POST", "/admin/requestAuthSession", map[string]interface{}{
+		"RealmID": args[0],
+		"UserID":  args[1],
+		"Config":  sessionConfig,
+	}, &res)
+	if err != nil {
+		return err
+	}
+	return printJSON(res)
+}
+
+func removeSession(c *adminClient, args []string) error {
+	var res json.RawMessage
+	err := c.do("POST", "/admin/removeAuthSession", map[string]string{
+		"RealmID": args[0],
+		"UserID":  args[1],
+	}, &res)
+	if err != nil {
+		return err
+	}
+	return printJSON(res)
+}
+
+// runExport prints Go-NEB's config. JSON is valid YAML, so this can be used as a CONFIG_FILE or
+// passed to "import". Access tokens and secrets are redacted, and the stored ones are kept when it
+// is applied again.
+func runExport(c *adminClient) error {
+	cfg, err := c.export()
+	if err != nil {
+		return err
+	}
+	return printJSON(cfg)
+}
+
+// runImport applies a config file via the admin API. Unlike CONFIG_FILE, nothing is ever deleted.
+func runImport(c *adminClient, path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	cfg, err := config.Parse(data)
+	if err != nil {
+		return err
+	}
+	for _, client := range cfg.Clients {
+		if err := c.do("POST", "/admin/configureClient", client, nil); err != nil {
+			return err
+		}
+		fmt.Println("Configured client", client.UserID)
+	}
+	for _, realm := range cfg.Realms {
+		if err := c.do("POST", "/admin/configureAuthRealm", realm, nil); err != nil {
+			return err
+		}
+		fmt.Println("Configured realm", realm.ID)
+	}
+	for _, session := range cfg.Sessions {
+		// There is no admin API to store an already authenticated session.
+		fmt.Fprintf(os.Stderr, "Skipped session for %s in realm %s: use CONFIG_FILE to declare sessions\n",
+			session.UserID, session.RealmID)
+	}
+	for _, service := range cfg.Services {
+		if err := c.do("POST", "/admin/configureService", service, nil); err != nil {
+			return err
+		}
+		fmt.Println("Configured service", service.ID)
+	}
+	return nil
+}
+
+const deliveriesUsage = "nebctl deliveries list <service>|show <id>|replay <id>"
+
+var deliveriesCommands = map[string]subcommand{
+	"list":   {1, 1, listDeliveries},
+	"show":   {1, 1, showDelivery},
+	"replay": {1, 1, replayDelivery},
+}
+
+func runDeliveries(c *adminClient, args []string) error {
+	return runSubcommand(c, deliveriesCommands, deliveriesUsage, args)
+}
+
+func listDeliveries(c *adminClient, args []string) error {
+	var res struct {
+		Deliveries []struct {
+			ID           string
+			TimeMs       int64
+			Method       string
+			Size         int
+			Truncated    bool
+			ResponseCode int
+		}
+	}
+	if err := c.do("GET", "/admin/webhookDeliveries?service_id="+url.QueryEscape(args[0]), nil, &res); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTIME\tMETHOD\tSIZE\tRESPONSE")
+	for _, d := range res.Deliveries {
+		size := fmt.Sprint(d.Size)
+		if d.Truncated {
+			size += "+"
+		}
+		t := time.Unix(0, d.TimeMs*int64(time.Millisecond)).Format(time.RFC3339)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\n", d.ID, t, d.Method, size, d.ResponseCode)
+	}
+	return w.Flush()
+}
+
+func showDelivery(c *adminClient, args []string) error {
+	return postID(c, "/admin/getWebhookDelivery", args[0])
+}
+
+func replayDelivery(c *adminClient, args []string) error {
+	return postID(c, "/admin/replayWebhookDelivery", args[0])
+}
+
+// postID posts {"ID": id} to the given path, printing the response.
+func postID(c *adminClient, path, id string) error {
+	var res json.RawMessage
+	if err := c.do("POST", path, map[string]string{"ID": id}, &res); err != nil {
+		return err
+	}
+	return printJSON(res)
+}
+
+const deadLettersUsage = "nebctl deadletters list [service]|show <id>|replay <id>|remove <id>"
+
+var deadLettersCommands = map[string]subcommand{
+	"list":   {0, 1, listDeadLetters},
+	"show":   {1, 1, showDeadLetter},
+	"replay": {1, 1, replayDeadLetter},
+	"remove": {1, 1, removeDeadLetter},
+}
+
+func runDeadLetters(c *adminClient, args []string) error {
+	return runSubcommand(c, deadLettersCommands, deadLettersUsage, args)
+}
+
+func listDeadLetters(c *adminClient, args []string) error {
+	path := "/admin/deadLetters"
+	if len(args) == 1 {
+		path += "?service_id=" + url.QueryEscape(args[0])
+	}
+	var res struct {
+		DeadLetters []struct {
+			ID        string
+			ServiceID string
+			TimeMs    int64
+			Attempts  int
+			Reason    string
+		}
+	}
+	if err := c.do("GET", path, nil, &res); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSERVICE\tTIME\tATTEMPTS\tREASON")
+	for _, l := range res.DeadLetters {
+		t := time.Unix(0, l.TimeMs*int64(time.Millisecond)).Format(time.RFC3339)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", l.ID, l.ServiceID, t, l.Attempts, l.Reason)
+	}
+	return w.Flush()
+}
+
+func showDeadLetter(c *adminClient, args []string) error {
+	return postID(c, "/admin/getDeadLetter", args[0])
+}
+
+func replayDeadLetter(c *adminClient, args []string) error {
+	return postID(c, "/admin/replayDeadLetter", args[0])
+}
+
+func removeDeadLetter(c *adminClient, args []string) error {
+	return c.do("POST", "/admin/removeDeadLetter", map[string]string{"ID": args[0]}, nil)
+}
+
+type recentError struct {
+	ID      int64
+	Time    time.Time
+	Level   string
+	Message string
+	Fields  map[string]string
+}
+
+func runErrors(c *adminClient, args []string) error {
+	flags := flag.NewFlagSet("errors", flag.ExitOnError)
+	follow := flags.Bool("f", false, "Keep printing new warnings and errors as they happen")
+	flags.Parse(args)
+
+	var since int64
+	for {
+		var res struct {
+			Errors []recentError
+		}
+		if err := c.do("GET", fmt.Sprintf("/admin/recentErrors?since=%d", since), nil, &res); err != nil {
+			return err
+		}
+		for _, e := range res.Errors {
+			fmt.Printf("%s %-7s %s", e.Time.Format(time.RFC3339), strings.ToUpper(e.Level), e.Message)
+			var keys []string
+			for k := range e.Fields {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				fmt.Printf(" %s=%q", k, e.Fields[k])
+			}
+			fmt.Println()
+			since = e.ID
+		}
+		if !*follow {
+			return nil
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// runRekey encrypts every secret in Go-NEB's database with a new data key.
+func runRekey(c *adminClient, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("usage: nebctl rekey")
+	}
+	var res struct {
+		KeyID       string
+		Reencrypted int
+		Removed     int
+	}
+	if err := c.do("POST", "/admin/rekeyDatabase", nil, &res); err != nil {
+		return err
+	}
+	fmt.Printf("Encrypted %d values with data key %s, removing %d old data keys\n", res.Reencrypted, res.KeyID, res.Removed)
+	return nil
+}
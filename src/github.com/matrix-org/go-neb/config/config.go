@@ -0,0 +1,179 @@
+// Package config loads Go-NEB config files, which declare the clients, realms, sessions and
+// services that Go-NEB should be running with. The config file is written in YAML (or JSON,
+// which is valid YAML) and uses the same field names as the /admin HTTP APIs:
+//
+//	clients:
+//	  - UserID: "@goneb:localhost"
+//	    HomeserverURL: "http://localhost:8008"
+//	    AccessToken: "<access_token>"
+//	    Sync: true
+//	realms:
+//	  - ID: "github_realm"
+//	    Type: "github"
+//	    Config:
+//	      ClientSecret: "YOUR_CLIENT_SECRET"
+//	      ClientID: "YOUR_CLIENT_ID"
+//	sessions:
+//	  - RealmID: "github_realm"
+//	    UserID: "@alice:localhost"
+//	    Config:
+//	      AccessToken: "YOUR_GITHUB_TOKEN"
+//	services:
+//	  - ID: "echo_service"
+//	    Type: "echo"
+//	    UserID: "@goneb:localhost"
+//	    Config: {}
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/matrix-org/go-neb/types"
+	"io/ioutil"
+)
+
+// Config is the parsed representation of a config file.
+type Config struct {
+	Clients  []types.ClientConfig
+	Realms   []Realm
+	Sessions []Session
+	Services []Service
+}
+
+// Realm is an auth realm declared in a config file.
+type Realm struct {
+	ID     string
+	Type   string
+	Config json.RawMessage
+}
+
+// Session is an auth session declared in a config file. Sessions declared this way are already
+// authenticated: the Config must contain whatever the realm needs to act as the user, e.g. an
+// AccessToken.
+type Session struct {
+	SessionID string // Optional. Defaults to the UserID, followed by the label if there is one.
+	RealmID   string
+	UserID    string
+	Config    json.RawMessage
+}
+
+// Label returns the label in the session's Config, which realms with labelled sessions use to tell
+// a user's sessions apart, or the empty label of the user's default session.
+func (s Session) Label() string {
+	var cfg struct {
+		Label string
+	}
+	json.Unmarshal(s.Config, &cfg)
+	return cfg.Label
+}
+
+// Service is a service declared in a config file.
+type Service struct {
+	ID     string
+	Type   string
+	UserID string
+	Config json.RawMessage
+}
+
+// Load reads and parses the config file at the given path.
+func Load(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Parse parses the given config file contents and checks that all required fields are present.
+func Parse(data []byte) (*Config, error) {
+	j, err := YAMLToJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	if err = json.Unmarshal(j, &cfg); err != nil {
+		return nil, err
+	}
+	if err = cfg.check(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// check checks that every section has its required fields and no duplicates.
+func (c *Config) check() error {
+	ids := make(uniqueIDs)
+	for _, check := range []func(uniqueIDs) error{c.checkClients, c.checkRealms, c.checkSessions, c.checkServices} {
+		if err := check(ids); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uniqueIDs are the IDs declared so far, by kind of thing and ID.
+type uniqueIDs map[string]bool
+
+// add adds the ID of the given kind, returning an error if it was already declared.
+func (u uniqueIDs) add(kind, id string) error {
+	if u[kind+"/"+id] {
+		return fmt.Errorf("Duplicate %s: %s", kind, id)
+	}
+	u[kind+"/"+id] = true
+	return nil
+}
+
+func (c *Config) checkClients(ids uniqueIDs) error {
+	for i := range c.Clients {
+		if err := c.Clients[i].Check(); err != nil {
+			return fmt.Errorf("Client %d: %s", i, err)
+		}
+		if err := ids.add("client", c.Clients[i].UserID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Config) checkRealms(ids uniqueIDs) error {
+	for i, r := range c.Realms {
+		if r.ID == "" || r.Type == "" || r.Config == nil {
+			return fmt.Errorf(`Realm %d: Must supply an "ID", a "Type" and a "Config"`, i)
+		}
+		if err := ids.add("realm", r.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkSessions also gives sessions without a SessionID their default one.
+func (c *Config) checkSessions(ids uniqueIDs) error {
+	for i, s := range c.Sessions {
+		if s.RealmID == "" || s.UserID == "" || s.Config == nil {
+			return fmt.Errorf(`Session %d: Must supply a "RealmID", a "UserID" and a "Config"`, i)
+		}
+		if err := ids.add("session", s.RealmID+" "+s.UserID+" "+s.Label()); err != nil {
+			return err
+		}
+		if c.Sessions[i].SessionID == "" {
+			c.Sessions[i].SessionID = s.UserID
+			if label := s.Label(); label != "" {
+				c.Sessions[i].SessionID += " " + label
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Config) checkServices(ids uniqueIDs) error {
+	for i, s := range c.Services {
+		if s.ID == "" || s.Type == "" || s.UserID == "" || s.Config == nil {
+			return fmt.Errorf(`Service %d: Must supply an "ID", a "Type", a "UserID" and a "Config"`, i)
+		}
+		if err := ids.add("service", s.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v2"
+)
+
+// YAMLToJSON converts the given YAML document into JSON. JSON is valid YAML, so it is converted
+// as it is. Duplicate keys are an error, as they are usually a mistake.
+func YAMLToJSON(data []byte) ([]byte, error) {
+	var v interface{}
+	if err := yaml.UnmarshalStrict(data, &v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(jsonValue(v))
+}
+
+// jsonValue converts the mappings in a decoded YAML value, whose keys may be of any type, into
+// maps with string keys, so that it can be encoded as JSON.
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, child := range v {
+			m[fmt.Sprint(k)] = jsonValue(child)
+		}
+		return m
+	case []interface{}:
+		for i, child := range v {
+			v[i] = jsonValue(child)
+		}
+	}
+	return v
+}
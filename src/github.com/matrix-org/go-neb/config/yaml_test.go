@@ -0,0 +1,38 @@
+package config
+
+import (
+	"testing"
+)
+
+var yamltests = []struct {
+	in      string
+	outJSON string
+}{
+	{"a: 1\nb: [x, \"@goneb:localhost\"]\nc:\n  d: ~\n", `{"a":1,"b":["x","@goneb:localhost"],"c":{"d":null}}`},
+	// keys which aren't strings
+	{"1: one\ntrue: yes\n", `{"1":"one","true":true}`},
+	// anchors and aliases
+	{"base: &base\n  Sync: true\nclient:\n  <<: *base\n  UserID: x\n", `{"base":{"Sync":true},"client":{"Sync":true,"UserID":"x"}}`},
+	// JSON
+	{"{\n\t\"a\": [1, 2],\n\t\"b\": null\n}\n", `{"a":[1,2],"b":null}`},
+}
+
+func TestYAMLToJSON(t *testing.T) {
+	for _, yt := range yamltests {
+		j, err := YAMLToJSON([]byte(yt.in))
+		if err != nil {
+			t.Fatalf("YAMLToJSON(%q) => error: %s", yt.in, err)
+		}
+		if string(j) != yt.outJSON {
+			t.Fatalf("YAMLToJSON(%q) => Want %s got %s", yt.in, yt.outJSON, string(j))
+		}
+	}
+}
+
+func TestYAMLToJSONErrors(t *testing.T) {
+	for _, in := range []string{"a: 1\n  b: 2\n", "a: 1\na: 2\n", "a: [1, 2\n"} {
+		if j, err := YAMLToJSON([]byte(in)); err == nil {
+			t.Fatalf("YAMLToJSON(%q) => Want error got %s", in, string(j))
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"github.com/matrix-org/go-neb/errors"
+	"github.com/matrix-org/go-neb/secrets"
+	"github.com/matrix-org/go-neb/types"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// A configField describes a top-level field of a realm or service config, so that the web UI can
+// build a form for each type.
+type configField struct {
+	Name   string
+	Kind   string // "string", "bool", "number", "list" of strings, or "json" for anything else
+	Secret bool   // true if the value is redacted when the config is shown
+}
+
+var secretType = reflect.TypeOf(secrets.Secret{})
+
+// configFields returns the fields a realm or service config of the given type can be decoded
+// from, in the order they are declared.
+func configFields(t reflect.Type) []configField {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	var fields []configField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			fields = append(fields, configFields(f.Type)...)
+			continue
+		}
+		if f.PkgPath != "" {
+			continue // unexported
+		}
+		name := f.Name
+		if tag := strings.Split(f.Tag.Get("json"), ",")[0]; tag == "-" {
+			continue
+		} else if tag != "" {
+			name = tag
+		}
+		fields = append(fields, configField{Name: name, Kind: fieldKind(f.Type), Secret: isSecretKey(name)})
+	}
+	return fields
+}
+
+func fieldKind(t reflect.Type) string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case t == secretType:
+		return "string"
+	case t.Kind() == reflect.String:
+		return "string"
+	case t.Kind() == reflect.Bool:
+		return "bool"
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Float64:
+		return "number"
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.String:
+		return "list"
+	}
+	return "json"
+}
+
+// configTypesHandler returns the fields of every realm and service type's config.
+type configTypesHandler struct{}
+
+func (h *configTypesHandler) OnIncomingRequest(req *http.Request) (interface{}, *errors.HTTPError) {
+	if req.Method != "GET" {
+		return nil, &errors.HTTPError{nil, "Unsupported Method", 405}
+	}
+	res := struct {
+		Services map[string][]configField
+		Realms   map[string][]configField
+	}{make(map[string][]configField), make(map[string][]configField)}
+	for serviceType, srv := range types.ServiceTypes() {
+		res.Services[serviceType] = configFields(reflect.TypeOf(srv))
+	}
+	for realmType, realm := range types.AuthRealmTypes() {
+		res.Realms[realmType] = configFields(reflect.TypeOf(realm))
+	}
+	return &res, nil
+}
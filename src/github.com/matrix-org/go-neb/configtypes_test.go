@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/matrix-org/go-neb/secrets"
+	"reflect"
+	"testing"
+)
+
+type embeddedConfig struct {
+	RealmID string
+}
+
+type testConfig struct {
+	embeddedConfig
+	id          string
+	SecretToken secrets.Secret
+	APIKey      string `json:"api_key"`
+	Ignored     string `json:"-"`
+	Enabled     bool
+	Threshold   int
+	Branches    []string
+	Rooms       map[string]struct{ Repos []string }
+}
+
+func TestConfigFields(t *testing.T) {
+	want := []configField{
+		{"RealmID", "string", false},
+		{"SecretToken", "string", true},
+		{"api_key", "string", true},
+		{"Enabled", "bool", false},
+		{"Threshold", "number", false},
+		{"Branches", "list", false},
+		{"Rooms", "json", false},
+	}
+	if got := configFields(reflect.TypeOf(&testConfig{})); !reflect.DeepEqual(got, want) {
+		t.Errorf("configFields => want %v, got %v", want, got)
+	}
+}
+
+func TestUnredactConfig(t *testing.T) {
+	stored := map[string]interface{}{
+		"SecretToken": "s3cret",
+		"Rooms":       map[string]interface{}{"!a:x": map[string]interface{}{"APIKey": "k1"}},
+		"Keys":        []interface{}{"k2", "k3"},
+	}
+	tests := []struct {
+		in      string
+		stored  interface{}
+		want    string
+		wantErr bool
+	}{
+		{`{"SecretToken":"<redacted>","Rooms":{"!a:x":{"APIKey":"<redacted>"}},"Keys":["new","<redacted>"]}`, stored,
+			`{"Keys":["new","k3"],"Rooms":{"!a:x":{"APIKey":"k1"}},"SecretToken":"s3cret"}`, false},
+		{`{"SecretToken":"changed","Other":"x"}`, stored, `{"Other":"x","SecretToken":"changed"}`, false},
+		{`{"SecretToken":"<redacted>"}`, nil, "", true},
+		{`{"Rooms":{"!b:x":{"APIKey":"<redacted>"}}}`, stored, "", true},
+	}
+	for _, test := range tests {
+		got, httpErr := unredactConfig(json.RawMessage(test.in), test.stored)
+		if test.wantErr {
+			if httpErr == nil || httpErr.Code != 400 {
+				t.Errorf("unredactConfig(%s) => want a 400 error, got %s %v", test.in, got, httpErr)
+			}
+			continue
+		}
+		if httpErr != nil || string(got) != test.want {
+			t.Errorf("unredactConfig(%s) => want %s, got %s %v", test.in, test.want, got, httpErr)
+		}
+	}
+}
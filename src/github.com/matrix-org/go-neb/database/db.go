@@ -2,7 +2,9 @@ package database
 
 import (
 	"database/sql"
+	"encoding/json"
 	"github.com/matrix-org/go-neb/types"
+	"sync"
 	"time"
 )
 
@@ -26,14 +28,48 @@ func GetServiceDB() *ServiceDB {
 	return globalServiceDB
 }
 
+var sessionListeners struct {
+	sync.Mutex
+	fns []func(realmID, userID string)
+}
+
+// OnAuthSessionChange registers a function to call whenever a user's auth sessions in a realm
+// may have changed, e.g. so that anything cached from them can be dropped. The user ID is empty
+// if every session in the realm may have changed, because the realm itself did.
+func OnAuthSessionChange(fn func(realmID, userID string)) {
+	sessionListeners.Lock()
+	defer sessionListeners.Unlock()
+	sessionListeners.fns = append(sessionListeners.fns, fn)
+}
+
+// authSessionChanged calls the OnAuthSessionChange functions. It is called whether or not the
+// change succeeded, as being called needlessly does no harm.
+func authSessionChanged(realmID, userID string) {
+	sessionListeners.Lock()
+	fns := sessionListeners.fns
+	sessionListeners.Unlock()
+	for _, fn := range fns {
+		fn(realmID, userID)
+	}
+}
+
 // Open a SQL database to use as a ServiceDB. This will automatically create
-// the necessary database tables if they aren't already present.
+// the necessary database tables if they aren't already present, and apply any
+// pending migrations to existing ones (see Migration). Secrets are encrypted
+// if SetEncryptionKey was called first. The database type is "sqlite3",
+// "postgres" or "mysql".
 func Open(databaseType, databaseURL string) (serviceDB *ServiceDB, err error) {
-	db, err := sql.Open(databaseType, databaseURL)
+	db, err := openDB(databaseType, databaseURL)
 	if err != nil {
 		return
 	}
-	if _, err = db.Exec(schemaSQL); err != nil {
+	if err = execStatements(db, databaseType, schemaSQL); err != nil {
+		return
+	}
+	if err = migrate(db, databaseType); err != nil {
+		return
+	}
+	if err = loadDataKeys(db); err != nil {
 		return
 	}
 	serviceDB = &ServiceDB{db: db}
@@ -77,6 +113,14 @@ func (d *ServiceDB) LoadMatrixClientConfig(userID string) (config types.ClientCo
 	return
 }
 
+// DeleteMatrixClientConfig deletes the Matrix client config for the given user.
+// No error is returned if the config did not exist in the first place.
+func (d *ServiceDB) DeleteMatrixClientConfig(userID string) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		return deleteMatrixClientConfigTxn(txn, userID)
+	})
+}
+
 // UpdateNextBatch updates the next_batch token for the given user.
 func (d *ServiceDB) UpdateNextBatch(userID, nextBatch string) (err error) {
 	err = runTransaction(d.db, func(txn *sql.Tx) error {
@@ -104,14 +148,137 @@ func (d *ServiceDB) LoadService(serviceID string) (service types.Service, err er
 	return
 }
 
-// DeleteService deletes the given service from the database.
-func (d *ServiceDB) DeleteService(serviceID string) (err error) {
+// DeleteService deletes the given service, and its stored webhook deliveries, dead letters,
+// webhook key, webhook IDs, karma, scheduled jobs, polls and mirrored posts, from the database.
+// The deletion is recorded in the service's history, as made by the given actor.
+func (d *ServiceDB) DeleteService(serviceID, actor string) (err error) {
 	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		serviceType, serviceUserID, serviceJSON, err := selectServiceConfigTxn(txn, serviceID)
+		if err == nil {
+			err = insertServiceChangeTxn(txn, time.Now(), serviceID, types.ServiceChange{
+				Action:    "delete",
+				Actor:     actor,
+				Type:      serviceType,
+				UserID:    serviceUserID,
+				OldConfig: serviceJSON,
+			})
+		}
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if err = deleteWebhookKeyTxn(txn, serviceID); err != nil {
+			return err
+		}
+		if err = deleteWebhookIDsTxn(txn, serviceID); err != nil {
+			return err
+		}
+		if err = deleteWebhookDeliveriesTxn(txn, serviceID); err != nil {
+			return err
+		}
+		if err = deleteDeadLettersTxn(txn, serviceID); err != nil {
+			return err
+		}
+		if err = deleteKarmaTxn(txn, serviceID); err != nil {
+			return err
+		}
+		if err = deleteScheduledJobsTxn(txn, serviceID); err != nil {
+			return err
+		}
+		if err = deletePollsTxn(txn, serviceID); err != nil {
+			return err
+		}
+		if err = deleteMirroredPostsTxn(txn, serviceID); err != nil {
+			return err
+		}
 		return deleteServiceTxn(txn, serviceID)
 	})
 	return
 }
 
+// LoadWebhookKey loads the key in the given service's webhook endpoint URL. Returns "" if the
+// service's endpoint has never been rotated.
+func (d *ServiceDB) LoadWebhookKey(serviceID string) (webhookKey string, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		webhookKey, err = selectWebhookKeyTxn(txn, serviceID)
+		if err == sql.ErrNoRows {
+			webhookKey, err = "", nil
+		}
+		return err
+	})
+	return
+}
+
+// LoadWebhookID loads the ID of the webhook the given service created on a remote system, e.g.
+// "github.com/owner/repo". Returns "" if none is stored.
+func (d *ServiceDB) LoadWebhookID(serviceID, target string) (hookID string, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		hookID, err = selectWebhookIDTxn(txn, serviceID, target)
+		if err == sql.ErrNoRows {
+			hookID, err = "", nil
+		}
+		return err
+	})
+	return
+}
+
+// StoreWebhookID stores the ID of the webhook the given service created on a remote system,
+// replacing any stored for it before.
+func (d *ServiceDB) StoreWebhookID(serviceID, target, hookID string) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		if err := deleteWebhookIDTxn(txn, serviceID, target); err != nil {
+			return err
+		}
+		return insertWebhookIDTxn(txn, time.Now(), serviceID, target, hookID)
+	})
+}
+
+// LoadQueuedMessages loads every message waiting to be sent into a room again, in the order they
+// were queued. Returns an empty list if there are none.
+func (d *ServiceDB) LoadQueuedMessages() (msgs []types.QueuedMessage, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		msgs, err = selectQueuedMessagesTxn(txn)
+		return err
+	})
+	return
+}
+
+// StoreQueuedMessage stores a message waiting to be sent into a room again, replacing the message
+// with the same ID.
+func (d *ServiceDB) StoreQueuedMessage(msg types.QueuedMessage) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		if err := deleteQueuedMessageTxn(txn, msg.ID); err != nil {
+			return err
+		}
+		return insertQueuedMessageTxn(txn, msg)
+	})
+}
+
+// DeleteQueuedMessage deletes a queued message, once it has been sent or given up on.
+func (d *ServiceDB) DeleteQueuedMessage(msgID string) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		return deleteQueuedMessageTxn(txn, msgID)
+	})
+}
+
+// DeleteWebhookID forgets the ID of the webhook the given service created on a remote system, e.g.
+// because it was deleted.
+func (d *ServiceDB) DeleteWebhookID(serviceID, target string) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		return deleteWebhookIDTxn(txn, serviceID, target)
+	})
+}
+
+// StoreWebhookKey stores the key in the given service's webhook endpoint URL, replacing any
+// previous key so that requests to the previous URL are rejected.
+func (d *ServiceDB) StoreWebhookKey(serviceID, webhookKey string) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		if err := deleteWebhookKeyTxn(txn, serviceID); err != nil {
+			return err
+		}
+		return insertWebhookKeyTxn(txn, time.Now(), serviceID, webhookKey)
+	})
+}
+
 // LoadServicesForUser loads all the bot services configured for a given user.
 // Returns an empty list if there aren't any services configured.
 func (d *ServiceDB) LoadServicesForUser(serviceUserID string) (services []types.Service, err error) {
@@ -125,19 +292,68 @@ func (d *ServiceDB) LoadServicesForUser(serviceUserID string) (services []types.
 	return
 }
 
+// LoadServices loads every service in the database, ordered by service ID.
+// Returns an empty list if there aren't any services configured.
+func (d *ServiceDB) LoadServices() (services []types.Service, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		services, err = selectServicesTxn(txn)
+		return err
+	})
+	return
+}
+
 // StoreService stores a service into the database either by inserting a new
 // service or updating an existing service. Returns the old service if there
-// was one.
-func (d *ServiceDB) StoreService(service types.Service) (oldService types.Service, err error) {
+// was one. The change is recorded in the service's history, as made by the
+// given actor.
+func (d *ServiceDB) StoreService(service types.Service, actor string) (oldService types.Service, err error) {
 	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		change := types.ServiceChange{
+			Action: "update",
+			Actor:  actor,
+			Type:   service.ServiceType(),
+			UserID: service.ServiceUserID(),
+		}
+		now := time.Now()
 		oldService, err = selectServiceTxn(txn, service.ServiceID())
 		if err == sql.ErrNoRows {
-			return insertServiceTxn(txn, time.Now(), service)
+			change.Action = "create"
+			err = insertServiceTxn(txn, now, service)
 		} else if err != nil {
 			return err
 		} else {
-			return updateServiceTxn(txn, time.Now(), service)
+			if change.OldConfig, err = json.Marshal(oldService); err != nil {
+				return err
+			}
+			err = updateServiceTxn(txn, now, service)
+		}
+		if err != nil {
+			return err
+		}
+		if change.NewConfig, err = json.Marshal(service); err != nil {
+			return err
 		}
+		return insertServiceChangeTxn(txn, now, service.ServiceID(), change)
+	})
+	return
+}
+
+// LoadServiceHistory loads every recorded change to the given service, newest first. Changes are
+// kept after the service is deleted. Returns an empty list if there are none.
+func (d *ServiceDB) LoadServiceHistory(serviceID string) (changes []types.ServiceChange, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		changes, err = selectServiceChangesTxn(txn, serviceID)
+		return err
+	})
+	return
+}
+
+// LoadServiceChange loads a version of the given service from its history.
+// Returns sql.ErrNoRows if there is no such version.
+func (d *ServiceDB) LoadServiceChange(serviceID string, version int64) (change types.ServiceChange, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		change, err = selectServiceChangeTxn(txn, serviceID, version)
+		return err
 	})
 	return
 }
@@ -152,6 +368,16 @@ func (d *ServiceDB) LoadAuthRealm(realmID string) (realm types.AuthRealm, err er
 	return
 }
 
+// LoadAuthRealms loads every auth realm in the database, ordered by realm ID.
+// Returns an empty list if there are no realms.
+func (d *ServiceDB) LoadAuthRealms() (realms []types.AuthRealm, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		realms, err = selectRealmsTxn(txn)
+		return err
+	})
+	return
+}
+
 // LoadAuthRealmsByType loads all auth realms with the given type from the database.
 // The realms are ordered based on their realm ID.
 // Returns an empty list if there are no realms with that type.
@@ -167,6 +393,7 @@ func (d *ServiceDB) LoadAuthRealmsByType(realmType string) (realms []types.AuthR
 // This function updates the time added/updated values. The previous realm, if any, is
 // returned.
 func (d *ServiceDB) StoreAuthRealm(realm types.AuthRealm) (old types.AuthRealm, err error) {
+	defer authSessionChanged(realm.ID(), "")
 	err = runTransaction(d.db, func(txn *sql.Tx) error {
 		old, err = selectRealmTxn(txn, realm.ID())
 		if err == sql.ErrNoRows {
@@ -180,12 +407,24 @@ func (d *ServiceDB) StoreAuthRealm(realm types.AuthRealm) (old types.AuthRealm,
 	return
 }
 
+// DeleteAuthRealm deletes the given AuthRealm. Auth sessions for the realm are left
+// untouched. No error is returned if the realm did not exist in the first place.
+func (d *ServiceDB) DeleteAuthRealm(realmID string) error {
+	defer authSessionChanged(realmID, "")
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		return deleteRealmTxn(txn, realmID)
+	})
+}
+
 // StoreAuthSession stores the given AuthSession, clobbering based on the tuple of
-// user ID and realm ID. This function updates the time added/updated values.
-// The previous session, if any, is returned.
+// user ID, realm ID and session label (see types.LabelledSession). This function updates
+// the time added/updated values. The previous session, if any, is returned.
 func (d *ServiceDB) StoreAuthSession(session types.AuthSession) (old types.AuthSession, err error) {
+	defer authSessionChanged(session.RealmID(), session.UserID())
 	err = runTransaction(d.db, func(txn *sql.Tx) error {
-		old, err = selectAuthSessionByUserTxn(txn, session.RealmID(), session.UserID())
+		old, err = selectAuthSessionByLabelTxn(
+			txn, session.RealmID(), session.UserID(), types.SessionLabel(session),
+		)
 		if err == sql.ErrNoRows {
 			return insertAuthSessionTxn(txn, time.Now(), session)
 		} else if err != nil {
@@ -197,20 +436,58 @@ func (d *ServiceDB) StoreAuthSession(session types.AuthSession) (old types.AuthS
 	return
 }
 
-// RemoveAuthSession removes the auth session for the given user on the given realm.
-// No error is returned if the session did not exist in the first place.
+// RemoveAuthSession removes every auth session for the given user on the given realm.
+// No error is returned if there were no sessions in the first place.
 func (d *ServiceDB) RemoveAuthSession(realmID, userID string) error {
+	defer authSessionChanged(realmID, userID)
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		return deleteAuthSessionsTxn(txn, realmID, userID)
+	})
+}
+
+// RemoveAuthSessionByLabel removes the auth session with the given label for the given
+// user on the given realm. No error is returned if the session did not exist in the first place.
+func (d *ServiceDB) RemoveAuthSessionByLabel(realmID, userID, label string) error {
+	defer authSessionChanged(realmID, userID)
 	return runTransaction(d.db, func(txn *sql.Tx) error {
-		return deleteAuthSessionTxn(txn, realmID, userID)
+		return deleteAuthSessionTxn(txn, realmID, userID, label)
 	})
 }
 
-// LoadAuthSessionByUser loads an AuthSession from the database based on the given
-// realm and user ID.
+// LoadAuthSessionByUser loads the default AuthSession, which has the empty label, from the
+// database based on the given realm and user ID.
+// Returns sql.ErrNoRows if the session isn't in the database.
+func (d *ServiceDB) LoadAuthSessionByUser(realmID, userID string) (types.AuthSession, error) {
+	return d.LoadAuthSessionByLabel(realmID, userID, "")
+}
+
+// LoadAuthSessionByLabel loads an AuthSession from the database based on the given
+// realm, user ID and session label.
 // Returns sql.ErrNoRows if the session isn't in the database.
-func (d *ServiceDB) LoadAuthSessionByUser(realmID, userID string) (session types.AuthSession, err error) {
+func (d *ServiceDB) LoadAuthSessionByLabel(realmID, userID, label string) (session types.AuthSession, err error) {
 	err = runTransaction(d.db, func(txn *sql.Tx) error {
-		session, err = selectAuthSessionByUserTxn(txn, realmID, userID)
+		session, err = selectAuthSessionByLabelTxn(txn, realmID, userID, label)
+		return err
+	})
+	return
+}
+
+// LoadAuthSessionsByUser loads every AuthSession the given user has in the given realm,
+// ordered by label, so the default session comes first if there is one.
+// Returns an empty list if there are no sessions.
+func (d *ServiceDB) LoadAuthSessionsByUser(realmID, userID string) (sessions []types.AuthSession, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		sessions, err = selectAuthSessionsByUserTxn(txn, realmID, userID)
+		return err
+	})
+	return
+}
+
+// LoadAuthSessions loads every AuthSession for the given realm, ordered by user ID and label.
+// Returns an empty list if there are no sessions.
+func (d *ServiceDB) LoadAuthSessions(realmID string) (sessions []types.AuthSession, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		sessions, err = selectAuthSessionsTxn(txn, realmID)
 		return err
 	})
 	return
@@ -254,6 +531,309 @@ func (d *ServiceDB) StoreBotOptions(opts types.BotOptions) (oldOpts types.BotOpt
 	return
 }
 
+// StoreWebhookDelivery stores an incoming webhook request. Only the most recent keep deliveries
+// for each service are kept: older ones are deleted.
+func (d *ServiceDB) StoreWebhookDelivery(delivery types.WebhookDelivery, keep int) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		if err := insertWebhookDeliveryTxn(txn, delivery); err != nil {
+			return err
+		}
+		return pruneWebhookDeliveriesTxn(txn, delivery.ServiceID, keep)
+	})
+}
+
+// LoadWebhookDelivery loads a stored webhook request.
+// Returns sql.ErrNoRows if the delivery isn't in the database.
+func (d *ServiceDB) LoadWebhookDelivery(deliveryID string) (delivery types.WebhookDelivery, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		delivery, err = selectWebhookDeliveryTxn(txn, deliveryID)
+		return err
+	})
+	return
+}
+
+// LoadWebhookDeliveries loads the stored webhook requests for a service, most recent first.
+// Returns an empty list if there are none.
+func (d *ServiceDB) LoadWebhookDeliveries(serviceID string) (deliveries []types.WebhookDelivery, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		deliveries, err = selectWebhookDeliveriesTxn(txn, serviceID)
+		return err
+	})
+	return
+}
+
+// StoreDeadLetter stores a webhook delivery which a service failed to process, replacing the dead
+// letter for the same delivery if there is one. Only the most recent keep dead letters for each
+// service are kept: older ones are deleted.
+func (d *ServiceDB) StoreDeadLetter(letter types.DeadLetter, keep int) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		if err := deleteDeadLetterTxn(txn, letter.ID); err != nil {
+			return err
+		}
+		if err := insertDeadLetterTxn(txn, letter); err != nil {
+			return err
+		}
+		return pruneDeadLettersTxn(txn, letter.ServiceID, keep)
+	})
+}
+
+// LoadDeadLetter loads the dead letter for a webhook delivery.
+// Returns sql.ErrNoRows if the delivery isn't a dead letter.
+func (d *ServiceDB) LoadDeadLetter(deliveryID string) (letter types.DeadLetter, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		letter, err = selectDeadLetterTxn(txn, deliveryID)
+		return err
+	})
+	return
+}
+
+// LoadDeadLetters loads the dead letters for a service, or for every service if serviceID is
+// empty, most recent first. Returns an empty list if there are none.
+func (d *ServiceDB) LoadDeadLetters(serviceID string) (letters []types.DeadLetter, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		letters, err = selectDeadLettersTxn(txn, serviceID)
+		return err
+	})
+	return
+}
+
+// DeleteDeadLetter deletes the dead letter for a webhook delivery, if there is one.
+func (d *ServiceDB) DeleteDeadLetter(deliveryID string) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		return deleteDeadLetterTxn(txn, deliveryID)
+	})
+}
+
+// LoadManagedResources loads all the managed resources of the given type. Managed resources
+// are things which were created from a config file rather than via the HTTP API. Returns a map
+// of resource ID to the JSON the resource was last declared with.
+func (d *ServiceDB) LoadManagedResources(resourceType string) (resources map[string][]byte, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		resources, err = selectManagedResourcesTxn(txn, resourceType)
+		return err
+	})
+	return
+}
+
+// StoreManagedResource marks the resource with the given type and ID as managed, recording the
+// JSON it was declared with.
+func (d *ServiceDB) StoreManagedResource(resourceType, resourceID string, resourceJSON []byte) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		now := time.Now()
+		updated, err := updateManagedResourceTxn(txn, now, resourceType, resourceID, resourceJSON)
+		if err != nil || updated > 0 {
+			return err
+		}
+		return insertManagedResourceTxn(txn, now, resourceType, resourceID, resourceJSON)
+	})
+}
+
+// RemoveManagedResource stops treating the resource with the given type and ID as managed.
+// The resource itself is left untouched.
+func (d *ServiceDB) RemoveManagedResource(resourceType, resourceID string) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		return deleteManagedResourceTxn(txn, resourceType, resourceID)
+	})
+}
+
+// LoadCryptoState loads the end-to-end encryption state of a Matrix client's device, as stored by
+// StoreCryptoState. Returns a map of key to the JSON stored with it.
+func (d *ServiceDB) LoadCryptoState(userID, deviceID string) (state map[string][]byte, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		state, err = selectCryptoStateTxn(txn, userID, deviceID)
+		return err
+	})
+	return
+}
+
+// StoreCryptoState stores part of the end-to-end encryption state of a Matrix client's device, e.g.
+// its olm account or a megolm session, replacing any stored with the same key.
+func (d *ServiceDB) StoreCryptoState(userID, deviceID, key string, stateJSON []byte) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		now := time.Now()
+		updated, err := updateCryptoStateTxn(txn, now, userID, deviceID, key, stateJSON)
+		if err != nil || updated > 0 {
+			return err
+		}
+		return insertCryptoStateTxn(txn, now, userID, deviceID, key, stateJSON)
+	})
+}
+
+// AddKarma adds delta to the karma the given service has recorded for the name in the room, which
+// starts at 0, and returns the new score.
+func (d *ServiceDB) AddKarma(serviceID, roomID, name string, delta int) (score int, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		updated, err := updateKarmaTxn(txn, time.Now(), serviceID, roomID, name, delta)
+		if err != nil {
+			return err
+		}
+		if updated == 0 {
+			if err = insertKarmaTxn(txn, time.Now(), serviceID, roomID, name, delta); err != nil {
+				return err
+			}
+		}
+		score, err = selectKarmaTxn(txn, serviceID, roomID, name)
+		return err
+	})
+	return
+}
+
+// LoadKarma loads the karma the given service has recorded for the name in the room.
+// Returns sql.ErrNoRows if the name has never been given karma there.
+func (d *ServiceDB) LoadKarma(serviceID, roomID, name string) (score int, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		score, err = selectKarmaTxn(txn, serviceID, roomID, name)
+		return err
+	})
+	return
+}
+
+// LoadTopKarma loads the highest limit karma scores the given service has recorded in the room,
+// highest first. Returns an empty list if there are none.
+func (d *ServiceDB) LoadTopKarma(serviceID, roomID string, limit int) (scores []types.KarmaScore, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		scores, err = selectTopKarmaTxn(txn, serviceID, roomID, limit)
+		return err
+	})
+	return
+}
+
+// StoreScheduledJob stores a job for a service to run later, replacing the job with the same ID.
+func (d *ServiceDB) StoreScheduledJob(job types.ScheduledJob) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		if err := deleteScheduledJobTxn(txn, job.ID); err != nil {
+			return err
+		}
+		return insertScheduledJobTxn(txn, job)
+	})
+}
+
+// LoadDueScheduledJobs loads the scheduled jobs which are due at the given time, in milliseconds
+// since the Unix epoch, earliest first.
+func (d *ServiceDB) LoadDueScheduledJobs(nowMs int64) (jobs []types.ScheduledJob, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		jobs, err = selectDueScheduledJobsTxn(txn, nowMs)
+		return err
+	})
+	return
+}
+
+// LoadNextScheduledJobDue loads when the earliest scheduled job is due, in milliseconds since the
+// Unix epoch. Returns sql.ErrNoRows if there are no scheduled jobs.
+func (d *ServiceDB) LoadNextScheduledJobDue() (dueMs int64, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		dueMs, err = selectNextScheduledJobDueTxn(txn)
+		return err
+	})
+	return
+}
+
+// DeleteScheduledJob deletes a scheduled job, if it exists.
+func (d *ServiceDB) DeleteScheduledJob(jobID string) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		return deleteScheduledJobTxn(txn, jobID)
+	})
+}
+
+// DeleteScheduledJobs deletes every job the given service has scheduled.
+func (d *ServiceDB) DeleteScheduledJobs(serviceID string) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		return deleteScheduledJobsTxn(txn, serviceID)
+	})
+}
+
+// LoadPoll loads the poll the given service has open in the room. Returns sql.ErrNoRows if there
+// isn't one.
+func (d *ServiceDB) LoadPoll(serviceID, roomID string) (poll types.Poll, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		poll, err = selectPollTxn(txn, serviceID, roomID)
+		return err
+	})
+	return
+}
+
+// StorePoll stores the poll, replacing the one its service had open in its room.
+func (d *ServiceDB) StorePoll(poll types.Poll) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		now := time.Now()
+		updated, err := updatePollTxn(txn, now, poll)
+		if err != nil || updated > 0 {
+			return err
+		}
+		return insertPollTxn(txn, now, poll)
+	})
+}
+
+// DeletePoll deletes the poll the given service has open in the room, if there is one.
+func (d *ServiceDB) DeletePoll(serviceID, roomID string) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		return deletePollTxn(txn, serviceID, roomID)
+	})
+}
+
+// MarkPostMirrored records that the given service has mirrored the post into the room. Returns
+// false if it already had.
+func (d *ServiceDB) MarkPostMirrored(serviceID, roomID, postID string) (marked bool, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		mirrored, err := selectMirroredPostTxn(txn, serviceID, roomID, postID)
+		if err != nil || mirrored {
+			return err
+		}
+		marked = true
+		return insertMirroredPostTxn(txn, time.Now(), serviceID, roomID, postID)
+	})
+	return
+}
+
+// ForgetMirroredPost forgets that the given service mirrored the post into the room, e.g. because
+// sending it failed, so that it can be marked again.
+func (d *ServiceDB) ForgetMirroredPost(serviceID, roomID, postID string) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		return deleteMirroredPostTxn(txn, serviceID, roomID, postID)
+	})
+}
+
+// DeleteMirroredPostsBefore forgets the posts the given service mirrored before the given time.
+func (d *ServiceDB) DeleteMirroredPostsBefore(serviceID string, before time.Time) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		return deleteMirroredPostsBeforeTxn(txn, serviceID, before)
+	})
+}
+
+// StoreSilence stores the silence, replacing any of the same thing in its room, and forgets the
+// room's expired silences.
+func (d *ServiceDB) StoreSilence(silence types.Silence) error {
+	return runTransaction(d.db, func(txn *sql.Tx) error {
+		now := time.Now()
+		if err := deleteExpiredSilencesTxn(txn, silence.RoomID, now); err != nil {
+			return err
+		}
+		if _, err := deleteSilenceTxn(txn, silence.RoomID, silence.Matcher); err != nil {
+			return err
+		}
+		return insertSilenceTxn(txn, now, silence)
+	})
+}
+
+// LoadSilences loads the silences in the room which haven't expired, those expiring soonest first.
+func (d *ServiceDB) LoadSilences(roomID string) (silences []types.Silence, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		silences, err = selectSilencesTxn(txn, roomID, time.Now())
+		return err
+	})
+	return
+}
+
+// DeleteSilence deletes the silence of the matcher in the room. Returns false if there wasn't one.
+func (d *ServiceDB) DeleteSilence(roomID, matcher string) (deleted bool, err error) {
+	err = runTransaction(d.db, func(txn *sql.Tx) error {
+		n, err := deleteSilenceTxn(txn, roomID, matcher)
+		deleted = n > 0
+		return err
+	})
+	return
+}
+
 func runTransaction(db *sql.DB, fn func(txn *sql.Tx) error) (err error) {
 	txn, err := db.Begin()
 	if err != nil {
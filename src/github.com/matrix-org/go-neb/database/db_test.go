@@ -0,0 +1,554 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/plugin"
+	"github.com/matrix-org/go-neb/types"
+	_ "github.com/mattn/go-sqlite3"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testDatabaseURLs name the environment variables holding the URLs of the PostgreSQL and MySQL
+// databases to run the database tests on as well as SQLite, e.g. those started by
+// docker-compose.test.yml. The tests drop every table in them. Those which aren't set are skipped.
+var testDatabaseURLs = map[string]string{
+	"postgres": "NEB_TEST_POSTGRES_URL",
+	"mysql":    "NEB_TEST_MYSQL_URL",
+}
+
+// forEachDatabase runs the test on an empty database of each type.
+func forEachDatabase(t *testing.T, test func(t *testing.T, db *ServiceDB)) {
+	for _, databaseType := range []string{"sqlite3", "postgres", "mysql"} {
+		t.Run(databaseType, func(t *testing.T) {
+			databaseURL := emptyDatabase(t, databaseType)
+			db, err := Open(databaseType, databaseURL)
+			if err != nil {
+				t.Fatalf("Open(%s) => %s", databaseType, err)
+			}
+			defer db.db.Close()
+			test(t, db)
+		})
+	}
+}
+
+// emptyDatabase returns the URL of an empty database of the given type, skipping the test if there
+// isn't one to use.
+func emptyDatabase(t *testing.T, databaseType string) string {
+	if databaseType == "sqlite3" {
+		return filepath.Join(t.TempDir(), "go-neb.db")
+	}
+	databaseURL := os.Getenv(testDatabaseURLs[databaseType])
+	if databaseURL == "" {
+		t.Skipf("%s is not set", testDatabaseURLs[databaseType])
+	}
+	db, err := openDB(databaseType, databaseURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var stmts []string
+	if databaseType == "postgres" {
+		stmts = []string{"DROP SCHEMA public CASCADE", "CREATE SCHEMA public"}
+	} else {
+		var rows *sql.Rows
+		if rows, err = db.Query("SELECT table_name FROM information_schema.tables WHERE table_schema = DATABASE()"); err != nil {
+			t.Fatal(err)
+		}
+		for rows.Next() {
+			var table string
+			if err = rows.Scan(&table); err != nil {
+				t.Fatal(err)
+			}
+			stmts = append(stmts, "DROP TABLE "+table)
+		}
+		rows.Close()
+	}
+	for _, stmt := range stmts {
+		if _, err = db.Exec(stmt); err != nil {
+			t.Fatalf("%s: %s", stmt, err)
+		}
+	}
+	return databaseURL
+}
+
+type testService struct {
+	id     string
+	userID string
+	Secret string
+	Rooms  []string
+}
+
+func (s *testService) ServiceUserID() string { return s.userID }
+func (s *testService) ServiceID() string     { return s.id }
+func (s *testService) ServiceType() string   { return "test-db" }
+func (s *testService) Plugin(cli *matrix.Client, roomID string) plugin.Plugin {
+	return plugin.Plugin{}
+}
+func (s *testService) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli *matrix.Client) {
+}
+func (s *testService) ValidateConfig() []types.ConfigError                            { return nil }
+func (s *testService) Register(oldService types.Service, client *matrix.Client) error { return nil }
+func (s *testService) PostRegister(oldService types.Service)                          {}
+
+type testRealm struct {
+	id           string
+	ClientSecret string
+}
+
+func (r *testRealm) ID() string                                                 { return r.id }
+func (r *testRealm) Type() string                                               { return "test-db" }
+func (r *testRealm) Init() error                                                { return nil }
+func (r *testRealm) Register() error                                            { return nil }
+func (r *testRealm) OnReceiveRedirect(w http.ResponseWriter, req *http.Request) {}
+func (r *testRealm) RequestAuthSession(userID string, config json.RawMessage) interface{} {
+	return nil
+}
+func (r *testRealm) AuthSession(id, userID, realmID string) types.AuthSession {
+	return &testSession{id: id, userID: userID, realmID: realmID}
+}
+
+type testSession struct {
+	id      string
+	userID  string
+	realmID string
+	Label   string
+	Token   string
+}
+
+func (s *testSession) ID() string           { return s.id }
+func (s *testSession) UserID() string       { return s.userID }
+func (s *testSession) RealmID() string      { return s.realmID }
+func (s *testSession) Authenticated() bool  { return s.Token != "" }
+func (s *testSession) Info() interface{}    { return nil }
+func (s *testSession) SessionLabel() string { return s.Label }
+
+func init() {
+	types.RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) types.Service {
+		return &testService{id: serviceID, userID: serviceUserID}
+	})
+	types.RegisterAuthRealm(func(realmID, redirectURL string) types.AuthRealm {
+		return &testRealm{id: realmID}
+	})
+}
+
+func TestOpenAppliesMigrations(t *testing.T) {
+	for _, databaseType := range []string{"sqlite3", "postgres", "mysql"} {
+		t.Run(databaseType, func(t *testing.T) {
+			databaseURL := emptyDatabase(t, databaseType)
+			// Opening the database again must find the schema already there and the migrations applied.
+			for i := 0; i < 2; i++ {
+				db, err := Open(databaseType, databaseURL)
+				if err != nil {
+					t.Fatalf("Open #%d => %s", i+1, err)
+				}
+				db.db.Close()
+			}
+			pending, err := PendingMigrations(databaseType, databaseURL)
+			if err != nil || len(pending) != 0 {
+				t.Errorf("PendingMigrations => want none, got %v, %v", pending, err)
+			}
+		})
+	}
+}
+
+func TestMigrateAuthSessionLabels(t *testing.T) {
+	// Only SQLite databases are old enough to have auth sessions without labels.
+	databaseURL := filepath.Join(t.TempDir(), "go-neb.db")
+	old, err := sql.Open("sqlite3", databaseURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = old.Exec(`
+CREATE TABLE auth_sessions (
+	session_id TEXT NOT NULL,
+	realm_id TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+	session_json TEXT NOT NULL,
+	time_added_ms BIGINT NOT NULL,
+	time_updated_ms BIGINT NOT NULL,
+	UNIQUE(realm_id, user_id),
+	UNIQUE(realm_id, session_id)
+);
+INSERT INTO auth_sessions VALUES ('s1', 'realm', '@alice:localhost', '{"Token":"t1"}', 1, 1);
+`)
+	old.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := Open("sqlite3", databaseURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.db.Close()
+	if _, err = db.StoreAuthRealm(&testRealm{id: "realm"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.StoreAuthSession(&testSession{id: "s2", userID: "@alice:localhost", realmID: "realm", Label: "work", Token: "t2"}); err != nil {
+		t.Fatalf("StoreAuthSession with a label after migrating => %s", err)
+	}
+	sessions, err := db.LoadAuthSessionsByUser("realm", "@alice:localhost")
+	if err != nil || len(sessions) != 2 {
+		t.Errorf("LoadAuthSessionsByUser => want the old session and the labelled one, got %v, %v", sessions, err)
+	}
+}
+
+func TestMatrixClientConfigs(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, db *ServiceDB) {
+		config := types.ClientConfig{UserID: "@neb:localhost", HomeserverURL: "http://localhost:8008", AccessToken: "tok"}
+		if _, err := db.StoreMatrixClientConfig(config); err != nil {
+			t.Fatal(err)
+		}
+		config.AccessToken = "tok2"
+		old, err := db.StoreMatrixClientConfig(config)
+		if err != nil || old.AccessToken != "tok" {
+			t.Errorf("StoreMatrixClientConfig again => want the old config, got %+v, %v", old, err)
+		}
+		if err = db.UpdateNextBatch(config.UserID, "s123"); err != nil {
+			t.Fatal(err)
+		}
+		nextBatch, err := db.LoadNextBatch(config.UserID)
+		if err != nil || nextBatch != "s123" {
+			t.Errorf("LoadNextBatch => want s123, got %q, %v", nextBatch, err)
+		}
+		configs, err := db.LoadMatrixClientConfigs()
+		if err != nil || !reflect.DeepEqual(configs, []types.ClientConfig{config}) {
+			t.Errorf("LoadMatrixClientConfigs => want %+v, got %+v, %v", config, configs, err)
+		}
+		if err = db.DeleteMatrixClientConfig(config.UserID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = db.LoadMatrixClientConfig(config.UserID); err != sql.ErrNoRows {
+			t.Errorf("LoadMatrixClientConfig after deleting => want sql.ErrNoRows, got %v", err)
+		}
+	})
+}
+
+// storeServiceTwice stores a service, then stores it again with another room, returning it.
+func storeServiceTwice(t *testing.T, db *ServiceDB) *testService {
+	srv := &testService{id: "svc", userID: "@neb:localhost", Secret: "s3cret", Rooms: []string{"!a:localhost"}}
+	if old, err := db.StoreService(srv, "test"); err != nil || old != nil {
+		t.Fatalf("StoreService => want no old service, got %v, %v", old, err)
+	}
+	srv.Rooms = append(srv.Rooms, "!b:localhost")
+	old, err := db.StoreService(srv, "test")
+	if err != nil || len(old.(*testService).Rooms) != 1 {
+		t.Fatalf("StoreService again => want the old service, got %+v, %v", old, err)
+	}
+	return srv
+}
+
+// checkServiceHistory checks that the service stored by storeServiceTwice, then deleted, has a
+// change for each.
+func checkServiceHistory(t *testing.T, db *ServiceDB) {
+	changes, err := db.LoadServiceHistory("svc")
+	if err != nil || len(changes) != 3 {
+		t.Fatalf("LoadServiceHistory => want 3 changes, got %+v, %v", changes, err)
+	}
+	for i, action := range []string{"delete", "update", "create"} {
+		if changes[i].Action != action || changes[i].Version != int64(3-i) {
+			t.Errorf("LoadServiceHistory => want change %d to be version %d, %s, got %+v", i, 3-i, action, changes[i])
+		}
+	}
+	if change, err := db.LoadServiceChange("svc", 2); err != nil || change.Action != "update" || len(change.OldConfig) == 0 {
+		t.Errorf("LoadServiceChange(2) => want the update, got %+v, %v", change, err)
+	}
+}
+
+func TestServicesAndHistory(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, db *ServiceDB) {
+		srv := storeServiceTwice(t, db)
+		loaded, err := db.LoadService("svc")
+		if err != nil || !reflect.DeepEqual(loaded, srv) {
+			t.Errorf("LoadService => want %+v, got %+v, %v", srv, loaded, err)
+		}
+		services, err := db.LoadServicesForUser("@neb:localhost")
+		if err != nil || len(services) != 1 {
+			t.Errorf("LoadServicesForUser => want the service, got %v, %v", services, err)
+		}
+		if err = db.DeleteService("svc", "test"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = db.LoadService("svc"); err != sql.ErrNoRows {
+			t.Errorf("LoadService after deleting => want sql.ErrNoRows, got %v", err)
+		}
+		checkServiceHistory(t, db)
+	})
+}
+
+func TestWebhookKeys(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, db *ServiceDB) {
+		for _, key := range []string{"key1", "key2"} {
+			if err := db.StoreWebhookKey("svc", key); err != nil {
+				t.Fatal(err)
+			}
+		}
+		key, err := db.LoadWebhookKey("svc")
+		if err != nil || key != "key2" {
+			t.Errorf("LoadWebhookKey => want key2, got %q, %v", key, err)
+		}
+	})
+}
+
+// storeTestSessions stores sessions of @alice:localhost with the realm "realm": a default
+// session, s3, which replaced s1, and a labelled one, s2.
+func storeTestSessions(t *testing.T, db *ServiceDB) {
+	for _, s := range []*testSession{
+		{id: "s1", userID: "@alice:localhost", realmID: "realm", Token: "t1"},
+		{id: "s2", userID: "@alice:localhost", realmID: "realm", Label: "work", Token: "t2"},
+		{id: "s3", userID: "@alice:localhost", realmID: "realm", Token: "t3"}, // replaces s1
+	} {
+		if _, err := db.StoreAuthSession(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAuthRealmsAndSessions(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, db *ServiceDB) {
+		if _, err := db.StoreAuthRealm(&testRealm{id: "realm", ClientSecret: "a"}); err != nil {
+			t.Fatal(err)
+		}
+		if old, err := db.StoreAuthRealm(&testRealm{id: "realm", ClientSecret: "b"}); err != nil || old.(*testRealm).ClientSecret != "a" {
+			t.Errorf("StoreAuthRealm again => want the old realm, got %+v, %v", old, err)
+		}
+		storeTestSessions(t, db)
+		session, err := db.LoadAuthSessionByUser("realm", "@alice:localhost")
+		if err != nil || session.(*testSession).Token != "t3" {
+			t.Errorf("LoadAuthSessionByUser => want the replaced session, got %+v, %v", session, err)
+		}
+		session, err = db.LoadAuthSessionByID("realm", "s2")
+		if err != nil || session.(*testSession).Label != "work" {
+			t.Errorf("LoadAuthSessionByID(s2) => want the labelled session, got %+v, %v", session, err)
+		}
+		if err = db.RemoveAuthSessionByLabel("realm", "@alice:localhost", "work"); err != nil {
+			t.Fatal(err)
+		}
+		if sessions, err := db.LoadAuthSessions("realm"); err != nil || len(sessions) != 1 {
+			t.Errorf("LoadAuthSessions => want 1 session, got %v, %v", sessions, err)
+		}
+	})
+}
+
+// storeUnchangedRows stores the same rows for the nth time.
+func storeUnchangedRows(t *testing.T, db *ServiceDB, n int) {
+	if err := db.StoreManagedResource("service", "svc", []byte(`{"a":1}`)); err != nil {
+		t.Fatalf("StoreManagedResource #%d => %s", n, err)
+	}
+	if err := db.StoreCryptoState("@neb:localhost", "DEVICE", "account", []byte(`{"b":2}`)); err != nil {
+		t.Fatalf("StoreCryptoState #%d => %s", n, err)
+	}
+	if err := db.StorePoll(types.Poll{ServiceID: "svc", RoomID: "!a:localhost", Question: "?"}); err != nil {
+		t.Fatalf("StorePoll #%d => %s", n, err)
+	}
+	opts := types.BotOptions{UserID: "@neb:localhost", RoomID: "!a:localhost", Options: map[string]interface{}{"x": "y"}}
+	if _, err := db.StoreBotOptions(opts); err != nil {
+		t.Fatalf("StoreBotOptions #%d => %s", n, err)
+	}
+	if _, err := db.AddKarma("svc", "!a:localhost", "alice", 0); err != nil {
+		t.Fatalf("AddKarma(0) #%d => %s", n, err)
+	}
+}
+
+// The Store functions which update a row if there is one and insert one otherwise must update the
+// row even when nothing in it changes, so they mustn't rely on a database counting only the rows
+// an UPDATE changed.
+func TestUpsertsOfUnchangedRows(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, db *ServiceDB) {
+		for i := 0; i < 2; i++ {
+			storeUnchangedRows(t, db, i+1)
+		}
+		if resources, err := db.LoadManagedResources("service"); err != nil || string(resources["svc"]) != `{"a":1}` {
+			t.Errorf("LoadManagedResources => got %s, %v", resources, err)
+		}
+		if state, err := db.LoadCryptoState("@neb:localhost", "DEVICE"); err != nil || string(state["account"]) != `{"b":2}` {
+			t.Errorf("LoadCryptoState => got %s, %v", state, err)
+		}
+		if poll, err := db.LoadPoll("svc", "!a:localhost"); err != nil || poll.Question != "?" {
+			t.Errorf("LoadPoll => got %+v, %v", poll, err)
+		}
+	})
+}
+
+func TestKarma(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, db *ServiceDB) {
+		for _, delta := range []int{1, 1, -3} {
+			if _, err := db.AddKarma("svc", "!a:localhost", "alice", delta); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := db.AddKarma("svc", "!a:localhost", "bob", 5); err != nil {
+			t.Fatal(err)
+		}
+		if score, err := db.LoadKarma("svc", "!a:localhost", "alice"); err != nil || score != -1 {
+			t.Errorf("LoadKarma(alice) => want -1, got %d, %v", score, err)
+		}
+		scores, err := db.LoadTopKarma("svc", "!a:localhost", 1)
+		if want := []types.KarmaScore{{Name: "bob", Score: 5}}; err != nil || !reflect.DeepEqual(scores, want) {
+			t.Errorf("LoadTopKarma(1) => want %+v, got %+v, %v", want, scores, err)
+		}
+	})
+}
+
+func TestWebhookDeliveriesAreKept(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, db *ServiceDB) {
+		for i, id := range []string{"d1", "d2", "d3", "d4"} {
+			delivery := types.WebhookDelivery{ID: id, ServiceID: "svc", TimeMs: int64(i + 1), Body: "{}"}
+			if err := db.StoreWebhookDelivery(delivery, 2); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.StoreDeadLetter(types.DeadLetter{WebhookDelivery: delivery, Reason: "oops"}, 2); err != nil {
+				t.Fatal(err)
+			}
+		}
+		deliveries, err := db.LoadWebhookDeliveries("svc")
+		if err != nil || len(deliveries) != 2 || deliveries[0].ID != "d4" || deliveries[1].ID != "d3" {
+			t.Errorf("LoadWebhookDeliveries => want d4 and d3, got %+v, %v", deliveries, err)
+		}
+		letters, err := db.LoadDeadLetters("svc")
+		if err != nil || len(letters) != 2 {
+			t.Errorf("LoadDeadLetters => want 2, got %+v, %v", letters, err)
+		}
+		if err = db.DeleteDeadLetter("d4"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = db.LoadDeadLetter("d4"); err != sql.ErrNoRows {
+			t.Errorf("LoadDeadLetter after deleting => want sql.ErrNoRows, got %v", err)
+		}
+	})
+}
+
+func TestScheduledJobs(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, db *ServiceDB) {
+		for _, job := range []types.ScheduledJob{
+			{ID: "j1", ServiceID: "svc", DueMs: 200, Data: json.RawMessage(`{}`)},
+			{ID: "j2", ServiceID: "svc", DueMs: 100, Data: json.RawMessage(`{}`)},
+			{ID: "j1", ServiceID: "svc", DueMs: 300, Data: json.RawMessage(`{}`)}, // replaces j1
+		} {
+			if err := db.StoreScheduledJob(job); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if dueMs, err := db.LoadNextScheduledJobDue(); err != nil || dueMs != 100 {
+			t.Errorf("LoadNextScheduledJobDue => want 100, got %d, %v", dueMs, err)
+		}
+		if jobs, err := db.LoadDueScheduledJobs(250); err != nil || len(jobs) != 1 || jobs[0].ID != "j2" {
+			t.Errorf("LoadDueScheduledJobs(250) => want j2, got %+v, %v", jobs, err)
+		}
+		if err := db.DeleteScheduledJobs("svc"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.LoadNextScheduledJobDue(); err != sql.ErrNoRows {
+			t.Errorf("LoadNextScheduledJobDue after deleting => want sql.ErrNoRows, got %v", err)
+		}
+	})
+}
+
+func TestQueuedMessages(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, db *ServiceDB) {
+		for _, msg := range []types.QueuedMessage{
+			{ID: "m2", RoomID: "!a:localhost", Seq: 2, Content: json.RawMessage(`{}`)},
+			{ID: "m1", RoomID: "!a:localhost", Seq: 1, Content: json.RawMessage(`{}`)},
+		} {
+			if err := db.StoreQueuedMessage(msg); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if msgs, err := db.LoadQueuedMessages(); err != nil || len(msgs) != 2 || msgs[0].ID != "m1" {
+			t.Errorf("LoadQueuedMessages => want m1 then m2, got %+v, %v", msgs, err)
+		}
+	})
+}
+
+func TestSilences(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, db *ServiceDB) {
+		expires := time.Now().Add(time.Hour).UnixNano() / 1000000
+		if err := db.StoreSilence(types.Silence{RoomID: "!a:localhost", Matcher: "repo", ExpiresMs: expires}); err != nil {
+			t.Fatal(err)
+		}
+		if silences, err := db.LoadSilences("!a:localhost"); err != nil || len(silences) != 1 {
+			t.Errorf("LoadSilences => want 1, got %+v, %v", silences, err)
+		}
+		for _, want := range []bool{true, false} {
+			if deleted, err := db.DeleteSilence("!a:localhost", "repo"); err != nil || deleted != want {
+				t.Errorf("DeleteSilence => want %v, got %v, %v", want, deleted, err)
+			}
+		}
+	})
+}
+
+func TestMirroredPosts(t *testing.T) {
+	forEachDatabase(t, func(t *testing.T, db *ServiceDB) {
+		for _, want := range []bool{true, false} {
+			if marked, err := db.MarkPostMirrored("svc", "!a:localhost", "post"); err != nil || marked != want {
+				t.Errorf("MarkPostMirrored => want %v, got %v, %v", want, marked, err)
+			}
+		}
+		if err := db.DeleteMirroredPostsBefore("svc", time.Now().Add(time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+		if marked, err := db.MarkPostMirrored("svc", "!a:localhost", "post"); err != nil || !marked {
+			t.Errorf("MarkPostMirrored after forgetting => want true, got %v, %v", marked, err)
+		}
+	})
+}
+
+// checkEncrypted fails the test unless the first value of the column, given as "column FROM table",
+// is encrypted.
+func checkEncrypted(t *testing.T, db *ServiceDB, column string) {
+	var stored string
+	if err := db.db.QueryRow("SELECT " + column).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(stored, encryptedPrefix) {
+		t.Errorf("%s => want it encrypted, got %s", column, stored)
+	}
+}
+
+func TestRekey(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	if err := SetEncryptionKey(key, ""); err != nil {
+		t.Fatal(err)
+	}
+	defer SetEncryptionKey("", "")
+	forEachDatabase(t, func(t *testing.T, db *ServiceDB) {
+		srv := &testService{id: "svc", userID: "@neb:localhost", Secret: "s3cret"}
+		if _, err := db.StoreService(srv, "test"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.StoreWebhookKey("svc", "hook-key"); err != nil {
+			t.Fatal(err)
+		}
+		for _, column := range []string{"service_json FROM services", "webhook_key FROM webhook_keys"} {
+			checkEncrypted(t, db, column)
+		}
+		result, err := db.Rekey()
+		if err != nil || result.Reencrypted == 0 || result.Removed != 1 {
+			t.Errorf("Rekey => got %+v, %v", result, err)
+		}
+		checkRekeyedService(t, db, srv)
+	})
+}
+
+// checkRekeyedService fails the test unless the service, its webhook key "hook-key" and its history
+// can still be loaded after Rekey.
+func checkRekeyedService(t *testing.T, db *ServiceDB, srv *testService) {
+	if loaded, err := db.LoadService(srv.id); err != nil || !reflect.DeepEqual(loaded, srv) {
+		t.Errorf("LoadService after Rekey => want %+v, got %+v, %v", srv, loaded, err)
+	}
+	if webhookKey, err := db.LoadWebhookKey(srv.id); err != nil || webhookKey != "hook-key" {
+		t.Errorf("LoadWebhookKey after Rekey => want hook-key, got %q, %v", webhookKey, err)
+	}
+	if changes, err := db.LoadServiceHistory(srv.id); err != nil || len(changes) != 1 || changes[0].NewConfig == nil {
+		t.Errorf("LoadServiceHistory after Rekey => want 1 change, got %+v, %v", changes, err)
+	}
+}
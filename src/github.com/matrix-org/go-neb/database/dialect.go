@@ -0,0 +1,290 @@
+package database
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The queries in this package are written for SQLite, with PostgreSQL's numbered placeholders
+// such as $1, which SQLite also accepts. PostgreSQL and MySQL are opened through drivers which
+// wrap theirs to smooth over the differences which remain, and their schemas are adjusted by
+// dialectStatements.
+func init() {
+	sql.Register("neb-postgres", &dialectDriver{Driver: &pq.Driver{}, bytesAsText: true})
+	sql.Register("neb-mysql", &dialectDriver{Driver: &mysql.MySQLDriver{}, questionMarks: true, dsn: mysqlDSN})
+}
+
+// driverNames are the database/sql drivers used for each DATABASE_TYPE.
+var driverNames = map[string]string{
+	"sqlite3":  "sqlite3",
+	"postgres": "neb-postgres",
+	"mysql":    "neb-mysql",
+}
+
+// openDB opens the database of the given type, which must be "sqlite3", "postgres" or "mysql".
+func openDB(databaseType, databaseURL string) (*sql.DB, error) {
+	driverName, ok := driverNames[databaseType]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported DATABASE_TYPE %q: must be sqlite3, postgres or mysql", databaseType)
+	}
+	return sql.Open(driverName, databaseURL)
+}
+
+// execStatements runs each of the semicolon separated statements of a script in turn, as
+// PostgreSQL and MySQL can't prepare several statements at once. Statements for MySQL are
+// adjusted by dialectStatements.
+func execStatements(db interface {
+	Exec(string, ...interface{}) (sql.Result, error)
+}, databaseType, script string) error {
+	for _, stmt := range dialectStatements(databaseType, script) {
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("%s: %s", err, strings.TrimSpace(stmt))
+		}
+	}
+	return nil
+}
+
+// splitStatements splits a script into its statements. Semicolons only end statements at the end
+// of a line, so that they can appear in string literals.
+func splitStatements(script string) []string {
+	var stmts []string
+	for _, stmt := range strings.Split(script, ";\n") {
+		if stmt = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(stmt), ";")); stmt != "" {
+			stmts = append(stmts, stmt)
+		}
+	}
+	return stmts
+}
+
+var (
+	createTableRegex = regexp.MustCompile(`^CREATE TABLE IF NOT EXISTS (\w+) \(\n((?s).*)\n\)$`)
+	createIndexRegex = regexp.MustCompile(`^CREATE (UNIQUE )?INDEX IF NOT EXISTS (\w+) ON (\w+)\(([\w, ]+)\)$`)
+	uniqueRegex      = regexp.MustCompile(`^UNIQUE\(([\w, ]+)\)$`)
+	columnRegex      = regexp.MustCompile(`^(\w+) TEXT( .*)?$`)
+)
+
+// dialectStatements returns the statements of a script of CREATE TABLE and CREATE INDEX
+// statements, or of the other statements of migrations, to run on a database of the given type.
+//
+// MySQL can only index TEXT columns by a prefix of them, and has no CREATE INDEX IF NOT EXISTS, so
+// for MySQL the TEXT columns which are part of a key are made VARCHAR(255), those which aren't are
+// made MEDIUMTEXT to allow values over 64KB, and indexes on tables made by the script are made
+// along with the tables. Tables compare text case sensitively, as the other databases do.
+func dialectStatements(databaseType, script string) []string {
+	stmts := splitStatements(script)
+	if databaseType != "mysql" {
+		return stmts
+	}
+	tables := make(map[string]*mysqlTable)
+	var out []string
+	for _, stmt := range stmts {
+		if m := createTableRegex.FindStringSubmatch(stmt); m != nil {
+			tables[m[1]] = newMySQLTable(m[2])
+			out = append(out, m[1]) // replaced by the statement once the table's indexes are known
+			continue
+		}
+		if m := createIndexRegex.FindStringSubmatch(stmt); m != nil && tables[m[3]] != nil {
+			tables[m[3]].addIndex(m[1], m[2], m[4])
+			continue
+		}
+		out = append(out, stmt)
+	}
+	for i, stmt := range out {
+		if t := tables[stmt]; t != nil {
+			out[i] = t.statement(stmt)
+		}
+	}
+	return out
+}
+
+// mysqlTable is a table made by a script, to be created on MySQL along with its indexes.
+type mysqlTable struct {
+	columns []string
+	indexes []string
+	// keys are the columns which are part of a key.
+	keys map[string]bool
+}
+
+// newMySQLTable returns the table with the body of a CREATE TABLE statement.
+func newMySQLTable(body string) *mysqlTable {
+	t := &mysqlTable{keys: make(map[string]bool)}
+	for _, line := range strings.Split(body, "\n") {
+		line = strings.TrimSuffix(strings.TrimSpace(line), ",")
+		if u := uniqueRegex.FindStringSubmatch(line); u != nil {
+			t.addKey(u[1])
+		}
+		t.columns = append(t.columns, line)
+	}
+	return t
+}
+
+// addIndex adds an index with the name on the comma separated columns. unique is "UNIQUE " for a
+// unique index.
+func (t *mysqlTable) addIndex(unique, name, columns string) {
+	t.indexes = append(t.indexes, fmt.Sprintf("%sINDEX %s (%s)", unique, name, columns))
+	t.addKey(columns)
+}
+
+// addKey marks the comma separated columns as part of a key.
+func (t *mysqlTable) addKey(columns string) {
+	for _, col := range strings.Split(columns, ",") {
+		t.keys[strings.TrimSpace(col)] = true
+	}
+}
+
+// statement returns the CREATE TABLE statement of the table with the name.
+func (t *mysqlTable) statement(name string) string {
+	var lines []string
+	for _, line := range t.columns {
+		if m := columnRegex.FindStringSubmatch(line); m != nil {
+			if t.keys[m[1]] {
+				line = m[1] + " VARCHAR(255)" + m[2]
+			} else {
+				line = m[1] + " MEDIUMTEXT" + m[2]
+			}
+		}
+		lines = append(lines, line)
+	}
+	lines = append(lines, t.indexes...)
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (\n\t%s\n) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin", name, strings.Join(lines, ",\n\t"))
+}
+
+// mysqlDSN makes MySQL report the rows an UPDATE matched rather than those it changed, as the
+// other databases do, since callers check whether anything was updated.
+func mysqlDSN(dsn string) (string, error) {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return "", err
+	}
+	cfg.ClientFoundRows = true
+	return cfg.FormatDSN(), nil
+}
+
+// A dialectDriver wraps a database/sql driver so that it can run the queries in this package.
+type dialectDriver struct {
+	driver.Driver
+	// questionMarks rewrites numbered placeholders such as $1 as ?, repeating arguments as needed.
+	questionMarks bool
+	// bytesAsText passes []byte arguments as strings, so that PostgreSQL stores them in TEXT
+	// columns as they are rather than as bytea.
+	bytesAsText bool
+	// dsn adjusts the data source name, if set.
+	dsn func(string) (string, error)
+}
+
+func (d *dialectDriver) Open(name string) (driver.Conn, error) {
+	if d.dsn != nil {
+		var err error
+		if name, err = d.dsn(name); err != nil {
+			return nil, err
+		}
+	}
+	conn, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &dialectConn{conn, d}, nil
+}
+
+type dialectConn struct {
+	driver.Conn
+	d *dialectDriver
+}
+
+func (c *dialectConn) Prepare(query string) (driver.Stmt, error) {
+	var args []int
+	numInput := -1
+	if c.d.questionMarks {
+		query, args = questionMarks(query)
+		numInput = 0
+		for _, n := range args {
+			if n+1 > numInput {
+				numInput = n + 1
+			}
+		}
+	}
+	stmt, err := c.Conn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	if numInput == -1 {
+		numInput = stmt.NumInput()
+	}
+	return &dialectStmt{stmt, c.d, args, numInput}, nil
+}
+
+type dialectStmt struct {
+	driver.Stmt
+	d        *dialectDriver
+	args     []int // the index of the argument for each ? placeholder, if they were rewritten
+	numInput int
+}
+
+func (s *dialectStmt) NumInput() int {
+	return s.numInput
+}
+
+func (s *dialectStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.Stmt.Exec(s.values(args)) // nolint: staticcheck
+}
+
+func (s *dialectStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.Stmt.Query(s.values(args)) // nolint: staticcheck
+}
+
+// values returns the arguments to pass to the wrapped statement.
+func (s *dialectStmt) values(args []driver.Value) []driver.Value {
+	if s.d.questionMarks {
+		ordered := make([]driver.Value, len(s.args))
+		for i, n := range s.args {
+			ordered[i] = args[n]
+		}
+		args = ordered
+	}
+	if s.d.bytesAsText {
+		for i, arg := range args {
+			if b, ok := arg.([]byte); ok {
+				args[i] = string(b)
+			}
+		}
+	}
+	return args
+}
+
+// questionMarks rewrites the numbered placeholders of a query, e.g. $1, as ?. Returns the query,
+// and the index of the argument for each ? in order. Placeholders in string literals are left
+// alone.
+func questionMarks(query string) (string, []int) {
+	var b strings.Builder
+	var args []int
+	inString := false
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		if c == '\'' {
+			inString = !inString
+		}
+		if c != '$' || inString {
+			b.WriteByte(c)
+			continue
+		}
+		j := i + 1
+		for j < len(query) && query[j] >= '0' && query[j] <= '9' {
+			j++
+		}
+		n, err := strconv.Atoi(query[i+1 : j])
+		if err != nil || n < 1 {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('?')
+		args = append(args, n-1)
+		i = j - 1
+	}
+	return b.String(), args
+}
@@ -0,0 +1,63 @@
+package database
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestQuestionMarks(t *testing.T) {
+	tests := []struct {
+		in       string
+		wantSQL  string
+		wantArgs []int
+	}{
+		{"SELECT a FROM t WHERE b = $1", "SELECT a FROM t WHERE b = ?", []int{0}},
+		{"SELECT a FROM t", "SELECT a FROM t", nil},
+		{"UPDATE t SET a = $2 WHERE b = $1 AND c = $1", "UPDATE t SET a = ? WHERE b = ? AND c = ?", []int{1, 0, 0}},
+		{"INSERT INTO t(a, b) VALUES ($10, '$1')", "INSERT INTO t(a, b) VALUES (?, '$1')", []int{9}},
+		{"SELECT '$' || $1", "SELECT '$' || ?", []int{0}},
+		{"SELECT $0, $x", "SELECT $0, $x", nil},
+	}
+	for _, test := range tests {
+		gotSQL, gotArgs := questionMarks(test.in)
+		if gotSQL != test.wantSQL || !reflect.DeepEqual(gotArgs, test.wantArgs) {
+			t.Errorf("questionMarks(%q) => want %q, %v got %q, %v", test.in, test.wantSQL, test.wantArgs, gotSQL, gotArgs)
+		}
+	}
+}
+
+func TestDialectStatements(t *testing.T) {
+	script := `
+CREATE TABLE IF NOT EXISTS things (
+	thing_id TEXT NOT NULL,
+	owner TEXT NOT NULL,
+	thing_json TEXT NOT NULL,
+	time_added_ms BIGINT NOT NULL,
+	UNIQUE(thing_id)
+);
+CREATE INDEX IF NOT EXISTS things_owner_idx ON things(owner, time_added_ms);
+
+DROP TABLE others;
+`
+	if got := dialectStatements("postgres", script); len(got) != 3 || !strings.HasPrefix(got[1], "CREATE INDEX IF NOT EXISTS") {
+		t.Errorf("dialectStatements(postgres) => want the 3 statements as they are, got %q", got)
+	}
+	want := []string{`CREATE TABLE IF NOT EXISTS things (
+	thing_id VARCHAR(255) NOT NULL,
+	owner VARCHAR(255) NOT NULL,
+	thing_json MEDIUMTEXT NOT NULL,
+	time_added_ms BIGINT NOT NULL,
+	UNIQUE(thing_id),
+	INDEX things_owner_idx (owner, time_added_ms)
+) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin`, "DROP TABLE others"}
+	if got := dialectStatements("mysql", script); !reflect.DeepEqual(got, want) {
+		t.Errorf("dialectStatements(mysql) => want %q got %q", want, got)
+	}
+	// Every table of the real schema is rewritten, and its indexes are made along with it.
+	for _, stmt := range dialectStatements("mysql", schemaSQL) {
+		if !strings.HasSuffix(stmt, "utf8mb4_bin") || strings.Contains(stmt, " TEXT ") {
+			t.Errorf("dialectStatements(mysql, schemaSQL) => want only rewritten tables, got %q", stmt)
+		}
+	}
+}
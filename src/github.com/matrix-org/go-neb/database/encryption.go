@@ -0,0 +1,461 @@
+package database
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The columns which hold secrets: Matrix access tokens, service secrets, including old versions of
+// services, realm client secrets, users' OAuth tokens, config file declarations of all of these,
+// webhook requests, whose bodies and URLs may contain tokens, the keys in services' webhook URLs,
+// and Matrix clients' olm and megolm keys. When a key is set with SetEncryptionKey they are stored
+// encrypted, bound to their table, column and row, and are decrypted as they are loaded.
+//
+// This is envelope encryption. The columns are encrypted with a random data key, which is stored
+// in the encryption_keys table encrypted with the key given to SetEncryptionKey, so that key is
+// never stored, and changing it means encrypting the data key again rather than every column.
+var encryptedColumns = []struct {
+	table  string
+	column string
+	keys   []string // the columns which identify a row
+}{
+	{"matrix_clients", "client_json", []string{"user_id"}},
+	{"services", "service_json", []string{"service_id"}},
+	{"auth_realms", "realm_json", []string{"realm_id"}},
+	{"auth_sessions", "session_json", []string{"realm_id", "session_id"}},
+	{"service_history", "old_json", []string{"service_id", "version"}},
+	{"service_history", "new_json", []string{"service_id", "version"}},
+	{"managed_resources", "resource_json", []string{"resource_type", "resource_id"}},
+	{"webhook_deliveries", "delivery_json", []string{"delivery_id"}},
+	{"webhook_dead_letters", "dead_letter_json", []string{"delivery_id"}},
+	{"crypto_state", "state_json", []string{"user_id", "device_id", "state_key"}},
+	{"webhook_keys", "webhook_key", []string{"service_id"}},
+}
+
+// encryptedPrefix starts encrypted values, followed by the ID of their data key, a colon and the
+// base64 encoded nonce and ciphertext. Values without it are stored as they are: JSON never starts
+// with it.
+const encryptedPrefix = "enc:"
+
+// ErrNoEncryptionKey is returned by Rekey if there is no key to encrypt the database with.
+var ErrNoEncryptionKey = errors.New("DATABASE_ENCRYPTION_KEY is not set")
+
+var encryption struct {
+	sync.RWMutex
+	key         []byte // key encryption key
+	previousKey []byte // key encryption key the data keys may still be encrypted with
+	dataKeys    map[string]cipher.AEAD
+	current     string // ID of the data key values are encrypted with, or "" to store them as they are
+}
+
+// SetEncryptionKey sets the key the database's secrets are encrypted with, and the key they were
+// encrypted with before that, if it is being changed. Keys are 32 random bytes, base64 encoded.
+// It must be called before Open. Without a key, secrets are stored as they are, and an encrypted
+// database can't be opened.
+func SetEncryptionKey(key, previousKey string) error {
+	k, err := parseEncryptionKey(key)
+	if err != nil {
+		return fmt.Errorf("Bad encryption key: %s", err)
+	}
+	prev, err := parseEncryptionKey(previousKey)
+	if err != nil {
+		return fmt.Errorf("Bad previous encryption key: %s", err)
+	}
+	if k == nil && prev != nil {
+		return errors.New("A previous encryption key was given without an encryption key")
+	}
+	encryption.Lock()
+	defer encryption.Unlock()
+	encryption.key = k
+	encryption.previousKey = prev
+	return nil
+}
+
+// PickleKeys returns the keys for Matrix clients to encrypt their olm state with as it is pickled,
+// derived from the encryption key: the first from the current key, then one from the previous key
+// if it is being changed, as state may still be pickled with it. Returns nil without a key.
+func PickleKeys() [][]byte {
+	encryption.RLock()
+	defer encryption.RUnlock()
+	var keys [][]byte
+	for _, k := range [][]byte{encryption.key, encryption.previousKey} {
+		if k != nil {
+			mac := hmac.New(sha256.New, k)
+			mac.Write([]byte("go-neb olm pickle key"))
+			keys = append(keys, mac.Sum(nil))
+		}
+	}
+	return keys
+}
+
+func parseEncryptionKey(key string) ([]byte, error) {
+	if key == "" {
+		return nil, nil
+	}
+	k, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(k) != 32 {
+		return nil, fmt.Errorf("it is %d bytes long, not 32", len(k))
+	}
+	return k, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext with AES-256-GCM, returning the random nonce followed by the ciphertext.
+// The additional data is authenticated but not encrypted: open must be given the same.
+func seal(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func open(aead cipher.AEAD, sealed, additionalData []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("ciphertext is too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], additionalData)
+}
+
+// rowData returns the additional data to encrypt a value in the column of the row identified by
+// rowKey with, the values of the table's key columns. It binds the value to its row, so a value
+// copied into another row or column, or another table, can't be decrypted.
+func rowData(table, column string, rowKey []string) []byte {
+	ad, _ := json.Marshal(append([]string{table, column}, rowKey...))
+	return ad
+}
+
+// encryptColumn returns the value to store in a column which holds secrets, for the row identified
+// by rowKey: the value encrypted with the current data key, or the value itself if there isn't one.
+func encryptColumn(value []byte, table, column string, rowKey ...string) ([]byte, error) {
+	encryption.RLock()
+	defer encryption.RUnlock()
+	return encryptLocked(value, rowData(table, column, rowKey))
+}
+
+func encryptLocked(value, additionalData []byte) ([]byte, error) {
+	if encryption.current == "" {
+		return value, nil
+	}
+	sealed, err := seal(encryption.dataKeys[encryption.current], value, additionalData)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(encryptedPrefix + encryption.current + ":" + base64.StdEncoding.EncodeToString(sealed)), nil
+}
+
+// decryptColumn returns the value stored in a column which holds secrets, for the row identified by
+// rowKey, decrypting it if it is encrypted.
+func decryptColumn(stored []byte, table, column string, rowKey ...string) ([]byte, error) {
+	encryption.RLock()
+	defer encryption.RUnlock()
+	return decryptLocked(stored, rowData(table, column, rowKey))
+}
+
+func decryptLocked(stored, additionalData []byte) ([]byte, error) {
+	if !bytes.HasPrefix(stored, []byte(encryptedPrefix)) {
+		return stored, nil
+	}
+	parts := strings.SplitN(string(stored[len(encryptedPrefix):]), ":", 2)
+	if len(parts) != 2 {
+		return nil, errors.New("Malformed encrypted value")
+	}
+	aead := encryption.dataKeys[parts[0]]
+	if aead == nil {
+		return nil, fmt.Errorf("Value is encrypted with unknown data key %s", parts[0])
+	}
+	sealed, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	value, err := open(aead, sealed, additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decrypt value with data key %s: %s", parts[0], err)
+	}
+	return value, nil
+}
+
+const selectEncryptionKeysSQL = `
+SELECT key_id, wrapped_key FROM encryption_keys ORDER BY time_added_ms, key_id
+`
+
+const insertEncryptionKeySQL = `
+INSERT INTO encryption_keys(key_id, wrapped_key, time_added_ms) VALUES ($1, $2, $3)
+`
+
+const updateEncryptionKeySQL = `
+UPDATE encryption_keys SET wrapped_key = $1 WHERE key_id = $2
+`
+
+const deleteEncryptionKeySQL = `
+DELETE FROM encryption_keys WHERE key_id = $1
+`
+
+// loadDataKeys reads the data keys from the database, decrypting them with the encryption key. Keys
+// encrypted with the previous encryption key are encrypted again with the current one. If there is
+// an encryption key but no data key yet, one is made, so secrets are encrypted from now on.
+func loadDataKeys(db *sql.DB) error {
+	encryption.Lock()
+	defer encryption.Unlock()
+	encryption.dataKeys = make(map[string]cipher.AEAD)
+	encryption.current = ""
+	return runTransaction(db, func(txn *sql.Tx) error {
+		ids, wrapped, err := selectDataKeysTxn(txn)
+		if err != nil {
+			return err
+		}
+		if encryption.key == nil {
+			if len(ids) > 0 {
+				return errors.New("The database's secrets are encrypted: DATABASE_ENCRYPTION_KEY must be set")
+			}
+			return nil
+		}
+		kek, err := newAEAD(encryption.key)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if err = addDataKeyTxn(txn, kek, id, wrapped[id]); err != nil {
+				return err
+			}
+		}
+		if encryption.current == "" {
+			id, err := insertDataKeyTxn(txn, kek)
+			if err != nil {
+				return err
+			}
+			log.WithField("key_id", id).Info("Made a data key: secrets will be stored encrypted")
+		}
+		return nil
+	})
+}
+
+// selectDataKeysTxn returns the IDs of the data keys, oldest first, and their encrypted keys by ID.
+func selectDataKeysTxn(txn *sql.Tx) (ids []string, wrapped map[string]string, err error) {
+	rows, err := txn.Query(selectEncryptionKeysSQL)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	wrapped = make(map[string]string)
+	for rows.Next() {
+		var id, w string
+		if err = rows.Scan(&id, &w); err != nil {
+			return
+		}
+		wrapped[id] = w
+		ids = append(ids, id)
+	}
+	return
+}
+
+// addDataKeyTxn decrypts the data key with the key encryption key, or with the previous one, in which
+// case it is stored encrypted with the current one, and makes it the one values are encrypted with.
+// encryption must be locked.
+func addDataKeyTxn(txn *sql.Tx, kek cipher.AEAD, id, wrapped string) error {
+	dataKey, err := unwrapDataKey(kek, wrapped)
+	if err != nil && encryption.previousKey != nil {
+		if dataKey, err = rewrapDataKey(txn, kek, id, wrapped); err == nil {
+			log.WithField("key_id", id).Info("Encrypted data key with the new DATABASE_ENCRYPTION_KEY")
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to decrypt data key %s: is DATABASE_ENCRYPTION_KEY right? %s", id, err)
+	}
+	if encryption.dataKeys[id], err = newAEAD(dataKey); err != nil {
+		return err
+	}
+	encryption.current = id
+	return nil
+}
+
+func unwrapDataKey(kek cipher.AEAD, wrapped string) ([]byte, error) {
+	sealed, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, err
+	}
+	return open(kek, sealed, nil)
+}
+
+// rewrapDataKey decrypts a data key with the previous encryption key, and stores it encrypted with
+// the current one.
+func rewrapDataKey(txn *sql.Tx, kek cipher.AEAD, id, wrapped string) ([]byte, error) {
+	previous, err := newAEAD(encryption.previousKey)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := unwrapDataKey(previous, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := seal(kek, dataKey, nil)
+	if err != nil {
+		return nil, err
+	}
+	_, err = txn.Exec(updateEncryptionKeySQL, base64.StdEncoding.EncodeToString(sealed), id)
+	return dataKey, err
+}
+
+// insertDataKeyTxn makes a data key, stores it encrypted with the key encryption key and makes it
+// the one values are encrypted with. encryption must be locked.
+func insertDataKeyTxn(txn *sql.Tx, kek cipher.AEAD) (string, error) {
+	dataKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return "", err
+	}
+	idBytes := make([]byte, 8)
+	if _, err := io.ReadFull(rand.Reader, idBytes); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(idBytes)
+	sealed, err := seal(kek, dataKey, nil)
+	if err != nil {
+		return "", err
+	}
+	_, err = txn.Exec(insertEncryptionKeySQL, id, base64.StdEncoding.EncodeToString(sealed), time.Now().UnixNano()/1000000)
+	if err != nil {
+		return "", err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	encryption.dataKeys[id] = aead
+	encryption.current = id
+	return id, nil
+}
+
+// RekeyResult is what Rekey did.
+type RekeyResult struct {
+	KeyID       string // the new data key
+	Reencrypted int    // values encrypted with it
+	Removed     int    // old data keys removed
+}
+
+// Rekey makes a new data key, encrypts every secret in the database with it, including any stored
+// before encryption was turned on, and removes the old data keys. It requires an encryption key.
+func (d *ServiceDB) Rekey() (result RekeyResult, err error) {
+	encryption.Lock()
+	defer encryption.Unlock()
+	if encryption.key == nil {
+		return result, ErrNoEncryptionKey
+	}
+	kek, err := newAEAD(encryption.key)
+	if err != nil {
+		return
+	}
+	// Restore the keys if the transaction fails, so that values stored meanwhile can be read.
+	oldKeys := make(map[string]cipher.AEAD)
+	for id, aead := range encryption.dataKeys {
+		oldKeys[id] = aead
+	}
+	oldCurrent := encryption.current
+	err = runTransaction(d.db, func(txn *sql.Tx) (err error) {
+		if result.KeyID, err = insertDataKeyTxn(txn, kek); err != nil {
+			return err
+		}
+		for _, c := range encryptedColumns {
+			var n int
+			if n, err = reencryptColumnTxn(txn, c.table, c.column, c.keys); err != nil {
+				return err
+			}
+			result.Reencrypted += n
+		}
+		for id := range oldKeys {
+			if _, err = txn.Exec(deleteEncryptionKeySQL, id); err != nil {
+				return err
+			}
+			result.Removed++
+		}
+		return nil
+	})
+	if err != nil {
+		encryption.dataKeys = oldKeys
+		encryption.current = oldCurrent
+		return
+	}
+	for id := range oldKeys {
+		delete(encryption.dataKeys, id)
+	}
+	return
+}
+
+// reencryptColumnTxn encrypts every value of the column with the current data key. Rows are
+// identified by their key columns. encryption must be locked, so the values are decrypted and
+// encrypted without locking it again.
+func reencryptColumnTxn(txn *sql.Tx, table, column string, keys []string) (int, error) {
+	rows, err := txn.Query(fmt.Sprintf("SELECT %s, %s FROM %s", strings.Join(keys, ", "), column, table))
+	if err != nil {
+		return 0, err
+	}
+	type row struct {
+		key    []string
+		stored []byte
+	}
+	var values []row
+	for rows.Next() {
+		r := row{key: make([]string, len(keys))}
+		dest := make([]interface{}, len(keys)+1)
+		for i := range keys {
+			dest[i] = new(string)
+		}
+		dest[len(keys)] = &r.stored
+		if err = rows.Scan(dest...); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		for i := range keys {
+			r.key[i] = *dest[i].(*string)
+		}
+		values = append(values, r)
+	}
+	rows.Close()
+	where := make([]string, len(keys))
+	for i, key := range keys {
+		where[i] = fmt.Sprintf("%s = $%d", key, i+2)
+	}
+	updateSQL := fmt.Sprintf("UPDATE %s SET %s = $1 WHERE %s", table, column, strings.Join(where, " AND "))
+	for _, r := range values {
+		ad := rowData(table, column, r.key)
+		value, err := decryptLocked(r.stored, ad)
+		if err != nil {
+			return 0, fmt.Errorf("Cannot decrypt %s of %s row %v: %s", column, table, r.key, err)
+		}
+		if value, err = encryptLocked(value, ad); err != nil {
+			return 0, err
+		}
+		args := []interface{}{value}
+		for _, k := range r.key {
+			args = append(args, k)
+		}
+		if _, err = txn.Exec(updateSQL, args...); err != nil {
+			return 0, err
+		}
+	}
+	return len(values), nil
+}
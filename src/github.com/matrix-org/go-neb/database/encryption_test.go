@@ -0,0 +1,102 @@
+package database
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestParseEncryptionKey(t *testing.T) {
+	good := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	if k, err := parseEncryptionKey(good); err != nil || len(k) != 32 {
+		t.Errorf("parseEncryptionKey(32 bytes): got %v, %v", k, err)
+	}
+	if k, err := parseEncryptionKey(""); err != nil || k != nil {
+		t.Errorf("parseEncryptionKey(\"\"): got %v, %v, want no key", k, err)
+	}
+	short := base64.StdEncoding.EncodeToString(make([]byte, 16))
+	for _, key := range []string{short, "not base64!"} {
+		if _, err := parseEncryptionKey(key); err == nil {
+			t.Errorf("parseEncryptionKey(%q): got nil error", key)
+		}
+	}
+}
+
+func TestEncryptColumn(t *testing.T) {
+	aead, err := newAEAD(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryption.dataKeys = map[string]cipher.AEAD{"k1": aead}
+	encryption.current = ""
+	defer func() {
+		encryption.dataKeys = nil
+		encryption.current = ""
+	}()
+
+	value := []byte(`{"Token":"secret"}`)
+	stored, err := encryptColumn(value, "services", "service_json", "svc1")
+	if err != nil || !bytes.Equal(stored, value) {
+		t.Errorf("encryptColumn without a data key: got %s, %v, want the value as it is", stored, err)
+	}
+
+	encryption.current = "k1"
+	stored, err = encryptColumn(value, "services", "service_json", "svc1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(stored), "enc:k1:") || bytes.Contains(stored, []byte("secret")) {
+		t.Errorf("encryptColumn: got %s, want it encrypted with k1", stored)
+	}
+	for _, s := range [][]byte{stored, value} {
+		got, err := decryptColumn(s, "services", "service_json", "svc1")
+		if err != nil || !bytes.Equal(got, value) {
+			t.Errorf("decryptColumn(%s): got %s, %v, want %s", s, got, err, value)
+		}
+	}
+
+	tampered := append([]byte{}, stored...)
+	tampered[len(tampered)-2] ^= 1
+	unknown := []byte("enc:k2:" + strings.TrimPrefix(string(stored), "enc:k1:"))
+	for _, s := range [][]byte{tampered, unknown, []byte("enc:nocolon")} {
+		if _, err := decryptColumn(s, "services", "service_json", "svc1"); err == nil {
+			t.Errorf("decryptColumn(%s): got nil error", s)
+		}
+	}
+
+}
+
+func TestEncryptColumnBindsRow(t *testing.T) {
+	aead, err := newAEAD(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryption.dataKeys = map[string]cipher.AEAD{"k1": aead}
+	encryption.current = "k1"
+	defer func() {
+		encryption.dataKeys = nil
+		encryption.current = ""
+	}()
+
+	stored, err := encryptColumn([]byte(`{"Token":"secret"}`), "services", "service_json", "svc1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A value is bound to its row and column, so it can't be copied to another.
+	elsewhere := []struct {
+		table, column string
+		key           []string
+	}{
+		{"services", "service_json", []string{"svc2"}},
+		{"services", "service_json", nil},
+		{"auth_realms", "realm_json", []string{"svc1"}},
+		{"service_history", "old_json", []string{"svc1"}},
+	}
+	for _, e := range elsewhere {
+		if _, err := decryptColumn(stored, e.table, e.column, e.key...); err == nil {
+			t.Errorf("decryptColumn(%s.%s %v): got nil error for a value from services.service_json [svc1]", e.table, e.column, e.key)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package database
+
+import (
+	"database/sql"
+	log "github.com/Sirupsen/logrus"
+	"time"
+)
+
+// A Migration changes the tables of existing databases in a way the schema's CREATE TABLE IF NOT
+// EXISTS statements can't, e.g. adding a column. Migrations are applied in order of Version, each
+// once, when the database is opened. The schema_version table records those which have been.
+//
+// The schema creates new tables as the migrations leave them, so migrations must do nothing to
+// tables which are already as they would leave them. New tables and indexes on them belong in the
+// schema rather than in a migration.
+type Migration struct {
+	Version     int
+	Description string
+	apply       func(txn *sql.Tx, databaseType string) error
+}
+
+// migrations are every migration, in order of Version. Add new ones at the end.
+var migrations = []Migration{
+	{1, "Allow several auth sessions per user in a realm, told apart by their labels", migrateAuthSessionLabelsTxn},
+}
+
+const schemaVersionSQL = `
+CREATE TABLE IF NOT EXISTS schema_version (
+	version BIGINT NOT NULL,
+	description TEXT NOT NULL,
+	time_applied_ms BIGINT NOT NULL,
+	UNIQUE(version)
+);
+`
+
+const selectSchemaVersionSQL = `
+SELECT COALESCE(MAX(version), 0) FROM schema_version
+`
+
+const insertSchemaVersionSQL = `
+INSERT INTO schema_version(version, description, time_applied_ms) VALUES ($1, $2, $3)
+`
+
+// PendingMigrations returns the migrations which opening the database would apply, without
+// changing it. A database which doesn't exist yet would have every migration applied, but none of
+// them would change anything.
+func PendingMigrations(databaseType, databaseURL string) ([]Migration, error) {
+	db, err := openDB(databaseType, databaseURL)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	var version int
+	if err = db.QueryRow(selectSchemaVersionSQL).Scan(&version); err != nil {
+		// There is no schema_version table until migrations are first applied.
+		version = 0
+	}
+	return pendingMigrations(migrations, version), nil
+}
+
+// pendingMigrations returns the migrations after the given version.
+func pendingMigrations(all []Migration, version int) []Migration {
+	var pending []Migration
+	for _, m := range all {
+		if m.Version > version {
+			pending = append(pending, m)
+		}
+	}
+	return pending
+}
+
+// migrate applies the migrations which haven't been, each in a transaction of its own along with
+// recording that it has been.
+func migrate(db *sql.DB, databaseType string) error {
+	if err := execStatements(db, databaseType, schemaVersionSQL); err != nil {
+		return err
+	}
+	var version int
+	if err := db.QueryRow(selectSchemaVersionSQL).Scan(&version); err != nil {
+		return err
+	}
+	for _, m := range pendingMigrations(migrations, version) {
+		logger := log.WithFields(log.Fields{
+			"version":     m.Version,
+			"description": m.Description,
+		})
+		logger.Info("Applying database migration")
+		err := runTransaction(db, func(txn *sql.Tx) error {
+			if err := m.apply(txn, databaseType); err != nil {
+				return err
+			}
+			_, err := txn.Exec(insertSchemaVersionSQL, m.Version, m.Description, time.Now().UnixNano()/1000000)
+			return err
+		})
+		if err != nil {
+			logger.WithError(err).Error("Failed to apply database migration")
+			return err
+		}
+	}
+	return nil
+}
+
+// Databases made before users could have several sessions per realm allow only one per user.
+// SQLite can't drop constraints, so the table is rebuilt with the label column. Only SQLite
+// databases are old enough to need this.
+const selectAuthSessionLabelSQL = `
+SELECT label FROM auth_sessions LIMIT 1
+`
+
+const migrateAuthSessionLabelsSQL = `
+ALTER TABLE auth_sessions RENAME TO auth_sessions_old;
+CREATE TABLE auth_sessions (
+	session_id TEXT NOT NULL,
+	realm_id TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+	label TEXT NOT NULL DEFAULT '',
+	session_json TEXT NOT NULL,
+	time_added_ms BIGINT NOT NULL,
+	time_updated_ms BIGINT NOT NULL,
+	UNIQUE(realm_id, user_id, label),
+	UNIQUE(realm_id, session_id)
+);
+INSERT INTO auth_sessions(
+	session_id, realm_id, user_id, label, session_json, time_added_ms, time_updated_ms
+) SELECT session_id, realm_id, user_id, '', session_json, time_added_ms, time_updated_ms
+	FROM auth_sessions_old;
+DROP TABLE auth_sessions_old;
+`
+
+func migrateAuthSessionLabelsTxn(txn *sql.Tx, databaseType string) error {
+	if databaseType != "sqlite3" {
+		// The schema made their tables with labels, and PostgreSQL can't carry on with the
+		// transaction after the query below fails.
+		return nil
+	}
+	rows, err := txn.Query(selectAuthSessionLabelSQL)
+	if err == nil {
+		// It already has labels.
+		return rows.Close()
+	}
+	return execStatements(txn, databaseType, migrateAuthSessionLabelsSQL)
+}
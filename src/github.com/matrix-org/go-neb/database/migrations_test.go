@@ -0,0 +1,45 @@
+package database
+
+import (
+	"testing"
+)
+
+func TestMigrationVersions(t *testing.T) {
+	last := 0
+	for _, m := range migrations {
+		if m.Version <= last {
+			t.Errorf("Migration %d follows migration %d: versions must increase", m.Version, last)
+		}
+		if m.Description == "" || m.apply == nil {
+			t.Errorf("Migration %d has no description or nothing to apply", m.Version)
+		}
+		last = m.Version
+	}
+}
+
+func TestPendingMigrations(t *testing.T) {
+	all := []Migration{{Version: 1}, {Version: 2}, {Version: 5}}
+	for _, tc := range []struct {
+		version int
+		want    []int
+	}{
+		{0, []int{1, 2, 5}},
+		{2, []int{5}},
+		{5, nil},
+	} {
+		var got []int
+		for _, m := range pendingMigrations(all, tc.version) {
+			got = append(got, m.Version)
+		}
+		if len(got) != len(tc.want) {
+			t.Errorf("pendingMigrations(%d): got %v, want %v", tc.version, got, tc.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("pendingMigrations(%d): got %v, want %v", tc.version, got, tc.want)
+				break
+			}
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/matrix-org/go-neb/types"
+	"strconv"
 	"time"
 )
 
@@ -42,10 +43,11 @@ CREATE TABLE IF NOT EXISTS auth_sessions (
 	session_id TEXT NOT NULL,
 	realm_id TEXT NOT NULL,
 	user_id TEXT NOT NULL,
+	label TEXT NOT NULL DEFAULT '',
 	session_json TEXT NOT NULL,
 	time_added_ms BIGINT NOT NULL,
 	time_updated_ms BIGINT NOT NULL,
-	UNIQUE(realm_id, user_id),
+	UNIQUE(realm_id, user_id, label),
 	UNIQUE(realm_id, session_id)
 );
 
@@ -58,6 +60,135 @@ CREATE TABLE IF NOT EXISTS bot_options (
 	time_updated_ms BIGINT NOT NULL,
 	UNIQUE(user_id, room_id)
 );
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+	delivery_id TEXT NOT NULL,
+	service_id TEXT NOT NULL,
+	delivery_json TEXT NOT NULL,
+	time_added_ms BIGINT NOT NULL,
+	UNIQUE(delivery_id)
+);
+CREATE INDEX IF NOT EXISTS webhook_deliveries_service_idx ON webhook_deliveries(service_id, time_added_ms);
+
+CREATE TABLE IF NOT EXISTS webhook_dead_letters (
+	delivery_id TEXT NOT NULL,
+	service_id TEXT NOT NULL,
+	dead_letter_json TEXT NOT NULL,
+	time_added_ms BIGINT NOT NULL,
+	UNIQUE(delivery_id)
+);
+CREATE INDEX IF NOT EXISTS webhook_dead_letters_service_idx ON webhook_dead_letters(service_id, time_added_ms);
+
+CREATE TABLE IF NOT EXISTS webhook_keys (
+	service_id TEXT NOT NULL,
+	webhook_key TEXT NOT NULL,
+	time_added_ms BIGINT NOT NULL,
+	UNIQUE(service_id)
+);
+
+CREATE TABLE IF NOT EXISTS managed_resources (
+	resource_type TEXT NOT NULL,
+	resource_id TEXT NOT NULL,
+	resource_json TEXT NOT NULL,
+	time_added_ms BIGINT NOT NULL,
+	time_updated_ms BIGINT NOT NULL,
+	UNIQUE(resource_type, resource_id)
+);
+
+CREATE TABLE IF NOT EXISTS karma (
+	service_id TEXT NOT NULL,
+	room_id TEXT NOT NULL,
+	name TEXT NOT NULL,
+	score BIGINT NOT NULL,
+	time_added_ms BIGINT NOT NULL,
+	time_updated_ms BIGINT NOT NULL,
+	UNIQUE(service_id, room_id, name)
+);
+CREATE INDEX IF NOT EXISTS karma_score_idx ON karma(service_id, room_id, score);
+
+CREATE TABLE IF NOT EXISTS scheduled_jobs (
+	job_id TEXT NOT NULL,
+	service_id TEXT NOT NULL,
+	job_json TEXT NOT NULL,
+	due_ms BIGINT NOT NULL,
+	UNIQUE(job_id)
+);
+CREATE INDEX IF NOT EXISTS scheduled_jobs_due_idx ON scheduled_jobs(due_ms);
+CREATE INDEX IF NOT EXISTS scheduled_jobs_service_idx ON scheduled_jobs(service_id);
+
+CREATE TABLE IF NOT EXISTS polls (
+	service_id TEXT NOT NULL,
+	room_id TEXT NOT NULL,
+	poll_json TEXT NOT NULL,
+	time_added_ms BIGINT NOT NULL,
+	time_updated_ms BIGINT NOT NULL,
+	UNIQUE(service_id, room_id)
+);
+
+CREATE TABLE IF NOT EXISTS mirrored_posts (
+	service_id TEXT NOT NULL,
+	room_id TEXT NOT NULL,
+	post_id TEXT NOT NULL,
+	time_added_ms BIGINT NOT NULL,
+	UNIQUE(service_id, room_id, post_id)
+);
+CREATE INDEX IF NOT EXISTS mirrored_posts_time_idx ON mirrored_posts(service_id, time_added_ms);
+
+CREATE TABLE IF NOT EXISTS silences (
+	room_id TEXT NOT NULL,
+	matcher TEXT NOT NULL,
+	silence_json TEXT NOT NULL,
+	expires_ms BIGINT NOT NULL,
+	time_added_ms BIGINT NOT NULL,
+	UNIQUE(room_id, matcher)
+);
+
+CREATE TABLE IF NOT EXISTS webhook_ids (
+	service_id TEXT NOT NULL,
+	target TEXT NOT NULL,
+	hook_id TEXT NOT NULL,
+	time_added_ms BIGINT NOT NULL,
+	UNIQUE(service_id, target)
+);
+
+CREATE TABLE IF NOT EXISTS queued_messages (
+	message_id TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+	room_id TEXT NOT NULL,
+	seq BIGINT NOT NULL,
+	message_json TEXT NOT NULL,
+	UNIQUE(message_id)
+);
+CREATE INDEX IF NOT EXISTS queued_messages_seq_idx ON queued_messages(seq);
+
+CREATE TABLE IF NOT EXISTS service_history (
+	service_id TEXT NOT NULL,
+	version BIGINT NOT NULL,
+	action TEXT NOT NULL,
+	actor TEXT NOT NULL,
+	service_type TEXT NOT NULL,
+	service_user_id TEXT NOT NULL,
+	old_json TEXT NOT NULL,
+	new_json TEXT NOT NULL,
+	time_ms BIGINT NOT NULL,
+	UNIQUE(service_id, version)
+);
+
+CREATE TABLE IF NOT EXISTS encryption_keys (
+	key_id TEXT NOT NULL,
+	wrapped_key TEXT NOT NULL,
+	time_added_ms BIGINT NOT NULL,
+	UNIQUE(key_id)
+);
+
+CREATE TABLE IF NOT EXISTS crypto_state (
+	user_id TEXT NOT NULL,
+	device_id TEXT NOT NULL,
+	state_key TEXT NOT NULL,
+	state_json TEXT NOT NULL,
+	time_updated_ms BIGINT NOT NULL,
+	UNIQUE(user_id, device_id, state_key)
+);
 `
 
 const selectMatrixClientConfigSQL = `
@@ -70,12 +201,15 @@ func selectMatrixClientConfigTxn(txn *sql.Tx, userID string) (config types.Clien
 	if err != nil {
 		return
 	}
+	if configJSON, err = decryptColumn(configJSON, "matrix_clients", "client_json", userID); err != nil {
+		return
+	}
 	err = json.Unmarshal(configJSON, &config)
 	return
 }
 
 const selectMatrixClientConfigsSQL = `
-SELECT client_json FROM matrix_clients
+SELECT user_id, client_json FROM matrix_clients
 `
 
 func selectMatrixClientConfigsTxn(txn *sql.Tx) (configs []types.ClientConfig, err error) {
@@ -86,8 +220,12 @@ func selectMatrixClientConfigsTxn(txn *sql.Tx) (configs []types.ClientConfig, er
 	defer rows.Close()
 	for rows.Next() {
 		var config types.ClientConfig
+		var userID string
 		var configJSON []byte
-		if err = rows.Scan(&configJSON); err != nil {
+		if err = rows.Scan(&userID, &configJSON); err != nil {
+			return
+		}
+		if configJSON, err = decryptColumn(configJSON, "matrix_clients", "client_json", userID); err != nil {
 			return
 		}
 		if err = json.Unmarshal(configJSON, &config); err != nil {
@@ -110,6 +248,9 @@ func insertMatrixClientConfigTxn(txn *sql.Tx, now time.Time, config types.Client
 	if err != nil {
 		return err
 	}
+	if configJSON, err = encryptColumn(configJSON, "matrix_clients", "client_json", config.UserID); err != nil {
+		return err
+	}
 	_, err = txn.Exec(insertMatrixClientConfigSQL, config.UserID, configJSON, t, t)
 	return err
 }
@@ -125,10 +266,22 @@ func updateMatrixClientConfigTxn(txn *sql.Tx, now time.Time, config types.Client
 	if err != nil {
 		return err
 	}
+	if configJSON, err = encryptColumn(configJSON, "matrix_clients", "client_json", config.UserID); err != nil {
+		return err
+	}
 	_, err = txn.Exec(updateMatrixClientConfigSQL, configJSON, t, config.UserID)
 	return err
 }
 
+const deleteMatrixClientConfigSQL = `
+DELETE FROM matrix_clients WHERE user_id = $1
+`
+
+func deleteMatrixClientConfigTxn(txn *sql.Tx, userID string) error {
+	_, err := txn.Exec(deleteMatrixClientConfigSQL, userID)
+	return err
+}
+
 const updateNextBatchSQL = `
 UPDATE matrix_clients SET next_batch = $1 WHERE user_id = $2
 `
@@ -152,19 +305,28 @@ func selectNextBatchTxn(txn *sql.Tx, userID string) (string, error) {
 }
 
 const selectServiceSQL = `
-SELECT service_type, service_user_id, service_json FROM services
-	WHERE service_id = $1
+SELECT service_type, service_user_id, service_json, COALESCE(webhook_key, '') FROM services
+	LEFT JOIN webhook_keys ON webhook_keys.service_id = services.service_id
+	WHERE services.service_id = $1
 `
 
 func selectServiceTxn(txn *sql.Tx, serviceID string) (types.Service, error) {
 	var serviceType string
 	var serviceUserID string
 	var serviceJSON []byte
+	var webhookKey string
 	row := txn.QueryRow(selectServiceSQL, serviceID)
-	if err := row.Scan(&serviceType, &serviceUserID, &serviceJSON); err != nil {
+	if err := row.Scan(&serviceType, &serviceUserID, &serviceJSON, &webhookKey); err != nil {
+		return nil, err
+	}
+	serviceJSON, err := decryptColumn(serviceJSON, "services", "service_json", serviceID)
+	if err != nil {
+		return nil, err
+	}
+	if webhookKey, err = decryptWebhookKey(serviceID, webhookKey); err != nil {
 		return nil, err
 	}
-	return types.CreateService(serviceID, serviceType, serviceUserID, serviceJSON)
+	return types.CreateService(serviceID, serviceType, serviceUserID, webhookKey, serviceJSON)
 }
 
 const updateServiceSQL = `
@@ -177,6 +339,9 @@ func updateServiceTxn(txn *sql.Tx, now time.Time, service types.Service) error {
 	if err != nil {
 		return err
 	}
+	if serviceJSON, err = encryptColumn(serviceJSON, "services", "service_json", service.ServiceID()); err != nil {
+		return err
+	}
 	t := now.UnixNano() / 1000000
 	_, err = txn.Exec(
 		updateServiceSQL, service.ServiceType(), service.ServiceUserID(), serviceJSON, t,
@@ -196,6 +361,9 @@ func insertServiceTxn(txn *sql.Tx, now time.Time, service types.Service) error {
 	if err != nil {
 		return err
 	}
+	if serviceJSON, err = encryptColumn(serviceJSON, "services", "service_json", service.ServiceID()); err != nil {
+		return err
+	}
 	t := now.UnixNano() / 1000000
 	_, err = txn.Exec(
 		insertServiceSQL,
@@ -205,7 +373,9 @@ func insertServiceTxn(txn *sql.Tx, now time.Time, service types.Service) error {
 }
 
 const selectServicesForUserSQL = `
-SELECT service_id, service_type, service_json FROM services WHERE service_user_id=$1 ORDER BY service_id
+SELECT services.service_id, service_type, service_json, COALESCE(webhook_key, '') FROM services
+	LEFT JOIN webhook_keys ON webhook_keys.service_id = services.service_id
+	WHERE service_user_id=$1 ORDER BY services.service_id
 `
 
 func selectServicesForUserTxn(txn *sql.Tx, userID string) (srvs []types.Service, err error) {
@@ -219,10 +389,54 @@ func selectServicesForUserTxn(txn *sql.Tx, userID string) (srvs []types.Service,
 		var serviceID string
 		var serviceType string
 		var serviceJSON []byte
-		if err = rows.Scan(&serviceID, &serviceType, &serviceJSON); err != nil {
+		var webhookKey string
+		if err = rows.Scan(&serviceID, &serviceType, &serviceJSON, &webhookKey); err != nil {
+			return
+		}
+		if serviceJSON, err = decryptColumn(serviceJSON, "services", "service_json", serviceID); err != nil {
+			return
+		}
+		if webhookKey, err = decryptWebhookKey(serviceID, webhookKey); err != nil {
+			return
+		}
+		s, err = types.CreateService(serviceID, serviceType, userID, webhookKey, serviceJSON)
+		if err != nil {
+			return
+		}
+		srvs = append(srvs, s)
+	}
+	return
+}
+
+const selectServicesSQL = `
+SELECT services.service_id, service_type, service_user_id, service_json, COALESCE(webhook_key, '') FROM services
+	LEFT JOIN webhook_keys ON webhook_keys.service_id = services.service_id
+	ORDER BY services.service_id
+`
+
+func selectServicesTxn(txn *sql.Tx) (srvs []types.Service, err error) {
+	rows, err := txn.Query(selectServicesSQL)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s types.Service
+		var serviceID string
+		var serviceType string
+		var serviceUserID string
+		var serviceJSON []byte
+		var webhookKey string
+		if err = rows.Scan(&serviceID, &serviceType, &serviceUserID, &serviceJSON, &webhookKey); err != nil {
+			return
+		}
+		if serviceJSON, err = decryptColumn(serviceJSON, "services", "service_json", serviceID); err != nil {
+			return
+		}
+		if webhookKey, err = decryptWebhookKey(serviceID, webhookKey); err != nil {
 			return
 		}
-		s, err = types.CreateService(serviceID, serviceType, userID, serviceJSON)
+		s, err = types.CreateService(serviceID, serviceType, serviceUserID, webhookKey, serviceJSON)
 		if err != nil {
 			return
 		}
@@ -231,6 +445,21 @@ func selectServicesForUserTxn(txn *sql.Tx, userID string) (srvs []types.Service,
 	return
 }
 
+const selectServiceConfigSQL = `
+SELECT service_type, service_user_id, service_json FROM services WHERE service_id = $1
+`
+
+// selectServiceConfigTxn returns a service's stored config, without creating the service from it,
+// so that it can be read even if the service can no longer be created.
+func selectServiceConfigTxn(txn *sql.Tx, serviceID string) (serviceType, serviceUserID string, serviceJSON []byte, err error) {
+	err = txn.QueryRow(selectServiceConfigSQL, serviceID).Scan(&serviceType, &serviceUserID, &serviceJSON)
+	if err != nil {
+		return
+	}
+	serviceJSON, err = decryptColumn(serviceJSON, "services", "service_json", serviceID)
+	return
+}
+
 const deleteServiceSQL = `
 DELETE FROM services WHERE service_id = $1
 `
@@ -240,228 +469,1187 @@ func deleteServiceTxn(txn *sql.Tx, serviceID string) error {
 	return err
 }
 
-const insertRealmSQL = `
-INSERT INTO auth_realms(
-	realm_id, realm_type, realm_json, time_added_ms, time_updated_ms
-) VALUES ($1, $2, $3, $4, $5)
+const selectWebhookKeySQL = `
+SELECT webhook_key FROM webhook_keys WHERE service_id = $1
 `
 
-func insertRealmTxn(txn *sql.Tx, now time.Time, realm types.AuthRealm) error {
-	realmJSON, err := json.Marshal(realm)
+func selectWebhookKeyTxn(txn *sql.Tx, serviceID string) (webhookKey string, err error) {
+	if err = txn.QueryRow(selectWebhookKeySQL, serviceID).Scan(&webhookKey); err != nil {
+		return
+	}
+	return decryptWebhookKey(serviceID, webhookKey)
+}
+
+// decryptWebhookKey returns the key in a service's webhook endpoint URL, as stored in the
+// webhook_keys table, decrypting it if it is encrypted. An empty key is returned as it is.
+func decryptWebhookKey(serviceID, stored string) (string, error) {
+	webhookKey, err := decryptColumn([]byte(stored), "webhook_keys", "webhook_key", serviceID)
+	return string(webhookKey), err
+}
+
+const insertWebhookKeySQL = `
+INSERT INTO webhook_keys(service_id, webhook_key, time_added_ms) VALUES ($1, $2, $3)
+`
+
+func insertWebhookKeyTxn(txn *sql.Tx, now time.Time, serviceID, webhookKey string) error {
+	stored, err := encryptColumn([]byte(webhookKey), "webhook_keys", "webhook_key", serviceID)
 	if err != nil {
 		return err
 	}
-	t := now.UnixNano() / 1000000
-	_, err = txn.Exec(
-		insertRealmSQL,
-		realm.ID(), realm.Type(), realmJSON, t, t,
-	)
+	_, err = txn.Exec(insertWebhookKeySQL, serviceID, string(stored), now.UnixNano()/1000000)
 	return err
 }
 
-const selectRealmSQL = `
-SELECT realm_type, realm_json FROM auth_realms WHERE realm_id = $1
+const selectWebhookIDSQL = `
+SELECT hook_id FROM webhook_ids WHERE service_id = $1 AND target = $2
 `
 
-func selectRealmTxn(txn *sql.Tx, realmID string) (types.AuthRealm, error) {
-	var realmType string
-	var realmJSON []byte
-	row := txn.QueryRow(selectRealmSQL, realmID)
-	if err := row.Scan(&realmType, &realmJSON); err != nil {
-		return nil, err
-	}
-	return types.CreateAuthRealm(realmID, realmType, realmJSON)
+func selectWebhookIDTxn(txn *sql.Tx, serviceID, target string) (hookID string, err error) {
+	err = txn.QueryRow(selectWebhookIDSQL, serviceID, target).Scan(&hookID)
+	return
 }
 
-const selectRealmsByTypeSQL = `
-SELECT realm_id, realm_json FROM auth_realms WHERE realm_type = $1 ORDER BY realm_id
+const insertWebhookIDSQL = `
+INSERT INTO webhook_ids(service_id, target, hook_id, time_added_ms) VALUES ($1, $2, $3, $4)
 `
 
-func selectRealmsByTypeTxn(txn *sql.Tx, realmType string) (realms []types.AuthRealm, err error) {
-	rows, err := txn.Query(selectRealmsByTypeSQL, realmType)
+func insertWebhookIDTxn(txn *sql.Tx, now time.Time, serviceID, target, hookID string) error {
+	_, err := txn.Exec(insertWebhookIDSQL, serviceID, target, hookID, now.UnixNano()/1000000)
+	return err
+}
+
+const deleteWebhookIDSQL = `
+DELETE FROM webhook_ids WHERE service_id = $1 AND target = $2
+`
+
+func deleteWebhookIDTxn(txn *sql.Tx, serviceID, target string) error {
+	_, err := txn.Exec(deleteWebhookIDSQL, serviceID, target)
+	return err
+}
+
+const deleteWebhookIDsSQL = `
+DELETE FROM webhook_ids WHERE service_id = $1
+`
+
+func deleteWebhookIDsTxn(txn *sql.Tx, serviceID string) error {
+	_, err := txn.Exec(deleteWebhookIDsSQL, serviceID)
+	return err
+}
+
+const selectQueuedMessagesSQL = `
+SELECT message_json FROM queued_messages ORDER BY seq
+`
+
+func selectQueuedMessagesTxn(txn *sql.Tx) (msgs []types.QueuedMessage, err error) {
+	rows, err := txn.Query(selectQueuedMessagesSQL)
 	if err != nil {
 		return
 	}
 	defer rows.Close()
 	for rows.Next() {
-		var realm types.AuthRealm
-		var realmID string
-		var realmJSON []byte
-		if err = rows.Scan(&realmID, &realmJSON); err != nil {
+		var msgJSON []byte
+		if err = rows.Scan(&msgJSON); err != nil {
 			return
 		}
-		realm, err = types.CreateAuthRealm(realmID, realmType, realmJSON)
-		if err != nil {
+		var msg types.QueuedMessage
+		if err = json.Unmarshal(msgJSON, &msg); err != nil {
 			return
 		}
-		realms = append(realms, realm)
+		msgs = append(msgs, msg)
 	}
 	return
 }
 
-const updateRealmSQL = `
-UPDATE auth_realms SET realm_type=$1, realm_json=$2, time_updated_ms=$3
-	WHERE realm_id=$4
+const insertQueuedMessageSQL = `
+INSERT INTO queued_messages(message_id, user_id, room_id, seq, message_json) VALUES ($1, $2, $3, $4, $5)
 `
 
-func updateRealmTxn(txn *sql.Tx, now time.Time, realm types.AuthRealm) error {
-	realmJSON, err := json.Marshal(realm)
+func insertQueuedMessageTxn(txn *sql.Tx, msg types.QueuedMessage) error {
+	msgJSON, err := json.Marshal(&msg)
 	if err != nil {
 		return err
 	}
-	t := now.UnixNano() / 1000000
-	_, err = txn.Exec(
-		updateRealmSQL, realm.Type(), realmJSON, t,
-		realm.ID(),
-	)
+	_, err = txn.Exec(insertQueuedMessageSQL, msg.ID, msg.UserID, msg.RoomID, msg.Seq, msgJSON)
 	return err
 }
 
-const insertAuthSessionSQL = `
-INSERT INTO auth_sessions(
-	session_id, realm_id, user_id, session_json, time_added_ms, time_updated_ms
-) VALUES ($1, $2, $3, $4, $5, $6)
+const deleteQueuedMessageSQL = `
+DELETE FROM queued_messages WHERE message_id = $1
 `
 
-func insertAuthSessionTxn(txn *sql.Tx, now time.Time, session types.AuthSession) error {
-	sessionJSON, err := json.Marshal(session)
-	if err != nil {
-		return err
-	}
-	t := now.UnixNano() / 1000000
-	_, err = txn.Exec(
-		insertAuthSessionSQL,
-		session.ID(), session.RealmID(), session.UserID(), sessionJSON, t, t,
-	)
+func deleteQueuedMessageTxn(txn *sql.Tx, msgID string) error {
+	_, err := txn.Exec(deleteQueuedMessageSQL, msgID)
 	return err
 }
 
-const deleteAuthSessionSQL = `
-DELETE FROM auth_sessions WHERE realm_id=$1 AND user_id=$2
+const deleteWebhookKeySQL = `
+DELETE FROM webhook_keys WHERE service_id = $1
 `
 
-func deleteAuthSessionTxn(txn *sql.Tx, realmID, userID string) error {
-	_, err := txn.Exec(deleteAuthSessionSQL, realmID, userID)
+func deleteWebhookKeyTxn(txn *sql.Tx, serviceID string) error {
+	_, err := txn.Exec(deleteWebhookKeySQL, serviceID)
 	return err
 }
 
-const selectAuthSessionByUserSQL = `
-SELECT session_id, realm_type, realm_json, session_json FROM auth_sessions
-	JOIN auth_realms ON auth_sessions.realm_id = auth_realms.realm_id
-	WHERE auth_sessions.realm_id = $1 AND auth_sessions.user_id = $2
+const selectNextServiceVersionSQL = `
+SELECT COALESCE(MAX(version), 0) + 1 FROM service_history WHERE service_id = $1
 `
 
-func selectAuthSessionByUserTxn(txn *sql.Tx, realmID, userID string) (types.AuthSession, error) {
-	var id string
-	var realmType string
-	var realmJSON []byte
-	var sessionJSON []byte
-	row := txn.QueryRow(selectAuthSessionByUserSQL, realmID, userID)
-	if err := row.Scan(&id, &realmType, &realmJSON, &sessionJSON); err != nil {
-		return nil, err
+const insertServiceChangeSQL = `
+INSERT INTO service_history(
+	service_id, version, action, actor, service_type, service_user_id, old_json, new_json, time_ms
+) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+`
+
+// insertServiceChangeTxn records a change to a service, as the next version of it. Its Version
+// and ServiceID are ignored.
+func insertServiceChangeTxn(txn *sql.Tx, now time.Time, serviceID string, change types.ServiceChange) error {
+	var version int64
+	if err := txn.QueryRow(selectNextServiceVersionSQL, serviceID).Scan(&version); err != nil {
+		return err
 	}
-	realm, err := types.CreateAuthRealm(realmID, realmType, realmJSON)
+	v := strconv.FormatInt(version, 10)
+	oldJSON, err := encryptColumn(change.OldConfig, "service_history", "old_json", serviceID, v)
 	if err != nil {
-		return nil, err
-	}
-	session := realm.AuthSession(id, userID, realmID)
-	if session == nil {
-		return nil, fmt.Errorf("Cannot create session for given realm")
+		return err
 	}
-	if err := json.Unmarshal(sessionJSON, session); err != nil {
-		return nil, err
+	newJSON, err := encryptColumn(change.NewConfig, "service_history", "new_json", serviceID, v)
+	if err != nil {
+		return err
 	}
-	return session, nil
+	_, err = txn.Exec(
+		insertServiceChangeSQL, serviceID, version, change.Action, change.Actor, change.Type, change.UserID,
+		string(oldJSON), string(newJSON), now.UnixNano()/1000000,
+	)
+	return err
 }
 
-const selectAuthSessionByIDSQL = `
-SELECT user_id, realm_type, realm_json, session_json FROM auth_sessions
-	JOIN auth_realms ON auth_sessions.realm_id = auth_realms.realm_id
-	WHERE auth_sessions.realm_id = $1 AND auth_sessions.session_id = $2
+const selectServiceChangesSQL = `
+SELECT version, action, actor, service_type, service_user_id, old_json, new_json, time_ms
+	FROM service_history WHERE service_id = $1 ORDER BY version DESC
 `
 
-func selectAuthSessionByIDTxn(txn *sql.Tx, realmID, id string) (types.AuthSession, error) {
-	var userID string
-	var realmType string
-	var realmJSON []byte
-	var sessionJSON []byte
-	row := txn.QueryRow(selectAuthSessionByIDSQL, realmID, id)
-	if err := row.Scan(&userID, &realmType, &realmJSON, &sessionJSON); err != nil {
-		return nil, err
-	}
-	realm, err := types.CreateAuthRealm(realmID, realmType, realmJSON)
+func selectServiceChangesTxn(txn *sql.Tx, serviceID string) ([]types.ServiceChange, error) {
+	rows, err := txn.Query(selectServiceChangesSQL, serviceID)
 	if err != nil {
 		return nil, err
 	}
-	session := realm.AuthSession(id, userID, realmID)
-	if session == nil {
-		return nil, fmt.Errorf("Cannot create session for given realm")
-	}
-	if err := json.Unmarshal(sessionJSON, session); err != nil {
-		return nil, err
-	}
-	return session, nil
+	return scanServiceChanges(rows, serviceID)
 }
 
-const updateAuthSessionSQL = `
-UPDATE auth_sessions SET session_id=$1, session_json=$2, time_updated_ms=$3
-	WHERE realm_id=$4 AND user_id=$5
+const selectServiceChangeSQL = `
+SELECT version, action, actor, service_type, service_user_id, old_json, new_json, time_ms
+	FROM service_history WHERE service_id = $1 AND version = $2
 `
 
-func updateAuthSessionTxn(txn *sql.Tx, now time.Time, session types.AuthSession) error {
-	sessionJSON, err := json.Marshal(session)
+func selectServiceChangeTxn(txn *sql.Tx, serviceID string, version int64) (types.ServiceChange, error) {
+	rows, err := txn.Query(selectServiceChangeSQL, serviceID, version)
 	if err != nil {
-		return err
+		return types.ServiceChange{}, err
 	}
-	t := now.UnixNano() / 1000000
-	_, err = txn.Exec(
-		updateAuthSessionSQL, session.ID(), sessionJSON, t,
-		session.RealmID(), session.UserID(),
+	changes, err := scanServiceChanges(rows, serviceID)
+	if err != nil {
+		return types.ServiceChange{}, err
+	}
+	if len(changes) == 0 {
+		return types.ServiceChange{}, sql.ErrNoRows
+	}
+	return changes[0], nil
+}
+
+func scanServiceChanges(rows *sql.Rows, serviceID string) (changes []types.ServiceChange, err error) {
+	defer rows.Close()
+	for rows.Next() {
+		change := types.ServiceChange{ServiceID: serviceID}
+		var oldJSON, newJSON []byte
+		err = rows.Scan(
+			&change.Version, &change.Action, &change.Actor, &change.Type, &change.UserID,
+			&oldJSON, &newJSON, &change.TimeMs,
+		)
+		if err != nil {
+			return
+		}
+		version := strconv.FormatInt(change.Version, 10)
+		if oldJSON, err = decryptColumn(oldJSON, "service_history", "old_json", serviceID, version); err != nil {
+			return
+		}
+		if newJSON, err = decryptColumn(newJSON, "service_history", "new_json", serviceID, version); err != nil {
+			return
+		}
+		if len(oldJSON) > 0 {
+			change.OldConfig = oldJSON
+		}
+		if len(newJSON) > 0 {
+			change.NewConfig = newJSON
+		}
+		changes = append(changes, change)
+	}
+	return
+}
+
+const insertRealmSQL = `
+INSERT INTO auth_realms(
+	realm_id, realm_type, realm_json, time_added_ms, time_updated_ms
+) VALUES ($1, $2, $3, $4, $5)
+`
+
+func insertRealmTxn(txn *sql.Tx, now time.Time, realm types.AuthRealm) error {
+	realmJSON, err := json.Marshal(realm)
+	if err != nil {
+		return err
+	}
+	if realmJSON, err = encryptColumn(realmJSON, "auth_realms", "realm_json", realm.ID()); err != nil {
+		return err
+	}
+	t := now.UnixNano() / 1000000
+	_, err = txn.Exec(
+		insertRealmSQL,
+		realm.ID(), realm.Type(), realmJSON, t, t,
+	)
+	return err
+}
+
+const selectRealmSQL = `
+SELECT realm_type, realm_json FROM auth_realms WHERE realm_id = $1
+`
+
+func selectRealmTxn(txn *sql.Tx, realmID string) (types.AuthRealm, error) {
+	var realmType string
+	var realmJSON []byte
+	row := txn.QueryRow(selectRealmSQL, realmID)
+	if err := row.Scan(&realmType, &realmJSON); err != nil {
+		return nil, err
+	}
+	realmJSON, err := decryptColumn(realmJSON, "auth_realms", "realm_json", realmID)
+	if err != nil {
+		return nil, err
+	}
+	return types.CreateAuthRealm(realmID, realmType, realmJSON)
+}
+
+const selectRealmsByTypeSQL = `
+SELECT realm_id, realm_json FROM auth_realms WHERE realm_type = $1 ORDER BY realm_id
+`
+
+func selectRealmsByTypeTxn(txn *sql.Tx, realmType string) (realms []types.AuthRealm, err error) {
+	rows, err := txn.Query(selectRealmsByTypeSQL, realmType)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var realm types.AuthRealm
+		var realmID string
+		var realmJSON []byte
+		if err = rows.Scan(&realmID, &realmJSON); err != nil {
+			return
+		}
+		if realmJSON, err = decryptColumn(realmJSON, "auth_realms", "realm_json", realmID); err != nil {
+			return
+		}
+		realm, err = types.CreateAuthRealm(realmID, realmType, realmJSON)
+		if err != nil {
+			return
+		}
+		realms = append(realms, realm)
+	}
+	return
+}
+
+const selectRealmsSQL = `
+SELECT realm_id, realm_type, realm_json FROM auth_realms ORDER BY realm_id
+`
+
+func selectRealmsTxn(txn *sql.Tx) (realms []types.AuthRealm, err error) {
+	rows, err := txn.Query(selectRealmsSQL)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var realm types.AuthRealm
+		var realmID string
+		var realmType string
+		var realmJSON []byte
+		if err = rows.Scan(&realmID, &realmType, &realmJSON); err != nil {
+			return
+		}
+		if realmJSON, err = decryptColumn(realmJSON, "auth_realms", "realm_json", realmID); err != nil {
+			return
+		}
+		realm, err = types.CreateAuthRealm(realmID, realmType, realmJSON)
+		if err != nil {
+			return
+		}
+		realms = append(realms, realm)
+	}
+	return
+}
+
+const updateRealmSQL = `
+UPDATE auth_realms SET realm_type=$1, realm_json=$2, time_updated_ms=$3
+	WHERE realm_id=$4
+`
+
+func updateRealmTxn(txn *sql.Tx, now time.Time, realm types.AuthRealm) error {
+	realmJSON, err := json.Marshal(realm)
+	if err != nil {
+		return err
+	}
+	if realmJSON, err = encryptColumn(realmJSON, "auth_realms", "realm_json", realm.ID()); err != nil {
+		return err
+	}
+	t := now.UnixNano() / 1000000
+	_, err = txn.Exec(
+		updateRealmSQL, realm.Type(), realmJSON, t,
+		realm.ID(),
 	)
 	return err
 }
 
-const selectBotOptionsSQL = `
-SELECT bot_options_json, set_by_user_id FROM bot_options WHERE user_id = $1 AND room_id = $2
+const deleteRealmSQL = `
+DELETE FROM auth_realms WHERE realm_id = $1
+`
+
+func deleteRealmTxn(txn *sql.Tx, realmID string) error {
+	_, err := txn.Exec(deleteRealmSQL, realmID)
+	return err
+}
+
+const insertAuthSessionSQL = `
+INSERT INTO auth_sessions(
+	session_id, realm_id, user_id, label, session_json, time_added_ms, time_updated_ms
+) VALUES ($1, $2, $3, $4, $5, $6, $7)
+`
+
+func insertAuthSessionTxn(txn *sql.Tx, now time.Time, session types.AuthSession) error {
+	sessionJSON, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	if sessionJSON, err = encryptColumn(sessionJSON, "auth_sessions", "session_json", session.RealmID(), session.ID()); err != nil {
+		return err
+	}
+	t := now.UnixNano() / 1000000
+	_, err = txn.Exec(
+		insertAuthSessionSQL,
+		session.ID(), session.RealmID(), session.UserID(), types.SessionLabel(session), sessionJSON, t, t,
+	)
+	return err
+}
+
+const deleteAuthSessionsSQL = `
+DELETE FROM auth_sessions WHERE realm_id=$1 AND user_id=$2
+`
+
+func deleteAuthSessionsTxn(txn *sql.Tx, realmID, userID string) error {
+	_, err := txn.Exec(deleteAuthSessionsSQL, realmID, userID)
+	return err
+}
+
+const deleteAuthSessionSQL = `
+DELETE FROM auth_sessions WHERE realm_id=$1 AND user_id=$2 AND label=$3
+`
+
+func deleteAuthSessionTxn(txn *sql.Tx, realmID, userID, label string) error {
+	_, err := txn.Exec(deleteAuthSessionSQL, realmID, userID, label)
+	return err
+}
+
+const selectAuthSessionByLabelSQL = `
+SELECT session_id, realm_type, realm_json, session_json FROM auth_sessions
+	JOIN auth_realms ON auth_sessions.realm_id = auth_realms.realm_id
+	WHERE auth_sessions.realm_id = $1 AND auth_sessions.user_id = $2 AND auth_sessions.label = $3
+`
+
+func selectAuthSessionByLabelTxn(txn *sql.Tx, realmID, userID, label string) (types.AuthSession, error) {
+	var id string
+	var realmType string
+	var realmJSON []byte
+	var sessionJSON []byte
+	row := txn.QueryRow(selectAuthSessionByLabelSQL, realmID, userID, label)
+	if err := row.Scan(&id, &realmType, &realmJSON, &sessionJSON); err != nil {
+		return nil, err
+	}
+	realmJSON, err := decryptColumn(realmJSON, "auth_realms", "realm_json", realmID)
+	if err != nil {
+		return nil, err
+	}
+	if sessionJSON, err = decryptColumn(sessionJSON, "auth_sessions", "session_json", realmID, id); err != nil {
+		return nil, err
+	}
+	realm, err := types.CreateAuthRealm(realmID, realmType, realmJSON)
+	if err != nil {
+		return nil, err
+	}
+	session := realm.AuthSession(id, userID, realmID)
+	if session == nil {
+		return nil, fmt.Errorf("Cannot create session for given realm")
+	}
+	if err := json.Unmarshal(sessionJSON, session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+const selectAuthSessionByIDSQL = `
+SELECT user_id, realm_type, realm_json, session_json FROM auth_sessions
+	JOIN auth_realms ON auth_sessions.realm_id = auth_realms.realm_id
+	WHERE auth_sessions.realm_id = $1 AND auth_sessions.session_id = $2
+`
+
+func selectAuthSessionByIDTxn(txn *sql.Tx, realmID, id string) (types.AuthSession, error) {
+	var userID string
+	var realmType string
+	var realmJSON []byte
+	var sessionJSON []byte
+	row := txn.QueryRow(selectAuthSessionByIDSQL, realmID, id)
+	if err := row.Scan(&userID, &realmType, &realmJSON, &sessionJSON); err != nil {
+		return nil, err
+	}
+	realmJSON, err := decryptColumn(realmJSON, "auth_realms", "realm_json", realmID)
+	if err != nil {
+		return nil, err
+	}
+	if sessionJSON, err = decryptColumn(sessionJSON, "auth_sessions", "session_json", realmID, id); err != nil {
+		return nil, err
+	}
+	realm, err := types.CreateAuthRealm(realmID, realmType, realmJSON)
+	if err != nil {
+		return nil, err
+	}
+	session := realm.AuthSession(id, userID, realmID)
+	if session == nil {
+		return nil, fmt.Errorf("Cannot create session for given realm")
+	}
+	if err := json.Unmarshal(sessionJSON, session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+const selectAuthSessionsSQL = `
+SELECT session_id, user_id, realm_type, realm_json, session_json FROM auth_sessions
+	JOIN auth_realms ON auth_sessions.realm_id = auth_realms.realm_id
+	WHERE auth_sessions.realm_id = $1 ORDER BY user_id, label
+`
+
+func selectAuthSessionsTxn(txn *sql.Tx, realmID string) ([]types.AuthSession, error) {
+	rows, err := txn.Query(selectAuthSessionsSQL, realmID)
+	if err != nil {
+		return nil, err
+	}
+	return scanAuthSessions(rows, realmID)
+}
+
+const selectAuthSessionsByUserSQL = `
+SELECT session_id, user_id, realm_type, realm_json, session_json FROM auth_sessions
+	JOIN auth_realms ON auth_sessions.realm_id = auth_realms.realm_id
+	WHERE auth_sessions.realm_id = $1 AND auth_sessions.user_id = $2 ORDER BY label
+`
+
+func selectAuthSessionsByUserTxn(txn *sql.Tx, realmID, userID string) ([]types.AuthSession, error) {
+	rows, err := txn.Query(selectAuthSessionsByUserSQL, realmID, userID)
+	if err != nil {
+		return nil, err
+	}
+	return scanAuthSessions(rows, realmID)
+}
+
+func scanAuthSessions(rows *sql.Rows, realmID string) (sessions []types.AuthSession, err error) {
+	defer rows.Close()
+	var realm types.AuthRealm
+	for rows.Next() {
+		var id, userID, realmType string
+		var realmJSON, sessionJSON []byte
+		if err = rows.Scan(&id, &userID, &realmType, &realmJSON, &sessionJSON); err != nil {
+			return
+		}
+		if sessionJSON, err = decryptColumn(sessionJSON, "auth_sessions", "session_json", realmID, id); err != nil {
+			return
+		}
+		if realm == nil {
+			if realmJSON, err = decryptColumn(realmJSON, "auth_realms", "realm_json", realmID); err != nil {
+				return
+			}
+			if realm, err = types.CreateAuthRealm(realmID, realmType, realmJSON); err != nil {
+				return
+			}
+		}
+		session := realm.AuthSession(id, userID, realmID)
+		if session == nil {
+			return nil, fmt.Errorf("Cannot create session for given realm")
+		}
+		if err = json.Unmarshal(sessionJSON, session); err != nil {
+			return
+		}
+		sessions = append(sessions, session)
+	}
+	return
+}
+
+const updateAuthSessionSQL = `
+UPDATE auth_sessions SET session_id=$1, session_json=$2, time_updated_ms=$3
+	WHERE realm_id=$4 AND user_id=$5 AND label=$6
+`
+
+func updateAuthSessionTxn(txn *sql.Tx, now time.Time, session types.AuthSession) error {
+	sessionJSON, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	if sessionJSON, err = encryptColumn(sessionJSON, "auth_sessions", "session_json", session.RealmID(), session.ID()); err != nil {
+		return err
+	}
+	t := now.UnixNano() / 1000000
+	_, err = txn.Exec(
+		updateAuthSessionSQL, session.ID(), sessionJSON, t,
+		session.RealmID(), session.UserID(), types.SessionLabel(session),
+	)
+	return err
+}
+
+const selectBotOptionsSQL = `
+SELECT bot_options_json, set_by_user_id FROM bot_options WHERE user_id = $1 AND room_id = $2
+`
+
+func selectBotOptionsTxn(txn *sql.Tx, userID, roomID string) (opts types.BotOptions, err error) {
+	var optionsJSON []byte
+	err = txn.QueryRow(selectBotOptionsSQL, userID, roomID).Scan(&optionsJSON, &opts.SetByUserID)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(optionsJSON, &opts.Options)
+	return
+}
+
+const insertBotOptionsSQL = `
+INSERT INTO bot_options(
+	user_id, room_id, bot_options_json, set_by_user_id, time_added_ms, time_updated_ms
+) VALUES ($1, $2, $3, $4, $5, $6)
+`
+
+func insertBotOptionsTxn(txn *sql.Tx, now time.Time, opts types.BotOptions) error {
+	t := now.UnixNano() / 1000000
+	optsJSON, err := json.Marshal(&opts.Options)
+	if err != nil {
+		return err
+	}
+	_, err = txn.Exec(insertBotOptionsSQL, opts.UserID, opts.RoomID, optsJSON, opts.SetByUserID, t, t)
+	return err
+}
+
+const updateBotOptionsSQL = `
+UPDATE bot_options SET bot_options_json = $1, set_by_user_id = $2, time_updated_ms = $3
+	WHERE user_id = $4 AND room_id = $5
+`
+
+func updateBotOptionsTxn(txn *sql.Tx, now time.Time, opts types.BotOptions) error {
+	t := now.UnixNano() / 1000000
+	optsJSON, err := json.Marshal(&opts.Options)
+	if err != nil {
+		return err
+	}
+	_, err = txn.Exec(updateBotOptionsSQL, optsJSON, opts.SetByUserID, t, opts.UserID, opts.RoomID)
+	return err
+}
+
+const insertWebhookDeliverySQL = `
+INSERT INTO webhook_deliveries(delivery_id, service_id, delivery_json, time_added_ms) VALUES ($1, $2, $3, $4)
+`
+
+func insertWebhookDeliveryTxn(txn *sql.Tx, delivery types.WebhookDelivery) error {
+	deliveryJSON, err := json.Marshal(&delivery)
+	if err != nil {
+		return err
+	}
+	if deliveryJSON, err = encryptColumn(deliveryJSON, "webhook_deliveries", "delivery_json", delivery.ID); err != nil {
+		return err
+	}
+	_, err = txn.Exec(insertWebhookDeliverySQL, delivery.ID, delivery.ServiceID, deliveryJSON, delivery.TimeMs)
+	return err
+}
+
+const pruneWebhookDeliveriesSQL = `
+DELETE FROM webhook_deliveries WHERE service_id = $1 AND delivery_id NOT IN (
+	SELECT delivery_id FROM (
+		SELECT delivery_id FROM webhook_deliveries WHERE service_id = $1 ORDER BY time_added_ms DESC LIMIT $2
+	) AS kept
+)
+`
+
+func pruneWebhookDeliveriesTxn(txn *sql.Tx, serviceID string, keep int) error {
+	_, err := txn.Exec(pruneWebhookDeliveriesSQL, serviceID, keep)
+	return err
+}
+
+const selectWebhookDeliverySQL = `
+SELECT delivery_json FROM webhook_deliveries WHERE delivery_id = $1
+`
+
+func selectWebhookDeliveryTxn(txn *sql.Tx, deliveryID string) (delivery types.WebhookDelivery, err error) {
+	var deliveryJSON []byte
+	if err = txn.QueryRow(selectWebhookDeliverySQL, deliveryID).Scan(&deliveryJSON); err != nil {
+		return
+	}
+	if deliveryJSON, err = decryptColumn(deliveryJSON, "webhook_deliveries", "delivery_json", deliveryID); err != nil {
+		return
+	}
+	err = json.Unmarshal(deliveryJSON, &delivery)
+	return
+}
+
+const selectWebhookDeliveriesSQL = `
+SELECT delivery_id, delivery_json FROM webhook_deliveries WHERE service_id = $1 ORDER BY time_added_ms DESC
+`
+
+func selectWebhookDeliveriesTxn(txn *sql.Tx, serviceID string) (deliveries []types.WebhookDelivery, err error) {
+	rows, err := txn.Query(selectWebhookDeliveriesSQL, serviceID)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var deliveryID string
+		var deliveryJSON []byte
+		if err = rows.Scan(&deliveryID, &deliveryJSON); err != nil {
+			return
+		}
+		if deliveryJSON, err = decryptColumn(deliveryJSON, "webhook_deliveries", "delivery_json", deliveryID); err != nil {
+			return
+		}
+		var delivery types.WebhookDelivery
+		if err = json.Unmarshal(deliveryJSON, &delivery); err != nil {
+			return
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return
+}
+
+const deleteDeadLetterSQL = `
+DELETE FROM webhook_dead_letters WHERE delivery_id = $1
+`
+
+func deleteDeadLetterTxn(txn *sql.Tx, deliveryID string) error {
+	_, err := txn.Exec(deleteDeadLetterSQL, deliveryID)
+	return err
+}
+
+const insertDeadLetterSQL = `
+INSERT INTO webhook_dead_letters(delivery_id, service_id, dead_letter_json, time_added_ms) VALUES ($1, $2, $3, $4)
+`
+
+func insertDeadLetterTxn(txn *sql.Tx, letter types.DeadLetter) error {
+	letterJSON, err := json.Marshal(&letter)
+	if err != nil {
+		return err
+	}
+	if letterJSON, err = encryptColumn(letterJSON, "webhook_dead_letters", "dead_letter_json", letter.ID); err != nil {
+		return err
+	}
+	_, err = txn.Exec(insertDeadLetterSQL, letter.ID, letter.ServiceID, letterJSON, letter.TimeMs)
+	return err
+}
+
+const pruneDeadLettersSQL = `
+DELETE FROM webhook_dead_letters WHERE service_id = $1 AND delivery_id NOT IN (
+	SELECT delivery_id FROM (
+		SELECT delivery_id FROM webhook_dead_letters WHERE service_id = $1 ORDER BY time_added_ms DESC LIMIT $2
+	) AS kept
+)
+`
+
+func pruneDeadLettersTxn(txn *sql.Tx, serviceID string, keep int) error {
+	_, err := txn.Exec(pruneDeadLettersSQL, serviceID, keep)
+	return err
+}
+
+const selectDeadLetterSQL = `
+SELECT dead_letter_json FROM webhook_dead_letters WHERE delivery_id = $1
+`
+
+func selectDeadLetterTxn(txn *sql.Tx, deliveryID string) (letter types.DeadLetter, err error) {
+	var letterJSON []byte
+	if err = txn.QueryRow(selectDeadLetterSQL, deliveryID).Scan(&letterJSON); err != nil {
+		return
+	}
+	if letterJSON, err = decryptColumn(letterJSON, "webhook_dead_letters", "dead_letter_json", deliveryID); err != nil {
+		return
+	}
+	err = json.Unmarshal(letterJSON, &letter)
+	return
+}
+
+const selectDeadLettersSQL = `
+SELECT delivery_id, dead_letter_json FROM webhook_dead_letters WHERE service_id = $1 ORDER BY time_added_ms DESC
+`
+
+const selectAllDeadLettersSQL = `
+SELECT delivery_id, dead_letter_json FROM webhook_dead_letters ORDER BY time_added_ms DESC
+`
+
+func selectDeadLettersTxn(txn *sql.Tx, serviceID string) (letters []types.DeadLetter, err error) {
+	var rows *sql.Rows
+	if serviceID == "" {
+		rows, err = txn.Query(selectAllDeadLettersSQL)
+	} else {
+		rows, err = txn.Query(selectDeadLettersSQL, serviceID)
+	}
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var deliveryID string
+		var letterJSON []byte
+		if err = rows.Scan(&deliveryID, &letterJSON); err != nil {
+			return
+		}
+		if letterJSON, err = decryptColumn(letterJSON, "webhook_dead_letters", "dead_letter_json", deliveryID); err != nil {
+			return
+		}
+		var letter types.DeadLetter
+		if err = json.Unmarshal(letterJSON, &letter); err != nil {
+			return
+		}
+		letters = append(letters, letter)
+	}
+	return
+}
+
+const deleteDeadLettersSQL = `
+DELETE FROM webhook_dead_letters WHERE service_id = $1
+`
+
+func deleteDeadLettersTxn(txn *sql.Tx, serviceID string) error {
+	_, err := txn.Exec(deleteDeadLettersSQL, serviceID)
+	return err
+}
+
+const deleteWebhookDeliveriesSQL = `
+DELETE FROM webhook_deliveries WHERE service_id = $1
 `
 
-func selectBotOptionsTxn(txn *sql.Tx, userID, roomID string) (opts types.BotOptions, err error) {
-	var optionsJSON []byte
-	err = txn.QueryRow(selectBotOptionsSQL, userID, roomID).Scan(&optionsJSON, &opts.SetByUserID)
+func deleteWebhookDeliveriesTxn(txn *sql.Tx, serviceID string) error {
+	_, err := txn.Exec(deleteWebhookDeliveriesSQL, serviceID)
+	return err
+}
+
+const selectManagedResourcesSQL = `
+SELECT resource_id, resource_json FROM managed_resources WHERE resource_type = $1
+`
+
+func selectManagedResourcesTxn(txn *sql.Tx, resourceType string) (map[string][]byte, error) {
+	rows, err := txn.Query(selectManagedResourcesSQL, resourceType)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	resources := make(map[string][]byte)
+	for rows.Next() {
+		var id string
+		var resourceJSON []byte
+		if err = rows.Scan(&id, &resourceJSON); err != nil {
+			return nil, err
+		}
+		if resources[id], err = decryptColumn(resourceJSON, "managed_resources", "resource_json", resourceType, id); err != nil {
+			return nil, err
+		}
+	}
+	return resources, rows.Err()
+}
+
+const insertManagedResourceSQL = `
+INSERT INTO managed_resources(
+	resource_type, resource_id, resource_json, time_added_ms, time_updated_ms
+) VALUES ($1, $2, $3, $4, $5)
+`
+
+func insertManagedResourceTxn(txn *sql.Tx, now time.Time, resourceType, resourceID string, resourceJSON []byte) error {
+	t := now.UnixNano() / 1000000
+	resourceJSON, err := encryptColumn(resourceJSON, "managed_resources", "resource_json", resourceType, resourceID)
+	if err != nil {
+		return err
+	}
+	_, err = txn.Exec(insertManagedResourceSQL, resourceType, resourceID, resourceJSON, t, t)
+	return err
+}
+
+const updateManagedResourceSQL = `
+UPDATE managed_resources SET resource_json = $1, time_updated_ms = $2
+	WHERE resource_type = $3 AND resource_id = $4
+`
+
+func updateManagedResourceTxn(txn *sql.Tx, now time.Time, resourceType, resourceID string, resourceJSON []byte) (int64, error) {
+	t := now.UnixNano() / 1000000
+	resourceJSON, err := encryptColumn(resourceJSON, "managed_resources", "resource_json", resourceType, resourceID)
+	if err != nil {
+		return 0, err
+	}
+	res, err := txn.Exec(updateManagedResourceSQL, resourceJSON, t, resourceType, resourceID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+const deleteManagedResourceSQL = `
+DELETE FROM managed_resources WHERE resource_type = $1 AND resource_id = $2
+`
+
+func deleteManagedResourceTxn(txn *sql.Tx, resourceType, resourceID string) error {
+	_, err := txn.Exec(deleteManagedResourceSQL, resourceType, resourceID)
+	return err
+}
+
+const selectKarmaSQL = `
+SELECT score FROM karma WHERE service_id = $1 AND room_id = $2 AND name = $3
+`
+
+func selectKarmaTxn(txn *sql.Tx, serviceID, roomID, name string) (score int, err error) {
+	err = txn.QueryRow(selectKarmaSQL, serviceID, roomID, name).Scan(&score)
+	return
+}
+
+const selectTopKarmaSQL = `
+SELECT name, score FROM karma WHERE service_id = $1 AND room_id = $2 ORDER BY score DESC, name LIMIT $3
+`
+
+func selectTopKarmaTxn(txn *sql.Tx, serviceID, roomID string, limit int) (scores []types.KarmaScore, err error) {
+	rows, err := txn.Query(selectTopKarmaSQL, serviceID, roomID, limit)
 	if err != nil {
 		return
 	}
-	err = json.Unmarshal(optionsJSON, &opts.Options)
+	defer rows.Close()
+	for rows.Next() {
+		var score types.KarmaScore
+		if err = rows.Scan(&score.Name, &score.Score); err != nil {
+			return
+		}
+		scores = append(scores, score)
+	}
+	err = rows.Err()
 	return
 }
 
-const insertBotOptionsSQL = `
-INSERT INTO bot_options(
-	user_id, room_id, bot_options_json, set_by_user_id, time_added_ms, time_updated_ms
-) VALUES ($1, $2, $3, $4, $5, $6)
+const insertKarmaSQL = `
+INSERT INTO karma(service_id, room_id, name, score, time_added_ms, time_updated_ms)
+	VALUES ($1, $2, $3, $4, $5, $6)
 `
 
-func insertBotOptionsTxn(txn *sql.Tx, now time.Time, opts types.BotOptions) error {
+func insertKarmaTxn(txn *sql.Tx, now time.Time, serviceID, roomID, name string, score int) error {
 	t := now.UnixNano() / 1000000
-	optsJSON, err := json.Marshal(&opts.Options)
+	_, err := txn.Exec(insertKarmaSQL, serviceID, roomID, name, score, t, t)
+	return err
+}
+
+const updateKarmaSQL = `
+UPDATE karma SET score = score + $1, time_updated_ms = $2
+	WHERE service_id = $3 AND room_id = $4 AND name = $5
+`
+
+func updateKarmaTxn(txn *sql.Tx, now time.Time, serviceID, roomID, name string, delta int) (int64, error) {
+	t := now.UnixNano() / 1000000
+	res, err := txn.Exec(updateKarmaSQL, delta, t, serviceID, roomID, name)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+const deleteKarmaSQL = `
+DELETE FROM karma WHERE service_id = $1
+`
+
+func deleteKarmaTxn(txn *sql.Tx, serviceID string) error {
+	_, err := txn.Exec(deleteKarmaSQL, serviceID)
+	return err
+}
+
+const deleteScheduledJobSQL = `
+DELETE FROM scheduled_jobs WHERE job_id = $1
+`
+
+func deleteScheduledJobTxn(txn *sql.Tx, jobID string) error {
+	_, err := txn.Exec(deleteScheduledJobSQL, jobID)
+	return err
+}
+
+const insertScheduledJobSQL = `
+INSERT INTO scheduled_jobs(job_id, service_id, job_json, due_ms) VALUES ($1, $2, $3, $4)
+`
+
+func insertScheduledJobTxn(txn *sql.Tx, job types.ScheduledJob) error {
+	jobJSON, err := json.Marshal(&job)
 	if err != nil {
 		return err
 	}
-	_, err = txn.Exec(insertBotOptionsSQL, opts.UserID, opts.RoomID, optsJSON, opts.SetByUserID, t, t)
+	_, err = txn.Exec(insertScheduledJobSQL, job.ID, job.ServiceID, jobJSON, job.DueMs)
 	return err
 }
 
-const updateBotOptionsSQL = `
-UPDATE bot_options SET bot_options_json = $1, set_by_user_id = $2, time_updated_ms = $3
-	WHERE user_id = $4 AND room_id = $5
+const selectDueScheduledJobsSQL = `
+SELECT job_json FROM scheduled_jobs WHERE due_ms <= $1 ORDER BY due_ms
 `
 
-func updateBotOptionsTxn(txn *sql.Tx, now time.Time, opts types.BotOptions) error {
+func selectDueScheduledJobsTxn(txn *sql.Tx, nowMs int64) (jobs []types.ScheduledJob, err error) {
+	rows, err := txn.Query(selectDueScheduledJobsSQL, nowMs)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var jobJSON []byte
+		if err = rows.Scan(&jobJSON); err != nil {
+			return
+		}
+		var job types.ScheduledJob
+		if err = json.Unmarshal(jobJSON, &job); err != nil {
+			return
+		}
+		jobs = append(jobs, job)
+	}
+	return
+}
+
+const selectNextScheduledJobDueSQL = `
+SELECT due_ms FROM scheduled_jobs ORDER BY due_ms LIMIT 1
+`
+
+func selectNextScheduledJobDueTxn(txn *sql.Tx) (dueMs int64, err error) {
+	err = txn.QueryRow(selectNextScheduledJobDueSQL).Scan(&dueMs)
+	return
+}
+
+const deleteScheduledJobsSQL = `
+DELETE FROM scheduled_jobs WHERE service_id = $1
+`
+
+func deleteScheduledJobsTxn(txn *sql.Tx, serviceID string) error {
+	_, err := txn.Exec(deleteScheduledJobsSQL, serviceID)
+	return err
+}
+
+const selectPollSQL = `
+SELECT poll_json FROM polls WHERE service_id = $1 AND room_id = $2
+`
+
+func selectPollTxn(txn *sql.Tx, serviceID, roomID string) (poll types.Poll, err error) {
+	var pollJSON []byte
+	if err = txn.QueryRow(selectPollSQL, serviceID, roomID).Scan(&pollJSON); err != nil {
+		return
+	}
+	err = json.Unmarshal(pollJSON, &poll)
+	return
+}
+
+const insertPollSQL = `
+INSERT INTO polls(service_id, room_id, poll_json, time_added_ms, time_updated_ms)
+	VALUES ($1, $2, $3, $4, $5)
+`
+
+func insertPollTxn(txn *sql.Tx, now time.Time, poll types.Poll) error {
+	pollJSON, err := json.Marshal(&poll)
+	if err != nil {
+		return err
+	}
 	t := now.UnixNano() / 1000000
-	optsJSON, err := json.Marshal(&opts.Options)
+	_, err = txn.Exec(insertPollSQL, poll.ServiceID, poll.RoomID, pollJSON, t, t)
+	return err
+}
+
+const updatePollSQL = `
+UPDATE polls SET poll_json = $1, time_updated_ms = $2 WHERE service_id = $3 AND room_id = $4
+`
+
+func updatePollTxn(txn *sql.Tx, now time.Time, poll types.Poll) (int64, error) {
+	pollJSON, err := json.Marshal(&poll)
+	if err != nil {
+		return 0, err
+	}
+	t := now.UnixNano() / 1000000
+	res, err := txn.Exec(updatePollSQL, pollJSON, t, poll.ServiceID, poll.RoomID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+const deletePollSQL = `
+DELETE FROM polls WHERE service_id = $1 AND room_id = $2
+`
+
+func deletePollTxn(txn *sql.Tx, serviceID, roomID string) error {
+	_, err := txn.Exec(deletePollSQL, serviceID, roomID)
+	return err
+}
+
+const deletePollsSQL = `
+DELETE FROM polls WHERE service_id = $1
+`
+
+func deletePollsTxn(txn *sql.Tx, serviceID string) error {
+	_, err := txn.Exec(deletePollsSQL, serviceID)
+	return err
+}
+
+const selectMirroredPostSQL = `
+SELECT COUNT(*) FROM mirrored_posts WHERE service_id = $1 AND room_id = $2 AND post_id = $3
+`
+
+func selectMirroredPostTxn(txn *sql.Tx, serviceID, roomID, postID string) (mirrored bool, err error) {
+	var count int
+	err = txn.QueryRow(selectMirroredPostSQL, serviceID, roomID, postID).Scan(&count)
+	return count > 0, err
+}
+
+const insertMirroredPostSQL = `
+INSERT INTO mirrored_posts(service_id, room_id, post_id, time_added_ms) VALUES ($1, $2, $3, $4)
+`
+
+func insertMirroredPostTxn(txn *sql.Tx, now time.Time, serviceID, roomID, postID string) error {
+	_, err := txn.Exec(insertMirroredPostSQL, serviceID, roomID, postID, now.UnixNano()/1000000)
+	return err
+}
+
+const deleteMirroredPostSQL = `
+DELETE FROM mirrored_posts WHERE service_id = $1 AND room_id = $2 AND post_id = $3
+`
+
+func deleteMirroredPostTxn(txn *sql.Tx, serviceID, roomID, postID string) error {
+	_, err := txn.Exec(deleteMirroredPostSQL, serviceID, roomID, postID)
+	return err
+}
+
+const deleteMirroredPostsBeforeSQL = `
+DELETE FROM mirrored_posts WHERE service_id = $1 AND time_added_ms < $2
+`
+
+func deleteMirroredPostsBeforeTxn(txn *sql.Tx, serviceID string, before time.Time) error {
+	_, err := txn.Exec(deleteMirroredPostsBeforeSQL, serviceID, before.UnixNano()/1000000)
+	return err
+}
+
+const deleteMirroredPostsSQL = `
+DELETE FROM mirrored_posts WHERE service_id = $1
+`
+
+func deleteMirroredPostsTxn(txn *sql.Tx, serviceID string) error {
+	_, err := txn.Exec(deleteMirroredPostsSQL, serviceID)
+	return err
+}
+
+const selectSilencesSQL = `
+SELECT silence_json FROM silences WHERE room_id = $1 AND expires_ms > $2 ORDER BY expires_ms
+`
+
+func selectSilencesTxn(txn *sql.Tx, roomID string, now time.Time) (silences []types.Silence, err error) {
+	rows, err := txn.Query(selectSilencesSQL, roomID, now.UnixNano()/1000000)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var silenceJSON []byte
+		if err = rows.Scan(&silenceJSON); err != nil {
+			return
+		}
+		var silence types.Silence
+		if err = json.Unmarshal(silenceJSON, &silence); err != nil {
+			return
+		}
+		silences = append(silences, silence)
+	}
+	return
+}
+
+const insertSilenceSQL = `
+INSERT INTO silences(room_id, matcher, silence_json, expires_ms, time_added_ms)
+	VALUES ($1, $2, $3, $4, $5)
+`
+
+func insertSilenceTxn(txn *sql.Tx, now time.Time, silence types.Silence) error {
+	silenceJSON, err := json.Marshal(&silence)
 	if err != nil {
 		return err
 	}
-	_, err = txn.Exec(updateBotOptionsSQL, optsJSON, opts.SetByUserID, t, opts.UserID, opts.RoomID)
+	_, err = txn.Exec(insertSilenceSQL, silence.RoomID, silence.Matcher, silenceJSON, silence.ExpiresMs,
+		now.UnixNano()/1000000)
+	return err
+}
+
+const deleteSilenceSQL = `
+DELETE FROM silences WHERE room_id = $1 AND matcher = $2
+`
+
+func deleteSilenceTxn(txn *sql.Tx, roomID, matcher string) (int64, error) {
+	res, err := txn.Exec(deleteSilenceSQL, roomID, matcher)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+const deleteExpiredSilencesSQL = `
+DELETE FROM silences WHERE room_id = $1 AND expires_ms <= $2
+`
+
+func deleteExpiredSilencesTxn(txn *sql.Tx, roomID string, now time.Time) error {
+	_, err := txn.Exec(deleteExpiredSilencesSQL, roomID, now.UnixNano()/1000000)
+	return err
+}
+
+const selectCryptoStateSQL = `
+SELECT state_key, state_json FROM crypto_state WHERE user_id = $1 AND device_id = $2
+`
+
+func selectCryptoStateTxn(txn *sql.Tx, userID, deviceID string) (map[string][]byte, error) {
+	rows, err := txn.Query(selectCryptoStateSQL, userID, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	state := make(map[string][]byte)
+	for rows.Next() {
+		var key string
+		var stateJSON []byte
+		if err = rows.Scan(&key, &stateJSON); err != nil {
+			return nil, err
+		}
+		if state[key], err = decryptColumn(stateJSON, "crypto_state", "state_json", userID, deviceID, key); err != nil {
+			return nil, err
+		}
+	}
+	return state, rows.Err()
+}
+
+const insertCryptoStateSQL = `
+INSERT INTO crypto_state(user_id, device_id, state_key, state_json, time_updated_ms) VALUES ($1, $2, $3, $4, $5)
+`
+
+func insertCryptoStateTxn(txn *sql.Tx, now time.Time, userID, deviceID, key string, stateJSON []byte) error {
+	stateJSON, err := encryptColumn(stateJSON, "crypto_state", "state_json", userID, deviceID, key)
+	if err != nil {
+		return err
+	}
+	_, err = txn.Exec(insertCryptoStateSQL, userID, deviceID, key, stateJSON, now.UnixNano()/1000000)
 	return err
 }
+
+const updateCryptoStateSQL = `
+UPDATE crypto_state SET state_json = $1, time_updated_ms = $2
+	WHERE user_id = $3 AND device_id = $4 AND state_key = $5
+`
+
+func updateCryptoStateTxn(txn *sql.Tx, now time.Time, userID, deviceID, key string, stateJSON []byte) (int64, error) {
+	stateJSON, err := encryptColumn(stateJSON, "crypto_state", "state_json", userID, deviceID, key)
+	if err != nil {
+		return 0, err
+	}
+	res, err := txn.Exec(updateCryptoStateSQL, stateJSON, now.UnixNano()/1000000, userID, deviceID, key)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
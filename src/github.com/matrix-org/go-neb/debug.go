@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// debugHandlers returns the handlers for diagnosing memory growth and goroutine leaks in a running
+// process, keyed by path. They must only be served behind admin auth: profiles reveal a lot about
+// the process, and some of them take seconds of CPU to produce.
+//
+// Importing net/http/pprof also registers these handlers on http.DefaultServeMux, which is why no
+// listener serves http.DefaultServeMux.
+func debugHandlers() map[string]http.HandlerFunc {
+	return map[string]http.HandlerFunc{
+		// Includes /debug/pprof/goroutine?debug=2 for a dump of every goroutine's stack, and
+		// /debug/pprof/heap for a heap profile.
+		"/debug/pprof/":        allowMethods(pprof.Index, "GET"),
+		"/debug/pprof/cmdline": allowMethods(pprof.Cmdline, "GET"),
+		"/debug/pprof/profile": allowMethods(pprof.Profile, "GET"),
+		"/debug/pprof/symbol":  allowMethods(pprof.Symbol, "GET", "POST"),
+		"/debug/pprof/trace":   allowMethods(pprof.Trace, "GET"),
+		"/debug/gcstats":       gcStatsHandler,
+	}
+}
+
+// allowMethods wraps a handler which would serve any method, responding to other methods with
+// HTTP 405 instead.
+func allowMethods(handler http.HandlerFunc, methods ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		for _, m := range methods {
+			if req.Method == m {
+				handler(w, req)
+				return
+			}
+		}
+		w.WriteHeader(405)
+	}
+}
+
+// gcStats is a summary of the garbage collector and memory usage.
+type gcStats struct {
+	Goroutines     int
+	NumGC          int64
+	LastGC         time.Time
+	PauseTotalMs   float64
+	RecentPausesMs []float64 // The most recent first.
+	HeapAllocBytes uint64    // Bytes of allocated heap objects.
+	HeapSysBytes   uint64    // Bytes of heap memory obtained from the OS.
+	HeapObjects    uint64
+	NextGCBytes    uint64 // The heap size the next GC will happen at.
+	SysBytes       uint64 // Total bytes of memory obtained from the OS.
+}
+
+// gcStatsHandler serves a summary of the garbage collector and memory usage as JSON. With ?gc=1, a
+// garbage collection is run first so that the numbers only include live objects.
+func gcStatsHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		w.WriteHeader(405)
+		return
+	}
+	if req.URL.Query().Get("gc") == "1" {
+		runtime.GC()
+	}
+	var gc debug.GCStats
+	debug.ReadGCStats(&gc)
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	stats := gcStats{
+		Goroutines:     runtime.NumGoroutine(),
+		NumGC:          gc.NumGC,
+		LastGC:         gc.LastGC,
+		PauseTotalMs:   durationMs(gc.PauseTotal),
+		RecentPausesMs: []float64{},
+		HeapAllocBytes: mem.HeapAlloc,
+		HeapSysBytes:   mem.HeapSys,
+		HeapObjects:    mem.HeapObjects,
+		NextGCBytes:    mem.NextGC,
+		SysBytes:       mem.Sys,
+	}
+	for i := 0; i < len(gc.Pause) && i < 10; i++ {
+		stats.RecentPausesMs = append(stats.RecentPausesMs, durationMs(gc.Pause[i]))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&stats)
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"github.com/matrix-org/go-neb/server"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDebugHandlersRequireAuth(t *testing.T) {
+	handlers := debugHandlers()
+	tests := []struct {
+		method     string
+		path       string
+		handler    string
+		authHeader string
+		wantCode   int
+	}{
+		{"GET", "/debug/pprof/goroutine?debug=2", "/debug/pprof/", "", 401},
+		{"OPTIONS", "/debug/pprof/goroutine?debug=2", "/debug/pprof/", "", 204},
+		{"OPTIONS", "/debug/pprof/cmdline", "/debug/pprof/cmdline", "", 204},
+		{"OPTIONS", "/debug/pprof/profile", "/debug/pprof/profile", "", 204},
+		{"OPTIONS", "/debug/gcstats", "/debug/gcstats", "", 204},
+		{"PUT", "/debug/pprof/goroutine?debug=2", "/debug/pprof/", "Bearer s3cret", 405},
+		{"GET", "/debug/pprof/goroutine?debug=2", "/debug/pprof/", "Bearer s3cret", 200},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.path, nil)
+		if test.authHeader != "" {
+			req.Header.Set("Authorization", test.authHeader)
+		}
+		w := httptest.NewRecorder()
+		server.WithAdminAuth("s3cret", handlers[test.handler])(w, req)
+		if w.Code != test.wantCode {
+			t.Errorf("%s %s with Authorization %q => Want HTTP %d got %d", test.method, test.path, test.authHeader, test.wantCode, w.Code)
+		}
+		if test.wantCode != 200 && strings.Contains(w.Body.String(), "goroutine") {
+			t.Errorf("%s %s with Authorization %q => Want no profile output, got %q", test.method, test.path, test.authHeader, w.Body.String())
+		}
+	}
+}
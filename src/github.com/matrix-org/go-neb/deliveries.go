@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/clients"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/errors"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/ops"
+	"github.com/matrix-org/go-neb/server"
+	"github.com/matrix-org/go-neb/status"
+	"github.com/matrix-org/go-neb/types"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// maxStoredWebhookBody is the largest webhook body which is stored in full. Larger bodies are
+// still passed to the service, but only this much is stored and the delivery cannot be replayed.
+const maxStoredWebhookBody = 256 * 1024
+
+// webhookDeliveriesPerService is the number of recent webhook deliveries stored for each service.
+const webhookDeliveriesPerService = 20
+
+// deadLettersPerService is the number of dead letters kept for each service. A service which
+// fails on everything it receives would otherwise fill the database.
+const deadLettersPerService = 100
+
+// unstoredWebhookHeaders are never written to the database, nor are secret-looking headers such as
+// X-Gitlab-Token, or query parameters such as ?token=. They authenticate the sender to reverse
+// proxies, or carry a secret shared with the service, and are not needed to replay a delivery:
+// services don't check shared secrets on replays, which the admin API authenticates instead (see
+// server.MarkReplay). Signature headers, which are derived from the body, are kept so that
+// replays of signed requests still verify.
+var unstoredWebhookHeaders = []string{"Authorization", "Cookie", "Proxy-Authorization"}
+
+// redacted replaces secrets when a stored delivery is displayed.
+const redacted = "<redacted>"
+
+// isSecretName returns true if a header or JSON key with this name probably holds a secret,
+// e.g. X-Gitlab-Token or "password".
+func isSecretName(name string) bool {
+	name = strings.ToLower(name)
+	for _, s := range []string{"secret", "token", "password"} {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// captureWebhook reads the body of an incoming webhook request into a delivery which can be
+// stored once the service has handled it. The request body is replaced so the service can still
+// read all of it.
+func captureWebhook(req *http.Request, serviceID string) (*types.WebhookDelivery, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxStoredWebhookBody+1))
+	if err != nil {
+		return nil, err
+	}
+	req.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body), req.Body))
+
+	id := make([]byte, 8)
+	if _, err = rand.Read(id); err != nil {
+		return nil, err
+	}
+	header := make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		if !isSecretName(k) {
+			header[k] = v
+		}
+	}
+	for _, k := range unstoredWebhookHeaders {
+		header.Del(k)
+	}
+	truncated := len(body) > maxStoredWebhookBody
+	if truncated {
+		body = body[:maxStoredWebhookBody]
+	}
+	return &types.WebhookDelivery{
+		ID:        hex.EncodeToString(id),
+		ServiceID: serviceID,
+		TimeMs:    time.Now().UnixNano() / 1000000,
+		Method:    req.Method,
+		URL:       stripSecretParams(req.URL.RequestURI()),
+		Header:    header,
+		Body:      string(body),
+		Truncated: truncated,
+	}, nil
+}
+
+// runWebhook passes a webhook request to a service, recording the service's activity, including
+// whether the request passed the service's signature or token check. Returns the HTTP status code
+// the service responded with, and why it failed to process the request if it panicked or responded
+// with a server error, e.g. because it couldn't send into a room. Client errors, e.g. a bad
+// signature, are the sender's problem rather than a failure to process.
+func runWebhook(service types.Service, w http.ResponseWriter, req *http.Request, cli *matrix.Client) (code int, failure string) {
+	status.Received(service.ServiceID())
+	rec := server.NewStatusRecorder(w)
+	defer func() {
+		if r := recover(); r != nil {
+			server.RequestLogger(req).WithFields(log.Fields{
+				"service_id": service.ServiceID(),
+				"panic":      fmt.Sprint(r),
+				"stack":      string(debug.Stack()),
+			}).Error("Recovered from panic in webhook handler")
+			// If the handler already started responding, this does nothing and the sender
+			// receives a truncated response.
+			rec.WriteHeader(500)
+			err := fmt.Errorf("Webhook handler panicked: %v", r)
+			status.Failed(service.ServiceID(), err)
+			code, failure = 500, err.Error()
+		}
+	}()
+	service.OnReceiveWebhook(rec, req, cli)
+	if rec.Code != 401 && rec.Code != 403 {
+		// Services reject requests which fail their signature or token check with one of these.
+		status.Verified(service.ServiceID())
+	}
+	if rec.Code >= 400 {
+		status.Failed(service.ServiceID(), fmt.Errorf("Webhook handler responded with HTTP %d", rec.Code))
+	}
+	if rec.Code >= 500 {
+		failure = fmt.Sprintf("Webhook handler responded with HTTP %d: see the logs for request %s",
+			rec.Code, req.Header.Get(server.RequestIDHeader))
+	}
+	return rec.Code, failure
+}
+
+// storeDeadLetter keeps a delivery which its service failed to process, so that it can be
+// replayed once the problem is fixed, and alerts the operators. Failing again to process a
+// delivery which is already a dead letter counts another attempt.
+func storeDeadLetter(db *database.ServiceDB, delivery types.WebhookDelivery, reason string) {
+	logger := log.WithFields(log.Fields{
+		"service_id":  delivery.ServiceID,
+		"delivery_id": delivery.ID,
+	})
+	letter, err := db.LoadDeadLetter(delivery.ID)
+	if err == sql.ErrNoRows {
+		letter = types.DeadLetter{WebhookDelivery: delivery}
+	} else if err != nil {
+		logger.WithError(err).Error("Failed to load dead letter")
+		return
+	}
+	letter.ResponseCode = delivery.ResponseCode
+	letter.Reason = reason
+	letter.Attempts++
+	letter.LastAttemptMs = time.Now().UnixNano() / 1000000
+	if err = db.StoreDeadLetter(letter, deadLettersPerService); err != nil {
+		logger.WithError(err).Error("Failed to store dead letter")
+		return
+	}
+	logger.WithField("reason", reason).Warn("Stored webhook delivery as a dead letter")
+	ops.Alert("Service %s is failing to process webhook deliveries. They are kept as dead letters to replay once it is fixed: see /admin/deadLetters?service_id=%s",
+		delivery.ServiceID, delivery.ServiceID)
+}
+
+// stripSecretParams removes secret-looking query parameters, e.g. ?token=, from a request URI.
+func stripSecretParams(uri string) string {
+	u, err := url.ParseRequestURI(uri)
+	if err != nil {
+		return uri
+	}
+	query := u.Query()
+	changed := false
+	for k := range query {
+		if isSecretName(k) {
+			query.Del(k)
+			changed = true
+		}
+	}
+	if !changed {
+		return uri
+	}
+	u.RawQuery = query.Encode()
+	return u.RequestURI()
+}
+
+// redactDelivery returns a copy of the delivery with the values of secret-looking headers and
+// top-level JSON body keys replaced, and secret-looking query parameters removed, in case the
+// delivery was stored before they were removed on capture.
+func redactDelivery(d types.WebhookDelivery) types.WebhookDelivery {
+	d.URL = stripSecretParams(d.URL)
+	header := make(http.Header, len(d.Header))
+	for k, v := range d.Header {
+		if isSecretName(k) {
+			v = []string{redacted}
+		}
+		header[k] = v
+	}
+	d.Header = header
+
+	var body map[string]interface{}
+	if json.Unmarshal([]byte(d.Body), &body) == nil {
+		changed := false
+		for k := range body {
+			if isSecretName(k) {
+				body[k] = redacted
+				changed = true
+			}
+		}
+		if changed {
+			if b, err := json.Marshal(body); err == nil {
+				d.Body = string(b)
+			}
+		}
+	}
+	return d
+}
+
+type webhookDeliveriesHandler struct {
+	db *database.ServiceDB
+}
+
+func (h *webhookDeliveriesHandler) OnIncomingRequest(req *http.Request) (interface{}, *errors.HTTPError) {
+	if req.Method != "GET" {
+		return nil, &errors.HTTPError{nil, "Unsupported Method", 405}
+	}
+	serviceID := req.URL.Query().Get("service_id")
+	if serviceID == "" {
+		return nil, &errors.HTTPError{nil, `Missing "service_id"`, 400}
+	}
+	deliveries, err := h.db.LoadWebhookDeliveries(serviceID)
+	if err != nil {
+		return nil, &errors.HTTPError{err, "Failed to load webhook deliveries", 500}
+	}
+	type deliverySummary struct {
+		ID           string
+		TimeMs       int64
+		Method       string
+		URL          string
+		Size         int
+		Truncated    bool
+		ResponseCode int
+	}
+	res := struct {
+		Deliveries []deliverySummary
+	}{[]deliverySummary{}}
+	for _, d := range deliveries {
+		res.Deliveries = append(res.Deliveries, deliverySummary{
+			d.ID, d.TimeMs, d.Method, d.URL, len(d.Body), d.Truncated, d.ResponseCode,
+		})
+	}
+	return &res, nil
+}
+
+type getWebhookDeliveryHandler struct {
+	db *database.ServiceDB
+}
+
+func (h *getWebhookDeliveryHandler) OnIncomingRequest(req *http.Request) (interface{}, *errors.HTTPError) {
+	if req.Method != "POST" {
+		return nil, &errors.HTTPError{nil, "Unsupported Method", 405}
+	}
+	var body struct {
+		ID string
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return nil, &errors.HTTPError{err, "Error parsing request JSON", 400}
+	}
+	if body.ID == "" {
+		return nil, &errors.HTTPError{nil, `Must supply a "ID"`, 400}
+	}
+	delivery, err := h.db.LoadWebhookDelivery(body.ID)
+	if err == sql.ErrNoRows {
+		return nil, &errors.HTTPError{err, "Webhook delivery not found", 404}
+	} else if err != nil {
+		return nil, &errors.HTTPError{err, "Failed to load webhook delivery", 500}
+	}
+	redactedDelivery := redactDelivery(delivery)
+	return &redactedDelivery, nil
+}
+
+type replayWebhookDeliveryHandler struct {
+	db      *database.ServiceDB
+	clients *clients.Clients
+}
+
+func (h *replayWebhookDeliveryHandler) OnIncomingRequest(req *http.Request) (interface{}, *errors.HTTPError) {
+	if req.Method != "POST" {
+		return nil, &errors.HTTPError{nil, "Unsupported Method", 405}
+	}
+	var body struct {
+		ID string
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return nil, &errors.HTTPError{err, "Error parsing request JSON", 400}
+	}
+	if body.ID == "" {
+		return nil, &errors.HTTPError{nil, `Must supply a "ID"`, 400}
+	}
+	delivery, err := h.db.LoadWebhookDelivery(body.ID)
+	if err == sql.ErrNoRows {
+		return nil, &errors.HTTPError{err, "Webhook delivery not found", 404}
+	} else if err != nil {
+		return nil, &errors.HTTPError{err, "Failed to load webhook delivery", 500}
+	}
+	res, httpErr := replayDelivery(h.db, h.clients, delivery)
+	if httpErr != nil {
+		return nil, httpErr
+	}
+	return res, nil
+}
+
+// A replayResult is what a service did with a replayed delivery.
+type replayResult struct {
+	RequestID string // The request ID of the replay, for finding it in the logs.
+	Code      int
+	Body      string
+	// Failure is why the service failed to process the delivery, if it did. The delivery is then
+	// stored as a dead letter; otherwise any dead letter for it is removed.
+	Failure string `json:",omitempty"`
+}
+
+// replayDelivery passes a stored delivery to its service again.
+func replayDelivery(db *database.ServiceDB, clis *clients.Clients, delivery types.WebhookDelivery) (*replayResult, *errors.HTTPError) {
+	if delivery.Truncated {
+		return nil, &errors.HTTPError{nil, "Webhook delivery was too large to store in full and cannot be replayed", 400}
+	}
+
+	// Replay against the service as it is configured now, which may differ from when the delivery
+	// was received: that's usually the point.
+	service, err := db.LoadService(delivery.ServiceID)
+	if err == sql.ErrNoRows {
+		return nil, &errors.HTTPError{err, "Service not found", 404}
+	} else if err != nil {
+		return nil, &errors.HTTPError{err, "Failed to load service", 500}
+	}
+	cli, err := clis.Client(service.ServiceUserID())
+	if err != nil {
+		return nil, &errors.HTTPError{err, "Failed to retrieve matrix client instance", 500}
+	}
+
+	replayReq, err := http.NewRequest(delivery.Method, delivery.URL, strings.NewReader(delivery.Body))
+	if err != nil {
+		return nil, &errors.HTTPError{err, "Failed to rebuild webhook request", 500}
+	}
+	for k, v := range delivery.Header {
+		replayReq.Header[k] = v
+	}
+	// Give the replay its own request ID so its log lines can be told apart from the original's.
+	replayReq.Header.Del(server.RequestIDHeader)
+	replayReq = server.MarkReplay(replayReq)
+	res := httptest.NewRecorder()
+	var failure string
+	server.WithRequestID(func(w http.ResponseWriter, r *http.Request) {
+		delivery.ResponseCode, failure = runWebhook(service, w, r, cli)
+	})(res, replayReq)
+
+	if failure != "" {
+		storeDeadLetter(db, delivery, failure)
+	} else if err = db.DeleteDeadLetter(delivery.ID); err != nil {
+		log.WithError(err).WithField("delivery_id", delivery.ID).Error("Failed to delete dead letter")
+	}
+	return &replayResult{replayReq.Header.Get(server.RequestIDHeader), res.Code, res.Body.String(), failure}, nil
+}
+
+type deadLettersHandler struct {
+	db *database.ServiceDB
+}
+
+func (h *deadLettersHandler) OnIncomingRequest(req *http.Request) (interface{}, *errors.HTTPError) {
+	if req.Method != "GET" {
+		return nil, &errors.HTTPError{nil, "Unsupported Method", 405}
+	}
+	letters, err := h.db.LoadDeadLetters(req.URL.Query().Get("service_id"))
+	if err != nil {
+		return nil, &errors.HTTPError{err, "Failed to load dead letters", 500}
+	}
+	type deadLetterSummary struct {
+		ID            string
+		ServiceID     string
+		TimeMs        int64
+		Method        string
+		Size          int
+		Truncated     bool
+		ResponseCode  int
+		Reason        string
+		Attempts      int
+		LastAttemptMs int64
+	}
+	res := struct {
+		DeadLetters []deadLetterSummary
+	}{[]deadLetterSummary{}}
+	for _, l := range letters {
+		res.DeadLetters = append(res.DeadLetters, deadLetterSummary{
+			l.ID, l.ServiceID, l.TimeMs, l.Method, len(l.Body), l.Truncated, l.ResponseCode,
+			l.Reason, l.Attempts, l.LastAttemptMs,
+		})
+	}
+	return &res, nil
+}
+
+// loadDeadLetter loads the dead letter whose ID is given in the request body.
+func loadDeadLetter(db *database.ServiceDB, req *http.Request) (*types.DeadLetter, *errors.HTTPError) {
+	if req.Method != "POST" {
+		return nil, &errors.HTTPError{nil, "Unsupported Method", 405}
+	}
+	var body struct {
+		ID string
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return nil, &errors.HTTPError{err, "Error parsing request JSON", 400}
+	}
+	if body.ID == "" {
+		return nil, &errors.HTTPError{nil, `Must supply a "ID"`, 400}
+	}
+	letter, err := db.LoadDeadLetter(body.ID)
+	if err == sql.ErrNoRows {
+		return nil, &errors.HTTPError{err, "Dead letter not found", 404}
+	} else if err != nil {
+		return nil, &errors.HTTPError{err, "Failed to load dead letter", 500}
+	}
+	return &letter, nil
+}
+
+type getDeadLetterHandler struct {
+	db *database.ServiceDB
+}
+
+func (h *getDeadLetterHandler) OnIncomingRequest(req *http.Request) (interface{}, *errors.HTTPError) {
+	letter, httpErr := loadDeadLetter(h.db, req)
+	if httpErr != nil {
+		return nil, httpErr
+	}
+	letter.WebhookDelivery = redactDelivery(letter.WebhookDelivery)
+	return letter, nil
+}
+
+type replayDeadLetterHandler struct {
+	db      *database.ServiceDB
+	clients *clients.Clients
+}
+
+func (h *replayDeadLetterHandler) OnIncomingRequest(req *http.Request) (interface{}, *errors.HTTPError) {
+	letter, httpErr := loadDeadLetter(h.db, req)
+	if httpErr != nil {
+		return nil, httpErr
+	}
+	res, httpErr := replayDelivery(h.db, h.clients, letter.WebhookDelivery)
+	if httpErr != nil {
+		return nil, httpErr
+	}
+	return res, nil
+}
+
+type removeDeadLetterHandler struct {
+	db *database.ServiceDB
+}
+
+func (h *removeDeadLetterHandler) OnIncomingRequest(req *http.Request) (interface{}, *errors.HTTPError) {
+	letter, httpErr := loadDeadLetter(h.db, req)
+	if httpErr != nil {
+		return nil, httpErr
+	}
+	if err := h.db.DeleteDeadLetter(letter.ID); err != nil {
+		return nil, &errors.HTTPError{err, "Failed to delete dead letter", 500}
+	}
+	return &struct{}{}, nil
+}
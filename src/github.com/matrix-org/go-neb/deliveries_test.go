@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStripSecretParams(t *testing.T) {
+	tests := map[string]string{
+		"/services/hooks/ZWNobw":                          "/services/hooks/ZWNobw",
+		"/services/hooks/ZWNobw?token=s3cret":             "/services/hooks/ZWNobw",
+		"/services/hooks/ZWNobw?a=1&token=s3cret":         "/services/hooks/ZWNobw?a=1",
+		"/services/hooks/ZWNobw?secret=x&api_token=y&b=2": "/services/hooks/ZWNobw?b=2",
+	}
+	for uri, want := range tests {
+		if got := stripSecretParams(uri); got != want {
+			t.Errorf("stripSecretParams(%q) => want %q got %q", uri, want, got)
+		}
+	}
+}
+
+func TestCaptureWebhookDropsSecrets(t *testing.T) {
+	req := httptest.NewRequest("POST", "/services/hooks/ZWNobw?token=s3cret&a=1", strings.NewReader(`{"a":1}`))
+	req.Header.Set("Authorization", "Bearer s3cret")
+	req.Header.Set("X-Gitlab-Token", "s3cret")
+	req.Header.Set("X-Webhook-Secret", "s3cret")
+	req.Header.Set("X-Hub-Signature-256", "sha256=abc")
+	req.Header.Set("Content-Type", "application/json")
+	d, err := captureWebhook(req, "svc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"Authorization", "X-Gitlab-Token", "X-Webhook-Secret"} {
+		if v, ok := d.Header[k]; ok {
+			t.Errorf("captureWebhook => want %s not stored, got %q", k, v)
+		}
+	}
+	for _, k := range []string{"X-Hub-Signature-256", "Content-Type"} {
+		if d.Header.Get(k) != req.Header.Get(k) {
+			t.Errorf("captureWebhook => want %s stored, got %q", k, d.Header.Get(k))
+		}
+	}
+	if d.URL != "/services/hooks/ZWNobw?a=1" || d.Body != `{"a":1}` {
+		t.Errorf("captureWebhook => want URL without token and the body, got %q %q", d.URL, d.Body)
+	}
+	if req.Header.Get("X-Gitlab-Token") != "s3cret" {
+		t.Errorf("captureWebhook => want the request's headers left alone, got %v", req.Header)
+	}
+	if body, _ := ioutil.ReadAll(req.Body); string(body) != `{"a":1}` {
+		t.Errorf("captureWebhook => want the request body still readable, got %q", body)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/httpclient"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// errorReportInterval is how often the same error is reported. Repeats in between are counted
+// and included in the next report, so a failure which happens on every request doesn't flood
+// the receiver.
+const errorReportInterval = 10 * time.Minute
+
+// maxTrackedErrors is the number of distinct error messages whose repeats are counted. Beyond
+// this, errors which haven't been reported recently are forgotten.
+const maxTrackedErrors = 1000
+
+// errorReport is the JSON body POSTed to ERROR_WEBHOOK_URL.
+type errorReport struct {
+	Text    string            `json:"text"` // A one line summary, for Slack-compatible receivers.
+	Level   string            `json:"level"`
+	Message string            `json:"message"`
+	Time    time.Time         `json:"time"`
+	Fields  map[string]string `json:"fields"`
+	Repeats int               `json:"repeats"` // Times the error happened since it was last reported.
+}
+
+type trackedError struct {
+	lastReported time.Time
+	repeats      int
+}
+
+// errorReporter is a logrus hook which POSTs errors and panics to a webhook, so that operators
+// find out about them without watching the logs.
+type errorReporter struct {
+	url        string
+	httpClient *http.Client
+	mu         sync.Mutex
+	errors     map[string]*trackedError // message => tracking info
+}
+
+func newErrorReporter(url string) *errorReporter {
+	return &errorReporter{
+		url:        url,
+		httpClient: httpclient.New(10 * time.Second),
+		errors:     make(map[string]*trackedError),
+	}
+}
+
+func (r *errorReporter) Levels() []log.Level {
+	return []log.Level{log.PanicLevel, log.FatalLevel, log.ErrorLevel}
+}
+
+func (r *errorReporter) Fire(entry *log.Entry) error {
+	repeats, report := r.track(entry.Message, entry.Time)
+	if !report {
+		return nil
+	}
+	fields := make(map[string]string, len(entry.Data))
+	for k, v := range entry.Data {
+		fields[k] = fmt.Sprint(v)
+	}
+	body, err := json.Marshal(&errorReport{
+		Text:    fmt.Sprintf("Go-NEB %s: %s", entry.Level, entry.Message),
+		Level:   entry.Level.String(),
+		Message: entry.Message,
+		Time:    entry.Time,
+		Fields:  fields,
+		Repeats: repeats,
+	})
+	if err != nil {
+		return err
+	}
+	if entry.Level == log.ErrorLevel {
+		go r.send(body)
+	} else {
+		// The process is about to exit: send the report before it does.
+		r.send(body)
+	}
+	return nil
+}
+
+// track records that an error with the given message happened. Returns true if it should be
+// reported, along with the number of times it happened since it was last reported.
+func (r *errorReporter) track(message string, now time.Time) (int, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e := r.errors[message]
+	if e == nil {
+		if len(r.errors) >= maxTrackedErrors {
+			for msg, old := range r.errors {
+				if now.Sub(old.lastReported) > errorReportInterval {
+					delete(r.errors, msg)
+				}
+			}
+		}
+		r.errors[message] = &trackedError{lastReported: now}
+		return 0, true
+	}
+	if now.Sub(e.lastReported) < errorReportInterval {
+		e.repeats++
+		return 0, false
+	}
+	repeats := e.repeats
+	e.lastReported = now
+	e.repeats = 0
+	return repeats, true
+}
+
+func (r *errorReporter) send(body []byte) {
+	res, err := r.httpClient.Post(r.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		// Don't log at error level, else this failure would be reported too.
+		log.WithError(err).Warn("Failed to send error report")
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		log.WithField("status", res.StatusCode).Warn("Failed to send error report")
+	}
+}
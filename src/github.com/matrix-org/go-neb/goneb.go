@@ -1,73 +1,787 @@
 package main
 
 import (
+	"crypto/tls"
+	"flag"
+	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/matrix-org/dugong"
+	"github.com/matrix-org/go-neb/batch"
 	"github.com/matrix-org/go-neb/clients"
 	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/metrics"
+	"github.com/matrix-org/go-neb/ops"
+	"github.com/matrix-org/go-neb/plugin"
+	_ "github.com/matrix-org/go-neb/realms/bitbucket"
 	_ "github.com/matrix-org/go-neb/realms/github"
+	_ "github.com/matrix-org/go-neb/realms/githubapp"
+	_ "github.com/matrix-org/go-neb/realms/gitlab"
+	_ "github.com/matrix-org/go-neb/realms/google"
 	_ "github.com/matrix-org/go-neb/realms/jira"
+	_ "github.com/matrix-org/go-neb/realms/pagerduty"
+	_ "github.com/matrix-org/go-neb/realms/pat"
+	_ "github.com/matrix-org/go-neb/realms/slack"
+	"github.com/matrix-org/go-neb/relay"
+	"github.com/matrix-org/go-neb/scheduler"
+	"github.com/matrix-org/go-neb/secrets"
 	"github.com/matrix-org/go-neb/server"
+	_ "github.com/matrix-org/go-neb/services/alertmanager"
+	_ "github.com/matrix-org/go-neb/services/bitbucket"
+	_ "github.com/matrix-org/go-neb/services/cron"
+	_ "github.com/matrix-org/go-neb/services/dice"
+	_ "github.com/matrix-org/go-neb/services/dockerhub"
 	_ "github.com/matrix-org/go-neb/services/echo"
+	_ "github.com/matrix-org/go-neb/services/email"
+	_ "github.com/matrix-org/go-neb/services/fediverse"
 	_ "github.com/matrix-org/go-neb/services/giphy"
+	_ "github.com/matrix-org/go-neb/services/gitea"
 	_ "github.com/matrix-org/go-neb/services/github"
+	_ "github.com/matrix-org/go-neb/services/gitlab"
+	_ "github.com/matrix-org/go-neb/services/grafana"
+	_ "github.com/matrix-org/go-neb/services/guggy"
 	_ "github.com/matrix-org/go-neb/services/jira"
+	_ "github.com/matrix-org/go-neb/services/karma"
+	_ "github.com/matrix-org/go-neb/services/outgoingwebhook"
+	_ "github.com/matrix-org/go-neb/services/pagerduty"
+	_ "github.com/matrix-org/go-neb/services/poll"
+	_ "github.com/matrix-org/go-neb/services/reminder"
+	_ "github.com/matrix-org/go-neb/services/search"
+	_ "github.com/matrix-org/go-neb/services/sentry"
+	_ "github.com/matrix-org/go-neb/services/statuspage"
+	_ "github.com/matrix-org/go-neb/services/translate"
+	_ "github.com/matrix-org/go-neb/services/travisci"
+	_ "github.com/matrix-org/go-neb/services/weather"
+	_ "github.com/matrix-org/go-neb/services/webhook"
+	"github.com/matrix-org/go-neb/streams"
+	"github.com/matrix-org/go-neb/tokens"
 	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/go-neb/ui"
 	_ "github.com/mattn/go-sqlite3"
+	"golang.org/x/crypto/acme/autocert"
+	"net"
 	"net/http"
-	_ "net/http/pprof"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
 func main() {
-	bindAddress := os.Getenv("BIND_ADDRESS")
-	databaseType := os.Getenv("DATABASE_TYPE")
-	databaseURL := os.Getenv("DATABASE_URL")
-	baseURL := os.Getenv("BASE_URL")
-	logDir := os.Getenv("LOG_DIR")
+	configFile := os.Getenv("CONFIG_FILE")
+	flag.StringVar(&configFile, "config", configFile, "YAML file of clients, realms, sessions and services to apply on startup, instead of CONFIG_FILE")
+	flag.Parse()
+
+	errorLog := setupLogs()
+	logVariables(configFile)
+
+	httpCfg := loadHTTPConfig()
+	webhookCfg := loadWebhookConfig()
+	maxCommands := loadLimits()
+	// Load certificates before doing anything else so that mistakes are reported straight away.
+	tlsCfg := loadTLSConfig()
+	adminCfg := loadAdminConfig()
+	var certs []*server.Certificate
+	for _, cert := range []*server.Certificate{tlsCfg.cert, adminCfg.cert} {
+		if cert != nil {
+			certs = append(certs, cert)
+		}
+	}
+
+	// Realms and services can refer to secrets in Vault, which are read whenever they are loaded.
+	secrets.SetVault(os.Getenv("VAULT_ADDR"), os.Getenv("VAULT_TOKEN"))
+
+	dbCfg := loadDatabaseConfig()
+	if dbCfg.dryRun {
+		dryRunMigrations(dbCfg)
+		return
+	}
+	db := openDatabase(dbCfg)
+
+	startupCheck := os.Getenv("STARTUP_CHECK")
+	clients, configureServices, checker := startClients(db, maxCommands, startupCheck)
+
+	reconciler := &configReconciler{
+		db: db, clients: clients, services: configureServices, configFile: configFile,
+	}
+	if configFile != "" {
+		if _, err := reconciler.reload(); err != nil {
+			log.WithError(err).Panic("Failed to apply config file")
+		}
+	}
+	if configFile != "" || len(certs) > 0 {
+		go reloadOnSIGHUP(reconciler, certs)
+	}
+	checkServicesOnStartup(configureServices, startupCheck)
+
+	go newQuietChecker(db).run()
 
-	if logDir != "" {
+	// Not http.DefaultServeMux, since net/http/pprof registers its handlers there without auth.
+	mainMux := http.NewServeMux()
+	mainMux.Handle("/test", server.MakeJSONAPI(&heartbeatHandler{}))
+	adminMux := newAdminMux(mainMux, adminCfg)
+	registerAdminHandlers(adminMux, adminCfg.token, db, clients, configureServices, reconciler, errorLog)
+	metricsMux := newMetricsMux(mainMux, httpCfg.metricsBindAddress)
+	webhooks := registerWebhookHandlers(mainMux, webhookCfg, httpCfg.pathPrefix, db, clients, checker)
+	rh := &realmRedirectHandler{db: db, clients: clients}
+	mainMux.HandleFunc("/realms/redirects/", server.WithRecovery(rh.handle))
+
+	if tlsCfg.acmeHTTPBindAddress != "" {
+		go func() {
+			// Answers http-01 challenges, and redirects everything else to HTTPS.
+			log.WithError(http.ListenAndServe(tlsCfg.acmeHTTPBindAddress, tlsCfg.acmeManager.HTTPHandler(nil))).Panic("Failed to serve ACME HTTP listener")
+		}()
+	}
+
+	if httpCfg.metricsBindAddress != "" {
+		go func() {
+			log.WithError(http.ListenAndServe(httpCfg.metricsBindAddress, server.WithPathPrefix(httpCfg.pathPrefix, metricsMux))).Panic("Failed to serve metrics listener")
+		}()
+	}
+
+	shutdown := newGracefulShutdown(listen(httpCfg, tlsCfg), webhooks, clients, httpCfg.drainTimeout)
+	if adminCfg.bindAddress != "" {
+		serveAdmin(shutdown, adminCfg, httpCfg.newServer(adminMux))
+	}
+	if err := shutdown.serve(httpCfg.newServer(mainMux)); err != nil {
+		log.WithError(err).Panic("Failed to serve")
+	}
+}
+
+// loggedVariables are the environment variables whose values are logged on startup. Secrets such
+// as ADMIN_TOKEN and DATABASE_ENCRYPTION_KEY aren't logged.
+var loggedVariables = []string{
+	"BIND_ADDRESS", "DATABASE_TYPE", "DATABASE_URL", "DATABASE_MIGRATIONS", "BASE_URL", "TRUSTED_PROXIES",
+	"TLS_CERT_FILE", "ACME_HOST_NAMES", "ACME_DIRECTORY_URL", "ACME_HTTP_BIND_ADDRESS", "LOG_DIR", "LOG_LEVEL",
+	"LOG_FORMAT", "ADMIN_BIND_ADDRESS", "ADMIN_TLS_CERT_FILE", "METRICS_BIND_ADDRESS", "CONFIG_FILE",
+	"SHUTDOWN_TIMEOUT", "OPS_ROOM_ID", "OPS_USER_ID", "STARTUP_CHECK", "WEBHOOK_MAX_BODY_SIZE",
+	"WEBHOOK_MAX_CONCURRENT", "WEBHOOK_ALLOWED_IPS", "WEBHOOK_RELAY_URL", "COMMAND_MAX_CONCURRENT",
+	"COMMAND_TIMEOUT", "EXPANSION_COOLDOWN", "EXPANSION_MAX_PER_MINUTE", "OVERLOAD_THRESHOLD",
+	"MATRIX_SEND_RATE", "MATRIX_SEND_BURST", "READ_TIMEOUT", "WRITE_TIMEOUT", "MAX_CONNECTIONS",
+	"TOKEN_REFRESH_INTERVAL", "VAULT_ADDR",
+}
+
+// logVariables logs the values of the loggedVariables. The -config flag overrides CONFIG_FILE, so
+// the config file which is actually used is given.
+func logVariables(configFile string) {
+	values := make([]string, len(loggedVariables))
+	for i, name := range loggedVariables {
+		value := os.Getenv(name)
+		if name == "CONFIG_FILE" {
+			value = configFile
+		}
+		values[i] = name + "=" + value
+	}
+	log.Infof("Go-NEB (%s)", strings.Join(values, " "))
+}
+
+// setupLogs sets up logging from the LOG_* and ERROR_WEBHOOK_URL environment variables. Returns
+// the log of recent errors for /admin/recentErrors.
+func setupLogs() *recentErrorLog {
+	if err := setupLogging(os.Getenv("LOG_LEVEL"), os.Getenv("LOG_FORMAT")); err != nil {
+		log.Panic(err)
+	}
+	errorLog := &recentErrorLog{}
+	log.AddHook(errorLog)
+	if errorWebhookURL := os.Getenv("ERROR_WEBHOOK_URL"); errorWebhookURL != "" {
+		log.AddHook(newErrorReporter(errorWebhookURL))
+	}
+	if logDir := os.Getenv("LOG_DIR"); logDir != "" {
 		log.AddHook(dugong.NewFSHook(
 			filepath.Join(logDir, "info.log"),
 			filepath.Join(logDir, "warn.log"),
 			filepath.Join(logDir, "error.log"),
 		))
 	}
+	return errorLog
+}
 
-	log.Infof(
-		"Go-NEB (BIND_ADDRESS=%s DATABASE_TYPE=%s DATABASE_URL=%s BASE_URL=%s LOG_DIR=%s)",
-		bindAddress, databaseType, databaseURL, baseURL, logDir,
-	)
+// httpConfig is the configuration of the listeners, from BIND_ADDRESS, BASE_URL and the
+// environment variables for timeouts and limits on connections.
+type httpConfig struct {
+	bindAddress        string
+	metricsBindAddress string
+	// If BASE_URL has a path, a reverse proxy is serving Go-NEB under it.
+	pathPrefix   string
+	drainTimeout time.Duration
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	maxConns     int
+}
 
+func loadHTTPConfig() (cfg httpConfig) {
+	cfg.bindAddress = os.Getenv("BIND_ADDRESS")
+	cfg.metricsBindAddress = os.Getenv("METRICS_BIND_ADDRESS")
+	baseURL := os.Getenv("BASE_URL")
 	err := types.BaseURL(baseURL)
 	if err != nil {
 		log.Panic(err)
 	}
+	parsedBaseURL, err := url.Parse(baseURL)
+	if err != nil {
+		log.Panic(err)
+	}
+	cfg.pathPrefix = parsedBaseURL.Path
+	if err = server.TrustProxies(os.Getenv("TRUSTED_PROXIES")); err != nil {
+		log.Panic(err)
+	}
+	if cfg.drainTimeout, err = durationFromEnv("SHUTDOWN_TIMEOUT", os.Getenv("SHUTDOWN_TIMEOUT"), 30*time.Second); err != nil {
+		log.Panic(err)
+	}
+	if cfg.readTimeout, err = durationFromEnv("READ_TIMEOUT", os.Getenv("READ_TIMEOUT"), 60*time.Second); err != nil {
+		log.Panic(err)
+	}
+	if cfg.writeTimeout, err = durationFromEnv("WRITE_TIMEOUT", os.Getenv("WRITE_TIMEOUT"), 0); err != nil {
+		log.Panic(err)
+	}
+	if cfg.maxConns, err = intFromEnv("MAX_CONNECTIONS", os.Getenv("MAX_CONNECTIONS"), 0); err != nil {
+		log.Panic(err)
+	}
+	return
+}
+
+// newServer returns a server for the given handler under the path prefix, with the READ_TIMEOUT
+// and WRITE_TIMEOUT.
+func (cfg httpConfig) newServer(handler http.Handler) *http.Server {
+	return newHTTPServer(server.WithPathPrefix(cfg.pathPrefix, handler), cfg.readTimeout, cfg.writeTimeout)
+}
+
+// webhookConfig is the configuration of incoming webhooks, from the WEBHOOK_* environment
+// variables.
+type webhookConfig struct {
+	maxBodySize   int
+	maxConcurrent int
+	allowlist     *server.Allowlist
+	relayURL      string
+	relayToken    string
+}
+
+func loadWebhookConfig() (cfg webhookConfig) {
+	var err error
+	if cfg.maxBodySize, err = intFromEnv("WEBHOOK_MAX_BODY_SIZE", os.Getenv("WEBHOOK_MAX_BODY_SIZE"), 25*1024*1024); err != nil {
+		log.Panic(err)
+	}
+	if cfg.maxConcurrent, err = intFromEnv("WEBHOOK_MAX_CONCURRENT", os.Getenv("WEBHOOK_MAX_CONCURRENT"), 0); err != nil {
+		log.Panic(err)
+	}
+	if cfg.allowlist, err = server.ParseAllowlist(strings.Split(os.Getenv("WEBHOOK_ALLOWED_IPS"), ",")); err != nil {
+		log.Panicf("Bad WEBHOOK_ALLOWED_IPS: %s", err)
+	}
+	cfg.relayURL = os.Getenv("WEBHOOK_RELAY_URL")
+	cfg.relayToken = os.Getenv("WEBHOOK_RELAY_TOKEN")
+	if cfg.relayURL != "" && cfg.relayToken == "" {
+		log.Panic("WEBHOOK_RELAY_TOKEN is required when WEBHOOK_RELAY_URL is set")
+	}
+	return
+}
+
+// loadLimits sets the limits on commands, expansions and sending messages from the environment
+// variables for them. Returns the COMMAND_MAX_CONCURRENT, which is set on the clients once they
+// are created.
+func loadLimits() int {
+	maxCommands, err := intFromEnv("COMMAND_MAX_CONCURRENT", os.Getenv("COMMAND_MAX_CONCURRENT"), clients.DefaultMaxConcurrentCommands)
+	if err != nil {
+		log.Panic(err)
+	}
+	if maxCommands == 0 {
+		log.Panic("Bad COMMAND_MAX_CONCURRENT: must be at least 1")
+	}
+	commandTimeout, err := durationFromEnv("COMMAND_TIMEOUT", os.Getenv("COMMAND_TIMEOUT"), plugin.DefaultCommandTimeout)
+	if err != nil {
+		log.Panic(err)
+	}
+	plugin.SetCommandTimeout(commandTimeout)
+	cooldown, err := durationFromEnv("EXPANSION_COOLDOWN", os.Getenv("EXPANSION_COOLDOWN"), plugin.DefaultExpansionCooldown)
+	if err != nil {
+		log.Panic(err)
+	}
+	maxExpansions, err := intFromEnv("EXPANSION_MAX_PER_MINUTE", os.Getenv("EXPANSION_MAX_PER_MINUTE"), plugin.DefaultMaxExpansionsPerMinute)
+	if err != nil {
+		log.Panic(err)
+	}
+	plugin.SetExpansionLimits(cooldown, maxExpansions)
+	maxInFlight, err := intFromEnv("OVERLOAD_THRESHOLD", os.Getenv("OVERLOAD_THRESHOLD"), batch.DefaultOverloadThreshold)
+	if err != nil {
+		log.Panic(err)
+	}
+	batch.SetOverloadThreshold(maxInFlight)
+	sendRate, err := intFromEnv("MATRIX_SEND_RATE", os.Getenv("MATRIX_SEND_RATE"), matrix.DefaultSendRate)
+	if err != nil {
+		log.Panic(err)
+	}
+	sendBurst, err := intFromEnv("MATRIX_SEND_BURST", os.Getenv("MATRIX_SEND_BURST"), matrix.DefaultSendBurst)
+	if err != nil {
+		log.Panic(err)
+	}
+	matrix.SetSendRate(sendRate, sendBurst)
+	return maxCommands
+}
+
+// tlsConfig is the configuration of TLS on BIND_ADDRESS, from the TLS_* and ACME_* environment
+// variables. At most one of cert and acmeManager is set.
+type tlsConfig struct {
+	cert                *server.Certificate
+	acmeManager         *autocert.Manager
+	acmeHTTPBindAddress string
+}
+
+func loadTLSConfig() (cfg tlsConfig) {
+	var err error
+	if cfg.cert, err = loadCertificate(os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE"), "TLS"); err != nil {
+		log.Panic(err)
+	}
+	cfg.acmeManager, err = newACMEManager(
+		os.Getenv("ACME_HOST_NAMES"), os.Getenv("ACME_CACHE_DIR"), os.Getenv("ACME_EMAIL"), os.Getenv("ACME_DIRECTORY_URL"), cfg.cert != nil,
+	)
+	if err != nil {
+		log.Panic(err)
+	}
+	cfg.acmeHTTPBindAddress = os.Getenv("ACME_HTTP_BIND_ADDRESS")
+	if cfg.acmeHTTPBindAddress != "" && cfg.acmeManager == nil {
+		log.Panic("ACME_HTTP_BIND_ADDRESS requires ACME_HOST_NAMES")
+	}
+	return
+}
+
+// adminConfig is the configuration of the admin endpoints, from the ADMIN_* environment variables.
+type adminConfig struct {
+	token        string
+	bindAddress  string
+	cert         *server.Certificate
+	clientCAFile string
+}
+
+func loadAdminConfig() (cfg adminConfig) {
+	cfg.token = os.Getenv("ADMIN_TOKEN")
+	cfg.bindAddress = os.Getenv("ADMIN_BIND_ADDRESS")
+	cfg.clientCAFile = os.Getenv("ADMIN_TLS_CLIENT_CA_FILE")
+	var err error
+	if cfg.cert, err = loadCertificate(os.Getenv("ADMIN_TLS_CERT_FILE"), os.Getenv("ADMIN_TLS_KEY_FILE"), "ADMIN_TLS"); err != nil {
+		log.Panic(err)
+	}
+	if err = checkAdminTLS(cfg.bindAddress, cfg.cert, cfg.clientCAFile); err != nil {
+		log.Panic(err)
+	}
+	if cfg.token == "" && cfg.clientCAFile == "" {
+		log.Warn("Neither ADMIN_TOKEN nor ADMIN_TLS_CLIENT_CA_FILE is set: anyone who can reach the admin endpoints can reconfigure Go-NEB")
+	}
+	return
+}
+
+// databaseConfig is the configuration of the database, from the DATABASE_* environment variables.
+type databaseConfig struct {
+	databaseType string
+	url          string
+	// dryRun is true if DATABASE_MIGRATIONS is "dry-run".
+	dryRun                bool
+	encryptionKey         string
+	previousEncryptionKey string
+}
+
+func loadDatabaseConfig() databaseConfig {
+	cfg := databaseConfig{
+		databaseType:          os.Getenv("DATABASE_TYPE"),
+		url:                   os.Getenv("DATABASE_URL"),
+		encryptionKey:         os.Getenv("DATABASE_ENCRYPTION_KEY"),
+		previousEncryptionKey: os.Getenv("DATABASE_ENCRYPTION_PREVIOUS_KEY"),
+	}
+	switch migrations := os.Getenv("DATABASE_MIGRATIONS"); migrations {
+	case "", "apply":
+	case "dry-run":
+		cfg.dryRun = true
+	default:
+		log.Panicf("Bad DATABASE_MIGRATIONS %q: must be \"apply\" or \"dry-run\"", migrations)
+	}
+	return cfg
+}
+
+// dryRunMigrations logs the database migrations which would be applied, without changing the
+// database.
+func dryRunMigrations(cfg databaseConfig) {
+	pending, err := database.PendingMigrations(cfg.databaseType, cfg.url)
+	if err != nil {
+		log.Panic(err)
+	}
+	for _, m := range pending {
+		log.WithField("version", m.Version).Infof("Would apply database migration: %s", m.Description)
+	}
+	log.Infof("%d database migrations would be applied. Exiting without changing the database.", len(pending))
+}
 
-	db, err := database.Open(databaseType, databaseURL)
+// openDatabase opens the database, applying any pending migrations, and makes it the database
+// which services use.
+func openDatabase(cfg databaseConfig) *database.ServiceDB {
+	// The keys aren't logged: knowing them and having the database is all it takes to read it.
+	if err := database.SetEncryptionKey(cfg.encryptionKey, cfg.previousEncryptionKey); err != nil {
+		log.Panic(err)
+	}
+	if cfg.encryptionKey != "" {
+		log.Info("Secrets in the database are encrypted with DATABASE_ENCRYPTION_KEY")
+	}
+	db, err := database.Open(cfg.databaseType, cfg.url)
 	if err != nil {
 		log.Panic(err)
 	}
 	database.SetServiceDB(db)
+	return db
+}
 
+// startClients starts syncing the clients in the database, along with everything which sends
+// messages through them. Returns the clients, the handler which configures services, and the
+// checker which checks services when they are first used if STARTUP_CHECK is "lazy".
+func startClients(db *database.ServiceDB, maxCommands int, startupCheck string) (*clients.Clients, *configureServiceHandler, *lazyChecker) {
+	refreshInterval, err := durationFromEnv("TOKEN_REFRESH_INTERVAL", os.Getenv("TOKEN_REFRESH_INTERVAL"), 5*time.Minute)
+	if err != nil {
+		log.Panic(err)
+	}
 	clients := clients.New(db)
-	if err := clients.Start(); err != nil {
+	clients.LimitCommands(maxCommands)
+	setupOpsRoom(clients)
+	configureServices := newConfigureServiceHandler(db, clients)
+	var checker *lazyChecker
+	if startupCheck == startupCheckLazy {
+		checker = newLazyChecker(configureServices)
+		clients.OnServiceUsed(checker.used)
+	}
+	if err = clients.Start(); err != nil {
 		log.Panic(err)
 	}
 
-	http.Handle("/test", server.MakeJSONAPI(&heartbeatHandler{}))
-	http.Handle("/admin/getService", server.MakeJSONAPI(&getServiceHandler{db: db}))
-	http.Handle("/admin/getSession", server.MakeJSONAPI(&getSessionHandler{db: db}))
-	http.Handle("/admin/configureClient", server.MakeJSONAPI(&configureClientHandler{db: db, clients: clients}))
-	http.Handle("/admin/configureService", server.MakeJSONAPI(newConfigureServiceHandler(db, clients)))
-	http.Handle("/admin/configureAuthRealm", server.MakeJSONAPI(&configureAuthRealmHandler{db: db}))
-	http.Handle("/admin/requestAuthSession", server.MakeJSONAPI(&requestAuthSessionHandler{db: db}))
-	http.Handle("/admin/removeAuthSession", server.MakeJSONAPI(&removeAuthSessionHandler{db: db}))
-	wh := &webhookHandler{db: db, clients: clients}
-	http.HandleFunc("/services/hooks/", wh.handle)
-	rh := &realmRedirectHandler{db: db}
-	http.HandleFunc("/realms/redirects/", rh.handle)
+	tokens.SetReauthNotifier(clients.RequestReauth)
+	tokens.StartRefresher(refreshInterval)
+	scheduler.Start(clients.Client)
+	streams.Start(clients.Client)
+	if err = batch.StartRetrying(clients.Client); err != nil {
+		log.Panic(err)
+	}
+	return clients, configureServices, checker
+}
 
-	http.ListenAndServe(bindAddress, nil)
+// setupOpsRoom sends alerts to the OPS_ROOM_ID from the OPS_USER_ID, if they are set.
+func setupOpsRoom(clients *clients.Clients) {
+	opsRoomID := os.Getenv("OPS_ROOM_ID")
+	opsUserID := os.Getenv("OPS_USER_ID")
+	if opsRoomID == "" && opsUserID == "" {
+		return
+	}
+	if opsRoomID == "" || opsUserID == "" {
+		log.Panic("OPS_ROOM_ID and OPS_USER_ID must be set together")
+	}
+	ops.SetRoom(opsRoomID, opsSender(clients, opsUserID))
+}
+
+// checkServicesOnStartup checks the services as the STARTUP_CHECK says.
+func checkServicesOnStartup(configureServices *configureServiceHandler, startupCheck string) {
+	switch startupCheck {
+	case "", startupCheckReport, startupCheckRepair:
+		// Check in the background: it can take a while, and broken services don't stop the rest
+		// from working.
+		go func() {
+			if _, checkErr := configureServices.checkServices(startupCheck == startupCheckRepair); checkErr != nil {
+				log.WithError(checkErr).Error("Failed to check services")
+			}
+		}()
+	case startupCheckOff, startupCheckLazy:
+	default:
+		log.Panicf("Unknown STARTUP_CHECK: %s", startupCheck)
+	}
+}
+
+// newAdminMux returns the mux for the admin endpoints: mainMux, unless they have a listener of
+// their own. The debug handlers are registered on it.
+func newAdminMux(mainMux *http.ServeMux, admin adminConfig) *http.ServeMux {
+	adminMux := mainMux
+	if admin.bindAddress != "" {
+		adminMux = http.NewServeMux()
+	}
+	for path, handler := range debugHandlers() {
+		adminMux.Handle(path, server.WithRecovery(server.WithAdminAuth(admin.token, handler)))
+	}
+	return adminMux
+}
+
+// registerAdminHandlers registers the /admin/ API and the UI on the admin mux.
+func registerAdminHandlers(adminMux *http.ServeMux, adminToken string, db *database.ServiceDB, clients *clients.Clients,
+	configureServices *configureServiceHandler, reconciler *configReconciler, errorLog *recentErrorLog) {
+	admin := func(path string, handler server.JSONRequestHandler) {
+		adminMux.Handle(path, server.WithRecovery(server.WithAdminAuth(adminToken, server.MakeJSONAPI(handler))))
+	}
+	admin("/admin/getService", &getServiceHandler{db: db})
+	admin("/admin/getSession", &getSessionHandler{db: db})
+	admin("/admin/configureClient", &configureClientHandler{db: db, clients: clients})
+	admin("/admin/configureService", configureServices)
+	admin("/admin/validateService", &validateServiceHandler{services: configureServices})
+	admin("/admin/configureAuthRealm", &configureAuthRealmHandler{db: db})
+	admin("/admin/requestAuthSession", &requestAuthSessionHandler{db: db})
+	admin("/admin/removeAuthSession", &removeAuthSessionHandler{db: db})
+	admin("/admin/reloadConfig", &reloadConfigHandler{reconciler: reconciler})
+	admin("/admin/checkServices", &checkServicesHandler{services: configureServices})
+	admin("/admin/removeService", &removeServiceHandler{services: configureServices})
+	admin("/admin/rotateWebhook", &rotateWebhookHandler{services: configureServices})
+	admin("/admin/rotateSecret", &rotateSecretHandler{services: configureServices})
+	admin("/admin/removeAuthRealm", &removeAuthRealmHandler{db: db})
+	admin("/admin/exportConfig", &exportConfigHandler{db: db})
+	admin("/admin/configTypes", &configTypesHandler{})
+	admin("/admin/recentErrors", &recentErrorsHandler{errorLog: errorLog})
+	admin("/admin/listRooms", &listRoomsHandler{db: db, clients: clients})
+	admin("/admin/serviceStatus", &serviceStatusHandler{db: db})
+	admin("/admin/webhookDeliveries", &webhookDeliveriesHandler{db: db})
+	admin("/admin/getWebhookDelivery", &getWebhookDeliveryHandler{db: db})
+	admin("/admin/replayWebhookDelivery", &replayWebhookDeliveryHandler{db: db, clients: clients})
+	admin("/admin/deadLetters", &deadLettersHandler{db: db})
+	admin("/admin/getDeadLetter", &getDeadLetterHandler{db: db})
+	admin("/admin/replayDeadLetter", &replayDeadLetterHandler{db: db, clients: clients})
+	admin("/admin/removeDeadLetter", &removeDeadLetterHandler{db: db})
+	admin("/admin/rekeyDatabase", &rekeyDatabaseHandler{db: db})
+	admin(serviceHistoryPath, &serviceHistoryHandler{db: db, services: configureServices})
+	// The UI page holds no data: it asks for the admin token and sends it with each API request.
+	adminMux.HandleFunc(ui.Path, ui.Handler)
+}
+
+// newMetricsMux returns the mux for the metrics endpoint: mainMux, unless it has a listener of its
+// own.
+func newMetricsMux(mainMux *http.ServeMux, metricsBindAddress string) *http.ServeMux {
+	metricsMux := mainMux
+	if metricsBindAddress != "" {
+		metricsMux = http.NewServeMux()
+		// Keep the heartbeat on the main listener too, for load balancers in front of it.
+		metricsMux.Handle("/test", server.MakeJSONAPI(&heartbeatHandler{}))
+	}
+	metricsMux.HandleFunc(metrics.Path, metrics.Handler)
+	return metricsMux
+}
+
+// registerWebhookHandlers registers the handler for incoming webhooks on the main mux, and pulls
+// them from the WEBHOOK_RELAY_URL if it is set. Returns the drainer which in-flight webhooks are
+// waited for with on shutdown.
+func registerWebhookHandlers(mainMux *http.ServeMux, cfg webhookConfig, pathPrefix string, db *database.ServiceDB,
+	clients *clients.Clients, checker *lazyChecker) *server.Drainer {
+	wh := &webhookHandler{db: db, clients: clients, allowlist: cfg.allowlist, checker: checker}
+	webhooks := &server.Drainer{}
+	limiter := server.NewLimiter(int64(cfg.maxBodySize), cfg.maxConcurrent)
+	hooks := server.WithRequestID(webhooks.Wrap(limiter.Wrap(server.WithRecovery(wh.handle))))
+	mainMux.HandleFunc("/services/hooks/", hooks)
+	if cfg.relayURL != "" {
+		// Only webhook requests are relayed, so that the relay can't be used to reach anything else.
+		relayMux := http.NewServeMux()
+		relayMux.HandleFunc("/services/hooks/", hooks)
+		go relay.NewPuller(cfg.relayURL, cfg.relayToken, server.WithPathPrefix(pathPrefix, relayMux)).Run()
+	}
+	return webhooks
+}
+
+// listen listens on the BIND_ADDRESS, over TLS if there is a certificate or ACME_HOST_NAMES.
+func listen(httpCfg httpConfig, tlsCfg tlsConfig) net.Listener {
+	listener, err := net.Listen("tcp", httpCfg.bindAddress)
+	if err != nil {
+		log.Panic(err)
+	}
+	if httpCfg.maxConns > 0 {
+		listener = server.LimitListener(listener, httpCfg.maxConns)
+	}
+	if tlsCfg.cert != nil {
+		listener = tls.NewListener(listener, tlsCfg.cert.TLSConfig())
+	} else if tlsCfg.acmeManager != nil {
+		listener = tls.NewListener(listener, server.ACMETLSConfig(tlsCfg.acmeManager))
+	}
+	return listener
+}
+
+// serveAdmin serves the admin endpoints on the ADMIN_BIND_ADDRESS until shutdown.
+func serveAdmin(shutdown *gracefulShutdown, cfg adminConfig, adminServer *http.Server) {
+	var err error
+	if adminServer.TLSConfig, err = adminTLSConfig(cfg.cert, cfg.clientCAFile); err != nil {
+		log.Panic(err)
+	}
+	adminListener, err := net.Listen("tcp", cfg.bindAddress)
+	if err != nil {
+		log.Panic(err)
+	}
+	shutdown.serveAlso(adminListener, adminServer, "admin listener")
+}
+
+// opsSender returns an ops.Sender which posts alerts as notices from the given client. The client
+// may be configured after Go-NEB starts, so it is looked up when each alert is sent.
+func opsSender(clients *clients.Clients, userID string) ops.Sender {
+	return func(roomID, text string) error {
+		cli, err := clients.Client(userID)
+		if err != nil {
+			return err
+		}
+		// Joining a room we're already in does nothing, and alerts are rare.
+		if _, err = cli.JoinRoom(roomID, "", ""); err != nil {
+			return err
+		}
+		_, err = cli.SendMessageEvent(roomID, "m.room.message", matrix.TextMessage{"m.notice", text})
+		return err
+	}
+}
+
+// durationFromEnv parses the value of the named environment variable as a duration, e.g. "30s".
+// Returns def if the value is empty.
+func durationFromEnv(name, value string, def time.Duration) (time.Duration, error) {
+	if value == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("Bad %s: %s", name, err)
+	}
+	return d, nil
+}
+
+// intFromEnv parses the value of the named environment variable as a non-negative integer.
+// Returns def if the value is empty.
+func intFromEnv(name, value string, def int) (int, error) {
+	if value == "" {
+		return def, nil
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil || i < 0 {
+		return 0, fmt.Errorf("Bad %s: must be a non-negative integer", name)
+	}
+	return i, nil
+}
+
+// setupLogging sets the minimum level which is logged ("debug", "info", "warn" or "error") and
+// the output format ("text" or "json"). Empty values leave the defaults of "info" and "text".
+func setupLogging(level, format string) error {
+	if level != "" {
+		lvl, err := log.ParseLevel(level)
+		if err != nil {
+			return err
+		}
+		log.SetLevel(lvl)
+	}
+	switch format {
+	case "", "text":
+		// logrus logs text by default
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("Unknown LOG_FORMAT: %s", format)
+	}
+	return nil
+}
+
+// loadCertificate loads the TLS certificate named by the <prefix>_CERT_FILE and <prefix>_KEY_FILE
+// environment variables, whose values are given. Returns nil if neither is set.
+func loadCertificate(certFile, keyFile, prefix string) (*server.Certificate, error) {
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("%s_CERT_FILE and %s_KEY_FILE must be set together", prefix, prefix)
+	}
+	cert, err := server.LoadCertificate(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load %s_CERT_FILE and %s_KEY_FILE: %s", prefix, prefix, err)
+	}
+	return cert, nil
+}
+
+// newACMEManager returns a manager which obtains certificates for BIND_ADDRESS over ACME for the
+// comma separated ACME_HOST_NAMES, whose value is given along with the other ACME_* variables.
+// Returns nil if ACME_HOST_NAMES isn't set.
+func newACMEManager(hostNames, cacheDir, email, directoryURL string, haveCert bool) (*autocert.Manager, error) {
+	if hostNames == "" {
+		return nil, nil
+	}
+	if haveCert {
+		return nil, fmt.Errorf("ACME_HOST_NAMES and TLS_CERT_FILE can't both be set")
+	}
+	if cacheDir == "" {
+		return nil, fmt.Errorf("ACME_CACHE_DIR must be set with ACME_HOST_NAMES, so that certificates aren't requested again on every restart")
+	}
+	var names []string
+	for _, name := range strings.Split(hostNames, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("ACME_HOST_NAMES has no host names: %q", hostNames)
+	}
+	return server.NewACMEManager(names, cacheDir, email, directoryURL), nil
+}
+
+// reloadOnSIGHUP reloads the TLS certificates and the config file, if there is one, whenever the
+// process receives SIGHUP.
+func reloadOnSIGHUP(reconciler *configReconciler, certs []*server.Certificate) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	for range sigs {
+		for _, cert := range certs {
+			if err := cert.Reload(); err != nil {
+				// Keep serving the old certificate rather than none at all.
+				log.WithError(err).Error("Failed to reload TLS certificate")
+			}
+		}
+		if len(certs) > 0 {
+			log.Info("Received SIGHUP: reloaded TLS certificates")
+		}
+		if reconciler.configFile == "" {
+			continue
+		}
+		log.WithField("config_file", reconciler.configFile).Info("Received SIGHUP: reloading config file")
+		changes, err := reconciler.reload()
+		if err != nil {
+			// Keep running with whatever was successfully applied: the previous config is still in
+			// the database so nothing is lost by carrying on.
+			log.WithError(err).Error("Failed to reload config file")
+			ops.Alert("Failed to reload config file %s: %s", reconciler.configFile, err)
+			continue
+		}
+		log.WithFields(log.Fields{
+			"applied": changes.Applied,
+			"removed": changes.Removed,
+		}).Info("Reloaded config file")
+	}
+}
+
+// checkAdminTLS checks that the ADMIN_TLS_* variables, whose certificate and client CA file are
+// given, make sense with the ADMIN_BIND_ADDRESS.
+func checkAdminTLS(adminBindAddress string, cert *server.Certificate, clientCAFile string) error {
+	if adminBindAddress == "" && (cert != nil || clientCAFile != "") {
+		return fmt.Errorf("ADMIN_TLS_* require ADMIN_BIND_ADDRESS: use TLS_CERT_FILE and TLS_KEY_FILE to serve the admin endpoints on BIND_ADDRESS over TLS")
+	}
+	if clientCAFile != "" && cert == nil {
+		return fmt.Errorf("ADMIN_TLS_CERT_FILE and ADMIN_TLS_KEY_FILE are required when ADMIN_TLS_CLIENT_CA_FILE is set")
+	}
+	return nil
+}
+
+// newHTTPServer returns a server for the given handler with the READ_TIMEOUT and WRITE_TIMEOUT.
+// Idle keep-alive connections are closed after the read timeout, so that slow or idle clients
+// can't hold connections open forever.
+func newHTTPServer(handler http.Handler, readTimeout, writeTimeout time.Duration) *http.Server {
+	return &http.Server{
+		Handler:      handler,
+		ReadTimeout:  readTimeout,
+		WriteTimeout: writeTimeout,
+		IdleTimeout:  readTimeout,
+	}
+}
+
+// adminTLSConfig returns the TLS config for the admin listener, or nil if no certificate is given.
+// If a client CA file is also given, every request must present a client certificate signed by
+// that CA.
+func adminTLSConfig(cert *server.Certificate, clientCAFile string) (*tls.Config, error) {
+	if cert == nil {
+		return nil, nil
+	}
+	tlsConfig := cert.TLSConfig()
+	if clientCAFile != "" {
+		clientCertConfig, err := server.ClientCertTLSConfig(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientAuth = clientCertConfig.ClientAuth
+		tlsConfig.ClientCAs = clientCertConfig.ClientCAs
+	}
+	return tlsConfig, nil
 }
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"github.com/matrix-org/go-neb/server"
+	"testing"
+)
+
+func TestCheckAdminTLS(t *testing.T) {
+	cert := &server.Certificate{}
+	tests := []struct {
+		bindAddress  string
+		cert         *server.Certificate
+		clientCAFile string
+		wantErr      bool
+	}{
+		{"", nil, "", false},
+		{":4051", nil, "", false},
+		{":4051", cert, "", false},
+		{":4051", cert, "ca.pem", false},
+		{"", cert, "", true},
+		{"", nil, "ca.pem", true},
+		{":4051", nil, "ca.pem", true},
+	}
+	for _, test := range tests {
+		err := checkAdminTLS(test.bindAddress, test.cert, test.clientCAFile)
+		if (err != nil) != test.wantErr {
+			t.Errorf("checkAdminTLS(%q, cert=%v, %q) => Want error %v got %v", test.bindAddress, test.cert != nil, test.clientCAFile, test.wantErr, err)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+// Package httpclient makes the HTTP clients Go-NEB sends requests to other servers with: the
+// homeserver, and the APIs services and realms use. They share one transport, so that connections
+// are pooled across them, and every client gives up on a request after a timeout, so that a server
+// which never answers can't hang the goroutine waiting for it.
+//
+// Requests go through the proxy in HTTPS_PROXY or HTTP_PROXY, if either is set, except to the hosts
+// in NO_PROXY. HTTPS connections use HTTP/2 where the server supports it.
+package httpclient
+
+import (
+	"github.com/dghubble/oauth1"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"net/http"
+	"time"
+)
+
+// DefaultTimeout is how long Default waits for a request, including reading the response body.
+const DefaultTimeout = 30 * time.Second
+
+// Transport is shared by every client. Dial and TLS settings are left at their defaults, as setting
+// them stops net/http from using HTTP/2; the clients' timeouts cover dialling.
+var Transport = &http.Transport{
+	Proxy:                 http.ProxyFromEnvironment,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ExpectContinueTimeout: 1 * time.Second,
+	// Go's default of 2 is too few when many requests go to the same API host.
+	MaxIdleConnsPerHost: 16,
+}
+
+// Default is a client with the DefaultTimeout, for anything which doesn't need a client of its own.
+var Default = New(DefaultTimeout)
+
+// New returns a client which uses Transport and gives up on requests after the timeout.
+func New(timeout time.Duration) *http.Client {
+	return &http.Client{Transport: Transport, Timeout: timeout}
+}
+
+// OAuth2 returns a client which authenticates its requests with tokens from the source, and gives up
+// on them after the DefaultTimeout.
+func OAuth2(src oauth2.TokenSource) *http.Client {
+	cli := oauth2.NewClient(Context(), src)
+	cli.Timeout = DefaultTimeout
+	return cli
+}
+
+// Context returns a context which makes the oauth1 and oauth2 packages use Default, e.g. to
+// exchange and refresh tokens. The clients they return use Transport but have no timeout, so
+// callers should set one.
+func Context() context.Context {
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, Default)
+	return context.WithValue(ctx, oauth1.HTTPClient, Default)
+}
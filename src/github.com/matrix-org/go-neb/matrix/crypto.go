@@ -0,0 +1,1307 @@
+package matrix
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/errors"
+	"maunium.net/go/mautrix/crypto/goolm/account"
+	"maunium.net/go/mautrix/crypto/goolm/session"
+	"maunium.net/go/mautrix/id"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	olmAlgorithm    = "m.olm.v1.curve25519-aes-sha2"
+	megolmAlgorithm = "m.megolm.v1.aes-sha2"
+	// Megolm sessions clients encrypt with are replaced after this many messages, or once this
+	// old, which are the defaults of m.room.encryption events.
+	megolmRotationMessages = 100
+	megolmRotationPeriod   = 7 * 24 * time.Hour
+	// maxSeenIndexes is how many message indexes of each megolm session are remembered to spot
+	// replayed messages. The lowest are forgotten first, and messages using them are refused.
+	maxSeenIndexes = 1000
+	// maxShareAttempts is how many times encrypt shares a new megolm session if the one it was
+	// sharing is replaced meanwhile.
+	maxShareAttempts = 3
+)
+
+// defaultPickleKey encrypts olm state as it is pickled if the CryptoStorer has no keys for it. It
+// isn't secret, so state pickled with it is only kept safe by the CryptoStorer.
+var defaultPickleKey = []byte("go-neb")
+
+// cryptoEventTypes are the types of event needed by clients with encryption enabled.
+var cryptoEventTypes = map[string]bool{
+	"m.room.encrypted":  true,
+	"m.room.encryption": true,
+}
+
+// CryptoStorer controls loading/saving of the end-to-end encryption state of clients' devices:
+// their olm accounts, their olm sessions with other devices and their megolm sessions. Values are
+// opaque, and kept by a key of their own for each device.
+type CryptoStorer interface {
+	// Save a value for a device, replacing any with the same key. Unlike next_batch tokens, state
+	// which isn't saved can't be made again, so errors are returned.
+	SaveCrypto(userID, deviceID, key string, value []byte) error
+	// Load every value saved for a device, by key.
+	LoadCrypto(userID, deviceID string) (map[string][]byte, error)
+	// PickleKeys returns the keys to encrypt olm state with as it is pickled: the first to pickle
+	// it with, then any it may have been pickled with before. If there are none, defaultPickleKey
+	// is used.
+	PickleKeys() [][]byte
+}
+
+// olmMachine encrypts the messages a client sends into encrypted rooms, and decrypts those it
+// receives from them. It is used by the worker goroutine as well as by those sending messages, so
+// its state is only used with it locked. It isn't locked while the homeserver is asked for keys
+// or sent them, so that sharing a room key with slow devices doesn't hold up everything else.
+type olmMachine struct {
+	sync.Mutex
+	cli            *Client
+	deviceID       string
+	store          CryptoStorer
+	pickleKeys     [][]byte // the first pickles state, any of them unpickles it
+	account        *account.Account
+	uploaded       bool   // true once the device's keys have been uploaded
+	ed25519        string // the device's identity keys
+	curve25519     string
+	olmSessions    map[string][]*olmSession          // their curve25519 key => sessions with that device
+	inbound        map[string]*inboundGroupSession   // session ID => megolm session to decrypt with
+	outbound       map[string]*outboundGroupSession  // room ID => megolm session to encrypt with
+	devices        map[string]map[string]*deviceKeys // user ID => device ID => the device's keys
+	devicesForgot  int                               // incremented as devices are forgotten
+	encryptedRooms map[string]bool                   // room ID => true if encrypted
+}
+
+// These are stored by the CryptoStorer, as JSON.
+type accountState struct {
+	Pickle   string
+	Uploaded bool
+}
+
+type olmSession struct {
+	TheirKey   string // the curve25519 key of the other device
+	Pickle     string
+	LastUsedMs int64
+	session    *session.OlmSession
+}
+
+type inboundGroupSession struct {
+	RoomID     string
+	SenderKey  string // the curve25519 key of the device which shared the session
+	SigningKey string // and its ed25519 key
+	Pickle     string
+	Seen       map[uint]string // message index => ID of the event which used it, to spot replays
+	Forgotten  uint            // indexes below this were dropped from Seen, so can't be checked
+	session    *session.MegolmInboundSession
+}
+
+type outboundGroupSession struct {
+	CreatedMs  int64
+	Messages   int
+	SharedWith map[string]bool // user ID + " " + device ID => true
+	Pickle     string
+	session    *session.MegolmOutboundSession
+}
+
+// deviceKeys are the keys of a device, as returned by /keys/query.
+type deviceKeys struct {
+	UserID     string            `json:"user_id"`
+	DeviceID   string            `json:"device_id"`
+	Algorithms []string          `json:"algorithms"`
+	Keys       map[string]string `json:"keys"`
+}
+
+func (d *deviceKeys) ed25519() string    { return d.Keys["ed25519:"+d.DeviceID] }
+func (d *deviceKeys) curve25519() string { return d.Keys["curve25519:"+d.DeviceID] }
+
+// megolmContent is the content of an m.room.encrypted event in a room. The m.relates_to of the
+// event it holds is left unencrypted, so that servers can aggregate relations.
+type megolmContent struct {
+	Algorithm  string          `json:"algorithm"`
+	SenderKey  string          `json:"sender_key,omitempty"`
+	Ciphertext string          `json:"ciphertext"`
+	SessionID  string          `json:"session_id"`
+	DeviceID   string          `json:"device_id,omitempty"`
+	RelatesTo  json.RawMessage `json:"m.relates_to,omitempty"`
+}
+
+// olmContent is the content of an m.room.encrypted event sent to devices.
+type olmContent struct {
+	Algorithm  string                   `json:"algorithm"`
+	SenderKey  string                   `json:"sender_key"`
+	Ciphertext map[string]olmCiphertext `json:"ciphertext"` // recipient's curve25519 key => message
+}
+
+type olmCiphertext struct {
+	Type int    `json:"type"`
+	Body string `json:"body"`
+}
+
+// olmPayload is what olm messages hold.
+type olmPayload struct {
+	Type          string            `json:"type"`
+	Content       json.RawMessage   `json:"content"`
+	Sender        string            `json:"sender"`
+	SenderDevice  string            `json:"sender_device"`
+	Keys          map[string]string `json:"keys"`
+	Recipient     string            `json:"recipient"`
+	RecipientKeys map[string]string `json:"recipient_keys"`
+}
+
+// roomKey is the content of an m.room_key event, which shares a megolm session.
+type roomKey struct {
+	Algorithm  string `json:"algorithm"`
+	RoomID     string `json:"room_id"`
+	SessionID  string `json:"session_id"`
+	SessionKey string `json:"session_key"`
+}
+
+// EnableEncryption makes the client encrypt the messages it sends into encrypted rooms and decrypt
+// those it receives from them, as the given device of its user, which must be the device of its
+// access token. Its olm account and sessions are loaded from the store, or made and saved to it if
+// the device has none. The device's keys are uploaded once the client starts syncing.
+func (cli *Client) EnableEncryption(deviceID string, store CryptoStorer) error {
+	m := &olmMachine{
+		cli:            cli,
+		deviceID:       deviceID,
+		store:          store,
+		olmSessions:    make(map[string][]*olmSession),
+		inbound:        make(map[string]*inboundGroupSession),
+		outbound:       make(map[string]*outboundGroupSession),
+		devices:        make(map[string]map[string]*deviceKeys),
+		encryptedRooms: make(map[string]bool),
+	}
+	// State pickled before the CryptoStorer had keys was pickled with the default key.
+	m.pickleKeys = append(append([][]byte{}, store.PickleKeys()...), defaultPickleKey)
+	values, err := store.LoadCrypto(cli.UserID, deviceID)
+	if err != nil {
+		return err
+	}
+	repickle := false
+	for key, value := range values {
+		var stale bool
+		if stale, err = m.load(key, value); err != nil {
+			return fmt.Errorf("Failed to load %s of %s: %s", key, cli.UserID, err)
+		}
+		repickle = repickle || stale
+	}
+	if m.account == nil {
+		if m.account, err = account.NewAccount(); err != nil {
+			return err
+		}
+		if err = m.saveAccount(); err != nil {
+			return err
+		}
+	} else if repickle {
+		// Pickle everything with the current key, so that the keys it was pickled with before can
+		// be dropped.
+		if err = m.saveAll(); err != nil {
+			return err
+		}
+		log.WithField("user_id", cli.UserID).Info("Pickled encryption state with the current key")
+	}
+	ed, curve, err := m.account.IdentityKeys()
+	if err != nil {
+		return err
+	}
+	m.ed25519, m.curve25519 = string(ed), string(curve)
+	cli.crypto = m
+	return nil
+}
+
+// load loads a value saved by the CryptoStorer. Returns true if it was pickled with a key other
+// than the current one.
+func (m *olmMachine) load(key string, value []byte) (stale bool, err error) {
+	switch {
+	case key == "account":
+		var state accountState
+		if err = json.Unmarshal(value, &state); err != nil {
+			return
+		}
+		stale, err = m.unpickle(func(pickleKey []byte) (err error) {
+			m.account, err = account.AccountFromPickled([]byte(state.Pickle), pickleKey)
+			return
+		})
+		m.uploaded = state.Uploaded
+	case strings.HasPrefix(key, "olm/"):
+		var s olmSession
+		if err = json.Unmarshal(value, &s); err != nil {
+			return
+		}
+		if stale, err = m.unpickle(func(pickleKey []byte) (err error) {
+			s.session, err = session.OlmSessionFromPickled([]byte(s.Pickle), pickleKey)
+			return
+		}); err != nil {
+			return
+		}
+		m.olmSessions[s.TheirKey] = append(m.olmSessions[s.TheirKey], &s)
+	case strings.HasPrefix(key, "inbound/"):
+		var s inboundGroupSession
+		if err = json.Unmarshal(value, &s); err != nil {
+			return
+		}
+		if stale, err = m.unpickle(func(pickleKey []byte) (err error) {
+			s.session, err = session.MegolmInboundSessionFromPickled([]byte(s.Pickle), pickleKey)
+			return
+		}); err != nil {
+			return
+		}
+		m.inbound[string(s.session.ID())] = &s
+	case strings.HasPrefix(key, "outbound/"):
+		var s outboundGroupSession
+		if err = json.Unmarshal(value, &s); err != nil {
+			return
+		}
+		if stale, err = m.unpickle(func(pickleKey []byte) (err error) {
+			s.session, err = session.MegolmOutboundSessionFromPickled([]byte(s.Pickle), pickleKey)
+			return
+		}); err != nil {
+			return
+		}
+		m.outbound[strings.TrimPrefix(key, "outbound/")] = &s
+	}
+	return
+}
+
+// unpickle calls fn with each of the pickle keys until it succeeds. Returns true if it succeeded
+// with a key other than the current one.
+func (m *olmMachine) unpickle(fn func(pickleKey []byte) error) (stale bool, err error) {
+	for i, pickleKey := range m.pickleKeys {
+		if err = fn(pickleKey); err == nil {
+			return i > 0, nil
+		}
+	}
+	return false, err
+}
+
+// saveAll saves all of the device's state.
+func (m *olmMachine) saveAll() error {
+	if err := m.saveAccount(); err != nil {
+		return err
+	}
+	for _, sessions := range m.olmSessions {
+		for _, s := range sessions {
+			if err := m.saveOlmSession(s); err != nil {
+				return err
+			}
+		}
+	}
+	for _, s := range m.inbound {
+		if err := m.saveInbound(s); err != nil {
+			return err
+		}
+	}
+	for roomID, s := range m.outbound {
+		if err := m.saveOutbound(roomID, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *olmMachine) save(key string, state interface{}) error {
+	value, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return m.store.SaveCrypto(m.cli.UserID, m.deviceID, key, value)
+}
+
+func (m *olmMachine) saveAccount() error {
+	pickled, err := m.account.Pickle(m.pickleKeys[0])
+	if err != nil {
+		return err
+	}
+	return m.save("account", accountState{string(pickled), m.uploaded})
+}
+
+func (m *olmMachine) saveOlmSession(s *olmSession) error {
+	pickled, err := s.session.Pickle(m.pickleKeys[0])
+	if err != nil {
+		return err
+	}
+	s.Pickle = string(pickled)
+	return m.save("olm/"+s.TheirKey+"/"+string(s.session.ID()), s)
+}
+
+func (m *olmMachine) saveInbound(s *inboundGroupSession) error {
+	pickled, err := s.session.Pickle(m.pickleKeys[0])
+	if err != nil {
+		return err
+	}
+	s.Pickle = string(pickled)
+	return m.save("inbound/"+string(s.session.ID()), s)
+}
+
+func (m *olmMachine) saveOutbound(roomID string, s *outboundGroupSession) error {
+	pickled, err := s.session.Pickle(m.pickleKeys[0])
+	if err != nil {
+		return err
+	}
+	s.Pickle = string(pickled)
+	return m.save("outbound/"+roomID, s)
+}
+
+// uploadKeys uploads the device's keys if they haven't been, and one-time keys until the homeserver
+// has half as many as the account can hold. count is how many the homeserver has, or -1 if that
+// isn't known, in which case one-time keys are only uploaded along with the device's keys. It is
+// only called by the worker, so keys aren't uploaded twice at once.
+func (m *olmMachine) uploadKeys(count int) error {
+	m.Lock()
+	defer m.Unlock()
+	wanted := int(m.account.MaxNumberOfOneTimeKeys()) / 2
+	if m.uploaded && (count < 0 || count >= wanted) {
+		return nil
+	}
+	var req struct {
+		DeviceKeys  map[string]interface{} `json:"device_keys,omitempty"`
+		OneTimeKeys map[string]interface{} `json:"one_time_keys,omitempty"`
+	}
+	var err error
+	if !m.uploaded {
+		if req.DeviceKeys, err = m.deviceKeys(); err != nil {
+			return err
+		}
+		if count < 0 {
+			count = 0
+		}
+	}
+	req.OneTimeKeys, err = m.oneTimeKeys(wanted - count)
+	if err != nil {
+		return err
+	}
+	m.Unlock()
+	_, err = m.cli.sendJSON("POST", m.cli.buildURL("keys", "upload"), &req)
+	m.Lock()
+	if err != nil {
+		return err
+	}
+	m.account.MarkKeysAsPublished()
+	m.uploaded = true
+	log.WithFields(log.Fields{
+		"user_id":       m.cli.UserID,
+		"device_id":     m.deviceID,
+		"one_time_keys": len(req.OneTimeKeys),
+	}).Info("Uploaded encryption keys")
+	return m.saveAccount()
+}
+
+// deviceKeys returns the device's signed identity keys.
+func (m *olmMachine) deviceKeys() (map[string]interface{}, error) {
+	keys := map[string]interface{}{
+		"user_id":    m.cli.UserID,
+		"device_id":  m.deviceID,
+		"algorithms": []string{olmAlgorithm, megolmAlgorithm},
+		"keys": map[string]string{
+			"curve25519:" + m.deviceID: m.curve25519,
+			"ed25519:" + m.deviceID:    m.ed25519,
+		},
+	}
+	if err := m.sign(keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// oneTimeKeys returns the signed one-time keys to upload, by key ID, making enough new ones that
+// there are at least missing. Keys which were made but not uploaded, because uploading failed,
+// are uploaded now. Returns nil if there are none.
+func (m *olmMachine) oneTimeKeys(missing int) (map[string]interface{}, error) {
+	keys, err := m.account.OneTimeKeys()
+	if err != nil {
+		return nil, err
+	}
+	if n := missing - len(keys); n > 0 {
+		if err = m.account.GenOneTimeKeys(uint(n)); err != nil {
+			return nil, err
+		}
+		if keys, err = m.account.OneTimeKeys(); err != nil {
+			return nil, err
+		}
+		// Save the keys before they are uploaded, so that messages encrypted with them can be read.
+		if err = m.saveAccount(); err != nil {
+			return nil, err
+		}
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	otks := make(map[string]interface{})
+	for keyID, key := range keys {
+		otk := map[string]interface{}{"key": string(key)}
+		if err = m.sign(otk); err != nil {
+			return nil, err
+		}
+		otks["signed_curve25519:"+keyID] = otk
+	}
+	return otks, nil
+}
+
+// sign adds the device's signature to an object.
+func (m *olmMachine) sign(obj map[string]interface{}) error {
+	signable, err := signableJSON(obj)
+	if err != nil {
+		return err
+	}
+	signature, err := m.account.Sign(signable)
+	if err != nil {
+		return err
+	}
+	obj["signatures"] = map[string]map[string]string{
+		m.cli.UserID: {"ed25519:" + m.deviceID: string(signature)},
+	}
+	return nil
+}
+
+// signableJSON returns the canonical JSON of an object, without its signatures and unsigned
+// parts, which is what signatures of it sign.
+func signableJSON(v interface{}) ([]byte, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var obj map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if err = dec.Decode(&obj); err != nil {
+		return nil, err
+	}
+	delete(obj, "signatures")
+	delete(obj, "unsigned")
+	// Maps are encoded with their keys sorted, and without spaces.
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err = enc.Encode(obj); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// verifySignature returns true if the object is signed by the user's device with the ed25519 key.
+func verifySignature(raw json.RawMessage, userID, deviceID, ed25519Key string) bool {
+	var signed struct {
+		Signatures map[string]map[string]string `json:"signatures"`
+	}
+	if err := json.Unmarshal(raw, &signed); err != nil {
+		return false
+	}
+	signature, err := base64.RawStdEncoding.DecodeString(signed.Signatures[userID]["ed25519:"+deviceID])
+	if err != nil {
+		return false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(ed25519Key)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return false
+	}
+	signable, err := signableJSON(raw)
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(key, signable, signature)
+}
+
+// roomEncrypted returns true if the room is encrypted. It asks the homeserver the first time, and
+// is then told by the worker if the room becomes encrypted.
+func (m *olmMachine) roomEncrypted(roomID string) (bool, error) {
+	m.Lock()
+	encrypted, known := m.encryptedRooms[roomID]
+	m.Unlock()
+	if known {
+		return encrypted, nil
+	}
+	var content map[string]interface{}
+	err := m.cli.getJSON(m.cli.buildURL("rooms", roomID, "state", "m.room.encryption"), &content)
+	if httpErr, ok := err.(errors.HTTPError); ok && httpErr.Code == 404 {
+		encrypted = false
+	} else if err != nil {
+		return false, err
+	} else {
+		encrypted = true
+	}
+	m.Lock()
+	m.encryptedRooms[roomID] = encrypted
+	m.Unlock()
+	return encrypted, nil
+}
+
+// encrypt returns the content of the m.room.encrypted event to send into the room in place of an
+// event. The megolm session it is encrypted with is shared with every device of the room's joined
+// members which doesn't have it yet.
+func (m *olmMachine) encrypt(roomID, eventType string, content interface{}) (interface{}, error) {
+	contentJSON, err := json.Marshal(content)
+	if err != nil {
+		return nil, err
+	}
+	var relation struct {
+		RelatesTo json.RawMessage `json:"m.relates_to"`
+	}
+	json.Unmarshal(contentJSON, &relation)
+	members, err := m.cli.joinedMembers(roomID)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := json.Marshal(struct {
+		Type    string          `json:"type"`
+		Content json.RawMessage `json:"content"`
+		RoomID  string          `json:"room_id"`
+	}{eventType, contentJSON, roomID})
+	if err != nil {
+		return nil, err
+	}
+
+	// m isn't locked while the session is shared, so it may be replaced meanwhile, e.g. because
+	// someone left the room, in which case the new session is shared and used instead.
+	for attempt := 0; attempt < maxShareAttempts; attempt++ {
+		var out *outboundGroupSession
+		if out, err = m.outboundSession(roomID); err != nil {
+			return nil, err
+		}
+		if err = m.shareGroupSession(roomID, out, members); err != nil {
+			return nil, err
+		}
+		var encrypted *megolmContent
+		if encrypted, err = m.encryptMegolm(roomID, out, plaintext); err != nil {
+			return nil, err
+		}
+		if encrypted != nil {
+			encrypted.RelatesTo = relation.RelatesTo
+			return encrypted, nil
+		}
+	}
+	return nil, fmt.Errorf("The megolm session of room %s was replaced each time it was shared", roomID)
+}
+
+// outboundSession returns the megolm session to encrypt the messages sent into the room with,
+// making a new one if there is none or it is due to be replaced.
+func (m *olmMachine) outboundSession(roomID string) (*outboundGroupSession, error) {
+	m.Lock()
+	defer m.Unlock()
+	out := m.outbound[roomID]
+	if out == nil || out.Messages >= megolmRotationMessages || time.Since(time.Unix(0, out.CreatedMs*1000000)) > megolmRotationPeriod {
+		s, err := session.NewMegolmOutboundSession()
+		if err != nil {
+			return nil, err
+		}
+		out = &outboundGroupSession{
+			CreatedMs:  time.Now().UnixNano() / 1000000,
+			SharedWith: make(map[string]bool),
+			session:    s,
+		}
+		m.outbound[roomID] = out
+	}
+	return out, nil
+}
+
+// encryptMegolm encrypts a message into the room with the megolm session. Returns nil if the
+// session has been replaced, so the message must be encrypted with the new one.
+func (m *olmMachine) encryptMegolm(roomID string, out *outboundGroupSession, plaintext []byte) (*megolmContent, error) {
+	m.Lock()
+	defer m.Unlock()
+	if m.outbound[roomID] != out || out.Messages >= megolmRotationMessages {
+		return nil, nil
+	}
+	ciphertext, err := out.session.Encrypt(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	out.Messages++
+	if err = m.saveOutbound(roomID, out); err != nil {
+		return nil, err
+	}
+	return &megolmContent{
+		Algorithm:  megolmAlgorithm,
+		SenderKey:  m.curve25519,
+		Ciphertext: string(ciphertext),
+		SessionID:  string(out.session.ID()),
+		DeviceID:   m.deviceID,
+	}, nil
+}
+
+// shareGroupSession sends the megolm session in m.room_key events to the devices of the users
+// which don't have it yet, encrypted with olm. Devices which can't be sent it, e.g. because they
+// have run out of one-time keys, are tried again with the next message. m must not be locked.
+func (m *olmMachine) shareGroupSession(roomID string, out *outboundGroupSession, userIDs []string) error {
+	devices, err := m.queryDevices(userIDs)
+	if err != nil {
+		return err
+	}
+	m.Lock()
+	targets, withoutSession := m.shareTargets(out, userIDs, devices)
+	m.Unlock()
+	if len(targets) == 0 {
+		return nil
+	}
+	oneTimeKeys, err := m.claimOneTimeKeys(withoutSession)
+	if err != nil {
+		return err
+	}
+	m.Lock()
+	messages, shared, err := m.encryptRoomKey(roomID, out, targets, oneTimeKeys)
+	m.Unlock()
+	if err != nil || len(shared) == 0 {
+		return err
+	}
+	if err = m.cli.sendToDevice("m.room.encrypted", messages); err != nil {
+		return err
+	}
+	m.Lock()
+	for _, d := range shared {
+		out.SharedWith[d.UserID+" "+d.DeviceID] = true
+	}
+	m.Unlock()
+	return nil
+}
+
+// shareTargets returns the devices of the users which the megolm session hasn't been shared with
+// yet, other than this one, and those of them there is no olm session with. m must be locked.
+func (m *olmMachine) shareTargets(out *outboundGroupSession, userIDs []string, devices map[string]map[string]*deviceKeys) (targets, withoutSession []*deviceKeys) {
+	for _, userID := range userIDs {
+		for deviceID, d := range devices[userID] {
+			if (userID == m.cli.UserID && deviceID == m.deviceID) || out.SharedWith[userID+" "+deviceID] {
+				continue
+			}
+			targets = append(targets, d)
+			if m.olmSession(d.curve25519()) == nil {
+				withoutSession = append(withoutSession, d)
+			}
+		}
+	}
+	return targets, withoutSession
+}
+
+// encryptRoomKey returns the m.room_key events sharing the megolm session to send to the devices,
+// by user ID and device ID, and the devices they are for. Olm sessions are made with the devices
+// which don't have one using the one-time keys claimed for them. m must be locked.
+func (m *olmMachine) encryptRoomKey(roomID string, out *outboundGroupSession, targets []*deviceKeys, oneTimeKeys map[string]string) (map[string]map[string]interface{}, []*deviceKeys, error) {
+	key := roomKey{megolmAlgorithm, roomID, string(out.session.ID()), out.session.Key()}
+	messages := make(map[string]map[string]interface{})
+	var shared []*deviceKeys
+	for _, d := range targets {
+		s := m.olmSession(d.curve25519())
+		if s == nil && oneTimeKeys[d.UserID+" "+d.DeviceID] != "" {
+			var err error
+			if s, err = m.newOlmSession(d, oneTimeKeys[d.UserID+" "+d.DeviceID]); err != nil {
+				return nil, nil, err
+			}
+		}
+		if s == nil {
+			log.WithFields(log.Fields{
+				"user_id":   m.cli.UserID,
+				"room_id":   roomID,
+				"target":    d.UserID,
+				"device_id": d.DeviceID,
+			}).Warn("Cannot share room key: no olm session with device")
+			continue
+		}
+		content, err := m.encryptOlm(s, d, "m.room_key", key)
+		if err != nil {
+			return nil, nil, err
+		}
+		if messages[d.UserID] == nil {
+			messages[d.UserID] = make(map[string]interface{})
+		}
+		messages[d.UserID][d.DeviceID] = content
+		shared = append(shared, d)
+	}
+	return messages, shared, nil
+}
+
+// queryDevices returns the verified keys of the users' devices, asking the homeserver for those of
+// users whose devices aren't known. m must not be locked.
+func (m *olmMachine) queryDevices(userIDs []string) (map[string]map[string]*deviceKeys, error) {
+	query := make(map[string][]string)
+	m.Lock()
+	for _, userID := range userIDs {
+		if _, known := m.devices[userID]; !known {
+			query[userID] = []string{}
+		}
+	}
+	forgot := m.devicesForgot
+	m.Unlock()
+	devices, err := m.fetchDevices(query)
+	if err != nil {
+		return nil, err
+	}
+	m.Lock()
+	defer m.Unlock()
+	for _, userID := range userIDs {
+		if _, queried := query[userID]; !queried {
+			devices[userID] = m.devices[userID]
+		} else if m.devicesForgot == forgot {
+			// The devices aren't kept if some changed while they were asked for, as the homeserver
+			// may have answered with those from before.
+			m.devices[userID] = devices[userID]
+		}
+	}
+	return devices, nil
+}
+
+// fetchDevices asks the homeserver for the keys of the devices of the users in the query, returning
+// those which are verified. m must not be locked.
+func (m *olmMachine) fetchDevices(query map[string][]string) (map[string]map[string]*deviceKeys, error) {
+	devices := make(map[string]map[string]*deviceKeys)
+	if len(query) == 0 {
+		return devices, nil
+	}
+	var res struct {
+		DeviceKeys map[string]map[string]json.RawMessage `json:"device_keys"`
+	}
+	if err := m.cli.postJSON(m.cli.buildURL("keys", "query"), map[string]interface{}{"device_keys": query}, &res); err != nil {
+		return nil, err
+	}
+	for userID, raws := range res.DeviceKeys {
+		if _, queried := query[userID]; queried {
+			devices[userID] = verifiedDevices(userID, raws)
+		}
+	}
+	return devices, nil
+}
+
+// verifiedDevices returns the user's devices whose keys are well formed and signed by the device,
+// by device ID, from the keys the homeserver returned.
+func verifiedDevices(userID string, raws map[string]json.RawMessage) map[string]*deviceKeys {
+	devices := make(map[string]*deviceKeys)
+	for deviceID, raw := range raws {
+		var d deviceKeys
+		if err := json.Unmarshal(raw, &d); err != nil || d.UserID != userID || d.DeviceID != deviceID ||
+			d.curve25519() == "" || !verifySignature(raw, userID, deviceID, d.ed25519()) {
+			log.WithFields(log.Fields{
+				"user_id":   userID,
+				"device_id": deviceID,
+			}).Warn("Ignoring device with bad keys")
+			continue
+		}
+		devices[deviceID] = &d
+	}
+	return devices
+}
+
+// claimOneTimeKeys claims a one-time key of each of the devices, for making olm sessions with
+// them. Returns the keys with good signatures, by user ID + " " + device ID.
+func (m *olmMachine) claimOneTimeKeys(devices []*deviceKeys) (map[string]string, error) {
+	claim := make(map[string]map[string]string)
+	byID := make(map[string]*deviceKeys)
+	for _, d := range devices {
+		if claim[d.UserID] == nil {
+			claim[d.UserID] = make(map[string]string)
+		}
+		claim[d.UserID][d.DeviceID] = "signed_curve25519"
+		byID[d.UserID+" "+d.DeviceID] = d
+	}
+	oneTimeKeys := make(map[string]string)
+	if len(claim) == 0 {
+		return oneTimeKeys, nil
+	}
+	var res struct {
+		OneTimeKeys map[string]map[string]map[string]json.RawMessage `json:"one_time_keys"`
+	}
+	if err := m.cli.postJSON(m.cli.buildURL("keys", "claim"), map[string]interface{}{"one_time_keys": claim}, &res); err != nil {
+		return nil, err
+	}
+	for userID, claimed := range res.OneTimeKeys {
+		for deviceID, keys := range claimed {
+			d := byID[userID+" "+deviceID]
+			if d == nil {
+				continue
+			}
+			for keyID, raw := range keys {
+				var otk struct {
+					Key string `json:"key"`
+				}
+				if !strings.HasPrefix(keyID, "signed_curve25519:") || json.Unmarshal(raw, &otk) != nil ||
+					!verifySignature(raw, userID, deviceID, d.ed25519()) {
+					log.WithFields(log.Fields{
+						"user_id":   userID,
+						"device_id": deviceID,
+					}).Warn("Ignoring one-time key with a bad signature")
+					continue
+				}
+				oneTimeKeys[userID+" "+deviceID] = otk.Key
+			}
+		}
+	}
+	return oneTimeKeys, nil
+}
+
+// newOlmSession makes an olm session with the device, using one of its one-time keys. m must be
+// locked.
+func (m *olmMachine) newOlmSession(d *deviceKeys, oneTimeKey string) (*olmSession, error) {
+	olmSess, err := m.account.NewOutboundSession(id.Curve25519(d.curve25519()), id.Curve25519(oneTimeKey))
+	if err != nil {
+		return nil, err
+	}
+	s := &olmSession{TheirKey: d.curve25519(), LastUsedMs: time.Now().UnixNano() / 1000000, session: olmSess.(*session.OlmSession)}
+	if err = m.saveOlmSession(s); err != nil {
+		return nil, err
+	}
+	m.olmSessions[s.TheirKey] = append(m.olmSessions[s.TheirKey], s)
+	return s, nil
+}
+
+// olmSession returns the most recently used olm session with the device which has the curve25519
+// key, or nil if there is none. m must be locked.
+func (m *olmMachine) olmSession(theirKey string) *olmSession {
+	var latest *olmSession
+	for _, s := range m.olmSessions[theirKey] {
+		if latest == nil || s.LastUsedMs > latest.LastUsedMs {
+			latest = s
+		}
+	}
+	return latest
+}
+
+// encryptOlm returns the content of an m.room.encrypted event to send to the device in place of an
+// event, encrypted with the olm session. m must be locked.
+func (m *olmMachine) encryptOlm(s *olmSession, d *deviceKeys, eventType string, content interface{}) (*olmContent, error) {
+	contentJSON, err := json.Marshal(content)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := json.Marshal(olmPayload{
+		Type:          eventType,
+		Content:       contentJSON,
+		Sender:        m.cli.UserID,
+		SenderDevice:  m.deviceID,
+		Keys:          map[string]string{"ed25519": m.ed25519},
+		Recipient:     d.UserID,
+		RecipientKeys: map[string]string{"ed25519": d.ed25519()},
+	})
+	if err != nil {
+		return nil, err
+	}
+	msgType, ciphertext, err := s.session.Encrypt(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	s.LastUsedMs = time.Now().UnixNano() / 1000000
+	if err = m.saveOlmSession(s); err != nil {
+		return nil, err
+	}
+	return &olmContent{
+		Algorithm:  olmAlgorithm,
+		SenderKey:  m.curve25519,
+		Ciphertext: map[string]olmCiphertext{d.curve25519(): {int(msgType), string(ciphertext)}},
+	}, nil
+}
+
+// onSync handles the parts of a /sync response for end-to-end encryption: the devices which
+// changed, the events sent to the device, and how many one-time keys the homeserver has left.
+func (m *olmMachine) onSync(res *syncHTTPResponse) {
+	m.Lock()
+	for _, userID := range append(res.DeviceLists.Changed, res.DeviceLists.Left...) {
+		// The user may have a new device which should be sent the room keys, or may have removed
+		// one which shouldn't be sent any more.
+		delete(m.devices, userID)
+		m.devicesForgot++
+		for roomID, out := range m.outbound {
+			for target := range out.SharedWith {
+				if strings.HasPrefix(target, userID+" ") {
+					m.rotate(roomID)
+					break
+				}
+			}
+		}
+	}
+	m.Unlock()
+	for _, event := range res.ToDevice.Events {
+		m.onToDeviceEvent(&event)
+	}
+	count := -1
+	if res.DeviceOneTimeKeysCount != nil {
+		count = res.DeviceOneTimeKeysCount["signed_curve25519"]
+	}
+	if err := m.uploadKeys(count); err != nil {
+		log.WithError(err).WithField("user_id", m.cli.UserID).Warn("Failed to upload encryption keys")
+	}
+}
+
+// rotate makes the client encrypt its next message into the room with a new megolm session, e.g.
+// because someone left the room who could read those encrypted with the current one. m must be
+// locked.
+func (m *olmMachine) rotate(roomID string) {
+	out := m.outbound[roomID]
+	if out == nil || out.Messages >= megolmRotationMessages {
+		return
+	}
+	out.Messages = megolmRotationMessages
+	if err := m.saveOutbound(roomID, out); err != nil {
+		log.WithError(err).WithField("room_id", roomID).Warn("Failed to save rotated megolm session")
+	}
+}
+
+// onRoomEvent keeps track of which rooms are encrypted and who leaves them, and decrypts
+// m.room.encrypted events, replacing them with the events they hold. Returns false if the event
+// can't be decrypted.
+func (m *olmMachine) onRoomEvent(event *Event) bool {
+	switch event.Type {
+	case "m.room.encryption":
+		m.Lock()
+		m.encryptedRooms[event.RoomID] = true
+		m.Unlock()
+	case "m.room.member":
+		if membership, _ := event.Content["membership"].(string); membership == "leave" || membership == "ban" {
+			m.Lock()
+			m.rotate(event.RoomID)
+			m.Unlock()
+		}
+	case "m.room.encrypted":
+		if err := m.decryptEvent(event); err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"user_id":  m.cli.UserID,
+				"room_id":  event.RoomID,
+				"event_id": event.ID,
+				"sender":   event.Sender,
+			}).Warn("Failed to decrypt event")
+			return false
+		}
+	}
+	return true
+}
+
+// decryptEvent replaces an m.room.encrypted event with the event it holds.
+func (m *olmMachine) decryptEvent(event *Event) error {
+	var content megolmContent
+	if err := decodeContent(event.Content, &content); err != nil {
+		return err
+	}
+	if content.Algorithm != megolmAlgorithm {
+		return fmt.Errorf("Unsupported algorithm %q", content.Algorithm)
+	}
+	in, err := m.inboundSession(event, content)
+	if err != nil {
+		return err
+	}
+	m.Lock()
+	defer m.Unlock()
+	plaintext, index, err := in.session.Decrypt([]byte(content.Ciphertext))
+	if err != nil {
+		return err
+	}
+	if err = m.markSeen(in, index, event.ID); err != nil {
+		return err
+	}
+	return setDecrypted(event, plaintext)
+}
+
+// inboundSession returns the megolm session the event was encrypted with, checking that it was
+// shared in the event's room by a device of the event's sender. m must not be locked.
+func (m *olmMachine) inboundSession(event *Event, content megolmContent) (*inboundGroupSession, error) {
+	m.Lock()
+	in := m.inbound[content.SessionID]
+	m.Unlock()
+	if in == nil || in.RoomID != event.RoomID || (content.SenderKey != "" && content.SenderKey != in.SenderKey) {
+		return nil, fmt.Errorf("No megolm session %s for the room: its key hasn't been shared with the device", content.SessionID)
+	}
+	// Otherwise the ciphertext of someone's event could be sent again as someone else's.
+	if !m.senderHasKeys(event.Sender, in.SenderKey, in.SigningKey) {
+		return nil, fmt.Errorf("Megolm session %s wasn't shared by a device of %s", content.SessionID, event.Sender)
+	}
+	return in, nil
+}
+
+// setDecrypted replaces the type and content of the event with those of its decrypted plaintext,
+// keeping its relation, which isn't encrypted.
+func setDecrypted(event *Event, plaintext []byte) error {
+	var decrypted struct {
+		Type    string                 `json:"type"`
+		Content map[string]interface{} `json:"content"`
+		RoomID  string                 `json:"room_id"`
+	}
+	if err := json.Unmarshal(plaintext, &decrypted); err != nil {
+		return err
+	}
+	if decrypted.RoomID != event.RoomID {
+		return fmt.Errorf("Event was encrypted for room %s", decrypted.RoomID)
+	}
+	if decrypted.Content == nil {
+		decrypted.Content = make(map[string]interface{})
+	}
+	if relatesTo, ok := event.Content["m.relates_to"]; ok {
+		if _, ok := decrypted.Content["m.relates_to"]; !ok {
+			decrypted.Content["m.relates_to"] = relatesTo
+		}
+	}
+	event.Type = decrypted.Type
+	event.Content = decrypted.Content
+	return nil
+}
+
+// markSeen records that the message index of the inbound megolm session was used by the event,
+// returning an error if it was already used by another, i.e. the event is a replay. Indexes are
+// saved with the session, so replays are spotted after restarting. m must be locked.
+func (m *olmMachine) markSeen(in *inboundGroupSession, index uint, eventID string) error {
+	sessionID := string(in.session.ID())
+	if seenBy, ok := in.Seen[index]; ok {
+		if seenBy != eventID {
+			return fmt.Errorf("Message index %d of megolm session %s was already used by %s", index, sessionID, seenBy)
+		}
+		return nil
+	}
+	if index < in.Forgotten {
+		return fmt.Errorf("Message index %d of megolm session %s is too old to check for replays", index, sessionID)
+	}
+	if in.Seen == nil {
+		in.Seen = make(map[uint]string)
+	}
+	in.Seen[index] = eventID
+	for len(in.Seen) > maxSeenIndexes {
+		lowest := index
+		for i := range in.Seen {
+			if i < lowest {
+				lowest = i
+			}
+		}
+		delete(in.Seen, lowest)
+		in.Forgotten = lowest + 1
+	}
+	if err := m.saveInbound(in); err != nil {
+		log.WithError(err).WithField("session_id", sessionID).Warn("Failed to save seen megolm message indexes")
+	}
+	return nil
+}
+
+// onToDeviceEvent handles an event sent to the device: megolm sessions shared with it in olm
+// encrypted m.room_key events.
+func (m *olmMachine) onToDeviceEvent(event *Event) {
+	logger := log.WithFields(log.Fields{
+		"user_id": m.cli.UserID,
+		"sender":  event.Sender,
+		"type":    event.Type,
+	})
+	if event.Type != "m.room.encrypted" {
+		return
+	}
+	payload, senderKey, ok := m.decryptToDevice(event, logger)
+	if !ok || payload.Type != "m.room_key" {
+		return
+	}
+	var key roomKey
+	if err := json.Unmarshal(payload.Content, &key); err != nil || key.Algorithm != megolmAlgorithm {
+		logger.Warn("Ignoring room key with an unsupported algorithm")
+		return
+	}
+	m.addRoomKey(key, senderKey, payload.Keys["ed25519"], logger)
+}
+
+// decryptToDevice decrypts an olm encrypted to-device event for the device, checking that it was
+// meant for the device and sent by a known device of its sender. Returns its payload and the
+// sender's curve25519 key, or false if it can't be decrypted or wasn't for the device.
+func (m *olmMachine) decryptToDevice(event *Event, logger *log.Entry) (olmPayload, string, bool) {
+	var payload olmPayload
+	var content olmContent
+	if err := decodeContent(event.Content, &content); err != nil || content.Algorithm != olmAlgorithm {
+		logger.WithField("algorithm", content.Algorithm).Warn("Ignoring to-device event with an unsupported algorithm")
+		return payload, "", false
+	}
+	ciphertext, ok := content.Ciphertext[m.curve25519]
+	if !ok {
+		return payload, "", false // it is for another of the user's devices
+	}
+
+	m.Lock()
+	plaintext, err := m.decryptOlm(content.SenderKey, ciphertext)
+	m.Unlock()
+	if err != nil {
+		logger.WithError(err).Warn("Failed to decrypt to-device event")
+		return payload, "", false
+	}
+	if err = json.Unmarshal(plaintext, &payload); err != nil ||
+		payload.Sender != event.Sender || payload.Recipient != m.cli.UserID || payload.RecipientKeys["ed25519"] != m.ed25519 {
+		logger.Warn("Ignoring to-device event which wasn't meant for the device")
+		return payload, "", false
+	}
+	if !m.senderHasKeys(event.Sender, content.SenderKey, payload.Keys["ed25519"]) {
+		logger.Warn("Ignoring to-device event from an unknown device")
+		return payload, "", false
+	}
+	return payload, content.SenderKey, true
+}
+
+// addRoomKey saves the megolm session shared in an m.room_key event by the device with the given
+// keys, unless it is already known. m must not be locked.
+func (m *olmMachine) addRoomKey(key roomKey, senderKey, signingKey string, logger *log.Entry) {
+	m.Lock()
+	defer m.Unlock()
+	if _, known := m.inbound[key.SessionID]; known {
+		return
+	}
+	s, err := session.NewMegolmInboundSession([]byte(key.SessionKey))
+	if err != nil || string(s.ID()) != key.SessionID {
+		logger.WithError(err).Warn("Ignoring bad room key")
+		return
+	}
+	in := &inboundGroupSession{
+		RoomID:     key.RoomID,
+		SenderKey:  senderKey,
+		SigningKey: signingKey,
+		session:    s,
+	}
+	if err = m.saveInbound(in); err != nil {
+		logger.WithError(err).Error("Failed to save room key")
+		return
+	}
+	m.inbound[key.SessionID] = in
+	logger.WithFields(log.Fields{
+		"room_id":    key.RoomID,
+		"session_id": key.SessionID,
+	}).Info("Received room key")
+}
+
+// decryptOlm decrypts an olm message from the device with the curve25519 key, with an existing olm
+// session or a new one made with one of the device's one-time keys. m must be locked.
+func (m *olmMachine) decryptOlm(senderKey string, ciphertext olmCiphertext) ([]byte, error) {
+	if plaintext, tried, err := m.decryptWithSessions(senderKey, ciphertext); tried {
+		return plaintext, err
+	}
+	if id.OlmMsgType(ciphertext.Type) != id.OlmMsgTypePreKey {
+		return nil, fmt.Errorf("No olm session with %s can decrypt the message", senderKey)
+	}
+	return m.decryptWithNewSession(senderKey, ciphertext)
+}
+
+// decryptWithSessions decrypts the message with the first of the olm sessions with the sender
+// which can. Returns false if none could, unless it is a pre-key message for one of them, which
+// fails if it can't be decrypted. m must be locked.
+func (m *olmMachine) decryptWithSessions(senderKey string, ciphertext olmCiphertext) ([]byte, bool, error) {
+	msgType := id.OlmMsgType(ciphertext.Type)
+	for _, s := range m.olmSessions[senderKey] {
+		if msgType == id.OlmMsgTypePreKey {
+			if matches, err := s.session.MatchesInboundSessionFrom(senderKey, ciphertext.Body); err != nil || !matches {
+				continue
+			}
+		}
+		plaintext, err := s.session.Decrypt(ciphertext.Body, msgType)
+		if err != nil {
+			// Go back to the session as it was, in case trying it changed it.
+			if restored, rerr := session.OlmSessionFromPickled([]byte(s.Pickle), m.pickleKeys[0]); rerr == nil {
+				s.session = restored
+			}
+			if msgType == id.OlmMsgTypePreKey {
+				return nil, true, err
+			}
+			continue
+		}
+		s.LastUsedMs = time.Now().UnixNano() / 1000000
+		return plaintext, true, m.saveOlmSession(s)
+	}
+	return nil, false, nil
+}
+
+// decryptWithNewSession makes a new olm session from the pre-key message and decrypts it, using
+// up the one-time key it was encrypted for. m must be locked.
+func (m *olmMachine) decryptWithNewSession(senderKey string, ciphertext olmCiphertext) ([]byte, error) {
+	theirKey := id.Curve25519(senderKey)
+	olmSess, err := m.account.NewInboundSessionFrom(&theirKey, ciphertext.Body)
+	if err != nil {
+		return nil, err
+	}
+	s := &olmSession{TheirKey: senderKey, LastUsedMs: time.Now().UnixNano() / 1000000, session: olmSess.(*session.OlmSession)}
+	plaintext, err := s.session.Decrypt(ciphertext.Body, id.OlmMsgTypePreKey)
+	if err != nil {
+		return nil, err
+	}
+	// The one-time key can't be used again.
+	if err = m.account.RemoveOneTimeKeys(olmSess); err != nil {
+		return nil, err
+	}
+	if err = m.saveAccount(); err != nil {
+		return nil, err
+	}
+	if err = m.saveOlmSession(s); err != nil {
+		return nil, err
+	}
+	m.olmSessions[senderKey] = append(m.olmSessions[senderKey], s)
+	return plaintext, nil
+}
+
+// senderHasKeys returns true if one of the user's devices has the curve25519 and ed25519 keys. The
+// user's devices are asked for again if none has them, in case the device is new. m must not be
+// locked.
+func (m *olmMachine) senderHasKeys(userID, curve25519Key, ed25519Key string) bool {
+	for attempt := 0; attempt < 2; attempt++ {
+		devices, err := m.queryDevices([]string{userID})
+		if err != nil {
+			log.WithError(err).WithField("user_id", userID).Warn("Failed to query devices")
+			return false
+		}
+		for _, d := range devices[userID] {
+			if d.curve25519() == curve25519Key && d.ed25519() == ed25519Key {
+				return true
+			}
+		}
+		m.Lock()
+		delete(m.devices, userID)
+		m.devicesForgot++
+		m.Unlock()
+	}
+	return false
+}
+
+// decodeContent decodes an event's content into a struct.
+func decodeContent(content map[string]interface{}, v interface{}) error {
+	raw, err := json.Marshal(content)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// joinedMembers returns the user IDs of the room's joined members.
+func (cli *Client) joinedMembers(roomID string) ([]string, error) {
+	var res struct {
+		Joined map[string]json.RawMessage `json:"joined"`
+	}
+	if err := cli.getJSON(cli.buildURL("rooms", roomID, "joined_members"), &res); err != nil {
+		return nil, err
+	}
+	userIDs := make([]string, 0, len(res.Joined))
+	for userID := range res.Joined {
+		userIDs = append(userIDs, userID)
+	}
+	return userIDs, nil
+}
+
+// sendToDevice sends events to devices. messages maps user IDs to device IDs to the content of the
+// event to send to each.
+func (cli *Client) sendToDevice(eventType string, messages interface{}) error {
+	_, err := cli.sendJSON("PUT", cli.buildURL("sendToDevice", eventType, newTxnID()), struct {
+		Messages interface{} `json:"messages"`
+	}{messages})
+	return err
+}
+
+// getJSON GETs the URL and decodes the JSON it returns into v. Unsuccessful responses are returned
+// as errors.HTTPError.
+func (cli *Client) getJSON(httpURL string, v interface{}) error {
+	res, err := cli.httpClient.Get(httpURL)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != 200 {
+		return errors.HTTPError{
+			Code:    res.StatusCode,
+			Message: "Failed to GET JSON: HTTP " + strconv.Itoa(res.StatusCode),
+		}
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// postJSON POSTs the content and decodes the JSON the homeserver returns into v.
+func (cli *Client) postJSON(httpURL string, content, v interface{}) error {
+	resBytes, err := cli.sendJSON("POST", httpURL, content)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(resBytes, v)
+}
@@ -0,0 +1,507 @@
+package matrix
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"maunium.net/go/mautrix/crypto/goolm/account"
+	olmcrypto "maunium.net/go/mautrix/crypto/goolm/crypto"
+	"maunium.net/go/mautrix/crypto/goolm/session"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memCryptoStore keeps crypto state in memory.
+type memCryptoStore map[string][]byte
+
+func (s memCryptoStore) SaveCrypto(userID, deviceID, key string, value []byte) error {
+	s[userID+"|"+deviceID+"|"+key] = value
+	return nil
+}
+
+func (s memCryptoStore) LoadCrypto(userID, deviceID string) (map[string][]byte, error) {
+	values := make(map[string][]byte)
+	for k, v := range s {
+		if strings.HasPrefix(k, userID+"|"+deviceID+"|") {
+			values[strings.TrimPrefix(k, userID+"|"+deviceID+"|")] = v
+		}
+	}
+	return values, nil
+}
+
+func (s memCryptoStore) PickleKeys() [][]byte {
+	return nil
+}
+
+// keyedCryptoStore keeps crypto state in memory, pickled with its keys.
+type keyedCryptoStore struct {
+	memCryptoStore
+	keys [][]byte
+}
+
+func (s keyedCryptoStore) PickleKeys() [][]byte {
+	return s.keys
+}
+
+// cryptoHomeserver is a homeserver with one encrypted room which every user has joined. Users are
+// identified by their access tokens, which are their user IDs.
+type cryptoHomeserver struct {
+	sync.Mutex
+	deviceKeys  map[string]map[string]json.RawMessage            // user => device => keys
+	oneTimeKeys map[string]map[string]map[string]json.RawMessage // user => device => key ID => key
+	toDevice    map[string][]Event                               // user => events sent to their devices
+	sent        []Event                                          // events sent into the room
+	users       []string
+	onClaim     func() // called as one-time keys are claimed
+}
+
+func (hs *cryptoHomeserver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	hs.Lock()
+	defer hs.Unlock()
+	userID := req.URL.Query().Get("access_token")
+	path := strings.TrimPrefix(req.URL.Path, "/_matrix/client/r0/")
+	var body map[string]json.RawMessage
+	json.NewDecoder(req.Body).Decode(&body)
+	switch {
+	case path == "keys/upload":
+		hs.uploadKeys(w, userID, body)
+	case path == "keys/query":
+		var query map[string][]string
+		json.Unmarshal(body["device_keys"], &query)
+		res := make(map[string]map[string]json.RawMessage)
+		for u := range query {
+			res[u] = hs.deviceKeys[u]
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"device_keys": res})
+	case path == "keys/claim":
+		hs.claimKeys(w, body)
+	case strings.HasPrefix(path, "sendToDevice/m.room.encrypted/"):
+		hs.sendToDevice(w, userID, body)
+	case path == "rooms/!r:x/state/m.room.encryption":
+		w.Write([]byte(`{"algorithm":"m.megolm.v1.aes-sha2"}`))
+	case path == "rooms/!r:x/joined_members":
+		joined := make(map[string]interface{})
+		for _, u := range hs.users {
+			joined[u] = map[string]interface{}{}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"joined": joined})
+	case strings.HasPrefix(path, "rooms/!r:x/send/"):
+		var content map[string]interface{}
+		raw, _ := json.Marshal(body)
+		json.Unmarshal(raw, &content)
+		eventID := fmt.Sprintf("$%d", len(hs.sent))
+		hs.sent = append(hs.sent, Event{ID: eventID, Type: strings.Split(path, "/")[3], Sender: userID, Content: content})
+		fmt.Fprintf(w, `{"event_id":"%s"}`, eventID)
+	default:
+		w.WriteHeader(404)
+	}
+}
+
+// uploadKeys stores the keys the user uploads. Each user has one device, which uploading device
+// keys replaces.
+func (hs *cryptoHomeserver) uploadKeys(w http.ResponseWriter, userID string, body map[string]json.RawMessage) {
+	var device struct {
+		DeviceID string `json:"device_id"`
+	}
+	if body["device_keys"] != nil {
+		json.Unmarshal(body["device_keys"], &device)
+		hs.deviceKeys[userID] = map[string]json.RawMessage{device.DeviceID: body["device_keys"]}
+		hs.oneTimeKeys[userID] = map[string]map[string]json.RawMessage{device.DeviceID: {}}
+	}
+	for deviceID := range hs.deviceKeys[userID] {
+		var keys map[string]json.RawMessage
+		json.Unmarshal(body["one_time_keys"], &keys)
+		for keyID, key := range keys {
+			hs.oneTimeKeys[userID][deviceID][keyID] = key
+		}
+		fmt.Fprintf(w, `{"one_time_key_counts":{"signed_curve25519":%d}}`, len(hs.oneTimeKeys[userID][deviceID]))
+	}
+}
+
+// claimKeys hands out, and forgets, one of the one-time keys of each of the devices claimed.
+func (hs *cryptoHomeserver) claimKeys(w http.ResponseWriter, body map[string]json.RawMessage) {
+	if hs.onClaim != nil {
+		hs.onClaim()
+	}
+	var claim map[string]map[string]string
+	json.Unmarshal(body["one_time_keys"], &claim)
+	res := make(map[string]map[string]map[string]json.RawMessage)
+	for u, devices := range claim {
+		res[u] = make(map[string]map[string]json.RawMessage)
+		for deviceID := range devices {
+			for keyID, key := range hs.oneTimeKeys[u][deviceID] {
+				res[u][deviceID] = map[string]json.RawMessage{keyID: key}
+				delete(hs.oneTimeKeys[u][deviceID], keyID)
+				break
+			}
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"one_time_keys": res})
+}
+
+// sendToDevice queues the encrypted events the user sends for the devices they are for.
+func (hs *cryptoHomeserver) sendToDevice(w http.ResponseWriter, userID string, body map[string]json.RawMessage) {
+	var messages map[string]map[string]map[string]interface{}
+	json.Unmarshal(body["messages"], &messages)
+	for u, devices := range messages {
+		for _, content := range devices {
+			hs.toDevice[u] = append(hs.toDevice[u], Event{Type: "m.room.encrypted", Sender: userID, Content: content})
+		}
+	}
+	w.Write([]byte(`{}`))
+}
+
+// syncTo returns the /sync response the homeserver would send the user with the events.
+func (hs *cryptoHomeserver) syncTo(t *testing.T, cli *Client, events ...Event) syncHTTPResponse {
+	hs.Lock()
+	toDevice := hs.toDevice[cli.UserID]
+	hs.toDevice[cli.UserID] = nil
+	hs.Unlock()
+	raw, _ := json.Marshal(map[string]interface{}{
+		"next_batch": "s1",
+		"to_device":  map[string]interface{}{"events": toDevice},
+		"rooms": map[string]interface{}{
+			"join": map[string]interface{}{
+				"!r:x": map[string]interface{}{"timeline": map[string]interface{}{"events": events}},
+			},
+		},
+	})
+	res, err := decodeSync(bytes.NewReader(raw), cli.Worker.wants)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *res
+}
+
+func newCryptoClient(t *testing.T, srv *httptest.Server, userID, deviceID string, store CryptoStorer) *Client {
+	u, _ := url.Parse(srv.URL)
+	cli := NewClient(u, userID, userID)
+	if err := cli.EnableEncryption(deviceID, store); err != nil {
+		t.Fatal(err)
+	}
+	if err := cli.crypto.uploadKeys(-1); err != nil {
+		t.Fatal(err)
+	}
+	return cli
+}
+
+func TestEncryptedRoom(t *testing.T) {
+	hs := &cryptoHomeserver{
+		deviceKeys:  make(map[string]map[string]json.RawMessage),
+		oneTimeKeys: make(map[string]map[string]map[string]json.RawMessage),
+		toDevice:    make(map[string][]Event),
+		users:       []string{"@a:x", "@b:x"},
+	}
+	srv := httptest.NewServer(hs)
+	defer srv.Close()
+	storeB := memCryptoStore{}
+	a := newCryptoClient(t, srv, "@a:x", "ADEVICE", memCryptoStore{})
+	b := newCryptoClient(t, srv, "@b:x", "BDEVICE", storeB)
+	var received []string
+	listen := func(cli *Client) {
+		cli.Worker.OnEventType("m.room.message", func(event *Event) {
+			received = append(received, fmt.Sprintf("%s %v", event.ID, event.Content["body"]))
+		})
+	}
+	listen(b)
+
+	if _, err := a.SendText("!r:x", "hello"); err != nil {
+		t.Fatalf("SendText => %s", err)
+	}
+	if _, err := a.SendText("!r:x", "again"); err != nil {
+		t.Fatalf("SendText => %s", err)
+	}
+	if len(hs.sent) != 2 || hs.sent[0].Type != "m.room.encrypted" || strings.Contains(fmt.Sprint(hs.sent[0].Content), "hello") {
+		t.Fatalf("SendText into an encrypted room => want m.room.encrypted events, got %v", hs.sent)
+	}
+	if len(hs.toDevice["@b:x"]) != 1 {
+		t.Fatalf("SendText => want the room key sent to @b:x once, got %v", hs.toDevice["@b:x"])
+	}
+
+	// A message from someone other than the device which shared the room key isn't decrypted.
+	spoofed := hs.sent[0]
+	spoofed.ID = "$spoofed"
+	spoofed.Sender = "@c:x"
+	b.Worker.onSyncHTTPResponse(hs.syncTo(t, b, spoofed))
+	b.Worker.onSyncHTTPResponse(hs.syncTo(t, b, hs.sent[0]))
+	// A replayed message isn't decrypted again.
+	replayed := hs.sent[0]
+	replayed.ID = "$replayed"
+	b.Worker.onSyncHTTPResponse(hs.syncTo(t, b, replayed))
+	if want := "$0 hello"; strings.Join(received, ",") != want {
+		t.Errorf("Received => want %q, got %q", want, strings.Join(received, ","))
+	}
+
+	// The room key is kept, so a restarted client can decrypt messages.
+	received = nil
+	b2 := NewClient(b.HomeserverURL, "@b:x", "@b:x")
+	if err := b2.EnableEncryption("BDEVICE", storeB); err != nil {
+		t.Fatal(err)
+	}
+	listen(b2)
+	replayed.ID = "$replayedAfterRestart"
+	b2.Worker.onSyncHTTPResponse(hs.syncTo(t, b2, replayed, hs.sent[1]))
+	if want := "$1 again"; strings.Join(received, ",") != want {
+		t.Errorf("Received after restarting => want %q, got %q", want, strings.Join(received, ","))
+	}
+
+	// B can reply to A with the olm session A made.
+	received = nil
+	listen(a)
+	if _, err := b2.SendText("!r:x", "reply"); err != nil {
+		t.Fatalf("SendText => %s", err)
+	}
+	a.Worker.onSyncHTTPResponse(hs.syncTo(t, a, hs.sent[2]))
+	if want := "$2 reply"; strings.Join(received, ",") != want {
+		t.Errorf("Received reply => want %q, got %q", want, strings.Join(received, ","))
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	cli := NewClient(&url.URL{}, "token", "@neb:x")
+	if err := cli.EnableEncryption("DEVICE", memCryptoStore{}); err != nil {
+		t.Fatal(err)
+	}
+	obj := map[string]interface{}{"key": "abc", "unsigned": map[string]interface{}{"age": 1}}
+	if err := cli.crypto.sign(obj); err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := json.Marshal(obj)
+	tests := []struct {
+		raw    string
+		userID string
+		want   bool
+	}{
+		{string(raw), "@neb:x", true},
+		{string(raw), "@other:x", false},
+		{strings.Replace(string(raw), `"abc"`, `"abd"`, 1), "@neb:x", false},
+		{strings.Replace(string(raw), `"age":1`, `"age":2`, 1), "@neb:x", true},
+	}
+	for _, test := range tests {
+		if got := verifySignature(json.RawMessage(test.raw), test.userID, "DEVICE", cli.crypto.ed25519); got != test.want {
+			t.Errorf("verifySignature(%s, %s) => want %v got %v", test.raw, test.userID, test.want, got)
+		}
+	}
+}
+
+func TestEncryptUnlocked(t *testing.T) {
+	hs := &cryptoHomeserver{
+		deviceKeys:  make(map[string]map[string]json.RawMessage),
+		oneTimeKeys: make(map[string]map[string]map[string]json.RawMessage),
+		toDevice:    make(map[string][]Event),
+		users:       []string{"@a:x", "@b:x"},
+	}
+	srv := httptest.NewServer(hs)
+	defer srv.Close()
+	a := newCryptoClient(t, srv, "@a:x", "ADEVICE", memCryptoStore{})
+	newCryptoClient(t, srv, "@b:x", "BDEVICE", memCryptoStore{})
+	// The worker can handle events while keys are claimed to send a message.
+	hs.onClaim = func() {
+		done := make(chan bool)
+		go func() {
+			a.crypto.onRoomEvent(&Event{Type: "m.room.encryption", RoomID: "!other:x"})
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Error("onRoomEvent while claiming one-time keys => want it handled, got it blocked")
+		}
+	}
+	if _, err := a.SendText("!r:x", "hello"); err != nil {
+		t.Fatalf("SendText => %s", err)
+	}
+}
+
+func TestMarkSeen(t *testing.T) {
+	store := memCryptoStore{}
+	cli := NewClient(&url.URL{}, "token", "@neb:x")
+	if err := cli.EnableEncryption("DEVICE", store); err != nil {
+		t.Fatal(err)
+	}
+	out, err := session.NewMegolmOutboundSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := session.NewMegolmInboundSession([]byte(out.Key()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := cli.crypto
+	in := &inboundGroupSession{RoomID: "!r:x", session: s}
+	for i := uint(0); i <= maxSeenIndexes; i++ {
+		if err = m.markSeen(in, i, fmt.Sprintf("$%d", i)); err != nil {
+			t.Fatalf("markSeen(%d) => %s", i, err)
+		}
+	}
+	tests := []struct {
+		index   uint
+		eventID string
+		wantErr bool
+	}{
+		{maxSeenIndexes, fmt.Sprintf("$%d", maxSeenIndexes), false}, // the same event again
+		{maxSeenIndexes, "$replayed", true},
+		{1, "$1", false},
+		{0, "$0", true}, // forgotten first, as the lowest
+		{maxSeenIndexes + 1, "$new", false},
+	}
+	for _, test := range tests {
+		if err = m.markSeen(in, test.index, test.eventID); (err != nil) != test.wantErr {
+			t.Errorf("markSeen(%d, %s) => want error %v, got %v", test.index, test.eventID, test.wantErr, err)
+		}
+	}
+	if len(in.Seen) != maxSeenIndexes {
+		t.Errorf("Seen => want %d indexes, got %d", maxSeenIndexes, len(in.Seen))
+	}
+	var saved inboundGroupSession
+	json.Unmarshal(store["@neb:x|DEVICE|inbound/"+string(s.ID())], &saved)
+	if saved.Seen[maxSeenIndexes+1] != "$new" || saved.Forgotten != 2 {
+		t.Errorf("Saved session => want $new seen and indexes below 2 forgotten, got %v, %d", saved.Seen[maxSeenIndexes+1], saved.Forgotten)
+	}
+}
+
+func TestPickleKeys(t *testing.T) {
+	store := memCryptoStore{}
+	cli := NewClient(&url.URL{}, "token", "@neb:x")
+	if err := cli.EnableEncryption("DEVICE", store); err != nil {
+		t.Fatal(err)
+	}
+	identity := cli.crypto.ed25519
+
+	// State pickled with the default key is pickled again with the store's key.
+	key, previousKey := []byte("current key"), []byte("previous key")
+	for _, keys := range [][][]byte{{previousKey}, {key, previousKey}} {
+		cli = NewClient(&url.URL{}, "token", "@neb:x")
+		if err := cli.EnableEncryption("DEVICE", keyedCryptoStore{store, keys}); err != nil || cli.crypto.ed25519 != identity {
+			t.Fatalf("EnableEncryption with keys %q => want account %s, got %v", keys, identity, err)
+		}
+	}
+	var state accountState
+	json.Unmarshal(store["@neb:x|DEVICE|account"], &state)
+	if _, err := account.AccountFromPickled([]byte(state.Pickle), key); err != nil {
+		t.Errorf("Saved account => want it pickled with %q, got %s", key, err)
+	}
+
+	cli = NewClient(&url.URL{}, "token", "@neb:x")
+	if err := cli.EnableEncryption("DEVICE", keyedCryptoStore{store, [][]byte{[]byte("wrong key")}}); err == nil {
+		t.Errorf("EnableEncryption with the wrong key => want an error, got nil")
+	}
+}
+
+// TestSignableJSON checks signableJSON against the canonical JSON examples of the Matrix spec.
+func TestSignableJSON(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{`{}`, `{}`},
+		{`{"one": 1, "two": "Two"}`, `{"one":1,"two":"Two"}`},
+		{`{"b": "2", "a": "1"}`, `{"a":"1","b":"2"}`},
+		{`{"auth": {"success": true, "mxid": "@john.doe:example.com", "profile": {"display_name": "John Doe", "three_pids": [{"medium": "email", "address": "john.doe@example.org"}, {"medium": "msisdn", "address": "123456789"}]}}}`,
+			`{"auth":{"mxid":"@john.doe:example.com","profile":{"display_name":"John Doe","three_pids":[{"address":"john.doe@example.org","medium":"email"},{"address":"123456789","medium":"msisdn"}]},"success":true}}`},
+		{`{"a": "日本語"}`, `{"a":"日本語"}`},
+		{`{"本": 2, "日": 1}`, `{"日":1,"本":2}`},
+		{`{"a": "\u65E5"}`, `{"a":"日"}`},
+		{`{"a": null}`, `{"a":null}`},
+		{`{"a": 1, "signatures": {}, "unsigned": {"age": 1}}`, `{"a":1}`},
+	}
+	for _, test := range tests {
+		if got, err := signableJSON(json.RawMessage(test.in)); err != nil || string(got) != test.want {
+			t.Errorf("signableJSON(%s) => want %s, got %s, %v", test.in, test.want, got, err)
+		}
+	}
+}
+
+// specSigningSeed is the ed25519 seed of the signing key of the Matrix spec's "Signing JSON"
+// examples, and specSigningKey its public key.
+const (
+	specSigningSeed = "YJDBA9Xnr2sVqXD9Vj7XVUnmFZcZrlw8Md7kMW+3XA1"
+	specSigningKey  = "XGX0JRS2Af3be3knz2fBiRbApjm2Dh61gXDJA8kcJNI"
+)
+
+// TestSpecSignatures checks that the olm implementation signs, and verifySignature verifies, as
+// in the Matrix spec's "Signing JSON" examples.
+func TestSpecSignatures(t *testing.T) {
+	seed, _ := base64.RawStdEncoding.DecodeString(specSigningSeed)
+	keyPair := olmcrypto.Ed25519GenerateFromSeed(seed)
+	if got := string(keyPair.B64Encoded()); got != specSigningKey {
+		t.Fatalf("Ed25519GenerateFromSeed(%s) => want public key %s, got %s", specSigningSeed, specSigningKey, got)
+	}
+	tests := []struct {
+		json      string
+		signature string
+	}{
+		{`{}`, "K8280/U9SSy9IVtjBuVeLr+HpOB4BQFWbg+UZaADMtTdGYI7Geitb76LTrr5QV/7Xg4ahLwYGYZzuHGZKM5ZAQ"},
+		{`{"one":1,"two":"Two"}`, "KqmLSbO39/Bzb0QIYE82zqLwsA+PDzYIpIRA2sRQ4sL53+sN6/fpNSoqE7BP7vBZhG6kYdD13EIMJpvhJI+6Bw"},
+	}
+	for _, test := range tests {
+		signature, err := keyPair.Sign([]byte(test.json))
+		if got := base64.RawStdEncoding.EncodeToString(signature); err != nil || got != test.signature {
+			t.Errorf("Sign(%s) => want %s, got %s, %v", test.json, test.signature, got, err)
+		}
+		signed := strings.TrimSuffix(test.json, "}")
+		if signed != "{" {
+			signed += ","
+		}
+		signed += `"signatures":{"domain":{"ed25519:1":"` + test.signature + `"}}}`
+		if !verifySignature(json.RawMessage(signed), "domain", "1", specSigningKey) {
+			t.Errorf("verifySignature(%s) => want true, got false", signed)
+		}
+		tampered := strings.Replace(signed, `"signatures"`, `"extra":0,"signatures"`, 1)
+		if verifySignature(json.RawMessage(tampered), "domain", "1", specSigningKey) {
+			t.Errorf("verifySignature(%s) => want false, got true", tampered)
+		}
+	}
+}
+
+// TestCurve25519 checks the olm implementation's key agreement against the test vectors of RFC
+// 7748, section 6.1.
+func TestCurve25519(t *testing.T) {
+	decode := func(s string) []byte {
+		b, _ := hex.DecodeString(s)
+		return b
+	}
+	alice, err := olmcrypto.Curve25519GenerateFromPrivate(decode("77076d0a7318a57d3c16c17251b26645df4c2f87ebc0992ab177fba51db92c2a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := olmcrypto.Curve25519GenerateFromPrivate(decode("5dab087e624a8a4b79e17f8b83800ee66f3bb1292618b6fd1c2f8b27ff88e0eb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		got  []byte
+		want string
+	}{
+		{"Alice's public key", alice.PublicKey, "8520f0098930a754748b7ddcb43ef75a0dbf3a0d26381af4eba4a98eaa9b4e6a"},
+		{"Bob's public key", bob.PublicKey, "de9edb7d7b7dc1b4d35b61c2ece435373f8343c85b78674dadfc7e146f882b4f"},
+	}
+	for _, pair := range []struct {
+		name string
+		from olmcrypto.Curve25519KeyPair
+		to   olmcrypto.Curve25519KeyPair
+	}{{"Alice's shared secret", alice, bob}, {"Bob's shared secret", bob, alice}} {
+		secret, secretErr := pair.from.SharedSecret(pair.to.PublicKey)
+		if secretErr != nil {
+			t.Fatal(secretErr)
+		}
+		tests = append(tests, struct {
+			name string
+			got  []byte
+			want string
+		}{pair.name, secret, "4a5d9d5ba4ce2de1728e3bf480350f25e07e21c947d19e3376f09b3c1e161742"})
+	}
+	for _, test := range tests {
+		if got := hex.EncodeToString(test.got); got != test.want {
+			t.Errorf("%s => want %s, got %s", test.name, test.want, got)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package matrix
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultSendRate and DefaultSendBurst are how many requests a client sends to the homeserver per
+// minute, and how many it may send at once after being idle, unless SetSendRate is called.
+const (
+	DefaultSendRate  = 300
+	DefaultSendBurst = 20
+)
+
+// maxSendWait is the longest a request waits for the limiter. If it would wait longer, it fails
+// with HTTP 429 instead, so that a webhook isn't held up for long: package batch queues failed
+// messages to be sent again later.
+const maxSendWait = 10 * time.Second
+
+// maxRateLimitRetries is how many times a request the homeserver rate limits is sent again, once it
+// says to.
+const maxRateLimitRetries = 3
+
+// defaultRetryAfter is how long to wait after being rate limited, if the homeserver doesn't say.
+const defaultRetryAfter = time.Second
+
+var (
+	sendRate    int64 = DefaultSendRate
+	sendBurst   int64 = DefaultSendBurst
+	rateLimited int64 // requests the homeserver rate limited, updated atomically
+)
+
+// SetSendRate sets how many requests each client sends to the homeserver per minute, and how many
+// it may send at once after being idle, for clients made afterwards. 0 sends as fast as the
+// homeserver allows: clients still wait as long as it says to when it rate limits them.
+func SetSendRate(perMinute, burst int) {
+	atomic.StoreInt64(&sendRate, int64(perMinute))
+	atomic.StoreInt64(&sendBurst, int64(burst))
+}
+
+// RateLimited returns how many requests the homeserver has rate limited, for metrics.
+func RateLimited() int64 {
+	return atomic.LoadInt64(&rateLimited)
+}
+
+// A limiter is a token bucket, shared by every request a client sends, so that a burst of
+// notifications from several services doesn't get the client rate limited. When the homeserver
+// rate limits it anyway, every request waits as long as the homeserver says to.
+type limiter struct {
+	mu          sync.Mutex
+	rate        float64 // tokens per second, or 0 for no limit
+	burst       float64
+	tokens      float64
+	last        time.Time
+	pausedUntil time.Time
+}
+
+func newLimiter(perMinute, burst int64) *limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &limiter{rate: float64(perMinute) / 60, burst: float64(burst), tokens: float64(burst)}
+}
+
+// reserve takes a token, returning how long to wait before sending the request. If that is longer
+// than max, the token is put back and ok is false.
+func (l *limiter) reserve(now time.Time, max time.Duration) (wait time.Duration, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate > 0 {
+		if !l.last.IsZero() {
+			l.tokens += now.Sub(l.last).Seconds() * l.rate
+			if l.tokens > l.burst {
+				l.tokens = l.burst
+			}
+		}
+		l.last = now
+		l.tokens--
+		if l.tokens < 0 {
+			wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+		}
+	}
+	if paused := l.pausedUntil.Sub(now); paused > wait {
+		wait = paused
+	}
+	if wait > max {
+		if l.rate > 0 {
+			l.tokens++
+		}
+		return wait, false
+	}
+	return wait, true
+}
+
+// pause makes every request wait until d from now.
+func (l *limiter) pause(now time.Time, d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if until := now.Add(d); until.After(l.pausedUntil) {
+		l.pausedUntil = until
+	}
+}
+
+// retryAfter returns how long a rate limited request says to wait: its body's retry_after_ms, as
+// in an M_LIMIT_EXCEEDED error, or its Retry-After header, in seconds.
+func retryAfter(header string, body []byte) time.Duration {
+	var errRes struct {
+		RetryAfterMs int64 `json:"retry_after_ms"`
+	}
+	if json.Unmarshal(body, &errRes) == nil && errRes.RetryAfterMs > 0 {
+		return time.Duration(errRes.RetryAfterMs) * time.Millisecond
+	}
+	if secs, err := strconv.Atoi(header); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	return defaultRetryAfter
+}
@@ -0,0 +1,102 @@
+package matrix
+
+import (
+	"github.com/matrix-org/go-neb/errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLimiterReserve(t *testing.T) {
+	l := newLimiter(60, 2) // a token a second
+	now := time.Unix(1000, 0)
+	for i, want := range []time.Duration{0, 0, time.Second, 2 * time.Second} {
+		if wait, ok := l.reserve(now, time.Minute); !ok || wait != want {
+			t.Errorf("reserve %d => want %s, got %s %v", i, want, wait, ok)
+		}
+	}
+	// Too long a wait puts the token back.
+	if _, ok := l.reserve(now, 2*time.Second); ok {
+		t.Error("reserve past max => want not ok")
+	}
+	if wait, _ := l.reserve(now.Add(3*time.Second), time.Minute); wait != 0 {
+		t.Errorf("reserve once refilled => want no wait, got %s", wait)
+	}
+
+	l.pause(now.Add(3*time.Second), 5*time.Second)
+	if wait, _ := l.reserve(now.Add(4*time.Second), time.Minute); wait != 4*time.Second {
+		t.Errorf("reserve whilst paused => want 4s, got %s", wait)
+	}
+
+	unlimited := newLimiter(0, 0)
+	for i := 0; i < 100; i++ {
+		if wait, ok := unlimited.reserve(now, 0); !ok || wait != 0 {
+			t.Fatalf("reserve without a rate => want no wait, got %s %v", wait, ok)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	for _, test := range []struct {
+		header, body string
+		want         time.Duration
+	}{
+		{"", `{"errcode":"M_LIMIT_EXCEEDED","error":"Too many requests","retry_after_ms":1500}`, 1500 * time.Millisecond},
+		{"3", `{"errcode":"M_LIMIT_EXCEEDED"}`, 3 * time.Second},
+		{"", `not json`, defaultRetryAfter},
+	} {
+		if got := retryAfter(test.header, []byte(test.body)); got != test.want {
+			t.Errorf("retryAfter(%q, %s) => want %s, got %s", test.header, test.body, test.want, got)
+		}
+	}
+}
+
+func TestSendRateLimited(t *testing.T) {
+	var requests int32
+	cli, done := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(429)
+			w.Write([]byte(`{"errcode":"M_LIMIT_EXCEEDED","retry_after_ms":50}`))
+			return
+		}
+		w.Write([]byte(`{"event_id":"$1"}`))
+	})
+	defer done()
+	before := RateLimited()
+
+	start := time.Now()
+	if _, err := cli.SendText("!r:x", "hi"); err != nil {
+		t.Fatalf("SendText rate limited once => want it sent again, got %v", err)
+	}
+	if took := time.Since(start); took < 50*time.Millisecond {
+		t.Errorf("SendText rate limited once took %s: want it to wait 50ms", took)
+	}
+	if got := atomic.LoadInt32(&requests); got != 2 {
+		t.Errorf("SendText rate limited once => want 2 requests, got %d", got)
+	}
+	if got := RateLimited() - before; got != 1 {
+		t.Errorf("RateLimited => want 1, got %d", got)
+	}
+}
+
+func TestSendRateLimitedTooLong(t *testing.T) {
+	cli, done := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(429)
+		w.Write([]byte(`{"errcode":"M_LIMIT_EXCEEDED","retry_after_ms":60000}`))
+	})
+	defer done()
+
+	start := time.Now()
+	_, err := cli.SendText("!r:x", "hi")
+	if httpErr, ok := err.(errors.HTTPError); !ok || httpErr.Code != 429 {
+		t.Errorf("SendText rate limited for a minute => want an HTTP 429 error, got %v", err)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("SendText rate limited for a minute took %s: want it to give up rather than wait", took)
+	}
+	// Other requests don't wait either, until the homeserver says they may be sent.
+	if _, err = cli.SendText("!other:x", "hi"); err == nil {
+		t.Error("SendText whilst rate limited => want an error")
+	}
+}
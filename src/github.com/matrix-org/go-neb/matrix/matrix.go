@@ -17,6 +17,8 @@ import (
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/matrix-org/go-neb/errors"
+	"github.com/matrix-org/go-neb/httpclient"
+	"github.com/matrix-org/go-neb/ops"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -24,13 +26,24 @@ import (
 	"path"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var (
-	filterJSON = json.RawMessage(`{"room":{"timeline":{"limit":50}}}`)
+	// Presence and account data are never used, so aren't asked for.
+	filterJSON = json.RawMessage(`{"room":{"timeline":{"limit":50}},"presence":{"types":[]},"account_data":{"types":[]}}`)
+	// txnCounter makes transaction IDs unique when several messages are sent at once.
+	txnCounter int64
 )
 
+// syncFailureAlertAfter is how long syncing must fail for before an operational alert is raised.
+const syncFailureAlertAfter = 2 * time.Minute
+
+// clientTimeout is how long the client waits for the homeserver to answer a request, which must be
+// longer than syncs wait for events.
+const clientTimeout = 2 * time.Minute
+
 // NextBatchStorer controls loading/saving of next_batch tokens for users
 type NextBatchStorer interface {
 	// Save a next_batch token for a given user. Best effort.
@@ -54,10 +67,16 @@ type Client struct {
 	Rooms           map[string]*Room
 	Worker          *Worker
 	syncingMutex    sync.Mutex
-	syncingID       uint32 // Identifies the current Sync. Only one Sync can be active at any given time.
+	syncingID       uint32         // Identifies the current Sync. Only one Sync can be active at any given time.
+	pending         sync.WaitGroup // Sync responses which have been received but not yet processed
 	httpClient      *http.Client
+	limiter         *limiter // shared by every request the client sends
 	filterID        string
 	NextBatchStorer NextBatchStorer
+	directMutex     sync.Mutex
+	directRooms     map[string]string // user ID => direct room ID
+	directLoaded    bool              // true once m.direct has been loaded into directRooms
+	crypto          *olmMachine       // set by EnableEncryption
 }
 
 func (cli *Client) buildURL(urlPath ...string) string {
@@ -119,6 +138,152 @@ func (cli *Client) JoinRoom(roomIDorAlias, serverName, invitingUserID string) (s
 	return joinRoomResponse.RoomID, nil
 }
 
+// LeaveRoom leaves the room with the given ID.
+func (cli *Client) LeaveRoom(roomID string) error {
+	_, err := cli.sendJSON("POST", cli.buildURL("rooms", roomID, "leave"), struct{}{})
+	return err
+}
+
+// CreateDirectRoom creates a private room for talking to the given user, and invites them to it.
+// Returns the room ID.
+func (cli *Client) CreateDirectRoom(userID string) (string, error) {
+	content := struct {
+		Invite   []string `json:"invite"`
+		IsDirect bool     `json:"is_direct"`
+		Preset   string   `json:"preset"`
+	}{[]string{userID}, true, "trusted_private_chat"}
+
+	resBytes, err := cli.sendJSON("POST", cli.buildURL("createRoom"), content)
+	if err != nil {
+		return "", err
+	}
+	var createRoomResponse createRoomHTTPResponse
+	if err = json.Unmarshal(resBytes, &createRoomResponse); err != nil {
+		return "", err
+	}
+	return createRoomResponse.RoomID, nil
+}
+
+// SendDirect sends a message event with the content into a direct room with the user, creating
+// one with CreateDirectRoom if the client has no direct room with them yet or can no longer send
+// into it, e.g. because the user has left. Direct rooms are looked up in, and recorded to, the
+// client's m.direct account data so that they survive restarts. Returns the ID of the room, which
+// is also returned if the room was made but sending into it failed.
+func (cli *Client) SendDirect(userID string, content interface{}) (string, error) {
+	roomID := cli.directRoom(userID)
+	if roomID != "" {
+		if _, err := cli.SendMessageEvent(roomID, "m.room.message", content); err == nil {
+			return roomID, nil
+		}
+	}
+	roomID, err := cli.CreateDirectRoom(userID)
+	if err != nil {
+		return "", err
+	}
+	cli.directMutex.Lock()
+	cli.directRooms[userID] = roomID
+	cli.directMutex.Unlock()
+	if err = cli.recordDirectRoom(userID, roomID); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"user_id": userID,
+			"room_id": roomID,
+		}).Warn("Failed to record the direct room in m.direct")
+	}
+	_, err = cli.SendMessageEvent(roomID, "m.room.message", content)
+	return roomID, err
+}
+
+// directRoom returns the ID of the newest direct room with the user, or "" if there is none. The
+// client's m.direct account data is loaded the first time, and again until loading it succeeds.
+func (cli *Client) directRoom(userID string) string {
+	cli.directMutex.Lock()
+	defer cli.directMutex.Unlock()
+	if !cli.directLoaded {
+		direct, err := cli.GetAccountData("m.direct")
+		if err != nil {
+			log.WithError(err).Warn("Failed to load m.direct")
+			return cli.directRooms[userID]
+		}
+		for u, roomIDs := range decodeDirect(direct) {
+			if _, ok := cli.directRooms[u]; !ok && len(roomIDs) > 0 {
+				cli.directRooms[u] = roomIDs[len(roomIDs)-1]
+			}
+		}
+		cli.directLoaded = true
+	}
+	return cli.directRooms[userID]
+}
+
+// recordDirectRoom adds the room to the user's direct rooms in the client's m.direct account data.
+// The account data is fetched afresh so that rooms recorded by other clients of the user are kept.
+func (cli *Client) recordDirectRoom(userID, roomID string) error {
+	direct, err := cli.GetAccountData("m.direct")
+	if err != nil {
+		return err
+	}
+	rooms := decodeDirect(direct)
+	rooms[userID] = append(rooms[userID], roomID)
+	return cli.SetAccountData("m.direct", rooms)
+}
+
+// decodeDirect decodes m.direct content, which maps user IDs to lists of room IDs. Content which
+// isn't in that shape decodes as no rooms.
+func decodeDirect(content json.RawMessage) map[string][]string {
+	rooms := make(map[string][]string)
+	if len(content) > 0 {
+		json.Unmarshal(content, &rooms)
+	}
+	return rooms
+}
+
+// GetAccountData returns the content of the client's global account data of the given type, or
+// nil if the client has none of that type.
+func (cli *Client) GetAccountData(eventType string) (json.RawMessage, error) {
+	res, err := cli.httpClient.Get(cli.buildURL("user", cli.UserID, "account_data", eventType))
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == 404 {
+		return nil, nil
+	}
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("Account data request returned HTTP %d", res.StatusCode)
+	}
+	var content json.RawMessage
+	if err := json.NewDecoder(res.Body).Decode(&content); err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+// SetAccountData replaces the content of the client's global account data of the given type.
+func (cli *Client) SetAccountData(eventType string, content interface{}) error {
+	_, err := cli.sendJSON("PUT", cli.buildURL("user", cli.UserID, "account_data", eventType), content)
+	return err
+}
+
+// JoinedRooms returns the IDs of the rooms the user is currently joined to.
+func (cli *Client) JoinedRooms() ([]string, error) {
+	res, err := cli.httpClient.Get(cli.buildURL("joined_rooms"))
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("Joined rooms request returned HTTP %d", res.StatusCode)
+	}
+	var joinedRoomsResponse joinedRoomsHTTPResponse
+	if err := json.NewDecoder(res.Body).Decode(&joinedRoomsResponse); err != nil {
+		return nil, err
+	}
+	return joinedRoomsResponse.JoinedRooms, nil
+}
+
 // SetDisplayName sets the user's profile display name
 func (cli *Client) SetDisplayName(displayName string) error {
 	urlPath := cli.buildURL("profile", cli.UserID, "displayname")
@@ -131,9 +296,21 @@ func (cli *Client) SetDisplayName(displayName string) error {
 
 // SendMessageEvent sends a message event into a room, returning the event_id on success.
 // contentJSON should be a pointer to something that can be encoded as JSON using json.Marshal.
+// If the client has encryption enabled and the room is encrypted, the event is sent encrypted.
 func (cli *Client) SendMessageEvent(roomID string, eventType string, contentJSON interface{}) (string, error) {
-	txnID := "go" + strconv.FormatInt(time.Now().UnixNano(), 10)
-	urlPath := cli.buildURL("rooms", roomID, "send", eventType, txnID)
+	if cli.crypto != nil {
+		encrypted, err := cli.crypto.roomEncrypted(roomID)
+		if err != nil {
+			return "", err
+		}
+		if encrypted {
+			if contentJSON, err = cli.crypto.encrypt(roomID, eventType, contentJSON); err != nil {
+				return "", err
+			}
+			eventType = "m.room.encrypted"
+		}
+	}
+	urlPath := cli.buildURL("rooms", roomID, "send", eventType, newTxnID())
 	resBytes, err := cli.sendJSON("PUT", urlPath, contentJSON)
 	if err != nil {
 		return "", err
@@ -145,25 +322,68 @@ func (cli *Client) SendMessageEvent(roomID string, eventType string, contentJSON
 	return sendEventResponse.EventID, nil
 }
 
+// newTxnID returns a new transaction ID for a request.
+func newTxnID() string {
+	return "go" + strconv.FormatInt(time.Now().UnixNano(), 10) + "." + strconv.FormatInt(atomic.AddInt64(&txnCounter, 1), 10)
+}
+
 // SendText sends an m.room.message event into the given room with a msgtype of m.text
 func (cli *Client) SendText(roomID, text string) (string, error) {
 	return cli.SendMessageEvent(roomID, "m.room.message",
 		TextMessage{"m.text", text})
 }
 
+// SendHTML sends an m.room.message event into the given room with a msgtype of m.text, formatted as
+// the HTML. Clients which can't show HTML show it as plain text.
+func (cli *Client) SendHTML(roomID, htmlText string) (string, error) {
+	return cli.SendMessageEvent(roomID, "m.room.message",
+		GetHTMLMessage("m.text", htmlText))
+}
+
+// SendImage sends an m.image message into the room, showing the image at the MXC URI. body
+// describes the image, for clients which can't show it.
+func (cli *Client) SendImage(roomID, body, url string, info ImageInfo) (string, error) {
+	return cli.SendMessageEvent(roomID, "m.room.message",
+		ImageMessage{"m.image", body, url, info})
+}
+
+// SendFile sends an m.file message into the room, linking to the file at the MXC URI. body is
+// usually the file's name.
+func (cli *Client) SendFile(roomID, body, url string, info FileInfo) (string, error) {
+	return cli.SendMessageEvent(roomID, "m.room.message",
+		FileMessage{"m.file", body, url, info})
+}
+
+// SendSticker sends an m.sticker event into the room, showing the image at the MXC URI. body
+// describes the sticker, for clients which can't show it.
+func (cli *Client) SendSticker(roomID, body, url string, info ImageInfo) (string, error) {
+	sticker := StickerMessage{body, url, info}
+	return cli.SendMessageEvent(roomID, sticker.EventType(), sticker)
+}
+
+// SendReaction reacts to the event with the key, e.g. "👍". Returns the ID of the reaction event.
+func (cli *Client) SendReaction(roomID, eventID, key string) (string, error) {
+	reaction := ReactionMessage{Relation{RelType: "m.annotation", EventID: eventID, Key: key}}
+	return cli.SendMessageEvent(roomID, reaction.EventType(), reaction)
+}
+
 // UploadLink uploads an HTTP URL and then returns an MXC URI.
 func (cli *Client) UploadLink(link string) (string, error) {
-	res, err := http.Get(link)
+	res, err := cli.httpClient.Get(link)
 	if res != nil {
 		defer res.Body.Close()
 	}
 	if err != nil {
 		return "", err
 	}
+	if res.StatusCode != 200 {
+		return "", fmt.Errorf("Fetching %s returned HTTP %d", link, res.StatusCode)
+	}
 	return cli.UploadToContentRepo(res.Body, res.Header.Get("Content-Type"), res.ContentLength)
 }
 
 // UploadToContentRepo uploads the given bytes to the content repository and returns an MXC URI.
+// contentLength is -1 if it isn't known, in which case the content is sent in chunks.
 func (cli *Client) UploadToContentRepo(content io.Reader, contentType string, contentLength int64) (string, error) {
 	req, err := http.NewRequest("POST", cli.buildBaseURL("_matrix/media/r0/upload"), content)
 	if err != nil {
@@ -183,7 +403,11 @@ func (cli *Client) UploadToContentRepo(content io.Reader, contentType string, co
 		return "", err
 	}
 	if res.StatusCode != 200 {
-		return "", fmt.Errorf("Upload request returned HTTP %d", res.StatusCode)
+		contents, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return "", errors.HTTPError{
+			Code:    res.StatusCode,
+			Message: "Upload request returned HTTP " + strconv.Itoa(res.StatusCode) + ": " + string(contents),
+		}
 	}
 	m := struct {
 		ContentURI string `json:"content_uri"`
@@ -218,31 +442,33 @@ func (cli *Client) Sync() {
 
 	logger.WithField("next_batch", nextToken).Print("Starting sync")
 
+	if cli.crypto != nil {
+		if err = cli.crypto.uploadKeys(-1); err != nil {
+			logger.WithError(err).Warn("Failed to upload encryption keys")
+		}
+	}
+
 	channel := make(chan syncHTTPResponse, 5)
+	var failures syncFailures
 
 	go func() {
 		for response := range channel {
 			cli.Worker.onSyncHTTPResponse(response)
+			cli.pending.Done()
 		}
 	}()
 	defer close(channel)
 
 	for {
 		// Do a /sync
-		syncBytes, err := cli.doSync(30000, nextToken)
+		syncResponse, err := cli.doSync(30000, nextToken)
 		if err != nil {
 			logger.WithError(err).Warn("doSync failed")
+			failures.failed(cli.UserID, err)
 			time.Sleep(5 * time.Second)
 			continue
 		}
-
-		// Decode sync response into syncHTTPResponse
-		var syncResponse syncHTTPResponse
-		if err = json.Unmarshal(syncBytes, &syncResponse); err != nil {
-			logger.WithError(err).Warn("Failed to decode sync data")
-			time.Sleep(5 * time.Second)
-			continue
-		}
+		failures.succeeded(cli.UserID)
 
 		//  Check that the syncing state hasn't changed
 		// Either because we've stopped syncing or another sync has been started.
@@ -252,7 +478,7 @@ func (cli *Client) Sync() {
 			return
 		}
 
-		processResponse := cli.shouldProcessResponse(nextToken, &syncResponse)
+		processResponse := cli.shouldProcessResponse(nextToken, syncResponse)
 		nextToken = syncResponse.NextBatch
 		logger.WithField("next_batch", nextToken).Print("Received sync response")
 
@@ -261,13 +487,47 @@ func (cli *Client) Sync() {
 		// a malformed/buggy event which keeps making us panic.
 		cli.NextBatchStorer.Save(cli.UserID, nextToken)
 
+		if !processResponse && cli.crypto != nil {
+			// Keys sent to the device are only sent once, so are processed even if the rooms
+			// aren't.
+			syncResponse.Rooms.Join = nil
+			syncResponse.Rooms.Invite = nil
+			processResponse = true
+		}
 		if processResponse {
 			// Update client state
-			channel <- syncResponse
+			cli.pending.Add(1)
+			channel <- *syncResponse
 		}
 	}
 }
 
+// syncFailures is a run of failed syncs, which the operators are alerted to once it has gone on
+// for syncFailureAlertAfter.
+type syncFailures struct {
+	since   time.Time // when the run started, or zero if the last sync succeeded
+	alerted bool
+}
+
+// failed records that a sync of the user failed with the error.
+func (f *syncFailures) failed(userID string, err error) {
+	if f.since.IsZero() {
+		f.since = time.Now()
+	}
+	if !f.alerted && time.Since(f.since) > syncFailureAlertAfter {
+		ops.Alert("%s has been failing to sync since %s: %s", userID, f.since.Format(time.RFC3339), err)
+		f.alerted = true
+	}
+}
+
+// succeeded records that a sync of the user succeeded, ending the run.
+func (f *syncFailures) succeeded(userID string) {
+	if f.alerted {
+		ops.Alert("%s is syncing again after failing since %s", userID, f.since.Format(time.RFC3339))
+	}
+	*f = syncFailures{}
+}
+
 // shouldProcessResponse returns true if the response should be processed. May modify the response to remove
 // stuff that shouldn't be processed.
 func (cli *Client) shouldProcessResponse(tokenOnSync string, syncResponse *syncHTTPResponse) bool {
@@ -329,6 +589,14 @@ func (cli *Client) StopSync() {
 	cli.incrementSyncingID()
 }
 
+// WaitForPendingEvents blocks until every sync response which has been received has been
+// processed, including any messages sent by event listeners. Call StopSync first, else more
+// responses may arrive whilst waiting. Events which are received but not processed would be lost,
+// as the next_batch token is saved before processing.
+func (cli *Client) WaitForPendingEvents() {
+	cli.pending.Wait()
+}
+
 // This should only be called by the worker goroutine
 func (cli *Client) getOrCreateRoom(roomID string) *Room {
 	room := cli.Rooms[roomID]
@@ -339,21 +607,49 @@ func (cli *Client) getOrCreateRoom(roomID string) *Room {
 	return room
 }
 
+// sendJSON sends the request once the client's limiter allows it. If the homeserver rate limits
+// it, it is sent again once the homeserver says to, up to maxRateLimitRetries times.
 func (cli *Client) sendJSON(method string, httpURL string, contentJSON interface{}) ([]byte, error) {
 	jsonStr, err := json.Marshal(contentJSON)
 	if err != nil {
 		return nil, err
 	}
-	req, err := http.NewRequest(method, httpURL, bytes.NewBuffer(jsonStr))
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Set("Content-Type", "application/json")
 	logger := log.WithFields(log.Fields{
 		"method": method,
 		"url":    httpURL,
 		"json":   string(jsonStr),
 	})
+	for attempt := 0; ; attempt++ {
+		wait, ok := cli.limiter.reserve(time.Now(), maxSendWait)
+		if !ok {
+			logger.WithField("wait", wait).Warn("Not sending JSON request: rate limited")
+			return nil, errors.HTTPError{
+				Code:    429,
+				Message: "Not sending " + method + " JSON: rate limited for another " + wait.String(),
+			}
+		}
+		time.Sleep(wait)
+		contents, limitedFor, err := cli.doJSON(method, httpURL, jsonStr, logger)
+		if limitedFor == 0 {
+			return contents, err
+		}
+		atomic.AddInt64(&rateLimited, 1)
+		cli.limiter.pause(time.Now(), limitedFor)
+		if attempt == maxRateLimitRetries {
+			return nil, err
+		}
+		logger.WithField("retry_after", limitedFor).Warn("Rate limited by the homeserver: sending again")
+	}
+}
+
+// doJSON sends the request. If the homeserver rate limits it, limitedFor is how long it says to
+// wait.
+func (cli *Client) doJSON(method, httpURL string, jsonStr []byte, logger *log.Entry) (contents []byte, limitedFor time.Duration, err error) {
+	req, err := http.NewRequest(method, httpURL, bytes.NewBuffer(jsonStr))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
 	logger.Print("Sending JSON request")
 	res, err := cli.httpClient.Do(req)
 	if res != nil {
@@ -361,24 +657,27 @@ func (cli *Client) sendJSON(method string, httpURL string, contentJSON interface
 	}
 	if err != nil {
 		logger.WithError(err).Warn("Failed to send JSON request")
-		return nil, err
+		return nil, 0, err
 	}
-	contents, err := ioutil.ReadAll(res.Body)
+	contents, err = ioutil.ReadAll(res.Body)
 	if res.StatusCode >= 300 {
 		logger.WithFields(log.Fields{
 			"code": res.StatusCode,
 			"body": string(contents),
 		}).Warn("Failed to send JSON request")
-		return nil, errors.HTTPError{
+		if res.StatusCode == 429 {
+			limitedFor = retryAfter(res.Header.Get("Retry-After"), contents)
+		}
+		return nil, limitedFor, errors.HTTPError{
 			Code:    res.StatusCode,
 			Message: "Failed to " + method + " JSON: HTTP " + strconv.Itoa(res.StatusCode),
 		}
 	}
 	if err != nil {
 		logger.WithError(err).Warn("Failed to read response")
-		return nil, err
+		return nil, 0, err
 	}
-	return contents, nil
+	return contents, 0, nil
 }
 
 func (cli *Client) createFilter() (string, error) {
@@ -394,7 +693,9 @@ func (cli *Client) createFilter() (string, error) {
 	return filterResponse.FilterID, nil
 }
 
-func (cli *Client) doSync(timeout int, since string) ([]byte, error) {
+// doSync does a /sync, decoding the response as it is read and dropping the events the Worker
+// doesn't want.
+func (cli *Client) doSync(timeout int, since string) (*syncHTTPResponse, error) {
 	query := map[string]string{
 		"timeout": strconv.Itoa(timeout),
 	}
@@ -410,16 +711,23 @@ func (cli *Client) doSync(timeout int, since string) ([]byte, error) {
 		"timeout": timeout,
 		"user_id": cli.UserID,
 	}).Print("Syncing")
-	res, err := http.Get(urlPath)
+	res, err := cli.httpClient.Get(urlPath)
 	if err != nil {
 		return nil, err
 	}
 	defer res.Body.Close()
-	contents, err := ioutil.ReadAll(res.Body)
+	if res.StatusCode != 200 {
+		contents, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return nil, errors.HTTPError{
+			Code:    res.StatusCode,
+			Message: "Failed to /sync: HTTP " + strconv.Itoa(res.StatusCode) + ": " + string(contents),
+		}
+	}
+	syncResponse, err := decodeSync(res.Body, cli.Worker.wants)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("Failed to decode sync data: %s", err)
 	}
-	return contents, nil
+	return syncResponse, nil
 }
 
 // NewClient creates a new Matrix Client ready for syncing
@@ -436,7 +744,9 @@ func NewClient(homeserverURL *url.URL, accessToken string, userID string) *Clien
 	// remember the token across restarts. In practice, a database backend should be used.
 	cli.NextBatchStorer = noopNextBatchStore{}
 	cli.Rooms = make(map[string]*Room)
-	cli.httpClient = &http.Client{}
+	cli.directRooms = make(map[string]string)
+	cli.httpClient = httpclient.New(clientTimeout)
+	cli.limiter = newLimiter(atomic.LoadInt64(&sendRate), atomic.LoadInt64(&sendBurst))
 
 	return &cli
 }
@@ -0,0 +1,214 @@
+package matrix
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/matrix-org/go-neb/errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func newTestClient(t *testing.T, handler http.HandlerFunc) (*Client, func()) {
+	srv := httptest.NewServer(handler)
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewClient(u, "token", "@neb:x"), srv.Close
+}
+
+func TestUploadToContentRepo(t *testing.T) {
+	cli, done := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		switch {
+		case req.URL.Path != "/_matrix/media/r0/upload" || req.URL.Query().Get("access_token") != "token":
+			w.WriteHeader(404)
+		case string(body) == "too big":
+			w.WriteHeader(413)
+			w.Write([]byte(`{"errcode":"M_TOO_LARGE"}`))
+		case req.Header.Get("Content-Type") == "text/plain" && string(body) == "hello":
+			w.Write([]byte(`{"content_uri":"mxc://x/abc"}`))
+		default:
+			w.WriteHeader(400)
+		}
+	})
+	defer done()
+
+	mxc, err := cli.UploadToContentRepo(strings.NewReader("hello"), "text/plain", 5)
+	if err != nil || mxc != "mxc://x/abc" {
+		t.Errorf("UploadToContentRepo => want mxc://x/abc, got %q %v", mxc, err)
+	}
+	mxc, err = cli.UploadToContentRepo(strings.NewReader("hello"), "text/plain", -1)
+	if err != nil || mxc != "mxc://x/abc" {
+		t.Errorf("UploadToContentRepo of unknown length => want mxc://x/abc, got %q %v", mxc, err)
+	}
+	_, err = cli.UploadToContentRepo(strings.NewReader("too big"), "text/plain", 7)
+	if httpErr, ok := err.(errors.HTTPError); !ok || httpErr.Code != 413 {
+		t.Errorf("UploadToContentRepo rejected by the server => want an HTTP 413 error, got %v", err)
+	}
+}
+
+func TestSendFile(t *testing.T) {
+	var content map[string]interface{}
+	cli, done := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		if !strings.HasPrefix(req.URL.Path, "/_matrix/client/r0/rooms/!r:x/send/m.room.message/") {
+			w.WriteHeader(404)
+			return
+		}
+		json.NewDecoder(req.Body).Decode(&content)
+		w.Write([]byte(`{"event_id":"$1"}`))
+	})
+	defer done()
+
+	eventID, err := cli.SendFile("!r:x", "notes.txt", "mxc://x/abc", FileInfo{Mimetype: "text/plain", Size: 5})
+	if err != nil || eventID != "$1" {
+		t.Fatalf("SendFile => want event $1, got %q %v", eventID, err)
+	}
+	want := map[string]interface{}{
+		"msgtype": "m.file",
+		"body":    "notes.txt",
+		"url":     "mxc://x/abc",
+		"info":    map[string]interface{}{"mimetype": "text/plain", "size": float64(5)},
+	}
+	got, _ := json.Marshal(content)
+	wantJSON, _ := json.Marshal(want)
+	if string(got) != string(wantJSON) {
+		t.Errorf("SendFile content => want %s, got %s", wantJSON, got)
+	}
+}
+
+func TestSendSticker(t *testing.T) {
+	var content map[string]interface{}
+	cli, done := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		if !strings.HasPrefix(req.URL.Path, "/_matrix/client/r0/rooms/!r:x/send/m.sticker/") {
+			w.WriteHeader(404)
+			return
+		}
+		json.NewDecoder(req.Body).Decode(&content)
+		w.Write([]byte(`{"event_id":"$1"}`))
+	})
+	defer done()
+
+	eventID, err := cli.SendSticker("!r:x", "thumbs up", "mxc://x/abc", ImageInfo{Height: 200, Width: 300, Mimetype: "image/gif", Size: 1024})
+	if err != nil || eventID != "$1" {
+		t.Fatalf("SendSticker => want event $1, got %q %v", eventID, err)
+	}
+	want := map[string]interface{}{
+		"body": "thumbs up",
+		"url":  "mxc://x/abc",
+		"info": map[string]interface{}{"h": float64(200), "w": float64(300), "mimetype": "image/gif", "size": float64(1024)},
+	}
+	got, _ := json.Marshal(content)
+	wantJSON, _ := json.Marshal(want)
+	if string(got) != string(wantJSON) {
+		t.Errorf("SendSticker content => want %s, got %s", wantJSON, got)
+	}
+}
+
+func TestSendDirect(t *testing.T) {
+	var mu sync.Mutex
+	created := 0
+	left := map[string]bool{}
+	var sentTo []string
+	cli, done := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case req.URL.Path == "/_matrix/client/r0/createRoom":
+			created++
+			fmt.Fprintf(w, `{"room_id":"!dm%d:x"}`, created)
+		case strings.HasPrefix(req.URL.Path, "/_matrix/client/r0/rooms/"):
+			roomID := strings.Split(req.URL.Path, "/")[5]
+			if left[roomID] {
+				w.WriteHeader(403)
+				w.Write([]byte(`{"errcode":"M_FORBIDDEN"}`))
+				return
+			}
+			sentTo = append(sentTo, roomID)
+			w.Write([]byte(`{"event_id":"$1"}`))
+		default:
+			w.WriteHeader(404)
+		}
+	})
+	defer done()
+
+	for i := 0; i < 2; i++ {
+		roomID, err := cli.SendDirect("@u:x", TextMessage{"m.notice", "hi"})
+		if err != nil || roomID != "!dm1:x" {
+			t.Errorf("SendDirect #%d => want !dm1:x, got %q %v", i, roomID, err)
+		}
+	}
+	mu.Lock()
+	left["!dm1:x"] = true
+	mu.Unlock()
+	roomID, err := cli.SendDirect("@u:x", TextMessage{"m.notice", "hi"})
+	if err != nil || roomID != "!dm2:x" {
+		t.Errorf("SendDirect after the room was left => want a new room !dm2:x, got %q %v", roomID, err)
+	}
+	if want := "!dm1:x !dm1:x !dm2:x"; strings.Join(sentTo, " ") != want {
+		t.Errorf("SendDirect sent to %v, want %s", sentTo, want)
+	}
+}
+
+// directHomeserver is a homeserver which keeps the m.direct account data of @neb:x.
+type directHomeserver struct {
+	sync.Mutex
+	direct  string   // the m.direct account data
+	created int      // how many rooms were created
+	sentTo  []string // the rooms messages were sent to
+}
+
+func (hs *directHomeserver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	hs.Lock()
+	defer hs.Unlock()
+	switch {
+	case req.URL.Path == "/_matrix/client/r0/user/@neb:x/account_data/m.direct" && req.Method == "GET":
+		w.Write([]byte(hs.direct))
+	case req.URL.Path == "/_matrix/client/r0/user/@neb:x/account_data/m.direct" && req.Method == "PUT":
+		body, _ := ioutil.ReadAll(req.Body)
+		hs.direct = string(body)
+		w.Write([]byte(`{}`))
+	case req.URL.Path == "/_matrix/client/r0/createRoom":
+		hs.created++
+		fmt.Fprintf(w, `{"room_id":"!dm%d:x"}`, hs.created)
+	case strings.HasPrefix(req.URL.Path, "/_matrix/client/r0/rooms/"):
+		hs.sentTo = append(hs.sentTo, strings.Split(req.URL.Path, "/")[5])
+		w.Write([]byte(`{"event_id":"$1"}`))
+	default:
+		w.WriteHeader(404)
+	}
+}
+
+func TestSendDirectUsesMDirect(t *testing.T) {
+	hs := &directHomeserver{direct: `{"@other:x":["!other:x"],"@u:x":["!old:x","!known:x"]}`}
+	cli, done := newTestClient(t, hs.ServeHTTP)
+	defer done()
+
+	if roomID, err := cli.SendDirect("@u:x", TextMessage{"m.notice", "hi"}); err != nil || roomID != "!known:x" {
+		t.Errorf("SendDirect with a room in m.direct => want !known:x, got %q %v", roomID, err)
+	}
+	if roomID, err := cli.SendDirect("@new:x", TextMessage{"m.notice", "hi"}); err != nil || roomID != "!dm1:x" {
+		t.Errorf("SendDirect without a room in m.direct => want a new room !dm1:x, got %q %v", roomID, err)
+	}
+	hs.Lock()
+	want := map[string][]string{"@other:x": {"!other:x"}, "@u:x": {"!old:x", "!known:x"}, "@new:x": {"!dm1:x"}}
+	if got := decodeDirect(json.RawMessage(hs.direct)); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("m.direct after creating a room => want %v, got %v", want, got)
+	}
+	hs.Unlock()
+
+	// A restarted client finds the room it made before.
+	cli2, done2 := newTestClient(t, hs.ServeHTTP)
+	defer done2()
+	if roomID, err := cli2.SendDirect("@new:x", TextMessage{"m.notice", "hi"}); err != nil || roomID != "!dm1:x" {
+		t.Errorf("SendDirect from a restarted client => want !dm1:x, got %q %v", roomID, err)
+	}
+	if want := "!known:x !dm1:x !dm1:x"; strings.Join(hs.sentTo, " ") != want || hs.created != 1 {
+		t.Errorf("SendDirect sent to %v and made %d rooms, want %s and 1", hs.sentTo, hs.created, want)
+	}
+}
@@ -8,33 +8,47 @@ type joinRoomHTTPResponse struct {
 	RoomID string `json:"room_id"`
 }
 
+type createRoomHTTPResponse struct {
+	RoomID string `json:"room_id"`
+}
+
+type joinedRoomsHTTPResponse struct {
+	JoinedRooms []string `json:"joined_rooms"`
+}
+
 type sendEventHTTPResponse struct {
 	EventID string `json:"event_id"`
 }
 
 type syncHTTPResponse struct {
-	NextBatch   string `json:"next_batch"`
-	AccountData struct {
+	NextBatch string `json:"next_batch"`
+	Rooms     struct {
+		Join   map[string]joinedRoomHTTPResponse  `json:"join"`
+		Invite map[string]invitedRoomHTTPResponse `json:"invite"`
+	} `json:"rooms"`
+	ToDevice struct {
 		Events []Event `json:"events"`
-	} `json:"account_data"`
-	Presence struct {
+	} `json:"to_device"`
+	DeviceLists struct {
+		Changed []string `json:"changed"`
+		Left    []string `json:"left"`
+	} `json:"device_lists"`
+	DeviceOneTimeKeysCount map[string]int `json:"device_one_time_keys_count"`
+}
+
+type joinedRoomHTTPResponse struct {
+	State struct {
 		Events []Event `json:"events"`
-	} `json:"presence"`
-	Rooms struct {
-		Join map[string]struct {
-			State struct {
-				Events []Event `json:"events"`
-			} `json:"state"`
-			Timeline struct {
-				Events    []Event `json:"events"`
-				Limited   bool    `json:"limited"`
-				PrevBatch string  `json:"prev_batch"`
-			} `json:"timeline"`
-		} `json:"join"`
-		Invite map[string]struct {
-			State struct {
-				Events []Event
-			} `json:"invite_state"`
-		} `json:"invite"`
-	} `json:"rooms"`
+	} `json:"state"`
+	Timeline struct {
+		Events    []Event `json:"events"`
+		Limited   bool    `json:"limited"`
+		PrevBatch string  `json:"prev_batch"`
+	} `json:"timeline"`
+}
+
+type invitedRoomHTTPResponse struct {
+	State struct {
+		Events []Event `json:"events"`
+	} `json:"invite_state"`
 }
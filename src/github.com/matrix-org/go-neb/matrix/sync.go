@@ -0,0 +1,192 @@
+package matrix
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// decodeSync decodes a /sync response as it is read, rather than reading it all into memory first.
+// Only the parts of the response the Worker uses are kept, and of those only the events whose type
+// is wanted: each event is held in memory on its own while its type is checked, so a response with
+// thousands of events no one listens for never needs more than one of them at a time.
+func decodeSync(r io.Reader, wanted func(eventType string) bool) (*syncHTTPResponse, error) {
+	dec := json.NewDecoder(r)
+	var res syncHTTPResponse
+	err := decodeObject(dec, func(key string) error {
+		switch key {
+		case "next_batch":
+			return dec.Decode(&res.NextBatch)
+		case "rooms":
+			return decodeObject(dec, func(key string) error {
+				switch key {
+				case "join":
+					res.Rooms.Join = make(map[string]joinedRoomHTTPResponse)
+					return decodeObject(dec, func(roomID string) error {
+						room, err := decodeJoinedRoom(dec, wanted)
+						res.Rooms.Join[roomID] = room
+						return err
+					})
+				case "invite":
+					res.Rooms.Invite = make(map[string]invitedRoomHTTPResponse)
+					return decodeObject(dec, func(roomID string) error {
+						var room invitedRoomHTTPResponse
+						err := decodeObject(dec, func(key string) error {
+							if key == "invite_state" {
+								return decodeEventList(dec, wanted, &room.State.Events)
+							}
+							return skipValue(dec)
+						})
+						res.Rooms.Invite[roomID] = room
+						return err
+					})
+				}
+				return skipValue(dec)
+			})
+		case "to_device":
+			// Only encrypted events are sent to devices: they share the keys of encrypted rooms.
+			return decodeEventList(dec, func(eventType string) bool {
+				return eventType == "m.room.encrypted"
+			}, &res.ToDevice.Events)
+		case "device_lists":
+			return dec.Decode(&res.DeviceLists)
+		case "device_one_time_keys_count":
+			return dec.Decode(&res.DeviceOneTimeKeysCount)
+		}
+		return skipValue(dec)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func decodeJoinedRoom(dec *json.Decoder, wanted func(string) bool) (room joinedRoomHTTPResponse, err error) {
+	err = decodeObject(dec, func(key string) error {
+		switch key {
+		case "state":
+			return decodeEventList(dec, wanted, &room.State.Events)
+		case "timeline":
+			return decodeObject(dec, func(key string) error {
+				switch key {
+				case "events":
+					return decodeEvents(dec, wanted, &room.Timeline.Events)
+				case "limited":
+					return dec.Decode(&room.Timeline.Limited)
+				case "prev_batch":
+					return dec.Decode(&room.Timeline.PrevBatch)
+				}
+				return skipValue(dec)
+			})
+		}
+		return skipValue(dec)
+	})
+	return
+}
+
+// decodeEventList decodes an object of the form {"events": [...]}.
+func decodeEventList(dec *json.Decoder, wanted func(string) bool, events *[]Event) error {
+	return decodeObject(dec, func(key string) error {
+		if key == "events" {
+			return decodeEvents(dec, wanted, events)
+		}
+		return skipValue(dec)
+	})
+}
+
+// decodeEvents decodes an array of events, appending the wanted ones to events.
+func decodeEvents(dec *json.Decoder, wanted func(string) bool, events *[]Event) error {
+	return decodeArray(dec, func() error {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return err
+		}
+		var header struct {
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal(raw, &header); err != nil {
+			return err
+		}
+		if !wanted(header.Type) {
+			return nil
+		}
+		var event Event
+		if err := json.Unmarshal(raw, &event); err != nil {
+			return err
+		}
+		*events = append(*events, event)
+		return nil
+	})
+}
+
+// decodeObject reads a JSON object, calling fn for each key with the decoder positioned at its
+// value. fn must read the whole value. A null is treated as an empty object.
+func decodeObject(dec *json.Decoder, fn func(key string) error) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok == nil {
+		return nil
+	}
+	if tok != json.Delim('{') {
+		return fmt.Errorf("sync: expected an object, got %v", tok)
+	}
+	for dec.More() {
+		tok, err = dec.Token()
+		if err != nil {
+			return err
+		}
+		key, ok := tok.(string)
+		if !ok {
+			return fmt.Errorf("sync: expected an object key, got %v", tok)
+		}
+		if err = fn(key); err != nil {
+			return err
+		}
+	}
+	_, err = dec.Token() // the closing '}'
+	return err
+}
+
+// decodeArray reads a JSON array, calling fn with the decoder positioned at each element. fn must
+// read the whole element. A null is treated as an empty array.
+func decodeArray(dec *json.Decoder, fn func() error) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok == nil {
+		return nil
+	}
+	if tok != json.Delim('[') {
+		return fmt.Errorf("sync: expected an array, got %v", tok)
+	}
+	for dec.More() {
+		if err = fn(); err != nil {
+			return err
+		}
+	}
+	_, err = dec.Token() // the closing ']'
+	return err
+}
+
+// skipValue reads past the next JSON value without keeping any of it.
+func skipValue(dec *json.Decoder) error {
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package matrix
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const syncJSON = `{
+	"next_batch": "s72595_4483_1934",
+	"presence": {"events": [{"type": "m.presence", "sender": "@alice:x", "content": {"presence": "online"}}]},
+	"account_data": {"events": [{"type": "m.push_rules", "content": {"global": {"content": [{"actions": []}]}}}]},
+	"rooms": {
+		"join": {
+			"!a:x": {
+				"state": {"events": [
+					{"type": "m.room.member", "state_key": "@neb:x", "sender": "@neb:x", "content": {"membership": "join"}},
+					{"type": "m.room.power_levels", "state_key": "", "content": {"users": {"@alice:x": 100}}}
+				]},
+				"timeline": {
+					"events": [
+						{"type": "m.room.message", "event_id": "$1", "sender": "@alice:x", "content": {"body": "!echo hi", "msgtype": "m.text"}},
+						{"type": "m.room.redaction", "event_id": "$2", "redacts": "$0", "content": {}}
+					],
+					"limited": true,
+					"prev_batch": "t34-23535_0_0"
+				},
+				"ephemeral": {"events": [{"type": "m.typing", "content": {"user_ids": ["@alice:x"]}}]},
+				"unread_notifications": {"highlight_count": 0, "notification_count": 1}
+			}
+		},
+		"invite": {
+			"!b:x": {"invite_state": {"events": [
+				{"type": "m.room.name", "state_key": "", "content": {"name": "B"}},
+				{"type": "m.room.member", "state_key": "@neb:x", "sender": "@bob:x", "content": {"membership": "invite"}}
+			]}}
+		},
+		"leave": {"!c:x": {"timeline": {"events": [{"type": "m.room.message", "content": {}}]}}}
+	}
+}`
+
+func TestDecodeSync(t *testing.T) {
+	wanted := func(eventType string) bool {
+		return eventType == "m.room.member" || eventType == "m.room.message"
+	}
+	res, err := decodeSync(strings.NewReader(syncJSON), wanted)
+	if err != nil {
+		t.Fatalf("decodeSync => want no error, got %s", err)
+	}
+	if res.NextBatch != "s72595_4483_1934" {
+		t.Errorf("NextBatch => want s72595_4483_1934, got %s", res.NextBatch)
+	}
+
+	room, ok := res.Rooms.Join["!a:x"]
+	if !ok || len(res.Rooms.Join) != 1 {
+		t.Fatalf("Rooms.Join => want only !a:x, got %v", res.Rooms.Join)
+	}
+	checkJoinedRoom(t, room)
+
+	invite := res.Rooms.Invite["!b:x"]
+	if len(invite.State.Events) != 1 || invite.State.Events[0].Content["membership"] != "invite" {
+		t.Errorf("Invite state => want only the invite, got %v", invite.State.Events)
+	}
+}
+
+// checkJoinedRoom checks the joined room decoded from syncJSON has only the wanted events.
+func checkJoinedRoom(t *testing.T, room joinedRoomHTTPResponse) {
+	if len(room.State.Events) != 1 || room.State.Events[0].Type != "m.room.member" {
+		t.Errorf("Joined room state => want only the m.room.member event, got %v", room.State.Events)
+	}
+	if !room.Timeline.Limited || room.Timeline.PrevBatch != "t34-23535_0_0" {
+		t.Errorf("Timeline => want limited with prev_batch t34-23535_0_0, got %v %s", room.Timeline.Limited, room.Timeline.PrevBatch)
+	}
+	want := Event{
+		Type:    "m.room.message",
+		ID:      "$1",
+		Sender:  "@alice:x",
+		Content: map[string]interface{}{"body": "!echo hi", "msgtype": "m.text"},
+	}
+	if len(room.Timeline.Events) != 1 || !reflect.DeepEqual(room.Timeline.Events[0], want) {
+		t.Errorf("Timeline events => want only %v, got %v", want, room.Timeline.Events)
+	}
+}
+
+func TestDecodeSyncErrors(t *testing.T) {
+	all := func(string) bool { return true }
+	for _, body := range []string{
+		``,
+		`[]`,
+		`{"next_batch": "s1", "rooms": {"join": {"!a:x": {"timeline": {"events": {}}}}}}`,
+		`{"next_batch": "s1", "rooms": {"join": {"!a:x": {"timeline": {"events": [{"type": `,
+	} {
+		if _, err := decodeSync(strings.NewReader(body), all); err == nil {
+			t.Errorf("decodeSync(%q) => want an error, got none", body)
+		}
+	}
+	res, err := decodeSync(strings.NewReader(`{"next_batch": "s1", "rooms": null}`), all)
+	if err != nil || res.NextBatch != "s1" {
+		t.Errorf("decodeSync with null rooms => want next_batch s1, got %v %v", res, err)
+	}
+}
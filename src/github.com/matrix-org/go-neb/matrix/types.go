@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"html"
 	"regexp"
+	"strings"
 )
 
 // Room represents a single Matrix room.
@@ -65,6 +66,37 @@ type Event struct {
 	ID        string                 `json:"event_id"`         // The unique ID of this event
 	RoomID    string                 `json:"room_id"`          // The room the event was sent to. May be nil (e.g. for presence)
 	Content   map[string]interface{} `json:"content"`          // The JSON content of the event.
+	Redacts   string                 `json:"redacts"`          // The event an m.room.redaction removes, in room versions before 11.
+}
+
+// A Relation relates an event to another, e.g. a reaction to the event it reacts to. It is the
+// "m.relates_to" of the event's content.
+type Relation struct {
+	RelType string `json:"rel_type"` // e.g. "m.annotation" for a reaction
+	EventID string `json:"event_id"`
+	Key     string `json:"key,omitempty"` // The reaction of an "m.annotation", e.g. "👍"
+}
+
+// Relation returns the event's relation to another event, if it has one.
+func (event *Event) Relation() (rel Relation, ok bool) {
+	value, ok := event.Content["m.relates_to"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	rel.RelType, _ = value["rel_type"].(string)
+	rel.EventID, _ = value["event_id"].(string)
+	rel.Key, _ = value["key"].(string)
+	ok = rel.EventID != ""
+	return
+}
+
+// RedactedEventID returns the ID of the event an m.room.redaction event removes, which is in its
+// content from room version 11 onwards.
+func (event *Event) RedactedEventID() string {
+	if redacts, ok := event.Content["redacts"].(string); ok && redacts != "" {
+		return redacts
+	}
+	return event.Redacts
 }
 
 // Body returns the value of the "body" key in the event content if it is
@@ -111,6 +143,41 @@ type ImageMessage struct {
 	Info    ImageInfo `json:"info"`
 }
 
+// StickerMessage is the contents of an m.sticker event: an image shown at a fixed size, without a
+// caption. Unlike the other messages here it isn't an m.room.message, so it is sent with
+// SendSticker, and command responses which are StickerMessages are sent as m.sticker events.
+type StickerMessage struct {
+	Body string    `json:"body"`
+	URL  string    `json:"url"`
+	Info ImageInfo `json:"info"`
+}
+
+// EventType returns "m.sticker", the type of event a StickerMessage is sent as.
+func (m StickerMessage) EventType() string { return "m.sticker" }
+
+// ReactionMessage is the contents of an m.reaction event, which reacts to another event with a
+// key, usually an emoji. Like StickerMessage it isn't an m.room.message.
+type ReactionMessage struct {
+	RelatesTo Relation `json:"m.relates_to"`
+}
+
+// EventType returns "m.reaction", the type of event a ReactionMessage is sent as.
+func (m ReactionMessage) EventType() string { return "m.reaction" }
+
+// FileInfo contains info about a file
+type FileInfo struct {
+	Mimetype string `json:"mimetype,omitempty"`
+	Size     uint   `json:"size,omitempty"`
+}
+
+// FileMessage is an m.file event
+type FileMessage struct {
+	MsgType string   `json:"msgtype"`
+	Body    string   `json:"body"`
+	URL     string   `json:"url"`
+	Info    FileInfo `json:"info"`
+}
+
 // An HTMLMessage is the contents of a Matrix HTML formated message event.
 type HTMLMessage struct {
 	Body          string `json:"body"`
@@ -119,19 +186,39 @@ type HTMLMessage struct {
 	FormattedBody string `json:"formatted_body"`
 }
 
-var htmlRegex = regexp.MustCompile("<[^<]+?>")
+var (
+	htmlRegex      = regexp.MustCompile("<[^<]+?>")
+	lineBreakRegex = regexp.MustCompile(`(?i)<br\s*/?>|</(p|div|li|tr|blockquote|pre|h[1-6])>`)
+	linkRegex      = regexp.MustCompile(`(?is)<a\s[^>]*href="([^"]*)"[^>]*>(.*?)</a>`)
+)
 
-// GetHTMLMessage returns an HTMLMessage with the body set to a stripped version of the provided HTML, in addition
-// to the provided HTML.
+// GetHTMLMessage returns an HTMLMessage with the body set to a plain text version of the provided HTML, in
+// addition to the provided HTML.
 func GetHTMLMessage(msgtype, htmlText string) HTMLMessage {
 	return HTMLMessage{
-		Body:          html.UnescapeString(htmlRegex.ReplaceAllLiteralString(htmlText, "")),
+		Body:          HTMLToText(htmlText),
 		MsgType:       msgtype,
 		Format:        "org.matrix.custom.html",
 		FormattedBody: htmlText,
 	}
 }
 
+// HTMLToText strips the tags from the HTML, for clients which can't show it. Line breaks and the
+// ends of blocks become newlines, and links are followed by their URLs if the text is different.
+func HTMLToText(htmlText string) string {
+	text := linkRegex.ReplaceAllStringFunc(htmlText, func(link string) string {
+		groups := linkRegex.FindStringSubmatch(link)
+		href, linkText := groups[1], htmlRegex.ReplaceAllLiteralString(groups[2], "")
+		if linkText == "" || linkText == href {
+			return href
+		}
+		return linkText + " (" + href + ")"
+	})
+	text = lineBreakRegex.ReplaceAllLiteralString(text, "\n")
+	text = htmlRegex.ReplaceAllLiteralString(text, "")
+	return strings.TrimRight(html.UnescapeString(text), "\n")
+}
+
 // StarterLinkMessage represents a message with a starter_link custom data.
 type StarterLinkMessage struct {
 	Body string
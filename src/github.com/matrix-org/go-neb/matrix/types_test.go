@@ -0,0 +1,59 @@
+package matrix
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+var htmltests = []struct {
+	html string
+	want string
+}{
+	{"<b>SYN-1</b> - It &lt;broke&gt;", "SYN-1 - It <broke>"},
+	{"one<br>two<br/>three", "one\ntwo\nthree"},
+	{"<p>para</p><ul><li>a</li><li>b</li></ul>", "para\na\nb"},
+	{`built <a href="https://ci/1?a=1&amp;b=2">#1</a>`, "built #1 (https://ci/1?a=1&b=2)"},
+	{`<a href="https://ci/1">https://ci/1</a>`, "https://ci/1"},
+}
+
+func TestGetHTMLMessage(t *testing.T) {
+	for _, test := range htmltests {
+		msg := GetHTMLMessage("m.notice", test.html)
+		if msg.Body != test.want {
+			t.Errorf("GetHTMLMessage(%q).Body => want %q got %q", test.html, test.want, msg.Body)
+		}
+		if msg.FormattedBody != test.html || msg.Format != "org.matrix.custom.html" {
+			t.Errorf("GetHTMLMessage(%q) => want the HTML as the formatted body, got %+v", test.html, msg)
+		}
+	}
+}
+
+func TestRelation(t *testing.T) {
+	var event Event
+	if err := json.Unmarshal([]byte(`{"type":"m.reaction","content":{"m.relates_to":{"rel_type":"m.annotation","event_id":"$poll","key":"1\ufe0f\u20e3"}}}`), &event); err != nil {
+		t.Fatal(err)
+	}
+	rel, ok := event.Relation()
+	if !ok || rel != (Relation{"m.annotation", "$poll", "1\ufe0f\u20e3"}) {
+		t.Errorf("Relation() => Want the annotation of $poll got %+v, %v", rel, ok)
+	}
+	if _, ok = (&Event{Content: map[string]interface{}{"body": "hi"}}).Relation(); ok {
+		t.Error("Relation() of an event without m.relates_to => Want false got true")
+	}
+}
+
+func TestRedactedEventID(t *testing.T) {
+	for body, want := range map[string]string{
+		`{"type":"m.room.redaction","redacts":"$old","content":{}}`:                 "$old",
+		`{"type":"m.room.redaction","content":{"redacts":"$new"}}`:                  "$new",
+		`{"type":"m.room.redaction","redacts":"$new","content":{"redacts":"$new"}}`: "$new",
+	} {
+		var event Event
+		if err := json.Unmarshal([]byte(body), &event); err != nil {
+			t.Fatal(err)
+		}
+		if got := event.RedactedEventID(); got != want {
+			t.Errorf("RedactedEventID() of %s => Want %s got %s", body, want, got)
+		}
+	}
+}
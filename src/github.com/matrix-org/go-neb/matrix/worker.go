@@ -1,5 +1,11 @@
 package matrix
 
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"runtime/debug"
+)
+
 // Worker processes incoming events and updates the Matrix client's data structures. It also informs
 // any attached listeners of the new events.
 type Worker struct {
@@ -27,27 +33,75 @@ func (worker *Worker) OnEventType(eventType string, callback OnEventListener) {
 	worker.listeners[eventType] = append(worker.listeners[eventType], callback)
 }
 
+// stateEventTypes are the types of state event kept in rooms' State, as well as those with
+// listeners. GetMembershipState needs the membership events.
+var stateEventTypes = map[string]bool{
+	"m.room.member": true,
+}
+
+// wants returns true if events of the type are used: they are kept in rooms' State, or there are
+// listeners for them. Other events are dropped as /sync responses are decoded.
+func (worker *Worker) wants(eventType string) bool {
+	_, exists := worker.listeners[eventType]
+	return exists || stateEventTypes[eventType] || (worker.client.crypto != nil && cryptoEventTypes[eventType])
+}
+
 func (worker *Worker) notifyListeners(event *Event) {
 	listeners, exists := worker.listeners[event.Type]
 	if !exists {
 		return
 	}
 	for _, fn := range listeners {
-		fn(event)
+		worker.notifyListener(fn, event)
+	}
+}
+
+// notifyListener calls the listener, recovering if it panics so that one bad event can't stop
+// the client from processing any more.
+func (worker *Worker) notifyListener(fn OnEventListener, event *Event) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.WithFields(log.Fields{
+				"user_id":  worker.client.UserID,
+				"room_id":  event.RoomID,
+				"event_id": event.ID,
+				"panic":    fmt.Sprint(r),
+				"stack":    string(debug.Stack()),
+			}).Error("Recovered from panic in event listener")
+		}
+	}()
+	fn(event)
+}
+
+// onRoomEvent returns false if the event can't be used, because it is encrypted with a key the
+// client doesn't have. Encrypted events are replaced by the events they hold.
+func (worker *Worker) onRoomEvent(event *Event) bool {
+	if crypto := worker.client.crypto; crypto != nil {
+		return crypto.onRoomEvent(event)
 	}
+	return true
 }
 
 func (worker *Worker) onSyncHTTPResponse(res syncHTTPResponse) {
+	if crypto := worker.client.crypto; crypto != nil {
+		// Room keys sent to the device are needed to decrypt the events in the same response.
+		crypto.onSync(&res)
+	}
 	for roomID, roomData := range res.Rooms.Join {
 		room := worker.client.getOrCreateRoom(roomID)
 		for _, event := range roomData.State.Events {
 			event.RoomID = roomID
+			if !worker.onRoomEvent(&event) {
+				continue
+			}
 			room.UpdateState(&event)
 			worker.notifyListeners(&event)
 		}
 		for _, event := range roomData.Timeline.Events {
 			event.RoomID = roomID
-			worker.notifyListeners(&event)
+			if worker.onRoomEvent(&event) {
+				worker.notifyListeners(&event)
+			}
 		}
 	}
 	for roomID, roomData := range res.Rooms.Invite {
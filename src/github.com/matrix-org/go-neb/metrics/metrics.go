@@ -0,0 +1,82 @@
+// Package metrics serves Go-NEB's metrics in the Prometheus text exposition format, so that they
+// can be scraped by Prometheus or anything else which understands it.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/matrix-org/go-neb/batch"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/plugin"
+	"github.com/matrix-org/go-neb/server"
+	"github.com/matrix-org/go-neb/status"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Path is the path metrics are served on.
+const Path = "/metrics"
+
+var startTime = time.Now()
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Handler serves the current metrics.
+func Handler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		w.WriteHeader(405)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	out := bufio.NewWriter(w)
+	defer out.Flush()
+
+	statuses := status.All()
+	var serviceIDs []string
+	for id := range statuses {
+		serviceIDs = append(serviceIDs, id)
+	}
+	sort.Strings(serviceIDs)
+	perService := func(name, typ, help string, value func(s status.ServiceStatus) int64) {
+		fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+		for _, id := range serviceIDs {
+			fmt.Fprintf(out, "%s{service_id=\"%s\"} %d\n", name, labelEscaper.Replace(id), value(statuses[id]))
+		}
+	}
+	perService("neb_service_received_total", "counter", "Webhooks (or poll results) received by a service.",
+		func(s status.ServiceStatus) int64 { return s.ReceivedCount })
+	perService("neb_service_verified_total", "counter", "Webhooks which passed a service's signature or token check.",
+		func(s status.ServiceStatus) int64 { return s.VerifiedCount })
+	perService("neb_service_filtered_total", "counter", "Verified webhooks a service forwarded to no room.",
+		func(s status.ServiceStatus) int64 { return s.FilteredCount })
+	perService("neb_service_forwarded_total", "counter", "Verified webhooks a service forwarded to rooms.",
+		func(s status.ServiceStatus) int64 { return s.ForwardedCount })
+	perService("neb_service_sent_total", "counter", "Messages sent into rooms by a service.",
+		func(s status.ServiceStatus) int64 { return s.SentCount })
+	perService("neb_service_errors_total", "counter", "Errors encountered by a service.",
+		func(s status.ServiceStatus) int64 { return s.ErrorCount })
+	perService("neb_service_last_received_timestamp_seconds", "gauge", "When a service last received a webhook (or poll result).",
+		func(s status.ServiceStatus) int64 { return s.LastReceivedMs / 1000 })
+	perService("neb_service_last_verified_timestamp_seconds", "gauge", "When a webhook last passed a service's signature or token check.",
+		func(s status.ServiceStatus) int64 { return s.LastVerifiedMs / 1000 })
+
+	single := func(name, typ, help string, value int64) {
+		fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, typ, name, value)
+	}
+	stats := batch.GetStats()
+	single("neb_notifications_in_flight", "gauge", "Notifications being sent into rooms.", stats.InFlight)
+	single("neb_notifications_coalesced_total", "counter", "Notifications held back to be merged with others because too many were being sent.", stats.Coalesced)
+	single("neb_notifications_shed_total", "counter", "Notifications dropped because far too many were being sent.", stats.Shed)
+	single("neb_notifications_queued", "gauge", "Notifications waiting to be sent again because sending them failed.", stats.Queued)
+	single("neb_matrix_rate_limited_total", "counter", "Requests the homeserver rejected with HTTP 429 because it was rate limiting Go-NEB.", matrix.RateLimited())
+	single("neb_commands_abandoned", "gauge", "Commands which timed out but are still running in the background.", plugin.AbandonedCommands())
+	single("neb_webhooks_shed_total", "counter", "Webhook requests rejected with HTTP 503 because WEBHOOK_MAX_CONCURRENT were being handled.", server.BusyRejections())
+
+	fmt.Fprintf(out, "# HELP process_start_time_seconds Start time of the process since the Unix epoch in seconds.\n")
+	fmt.Fprintf(out, "# TYPE process_start_time_seconds gauge\nprocess_start_time_seconds %d\n", startTime.Unix())
+	fmt.Fprintf(out, "# HELP go_goroutines Number of goroutines that currently exist.\n")
+	fmt.Fprintf(out, "# TYPE go_goroutines gauge\ngo_goroutines %d\n", runtime.NumGoroutine())
+}
@@ -0,0 +1,95 @@
+// Package ops posts Go-NEB's own operational alerts, e.g. a client failing to sync, into a Matrix
+// room watched by the people running it, so that they find out about problems before users do.
+//
+// Alerts are always logged. They are only posted if a room has been configured with SetRoom.
+package ops
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// alertInterval is how often the same alert is posted. Repeats in between are only logged.
+const alertInterval = 1 * time.Hour
+
+// repeatThreshold and repeatWindow control RepeatedFailure: an alert is posted when something
+// fails repeatThreshold times within repeatWindow.
+const (
+	repeatThreshold = 5
+	repeatWindow    = 10 * time.Minute
+)
+
+// A Sender posts a message into a room.
+type Sender func(roomID, text string) error
+
+var (
+	mu       sync.Mutex
+	roomID   string
+	sender   Sender
+	lastSent = make(map[string]time.Time)   // alert text => when it was last posted
+	failures = make(map[string][]time.Time) // RepeatedFailure key => recent failure times
+)
+
+// SetRoom sets the room alerts are posted into, and how to post them.
+func SetRoom(room string, send Sender) {
+	mu.Lock()
+	defer mu.Unlock()
+	roomID = room
+	sender = send
+}
+
+// Alert logs the given alert and posts it into the ops room. Identical alerts are posted at most
+// once an hour. Posting happens in the background, so Alert never blocks.
+func Alert(format string, args ...interface{}) {
+	text := fmt.Sprintf(format, args...)
+	log.WithField("alert", text).Warn("Operational alert")
+
+	mu.Lock()
+	defer mu.Unlock()
+	if sender == nil {
+		return
+	}
+	now := time.Now()
+	if last, ok := lastSent[text]; ok && now.Sub(last) < alertInterval {
+		return
+	}
+	for t, last := range lastSent {
+		if now.Sub(last) >= alertInterval {
+			delete(lastSent, t)
+		}
+	}
+	lastSent[text] = now
+	send, room := sender, roomID
+	go func() {
+		if err := send(room, text); err != nil {
+			log.WithError(err).WithField("room_id", room).Warn("Failed to post operational alert")
+		}
+	}()
+}
+
+// RepeatedFailure records that the thing identified by key failed, and posts an alert if it has
+// failed repeatedly in the last few minutes. Use this for failures which are expected to happen
+// occasionally, e.g. a webhook with a bad signature.
+func RepeatedFailure(key string, format string, args ...interface{}) {
+	mu.Lock()
+	now := time.Now()
+	var recent []time.Time
+	for _, t := range failures[key] {
+		if now.Sub(t) < repeatWindow {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+	failures[key] = recent
+	alert := len(recent) >= repeatThreshold
+	if alert {
+		delete(failures, key)
+	}
+	mu.Unlock()
+
+	if alert {
+		Alert(format, args...)
+	}
+}
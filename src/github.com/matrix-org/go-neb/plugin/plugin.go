@@ -1,28 +1,85 @@
 package plugin
 
 import (
+	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/matrix-org/go-neb/matrix"
 	"github.com/mattn/go-shellwords"
+	"golang.org/x/net/context"
 	"regexp"
 	"strings"
+	"sync/atomic"
+	"time"
+	"unicode"
 )
 
+// DefaultCommandTimeout is how long commands are given to respond, unless SetCommandTimeout is called.
+const DefaultCommandTimeout = 30 * time.Second
+
+var commandTimeout = DefaultCommandTimeout
+
+// SetCommandTimeout sets how long commands are given to respond before the user is told that they
+// timed out and their contexts are cancelled. 0 means no timeout.
+func SetCommandTimeout(timeout time.Duration) {
+	commandTimeout = timeout
+}
+
+// maxAbandonedCommands is how many commands which timed out, but ignored their context being
+// cancelled, may carry on running in the background. Past it, new commands are refused until some
+// finish, so that a backend which hangs can't pile up goroutines without bound.
+var maxAbandonedCommands int64 = 100
+
+// abandonedCommands is how many commands which timed out are still running.
+var abandonedCommands int64
+
+// AbandonedCommands returns how many commands which timed out are still running in the background.
+func AbandonedCommands() int64 {
+	return atomic.LoadInt64(&abandonedCommands)
+}
+
+// DefaultPrefix is what commands start with, unless a Plugin says otherwise.
+const DefaultPrefix = "!"
+
 // A Plugin is a list of commands and expansions to apply to incoming messages.
 type Plugin struct {
 	Commands   []Command
 	Expansions []Expansion
+	// Prefix is what messages must start with for the plugin's commands to be run, e.g. "?" or
+	// "neb:", so that several bots in a room can be told apart. Empty means DefaultPrefix.
+	Prefix string
+}
+
+// prefix returns what messages must start with to be commands for the plugin.
+func (plugin *Plugin) prefix() string {
+	if plugin.Prefix == "" {
+		return DefaultPrefix
+	}
+	return plugin.Prefix
+}
+
+// ValidatePrefix returns an error if messages can't start with the command prefix. An empty prefix
+// is valid, and means DefaultPrefix.
+func ValidatePrefix(prefix string) error {
+	if prefix != strings.TrimLeftFunc(prefix, unicode.IsSpace) {
+		return fmt.Errorf("prefix %q must not start with whitespace", prefix)
+	}
+	return nil
 }
 
-// A Command is something that a user invokes by sending a message starting with '!'
-// followed by a list of strings that name the command, followed by a list of argument
-// strings. The argument strings may be quoted using '\"' and '\'' in the same way
+// A Command is something that a user invokes by sending a message starting with the
+// plugin's prefix, usually '!', followed by a list of strings that name the command,
+// followed by a list of argument strings. The argument strings may be quoted using '\"' and '\'' in the same way
 // that they are quoted in the unix shell.
 type Command struct {
-	Path      []string
+	Path []string
+	// Arguments name the arguments the command takes, for its usage, e.g. {"realm", "[username]"}.
 	Arguments []string
-	Help      string
-	Command   func(roomID, userID string, arguments []string) (content interface{}, err error)
+	// Help describes what the command does, for the !help command.
+	Help    string
+	Command func(roomID, userID string, arguments []string) (content interface{}, err error)
+	// ContextCommand is called instead of Command if it is set. Its context is cancelled when the
+	// command times out, so that it can give up on whatever it is waiting for.
+	ContextCommand func(ctx context.Context, roomID, userID string, arguments []string) (content interface{}, err error)
 }
 
 // An Expansion is something that actives when the user sends any message
@@ -34,6 +91,60 @@ type Expansion struct {
 	Expand func(roomID, userID string, matchingGroups []string) interface{}
 }
 
+// typedContent is implemented by responses which are sent as events of a type other than
+// m.room.message, such as matrix.StickerMessage.
+type typedContent interface {
+	EventType() string
+}
+
+// Usage returns how to invoke the command, e.g. "!token realm [username] token".
+func (command *Command) Usage(prefix string) string {
+	return prefix + strings.Join(append(append([]string{}, command.Path...), command.Arguments...), " ")
+}
+
+// HelpPlugins returns a plugin for each prefix the commands of the plugins start with, which has a
+// "help" command listing those commands, their arguments and what they do. The help for
+// DefaultPrefix also says how to list the commands with other prefixes.
+func HelpPlugins(plugins []Plugin) []Plugin {
+	var prefixes []string
+	usages := make(map[string][]string) // prefix => usage lines
+	for _, plugin := range plugins {
+		prefix := plugin.prefix()
+		for _, command := range plugin.Commands {
+			if _, ok := usages[prefix]; !ok {
+				prefixes = append(prefixes, prefix)
+			}
+			usage := command.Usage(prefix)
+			if command.Help != "" {
+				usage += ": " + command.Help
+			}
+			usages[prefix] = append(usages[prefix], usage)
+		}
+	}
+	var helpPlugins []Plugin
+	for _, prefix := range prefixes {
+		text := "Commands:\n" + strings.Join(usages[prefix], "\n")
+		if prefix == DefaultPrefix {
+			for _, other := range prefixes {
+				if other != DefaultPrefix {
+					text += fmt.Sprintf("\nFor the commands starting with %s, send %shelp", other, other)
+				}
+			}
+		}
+		helpPlugins = append(helpPlugins, Plugin{
+			Prefix: prefix,
+			Commands: []Command{{
+				Path: []string{"help"},
+				Help: "List the commands you can use",
+				Command: func(roomID, userID string, args []string) (interface{}, error) {
+					return matrix.TextMessage{"m.notice", text}, nil
+				},
+			}},
+		})
+	}
+	return helpPlugins
+}
+
 // matches if the arguments start with the path of the command.
 func (command *Command) matches(arguments []string) bool {
 	if len(arguments) < len(command.Path) {
@@ -66,19 +177,18 @@ func runCommandForPlugin(plugin Plugin, event *matrix.Event, arguments []string)
 	}
 
 	cmdArgs := arguments[len(bestMatch.Path):]
-	log.WithFields(log.Fields{
-		"room_id": event.RoomID,
-		"user_id": event.Sender,
-		"command": bestMatch.Path,
-	}).Info("Executing command")
-	content, err := bestMatch.Command(event.RoomID, event.Sender, cmdArgs)
+	logger := log.WithFields(log.Fields{
+		"event_id": event.ID,
+		"room_id":  event.RoomID,
+		"user_id":  event.Sender,
+		"command":  bestMatch.Path,
+	})
+	logger.Info("Executing command")
+	content, err := bestMatch.run(plugin.prefix(), event.RoomID, event.Sender, cmdArgs)
 	if err != nil {
 		if content != nil {
-			log.WithFields(log.Fields{
+			logger.WithFields(log.Fields{
 				log.ErrorKey: err,
-				"room_id":    event.RoomID,
-				"user_id":    event.Sender,
-				"command":    bestMatch.Path,
 				"args":       cmdArgs,
 			}).Warn("Command returned both error and content.")
 		}
@@ -88,10 +198,82 @@ func runCommandForPlugin(plugin Plugin, event *matrix.Event, arguments []string)
 	return content
 }
 
-// run the expansions for a matrix event.
+// run runs the command, giving up on it if it takes longer than the command timeout. A command which
+// doesn't stop when its context is cancelled carries on in the background, but its response is
+// dropped, and it counts towards maxAbandonedCommands until it returns. prefix is only used to name
+// the command in errors.
+func (command *Command) run(prefix, roomID, userID string, arguments []string) (interface{}, error) {
+	if AbandonedCommands() >= maxAbandonedCommands {
+		log.WithField("command", command.Path).Warn("Refusing command: too many commands which timed out are still running")
+		return nil, fmt.Errorf("%s%s can't be run now, as too many commands are stuck. Try again later", prefix, strings.Join(command.Path, " "))
+	}
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if commandTimeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), commandTimeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	defer cancel()
+
+	type result struct {
+		content interface{}
+		err     error
+		panic   interface{}
+	}
+	done := make(chan result, 1)
+	// state is commandRunning until either the command returns, when the goroutine sets it to
+	// commandReturned, or it times out, when it is set to commandAbandoned.
+	state := commandRunning
+	go func() {
+		// Panics are passed back to be raised again on the calling goroutine, where the service's
+		// panics are recovered from.
+		defer func() {
+			if r := recover(); r != nil {
+				done <- result{panic: r}
+			}
+			if !atomic.CompareAndSwapInt32(&state, commandRunning, commandReturned) {
+				atomic.AddInt64(&abandonedCommands, -1)
+			}
+		}()
+		var res result
+		if command.ContextCommand != nil {
+			res.content, res.err = command.ContextCommand(ctx, roomID, userID, arguments)
+		} else {
+			res.content, res.err = command.Command(roomID, userID, arguments)
+		}
+		done <- res
+	}()
+
+	select {
+	case res := <-done:
+		if res.panic != nil {
+			panic(res.panic)
+		}
+		return res.content, res.err
+	case <-ctx.Done():
+		atomic.AddInt64(&abandonedCommands, 1)
+		if !atomic.CompareAndSwapInt32(&state, commandRunning, commandAbandoned) {
+			// It has returned since, e.g. because its context was cancelled, so isn't running.
+			atomic.AddInt64(&abandonedCommands, -1)
+		}
+		return nil, fmt.Errorf("%s%s timed out after %s", prefix, strings.Join(command.Path, " "), commandTimeout)
+	}
+}
+
+// The states of a command being run.
+const (
+	commandRunning int32 = iota
+	commandReturned
+	commandAbandoned
+)
+
+// run the expansions for a matrix event. Expansions which have been sent into the room
+// too recently or too often are skipped: see SetExpansionLimits.
 func runExpansionsForPlugin(plugin Plugin, event *matrix.Event, body string) []interface{} {
 	var responses []interface{}
 
+	limits := expansionLimits
 	for _, expansion := range plugin.Expansions {
 		matches := map[string]bool{}
 		for _, matchingGroups := range expansion.Regexp.FindAllStringSubmatch(body, -1) {
@@ -101,7 +283,16 @@ func runExpansionsForPlugin(plugin Plugin, event *matrix.Event, body string) []i
 				continue
 			}
 			matches[matchingText] = true
+			if !limits.allow(event.RoomID, expansion, matchingText) {
+				log.WithFields(log.Fields{
+					"event_id": event.ID,
+					"room_id":  event.RoomID,
+					"text":     matchingText,
+				}).Debug("Not expanding: expanded in this room too recently or too often")
+				continue
+			}
 			if response := expansion.Expand(event.RoomID, event.Sender, matchingGroups); response != nil {
+				limits.sent(event.RoomID, expansion, matchingText)
 				responses = append(responses, response)
 			}
 		}
@@ -113,14 +304,14 @@ func runExpansionsForPlugin(plugin Plugin, event *matrix.Event, body string) []i
 // runCommands runs the plugin commands or expansions for a single matrix
 // event. Returns a list of JSON encodable contents for the matrix messages
 // to use as responses.
-// If the message beings with '!' then it is assumed to be a command. Each
-// plugin is checked for a matching command, if a match is found then that
-// command is run. If more than one plugin has a matching command then all
-// of those commands are run. This shouldn't happen unless the same plugin
-// is installed multiple times since each plugin will usually have a
-// distinct prefix for its commands.
-// If the message doesn't begin with '!' then it is checked against the
-// expansions for each plugin.
+// If the message begins with the prefix of any of the plugins, usually '!', then
+// it is assumed to be a command. Each plugin with that prefix is checked for a
+// matching command, if a match is found then that command is run. If more than
+// one plugin has a matching command then all of those commands are run. This
+// shouldn't happen unless the same plugin is installed multiple times since
+// each plugin will usually have a distinct path for its commands.
+// If the message doesn't begin with any plugin's prefix, or with DefaultPrefix,
+// then it is checked against the expansions for each plugin.
 func runCommands(plugins []Plugin, event *matrix.Event) []interface{} {
 	body, ok := event.Body()
 	if !ok || body == "" {
@@ -134,18 +325,24 @@ func runCommands(plugins []Plugin, event *matrix.Event) []interface{} {
 
 	var responses []interface{}
 
-	if body[0] == '!' {
-		args, err := shellwords.Parse(body[1:])
+	// Messages starting with DefaultPrefix are commands for other bots or services even if not for
+	// these plugins, so aren't expanded either.
+	isCommand := strings.HasPrefix(body, DefaultPrefix)
+	for _, plugin := range plugins {
+		prefix := plugin.prefix()
+		if !strings.HasPrefix(body, prefix) {
+			continue
+		}
+		isCommand = true
+		args, err := shellwords.Parse(body[len(prefix):])
 		if err != nil {
-			args = strings.Split(body[1:], " ")
+			args = strings.Split(body[len(prefix):], " ")
 		}
-
-		for _, plugin := range plugins {
-			if response := runCommandForPlugin(plugin, event, args); response != nil {
-				responses = append(responses, response)
-			}
+		if response := runCommandForPlugin(plugin, event, args); response != nil {
+			responses = append(responses, response)
 		}
-	} else {
+	}
+	if !isCommand {
 		for _, plugin := range plugins {
 			expansions := runExpansionsForPlugin(plugin, event, body)
 			responses = append(responses, expansions...)
@@ -157,19 +354,30 @@ func runCommands(plugins []Plugin, event *matrix.Event) []interface{} {
 
 // OnMessage checks the message event to see whether it contains any commands
 // or expansions from the listed plugins and processes those commands or
-// expansions.
-func OnMessage(plugins []Plugin, client *matrix.Client, event *matrix.Event) {
+// expansions. Responses are sent as m.room.message events unless they have an
+// EventType method saying otherwise. Returns the number of responses which were
+// sent, and the last error encountered when sending a response, if any.
+func OnMessage(plugins []Plugin, client *matrix.Client, event *matrix.Event) (sent int, lastErr error) {
 	responses := runCommands(plugins, event)
 
 	for _, content := range responses {
-		_, err := client.SendMessageEvent(event.RoomID, "m.room.message", content)
+		eventType := "m.room.message"
+		if typed, ok := content.(typedContent); ok {
+			eventType = typed.EventType()
+		}
+		_, err := client.SendMessageEvent(event.RoomID, eventType, content)
 		if err != nil {
+			lastErr = err
 			log.WithFields(log.Fields{
 				log.ErrorKey: err,
+				"event_id":   event.ID,
 				"room_id":    event.RoomID,
 				"user_id":    event.Sender,
 				"content":    content,
 			}).Print("Failed to send command response")
+		} else {
+			sent++
 		}
 	}
+	return
 }
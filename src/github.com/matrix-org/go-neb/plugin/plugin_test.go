@@ -2,9 +2,12 @@ package plugin
 
 import (
 	"github.com/matrix-org/go-neb/matrix"
+	"golang.org/x/net/context"
+	"os"
 	"reflect"
 	"regexp"
 	"testing"
+	"time"
 )
 
 const (
@@ -12,6 +15,12 @@ const (
 	mySender = "@user:example.com"
 )
 
+func TestMain(m *testing.M) {
+	// Tests expand the same text in the same room over and over.
+	SetExpansionLimits(0, 0)
+	os.Exit(m.Run())
+}
+
 func makeTestEvent(msgtype, body string) *matrix.Event {
 	return &matrix.Event{
 		Sender: mySender,
@@ -123,6 +132,70 @@ func TestRunCommandsInvalidShell(t *testing.T) {
 	}
 }
 
+func TestRunCommandsPrefix(t *testing.T) {
+	question := makeTestPlugin([][]string{[]string{"test"}}, []*regexp.Regexp{regexp.MustCompile("expand")})
+	question.Prefix = "?"
+	plugins := []Plugin{
+		question,
+		makeTestPlugin([][]string{[]string{"test"}}, nil),
+	}
+	for _, test := range []struct {
+		body string
+		want []interface{}
+	}{
+		{"?test arg1", []interface{}{makeTestResponse(myRoomID, mySender, []string{"arg1"})}},
+		{"!test arg2", []interface{}{makeTestResponse(myRoomID, mySender, []string{"arg2"})}},
+		// Commands for other bots are not expanded.
+		{"!other expand", nil},
+		{"please expand", []interface{}{makeTestExpansion(myRoomID, mySender, []string{"expand"})}},
+	} {
+		got := runCommands(plugins, makeTestEvent("m.text", test.body))
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("runCommands(%q) => want %+v, got %+v", test.body, test.want, got)
+		}
+	}
+}
+
+func TestHelpPlugins(t *testing.T) {
+	echo := Plugin{Commands: []Command{{Path: []string{"echo"}, Arguments: []string{"text"}, Help: "Repeat the text"}}}
+	jira := Plugin{Prefix: "?", Commands: []Command{
+		{Path: []string{"jira"}, Arguments: []string{"issue"}},
+		{Path: []string{"jira", "create"}, Arguments: []string{"project", "title"}, Help: "Create an issue"},
+	}}
+	expander := makeTestPlugin(nil, []*regexp.Regexp{regexp.MustCompile("expand")})
+	helpPlugins := HelpPlugins([]Plugin{echo, expander, jira})
+
+	for _, test := range []struct {
+		body string
+		want []interface{}
+	}{
+		{"!help", []interface{}{matrix.TextMessage{"m.notice", "Commands:\n!echo text: Repeat the text\nFor the commands starting with ?, send ?help"}}},
+		{"?help", []interface{}{matrix.TextMessage{"m.notice", "Commands:\n?jira issue\n?jira create project title: Create an issue"}}},
+		{"please help", nil},
+	} {
+		got := runCommands(helpPlugins, makeTestEvent("m.text", test.body))
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("runCommands(HelpPlugins, %q) => want %+v, got %+v", test.body, test.want, got)
+		}
+	}
+	if got := HelpPlugins([]Plugin{expander}); len(got) != 0 {
+		t.Errorf("HelpPlugins without commands => want no plugins, got %+v", got)
+	}
+}
+
+func TestValidatePrefix(t *testing.T) {
+	for _, prefix := range []string{"", "!", "?", "neb: "} {
+		if err := ValidatePrefix(prefix); err != nil {
+			t.Errorf("ValidatePrefix(%q) => want nil, got %s", prefix, err)
+		}
+	}
+	for _, prefix := range []string{" ", " !"} {
+		if err := ValidatePrefix(prefix); err == nil {
+			t.Errorf("ValidatePrefix(%q) => want an error, got nil", prefix)
+		}
+	}
+}
+
 func TestExpansion(t *testing.T) {
 	plugins := []Plugin{
 		makeTestPlugin(nil, []*regexp.Regexp{
@@ -157,3 +230,88 @@ func TestExpansionDuplicateMatches(t *testing.T) {
 		t.Errorf("runCommands(\nplugins=%+v\nevent=%+v\n)\n%+v\nwanted: %+v", plugins, event, got, want)
 	}
 }
+
+func TestCommandTimeout(t *testing.T) {
+	SetCommandTimeout(20 * time.Millisecond)
+	defer SetCommandTimeout(DefaultCommandTimeout)
+
+	cancelled := make(chan bool, 1)
+	plugins := []Plugin{{
+		Commands: []Command{{
+			Path: []string{"slow"},
+			ContextCommand: func(ctx context.Context, roomID, userID string, args []string) (interface{}, error) {
+				select {
+				case <-ctx.Done():
+					cancelled <- true
+				case <-time.After(time.Second):
+					cancelled <- false
+				}
+				return "too late", nil
+			},
+		}},
+	}}
+	got := runCommands(plugins, makeTestEvent("m.text", "!slow"))
+	want := []interface{}{matrix.TextMessage{"m.notice", "!slow timed out after 20ms"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("runCommands(!slow) => want %+v, got %+v", want, got)
+	}
+	if !<-cancelled {
+		t.Error("Timed out command => want its context cancelled, but it wasn't")
+	}
+}
+
+func TestCommandPanic(t *testing.T) {
+	plugins := []Plugin{{
+		Commands: []Command{{
+			Path: []string{"panic"},
+			Command: func(roomID, userID string, args []string) (interface{}, error) {
+				panic("oh no")
+			},
+		}},
+	}}
+	defer func() {
+		if r := recover(); r != "oh no" {
+			t.Errorf("Panicking command => want the panic raised again, got %v", r)
+		}
+	}()
+	runCommands(plugins, makeTestEvent("m.text", "!panic"))
+}
+
+func TestAbandonedCommandsLimit(t *testing.T) {
+	SetCommandTimeout(20 * time.Millisecond)
+	defer SetCommandTimeout(DefaultCommandTimeout)
+	maxAbandonedCommands = 1
+	defer func() { maxAbandonedCommands = 100 }()
+
+	release := make(chan struct{})
+	plugins := []Plugin{{
+		Commands: []Command{{
+			Path: []string{"stuck"},
+			Command: func(roomID, userID string, args []string) (interface{}, error) {
+				<-release
+				return "too late", nil
+			},
+		}},
+	}}
+	got := runCommands(plugins, makeTestEvent("m.text", "!stuck"))
+	want := []interface{}{matrix.TextMessage{"m.notice", "!stuck timed out after 20ms"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("runCommands(!stuck) => want %+v, got %+v", want, got)
+	}
+	if n := AbandonedCommands(); n != 1 {
+		t.Errorf("AbandonedCommands after a command ignored its timeout => want 1, got %d", n)
+	}
+	got = runCommands(plugins, makeTestEvent("m.text", "!stuck"))
+	want = []interface{}{matrix.TextMessage{"m.notice", "!stuck can't be run now, as too many commands are stuck. Try again later"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("runCommands(!stuck) with too many abandoned => want %+v, got %+v", want, got)
+	}
+
+	close(release)
+	for i := 0; AbandonedCommands() != 0; i++ {
+		if i == 100 {
+			t.Fatalf("AbandonedCommands after the command returned => want 0, got %d", AbandonedCommands())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,63 @@
+package plugin
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"runtime/debug"
+	"sync"
+)
+
+// A Pool runs jobs on a fixed number of goroutines, so that a burst of messages can't start an
+// unbounded number of them. Jobs wait in a queue of limited length for a goroutine to be free.
+type Pool struct {
+	jobs chan func()
+	wg   sync.WaitGroup
+}
+
+// NewPool starts a pool of the given number of goroutines, with room to queue the given number of
+// jobs.
+func NewPool(workers, queued int) *Pool {
+	p := &Pool{jobs: make(chan func(), queued)}
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+// Submit queues the job to be run, returning false without running it if the queue is full. It
+// never blocks.
+func (p *Pool) Submit(job func()) bool {
+	p.wg.Add(1)
+	select {
+	case p.jobs <- job:
+		return true
+	default:
+		p.wg.Done()
+		return false
+	}
+}
+
+// Wait waits for every job submitted so far to finish.
+func (p *Pool) Wait() {
+	p.wg.Wait()
+}
+
+func (p *Pool) work() {
+	for job := range p.jobs {
+		p.run(job)
+	}
+}
+
+// run runs the job, recovering if it panics so that the goroutine isn't lost.
+func (p *Pool) run(job func()) {
+	defer p.wg.Done()
+	defer func() {
+		if r := recover(); r != nil {
+			log.WithFields(log.Fields{
+				"panic": fmt.Sprint(r),
+				"stack": string(debug.Stack()),
+			}).Error("Recovered from panic in pool job")
+		}
+	}()
+	job()
+}
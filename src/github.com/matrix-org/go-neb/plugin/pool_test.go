@@ -0,0 +1,45 @@
+package plugin
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+func TestPool(t *testing.T) {
+	p := NewPool(1, 1)
+	block := make(chan struct{})
+	started := make(chan struct{})
+	var ran int32
+
+	if !p.Submit(func() {
+		close(started)
+		<-block
+		atomic.AddInt32(&ran, 1)
+	}) {
+		t.Fatal("Submit to an idle pool => want it queued, but it wasn't")
+	}
+	<-started
+	if !p.Submit(func() { atomic.AddInt32(&ran, 1) }) {
+		t.Fatal("Submit with room in the queue => want it queued, but it wasn't")
+	}
+	if p.Submit(func() { atomic.AddInt32(&ran, 1) }) {
+		t.Error("Submit with a full queue => want it refused, but it was queued")
+	}
+
+	close(block)
+	p.Wait()
+	if n := atomic.LoadInt32(&ran); n != 2 {
+		t.Errorf("Jobs run => want 2, got %d", n)
+	}
+
+	// A panicking job doesn't lose the pool its goroutine.
+	p.Submit(func() { panic("oh no") })
+	p.Wait()
+	if !p.Submit(func() { atomic.AddInt32(&ran, 1) }) {
+		t.Fatal("Submit after a panic => want it queued, but it wasn't")
+	}
+	p.Wait()
+	if n := atomic.LoadInt32(&ran); n != 3 {
+		t.Errorf("Jobs run after a panic => want 3, got %d", n)
+	}
+}
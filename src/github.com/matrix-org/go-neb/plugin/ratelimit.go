@@ -0,0 +1,95 @@
+package plugin
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultExpansionCooldown is how long the same text isn't expanded again in a room, unless
+// SetExpansionLimits is called.
+const DefaultExpansionCooldown = 5 * time.Minute
+
+// DefaultMaxExpansionsPerMinute is the most expansions sent into a room in a minute, unless
+// SetExpansionLimits is called.
+const DefaultMaxExpansionsPerMinute = 5
+
+var expansionLimits = newExpansionLimiter(DefaultExpansionCooldown, DefaultMaxExpansionsPerMinute)
+
+// SetExpansionLimits sets how often expansions are sent into each room, so that a conversation
+// about an issue, or a message pasting a list of them, doesn't fill the room with the same details
+// over and over. Text isn't expanded again in a room for the cooldown after it was last expanded,
+// and at most perMinute expansions are sent into a room in any minute. 0 turns either limit off.
+// The limits apply across every plugin and client.
+func SetExpansionLimits(cooldown time.Duration, perMinute int) {
+	expansionLimits = newExpansionLimiter(cooldown, perMinute)
+}
+
+// An expansionLimiter remembers which expansions have been sent into which rooms recently.
+type expansionLimiter struct {
+	cooldown  time.Duration
+	perMinute int
+
+	mu       sync.Mutex
+	expanded map[string]time.Time   // room ID, regexp and text => when it was last expanded
+	recent   map[string][]time.Time // room ID => when expansions were sent in the last minute
+}
+
+func newExpansionLimiter(cooldown time.Duration, perMinute int) *expansionLimiter {
+	return &expansionLimiter{
+		cooldown:  cooldown,
+		perMinute: perMinute,
+		expanded:  make(map[string]time.Time),
+		recent:    make(map[string][]time.Time),
+	}
+}
+
+// allow returns true if the text matching the expansion may be expanded in the room now.
+func (l *expansionLimiter) allow(roomID string, expansion Expansion, text string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if l.cooldown > 0 {
+		for k, t := range l.expanded {
+			if now.Sub(t) >= l.cooldown {
+				delete(l.expanded, k)
+			}
+		}
+		if _, ok := l.expanded[expansionKey(roomID, expansion, text)]; ok {
+			return false
+		}
+	}
+	if l.perMinute > 0 {
+		var times []time.Time
+		for _, t := range l.recent[roomID] {
+			if now.Sub(t) < time.Minute {
+				times = append(times, t)
+			}
+		}
+		if len(times) == 0 {
+			delete(l.recent, roomID)
+		} else {
+			l.recent[roomID] = times
+		}
+		if len(times) >= l.perMinute {
+			return false
+		}
+	}
+	return true
+}
+
+// sent records that the text matching the expansion was expanded in the room.
+func (l *expansionLimiter) sent(roomID string, expansion Expansion, text string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if l.cooldown > 0 {
+		l.expanded[expansionKey(roomID, expansion, text)] = now
+	}
+	if l.perMinute > 0 {
+		l.recent[roomID] = append(l.recent[roomID], now)
+	}
+}
+
+func expansionKey(roomID string, expansion Expansion, text string) string {
+	return roomID + " " + expansion.Regexp.String() + " " + text
+}
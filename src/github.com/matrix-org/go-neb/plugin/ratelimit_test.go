@@ -0,0 +1,40 @@
+package plugin
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestExpansionLimits(t *testing.T) {
+	SetExpansionLimits(50*time.Millisecond, 3)
+	defer SetExpansionLimits(0, 0)
+
+	plugins := []Plugin{makeTestPlugin(nil, []*regexp.Regexp{regexp.MustCompile("[a-z]+#[0-9]+")})}
+	expand := func(roomID, body string) int {
+		event := makeTestEvent("m.text", body)
+		event.RoomID = roomID
+		return len(runCommands(plugins, event))
+	}
+
+	if n := expand("!a:x", "see foo#1 and foo#2"); n != 2 {
+		t.Errorf("First expansions => want 2, got %d", n)
+	}
+	if n := expand("!a:x", "foo#1 again"); n != 0 {
+		t.Errorf("Expanding the same text again straight away => want 0, got %d", n)
+	}
+	if n := expand("!b:x", "foo#1 elsewhere"); n != 1 {
+		t.Errorf("Expanding the same text in another room => want 1, got %d", n)
+	}
+	if n := expand("!a:x", "foo#3 foo#4 foo#5"); n != 1 {
+		t.Errorf("Expanding more than 3 a minute => want 1 more, got %d", n)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if n := expand("!b:x", "foo#1 after the cooldown"); n != 1 {
+		t.Errorf("Expanding the same text after the cooldown => want 1, got %d", n)
+	}
+	if n := expand("!a:x", "foo#1 after the cooldown"); n != 0 {
+		t.Errorf("Expanding after the cooldown but over 3 a minute => want 0, got %d", n)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/ops"
+	"github.com/matrix-org/go-neb/status"
+	"github.com/matrix-org/go-neb/types"
+	"time"
+)
+
+// quietCheckInterval is how often services are checked for having gone quiet.
+const quietCheckInterval = time.Minute
+
+// quietChecker alerts the operators about services which expect webhooks regularly but haven't
+// had a verified one for longer than they expect, which usually means the webhook is broken
+// without anything failing, e.g. because someone deleted it on the remote system.
+type quietChecker struct {
+	db *database.ServiceDB
+	// firstSeen is when each service was first checked, which stands in for its last webhook
+	// until it receives one: activity isn't remembered across restarts.
+	firstSeen map[string]time.Time
+}
+
+func newQuietChecker(db *database.ServiceDB) *quietChecker {
+	return &quietChecker{db: db, firstSeen: make(map[string]time.Time)}
+}
+
+// run checks services every quietCheckInterval, forever.
+func (q *quietChecker) run() {
+	for now := range time.Tick(quietCheckInterval) {
+		q.check(now)
+	}
+}
+
+func (q *quietChecker) check(now time.Time) {
+	services, err := q.db.LoadServices()
+	if err != nil {
+		log.WithError(err).Warn("Failed to load services to check for quiet ones")
+		return
+	}
+	seen := make(map[string]time.Time, len(services))
+	for _, service := range services {
+		alerter, ok := service.(types.QuietAlerter)
+		if !ok {
+			continue
+		}
+		period := alerter.QuietPeriod()
+		if period <= 0 {
+			continue
+		}
+		id := service.ServiceID()
+		last, ok := q.firstSeen[id]
+		if !ok {
+			last = now
+		}
+		seen[id] = last
+		if ms := status.Get(id).LastVerifiedMs; ms > 0 {
+			if verified := time.Unix(0, ms*int64(time.Millisecond)); verified.After(last) {
+				last = verified
+			}
+		}
+		if now.Sub(last) > period {
+			ops.Alert("Service %s (%s) has not received a webhook for over %s. Check that its webhook still exists and is sent to the right URL.",
+				id, service.ServiceType(), period)
+		}
+	}
+	// Forget services which were deleted or stopped expecting webhooks, so that they start afresh
+	// if they come back.
+	q.firstSeen = seen
+}
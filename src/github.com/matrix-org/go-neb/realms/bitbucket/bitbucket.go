@@ -0,0 +1,314 @@
+package realms
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/httpclient"
+	"github.com/matrix-org/go-neb/secrets"
+	"github.com/matrix-org/go-neb/services/bitbucket/client"
+	"github.com/matrix-org/go-neb/tokens"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/go-neb/util"
+	"golang.org/x/oauth2"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// BitbucketRealm can handle OAuth2 processes with Bitbucket Cloud. The scopes sessions are granted
+// are those of the OAuth consumer, as Bitbucket doesn't let them be asked for.
+type BitbucketRealm struct {
+	id          string
+	redirectURL string
+	// ClientID is the OAuth consumer's key, and ClientSecret its secret.
+	ClientSecret secrets.Secret
+	ClientID     secrets.Secret
+}
+
+// BitbucketSession represents an authenticated Bitbucket session
+type BitbucketSession struct {
+	// The client-supplied URL to redirect them to after the auth process is complete.
+	ClientsRedirectURL string
+	// AccessToken is the Bitbucket access token for the user
+	AccessToken string
+	// RefreshToken can be exchanged for a new AccessToken when the current one expires at Expiry.
+	RefreshToken string
+	Expiry       time.Time
+	// Scopes are the set of *ALLOWED* scopes, e.g. "repository webhook"
+	Scopes string
+	// Label tells the session apart from the user's others in the realm. It is empty for their
+	// default session.
+	Label   string
+	id      string
+	userID  string
+	realmID string
+}
+
+// Authenticated returns true if the user has completed the auth process
+func (s *BitbucketSession) Authenticated() bool {
+	return s.AccessToken != ""
+}
+
+// Info returns a list of possible repositories that this session can integrate with.
+func (s *BitbucketSession) Info() interface{} {
+	logger := log.WithFields(log.Fields{
+		"user_id":  s.userID,
+		"realm_id": s.realmID,
+	})
+	r, err := database.GetServiceDB().LoadAuthRealm(s.realmID)
+	if err != nil {
+		logger.WithError(err).Print("Failed to load realm")
+		return nil
+	}
+	realm, ok := r.(*BitbucketRealm)
+	if !ok {
+		logger.Print("Realm is not a BitbucketRealm")
+		return nil
+	}
+	cli, err := realm.bitbucketClient(s.userID, s.Label)
+	if err != nil {
+		logger.WithError(err).Print("Failed to create Bitbucket client")
+		return nil
+	}
+	repos, err := cli.ListRepositories()
+	if err != nil {
+		logger.WithError(err).Print("Failed to query Bitbucket repositories")
+		return nil
+	}
+	logger.Print("BitbucketSession.Info() Returning ", len(repos), " repos")
+	return struct {
+		Repos []client.Repository
+	}{repos}
+}
+
+// Token returns the session's OAuth2 token
+func (s *BitbucketSession) Token() *oauth2.Token {
+	return &oauth2.Token{
+		AccessToken:  s.AccessToken,
+		RefreshToken: s.RefreshToken,
+		Expiry:       s.Expiry,
+	}
+}
+
+// SetToken stores a refreshed OAuth2 token in the session
+func (s *BitbucketSession) SetToken(token *oauth2.Token) {
+	s.AccessToken = token.AccessToken
+	s.RefreshToken = token.RefreshToken
+	s.Expiry = token.Expiry
+}
+
+// SessionLabel returns the label which tells the session apart from the user's others.
+func (s *BitbucketSession) SessionLabel() string {
+	return s.Label
+}
+
+// GrantedScopes returns the scopes the user granted.
+func (s *BitbucketSession) GrantedScopes() []string {
+	return strings.Fields(s.Scopes)
+}
+
+// UserID returns the user_id who authorised with Bitbucket
+func (s *BitbucketSession) UserID() string {
+	return s.userID
+}
+
+// RealmID returns the realm ID of the realm which performed the authentication
+func (s *BitbucketSession) RealmID() string {
+	return s.realmID
+}
+
+// ID returns the session ID
+func (s *BitbucketSession) ID() string {
+	return s.id
+}
+
+// ID returns the realm ID
+func (r *BitbucketRealm) ID() string {
+	return r.id
+}
+
+// Type is bitbucket
+func (r *BitbucketRealm) Type() string {
+	return "bitbucket"
+}
+
+// Init does nothing.
+func (r *BitbucketRealm) Init() error {
+	return nil
+}
+
+// Register checks that the OAuth consumer's credentials are given.
+func (r *BitbucketRealm) Register() error {
+	if r.ClientID.Value() == "" || r.ClientSecret.Value() == "" {
+		return errors.New("ClientID and ClientSecret must be specified")
+	}
+	return nil
+}
+
+// OAuth2Config returns the config used to exchange codes for tokens and refresh them.
+func (r *BitbucketRealm) OAuth2Config() *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     r.ClientID.Value(),
+		ClientSecret: r.ClientSecret.Value(),
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  client.WebURL + "/site/oauth2/authorize",
+			TokenURL: client.WebURL + "/site/oauth2/access_token",
+		},
+		RedirectURL: r.redirectURL,
+	}
+}
+
+// RequestAuthSession generates an OAuth2 URL for this user to auth with Bitbucket via. The session
+// can be stored alongside the user's others with {"Label": "..."}.
+func (r *BitbucketRealm) RequestAuthSession(userID string, req json.RawMessage) interface{} {
+	state, err := util.RandomString(10)
+	if err != nil {
+		log.WithError(err).Print("Failed to generate state param")
+		return nil
+	}
+
+	// check if they supplied a redirect URL or a label
+	var reqBody struct {
+		RedirectURL string
+		Label       string
+	}
+	if err = json.Unmarshal(req, &reqBody); err != nil {
+		log.WithError(err).Print("Failed to decode request body")
+		return nil
+	}
+	u := r.OAuth2Config().AuthCodeURL(state)
+	session := &BitbucketSession{
+		ClientsRedirectURL: reqBody.RedirectURL,
+		Label:              reqBody.Label,
+		id:                 state, // key off the state for redirects
+		userID:             userID,
+		realmID:            r.ID(),
+	}
+	log.WithFields(log.Fields{
+		"clients_redirect_url": session.ClientsRedirectURL,
+		"redirect_url":         u,
+	}).Print("RequestAuthSession: Performing redirect")
+
+	_, err = database.GetServiceDB().StoreAuthSession(session)
+	if err != nil {
+		log.WithError(err).Print("Failed to store new auth session")
+		return nil
+	}
+
+	return &struct {
+		URL string
+	}{u}
+}
+
+// OnReceiveRedirect processes OAuth2 redirect requests from Bitbucket
+func (r *BitbucketRealm) OnReceiveRedirect(w http.ResponseWriter, req *http.Request) {
+	// parse out params from the request
+	code := req.URL.Query().Get("code")
+	state := req.URL.Query().Get("state")
+	logger := log.WithFields(log.Fields{
+		"state": state,
+	})
+	logger.WithField("code", code).Print("BitbucketRealm: OnReceiveRedirect")
+	if code == "" || state == "" {
+		failWith(logger, w, 400, "code and state are required", nil)
+		return
+	}
+	// load the session (we keyed off the state param)
+	session, err := database.GetServiceDB().LoadAuthSessionByID(r.ID(), state)
+	if err != nil {
+		// most likely cause
+		failWith(logger, w, 400, "Provided ?state= param is not recognised.", err)
+		return
+	}
+	bbSession, ok := session.(*BitbucketSession)
+	if !ok {
+		failWith(logger, w, 500, "Unexpected session found.", nil)
+		return
+	}
+	logger.WithField("user_id", bbSession.UserID()).Print("Mapped redirect to user")
+
+	if bbSession.AccessToken != "" {
+		r.redirectOr(w, 400, "You have already authenticated with Bitbucket", logger, bbSession)
+		return
+	}
+
+	// exchange code for access_token
+	token, err := r.OAuth2Config().Exchange(httpclient.Context(), code)
+	if err != nil {
+		failWith(logger, w, 502, "Failed to exchange code for token", err)
+		return
+	}
+
+	// update database and return
+	bbSession.SetToken(token)
+	bbSession.Scopes, _ = token.Extra("scopes").(string) // unlike most providers, "scopes"
+	logger.WithField("scope", bbSession.Scopes).Print("Scopes granted.")
+	_, err = database.GetServiceDB().StoreAuthSession(bbSession)
+	if err != nil {
+		failWith(logger, w, 500, "Failed to persist session", err)
+		return
+	}
+	r.redirectOr(
+		w, 200, "You have successfully linked your Bitbucket account to "+bbSession.UserID(), logger, bbSession,
+	)
+}
+
+func (r *BitbucketRealm) redirectOr(w http.ResponseWriter, code int, msg string, logger *log.Entry, bbSession *BitbucketSession) {
+	if bbSession.ClientsRedirectURL != "" {
+		w.Header().Set("Location", bbSession.ClientsRedirectURL)
+		w.WriteHeader(302)
+		// technically don't need a body but *shrug*
+		w.Write([]byte(bbSession.ClientsRedirectURL))
+	} else {
+		failWith(logger, w, code, msg, nil)
+	}
+}
+
+// AuthSession returns a BitbucketSession for this user
+func (r *BitbucketRealm) AuthSession(id, userID, realmID string) types.AuthSession {
+	return &BitbucketSession{
+		id:      id,
+		userID:  userID,
+		realmID: realmID,
+	}
+}
+
+// BitbucketClient returns a Bitbucket client which performs requests as the given user, with their
+// default session or, if scopes are given, their least privileged session which has them (see
+// tokens.FindSession). Returns an error if the user has no such session in this realm. The user's
+// access token is refreshed first if it is about to expire.
+func (r *BitbucketRealm) BitbucketClient(userID string, scopes ...string) (*client.Client, error) {
+	if len(scopes) == 0 {
+		return r.bitbucketClient(userID, "")
+	}
+	session, err := tokens.FindSession(r.id, userID, scopes...)
+	if err == sql.ErrNoRows {
+		return nil, errors.New(userID + " has not granted access to " + strings.Join(scopes, ", "))
+	} else if err != nil {
+		return nil, err
+	}
+	return r.bitbucketClient(userID, types.SessionLabel(session))
+}
+
+func (r *BitbucketRealm) bitbucketClient(userID, label string) (*client.Client, error) {
+	token, err := tokens.GetTokenForLabel(r.id, userID, label)
+	if err != nil {
+		return nil, err
+	}
+	return client.NewForUser(client.DefaultAPIURL, token.AccessToken, r.id, userID), nil
+}
+
+func failWith(logger *log.Entry, w http.ResponseWriter, code int, msg string, err error) {
+	logger.WithError(err).Print(msg)
+	w.WriteHeader(code)
+	w.Write([]byte(msg))
+}
+
+func init() {
+	types.RegisterAuthRealm(func(realmID, redirectURL string) types.AuthRealm {
+		return &BitbucketRealm{id: realmID, redirectURL: redirectURL}
+	})
+}
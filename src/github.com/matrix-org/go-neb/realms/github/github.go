@@ -1,25 +1,31 @@
 package realms
 
 import (
-	"crypto/rand"
-	"encoding/hex"
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/google/go-github/github"
 	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/httpclient"
+	"github.com/matrix-org/go-neb/secrets"
 	"github.com/matrix-org/go-neb/services/github/client"
 	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/go-neb/util"
+	"golang.org/x/oauth2"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strings"
 )
 
 // GithubRealm can handle OAuth processes with github.com
 type GithubRealm struct {
 	id           string
 	redirectURL  string
-	ClientSecret string
-	ClientID     string
+	ClientSecret secrets.Secret
+	ClientID     secrets.Secret
 	StarterLink  string
 }
 
@@ -30,7 +36,10 @@ type GithubSession struct {
 	// AccessToken is the github access token for the user
 	AccessToken string
 	// Scopes are the set of *ALLOWED* scopes (which may not be the same as the requested scopes)
-	Scopes  string
+	Scopes string
+	// Label tells the session apart from the user's others in the realm. It is empty for their
+	// default session.
+	Label   string
 	id      string
 	userID  string
 	realmID string
@@ -47,7 +56,7 @@ func (s *GithubSession) Info() interface{} {
 		"user_id":  s.userID,
 		"realm_id": s.realmID,
 	})
-	cli := client.New(s.AccessToken)
+	cli := client.NewForUser(s.AccessToken, s.realmID, s.userID)
 	var repos []client.TrimmedRepository
 
 	opts := &github.RepositoryListOptions{
@@ -81,6 +90,32 @@ func (s *GithubSession) Info() interface{} {
 	}{repos}
 }
 
+// Token returns the session's access token. Github tokens don't expire.
+func (s *GithubSession) Token() *oauth2.Token {
+	return &oauth2.Token{AccessToken: s.AccessToken}
+}
+
+// SetToken replaces the session's access token
+func (s *GithubSession) SetToken(token *oauth2.Token) {
+	s.AccessToken = token.AccessToken
+}
+
+// SessionLabel returns the label which tells the session apart from the user's others.
+func (s *GithubSession) SessionLabel() string {
+	return s.Label
+}
+
+// GrantedScopes returns the scopes the user granted.
+func (s *GithubSession) GrantedScopes() []string {
+	var scopes []string
+	for _, scope := range strings.Split(s.Scopes, ",") {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes
+}
+
 // UserID returns the user_id who authorised with Github
 func (s *GithubSession) UserID() string {
 	return s.userID
@@ -116,37 +151,46 @@ func (r *GithubRealm) Register() error {
 	return nil
 }
 
-// RequestAuthSession generates an OAuth2 URL for this user to auth with github via.
+// RequestAuthSession generates an OAuth2 URL for this user to auth with github via. Fewer or other
+// scopes than the default ones can be asked for with {"Scopes": [...]}, and the session can be
+// stored alongside the user's others with {"Label": "..."}.
 func (r *GithubRealm) RequestAuthSession(userID string, req json.RawMessage) interface{} {
-	state, err := randomString(10)
+	state, err := util.RandomString(10)
 	if err != nil {
 		log.WithError(err).Print("Failed to generate state param")
 		return nil
 	}
 
-	u, _ := url.Parse("https://github.com/login/oauth/authorize")
-	q := u.Query()
-	q.Set("client_id", r.ClientID)
-	q.Set("client_secret", r.ClientSecret)
-	q.Set("state", state)
-	q.Set("redirect_uri", r.redirectURL)
-	q.Set("scope", "admin:repo_hook,admin:org_hook,repo")
-	u.RawQuery = q.Encode()
-	session := &GithubSession{
-		id:      state, // key off the state for redirects
-		userID:  userID,
-		realmID: r.ID(),
-	}
-
-	// check if they supplied a redirect URL
+	// check if they supplied a redirect URL, scopes or a label
 	var reqBody struct {
 		RedirectURL string
+		Scopes      []string
+		Label       string
 	}
 	if err = json.Unmarshal(req, &reqBody); err != nil {
 		log.WithError(err).Print("Failed to decode request body")
 		return nil
 	}
-	session.ClientsRedirectURL = reqBody.RedirectURL
+	scopes := []string{"admin:repo_hook", "admin:org_hook", "repo"}
+	if len(reqBody.Scopes) > 0 {
+		scopes = reqBody.Scopes
+	}
+
+	u, _ := url.Parse("https://github.com/login/oauth/authorize")
+	q := u.Query()
+	q.Set("client_id", r.ClientID.Value())
+	q.Set("client_secret", r.ClientSecret.Value())
+	q.Set("state", state)
+	q.Set("redirect_uri", r.redirectURL)
+	q.Set("scope", strings.Join(scopes, ","))
+	u.RawQuery = q.Encode()
+	session := &GithubSession{
+		ClientsRedirectURL: reqBody.RedirectURL,
+		Label:              reqBody.Label,
+		id:                 state, // key off the state for redirects
+		userID:             userID,
+		realmID:            r.ID(),
+	}
 	log.WithFields(log.Fields{
 		"clients_redirect_url": session.ClientsRedirectURL,
 		"redirect_url":         u.String(),
@@ -196,8 +240,8 @@ func (r *GithubRealm) OnReceiveRedirect(w http.ResponseWriter, req *http.Request
 	}
 
 	// exchange code for access_token
-	res, err := http.PostForm("https://github.com/login/oauth/access_token",
-		url.Values{"client_id": {r.ClientID}, "client_secret": {r.ClientSecret}, "code": {code}})
+	res, err := httpclient.Default.PostForm("https://github.com/login/oauth/access_token",
+		url.Values{"client_id": {r.ClientID.Value()}, "client_secret": {r.ClientSecret.Value()}, "code": {code}})
 	if err != nil {
 		failWith(logger, w, 502, "Failed to exchange code for token", err)
 		return
@@ -239,6 +283,37 @@ func (r *GithubRealm) redirectOr(w http.ResponseWriter, code int, msg string, lo
 	}
 }
 
+// RevokeSession revokes the session's access token, so that it stops working straight away.
+func (r *GithubRealm) RevokeSession(session types.AuthSession) error {
+	ghSession, ok := session.(*GithubSession)
+	if !ok {
+		return errors.New("Failed to cast user session to a GithubSession")
+	}
+	body, err := json.Marshal(map[string]string{"access_token": ghSession.AccessToken})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(
+		"DELETE", "https://api.github.com/applications/"+r.ClientID.Value()+"/token", bytes.NewReader(body),
+	)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(r.ClientID.Value(), r.ClientSecret.Value())
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/vnd.github+json")
+	res, err := httpclient.Default.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	// 404 means the token had already been revoked.
+	if res.StatusCode != 204 && res.StatusCode != 404 {
+		return fmt.Errorf("Failed to revoke token: HTTP %d", res.StatusCode)
+	}
+	return nil
+}
+
 // AuthSession returns a GithubSession for this user
 func (r *GithubRealm) AuthSession(id, userID, realmID string) types.AuthSession {
 	return &GithubSession{
@@ -254,17 +329,6 @@ func failWith(logger *log.Entry, w http.ResponseWriter, code int, msg string, er
 	w.Write([]byte(msg))
 }
 
-// Generate a cryptographically secure pseudorandom string with the given number of bytes (length).
-// Returns a hex string of the bytes.
-func randomString(length int) (string, error) {
-	b := make([]byte, length)
-	_, err := rand.Read(b)
-	if err != nil {
-		return "", err
-	}
-	return hex.EncodeToString(b), nil
-}
-
 func init() {
 	types.RegisterAuthRealm(func(realmID, redirectURL string) types.AuthRealm {
 		return &GithubRealm{id: realmID, redirectURL: redirectURL}
@@ -0,0 +1,273 @@
+package realms
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/matrix-org/go-neb/httpclient"
+	"github.com/matrix-org/go-neb/secrets"
+	"github.com/matrix-org/go-neb/types"
+	"golang.org/x/oauth2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultAPIURL is the API of github.com, rather than of a Github Enterprise server.
+const defaultAPIURL = "https://api.github.com"
+
+// jwtLifetime is how long the JWTs which authenticate as the app last. Github allows at most 10
+// minutes.
+const jwtLifetime = 9 * time.Minute
+
+// tokenRefreshMargin is how long before an installation token expires a new one is made, so that
+// a request doesn't start with a token which expires before Github sees it.
+const tokenRefreshMargin = 5 * time.Minute
+
+// GithubAppRealm authenticates as an installation of a Github App, rather than as a user. Services
+// such as github-webhook use it to manage webhooks without depending on someone's OAuth token.
+// Installation tokens are made with a JWT signed by the app's private key, and made again shortly
+// before they expire.
+type GithubAppRealm struct {
+	id          string
+	redirectURL string
+	// AppID is the ID of the Github App, shown on its settings page.
+	AppID int64
+	// InstallationID is the ID of the app's installation on the account whose repositories it is
+	// used for, as in https://github.com/settings/installations/<ID>.
+	InstallationID int64
+	// PrivateKey is a PEM encoded private key of the app, as Github generates them.
+	PrivateKey secrets.Secret
+	// APIURL is the Github API. Optional: "https://api.github.com", or give
+	// "https://github.example.com/api/v3" for a Github Enterprise server.
+	APIURL string
+	key    *rsa.PrivateKey
+}
+
+// GithubAppSession is never stored: the realm authenticates as the app, not as users. It exists
+// to satisfy types.AuthRealm.
+type GithubAppSession struct {
+	id      string
+	userID  string
+	realmID string
+}
+
+// Authenticated returns false: users don't authenticate with the realm.
+func (s *GithubAppSession) Authenticated() bool {
+	return false
+}
+
+// Info returns nothing.
+func (s *GithubAppSession) Info() interface{} {
+	return nil
+}
+
+// UserID returns the user_id of the session
+func (s *GithubAppSession) UserID() string {
+	return s.userID
+}
+
+// RealmID returns the realm ID of the session
+func (s *GithubAppSession) RealmID() string {
+	return s.realmID
+}
+
+// ID returns the session ID
+func (s *GithubAppSession) ID() string {
+	return s.id
+}
+
+// An installationToken is a token which authenticates as an installation, until it expires.
+type installationToken struct {
+	appID          int64
+	installationID int64
+	token          string
+	expires        time.Time
+}
+
+var tokens = struct {
+	sync.Mutex
+	m map[string]*installationToken // realm ID => token
+}{m: make(map[string]*installationToken)}
+
+// ID returns the realm ID
+func (r *GithubAppRealm) ID() string {
+	return r.id
+}
+
+// Type is github-app
+func (r *GithubAppRealm) Type() string {
+	return "github-app"
+}
+
+// Init checks the IDs and the APIURL, and parses the private key.
+func (r *GithubAppRealm) Init() error {
+	if r.AppID <= 0 {
+		return errors.New("AppID is required")
+	}
+	if r.InstallationID <= 0 {
+		return errors.New("InstallationID is required")
+	}
+	if r.APIURL == "" {
+		r.APIURL = defaultAPIURL
+	}
+	u, err := url.Parse(r.APIURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("APIURL must be an http[s]:// URL, got %q", r.APIURL)
+	}
+	r.APIURL = strings.TrimSuffix(r.APIURL, "/")
+	r.key, err = parsePrivateKey(r.PrivateKey.Value())
+	if err != nil {
+		return fmt.Errorf("PrivateKey is not valid: %s", err)
+	}
+	return nil
+}
+
+// Register does nothing.
+func (r *GithubAppRealm) Register() error {
+	return nil
+}
+
+// RequestAuthSession refuses: the realm authenticates as the app, so users have nothing to
+// authenticate.
+func (r *GithubAppRealm) RequestAuthSession(userID string, req json.RawMessage) interface{} {
+	return errors.New("Users don't authenticate with github-app realms: Go-NEB authenticates as the app")
+}
+
+// OnReceiveRedirect is not used: users don't authenticate with the realm.
+func (r *GithubAppRealm) OnReceiveRedirect(w http.ResponseWriter, req *http.Request) {
+	w.WriteHeader(404)
+}
+
+// AuthSession returns a GithubAppSession for this user
+func (r *GithubAppRealm) AuthSession(id, userID, realmID string) types.AuthSession {
+	return &GithubAppSession{
+		id:      id,
+		userID:  userID,
+		realmID: realmID,
+	}
+}
+
+// Token returns a token which authenticates as the installation, as an oauth2.TokenSource. Tokens
+// are shared by every copy of the realm, and a new one is only made when the last is about to
+// expire.
+func (r *GithubAppRealm) Token() (*oauth2.Token, error) {
+	tokens.Lock()
+	defer tokens.Unlock()
+	t := tokens.m[r.id]
+	if t == nil || t.appID != r.AppID || t.installationID != r.InstallationID ||
+		time.Now().Add(tokenRefreshMargin).After(t.expires) {
+		var err error
+		if t, err = r.newInstallationToken(time.Now()); err != nil {
+			return nil, err
+		}
+		tokens.m[r.id] = t
+	}
+	return &oauth2.Token{AccessToken: t.token, TokenType: "token", Expiry: t.expires}, nil
+}
+
+// newInstallationToken asks Github for a new token for the installation.
+func (r *GithubAppRealm) newInstallationToken(now time.Time) (*installationToken, error) {
+	jwt, err := r.jwt(now)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", r.APIURL+"/app/installations/"+strconv.FormatInt(r.InstallationID, 10)+"/access_tokens", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	res, err := httpclient.Default.Do(req)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != 201 {
+		var errRes struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(res.Body).Decode(&errRes)
+		if errRes.Message == "" {
+			return nil, fmt.Errorf("Github returned HTTP %d for an installation token", res.StatusCode)
+		}
+		return nil, fmt.Errorf("Github returned HTTP %d for an installation token: %s", res.StatusCode, errRes.Message)
+	}
+	var body struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	if body.Token == "" {
+		return nil, errors.New("Github returned no installation token")
+	}
+	return &installationToken{r.AppID, r.InstallationID, body.Token, body.ExpiresAt}, nil
+}
+
+// jwt returns a JWT which authenticates as the app, signed with its private key. It is issued a
+// minute in the past, as Github recommends, in case its clock is behind.
+func (r *GithubAppRealm) jwt(now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(jwtLifetime).Unix(),
+		"iss": strconv.FormatInt(r.AppID, 10),
+	})
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	hashed := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, r.key, crypto.SHA256, hashed[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// parsePrivateKey parses a PEM encoded RSA private key, in PKCS #1 form as Github generates them,
+// or in PKCS #8 form.
+func parsePrivateKey(pemKey string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(pemKey))
+	if block == nil {
+		return nil, errors.New("The private key is not PEM encoded")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("The private key is not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+func init() {
+	types.RegisterAuthRealm(func(realmID, redirectURL string) types.AuthRealm {
+		return &GithubAppRealm{id: realmID, redirectURL: redirectURL}
+	})
+}
@@ -0,0 +1,130 @@
+package realms
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/matrix-org/go-neb/secrets"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestRealm(t *testing.T, apiURL string) *GithubAppRealm {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	r := &GithubAppRealm{
+		id:             "app",
+		AppID:          42,
+		InstallationID: 7,
+		PrivateKey:     secrets.New(string(pemKey)),
+		APIURL:         apiURL,
+	}
+	if err = r.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestJWT(t *testing.T) {
+	r := newTestRealm(t, "")
+	now := time.Unix(1500000000, 0)
+	jwt, err := r.jwt(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		t.Fatalf("JWT has %d parts, want 3", len(parts))
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashed := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err = rsa.VerifyPKCS1v15(&r.key.PublicKey, crypto.SHA256, hashed[:], sig); err != nil {
+		t.Fatalf("JWT signature does not verify: %s", err)
+	}
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var claims struct {
+		IAT int64  `json:"iat"`
+		EXP int64  `json:"exp"`
+		ISS string `json:"iss"`
+	}
+	if err = json.Unmarshal(claimsJSON, &claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims.ISS != "42" || claims.IAT != 1499999940 || claims.EXP != 1500000540 {
+		t.Errorf("JWT claims: got %+v", claims)
+	}
+}
+
+func TestInit(t *testing.T) {
+	r := &GithubAppRealm{AppID: 42, InstallationID: 7, PrivateKey: secrets.New("not a key")}
+	if err := r.Init(); err == nil {
+		t.Error("Init: got nil error for a bad private key")
+	}
+	r = &GithubAppRealm{InstallationID: 7}
+	if err := r.Init(); err == nil {
+		t.Error("Init: got nil error without an AppID")
+	}
+}
+
+func TestToken(t *testing.T) {
+	requests := 0
+	expires := time.Now().Add(time.Hour)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		if req.Method != "POST" || req.URL.Path != "/app/installations/7/access_tokens" {
+			t.Errorf("Unexpected request %s %s", req.Method, req.URL.Path)
+		}
+		if !strings.HasPrefix(req.Header.Get("Authorization"), "Bearer ") {
+			t.Errorf("Request is not authenticated with a JWT: %q", req.Header.Get("Authorization"))
+		}
+		w.WriteHeader(201)
+		fmt.Fprintf(w, `{"token":"tok%d","expires_at":%q}`, requests, expires.UTC().Format(time.RFC3339))
+	}))
+	defer srv.Close()
+	tokens.m = make(map[string]*installationToken)
+
+	r := newTestRealm(t, srv.URL)
+	for i := 0; i < 2; i++ {
+		tok, err := r.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tok.AccessToken != "tok1" {
+			t.Errorf("Token %d: got %q, want tok1", i, tok.AccessToken)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("Token: made %d requests, want 1", requests)
+	}
+
+	// Another copy of the realm, as loaded from the database, shares the token.
+	other := *r
+	if tok, err := other.Token(); err != nil || tok.AccessToken != "tok1" {
+		t.Errorf("Token of copy: got %v, %v, want tok1", tok, err)
+	}
+
+	// A token which is about to expire is made again.
+	expires = time.Now().Add(2 * time.Hour)
+	tokens.m["app"].expires = time.Now().Add(time.Minute)
+	if tok, err := r.Token(); err != nil || tok.AccessToken != "tok2" {
+		t.Errorf("Token near expiry: got %v, %v, want tok2", tok, err)
+	}
+}
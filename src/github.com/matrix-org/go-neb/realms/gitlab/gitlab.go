@@ -0,0 +1,360 @@
+package realms
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/httpclient"
+	"github.com/matrix-org/go-neb/secrets"
+	"github.com/matrix-org/go-neb/services/gitlab/client"
+	"github.com/matrix-org/go-neb/tokens"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/go-neb/util"
+	"golang.org/x/oauth2"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// GitlabRealm can handle OAuth2 processes with gitlab.com or a self-hosted GitLab installation.
+type GitlabRealm struct {
+	id           string
+	redirectURL  string
+	BaseURL      string // The URL of the GitLab installation. Defaults to https://gitlab.com
+	ClientSecret secrets.Secret
+	ClientID     secrets.Secret
+	StarterLink  string
+}
+
+// GitlabSession represents an authenticated GitLab session
+type GitlabSession struct {
+	// The client-supplied URL to redirect them to after the auth process is complete.
+	ClientsRedirectURL string
+	// AccessToken is the GitLab access token for the user
+	AccessToken string
+	// RefreshToken can be exchanged for a new AccessToken when the current one expires at Expiry.
+	RefreshToken string
+	Expiry       time.Time
+	// Scopes are the set of *ALLOWED* scopes (which may not be the same as the requested scopes)
+	Scopes string
+	// Label tells the session apart from the user's others in the realm. It is empty for their
+	// default session.
+	Label   string
+	id      string
+	userID  string
+	realmID string
+}
+
+// Authenticated returns true if the user has completed the auth process
+func (s *GitlabSession) Authenticated() bool {
+	return s.AccessToken != ""
+}
+
+// Info returns a list of possible projects that this session can integrate with.
+func (s *GitlabSession) Info() interface{} {
+	logger := log.WithFields(log.Fields{
+		"user_id":  s.userID,
+		"realm_id": s.realmID,
+	})
+	r, err := database.GetServiceDB().LoadAuthRealm(s.realmID)
+	if err != nil {
+		logger.WithError(err).Print("Failed to load realm")
+		return nil
+	}
+	realm, ok := r.(*GitlabRealm)
+	if !ok {
+		logger.Print("Realm is not a GitlabRealm")
+		return nil
+	}
+	cli, err := realm.gitlabClient(s.userID, s.Label)
+	if err != nil {
+		logger.WithError(err).Print("Failed to create GitLab client")
+		return nil
+	}
+	projects, err := cli.ListProjects()
+	if err != nil {
+		logger.WithError(err).Print("Failed to query GitLab projects")
+		return nil
+	}
+	logger.Print("GitlabSession.Info() Returning ", len(projects), " projects")
+	return struct {
+		Projects []client.Project
+	}{projects}
+}
+
+// Token returns the session's OAuth2 token
+func (s *GitlabSession) Token() *oauth2.Token {
+	return &oauth2.Token{
+		AccessToken:  s.AccessToken,
+		RefreshToken: s.RefreshToken,
+		Expiry:       s.Expiry,
+	}
+}
+
+// SetToken stores a refreshed OAuth2 token in the session
+func (s *GitlabSession) SetToken(token *oauth2.Token) {
+	s.AccessToken = token.AccessToken
+	s.RefreshToken = token.RefreshToken
+	s.Expiry = token.Expiry
+}
+
+// SessionLabel returns the label which tells the session apart from the user's others.
+func (s *GitlabSession) SessionLabel() string {
+	return s.Label
+}
+
+// GrantedScopes returns the scopes the user granted.
+func (s *GitlabSession) GrantedScopes() []string {
+	return strings.Fields(s.Scopes)
+}
+
+// UserID returns the user_id who authorised with GitLab
+func (s *GitlabSession) UserID() string {
+	return s.userID
+}
+
+// RealmID returns the realm ID of the realm which performed the authentication
+func (s *GitlabSession) RealmID() string {
+	return s.realmID
+}
+
+// ID returns the session ID
+func (s *GitlabSession) ID() string {
+	return s.id
+}
+
+// ID returns the realm ID
+func (r *GitlabRealm) ID() string {
+	return r.id
+}
+
+// Type is gitlab
+func (r *GitlabRealm) Type() string {
+	return "gitlab"
+}
+
+// Init canonicalises the BaseURL, defaulting it to gitlab.com.
+func (r *GitlabRealm) Init() error {
+	if r.BaseURL == "" {
+		r.BaseURL = client.DefaultBaseURL
+	}
+	u, err := url.Parse(r.BaseURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("BaseURL must be an http[s]:// URL, got %q", r.BaseURL)
+	}
+	r.BaseURL = strings.TrimSuffix(r.BaseURL, "/")
+	return nil
+}
+
+// Register checks that the OAuth2 application credentials are given.
+func (r *GitlabRealm) Register() error {
+	if r.ClientID.Value() == "" || r.ClientSecret.Value() == "" {
+		return errors.New("ClientID and ClientSecret must be specified")
+	}
+	return nil
+}
+
+// OAuth2Config returns the config used to exchange codes for tokens and refresh them.
+func (r *GitlabRealm) OAuth2Config() *oauth2.Config {
+	return r.oauth2Config([]string{"api"})
+}
+
+func (r *GitlabRealm) oauth2Config(scopes []string) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     r.ClientID.Value(),
+		ClientSecret: r.ClientSecret.Value(),
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  r.BaseURL + "/oauth/authorize",
+			TokenURL: r.BaseURL + "/oauth/token",
+		},
+		RedirectURL: r.redirectURL,
+		Scopes:      scopes,
+	}
+}
+
+// RequestAuthSession generates an OAuth2 URL for this user to auth with GitLab via. Other scopes
+// than "api" can be asked for with {"Scopes": [...]}, e.g. "read_api", and the session can be
+// stored alongside the user's others with {"Label": "..."}.
+func (r *GitlabRealm) RequestAuthSession(userID string, req json.RawMessage) interface{} {
+	state, err := util.RandomString(10)
+	if err != nil {
+		log.WithError(err).Print("Failed to generate state param")
+		return nil
+	}
+
+	// check if they supplied a redirect URL, scopes or a label
+	var reqBody struct {
+		RedirectURL string
+		Scopes      []string
+		Label       string
+	}
+	if err = json.Unmarshal(req, &reqBody); err != nil {
+		log.WithError(err).Print("Failed to decode request body")
+		return nil
+	}
+	cfg := r.OAuth2Config()
+	if len(reqBody.Scopes) > 0 {
+		cfg = r.oauth2Config(reqBody.Scopes)
+	}
+	u := cfg.AuthCodeURL(state)
+	session := &GitlabSession{
+		ClientsRedirectURL: reqBody.RedirectURL,
+		Label:              reqBody.Label,
+		id:                 state, // key off the state for redirects
+		userID:             userID,
+		realmID:            r.ID(),
+	}
+	log.WithFields(log.Fields{
+		"clients_redirect_url": session.ClientsRedirectURL,
+		"redirect_url":         u,
+	}).Print("RequestAuthSession: Performing redirect")
+
+	_, err = database.GetServiceDB().StoreAuthSession(session)
+	if err != nil {
+		log.WithError(err).Print("Failed to store new auth session")
+		return nil
+	}
+
+	return &struct {
+		URL string
+	}{u}
+}
+
+// OnReceiveRedirect processes OAuth2 redirect requests from GitLab
+func (r *GitlabRealm) OnReceiveRedirect(w http.ResponseWriter, req *http.Request) {
+	// parse out params from the request
+	code := req.URL.Query().Get("code")
+	state := req.URL.Query().Get("state")
+	logger := log.WithFields(log.Fields{
+		"state": state,
+	})
+	logger.WithField("code", code).Print("GitlabRealm: OnReceiveRedirect")
+	if code == "" || state == "" {
+		failWith(logger, w, 400, "code and state are required", nil)
+		return
+	}
+	// load the session (we keyed off the state param)
+	session, err := database.GetServiceDB().LoadAuthSessionByID(r.ID(), state)
+	if err != nil {
+		// most likely cause
+		failWith(logger, w, 400, "Provided ?state= param is not recognised.", err)
+		return
+	}
+	glSession, ok := session.(*GitlabSession)
+	if !ok {
+		failWith(logger, w, 500, "Unexpected session found.", nil)
+		return
+	}
+	logger.WithField("user_id", glSession.UserID()).Print("Mapped redirect to user")
+
+	if glSession.AccessToken != "" {
+		r.redirectOr(w, 400, "You have already authenticated with GitLab", logger, glSession)
+		return
+	}
+
+	// exchange code for access_token
+	token, err := r.OAuth2Config().Exchange(httpclient.Context(), code)
+	if err != nil {
+		failWith(logger, w, 502, "Failed to exchange code for token", err)
+		return
+	}
+
+	// update database and return
+	glSession.SetToken(token)
+	glSession.Scopes, _ = token.Extra("scope").(string)
+	logger.WithField("scope", glSession.Scopes).Print("Scopes granted.")
+	_, err = database.GetServiceDB().StoreAuthSession(glSession)
+	if err != nil {
+		failWith(logger, w, 500, "Failed to persist session", err)
+		return
+	}
+	r.redirectOr(
+		w, 200, "You have successfully linked your GitLab account to "+glSession.UserID(), logger, glSession,
+	)
+}
+
+func (r *GitlabRealm) redirectOr(w http.ResponseWriter, code int, msg string, logger *log.Entry, glSession *GitlabSession) {
+	if glSession.ClientsRedirectURL != "" {
+		w.Header().Set("Location", glSession.ClientsRedirectURL)
+		w.WriteHeader(302)
+		// technically don't need a body but *shrug*
+		w.Write([]byte(glSession.ClientsRedirectURL))
+	} else {
+		failWith(logger, w, code, msg, nil)
+	}
+}
+
+// RevokeSession revokes the session's access and refresh tokens, so that they stop working straight
+// away.
+func (r *GitlabRealm) RevokeSession(session types.AuthSession) error {
+	glSession, ok := session.(*GitlabSession)
+	if !ok {
+		return errors.New("Failed to cast user session to a GitlabSession")
+	}
+	res, err := httpclient.Default.PostForm(r.BaseURL+"/oauth/revoke", url.Values{
+		"client_id":     {r.ClientID.Value()},
+		"client_secret": {r.ClientSecret.Value()},
+		"token":         {glSession.AccessToken},
+	})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("Failed to revoke token: HTTP %d", res.StatusCode)
+	}
+	return nil
+}
+
+// AuthSession returns a GitlabSession for this user
+func (r *GitlabRealm) AuthSession(id, userID, realmID string) types.AuthSession {
+	return &GitlabSession{
+		id:      id,
+		userID:  userID,
+		realmID: realmID,
+	}
+}
+
+// GitlabClient returns a GitLab client which performs requests as the given user, with their
+// default session or, if scopes are given, their least privileged session which has them (see
+// tokens.FindSession). Returns an error if the user has no such session in this realm. The user's
+// access token is refreshed first if it is about to expire.
+func (r *GitlabRealm) GitlabClient(userID string, scopes ...string) (*client.Client, error) {
+	if len(scopes) == 0 {
+		return r.gitlabClient(userID, "")
+	}
+	session, err := tokens.FindSession(r.id, userID, scopes...)
+	if err == sql.ErrNoRows {
+		return nil, errors.New(userID + " has not granted access to " + strings.Join(scopes, ", "))
+	} else if err != nil {
+		return nil, err
+	}
+	return r.gitlabClient(userID, types.SessionLabel(session))
+}
+
+func (r *GitlabRealm) gitlabClient(userID, label string) (*client.Client, error) {
+	token, err := tokens.GetTokenForLabel(r.id, userID, label)
+	if err != nil {
+		return nil, err
+	}
+	return client.NewForUser(r.BaseURL, token.AccessToken, r.id, userID), nil
+}
+
+func failWith(logger *log.Entry, w http.ResponseWriter, code int, msg string, err error) {
+	logger.WithError(err).Print(msg)
+	w.WriteHeader(code)
+	w.Write([]byte(msg))
+}
+
+func init() {
+	types.RegisterAuthRealm(func(realmID, redirectURL string) types.AuthRealm {
+		return &GitlabRealm{id: realmID, redirectURL: redirectURL}
+	})
+}
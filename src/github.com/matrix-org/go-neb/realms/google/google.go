@@ -0,0 +1,376 @@
+package realms
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/httpclient"
+	"github.com/matrix-org/go-neb/secrets"
+	"github.com/matrix-org/go-neb/tokens"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/go-neb/util"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// GoogleRealm can handle OAuth2 processes with Google. Services such as calendars or translation
+// use it to act as a user. Users can grant more scopes later without losing the ones they have
+// already granted.
+type GoogleRealm struct {
+	id           string
+	redirectURL  string
+	ClientSecret secrets.Secret
+	ClientID     secrets.Secret
+	// The scopes every session is asked for, e.g. "https://www.googleapis.com/auth/calendar.readonly".
+	// Sessions can ask for more when they are requested.
+	Scopes      []string
+	StarterLink string
+}
+
+// GoogleSession represents an authenticated Google session
+type GoogleSession struct {
+	// The client-supplied URL to redirect them to after the auth process is complete.
+	ClientsRedirectURL string
+	// AccessToken is the Google access token for the user. It expires at Expiry.
+	AccessToken string
+	// RefreshToken is exchanged for a new AccessToken when the current one expires.
+	RefreshToken string
+	Expiry       time.Time
+	// Scopes are the set of *ALLOWED* scopes (which may not be the same as the requested scopes)
+	Scopes []string
+	// Label tells the session apart from the user's others in the realm. It is empty for their
+	// default session.
+	Label   string
+	id      string
+	userID  string
+	realmID string
+}
+
+// Authenticated returns true if the user has completed the auth process
+func (s *GoogleSession) Authenticated() bool {
+	return s.AccessToken != ""
+}
+
+// Info returns the scopes the user has granted and when the current access token expires.
+func (s *GoogleSession) Info() interface{} {
+	return struct {
+		Scopes      []string
+		Expiry      time.Time
+		Refreshable bool
+	}{s.Scopes, s.Expiry, s.RefreshToken != ""}
+}
+
+// UserID returns the user_id who authorised with Google
+func (s *GoogleSession) UserID() string {
+	return s.userID
+}
+
+// RealmID returns the realm ID of the realm which performed the authentication
+func (s *GoogleSession) RealmID() string {
+	return s.realmID
+}
+
+// ID returns the session ID
+func (s *GoogleSession) ID() string {
+	return s.id
+}
+
+// Token returns the session's OAuth2 token
+func (s *GoogleSession) Token() *oauth2.Token {
+	return &oauth2.Token{
+		AccessToken:  s.AccessToken,
+		RefreshToken: s.RefreshToken,
+		Expiry:       s.Expiry,
+	}
+}
+
+// SetToken stores a refreshed OAuth2 token in the session
+func (s *GoogleSession) SetToken(token *oauth2.Token) {
+	s.AccessToken = token.AccessToken
+	s.RefreshToken = token.RefreshToken
+	s.Expiry = token.Expiry
+}
+
+// SessionLabel returns the label which tells the session apart from the user's others.
+func (s *GoogleSession) SessionLabel() string {
+	return s.Label
+}
+
+// GrantedScopes returns the scopes the user granted.
+func (s *GoogleSession) GrantedScopes() []string {
+	return s.Scopes
+}
+
+// HasScopes returns true if the user has granted all of the given scopes.
+func (s *GoogleSession) HasScopes(scopes ...string) bool {
+	for _, want := range scopes {
+		found := false
+		for _, got := range s.Scopes {
+			if got == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// ID returns the realm ID
+func (r *GoogleRealm) ID() string {
+	return r.id
+}
+
+// Type is google
+func (r *GoogleRealm) Type() string {
+	return "google"
+}
+
+// Init does nothing.
+func (r *GoogleRealm) Init() error {
+	return nil
+}
+
+// Register checks that the OAuth2 client credentials are given.
+func (r *GoogleRealm) Register() error {
+	if r.ClientID.Value() == "" || r.ClientSecret.Value() == "" {
+		return errors.New("ClientID and ClientSecret must be specified")
+	}
+	return nil
+}
+
+func (r *GoogleRealm) oauth2Config(scopes []string) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     r.ClientID.Value(),
+		ClientSecret: r.ClientSecret.Value(),
+		Endpoint:     google.Endpoint,
+		RedirectURL:  r.redirectURL,
+		Scopes:       scopes,
+	}
+}
+
+// OAuth2Config returns the config used to refresh users' tokens
+func (r *GoogleRealm) OAuth2Config() *oauth2.Config {
+	return r.oauth2Config(nil)
+}
+
+// RequestAuthSession generates an OAuth2 URL for this user to auth with Google via. Scopes beyond
+// the realm's can be asked for with {"Scopes": [...]}. If the user has already authenticated, their
+// existing session keeps working until they have granted the new scopes. The session can be stored
+// alongside the user's others with {"Label": "..."}.
+func (r *GoogleRealm) RequestAuthSession(userID string, req json.RawMessage) interface{} {
+	state, err := util.RandomString(10)
+	if err != nil {
+		log.WithError(err).Print("Failed to generate state param")
+		return nil
+	}
+
+	// check if they supplied a redirect URL, extra scopes or a label
+	var reqBody struct {
+		RedirectURL string
+		Scopes      []string
+		Label       string
+	}
+	if err = json.Unmarshal(req, &reqBody); err != nil {
+		log.WithError(err).Print("Failed to decode request body")
+		return nil
+	}
+
+	session := &GoogleSession{
+		Label:   reqBody.Label,
+		id:      state, // key off the state for redirects
+		userID:  userID,
+		realmID: r.ID(),
+	}
+	old, err := database.GetServiceDB().LoadAuthSessionByLabel(r.ID(), userID, reqBody.Label)
+	if err != nil && err != sql.ErrNoRows {
+		log.WithError(err).Print("Failed to load existing auth session")
+		return nil
+	}
+	if oldSession, ok := old.(*GoogleSession); ok {
+		// Keep the tokens the user already has, so that services keep working in the meantime.
+		session.AccessToken = oldSession.AccessToken
+		session.RefreshToken = oldSession.RefreshToken
+		session.Expiry = oldSession.Expiry
+		session.Scopes = oldSession.Scopes
+	}
+	session.ClientsRedirectURL = reqBody.RedirectURL
+
+	opts := []oauth2.AuthCodeOption{oauth2.AccessTypeOffline}
+	if reqBody.Label == "" || old != nil {
+		// Grant the new scopes on top of the ones already granted, rather than instead of them.
+		// A new labelled session only gets the scopes asked for, so it can be less privileged.
+		opts = append(opts, oauth2.SetAuthURLParam("include_granted_scopes", "true"))
+	}
+	if session.RefreshToken == "" {
+		// Google only returns a refresh token the first time the user consents, unless asked to
+		// show the consent screen again.
+		opts = append(opts, oauth2.ApprovalForce)
+	}
+	u := r.oauth2Config(unionScopes(r.Scopes, reqBody.Scopes)).AuthCodeURL(state, opts...)
+	log.WithFields(log.Fields{
+		"clients_redirect_url": session.ClientsRedirectURL,
+		"redirect_url":         u,
+	}).Print("RequestAuthSession: Performing redirect")
+
+	_, err = database.GetServiceDB().StoreAuthSession(session)
+	if err != nil {
+		log.WithError(err).Print("Failed to store new auth session")
+		return nil
+	}
+
+	return &struct {
+		URL string
+	}{u}
+}
+
+// OnReceiveRedirect processes OAuth2 redirect requests from Google
+func (r *GoogleRealm) OnReceiveRedirect(w http.ResponseWriter, req *http.Request) {
+	// parse out params from the request
+	code := req.URL.Query().Get("code")
+	state := req.URL.Query().Get("state")
+	logger := log.WithFields(log.Fields{
+		"state": state,
+	})
+	logger.WithField("code", code).Print("GoogleRealm: OnReceiveRedirect")
+	if code == "" || state == "" {
+		failWith(logger, w, 400, "code and state are required", nil)
+		return
+	}
+	// load the session (we keyed off the state param)
+	session, err := database.GetServiceDB().LoadAuthSessionByID(r.ID(), state)
+	if err != nil {
+		// most likely cause
+		failWith(logger, w, 400, "Provided ?state= param is not recognised.", err)
+		return
+	}
+	gSession, ok := session.(*GoogleSession)
+	if !ok {
+		failWith(logger, w, 500, "Unexpected session found.", nil)
+		return
+	}
+	logger.WithField("user_id", gSession.UserID()).Print("Mapped redirect to user")
+
+	// exchange code for access_token
+	token, err := r.oauth2Config(nil).Exchange(httpclient.Context(), code)
+	if err != nil {
+		failWith(logger, w, 502, "Failed to exchange code for token", err)
+		return
+	}
+
+	// update database and return
+	gSession.AccessToken = token.AccessToken
+	gSession.Expiry = token.Expiry
+	if token.RefreshToken != "" {
+		// Only sent the first time the user consents.
+		gSession.RefreshToken = token.RefreshToken
+	}
+	if scope, ok := token.Extra("scope").(string); ok {
+		gSession.Scopes = unionScopes(strings.Fields(scope))
+	}
+	logger.WithField("scope", gSession.Scopes).Print("Scopes granted.")
+	_, err = database.GetServiceDB().StoreAuthSession(gSession)
+	if err != nil {
+		failWith(logger, w, 500, "Failed to persist session", err)
+		return
+	}
+	r.redirectOr(
+		w, 200, "You have successfully linked your Google account to "+gSession.UserID(), logger, gSession,
+	)
+}
+
+func (r *GoogleRealm) redirectOr(w http.ResponseWriter, code int, msg string, logger *log.Entry, gSession *GoogleSession) {
+	if gSession.ClientsRedirectURL != "" {
+		w.Header().Set("Location", gSession.ClientsRedirectURL)
+		w.WriteHeader(302)
+		// technically don't need a body but *shrug*
+		w.Write([]byte(gSession.ClientsRedirectURL))
+	} else {
+		failWith(logger, w, code, msg, nil)
+	}
+}
+
+// RevokeSession revokes the user's grant, so that neither of the session's tokens work any more.
+func (r *GoogleRealm) RevokeSession(session types.AuthSession) error {
+	gSession, ok := session.(*GoogleSession)
+	if !ok {
+		return errors.New("Failed to cast user session to a GoogleSession")
+	}
+	// Revoking the refresh token revokes the access tokens made with it too.
+	token := gSession.RefreshToken
+	if token == "" {
+		token = gSession.AccessToken
+	}
+	res, err := httpclient.Default.PostForm("https://oauth2.googleapis.com/revoke", url.Values{"token": {token}})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("Failed to revoke token: HTTP %d", res.StatusCode)
+	}
+	return nil
+}
+
+// AuthSession returns a GoogleSession for this user
+func (r *GoogleRealm) AuthSession(id, userID, realmID string) types.AuthSession {
+	return &GoogleSession{
+		id:      id,
+		userID:  userID,
+		realmID: realmID,
+	}
+}
+
+// GoogleClient returns an HTTP client which makes requests to Google APIs as the given user, with
+// their least privileged session which has all of the given scopes (see tokens.FindSession). The
+// access token is refreshed shortly before it expires.
+func (r *GoogleRealm) GoogleClient(userID string, scopes ...string) (*http.Client, error) {
+	session, err := tokens.FindSession(r.id, userID, scopes...)
+	if err == sql.ErrNoRows {
+		if len(scopes) == 0 {
+			return nil, errors.New("No authenticated Google session found for " + userID)
+		}
+		return nil, errors.New(userID + " has not granted access to " + strings.Join(scopes, ", "))
+	} else if err != nil {
+		return nil, err
+	}
+	return tokens.ClientForLabel(r, userID, types.SessionLabel(session)), nil
+}
+
+// unionScopes returns the sorted, de-duplicated union of the given lists of scopes.
+func unionScopes(lists ...[]string) []string {
+	set := make(map[string]bool)
+	for _, list := range lists {
+		for _, scope := range list {
+			set[scope] = true
+		}
+	}
+	scopes := []string{}
+	for scope := range set {
+		scopes = append(scopes, scope)
+	}
+	sort.Strings(scopes)
+	return scopes
+}
+
+func failWith(logger *log.Entry, w http.ResponseWriter, code int, msg string, err error) {
+	logger.WithError(err).Print(msg)
+	w.WriteHeader(code)
+	w.Write([]byte(msg))
+}
+
+func init() {
+	types.RegisterAuthRealm(func(realmID, redirectURL string) types.AuthRealm {
+		return &GoogleRealm{id: realmID, redirectURL: redirectURL}
+	})
+}
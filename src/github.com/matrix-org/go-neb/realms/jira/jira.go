@@ -12,11 +12,13 @@ import (
 	"github.com/andygrunwald/go-jira"
 	"github.com/dghubble/oauth1"
 	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/httpclient"
 	"github.com/matrix-org/go-neb/realms/jira/urls"
+	"github.com/matrix-org/go-neb/secrets"
 	"github.com/matrix-org/go-neb/types"
-	"golang.org/x/net/context"
 	"net/http"
 	"strings"
+	"time"
 )
 
 // JIRARealm is an AuthRealm which can process JIRA installations
@@ -25,31 +27,40 @@ type JIRARealm struct {
 	redirectURL    string
 	privateKey     *rsa.PrivateKey
 	JIRAEndpoint   string
+	AuthType       string // "oauth1" (the default) for JIRA Server, or "oauth2" for Atlassian Cloud.
 	Server         string // clobbered based on /serverInfo request
 	Version        string // clobbered based on /serverInfo request
 	ConsumerName   string
-	ConsumerKey    string
-	ConsumerSecret string
+	ConsumerKey    secrets.Secret
+	ConsumerSecret secrets.Secret
 	PublicKeyPEM   string // clobbered based on PrivateKeyPEM
-	PrivateKeyPEM  string
-	HasWebhook     bool // clobbered based on NEB
+	PrivateKeyPEM  secrets.Secret
+	HasWebhook     bool           // clobbered based on NEB
+	ClientID       secrets.Secret // oauth2 only
+	ClientSecret   secrets.Secret // oauth2 only
 	StarterLink    string
 }
 
 // JIRASession represents a single authentication session between a user and a JIRA endpoint.
 // The endpoint is dictated by the realm ID.
 type JIRASession struct {
-	id                 string // request token
+	id                 string // request token for oauth1, state for oauth2
 	userID             string
 	realmID            string
-	RequestSecret      string
+	RequestSecret      string // oauth1 only
 	AccessToken        string
-	AccessSecret       string
-	ClientsRedirectURL string // where to redirect the client to after auth
+	AccessSecret       string    // oauth1 only
+	RefreshToken       string    // oauth2 only
+	Expiry             time.Time // oauth2 only: when AccessToken expires
+	CloudID            string    // oauth2 only: the ID of the Atlassian Cloud site, used in API URLs
+	ClientsRedirectURL string    // where to redirect the client to after auth
 }
 
 // Authenticated returns true if the user has completed the auth process
 func (s *JIRASession) Authenticated() bool {
+	if s.CloudID != "" {
+		return s.AccessToken != ""
+	}
 	return s.AccessToken != "" && s.AccessSecret != ""
 }
 
@@ -68,8 +79,8 @@ func (s *JIRASession) RealmID() string {
 	return s.realmID
 }
 
-// ID returns the OAuth1 request_token which is used when looking up sessions in the redirect
-// handler.
+// ID returns the OAuth1 request_token or OAuth2 state which is used when looking up sessions in the
+// redirect handler.
 func (s *JIRASession) ID() string {
 	return s.id
 }
@@ -84,11 +95,20 @@ func (r *JIRARealm) Type() string {
 	return "jira"
 }
 
-// Init initialises the private key for this JIRA realm.
+// Init initialises the private key for this JIRA realm, if it uses OAuth1.
 func (r *JIRARealm) Init() error {
-	if err := r.parsePrivateKey(); err != nil {
-		log.WithError(err).Print("Failed to parse private key")
-		return err
+	switch r.AuthType {
+	case "":
+		r.AuthType = authTypeOAuth1
+		fallthrough
+	case authTypeOAuth1:
+		if err := r.parsePrivateKey(); err != nil {
+			log.WithError(err).Print("Failed to parse private key")
+			return err
+		}
+	case authTypeOAuth2:
+	default:
+		return fmt.Errorf("AuthType must be %q or %q", authTypeOAuth1, authTypeOAuth2)
 	}
 	// Parse the messy input URL into a canonicalised form.
 	ju, err := urls.ParseJIRAURL(r.JIRAEndpoint)
@@ -102,7 +122,11 @@ func (r *JIRARealm) Init() error {
 
 // Register is called when this realm is being created from an external entity
 func (r *JIRARealm) Register() error {
-	if r.ConsumerName == "" || r.ConsumerKey == "" || r.ConsumerSecret == "" || r.PrivateKeyPEM == "" {
+	if r.AuthType == authTypeOAuth2 {
+		if r.ClientID.Value() == "" || r.ClientSecret.Value() == "" {
+			return errors.New("ClientID and ClientSecret must be specified.")
+		}
+	} else if r.ConsumerName == "" || r.ConsumerKey.Value() == "" || r.ConsumerSecret.Value() == "" || r.PrivateKeyPEM.Value() == "" {
 		return errors.New("ConsumerName, ConsumerKey, ConsumerSecret, PrivateKeyPEM must be specified.")
 	}
 	if r.JIRAEndpoint == "" {
@@ -142,6 +166,9 @@ func (r *JIRARealm) RequestAuthSession(userID string, req json.RawMessage) inter
 		log.WithError(err).Print("Failed to decode request body")
 		return nil
 	}
+	if r.AuthType == authTypeOAuth2 {
+		return r.requestOAuth2Session(userID, reqBody.RedirectURL)
+	}
 
 	authConfig := r.oauth1Config(r.JIRAEndpoint)
 	reqToken, reqSec, err := authConfig.RequestToken()
@@ -175,6 +202,10 @@ func (r *JIRARealm) RequestAuthSession(userID string, req json.RawMessage) inter
 
 // OnReceiveRedirect is called when JIRA installations redirect back to NEB
 func (r *JIRARealm) OnReceiveRedirect(w http.ResponseWriter, req *http.Request) {
+	if r.AuthType == authTypeOAuth2 {
+		r.onReceiveOAuth2Redirect(w, req)
+		return
+	}
 	logger := log.WithField("jira_url", r.JIRAEndpoint)
 
 	requestToken, verifier, err := oauth1.ParseAuthorizationCallback(req)
@@ -214,9 +245,15 @@ func (r *JIRARealm) OnReceiveRedirect(w http.ResponseWriter, req *http.Request)
 		failWith(logger, w, 500, "Failed to persist JIRA session", err)
 		return
 	}
+	r.redirectOr(w, jiraSession)
+}
+
+// redirectOr redirects the user to the session's ClientsRedirectURL after they have authenticated,
+// or tells them they have if there isn't one.
+func (r *JIRARealm) redirectOr(w http.ResponseWriter, jiraSession *JIRASession) {
 	if jiraSession.ClientsRedirectURL != "" {
-		w.WriteHeader(302)
 		w.Header().Set("Location", jiraSession.ClientsRedirectURL)
+		w.WriteHeader(302)
 		// technically don't need a body but *shrug*
 		w.Write([]byte(jiraSession.ClientsRedirectURL))
 	} else {
@@ -283,7 +320,7 @@ func (r *JIRARealm) JIRAClient(userID string, allowUnauth bool) (*jira.Client, e
 		if err == sql.ErrNoRows {
 			if allowUnauth {
 				// make an unauthenticated client
-				return jira.NewClient(nil, r.JIRAEndpoint)
+				return jira.NewClient(httpclient.Default, r.JIRAEndpoint)
 			}
 		}
 		return nil, err
@@ -294,19 +331,23 @@ func (r *JIRARealm) JIRAClient(userID string, allowUnauth bool) (*jira.Client, e
 		return nil, errors.New("Failed to cast user session to a JIRASession")
 	}
 	// Make sure they finished the auth process
-	if jsession.AccessSecret == "" || jsession.AccessToken == "" {
+	if !jsession.Authenticated() {
 		if allowUnauth {
 			// make an unauthenticated client
-			return jira.NewClient(nil, r.JIRAEndpoint)
+			return jira.NewClient(httpclient.Default, r.JIRAEndpoint)
 		}
 		return nil, errors.New("No authenticated session found for " + userID)
 	}
 	// make an authenticated client
+	if jsession.CloudID != "" {
+		return r.oauth2JIRAClient(jsession)
+	}
 	auth := r.oauth1Config(r.JIRAEndpoint)
 	httpClient := auth.Client(
-		context.TODO(),
+		httpclient.Context(),
 		oauth1.NewToken(jsession.AccessToken, jsession.AccessSecret),
 	)
+	httpClient.Timeout = httpclient.DefaultTimeout
 	return jira.NewClient(httpClient, r.JIRAEndpoint)
 }
 
@@ -314,7 +355,7 @@ func (r *JIRARealm) parsePrivateKey() error {
 	if r.privateKey != nil {
 		return nil
 	}
-	pk, err := loadPrivateKey(r.PrivateKeyPEM)
+	pk, err := loadPrivateKey(r.PrivateKeyPEM.Value())
 	if err != nil {
 		return err
 	}
@@ -329,8 +370,8 @@ func (r *JIRARealm) parsePrivateKey() error {
 
 func (r *JIRARealm) oauth1Config(jiraBaseURL string) *oauth1.Config {
 	return &oauth1.Config{
-		ConsumerKey:    r.ConsumerKey,
-		ConsumerSecret: r.ConsumerSecret,
+		ConsumerKey:    r.ConsumerKey.Value(),
+		ConsumerSecret: r.ConsumerSecret.Value(),
 		CallbackURL:    r.redirectURL,
 		// TODO: In JIRA Cloud, the Authorization URL is only the Instance BASE_URL:
 		//    https://BASE_URL.atlassian.net.
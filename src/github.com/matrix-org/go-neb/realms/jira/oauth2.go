@@ -0,0 +1,177 @@
+package realms
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/andygrunwald/go-jira"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/httpclient"
+	"github.com/matrix-org/go-neb/tokens"
+	"github.com/matrix-org/go-neb/util"
+	"golang.org/x/oauth2"
+	"net/http"
+	"strings"
+)
+
+// The ways a JIRARealm can authenticate users, set with AuthType.
+const (
+	authTypeOAuth1 = "oauth1" // OAuth 1.0a application links, for JIRA Server
+	authTypeOAuth2 = "oauth2" // OAuth 2.0 (3LO) apps, for Atlassian Cloud
+)
+
+// atlassianAPIURL is where Atlassian Cloud APIs are called with OAuth 2.0 tokens, rather than on
+// the site itself.
+const atlassianAPIURL = "https://api.atlassian.com/"
+
+var atlassianEndpoint = oauth2.Endpoint{
+	AuthURL:  "https://auth.atlassian.com/authorize",
+	TokenURL: "https://auth.atlassian.com/oauth/token",
+}
+
+// atlassianScopes lets Go-NEB read and create issues and manage webhooks, and get a refresh token.
+var atlassianScopes = []string{
+	"read:jira-work", "write:jira-work", "read:jira-user", "manage:jira-configuration", "offline_access",
+}
+
+func init() {
+	// Atlassian expects the client credentials in the request body, not in an Authorization header.
+	oauth2.RegisterBrokenAuthHeaderProvider(atlassianEndpoint.TokenURL)
+}
+
+// OAuth2Config returns the config used to refresh users' tokens when AuthType is "oauth2".
+func (r *JIRARealm) OAuth2Config() *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     r.ClientID.Value(),
+		ClientSecret: r.ClientSecret.Value(),
+		Endpoint:     atlassianEndpoint,
+		RedirectURL:  r.redirectURL,
+		Scopes:       atlassianScopes,
+	}
+}
+
+// requestOAuth2Session starts the OAuth 2.0 flow for this user, returning the URL to visit.
+func (r *JIRARealm) requestOAuth2Session(userID, clientsRedirectURL string) interface{} {
+	state, err := util.RandomString(10)
+	if err != nil {
+		log.WithError(err).Print("Failed to generate state param")
+		return nil
+	}
+	authURL := r.OAuth2Config().AuthCodeURL(state,
+		oauth2.SetAuthURLParam("audience", "api.atlassian.com"),
+		oauth2.SetAuthURLParam("prompt", "consent"),
+	)
+	_, err = database.GetServiceDB().StoreAuthSession(&JIRASession{
+		id:                 state, // key off the state for redirects
+		userID:             userID,
+		realmID:            r.id,
+		ClientsRedirectURL: clientsRedirectURL,
+	})
+	if err != nil {
+		log.WithError(err).Print("Failed to store new auth session")
+		return nil
+	}
+	return &struct {
+		URL string
+	}{authURL}
+}
+
+// onReceiveOAuth2Redirect exchanges the code in an OAuth 2.0 redirect for tokens, and finds the ID
+// Atlassian uses for this realm's site in API URLs.
+func (r *JIRARealm) onReceiveOAuth2Redirect(w http.ResponseWriter, req *http.Request) {
+	code := req.URL.Query().Get("code")
+	state := req.URL.Query().Get("state")
+	logger := log.WithFields(log.Fields{
+		"jira_url": r.JIRAEndpoint,
+		"state":    state,
+	})
+	if code == "" || state == "" {
+		failWith(logger, w, 400, "code and state are required", nil)
+		return
+	}
+	session, err := database.GetServiceDB().LoadAuthSessionByID(r.id, state)
+	if err != nil {
+		failWith(logger, w, 400, "Provided ?state= param is not recognised.", err)
+		return
+	}
+	jiraSession, ok := session.(*JIRASession)
+	if !ok {
+		failWith(logger, w, 500, "Unexpected session type found.", nil)
+		return
+	}
+	logger = logger.WithField("user_id", jiraSession.UserID())
+	logger.Print("Retrieved auth session for user")
+
+	token, err := r.OAuth2Config().Exchange(httpclient.Context(), code)
+	if err != nil {
+		failWith(logger, w, 502, "Failed exchange for access token.", err)
+		return
+	}
+	logger.Print("Exchanged for access token")
+
+	cloudID, err := r.findCloudID(httpclient.OAuth2(oauth2.StaticTokenSource(token)))
+	if err != nil {
+		failWith(logger, w, 403, err.Error(), err)
+		return
+	}
+
+	jiraSession.AccessToken = token.AccessToken
+	jiraSession.RefreshToken = token.RefreshToken
+	jiraSession.Expiry = token.Expiry
+	jiraSession.CloudID = cloudID
+	_, err = database.GetServiceDB().StoreAuthSession(jiraSession)
+	if err != nil {
+		failWith(logger, w, 500, "Failed to persist JIRA session", err)
+		return
+	}
+	r.redirectOr(w, jiraSession)
+}
+
+// findCloudID returns the ID of the Atlassian Cloud site at JIRAEndpoint, if the given client's
+// token grants access to it.
+func (r *JIRARealm) findCloudID(httpClient *http.Client) (string, error) {
+	res, err := httpClient.Get(atlassianAPIURL + "oauth/token/accessible-resources")
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return "", fmt.Errorf("Failed to list accessible Atlassian sites: HTTP %d", res.StatusCode)
+	}
+	var sites []struct {
+		ID  string `json:"id"`
+		URL string `json:"url"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&sites); err != nil {
+		return "", err
+	}
+	for _, site := range sites {
+		if strings.TrimSuffix(site.URL, "/") == strings.TrimSuffix(r.JIRAEndpoint, "/") {
+			return site.ID, nil
+		}
+	}
+	return "", fmt.Errorf("Your Atlassian account has not granted access to %s", r.JIRAEndpoint)
+}
+
+// oauth2JIRAClient returns a jira.Client which calls the Atlassian Cloud API with the session's
+// OAuth 2.0 token, refreshing it shortly before it expires.
+func (r *JIRARealm) oauth2JIRAClient(session *JIRASession) (*jira.Client, error) {
+	return jira.NewClient(tokens.Client(r, session.UserID()), atlassianAPIURL+"ex/jira/"+session.CloudID+"/")
+}
+
+// Token returns the session's OAuth 2.0 token. Sessions authenticated with OAuth 1.0a have no
+// expiry, so they are never refreshed.
+func (s *JIRASession) Token() *oauth2.Token {
+	return &oauth2.Token{
+		AccessToken:  s.AccessToken,
+		RefreshToken: s.RefreshToken,
+		Expiry:       s.Expiry,
+	}
+}
+
+// SetToken stores a refreshed OAuth 2.0 token in the session
+func (s *JIRASession) SetToken(token *oauth2.Token) {
+	s.AccessToken = token.AccessToken
+	s.RefreshToken = token.RefreshToken
+	s.Expiry = token.Expiry
+}
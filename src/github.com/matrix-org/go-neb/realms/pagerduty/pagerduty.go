@@ -0,0 +1,277 @@
+package realms
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/httpclient"
+	"github.com/matrix-org/go-neb/types"
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// defaultAPIURL is PagerDuty's REST API, for accounts outside its EU service region.
+const defaultAPIURL = "https://api.pagerduty.com"
+
+// PagerDutyRealm lets users authenticate with a PagerDuty user API token, so that commands such
+// as acknowledging an incident are done as them. Tokens are checked against the API before they
+// are stored.
+type PagerDutyRealm struct {
+	id          string
+	redirectURL string
+	// APIURL is the PagerDuty REST API. Optional: "https://api.pagerduty.com", or give
+	// "https://api.eu.pagerduty.com" for accounts in the EU service region.
+	APIURL      string
+	StarterLink string
+}
+
+// PagerDutySession represents a user API token submitted by a user
+type PagerDutySession struct {
+	// AccessToken is the user API token.
+	AccessToken string
+	// Login is the email address of the PagerDuty user the token belongs to.
+	Login string
+	// PagerDutyUserID is the ID of the PagerDuty user the token belongs to, e.g. "PXPGF42".
+	PagerDutyUserID string
+	id              string
+	userID          string
+	realmID         string
+}
+
+// An Incident is a PagerDuty incident, as the API returns it.
+type Incident struct {
+	ID             string `json:"id"`
+	IncidentNumber int    `json:"incident_number"`
+	Title          string `json:"title"`
+	Status         string `json:"status"`
+	HTMLURL        string `json:"html_url"`
+}
+
+// Authenticated returns true if the user has submitted a working token
+func (s *PagerDutySession) Authenticated() bool {
+	return s.AccessToken != ""
+}
+
+// Info returns the PagerDuty user the token belongs to.
+func (s *PagerDutySession) Info() interface{} {
+	return struct {
+		Login           string
+		PagerDutyUserID string
+	}{s.Login, s.PagerDutyUserID}
+}
+
+// UserID returns the user_id who submitted the token
+func (s *PagerDutySession) UserID() string {
+	return s.userID
+}
+
+// RealmID returns the realm ID of the realm which holds the token
+func (s *PagerDutySession) RealmID() string {
+	return s.realmID
+}
+
+// ID returns the session ID
+func (s *PagerDutySession) ID() string {
+	return s.id
+}
+
+// ID returns the realm ID
+func (r *PagerDutyRealm) ID() string {
+	return r.id
+}
+
+// Type is pagerduty
+func (r *PagerDutyRealm) Type() string {
+	return "pagerduty"
+}
+
+// Init checks and canonicalises the APIURL.
+func (r *PagerDutyRealm) Init() error {
+	if r.APIURL == "" {
+		r.APIURL = defaultAPIURL
+	}
+	u, err := url.Parse(r.APIURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("APIURL must be an http[s]:// URL, got %q", r.APIURL)
+	}
+	r.APIURL = strings.TrimSuffix(r.APIURL, "/")
+	return nil
+}
+
+// Register does nothing.
+func (r *PagerDutyRealm) Register() error {
+	return nil
+}
+
+// TokenHelp tells users which token to make.
+func (r *PagerDutyRealm) TokenHelp() string {
+	return "Make a user API token in PagerDuty, under My Profile > User Settings > Create API User Token"
+}
+
+// RequestAuthSession checks the token in {"Token": "..."} against the API, and stores it if it
+// works. Returns an error describing the problem if it doesn't.
+func (r *PagerDutyRealm) RequestAuthSession(userID string, req json.RawMessage) interface{} {
+	var reqBody struct {
+		Token string
+	}
+	if err := json.Unmarshal(req, &reqBody); err != nil {
+		log.WithError(err).Print("Failed to decode request body")
+		return nil
+	}
+	if reqBody.Token == "" {
+		return errors.New("Token is required. " + r.TokenHelp())
+	}
+	session := &PagerDutySession{
+		AccessToken: reqBody.Token,
+		// There are no redirects, so nothing needs to be keyed off the ID, but it must be unique.
+		id:      userID,
+		userID:  userID,
+		realmID: r.id,
+	}
+	logger := log.WithFields(log.Fields{
+		"user_id":  userID,
+		"realm_id": r.id,
+	})
+	var me struct {
+		User struct {
+			ID    string `json:"id"`
+			Email string `json:"email"`
+		} `json:"user"`
+	}
+	if err := r.do(context.Background(), session, "GET", "/users/me", nil, &me); err != nil {
+		logger.WithError(err).Print("Submitted token did not work")
+		return fmt.Errorf("The token did not work: %s", err)
+	}
+	session.Login = me.User.Email
+	session.PagerDutyUserID = me.User.ID
+	if _, err := database.GetServiceDB().StoreAuthSession(session); err != nil {
+		logger.WithError(err).Print("Failed to store new auth session")
+		return nil
+	}
+	logger.WithField("login", session.Login).Print("Stored PagerDuty token")
+	return &struct {
+		Login string
+	}{session.Login}
+}
+
+// OnReceiveRedirect is not used: users submit tokens directly.
+func (r *PagerDutyRealm) OnReceiveRedirect(w http.ResponseWriter, req *http.Request) {
+	w.WriteHeader(404)
+}
+
+// AuthSession returns a PagerDutySession for this user
+func (r *PagerDutyRealm) AuthSession(id, userID, realmID string) types.AuthSession {
+	return &PagerDutySession{
+		id:      id,
+		userID:  userID,
+		realmID: realmID,
+	}
+}
+
+// UpdateIncident sets the status of the incident, e.g. "acknowledged" or "resolved", as the user.
+// Returns sql.ErrNoRows if the user has not submitted a token.
+func (r *PagerDutyRealm) UpdateIncident(ctx context.Context, userID, incidentID, status string) (*Incident, error) {
+	session, err := r.loadSession(userID)
+	if err != nil {
+		return nil, err
+	}
+	var body struct {
+		Incident struct {
+			Type   string `json:"type"`
+			Status string `json:"status"`
+		} `json:"incident"`
+	}
+	body.Incident.Type = "incident_reference"
+	body.Incident.Status = status
+	var res struct {
+		Incident Incident `json:"incident"`
+	}
+	if err = r.do(ctx, session, "PUT", "/incidents/"+url.PathEscape(incidentID), body, &res); err != nil {
+		return nil, err
+	}
+	return &res.Incident, nil
+}
+
+// do calls the API with the session's token, sending the body as JSON if it isn't nil, and
+// decoding the JSON response into result.
+func (r *PagerDutyRealm) do(ctx context.Context, session *PagerDutySession, method, path string, body, result interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, r.APIURL+path, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.pagerduty+json;version=2")
+	req.Header.Set("Authorization", "Token token="+session.AccessToken)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if session.Login != "" {
+		// Only needed for account tokens, but says who made the change either way.
+		req.Header.Set("From", session.Login)
+	}
+	res, err := ctxhttp.Do(ctx, httpclient.Default, req)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return err
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		var errRes struct {
+			Error struct {
+				Message string   `json:"message"`
+				Errors  []string `json:"errors"`
+			} `json:"error"`
+		}
+		json.NewDecoder(res.Body).Decode(&errRes)
+		msg := errRes.Error.Message
+		if len(errRes.Error.Errors) > 0 {
+			msg += ": " + strings.Join(errRes.Error.Errors, ", ")
+		}
+		if msg == "" {
+			return fmt.Errorf("PagerDuty returned HTTP %d", res.StatusCode)
+		}
+		return fmt.Errorf("PagerDuty returned HTTP %d: %s", res.StatusCode, msg)
+	}
+	return json.NewDecoder(res.Body).Decode(result)
+}
+
+// loadSession returns the user's session. Returns sql.ErrNoRows if they have not submitted a token.
+func (r *PagerDutyRealm) loadSession(userID string) (*PagerDutySession, error) {
+	session, err := database.GetServiceDB().LoadAuthSessionByUser(r.id, userID)
+	if err != nil {
+		return nil, err
+	}
+	pdSession, ok := session.(*PagerDutySession)
+	if !ok {
+		return nil, errors.New("Failed to cast user session to a PagerDutySession")
+	}
+	if !pdSession.Authenticated() {
+		return nil, sql.ErrNoRows
+	}
+	return pdSession, nil
+}
+
+func init() {
+	types.RegisterAuthRealm(func(realmID, redirectURL string) types.AuthRealm {
+		return &PagerDutyRealm{id: realmID, redirectURL: redirectURL}
+	})
+}
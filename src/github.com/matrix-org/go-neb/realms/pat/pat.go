@@ -0,0 +1,394 @@
+package realms
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/andygrunwald/go-jira"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/httpclient"
+	ghclient "github.com/matrix-org/go-neb/services/github/client"
+	glclient "github.com/matrix-org/go-neb/services/gitlab/client"
+	"github.com/matrix-org/go-neb/tokens"
+	"github.com/matrix-org/go-neb/types"
+	"golang.org/x/oauth2"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// The upstreams whose tokens a PATRealm can hold, set with Provider.
+const (
+	providerGithub = "github"
+	providerGitlab = "gitlab"
+	providerJIRA   = "jira"
+)
+
+// PATRealm lets users authenticate by submitting a token they made themselves, rather than with
+// OAuth: a Github or GitLab personal access token, or a JIRA API token. Use it where Go-NEB can't
+// be registered as an OAuth application, e.g. with a self-hosted GitLab or JIRA. Tokens are checked
+// against the upstream API before they are stored.
+type PATRealm struct {
+	id          string
+	redirectURL string
+	// Provider is "github", "gitlab" or "jira".
+	Provider string
+	// BaseURL is the URL of the GitLab or JIRA installation. GitLab defaults to https://gitlab.com.
+	// Not used for Github.
+	BaseURL     string
+	StarterLink string
+}
+
+// PATSession represents a token submitted by a user
+type PATSession struct {
+	// AccessToken is the personal access token or API token.
+	AccessToken string
+	// Username is who the token belongs to, for JIRA: the email address on Atlassian Cloud, or
+	// the username on JIRA Server. Not used for Github and GitLab.
+	Username string
+	// Login is the upstream account the token belongs to, as reported when it was checked.
+	Login string
+	// Scopes are the token's scopes, as reported when it was checked. Only Github classic personal
+	// access tokens and GitLab personal access tokens report them.
+	Scopes []string
+	// Label tells the session apart from the user's others in the realm. It is empty for their
+	// default session.
+	Label   string
+	id      string
+	userID  string
+	realmID string
+}
+
+// Authenticated returns true if the user has submitted a working token
+func (s *PATSession) Authenticated() bool {
+	return s.AccessToken != ""
+}
+
+// Info returns the upstream account the token belongs to, and its scopes.
+func (s *PATSession) Info() interface{} {
+	return struct {
+		Login  string
+		Scopes []string
+	}{s.Login, s.Scopes}
+}
+
+// SessionLabel returns the label which tells the session apart from the user's others.
+func (s *PATSession) SessionLabel() string {
+	return s.Label
+}
+
+// GrantedScopes returns the token's scopes.
+func (s *PATSession) GrantedScopes() []string {
+	return s.Scopes
+}
+
+// UserID returns the user_id who submitted the token
+func (s *PATSession) UserID() string {
+	return s.userID
+}
+
+// RealmID returns the realm ID of the realm which holds the token
+func (s *PATSession) RealmID() string {
+	return s.realmID
+}
+
+// ID returns the session ID
+func (s *PATSession) ID() string {
+	return s.id
+}
+
+// Token returns the session's token. Personal access tokens are not refreshed.
+func (s *PATSession) Token() *oauth2.Token {
+	return &oauth2.Token{AccessToken: s.AccessToken}
+}
+
+// SetToken replaces the session's token
+func (s *PATSession) SetToken(token *oauth2.Token) {
+	s.AccessToken = token.AccessToken
+}
+
+// ID returns the realm ID
+func (r *PATRealm) ID() string {
+	return r.id
+}
+
+// Type is pat
+func (r *PATRealm) Type() string {
+	return "pat"
+}
+
+// Init checks the Provider and canonicalises the BaseURL.
+func (r *PATRealm) Init() error {
+	switch r.Provider {
+	case providerGithub:
+		if r.BaseURL != "" {
+			return errors.New("BaseURL is not supported for Github")
+		}
+		return nil
+	case providerGitlab:
+		if r.BaseURL == "" {
+			r.BaseURL = glclient.DefaultBaseURL
+		}
+	case providerJIRA:
+		if r.BaseURL == "" {
+			return errors.New("BaseURL is required for JIRA")
+		}
+	default:
+		return fmt.Errorf("Provider must be %q, %q or %q, got %q", providerGithub, providerGitlab, providerJIRA, r.Provider)
+	}
+	u, err := url.Parse(r.BaseURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("BaseURL must be an http[s]:// URL, got %q", r.BaseURL)
+	}
+	r.BaseURL = strings.TrimSuffix(r.BaseURL, "/")
+	return nil
+}
+
+// Register does nothing.
+func (r *PATRealm) Register() error {
+	return nil
+}
+
+// TokenHelp tells users which token to make.
+func (r *PATRealm) TokenHelp() string {
+	switch r.Provider {
+	case providerGithub:
+		return "Make a personal access token with the repo scope at https://github.com/settings/tokens"
+	case providerGitlab:
+		return "Make a personal access token with the api scope at " + r.BaseURL + "/-/profile/personal_access_tokens"
+	}
+	return "Make an API token (Atlassian Cloud) or personal access token (JIRA Server) for " + r.BaseURL +
+		", and give your email address (Atlassian Cloud) or username (JIRA Server) before it"
+}
+
+// RequestAuthSession checks the token in {"Token": "...", "Username": "..."} against the upstream
+// API, and stores it if it works. Returns an error describing the problem if it doesn't. The token
+// can be stored alongside the user's others with {"Label": "..."}, e.g. a token for each Github
+// organisation.
+func (r *PATRealm) RequestAuthSession(userID string, req json.RawMessage) interface{} {
+	var reqBody struct {
+		Token    string
+		Username string
+		Label    string
+	}
+	if err := json.Unmarshal(req, &reqBody); err != nil {
+		log.WithError(err).Print("Failed to decode request body")
+		return nil
+	}
+	if reqBody.Token == "" {
+		return errors.New("Token is required. " + r.TokenHelp())
+	}
+	if r.Provider == providerJIRA && reqBody.Username == "" {
+		return errors.New("Username is required for JIRA tokens")
+	}
+	// There are no redirects, so nothing needs to be keyed off the ID, but it must be unique.
+	id := userID
+	if reqBody.Label != "" {
+		id = userID + " " + reqBody.Label
+	}
+	session := &PATSession{
+		AccessToken: reqBody.Token,
+		Username:    reqBody.Username,
+		Label:       reqBody.Label,
+		id:          id,
+		userID:      userID,
+		realmID:     r.id,
+	}
+	logger := log.WithFields(log.Fields{
+		"user_id":  userID,
+		"realm_id": r.id,
+		"label":    reqBody.Label,
+	})
+	login, err := r.checkToken(session)
+	if err != nil {
+		logger.WithError(err).Print("Submitted token did not work")
+		return fmt.Errorf("The token did not work: %s", err)
+	}
+	session.Login = login
+	if _, err = database.GetServiceDB().StoreAuthSession(session); err != nil {
+		logger.WithError(err).Print("Failed to store new auth session")
+		return nil
+	}
+	logger.WithFields(log.Fields{
+		"login":  login,
+		"scopes": session.Scopes,
+	}).Print("Stored personal access token")
+	return &struct {
+		Login string
+	}{login}
+}
+
+// checkToken returns the upstream account the session's token belongs to, or an error if it
+// doesn't work. The token's scopes are recorded in the session where upstream reports them.
+func (r *PATRealm) checkToken(session *PATSession) (string, error) {
+	switch r.Provider {
+	case providerGithub:
+		return r.checkGithubToken(session)
+	case providerGitlab:
+		return r.checkGitlabToken(session)
+	}
+	return r.checkJiraToken(session)
+}
+
+func (r *PATRealm) checkGithubToken(session *PATSession) (string, error) {
+	user, res, err := ghclient.New(session.AccessToken).Users.Get("")
+	if err != nil {
+		return "", err
+	}
+	if user.Login == nil {
+		return "", errors.New("Github did not say who the token belongs to")
+	}
+	// Only classic tokens have scopes: fine-grained ones are limited to repositories instead.
+	for _, scope := range strings.Split(res.Header.Get("X-OAuth-Scopes"), ",") {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			session.Scopes = append(session.Scopes, scope)
+		}
+	}
+	return *user.Login, nil
+}
+
+func (r *PATRealm) checkGitlabToken(session *PATSession) (string, error) {
+	cli := glclient.New(r.BaseURL, session.AccessToken)
+	var user struct {
+		Username string `json:"username"`
+	}
+	if _, err := cli.Do("GET", "/user", nil, &user); err != nil {
+		return "", err
+	}
+	// Older GitLab versions can't say: the token is still usable, just without known scopes.
+	var token struct {
+		Scopes []string `json:"scopes"`
+	}
+	if _, err := cli.Do("GET", "/personal_access_tokens/self", nil, &token); err == nil {
+		session.Scopes = token.Scopes
+	}
+	return user.Username, nil
+}
+
+func (r *PATRealm) checkJiraToken(session *PATSession) (string, error) {
+	cli, err := r.jiraClient(session)
+	if err != nil {
+		return "", err
+	}
+	req, err := cli.NewRequest("GET", "rest/api/2/myself", nil)
+	if err != nil {
+		return "", err
+	}
+	var user struct {
+		Name         string `json:"name"`
+		EmailAddress string `json:"emailAddress"`
+	}
+	if _, err = cli.Do(req, &user); err != nil {
+		return "", err
+	}
+	if user.Name == "" {
+		return user.EmailAddress, nil // Atlassian Cloud no longer reports usernames
+	}
+	return user.Name, nil
+}
+
+// OnReceiveRedirect is not used: users submit tokens directly.
+func (r *PATRealm) OnReceiveRedirect(w http.ResponseWriter, req *http.Request) {
+	w.WriteHeader(404)
+}
+
+// AuthSession returns a PATSession for this user
+func (r *PATRealm) AuthSession(id, userID, realmID string) types.AuthSession {
+	return &PATSession{
+		id:      id,
+		userID:  userID,
+		realmID: realmID,
+	}
+}
+
+// GitlabClient returns a GitLab client which performs requests with the user's token: their default
+// one or, if scopes are given, their least privileged one which has them (see tokens.FindSession).
+// Returns an error if the realm's Provider is not gitlab, or the user has not submitted such a token.
+func (r *PATRealm) GitlabClient(userID string, scopes ...string) (*glclient.Client, error) {
+	if r.Provider != providerGitlab {
+		return nil, errors.New("Realm " + r.id + " does not hold GitLab tokens")
+	}
+	session, err := r.loadSession(userID, scopes...)
+	if err != nil {
+		return nil, err
+	}
+	return glclient.NewForUser(r.BaseURL, session.AccessToken, r.id, userID), nil
+}
+
+// JIRAClient returns a jira.Client which performs requests with the user's token, in the same way
+// as JIRARealm.JIRAClient. Returns an unauthenticated client if allowUnauth is true and the user
+// has not submitted a token.
+func (r *PATRealm) JIRAClient(userID string, allowUnauth bool) (*jira.Client, error) {
+	if r.Provider != providerJIRA {
+		return nil, errors.New("Realm " + r.id + " does not hold JIRA tokens")
+	}
+	session, err := r.loadSession(userID)
+	if err != nil {
+		if allowUnauth {
+			return jira.NewClient(httpclient.Default, r.BaseURL+"/")
+		}
+		return nil, err
+	}
+	return r.jiraClient(session)
+}
+
+func (r *PATRealm) jiraClient(session *PATSession) (*jira.Client, error) {
+	httpClient := &http.Client{
+		Transport: &basicAuthTransport{session.Username, session.AccessToken},
+		Timeout:   30 * time.Second,
+	}
+	return jira.NewClient(httpClient, r.BaseURL+"/")
+}
+
+// loadSession returns the user's default session or, if scopes are given, their least privileged
+// session which has them. Returns sql.ErrNoRows if they have not submitted such a token.
+func (r *PATRealm) loadSession(userID string, scopes ...string) (*PATSession, error) {
+	var session types.AuthSession
+	var err error
+	if len(scopes) == 0 {
+		session, err = database.GetServiceDB().LoadAuthSessionByUser(r.id, userID)
+	} else {
+		session, err = tokens.FindSession(r.id, userID, scopes...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	patSession, ok := session.(*PATSession)
+	if !ok {
+		return nil, errors.New("Failed to cast user session to a PATSession")
+	}
+	if !patSession.Authenticated() {
+		return nil, sql.ErrNoRows
+	}
+	return patSession, nil
+}
+
+// basicAuthTransport authenticates requests with a username and token, as JIRA API tokens are used.
+type basicAuthTransport struct {
+	username string
+	token    string
+}
+
+func (t *basicAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrippers must not modify the request they are given.
+	req2 := new(http.Request)
+	*req2 = *req
+	req2.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		req2.Header[k] = v
+	}
+	req2.SetBasicAuth(t.username, t.token)
+	return httpclient.Transport.RoundTrip(req2)
+}
+
+func init() {
+	types.RegisterAuthRealm(func(realmID, redirectURL string) types.AuthRealm {
+		return &PATRealm{id: realmID, redirectURL: redirectURL}
+	})
+}
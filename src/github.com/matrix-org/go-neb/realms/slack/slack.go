@@ -0,0 +1,544 @@
+package realms
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/httpclient"
+	"github.com/matrix-org/go-neb/secrets"
+	"github.com/matrix-org/go-neb/tokens"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/go-neb/util"
+	"golang.org/x/oauth2"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// slackURL is where the Slack API and OAuth pages are served from.
+var slackURL = "https://slack.com"
+
+// SlackRealm can handle OAuth2 processes with a Slack app, installing it into a workspace. The
+// session holds the workspace's bot token if bot Scopes are asked for, and the user's own token if
+// UserScopes are. Services such as the Slack relay use it to talk to the workspace.
+type SlackRealm struct {
+	id           string
+	redirectURL  string
+	ClientSecret secrets.Secret
+	ClientID     secrets.Secret
+	// Scopes are the bot token scopes every session is asked for, e.g. "chat:write".
+	Scopes []string
+	// UserScopes are the user token scopes every session is asked for, e.g. "chat:write".
+	UserScopes []string
+	// TeamID restricts installs to one workspace if set, e.g. "T012AB3C4".
+	TeamID      string
+	StarterLink string
+}
+
+// SlackSession represents an app installed into a Slack workspace by a user
+type SlackSession struct {
+	// The client-supplied URL to redirect them to after the auth process is complete.
+	ClientsRedirectURL string
+	// The workspace the app was installed into.
+	TeamID   string
+	TeamName string
+	// BotUserID is the Slack user ID of the app's bot user in the workspace.
+	BotUserID string
+	// SlackUserID is the Slack user ID of the user who installed the app.
+	SlackUserID string
+	// AccessToken is the bot token. With token rotation enabled on the app it expires at Expiry,
+	// and is replaced using RefreshToken.
+	AccessToken  string
+	RefreshToken string
+	Expiry       time.Time
+	// Scopes are the set of *ALLOWED* bot scopes.
+	Scopes []string
+	// UserAccessToken is the user's token, if user scopes were asked for. It is rotated in the
+	// same way as the bot token.
+	UserAccessToken  string
+	UserRefreshToken string
+	UserExpiry       time.Time
+	// UserScopes are the set of *ALLOWED* user scopes.
+	UserScopes []string
+	// Label tells the session apart from the user's others in the realm, e.g. for another
+	// workspace. It is empty for their default session.
+	Label   string
+	id      string
+	userID  string
+	realmID string
+}
+
+// Authenticated returns true if the user has completed the auth process
+func (s *SlackSession) Authenticated() bool {
+	return s.AccessToken != "" || s.UserAccessToken != ""
+}
+
+// Info returns the workspace the app was installed into and the scopes granted there.
+func (s *SlackSession) Info() interface{} {
+	return struct {
+		TeamID      string
+		TeamName    string
+		SlackUserID string
+		Scopes      []string
+		UserScopes  []string
+	}{s.TeamID, s.TeamName, s.SlackUserID, s.Scopes, s.UserScopes}
+}
+
+// UserID returns the user_id who installed the Slack app
+func (s *SlackSession) UserID() string {
+	return s.userID
+}
+
+// RealmID returns the realm ID of the realm which performed the authentication
+func (s *SlackSession) RealmID() string {
+	return s.realmID
+}
+
+// ID returns the session ID
+func (s *SlackSession) ID() string {
+	return s.id
+}
+
+// Token returns the session's bot token, or its user token if no bot scopes were granted.
+func (s *SlackSession) Token() *oauth2.Token {
+	if s.AccessToken == "" {
+		return &oauth2.Token{
+			AccessToken:  s.UserAccessToken,
+			RefreshToken: s.UserRefreshToken,
+			Expiry:       s.UserExpiry,
+		}
+	}
+	return &oauth2.Token{
+		AccessToken:  s.AccessToken,
+		RefreshToken: s.RefreshToken,
+		Expiry:       s.Expiry,
+	}
+}
+
+// SetToken stores a refreshed token in the session, in place of the one Token returns.
+func (s *SlackSession) SetToken(token *oauth2.Token) {
+	if s.AccessToken == "" {
+		s.UserAccessToken = token.AccessToken
+		s.UserRefreshToken = token.RefreshToken
+		s.UserExpiry = token.Expiry
+		return
+	}
+	s.AccessToken = token.AccessToken
+	s.RefreshToken = token.RefreshToken
+	s.Expiry = token.Expiry
+}
+
+// HasScopes returns true if all of the given bot scopes have been granted.
+func (s *SlackSession) HasScopes(scopes ...string) bool {
+	return containsAll(s.Scopes, scopes)
+}
+
+// SessionLabel returns the label which tells the session apart from the user's others.
+func (s *SlackSession) SessionLabel() string {
+	return s.Label
+}
+
+// GrantedScopes returns the scopes granted to the token which Token returns: the bot's, or the
+// user's if no bot scopes were granted.
+func (s *SlackSession) GrantedScopes() []string {
+	if s.AccessToken == "" {
+		return s.UserScopes
+	}
+	return s.Scopes
+}
+
+// ID returns the realm ID
+func (r *SlackRealm) ID() string {
+	return r.id
+}
+
+// Type is slack
+func (r *SlackRealm) Type() string {
+	return "slack"
+}
+
+// Init does nothing.
+func (r *SlackRealm) Init() error {
+	return nil
+}
+
+// Register checks that the app's credentials and some scopes are given.
+func (r *SlackRealm) Register() error {
+	if r.ClientID.Value() == "" || r.ClientSecret.Value() == "" {
+		return errors.New("ClientID and ClientSecret must be specified")
+	}
+	if len(r.Scopes) == 0 && len(r.UserScopes) == 0 {
+		return errors.New("At least one of Scopes and UserScopes must be specified")
+	}
+	return nil
+}
+
+// OAuth2Config returns the config used to refresh sessions' tokens. Refreshing only needs the
+// token endpoint: Slack's responses to authorization codes are not standard, so are handled by
+// exchangeCode.
+func (r *SlackRealm) OAuth2Config() *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     r.ClientID.Value(),
+		ClientSecret: r.ClientSecret.Value(),
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  slackURL + "/oauth/v2/authorize",
+			TokenURL: slackURL + "/api/oauth.v2.access",
+		},
+		RedirectURL: r.redirectURL,
+	}
+}
+
+// RequestAuthSession generates an OAuth2 URL for this user to install the Slack app with. Scopes
+// beyond the realm's can be asked for with {"Scopes": [...], "UserScopes": [...]}. Slack adds them
+// to the ones already granted, and the existing session keeps working until the user has granted
+// them. The session can be stored alongside the user's others with {"Label": "..."}.
+func (r *SlackRealm) RequestAuthSession(userID string, req json.RawMessage) interface{} {
+	state, err := util.RandomString(10)
+	if err != nil {
+		log.WithError(err).Print("Failed to generate state param")
+		return nil
+	}
+
+	// check if they supplied a redirect URL, extra scopes or a label
+	var reqBody struct {
+		RedirectURL string
+		Scopes      []string
+		UserScopes  []string
+		Label       string
+	}
+	if err = json.Unmarshal(req, &reqBody); err != nil {
+		log.WithError(err).Print("Failed to decode request body")
+		return nil
+	}
+
+	session := &SlackSession{
+		Label:   reqBody.Label,
+		id:      state, // key off the state for redirects
+		userID:  userID,
+		realmID: r.ID(),
+	}
+	old, err := database.GetServiceDB().LoadAuthSessionByLabel(r.ID(), userID, reqBody.Label)
+	if err != nil && err != sql.ErrNoRows {
+		log.WithError(err).Print("Failed to load existing auth session")
+		return nil
+	}
+	if oldSession, ok := old.(*SlackSession); ok {
+		// Keep the tokens the user already has, so that services keep working in the meantime.
+		*session = *oldSession
+		session.id = state
+	}
+	session.ClientsRedirectURL = reqBody.RedirectURL
+
+	q := url.Values{}
+	q.Set("client_id", r.ClientID.Value())
+	q.Set("redirect_uri", r.redirectURL)
+	q.Set("state", state)
+	// Slack separates scopes with commas, unlike most providers.
+	if scopes := unionScopes(r.Scopes, reqBody.Scopes); len(scopes) > 0 {
+		q.Set("scope", strings.Join(scopes, ","))
+	}
+	if scopes := unionScopes(r.UserScopes, reqBody.UserScopes); len(scopes) > 0 {
+		q.Set("user_scope", strings.Join(scopes, ","))
+	}
+	if r.TeamID != "" {
+		q.Set("team", r.TeamID)
+	}
+	u := slackURL + "/oauth/v2/authorize?" + q.Encode()
+	log.WithFields(log.Fields{
+		"clients_redirect_url": session.ClientsRedirectURL,
+		"redirect_url":         u,
+	}).Print("RequestAuthSession: Performing redirect")
+
+	_, err = database.GetServiceDB().StoreAuthSession(session)
+	if err != nil {
+		log.WithError(err).Print("Failed to store new auth session")
+		return nil
+	}
+
+	return &struct {
+		URL string
+	}{u}
+}
+
+// OnReceiveRedirect processes OAuth2 redirect requests from Slack
+func (r *SlackRealm) OnReceiveRedirect(w http.ResponseWriter, req *http.Request) {
+	// parse out params from the request
+	code := req.URL.Query().Get("code")
+	state := req.URL.Query().Get("state")
+	logger := log.WithFields(log.Fields{
+		"state": state,
+	})
+	logger.WithField("code", code).Print("SlackRealm: OnReceiveRedirect")
+	if errParam := req.URL.Query().Get("error"); errParam != "" {
+		failWith(logger, w, 400, "Slack returned an error: "+errParam, nil)
+		return
+	}
+	if code == "" || state == "" {
+		failWith(logger, w, 400, "code and state are required", nil)
+		return
+	}
+	// load the session (we keyed off the state param)
+	session, err := database.GetServiceDB().LoadAuthSessionByID(r.ID(), state)
+	if err != nil {
+		// most likely cause
+		failWith(logger, w, 400, "Provided ?state= param is not recognised.", err)
+		return
+	}
+	sSession, ok := session.(*SlackSession)
+	if !ok {
+		failWith(logger, w, 500, "Unexpected session found.", nil)
+		return
+	}
+	logger.WithField("user_id", sSession.UserID()).Print("Mapped redirect to user")
+
+	res, err := r.exchangeCode(code)
+	if err != nil {
+		failWith(logger, w, 502, "Failed to exchange code for token", err)
+		return
+	}
+	if r.TeamID != "" && res.Team.ID != r.TeamID {
+		failWith(logger, w, 403, "The app can only be installed into workspace "+r.TeamID, nil)
+		return
+	}
+	// update database and return
+	sSession.update(res, logger)
+	logger.WithFields(log.Fields{
+		"team_id":     sSession.TeamID,
+		"scope":       sSession.Scopes,
+		"user_scope":  sSession.UserScopes,
+		"refreshable": sSession.RefreshToken != "" || sSession.UserRefreshToken != "",
+	}).Print("Scopes granted.")
+	_, err = database.GetServiceDB().StoreAuthSession(sSession)
+	if err != nil {
+		failWith(logger, w, 500, "Failed to persist session", err)
+		return
+	}
+	r.redirectOr(
+		w, 200, "You have successfully installed the Slack app into "+sSession.TeamName+" for "+sSession.UserID(), logger, sSession,
+	)
+}
+
+func (r *SlackRealm) redirectOr(w http.ResponseWriter, code int, msg string, logger *log.Entry, sSession *SlackSession) {
+	if sSession.ClientsRedirectURL != "" {
+		w.Header().Set("Location", sSession.ClientsRedirectURL)
+		w.WriteHeader(302)
+		// technically don't need a body but *shrug*
+		w.Write([]byte(sSession.ClientsRedirectURL))
+	} else {
+		failWith(logger, w, code, msg, nil)
+	}
+}
+
+// slackOAuthResponse is the response to oauth.v2.access for an authorization code. The bot token
+// is at the top level, and the user's token under authed_user.
+type slackOAuthResponse struct {
+	OK           bool   `json:"ok"`
+	Error        string `json:"error"`
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	Scope        string `json:"scope"`
+	BotUserID    string `json:"bot_user_id"`
+	Team         struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"team"`
+	AuthedUser struct {
+		ID           string `json:"id"`
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int64  `json:"expires_in"`
+		Scope        string `json:"scope"`
+	} `json:"authed_user"`
+}
+
+// exchangeCode exchanges an authorization code for the tokens of the install.
+// update sets the workspace and tokens of the session from the response to an OAuth code exchange.
+func (s *SlackSession) update(res *slackOAuthResponse, logger *log.Entry) {
+	if s.TeamID != "" && res.Team.ID != s.TeamID {
+		// The tokens of the old workspace would be mixed up with the new one's otherwise.
+		logger.WithField("team_id", s.TeamID).Print("Replacing session for another workspace")
+		*s = SlackSession{
+			ClientsRedirectURL: s.ClientsRedirectURL,
+			Label:              s.Label,
+			id:                 s.id,
+			userID:             s.userID,
+			realmID:            s.realmID,
+		}
+	}
+	s.TeamID = res.Team.ID
+	s.TeamName = res.Team.Name
+	s.SlackUserID = res.AuthedUser.ID
+	if res.AccessToken != "" {
+		s.BotUserID = res.BotUserID
+		s.AccessToken = res.AccessToken
+		s.RefreshToken = res.RefreshToken
+		s.Expiry = expiryFrom(res.ExpiresIn)
+		s.Scopes = unionScopes(strings.Split(res.Scope, ","))
+	}
+	if res.AuthedUser.AccessToken != "" {
+		s.UserAccessToken = res.AuthedUser.AccessToken
+		s.UserRefreshToken = res.AuthedUser.RefreshToken
+		s.UserExpiry = expiryFrom(res.AuthedUser.ExpiresIn)
+		s.UserScopes = unionScopes(strings.Split(res.AuthedUser.Scope, ","))
+	}
+}
+
+func (r *SlackRealm) exchangeCode(code string) (*slackOAuthResponse, error) {
+	res, err := httpclient.Default.PostForm(slackURL+"/api/oauth.v2.access", url.Values{
+		"client_id":     {r.ClientID.Value()},
+		"client_secret": {r.ClientSecret.Value()},
+		"code":          {code},
+		"redirect_uri":  {r.redirectURL},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("HTTP %d: %s", res.StatusCode, body)
+	}
+	var oauthRes slackOAuthResponse
+	if err = json.Unmarshal(body, &oauthRes); err != nil {
+		return nil, err
+	}
+	// Slack reports errors in the body of 200 responses.
+	if !oauthRes.OK {
+		return nil, errors.New("Slack returned an error: " + oauthRes.Error)
+	}
+	if oauthRes.AccessToken == "" && oauthRes.AuthedUser.AccessToken == "" {
+		return nil, errors.New("Slack returned no tokens")
+	}
+	return &oauthRes, nil
+}
+
+// RevokeSession revokes the user's token. Bot tokens are left alone, as every install into the
+// same workspace shares one: revoking it would uninstall the app for everybody.
+func (r *SlackRealm) RevokeSession(session types.AuthSession) error {
+	sSession, ok := session.(*SlackSession)
+	if !ok {
+		return errors.New("Failed to cast user session to a SlackSession")
+	}
+	if sSession.UserAccessToken == "" {
+		return errors.New("Bot tokens are shared by the whole workspace, so are not revoked")
+	}
+	req, err := http.NewRequest("POST", slackURL+"/api/auth.revoke", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+sSession.UserAccessToken)
+	res, err := httpclient.Default.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	var revokeRes struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&revokeRes); err != nil {
+		return fmt.Errorf("Failed to revoke token: HTTP %d", res.StatusCode)
+	}
+	// The token may already have been revoked on Slack.
+	if !revokeRes.OK && revokeRes.Error != "invalid_auth" && revokeRes.Error != "token_revoked" {
+		return errors.New("Failed to revoke token: " + revokeRes.Error)
+	}
+	return nil
+}
+
+// AuthSession returns a SlackSession for this user
+func (r *SlackRealm) AuthSession(id, userID, realmID string) types.AuthSession {
+	return &SlackSession{
+		id:      id,
+		userID:  userID,
+		realmID: realmID,
+	}
+}
+
+// SlackClient returns an HTTP client which makes requests to the Slack API as the given user, and
+// the session it uses: their least privileged session which has all of the given scopes (see
+// tokens.FindSession). Requests are made with the session's bot token, or its user token if no bot
+// scopes were granted, and the scopes are checked against that token's. Rotating tokens are
+// refreshed shortly before they expire.
+func (r *SlackRealm) SlackClient(userID string, scopes ...string) (*http.Client, *SlackSession, error) {
+	session, err := tokens.FindSession(r.id, userID, scopes...)
+	if err == sql.ErrNoRows {
+		if len(scopes) == 0 {
+			return nil, nil, errors.New("No authenticated Slack session found for " + userID)
+		}
+		return nil, nil, errors.New(userID + " has not granted access to " + strings.Join(scopes, ", "))
+	} else if err != nil {
+		return nil, nil, err
+	}
+	sSession, ok := session.(*SlackSession)
+	if !ok {
+		return nil, nil, errors.New("Failed to cast user session to a SlackSession")
+	}
+	return tokens.ClientForLabel(r, userID, sSession.Label), sSession, nil
+}
+
+// expiryFrom returns when a token which expires in the given number of seconds expires, or the
+// zero time if it doesn't.
+func expiryFrom(expiresIn int64) time.Time {
+	if expiresIn <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(time.Duration(expiresIn) * time.Second)
+}
+
+// containsAll returns true if every scope in want is in got.
+func containsAll(got, want []string) bool {
+	for _, w := range want {
+		found := false
+		for _, g := range got {
+			if g == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// unionScopes returns the sorted, de-duplicated union of the given lists of scopes.
+func unionScopes(lists ...[]string) []string {
+	set := make(map[string]bool)
+	for _, list := range lists {
+		for _, scope := range list {
+			if scope = strings.TrimSpace(scope); scope != "" {
+				set[scope] = true
+			}
+		}
+	}
+	scopes := []string{}
+	for scope := range set {
+		scopes = append(scopes, scope)
+	}
+	sort.Strings(scopes)
+	return scopes
+}
+
+func failWith(logger *log.Entry, w http.ResponseWriter, code int, msg string, err error) {
+	logger.WithError(err).Print(msg)
+	w.WriteHeader(code)
+	w.Write([]byte(msg))
+}
+
+func init() {
+	types.RegisterAuthRealm(func(realmID, redirectURL string) types.AuthRealm {
+		return &SlackRealm{id: realmID, redirectURL: redirectURL}
+	})
+}
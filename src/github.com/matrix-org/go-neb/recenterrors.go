@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxRecentErrors is the number of warnings and errors kept in memory for /admin/recentErrors.
+const maxRecentErrors = 200
+
+// recentError is a single logged warning or error.
+type recentError struct {
+	ID      int64 // increases by 1 for every entry, so clients can ask for entries after one they've seen.
+	Time    time.Time
+	Level   string
+	Message string
+	Fields  map[string]string
+}
+
+// recentErrorLog is a logrus hook which remembers the most recent warnings and errors, so they can
+// be inspected via the admin API without access to the log files.
+type recentErrorLog struct {
+	mu      sync.Mutex
+	entries []recentError
+	nextID  int64
+}
+
+func (l *recentErrorLog) Levels() []log.Level {
+	return []log.Level{log.PanicLevel, log.FatalLevel, log.ErrorLevel, log.WarnLevel}
+}
+
+func (l *recentErrorLog) Fire(entry *log.Entry) error {
+	fields := make(map[string]string, len(entry.Data))
+	for k, v := range entry.Data {
+		fields[k] = fmt.Sprint(v)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.nextID++
+	l.entries = append(l.entries, recentError{
+		ID:      l.nextID,
+		Time:    entry.Time,
+		Level:   entry.Level.String(),
+		Message: entry.Message,
+		Fields:  fields,
+	})
+	if len(l.entries) > maxRecentErrors {
+		l.entries = l.entries[len(l.entries)-maxRecentErrors:]
+	}
+	return nil
+}
+
+// since returns the remembered entries with an ID greater than the one given, oldest first.
+func (l *recentErrorLog) since(id int64) []recentError {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entries := []recentError{}
+	for _, e := range l.entries {
+		if e.ID > id {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+type recentErrorsHandler struct {
+	errorLog *recentErrorLog
+}
+
+func (h *recentErrorsHandler) OnIncomingRequest(req *http.Request) (interface{}, *errors.HTTPError) {
+	if req.Method != "GET" {
+		return nil, &errors.HTTPError{nil, "Unsupported Method", 405}
+	}
+	var since int64
+	if s := req.URL.Query().Get("since"); s != "" {
+		var err error
+		if since, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return nil, &errors.HTTPError{err, `"since" must be an integer`, 400}
+		}
+	}
+	return &struct {
+		Errors []recentError
+	}{h.errorLog.since(since)}, nil
+}
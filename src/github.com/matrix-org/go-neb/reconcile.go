@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/clients"
+	"github.com/matrix-org/go-neb/config"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/types"
+	"sync"
+)
+
+// The types of managed resource which can be declared in a config file.
+const (
+	managedRealm   = "realm"
+	managedClient  = "client"
+	managedSession = "session"
+	managedService = "service"
+)
+
+// A configReconciler makes the database match a config file.
+type configReconciler struct {
+	db         *database.ServiceDB
+	clients    *clients.Clients
+	services   *configureServiceHandler
+	configFile string
+	mu         sync.Mutex // held whilst reconciling so reloads do not interleave
+}
+
+// configChanges lists the resources which were modified by a reconcile, as "type id" strings.
+type configChanges struct {
+	Applied []string
+	Removed []string
+}
+
+// reload re-reads the config file and reconciles it with the database. Only the differences
+// between the file and the database are applied, so unchanged clients keep syncing and unchanged
+// services keep receiving webhooks.
+func (r *configReconciler) reload() (*configChanges, error) {
+	cfg, err := config.Load(r.configFile)
+	if err != nil {
+		return nil, err
+	}
+	return r.reconcile(cfg)
+}
+
+// reconcile creates or updates every realm, client, session and service declared in the config,
+// then removes anything which was previously created from a config file but is no longer declared.
+// Resources created via the HTTP API are never removed. Resources whose declaration has not changed
+// since they were last reconciled are left alone, so services are not needlessly re-registered.
+// Returns the changes made, which may be partial if an error is returned.
+func (r *configReconciler) reconcile(cfg *config.Config) (*configChanges, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	d, err := r.diff(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var changes configChanges
+	if err = r.apply(d.changed, &changes); err != nil {
+		return &changes, err
+	}
+	// Services are independent of each other, and registering them mostly means waiting for other
+	// servers, so they are applied concurrently.
+	if err = r.applyConcurrently(d.changedServices, &changes); err != nil {
+		return &changes, err
+	}
+	if err = r.removeAll(d.removed, &changes); err != nil {
+		return &changes, err
+	}
+	return &changes, nil
+}
+
+// A resourceChange is a resource to create, update or remove so that the database matches the
+// config.
+type resourceChange struct {
+	resourceType string
+	id           string
+	// declaration is the resource's declaration as JSON: the one in the config for resources to
+	// apply, or the one it was last applied with for resources to remove.
+	declaration []byte
+	// apply creates or updates the resource. It is nil for resources to remove.
+	apply func() error
+}
+
+// configDiff is the difference between a config and what was last applied from a config file.
+type configDiff struct {
+	// The realms, clients and sessions whose declarations have changed, in the order to apply them.
+	changed []resourceChange
+	// The services whose declarations have changed.
+	changedServices []resourceChange
+	// The resources which are no longer declared, in the order to remove them.
+	removed []resourceChange
+	// The declarations which each resource was last applied with, by type and ID.
+	managed map[string]map[string][]byte
+	// Whether each resource is declared in the config, by type and ID.
+	declared map[string]map[string]bool
+}
+
+// diff returns the resources which must be changed so that the database matches the config.
+func (r *configReconciler) diff(cfg *config.Config) (*configDiff, error) {
+	d := &configDiff{
+		managed:  make(map[string]map[string][]byte),
+		declared: make(map[string]map[string]bool),
+	}
+	for _, t := range []string{managedRealm, managedClient, managedSession, managedService} {
+		m, err := r.db.LoadManagedResources(t)
+		if err != nil {
+			return nil, err
+		}
+		d.managed[t] = m
+		d.declared[t] = make(map[string]bool)
+	}
+
+	for _, realm := range cfg.Realms {
+		realm := realm
+		_, loadErr := r.db.LoadAuthRealm(realm.ID)
+		if err := d.declare(&d.changed, managedRealm, realm.ID, realm, loadErr == nil, func() error {
+			return r.applyRealm(realm)
+		}); err != nil {
+			return nil, err
+		}
+	}
+	for _, client := range cfg.Clients {
+		client := client
+		_, loadErr := r.db.LoadMatrixClientConfig(client.UserID)
+		if err := d.declare(&d.changed, managedClient, client.UserID, client, loadErr == nil, func() error {
+			return r.applyClient(client)
+		}); err != nil {
+			return nil, err
+		}
+	}
+	for _, session := range cfg.Sessions {
+		session := session
+		_, loadErr := r.db.LoadAuthSessionByLabel(session.RealmID, session.UserID, session.Label())
+		if err := d.declare(&d.changed, managedSession, sessionResourceID(session), session, loadErr == nil, func() error {
+			return r.applySession(session)
+		}); err != nil {
+			return nil, err
+		}
+	}
+	for _, service := range cfg.Services {
+		service := service
+		_, loadErr := r.db.LoadService(service.ID)
+		if err := d.declare(&d.changedServices, managedService, service.ID, service, loadErr == nil, func() error {
+			return r.applyService(service)
+		}); err != nil {
+			return nil, err
+		}
+	}
+	d.removeUndeclared()
+	return d, nil
+}
+
+// declare marks the resource as declared, and adds it to the changes if it doesn't exist or its
+// declaration has changed since it was last applied.
+func (d *configDiff) declare(changes *[]resourceChange, resourceType, id string, declaration interface{}, exists bool, apply func() error) error {
+	d.declared[resourceType][id] = true
+	j, err := json.Marshal(declaration)
+	if err != nil {
+		return err
+	}
+	if exists && bytes.Equal(d.managed[resourceType][id], j) {
+		return nil
+	}
+	*changes = append(*changes, resourceChange{resourceType: resourceType, id: id, declaration: j, apply: apply})
+	return nil
+}
+
+// removeUndeclared adds every managed resource which isn't declared to the resources to remove.
+func (d *configDiff) removeUndeclared() {
+	// Remove things in the reverse order to creation, as services depend on clients and realms.
+	for _, t := range []string{managedService, managedSession, managedClient, managedRealm} {
+		for id, declaration := range d.managed[t] {
+			if !d.declared[t][id] {
+				d.removed = append(d.removed, resourceChange{resourceType: t, id: id, declaration: declaration})
+			}
+		}
+	}
+}
+
+// sessionResourceID returns the ID of the managed resource for the declared session.
+func sessionResourceID(session config.Session) string {
+	id := session.UserID + " " + session.RealmID
+	if label := session.Label(); label != "" {
+		id += " [" + label + "]"
+	}
+	return id
+}
+
+// logApplying logs that the resource's declaration is being applied.
+func logApplying(c resourceChange) {
+	log.WithFields(log.Fields{
+		"type": c.resourceType,
+		"id":   c.id,
+	}).Info("Applying declared config")
+}
+
+// apply applies each of the changes in turn, stopping at the first which fails.
+func (r *configReconciler) apply(changed []resourceChange, changes *configChanges) error {
+	for _, c := range changed {
+		logApplying(c)
+		if err := c.apply(); err != nil {
+			return fmt.Errorf("Failed to apply %s %s: %s", c.resourceType, c.id, err)
+		}
+		if err := r.applied(c, changes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyConcurrently applies all of the changes concurrently. Every change which was applied is
+// recorded, in the order they were declared, before the first which failed is reported.
+func (r *configReconciler) applyConcurrently(changed []resourceChange, changes *configChanges) error {
+	for _, c := range changed {
+		logApplying(c)
+	}
+	applyErrs := make([]error, len(changed))
+	forEachConcurrently(len(changed), maxConcurrentServices, func(i int) {
+		applyErrs[i] = changed[i].apply()
+	})
+	var applyErr error
+	for i, c := range changed {
+		if applyErrs[i] != nil {
+			if applyErr == nil {
+				applyErr = fmt.Errorf("Failed to apply %s %s: %s", c.resourceType, c.id, applyErrs[i])
+			}
+			continue
+		}
+		if err := r.applied(c, changes); err != nil {
+			return err
+		}
+	}
+	return applyErr
+}
+
+// applied records that the resource was applied with its declaration.
+func (r *configReconciler) applied(c resourceChange, changes *configChanges) error {
+	changes.Applied = append(changes.Applied, c.resourceType+" "+c.id)
+	return r.db.StoreManagedResource(c.resourceType, c.id, c.declaration)
+}
+
+// removeAll removes each of the resources in turn, stopping at the first which fails.
+func (r *configReconciler) removeAll(removed []resourceChange, changes *configChanges) error {
+	for _, c := range removed {
+		log.WithFields(log.Fields{
+			"type": c.resourceType,
+			"id":   c.id,
+		}).Info("Removing config which is no longer declared")
+		if err := r.remove(c.resourceType, c.id, c.declaration); err != nil {
+			return fmt.Errorf("Failed to remove %s %s: %s", c.resourceType, c.id, err)
+		}
+		changes.Removed = append(changes.Removed, c.resourceType+" "+c.id)
+		if err := r.db.RemoveManagedResource(c.resourceType, c.id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *configReconciler) applyRealm(declared config.Realm) error {
+	// A config exported by /admin/exportConfig has its secrets redacted.
+	realmConfig, httpErr := unredactRealmConfig(r.db, declared.ID, declared.Type, declared.Config)
+	if httpErr != nil {
+		return httpErr
+	}
+	realm, err := types.CreateAuthRealm(declared.ID, declared.Type, realmConfig)
+	if err != nil {
+		return err
+	}
+	if err = realm.Register(); err != nil {
+		return err
+	}
+	_, err = r.db.StoreAuthRealm(realm)
+	return err
+}
+
+func (r *configReconciler) applyClient(declared types.ClientConfig) error {
+	// A config exported by /admin/exportConfig has its access tokens redacted.
+	if httpErr := unredactAccessToken(r.db, &declared); httpErr != nil {
+		return httpErr
+	}
+	_, err := r.clients.Update(declared)
+	return err
+}
+
+func (r *configReconciler) applySession(declared config.Session) error {
+	realm, err := r.db.LoadAuthRealm(declared.RealmID)
+	if err != nil {
+		return err
+	}
+	session := realm.AuthSession(declared.SessionID, declared.UserID, declared.RealmID)
+	if session == nil {
+		return fmt.Errorf("Realm %s cannot create sessions", declared.RealmID)
+	}
+	if err = json.Unmarshal(declared.Config, session); err != nil {
+		return err
+	}
+	_, err = r.db.StoreAuthSession(session)
+	return err
+}
+
+func (r *configReconciler) applyService(declared config.Service) error {
+	serviceConfig, httpErr := unredactServiceConfig(r.db, declared.ID, declared.Type, declared.Config)
+	if httpErr != nil {
+		return httpErr
+	}
+	webhookKey, err := r.db.LoadWebhookKey(declared.ID)
+	if err != nil {
+		return err
+	}
+	service, err := types.CreateService(declared.ID, declared.Type, declared.UserID, webhookKey, serviceConfig)
+	if err != nil {
+		return err
+	}
+	if _, httpErr = r.services.configureService(service, "config file"); httpErr != nil {
+		return httpErr
+	}
+	return nil
+}
+
+// remove removes the resource with the given ID, which was created from the given declaration.
+func (r *configReconciler) remove(resourceType, id string, declaration []byte) error {
+	switch resourceType {
+	case managedService:
+		// Clean up as the admin API's DELETE does, so removing a service from the file removes its
+		// webhooks too.
+		deleted, httpErr := r.services.deleteService(id, "config file")
+		if httpErr != nil && httpErr.Code == 404 {
+			// It was already deleted via the admin API.
+			return nil
+		} else if httpErr != nil {
+			return httpErr
+		}
+		for _, p := range deleted.Problems {
+			log.WithField("service_id", id).Warn("Failed to clean up after removed service: ", p)
+		}
+		return nil
+	case managedSession:
+		var session config.Session
+		if err := json.Unmarshal(declaration, &session); err != nil {
+			return fmt.Errorf("Malformed session declaration: %s", err)
+		}
+		return r.db.RemoveAuthSessionByLabel(session.RealmID, session.UserID, session.Label())
+	case managedClient:
+		return r.clients.Remove(id)
+	case managedRealm:
+		return r.db.DeleteAuthRealm(id)
+	}
+	return fmt.Errorf("Unknown resource type")
+}
@@ -0,0 +1,141 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/httpclient"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+)
+
+// maxRetryDelay is the longest a Puller waits before polling again after failing to.
+const maxRetryDelay = time.Minute
+
+// A Puller polls a relay server for webhook deliveries and passes them to a handler.
+type Puller struct {
+	relayURL string
+	token    string
+	handler  http.Handler
+	client   *http.Client
+	stop     chan struct{}
+}
+
+// NewPuller makes a Puller which polls the relay at relayURL, e.g. "https://relay.example.com",
+// and passes deliveries to the handler. Its requests to the relay carry the given token.
+func NewPuller(relayURL, token string, handler http.Handler) *Puller {
+	return &Puller{
+		relayURL: strings.TrimSuffix(relayURL, "/"),
+		token:    token,
+		handler:  handler,
+		// Long enough for a poll to wait for a delivery, with time to spare for a slow network.
+		client: httpclient.New(pollWait + 30*time.Second),
+		stop:   make(chan struct{}),
+	}
+}
+
+// Run polls until Stop is called. Each delivery is handled in its own goroutine, so that a slow
+// one doesn't hold up the rest. Failures to reach the relay are logged and retried, backing off.
+func (p *Puller) Run() {
+	log.WithField("relay_url", p.relayURL).Info("Polling relay for webhook deliveries")
+	var retryDelay time.Duration
+	for {
+		select {
+		case <-p.stop:
+			return
+		default:
+		}
+		d, err := p.poll()
+		if err != nil {
+			if retryDelay == 0 {
+				retryDelay = time.Second
+			} else if retryDelay *= 2; retryDelay > maxRetryDelay {
+				retryDelay = maxRetryDelay
+			}
+			log.WithError(err).WithField("retry_in", retryDelay).Warn("Failed to poll relay")
+			select {
+			case <-p.stop:
+				return
+			case <-time.After(retryDelay):
+			}
+			continue
+		}
+		retryDelay = 0
+		if d != nil {
+			go p.handle(d)
+		}
+	}
+}
+
+// Stop stops polling. Deliveries already being handled are not waited for.
+func (p *Puller) Stop() {
+	close(p.stop)
+}
+
+// poll returns the next delivery, or nil if none arrived whilst waiting.
+func (p *Puller) poll() (*Delivery, error) {
+	req, err := http.NewRequest("GET", p.relayURL+PollPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.token)
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case 200:
+		var d Delivery
+		if err = json.NewDecoder(res.Body).Decode(&d); err != nil {
+			return nil, err
+		}
+		return &d, nil
+	case 204:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("relay returned HTTP %d", res.StatusCode)
+	}
+}
+
+// handle passes a delivery to the handler and sends the response back to the relay.
+func (p *Puller) handle(d *Delivery) {
+	logger := log.WithFields(log.Fields{
+		"delivery_id": d.ID,
+		"url":         d.URL,
+	})
+	req, err := http.NewRequest(d.Method, d.URL, bytes.NewReader(d.Body))
+	if err != nil {
+		logger.WithError(err).Warn("Failed to rebuild relayed webhook request")
+		return
+	}
+	req.Header = d.Header
+	req.RequestURI = d.URL
+	// The relay is trusted to say where the request came from, so that allowlists still work.
+	req.RemoteAddr = d.RemoteAddr
+	rec := httptest.NewRecorder()
+	p.handler.ServeHTTP(rec, req)
+
+	body, err := json.Marshal(Response{d.ID, rec.Code, rec.Body.String()})
+	if err != nil {
+		logger.WithError(err).Warn("Failed to encode relayed webhook response")
+		return
+	}
+	res, err := http.NewRequest("POST", p.relayURL+RespondPath, bytes.NewReader(body))
+	if err != nil {
+		logger.WithError(err).Warn("Failed to send response to relay")
+		return
+	}
+	res.Header.Set("Authorization", "Bearer "+p.token)
+	res.Header.Set("Content-Type", "application/json")
+	resp, err := p.client.Do(res)
+	if err != nil {
+		// The sender is told the delivery was accepted with an unknown outcome instead.
+		logger.WithError(err).Warn("Failed to send response to relay")
+		return
+	}
+	resp.Body.Close()
+}
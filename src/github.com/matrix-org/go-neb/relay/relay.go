@@ -0,0 +1,194 @@
+// Package relay lets a Go-NEB which can't be reached from the internet, e.g. because it is behind
+// NAT, still receive webhooks. A small relay server with a public address accepts webhook requests
+// on Go-NEB's behalf and queues them; Go-NEB long-polls the relay for them, handles them as if they
+// had been sent to it directly, and sends back the response, which the relay passes on to the
+// sender if it arrives in time.
+package relay
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PollPath and RespondPath are where Go-NEB polls the relay for deliveries and sends back its
+// responses to them.
+const (
+	PollPath    = "/relay/poll"
+	RespondPath = "/relay/respond"
+)
+
+// pollWait is how long a poll waits for a delivery before returning with none.
+const pollWait = 30 * time.Second
+
+// A Delivery is a webhook request received by the relay.
+type Delivery struct {
+	ID         string
+	Method     string
+	URL        string // The request URI, e.g. "/services/hooks/ZWNobw?foo=bar"
+	Header     http.Header
+	Body       []byte
+	RemoteAddr string // The address the request came from, e.g. "192.30.252.1:41234"
+}
+
+// A Response is what Go-NEB responded to a delivery with.
+type Response struct {
+	ID   string
+	Code int
+	Body string
+}
+
+// A Server is a relay server. Requests to paths under /services/hooks/ are queued as deliveries for
+// Go-NEB to poll for. The sender is given Go-NEB's response if it arrives within the response
+// timeout; otherwise the request is answered with HTTP 202, as whether Go-NEB has handled it, is
+// handling it or has yet to poll for it is unknown.
+type Server struct {
+	token           string
+	responseTimeout time.Duration
+	maxBodySize     int64
+	queue           chan *Delivery
+
+	mu      sync.Mutex
+	nextID  int64
+	waiting map[string]chan Response // delivery ID => the sender waiting for its response
+}
+
+// NewServer makes a relay server which Go-NEB authenticates to with the given token. At most
+// queueSize deliveries are held for Go-NEB at once: further requests get HTTP 503.
+func NewServer(token string, responseTimeout time.Duration, maxBodySize int64, queueSize int) *Server {
+	return &Server{
+		token:           token,
+		responseTimeout: responseTimeout,
+		maxBodySize:     maxBodySize,
+		queue:           make(chan *Delivery, queueSize),
+		waiting:         make(map[string]chan Response),
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch {
+	case req.URL.Path == PollPath:
+		s.poll(w, req)
+	case req.URL.Path == RespondPath:
+		s.respond(w, req)
+	case strings.Contains(req.URL.Path, "/services/hooks/"):
+		s.receive(w, req)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// receive queues a webhook request, then waits for Go-NEB's response to it.
+func (s *Server) receive(w http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, s.maxBodySize))
+	if err != nil {
+		http.Error(w, "Request body too large", 413)
+		return
+	}
+	s.mu.Lock()
+	s.nextID++
+	d := &Delivery{
+		ID:         fmt.Sprintf("%d-%d", time.Now().UnixNano(), s.nextID),
+		Method:     req.Method,
+		URL:        req.URL.RequestURI(),
+		Header:     req.Header,
+		Body:       body,
+		RemoteAddr: req.RemoteAddr,
+	}
+	resCh := make(chan Response, 1)
+	s.waiting[d.ID] = resCh
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.waiting, d.ID)
+		s.mu.Unlock()
+	}()
+
+	select {
+	case s.queue <- d:
+	default:
+		log.WithField("url", d.URL).Warn("Relay queue is full: rejecting webhook request")
+		http.Error(w, "Relay queue is full", 503)
+		return
+	}
+
+	timer := time.NewTimer(s.responseTimeout)
+	defer timer.Stop()
+	select {
+	case res := <-resCh:
+		w.WriteHeader(res.Code)
+		w.Write([]byte(res.Body))
+	case <-timer.C:
+		// Go-NEB is slow or isn't polling. It may have taken the delivery and still be handling it,
+		// or failed to send its response, or it may get the delivery when it next polls.
+		log.WithField("delivery_id", d.ID).Info("No response from Go-NEB in time: delivery outcome unknown")
+		w.WriteHeader(202)
+		w.Write([]byte("Accepted: outcome unknown"))
+	}
+}
+
+// poll returns the next delivery, waiting for one if there is none. Returns HTTP 204 if none
+// arrives in time.
+func (s *Server) poll(w http.ResponseWriter, req *http.Request) {
+	if !s.authorised(req) {
+		http.Error(w, "Bad token", 401)
+		return
+	}
+	var closed <-chan bool
+	if cn, ok := w.(http.CloseNotifier); ok {
+		closed = cn.CloseNotify()
+	}
+	timer := time.NewTimer(pollWait)
+	defer timer.Stop()
+	select {
+	case d := <-s.queue:
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(d); err != nil {
+			log.WithError(err).WithField("delivery_id", d.ID).Warn("Failed to send delivery to Go-NEB")
+		}
+	case <-timer.C:
+		w.WriteHeader(204)
+	case <-closed:
+	}
+}
+
+// respond passes Go-NEB's response to a delivery on to its sender, if they are still waiting.
+func (s *Server) respond(w http.ResponseWriter, req *http.Request) {
+	if !s.authorised(req) {
+		http.Error(w, "Bad token", 401)
+		return
+	}
+	if req.Method != "POST" {
+		w.WriteHeader(405)
+		return
+	}
+	var res Response
+	if err := json.NewDecoder(req.Body).Decode(&res); err != nil {
+		http.Error(w, "Bad response", 400)
+		return
+	}
+	s.mu.Lock()
+	resCh := s.waiting[res.ID]
+	s.mu.Unlock()
+	if resCh != nil {
+		select {
+		case resCh <- res:
+		default:
+		}
+	}
+	w.WriteHeader(200)
+}
+
+func (s *Server) authorised(req *http.Request) bool {
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(s.token)) == 1
+}
@@ -0,0 +1,72 @@
+package relay
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRelay(t *testing.T) {
+	relaySrv := httptest.NewServer(NewServer("s3cret", 5*time.Second, 1024, 10))
+	defer relaySrv.Close()
+
+	var gotBody, gotPath, gotHeader string
+	p := NewPuller(relaySrv.URL, "s3cret", http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		b, _ := ioutil.ReadAll(req.Body)
+		gotBody, gotPath, gotHeader = string(b), req.URL.Path, req.Header.Get("X-Github-Event")
+		w.WriteHeader(201)
+		w.Write([]byte("done"))
+	}))
+	go p.Run()
+	defer p.Stop()
+
+	req, _ := http.NewRequest("POST", relaySrv.URL+"/services/hooks/ZWNobw?x=1", strings.NewReader(`{"a":1}`))
+	req.Header.Set("X-Github-Event", "push")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != 201 || string(body) != "done" {
+		t.Errorf("Relayed request => Want HTTP 201 done got %d %s", res.StatusCode, body)
+	}
+	if gotBody != `{"a":1}` || gotPath != "/services/hooks/ZWNobw" || gotHeader != "push" {
+		t.Errorf("Handler got body %q path %q header %q", gotBody, gotPath, gotHeader)
+	}
+}
+
+func TestRelayAuth(t *testing.T) {
+	relaySrv := httptest.NewServer(NewServer("s3cret", time.Second, 1024, 10))
+	defer relaySrv.Close()
+	for _, path := range []string{PollPath, RespondPath} {
+		req, _ := http.NewRequest("POST", relaySrv.URL+path, nil)
+		req.Header.Set("Authorization", "Bearer wrong")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != 401 {
+			t.Errorf("%s with a bad token => Want HTTP 401 got %d", path, res.StatusCode)
+		}
+	}
+}
+
+func TestRelayQueuesWhenNotPolled(t *testing.T) {
+	relaySrv := httptest.NewServer(NewServer("s3cret", 50*time.Millisecond, 1024, 1))
+	defer relaySrv.Close()
+	for _, want := range []int{202, 503} {
+		res, err := http.Post(relaySrv.URL+"/services/hooks/ZWNobw", "application/json", strings.NewReader("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != want {
+			t.Errorf("Unpolled request => Want HTTP %d got %d", want, res.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Skip("No time zone data: ", err)
+	}
+	// A Friday
+	from := time.Date(2026, 10, 16, 9, 31, 20, 0, time.UTC)
+	for _, tc := range []struct {
+		spec string
+		from time.Time
+		want time.Time
+	}{
+		{"* * * * *", from, time.Date(2026, 10, 16, 9, 32, 0, 0, time.UTC)},
+		{"30 9 * * *", from, time.Date(2026, 10, 17, 9, 30, 0, 0, time.UTC)},
+		{"30 9 * * mon-fri", from, time.Date(2026, 10, 19, 9, 30, 0, 0, time.UTC)},
+		{"*/15 * * * *", from, time.Date(2026, 10, 16, 9, 45, 0, 0, time.UTC)},
+		{"0 0 1 jan *", from, time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"@weekly", from, time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)},
+		{"0 12 * * 7", from, time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)},
+		// Either the 1st of the month or a Monday, as both are restricted.
+		{"0 0 1 * 1", from, time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", from, time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", from, time.Time{}},
+		// The clocks go back an hour on the 25th of October 2026.
+		{"0 9 * * *", time.Date(2026, 10, 24, 10, 0, 0, 0, london), time.Date(2026, 10, 25, 9, 0, 0, 0, london)},
+	} {
+		c, err := ParseCron(tc.spec)
+		if err != nil {
+			t.Fatalf("ParseCron(%q) => %s", tc.spec, err)
+		}
+		if got := c.Next(tc.from); !got.Equal(tc.want) {
+			t.Errorf("ParseCron(%q).Next(%s) => Want %s got %s", tc.spec, tc.from, tc.want, got)
+		}
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8",
+		"*/0 * * * *", "5-1 * * * *", "* * * foo *", "@sometimes"} {
+		if _, err := ParseCron(spec); err == nil {
+			t.Errorf("ParseCron(%q) => Want an error", spec)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+// Package scheduler runs jobs which services schedule for later, e.g. sending a reminder. Jobs are
+// stored in the database, so that they are run even if Go-NEB restarts before they are due. Jobs
+// which fell due whilst Go-NEB was down are run as soon as it starts again.
+package scheduler
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/types"
+	"time"
+)
+
+// maxAttempts is how many times a job is started before it is given up on.
+const maxAttempts = 5
+
+// retryDelay is how long after a job is started it is started again, if it fails or Go-NEB stops
+// whilst it is running.
+const retryDelay = time.Minute
+
+// maxSleep is the longest the scheduler waits before checking for due jobs again, in case a job
+// was scheduled by something other than Schedule, e.g. another Go-NEB sharing the database.
+const maxSleep = time.Minute
+
+// wake is sent to when a job is scheduled, so that the scheduler sleeps until it is due if it is
+// due before the job the scheduler was waiting for.
+var wake = make(chan struct{}, 1)
+
+// Schedule stores a job for the service to run at the given time, which calls the service's RunJob
+// function with the job, whose Data is data encoded as JSON. The service must be a
+// types.JobRunner. Returns the job, whose ID can be given to Cancel.
+func Schedule(serviceID string, due time.Time, data interface{}) (*types.ScheduledJob, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	return ScheduleWithID(hex.EncodeToString(id), serviceID, due, data)
+}
+
+// ScheduleWithID is like Schedule, but the job has the given ID, and replaces the job with that ID
+// if there is one. This lets a job which may be run more than once, because it is retried,
+// schedule a follow-up job without scheduling it twice.
+func ScheduleWithID(jobID, serviceID string, due time.Time, data interface{}) (*types.ScheduledJob, error) {
+	dataJSON, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	job := types.ScheduledJob{
+		ID:        jobID,
+		ServiceID: serviceID,
+		DueMs:     due.UnixNano() / int64(time.Millisecond),
+		Data:      dataJSON,
+	}
+	if err = database.GetServiceDB().StoreScheduledJob(job); err != nil {
+		return nil, err
+	}
+	log.WithFields(log.Fields{
+		"service_id": serviceID,
+		"job_id":     job.ID,
+		"due":        due.UTC(),
+	}).Info("Scheduled job")
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+	return &job, nil
+}
+
+// Cancel deletes a scheduled job, so that it isn't run. Does nothing if the job has already run.
+func Cancel(jobID string) error {
+	return database.GetServiceDB().DeleteScheduledJob(jobID)
+}
+
+// CancelService deletes every job the service has scheduled.
+func CancelService(serviceID string) error {
+	return database.GetServiceDB().DeleteScheduledJobs(serviceID)
+}
+
+// Start starts running jobs when they are due, in the background, with clients from clientFor.
+func Start(clientFor func(userID string) (*matrix.Client, error)) {
+	go func() {
+		for {
+			runDue(time.Now(), clientFor)
+			sleep(time.Now())
+		}
+	}()
+}
+
+// sleep waits until the next job is due, for at most maxSleep, or until a job is scheduled.
+func sleep(now time.Time) {
+	wait := maxSleep
+	dueMs, err := database.GetServiceDB().LoadNextScheduledJobDue()
+	if err == nil {
+		if untilDue := time.Unix(0, dueMs*int64(time.Millisecond)).Sub(now); untilDue < wait {
+			wait = untilDue
+		}
+	} else if err != sql.ErrNoRows {
+		log.WithError(err).Error("Failed to load when the next scheduled job is due")
+	}
+	if wait <= 0 {
+		return
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-wake:
+	}
+}
+
+// runDue starts every job which is due. Each job is put back retryDelay later before it is started,
+// and deleted once it has run, so that a job which fails, or which is running when Go-NEB stops,
+// is started again.
+func runDue(now time.Time, clientFor func(userID string) (*matrix.Client, error)) {
+	db := database.GetServiceDB()
+	jobs, err := db.LoadDueScheduledJobs(now.UnixNano() / int64(time.Millisecond))
+	if err != nil {
+		log.WithError(err).Error("Failed to load due scheduled jobs")
+		return
+	}
+	for _, job := range jobs {
+		logger := log.WithFields(log.Fields{
+			"service_id": job.ServiceID,
+			"job_id":     job.ID,
+			"attempts":   job.Attempts,
+		})
+		if job.Attempts >= maxAttempts {
+			logger.Error("Giving up on scheduled job")
+			if err = db.DeleteScheduledJob(job.ID); err != nil {
+				logger.WithError(err).Error("Failed to delete scheduled job")
+			}
+			continue
+		}
+		job.Attempts++
+		job.DueMs = now.Add(retryDelay).UnixNano() / int64(time.Millisecond)
+		if err = db.StoreScheduledJob(job); err != nil {
+			logger.WithError(err).Error("Failed to store scheduled job before running it")
+			continue
+		}
+		service, err := db.LoadService(job.ServiceID)
+		if err == sql.ErrNoRows {
+			logger.Warn("Deleting scheduled job of a service which no longer exists")
+			if err = db.DeleteScheduledJob(job.ID); err != nil {
+				logger.WithError(err).Error("Failed to delete scheduled job")
+			}
+			continue
+		} else if err != nil {
+			logger.WithError(err).Error("Failed to load the service of a scheduled job")
+			continue
+		}
+		runner, ok := service.(types.JobRunner)
+		if !ok {
+			logger.Warn("Deleting scheduled job of a service which doesn't run jobs")
+			if err = db.DeleteScheduledJob(job.ID); err != nil {
+				logger.WithError(err).Error("Failed to delete scheduled job")
+			}
+			continue
+		}
+		cli, err := clientFor(service.ServiceUserID())
+		if err != nil {
+			logger.WithError(err).Error("Failed to get a client to run a scheduled job")
+			continue
+		}
+		go run(runner, cli, job, logger)
+	}
+}
+
+func run(runner types.JobRunner, cli *matrix.Client, job types.ScheduledJob, logger *log.Entry) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.WithField("panic", r).Error("Scheduled job panicked")
+		}
+	}()
+	if err := runner.RunJob(cli, job); err != nil {
+		logger.WithError(err).Warn("Scheduled job failed: it will be tried again")
+		return
+	}
+	if err := database.GetServiceDB().DeleteScheduledJob(job.ID); err != nil {
+		logger.WithError(err).Error("Failed to delete scheduled job which has run")
+	}
+}
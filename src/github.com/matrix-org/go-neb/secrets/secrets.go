@@ -0,0 +1,179 @@
+// Package secrets lets realm and service configs refer to secrets, such as OAuth client secrets,
+// rather than contain them. A Secret given as a reference is resolved whenever the config is
+// loaded, but only the reference is stored in the database and exported, so the secret itself
+// never leaves where it is kept. References look like:
+//
+//	${env:GITHUB_CLIENT_SECRET}             the environment variable GITHUB_CLIENT_SECRET
+//	${file:/run/secrets/github}             the contents of a file, without trailing newlines
+//	${vault:secret/data/goneb#github}       the "github" field of a Vault KV secret
+//
+// Anything else is used as the secret itself, as before.
+package secrets
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/matrix-org/go-neb/httpclient"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// vaultCacheLifetime is how long secrets read from Vault are used for before being read again, so
+// that loading a realm doesn't mean a request to Vault every time.
+const vaultCacheLifetime = 5 * time.Minute
+
+var refRegex = regexp.MustCompile(`^\$\{(env|file|vault):([^}]+)\}$`)
+
+// A Secret is a config value which may be given as a reference. Its zero value is an empty secret.
+type Secret struct {
+	ref   string
+	value string
+}
+
+// New returns a secret given as itself rather than as a reference.
+func New(value string) Secret {
+	return Secret{value: value}
+}
+
+// Value returns the secret itself.
+func (s Secret) Value() string {
+	return s.value
+}
+
+// UnmarshalJSON reads a secret from a JSON string, resolving it if it is a reference.
+func (s *Secret) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return err
+	}
+	groups := refRegex.FindStringSubmatch(str)
+	if groups == nil {
+		*s = Secret{value: str}
+		return nil
+	}
+	value, err := resolve(groups[1], groups[2])
+	if err != nil {
+		return fmt.Errorf("Failed to resolve secret %s: %s", str, err)
+	}
+	*s = Secret{ref: str, value: value}
+	return nil
+}
+
+// MarshalJSON writes the reference the secret was given as, or else the secret itself.
+func (s Secret) MarshalJSON() ([]byte, error) {
+	if s.ref != "" {
+		return json.Marshal(s.ref)
+	}
+	return json.Marshal(s.value)
+}
+
+func resolve(kind, name string) (string, error) {
+	switch kind {
+	case "env":
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", errors.New("the environment variable is not set")
+		}
+		return value, nil
+	case "file":
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	}
+	return vault.read(name)
+}
+
+var vault = &vaultClient{
+	cache:      make(map[string]vaultEntry),
+	httpClient: httpclient.New(10 * time.Second),
+}
+
+// SetVault sets the Vault server which ${vault:...} references are read from, and the token to
+// read them with.
+func SetVault(addr, token string) {
+	vault.mu.Lock()
+	defer vault.mu.Unlock()
+	vault.addr = strings.TrimSuffix(addr, "/")
+	vault.token = token
+	vault.cache = make(map[string]vaultEntry)
+}
+
+type vaultEntry struct {
+	fields  map[string]interface{}
+	fetched time.Time
+}
+
+type vaultClient struct {
+	mu         sync.Mutex
+	addr       string
+	token      string
+	cache      map[string]vaultEntry // secret path => fields
+	httpClient *http.Client
+}
+
+// read returns a field of a secret, given as "path#field". Both KV version 1 and 2 secrets engines
+// are supported: for version 2 the path includes "data/", e.g. "secret/data/goneb#github".
+func (v *vaultClient) read(ref string) (string, error) {
+	i := strings.LastIndex(ref, "#")
+	if i == -1 {
+		return "", errors.New("Vault references must look like path#field")
+	}
+	path, field := strings.Trim(ref[:i], "/"), ref[i+1:]
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.addr == "" {
+		return "", errors.New("VAULT_ADDR is not set")
+	}
+	entry, ok := v.cache[path]
+	if !ok || time.Since(entry.fetched) > vaultCacheLifetime {
+		fields, err := v.fetch(path)
+		if err != nil {
+			return "", err
+		}
+		entry = vaultEntry{fields, time.Now()}
+		v.cache[path] = entry
+	}
+	value, ok := entry.fields[field].(string)
+	if !ok {
+		return "", errors.New("the secret has no string field " + field)
+	}
+	return value, nil
+}
+
+func (v *vaultClient) fetch(path string) (map[string]interface{}, error) {
+	req, err := http.NewRequest("GET", v.addr+"/v1/"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	res, err := v.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("Vault returned HTTP %d", res.StatusCode)
+	}
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	// KV version 2 nests the fields, along with the secret's metadata.
+	if nested, ok := body.Data["data"].(map[string]interface{}); ok {
+		if _, hasMetadata := body.Data["metadata"]; hasMetadata {
+			return nested, nil
+		}
+	}
+	return body.Data, nil
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/httpclient"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GithubMetaURL is where Github publishes the ranges its webhooks are sent from.
+const GithubMetaURL = "https://api.github.com/meta"
+
+const (
+	// publishedRangesLifetime is how long published ranges are used for before being fetched again.
+	publishedRangesLifetime = time.Hour
+	// publishedRangesRetry is how long to wait before fetching published ranges again after failing
+	// to, so that webhook requests aren't held up fetching them every time while the provider is down.
+	publishedRangesRetry = time.Minute
+)
+
+// An Allowlist is the networks which requests may come from. The zero Allowlist allows requests
+// from anywhere.
+type Allowlist struct {
+	nets      []*net.IPNet
+	providers []string // meta URLs of providers whose published ranges are allowed
+}
+
+// ParseAllowlist parses IP addresses and CIDR ranges, e.g. "10.0.0.0/8", along with "github" for
+// the ranges Github publishes its webhooks as coming from, or "github:<meta URL>" for those of a
+// Github Enterprise server, e.g. "github:https://github.example.com/api/v3/meta".
+func ParseAllowlist(entries []string) (*Allowlist, error) {
+	a := &Allowlist{}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if entry == "github" {
+			a.providers = append(a.providers, GithubMetaURL)
+			continue
+		}
+		if strings.HasPrefix(entry, "github:") {
+			a.providers = append(a.providers, strings.TrimPrefix(entry, "github:"))
+			continue
+		}
+		n, err := parseNetwork(entry)
+		if err != nil {
+			return nil, fmt.Errorf("Bad allowed IP %q: %s", entry, err)
+		}
+		a.nets = append(a.nets, n)
+	}
+	return a, nil
+}
+
+// Empty returns true if the allowlist allows requests from anywhere.
+func (a *Allowlist) Empty() bool {
+	return a == nil || (len(a.nets) == 0 && len(a.providers) == 0)
+}
+
+// Allows returns true if the IP address is in one of the allowed networks. Published ranges are
+// fetched when first needed and then refreshed in the background every hour. If they have never
+// been fetched successfully, no address is in them.
+func (a *Allowlist) Allows(addr string) bool {
+	if a.Empty() {
+		return true
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	if containsIP(a.nets, ip) {
+		return true
+	}
+	for _, metaURL := range a.providers {
+		if containsIP(published.ranges(metaURL), ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsRequest returns true if the client which made the request is allowed.
+func (a *Allowlist) AllowsRequest(req *http.Request) bool {
+	return a.Empty() || a.Allows(ClientIP(req))
+}
+
+type publishedRanges struct {
+	nets       []*net.IPNet
+	fetched    time.Time
+	attempted  time.Time
+	refreshing bool
+}
+
+var published = &publishedRangesCache{
+	m:          make(map[string]*publishedRanges),
+	httpClient: httpclient.New(10 * time.Second),
+}
+
+type publishedRangesCache struct {
+	mu         sync.Mutex
+	m          map[string]*publishedRanges // meta URL => ranges
+	httpClient *http.Client
+}
+
+// ranges returns the webhook ranges published at the meta URL. The first time they are needed
+// they are fetched before returning. After that, stale ranges are returned while they are
+// refreshed in the background, and kept if refreshing fails. Only one fetch of each meta URL is
+// made at a time, and the cache isn't locked while it is made.
+func (c *publishedRangesCache) ranges(metaURL string) []*net.IPNet {
+	c.mu.Lock()
+	r := c.m[metaURL]
+	if r == nil {
+		r = &publishedRanges{}
+		c.m[metaURL] = r
+	}
+	if r.refreshing || time.Since(r.fetched) < publishedRangesLifetime || time.Since(r.attempted) < publishedRangesRetry {
+		nets := r.nets
+		c.mu.Unlock()
+		return nets
+	}
+	r.attempted = time.Now()
+	r.refreshing = true
+	nets, everFetched := r.nets, !r.fetched.IsZero()
+	c.mu.Unlock()
+
+	if everFetched {
+		go c.refresh(metaURL, r)
+		return nets
+	}
+	return c.refresh(metaURL, r)
+}
+
+// refresh fetches the ranges published at the meta URL and swaps them into r, returning r's
+// ranges afterwards.
+func (c *publishedRangesCache) refresh(metaURL string, r *publishedRanges) []*net.IPNet {
+	nets, err := c.fetch(metaURL)
+	if err != nil {
+		log.WithError(err).WithField("url", metaURL).Error("Failed to fetch published webhook IP ranges")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r.refreshing = false
+	if err == nil {
+		r.nets = nets
+		r.fetched = time.Now()
+	}
+	return r.nets
+}
+
+func (c *publishedRangesCache) fetch(metaURL string) ([]*net.IPNet, error) {
+	res, err := c.httpClient.Get(metaURL)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("%s returned HTTP %d", metaURL, res.StatusCode)
+	}
+	var meta struct {
+		Hooks []string `json:"hooks"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&meta); err != nil {
+		return nil, err
+	}
+	if len(meta.Hooks) == 0 {
+		return nil, fmt.Errorf("%s lists no webhook ranges", metaURL)
+	}
+	var nets []*net.IPNet
+	for _, hook := range meta.Hooks {
+		n, err := parseNetwork(hook)
+		if err != nil {
+			return nil, fmt.Errorf("Bad range %q from %s: %s", hook, metaURL, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
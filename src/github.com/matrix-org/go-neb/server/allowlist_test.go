@@ -0,0 +1,179 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseNetwork(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{"10.0.0.1", "10.0.0.1/32", false},
+		{"10.0.0.0/8", "10.0.0.0/8", false},
+		{"10.1.2.3/16", "10.1.0.0/16", false},
+		{"::1", "::1/128", false},
+		{"2001:db8::/32", "2001:db8::/32", false},
+		{"10.0.0.0/33", "", true},
+		{"not an ip", "", true},
+		{"", "", true},
+	}
+	for _, test := range tests {
+		n, err := parseNetwork(test.in)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("parseNetwork(%q) => want an error, got %s", test.in, n)
+			}
+			continue
+		}
+		if err != nil || n.String() != test.want {
+			t.Errorf("parseNetwork(%q) => want %s, got %v, %v", test.in, test.want, n, err)
+		}
+	}
+}
+
+func TestParseAllowlist(t *testing.T) {
+	tests := []struct {
+		entries   []string
+		allowed   []string
+		refused   []string
+		wantEmpty bool
+		wantErr   bool
+	}{
+		{nil, []string{"1.2.3.4", "::1"}, nil, true, false},
+		{[]string{" ", ""}, []string{"1.2.3.4"}, nil, true, false},
+		{[]string{"10.0.0.0/8", " 192.168.1.1 "}, []string{"10.9.8.7", "192.168.1.1"}, []string{"11.0.0.1", "192.168.1.2", "::1", "not an ip"}, false, false},
+		{[]string{"2001:db8::/32"}, []string{"2001:db8::1"}, []string{"2001:db9::1", "10.0.0.1"}, false, false},
+		{[]string{"10.0.0.0/8", "10.0.0.300"}, nil, nil, false, true},
+	}
+	for _, test := range tests {
+		a, err := ParseAllowlist(test.entries)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("ParseAllowlist(%q) => want an error, got none", test.entries)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseAllowlist(%q) => want no error, got %s", test.entries, err)
+			continue
+		}
+		if a.Empty() != test.wantEmpty {
+			t.Errorf("ParseAllowlist(%q).Empty() => want %v, got %v", test.entries, test.wantEmpty, a.Empty())
+		}
+		for _, addr := range test.allowed {
+			if !a.Allows(addr) {
+				t.Errorf("ParseAllowlist(%q).Allows(%q) => want true, got false", test.entries, addr)
+			}
+		}
+		for _, addr := range test.refused {
+			if a.Allows(addr) {
+				t.Errorf("ParseAllowlist(%q).Allows(%q) => want false, got true", test.entries, addr)
+			}
+		}
+	}
+}
+
+func TestAllowlistPublishedRanges(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"hooks":["192.30.252.0/22","2620:112:3000::/44"]}`))
+	}))
+	defer srv.Close()
+	a, err := ParseAllowlist([]string{"127.0.0.2", "github:" + srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, want := range map[string]bool{
+		"127.0.0.2":         true,
+		"192.30.253.1":      true,
+		"2620:112:3000::1":  true,
+		"192.30.1.1":        false,
+		"2620:112:4000::1":  false,
+		"not an ip address": false,
+	} {
+		if got := a.Allows(addr); got != want {
+			t.Errorf("Allows(%q) with published ranges => want %v, got %v", addr, want, got)
+		}
+	}
+}
+
+func TestPublishedRangesRefresh(t *testing.T) {
+	var mu sync.Mutex
+	hook := "10.0.0.0/8"
+	fetched := make(chan bool, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Fprintf(w, `{"hooks":[%q]}`, hook)
+		fetched <- true
+	}))
+	defer srv.Close()
+	c := &publishedRangesCache{m: make(map[string]*publishedRanges), httpClient: srv.Client()}
+
+	if nets := c.ranges(srv.URL); len(nets) != 1 || nets[0].String() != "10.0.0.0/8" {
+		t.Fatalf("First ranges() => want the fetched range, got %v", nets)
+	}
+	<-fetched
+
+	// Make the ranges stale and change them: the stale ones are returned while they are refreshed.
+	mu.Lock()
+	hook = "172.16.0.0/12"
+	c.m[srv.URL].fetched = time.Now().Add(-2 * publishedRangesLifetime)
+	c.m[srv.URL].attempted = c.m[srv.URL].fetched
+	mu.Unlock()
+	if nets := c.ranges(srv.URL); len(nets) != 1 || nets[0].String() != "10.0.0.0/8" {
+		t.Errorf("Stale ranges() => want the stale range, got %v", nets)
+	}
+	<-fetched
+	for i := 0; ; i++ {
+		nets := c.ranges(srv.URL)
+		if len(nets) == 1 && nets[0].String() == "172.16.0.0/12" {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("ranges() after refreshing => want the refreshed range, got %v", nets)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPublishedRangesFetchDoesNotBlock(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-release
+		w.Write([]byte(`{"hooks":["10.0.0.0/8"]}`))
+	}))
+	defer slow.Close()
+	defer close(release)
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"hooks":["172.16.0.0/12"]}`))
+	}))
+	defer fast.Close()
+	c := &publishedRangesCache{m: make(map[string]*publishedRanges), httpClient: &http.Client{}}
+
+	go c.ranges(slow.URL)
+	time.Sleep(50 * time.Millisecond)
+	done := make(chan []*net.IPNet)
+	go func() {
+		done <- c.ranges(fast.URL)
+	}()
+	select {
+	case nets := <-done:
+		if len(nets) != 1 || nets[0].String() != "172.16.0.0/12" {
+			t.Errorf("ranges() while another URL is being fetched => want the fetched range, got %v", nets)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ranges() while another URL is being fetched => want it not to wait, but it did")
+	}
+	// While the first fetch of the slow URL is in flight, others don't fetch it again or wait.
+	if nets := c.ranges(slow.URL); len(nets) != 0 {
+		t.Errorf("ranges() while its first fetch is in flight => want no ranges, got %v", nets)
+	}
+}
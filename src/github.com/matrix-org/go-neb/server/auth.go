@@ -0,0 +1,73 @@
+package server
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// WithAdminAuth wraps the given handler such that it is only invoked if the request carries
+// the given shared secret as an "Authorization: Bearer <token>" header. Requests without a
+// valid token receive a 401 JSON error response. CORS preflight requests, which never carry
+// credentials, are answered with the CORS headers alone: the handler is never invoked without a
+// valid token. If token is empty, the handler is returned unchanged and no authentication is
+// performed.
+func WithAdminAuth(token string, handler http.HandlerFunc) http.HandlerFunc {
+	if token == "" {
+		return handler
+	}
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == "OPTIONS" {
+			SetCORSHeaders(w)
+			w.WriteHeader(204)
+			return
+		}
+		if !hasBearerToken(req, token) {
+			log.WithFields(log.Fields{
+				"url":         req.URL,
+				"remote_addr": ClientIP(req),
+			}).Warn("Rejecting admin request with missing or invalid token")
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("WWW-Authenticate", `Bearer realm="go-neb"`)
+			SetCORSHeaders(w)
+			jsonErrorResponse(w, req, &errors.HTTPError{nil, "Missing or invalid admin token", 401})
+			return
+		}
+		handler(w, req)
+	}
+}
+
+// hasBearerToken returns true if the request has an Authorization header containing the given token.
+// The comparison is performed in constant time.
+func hasBearerToken(req *http.Request, token string) bool {
+	authHeader := req.Header.Get("Authorization")
+	if !strings.HasPrefix(authHeader, "Bearer ") {
+		return false
+	}
+	given := strings.TrimSpace(strings.TrimPrefix(authHeader, "Bearer "))
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+// ClientCertTLSConfig returns a TLS config which requires and verifies client certificates
+// signed by one of the CAs in the PEM file at caFile. This can be used to protect the admin
+// listener with mutual TLS.
+func ClientCertTLSConfig(caFile string) (*tls.Config, error) {
+	caPEM, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("No PEM encoded certificates found in %s", caFile)
+	}
+	return &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  pool,
+	}, nil
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWithAdminAuth(t *testing.T) {
+	called := false
+	handler := WithAdminAuth("s3cret", func(w http.ResponseWriter, req *http.Request) {
+		called = true
+		w.Write([]byte("secret stuff"))
+	})
+	tests := []struct {
+		method     string
+		authHeader string
+		wantCode   int
+		wantCalled bool
+	}{
+		{"GET", "", 401, false},
+		{"GET", "Bearer wrong", 401, false},
+		{"GET", "s3cret", 401, false},
+		{"GET", "Bearer s3cret", 200, true},
+		{"OPTIONS", "", 204, false},
+		{"OPTIONS", "Bearer wrong", 204, false},
+	}
+	for _, test := range tests {
+		called = false
+		req := httptest.NewRequest(test.method, "/admin/configureService", nil)
+		if test.authHeader != "" {
+			req.Header.Set("Authorization", test.authHeader)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		if w.Code != test.wantCode || called != test.wantCalled {
+			t.Errorf("%s with Authorization %q => Want HTTP %d, handler called %v, got %d, %v", test.method, test.authHeader, test.wantCode, test.wantCalled, w.Code, called)
+		}
+		if test.method == "OPTIONS" && (w.Body.Len() != 0 || w.Header().Get("Access-Control-Allow-Origin") == "") {
+			t.Errorf("OPTIONS with Authorization %q => Want only CORS headers, got body %q headers %v", test.authHeader, w.Body.String(), w.Header())
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"github.com/matrix-org/go-neb/errors"
+	"net/http"
+	"sync"
+)
+
+// A Drainer tracks in-flight requests so that they can be allowed to finish before the process
+// exits. Once draining has started, new requests are rejected.
+type Drainer struct {
+	mu       sync.Mutex
+	draining bool
+	inFlight sync.WaitGroup
+}
+
+// Wrap wraps the given handler such that it is tracked by the Drainer. Requests which arrive
+// after draining has started receive a 503 so that the sender can retry them elsewhere or later.
+func (d *Drainer) Wrap(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !d.begin() {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Connection", "close")
+			jsonErrorResponse(w, req, &errors.HTTPError{nil, "Shutting down", 503})
+			return
+		}
+		defer d.inFlight.Done()
+		handler(w, req)
+	}
+}
+
+// Drain stops new requests from being accepted and blocks until all in-flight requests have finished.
+func (d *Drainer) Drain() {
+	d.mu.Lock()
+	d.draining = true
+	d.mu.Unlock()
+	d.inFlight.Wait()
+}
+
+func (d *Drainer) begin() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.draining {
+		return false
+	}
+	d.inFlight.Add(1)
+	return true
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// busyRejections is how many requests Limiters have rejected because too many were being handled.
+// Updated atomically.
+var busyRejections int64
+
+// BusyRejections returns how many requests have been rejected with HTTP 503 because too many
+// requests were already being handled.
+func BusyRejections() int64 {
+	return atomic.LoadInt64(&busyRejections)
+}
+
+// A Limiter protects a handler from senders which are malicious or misbehaving, by limiting the
+// size of request bodies and the number of requests handled at once.
+type Limiter struct {
+	maxBodySize int64
+	slots       chan struct{} // nil if the number of requests isn't limited
+}
+
+// NewLimiter returns a Limiter which rejects request bodies larger than maxBodySize bytes and
+// handles at most maxConcurrent requests at once. Either may be 0 for no limit.
+func NewLimiter(maxBodySize int64, maxConcurrent int) *Limiter {
+	l := &Limiter{maxBodySize: maxBodySize}
+	if maxConcurrent > 0 {
+		l.slots = make(chan struct{}, maxConcurrent)
+	}
+	return l
+}
+
+// Wrap wraps the given handler such that requests over the limits are rejected: with HTTP 413 if
+// the body is too large, or HTTP 503 if too many requests are already being handled. Senders such
+// as Github retry failed deliveries, so rejecting requests is better than running out of memory.
+func (l *Limiter) Wrap(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if l.maxBodySize > 0 {
+			if req.ContentLength > l.maxBodySize {
+				RequestLogger(req).WithField("content_length", req.ContentLength).Warn("Rejecting request: body too large")
+				w.WriteHeader(413)
+				return
+			}
+			// The sender may have lied about the length, or not said.
+			req.Body = http.MaxBytesReader(w, req.Body, l.maxBodySize)
+		}
+		if l.slots != nil {
+			select {
+			case l.slots <- struct{}{}:
+				defer func() { <-l.slots }()
+			default:
+				atomic.AddInt64(&busyRejections, 1)
+				RequestLogger(req).Warn("Rejecting request: too many concurrent requests")
+				w.Header().Set("Retry-After", "10")
+				w.WriteHeader(503)
+				return
+			}
+		}
+		handler(w, req)
+	}
+}
+
+// LimitListener returns a listener which has at most n connections open at once. Further
+// connections wait to be accepted until an open one is closed. This stops senders from using up
+// all of the process's file descriptors.
+func LimitListener(l net.Listener, n int) net.Listener {
+	return &limitListener{Listener: l, slots: make(chan struct{}, n), done: make(chan struct{})}
+}
+
+var errListenerClosed = errors.New("listener closed")
+
+type limitListener struct {
+	net.Listener
+	slots     chan struct{}
+	done      chan struct{} // closed when the listener is closed
+	closeOnce sync.Once
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	select {
+	case l.slots <- struct{}{}:
+	case <-l.done:
+		return nil, errListenerClosed
+	}
+	c, err := l.Listener.Accept()
+	if err != nil {
+		<-l.slots
+		return nil, err
+	}
+	return &limitListenerConn{Conn: c, release: func() { <-l.slots }}, nil
+}
+
+// Close closes the listener, including stopping any Accept which is waiting for a free slot.
+func (l *limitListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+type limitListenerConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitListenerConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	log "github.com/Sirupsen/logrus"
+	"net/http"
+)
+
+// RequestIDHeader is the header which carries the correlation ID of an incoming request. If the
+// sender (or a reverse proxy in front of Go-NEB) sets it, that ID is used; otherwise one is generated.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength is the longest request ID which will be accepted from a client. Longer IDs
+// are replaced so that clients cannot fill the logs with junk.
+const maxRequestIDLength = 128
+
+// WithRequestID wraps the given handler such that every request has a correlation ID in its
+// RequestIDHeader by the time the handler is invoked. The ID is echoed back in the response.
+// Use RequestLogger to log with the ID.
+func WithRequestID(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		setRequestID(w, req)
+		handler(w, req)
+	}
+}
+
+// RequestLogger returns a logger which tags every line with the correlation ID of the request,
+// so the lifecycle of a single request can be traced through aggregated logs.
+func RequestLogger(req *http.Request) *log.Entry {
+	return log.WithField("request_id", req.Header.Get(RequestIDHeader))
+}
+
+func setRequestID(w http.ResponseWriter, req *http.Request) {
+	id := req.Header.Get(RequestIDHeader)
+	if id == "" || len(id) > maxRequestIDLength {
+		id = newRequestID()
+		req.Header.Set(RequestIDHeader, id)
+	}
+	w.Header().Set(RequestIDHeader, id)
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		// crypto/rand never fails on supported platforms, and a missing ID is not worth failing
+		// the request over.
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
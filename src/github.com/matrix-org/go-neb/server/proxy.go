@@ -0,0 +1,119 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxies are the networks which reverse proxies in front of Go-NEB connect from. The
+// X-Forwarded-* headers are only believed if they were set by one of these.
+var trustedProxies []*net.IPNet
+
+// TrustProxies sets the reverse proxies whose X-Forwarded-For and X-Forwarded-Proto headers are
+// believed, as a comma separated list of IP addresses and CIDR ranges, e.g. "127.0.0.1,10.0.0.0/8".
+func TrustProxies(proxies string) error {
+	var nets []*net.IPNet
+	for _, p := range strings.Split(proxies, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		n, err := parseNetwork(p)
+		if err != nil {
+			return fmt.Errorf("Bad trusted proxy %q: %s", p, err)
+		}
+		nets = append(nets, n)
+	}
+	trustedProxies = nets
+	return nil
+}
+
+// parseNetwork parses a CIDR range, or an IP address as the range of just that address.
+func parseNetwork(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+			s += "/32"
+		} else {
+			s += "/128"
+		}
+	}
+	_, n, err := net.ParseCIDR(s)
+	return n, err
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(strings.TrimSpace(addr))
+	return ip != nil && containsIP(trustedProxies, ip)
+}
+
+func remoteIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// ClientIP returns the IP address of the client which made the request. If the request came via
+// trusted proxies, this is the address they say they received it from.
+func ClientIP(req *http.Request) string {
+	ip := remoteIP(req)
+	if !isTrustedProxy(ip) {
+		return ip
+	}
+	// Each proxy appends the address it received the request from, so walk back along the list
+	// until we find an address we don't trust. Anything before that could have been made up.
+	forwarded := strings.Split(strings.Join(req.Header["X-Forwarded-For"], ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(forwarded[i])
+		if addr == "" {
+			continue
+		}
+		ip = addr
+		if !isTrustedProxy(addr) {
+			break
+		}
+	}
+	return ip
+}
+
+// Scheme returns "https" if the client made the request over TLS, else "http". If the request
+// came via a trusted proxy, the proxy's X-Forwarded-Proto header is believed.
+func Scheme(req *http.Request) string {
+	if proto := req.Header.Get("X-Forwarded-Proto"); proto != "" && isTrustedProxy(remoteIP(req)) {
+		return strings.ToLower(strings.TrimSpace(strings.Split(proto, ",")[0]))
+	}
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// WithPathPrefix wraps the given handler such that it also handles requests under the given path
+// prefix, as if the prefix wasn't there. This lets Go-NEB sit behind reverse proxies which serve it
+// under a prefix, whether or not they strip the prefix before passing the request on. If prefix is
+// empty or "/", the handler is returned unchanged.
+func WithPathPrefix(prefix string, handler http.Handler) http.Handler {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == prefix || strings.HasPrefix(req.URL.Path, prefix+"/") {
+			http.StripPrefix(prefix, handler).ServeHTTP(w, req)
+			return
+		}
+		handler.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,29 @@
+package server
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"net/http"
+	"runtime/debug"
+)
+
+// WithRecovery wraps the given handler such that a panic in it is logged as an error, with a stack
+// trace, and answered with HTTP 500. Without this, the panic would be logged by net/http where
+// error reporting can't see it.
+func WithRecovery(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		defer func() {
+			if r := recover(); r != nil {
+				RequestLogger(req).WithFields(log.Fields{
+					"url":   req.URL,
+					"panic": fmt.Sprint(r),
+					"stack": string(debug.Stack()),
+				}).Error("Recovered from panic in HTTP handler")
+				// If the handler already started responding, this does nothing and the client
+				// receives a truncated response.
+				w.WriteHeader(500)
+			}
+		}()
+		handler(w, req)
+	}
+}
@@ -0,0 +1,22 @@
+package server
+
+import (
+	"context"
+	"net/http"
+)
+
+type replayKey struct{}
+
+// MarkReplay returns a copy of the request marked as a replay of a stored webhook delivery.
+// Replays are asked for through the admin API, which authenticates them, and tokens sent in
+// Authorization headers or query parameters aren't stored with deliveries, so services which check
+// such a token skip the check for replays. Senders can't mark their own requests: the mark is not a header.
+func MarkReplay(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), replayKey{}, true))
+}
+
+// IsReplay returns true if the request was marked with MarkReplay.
+func IsReplay(req *http.Request) bool {
+	replay, _ := req.Context().Value(replayKey{}).(bool)
+	return replay
+}
@@ -35,11 +35,14 @@ func WithCORSOptions(handler http.HandlerFunc) http.HandlerFunc {
 }
 
 // MakeJSONAPI creates an HTTP handler which always responds to incoming requests with JSON responses.
+// Each request is given a correlation ID: see WithRequestID.
 func MakeJSONAPI(handler JSONRequestHandler) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
-		logger := log.WithFields(log.Fields{
-			"method": req.Method,
-			"url":    req.URL,
+		setRequestID(w, req)
+		logger := RequestLogger(req).WithFields(log.Fields{
+			"method":      req.Method,
+			"url":         req.URL,
+			"remote_addr": ClientIP(req),
 		})
 		logger.Print(">>> Incoming request")
 		res, httpErr := handler.OnIncomingRequest(req)
@@ -72,13 +75,14 @@ func MakeJSONAPI(handler JSONRequestHandler) http.HandlerFunc {
 
 func jsonErrorResponse(w http.ResponseWriter, req *http.Request, httpErr *errors.HTTPError) {
 	if httpErr.Code == 302 {
-		log.WithField("err", httpErr.Error()).Print("Redirecting")
+		RequestLogger(req).WithField("err", httpErr.Error()).Print("Redirecting")
 		http.Redirect(w, req, httpErr.Message, 302)
 		return
 	}
 
-	log.WithField("err", httpErr.Error()).Print("Request failed")
-	log.WithFields(log.Fields{
+	logger := RequestLogger(req)
+	logger.WithField("err", httpErr.Error()).Print("Request failed")
+	logger.WithFields(log.Fields{
 		"url":     req.URL,
 		"code":    httpErr.Code,
 		"message": httpErr.Message,
@@ -92,7 +96,7 @@ func jsonErrorResponse(w http.ResponseWriter, req *http.Request, httpErr *errors
 	if err != nil {
 		// We should never fail to marshal the JSON error response, but in this event just skip
 		// marshalling altogether
-		log.Warn("Failed to marshal error response")
+		logger.Warn("Failed to marshal error response")
 		w.Write([]byte(`{}`))
 		return
 	}
@@ -103,5 +107,22 @@ func jsonErrorResponse(w http.ResponseWriter, req *http.Request, httpErr *errors
 func SetCORSHeaders(w http.ResponseWriter) {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Origin, X-Requested-With, Content-Type, Accept")
+	w.Header().Set("Access-Control-Allow-Headers", "Origin, X-Requested-With, Content-Type, Accept, Authorization")
+}
+
+// A StatusRecorder wraps an http.ResponseWriter and remembers the status code which was written.
+type StatusRecorder struct {
+	http.ResponseWriter
+	Code int
+}
+
+// NewStatusRecorder returns a StatusRecorder for w. The Code is 200 until WriteHeader is called.
+func NewStatusRecorder(w http.ResponseWriter) *StatusRecorder {
+	return &StatusRecorder{w, 200}
+}
+
+// WriteHeader records the code and writes it to the wrapped ResponseWriter.
+func (r *StatusRecorder) WriteHeader(code int) {
+	r.Code = code
+	r.ResponseWriter.WriteHeader(code)
 }
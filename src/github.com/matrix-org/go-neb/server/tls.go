@@ -0,0 +1,83 @@
+package server
+
+import (
+	"crypto/tls"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"sync"
+)
+
+// A Certificate is a TLS certificate and private key loaded from PEM files. It can be reloaded
+// from the files, e.g. after they have been renewed, without restarting the listeners using it.
+type Certificate struct {
+	certFile string
+	keyFile  string
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+}
+
+// LoadCertificate loads a certificate and its private key from PEM files.
+func LoadCertificate(certFile, keyFile string) (*Certificate, error) {
+	c := &Certificate{certFile: certFile, keyFile: keyFile}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload loads the certificate from its files again. New connections use the new certificate.
+// If the files can't be loaded, the previous certificate is kept.
+func (c *Certificate) Reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cert = &cert
+	return nil
+}
+
+// GetCertificate returns the most recently loaded certificate. It is the GetCertificate function
+// of the TLS config returned by TLSConfig.
+func (c *Certificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// TLSConfig returns a TLS config for serving HTTP with this certificate.
+func (c *Certificate) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: c.GetCertificate,
+		NextProtos:     []string{"http/1.1"},
+	}
+}
+
+// NewACMEManager returns a manager which obtains certificates for the given host names from an
+// ACME directory, e.g. Let's Encrypt's, and renews them before they expire. Certificates and the
+// ACME account key are kept in the cache directory, so they are reused after a restart. The
+// directory URL defaults to Let's Encrypt's, and the email address, which the CA uses to warn about
+// problems with the certificates, is optional.
+func NewACMEManager(hostNames []string, cacheDir, email, directoryURL string) *autocert.Manager {
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cacheDir),
+		HostPolicy: autocert.HostWhitelist(hostNames...),
+		Email:      email,
+	}
+	if directoryURL != "" {
+		m.Client = &acme.Client{DirectoryURL: directoryURL}
+	}
+	return m
+}
+
+// ACMETLSConfig returns a TLS config for serving HTTP with certificates from the manager. The CA
+// can prove control of the host names with the tls-alpn-01 challenge on port 443 of the listener,
+// or with http-01 on port 80 if the manager's HTTPHandler is served there.
+func ACMETLSConfig(m *autocert.Manager) *tls.Config {
+	return &tls.Config{
+		GetCertificate: m.GetCertificate,
+		NextProtos:     []string{"http/1.1", acme.ALPNProto},
+	}
+}
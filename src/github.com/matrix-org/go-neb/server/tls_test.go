@@ -0,0 +1,33 @@
+package server
+
+import (
+	"golang.org/x/crypto/acme"
+	"golang.org/x/net/context"
+	"testing"
+)
+
+func TestACMEManager(t *testing.T) {
+	m := NewACMEManager([]string{"neb.example.com", "hooks.example.com"}, t.TempDir(), "ops@example.com", "https://acme.example.com/directory")
+	for host, want := range map[string]bool{
+		"neb.example.com":   true,
+		"hooks.example.com": true,
+		"example.com":       false,
+		"evil.example.net":  false,
+	} {
+		if err := m.HostPolicy(context.Background(), host); (err == nil) != want {
+			t.Errorf("HostPolicy(%q) => want allowed %v, got %v", host, want, err)
+		}
+	}
+	if m.Client == nil || m.Client.DirectoryURL != "https://acme.example.com/directory" {
+		t.Errorf("NewACMEManager => want the given directory URL, got %+v", m.Client)
+	}
+	if m.Email != "ops@example.com" {
+		t.Errorf("NewACMEManager => want email ops@example.com, got %q", m.Email)
+	}
+	if protos := ACMETLSConfig(m).NextProtos; len(protos) != 2 || protos[1] != acme.ALPNProto {
+		t.Errorf("ACMETLSConfig => want tls-alpn-01 to be answered, got NextProtos %v", protos)
+	}
+	if m := NewACMEManager([]string{"neb.example.com"}, t.TempDir(), "", ""); m.Client != nil {
+		t.Errorf("NewACMEManager without a directory URL => want Let's Encrypt's, got %+v", m.Client)
+	}
+}
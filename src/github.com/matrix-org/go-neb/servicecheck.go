@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/errors"
+	"github.com/matrix-org/go-neb/ops"
+	"github.com/matrix-org/go-neb/types"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// The policies for checking services at startup, set with STARTUP_CHECK.
+const (
+	startupCheckOff    = "off"    // don't check services
+	startupCheckReport = "report" // log and alert about broken services
+	startupCheckRepair = "repair" // also try to fix them by registering them again
+	startupCheckLazy   = "lazy"   // log and alert about each service the first time it is used
+)
+
+// maxConcurrentServices is how many services are checked, or applied from a config file, at once.
+// Most of the time goes on waiting for other servers, so doing them one at a time makes starting
+// an instance with hundreds of services take minutes.
+const maxConcurrentServices = 16
+
+// serviceCheck is the result of checking a single service.
+type serviceCheck struct {
+	ID          string
+	Type        string
+	Problems    []string // Empty if the service is fine.
+	Repaired    bool     // True if the service was registered again to fix the problems.
+	RepairError string   // Why registering the service again failed, if it did.
+}
+
+// checkService checks that the service is valid and that what it registered is still in place.
+// If repair is true and there are problems, the service is registered again to fix them. Services
+// which can't check what they registered are only validated.
+func (s *configureServiceHandler) checkService(service types.Service, repair bool) serviceCheck {
+	mut := s.getMutexForServiceID(service.ServiceID())
+	mut.Lock()
+	defer mut.Unlock()
+
+	check := serviceCheck{ID: service.ServiceID(), Type: service.ServiceType()}
+	if configErrs := service.ValidateConfig(); len(configErrs) > 0 {
+		// An invalid service can't be fixed by registering it again.
+		for _, e := range configErrs {
+			check.Problems = append(check.Problems, "Invalid config: "+e.Error())
+		}
+		return check
+	}
+	client, err := s.clients.Client(service.ServiceUserID())
+	if err != nil {
+		check.Problems = []string{fmt.Sprintf("Failed to load client %s: %s", service.ServiceUserID(), err)}
+		return check
+	}
+
+	switch srv := service.(type) {
+	case types.RegisterChecker:
+		check.Problems, err = srv.CheckRegistered(client)
+	case types.RegisterPlanner:
+		_, err = srv.PlanRegister(service, client)
+	default:
+		// Services which can't plan have no side effects in Register: see types.RegisterPlanner.
+		err = service.Register(service, client)
+	}
+	if err != nil {
+		// An invalid service can't be fixed by registering it again.
+		check.Problems = append(check.Problems, "Invalid service: "+err.Error())
+		return check
+	}
+
+	if len(check.Problems) > 0 && repair {
+		if err = service.Register(nil, client); err != nil {
+			check.RepairError = err.Error()
+		} else {
+			check.Repaired = true
+		}
+	}
+	return check
+}
+
+// checkServices checks every service, logging and alerting about the problems found. The checks
+// are returned in the order the services were loaded.
+func (s *configureServiceHandler) checkServices(repair bool) ([]serviceCheck, error) {
+	services, err := s.db.LoadServices()
+	if err != nil {
+		return nil, err
+	}
+	checks := make([]serviceCheck, len(services))
+	forEachConcurrently(len(services), maxConcurrentServices, func(i int) {
+		checks[i] = s.checkService(services[i], repair)
+		reportCheck(checks[i])
+	})
+	return checks, nil
+}
+
+// reportCheck logs and alerts about the problems found by the check, if there are any.
+func reportCheck(check serviceCheck) {
+	if len(check.Problems) == 0 {
+		return
+	}
+	logger := log.WithFields(log.Fields{
+		"service_id":   check.ID,
+		"service_type": check.Type,
+		"problems":     check.Problems,
+	})
+	summary := strings.Join(check.Problems, "; ")
+	switch {
+	case check.Repaired:
+		logger.Info("Repaired service")
+		ops.Alert("Repaired service %s (%s): %s", check.ID, check.Type, summary)
+	case check.RepairError != "":
+		logger.WithField(log.ErrorKey, check.RepairError).Warn("Failed to repair service")
+		ops.Alert("Failed to repair service %s (%s): %s: %s", check.ID, check.Type, summary, check.RepairError)
+	default:
+		logger.Warn("Service has problems")
+		ops.Alert("Service %s (%s) has problems: %s", check.ID, check.Type, summary)
+	}
+}
+
+// A lazyChecker checks each service the first time it is used, for STARTUP_CHECK=lazy, rather than
+// every service at startup. Services which are never used are never checked.
+type lazyChecker struct {
+	services *configureServiceHandler
+	mu       sync.Mutex
+	checked  map[string]bool // service ID => true once it has been checked
+}
+
+func newLazyChecker(services *configureServiceHandler) *lazyChecker {
+	return &lazyChecker{services: services, checked: make(map[string]bool)}
+}
+
+// used checks the service in the background if it hasn't been checked since startup.
+func (l *lazyChecker) used(service types.Service) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.checked[service.ServiceID()] {
+		return
+	}
+	l.checked[service.ServiceID()] = true
+	go func() {
+		reportCheck(l.services.checkService(service, false))
+	}()
+}
+
+// forEachConcurrently calls fn with each index from 0 to n-1, up to limit of them at once, and
+// waits for them all to return.
+func forEachConcurrently(n, limit int, fn func(i int)) {
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+type checkServicesHandler struct {
+	services *configureServiceHandler
+}
+
+func (h *checkServicesHandler) OnIncomingRequest(req *http.Request) (interface{}, *errors.HTTPError) {
+	if req.Method != "POST" {
+		return nil, &errors.HTTPError{nil, "Unsupported Method", 405}
+	}
+	var body struct {
+		Repair bool
+	}
+	if req.ContentLength != 0 {
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			return nil, &errors.HTTPError{err, "Error parsing request JSON", 400}
+		}
+	}
+	checks, err := h.services.checkServices(body.Repair)
+	if err != nil {
+		return nil, &errors.HTTPError{err, "Failed to check services", 500}
+	}
+	return &struct {
+		Services []serviceCheck
+	}{checks}, nil
+}
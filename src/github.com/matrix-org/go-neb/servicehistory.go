@@ -0,0 +1,133 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/errors"
+	"github.com/matrix-org/go-neb/server"
+	"github.com/matrix-org/go-neb/types"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// serviceHistoryPath is the prefix of the paths serviceHistoryHandler serves: the service ID
+// follows it, then "/history" or "/rollback".
+const serviceHistoryPath = "/admin/services/"
+
+// adminActor describes who made an admin request, for services' histories: the address it came
+// from, and the name on its client certificate if the admin listener requires one.
+func adminActor(req *http.Request) string {
+	actor := "admin API from " + server.ClientIP(req)
+	if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+		actor += " as " + req.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	return actor
+}
+
+// serviceHistoryHandler shows the recorded changes to a service, with
+// GET /admin/services/{id}/history, and configures a service as it was after one of them, with
+// POST /admin/services/{id}/rollback and {"Version": N}.
+type serviceHistoryHandler struct {
+	db       *database.ServiceDB
+	services *configureServiceHandler
+}
+
+func (h *serviceHistoryHandler) OnIncomingRequest(req *http.Request) (interface{}, *errors.HTTPError) {
+	path := strings.TrimPrefix(req.URL.Path, serviceHistoryPath)
+	switch {
+	case strings.HasSuffix(path, "/history") && len(path) > len("/history"):
+		if req.Method != "GET" {
+			return nil, &errors.HTTPError{nil, "Unsupported Method", 405}
+		}
+		return h.history(strings.TrimSuffix(path, "/history"))
+	case strings.HasSuffix(path, "/rollback") && len(path) > len("/rollback"):
+		if req.Method != "POST" {
+			return nil, &errors.HTTPError{nil, "Unsupported Method", 405}
+		}
+		return h.rollback(req, strings.TrimSuffix(path, "/rollback"))
+	}
+	return nil, &errors.HTTPError{nil, "Not found", 404}
+}
+
+func (h *serviceHistoryHandler) history(serviceID string) (interface{}, *errors.HTTPError) {
+	changes, err := h.db.LoadServiceHistory(serviceID)
+	if err != nil {
+		return nil, &errors.HTTPError{err, "Failed to load service history", 500}
+	}
+	if changes == nil {
+		changes = []types.ServiceChange{}
+	}
+	for i := range changes {
+		if changes[i].OldConfig, err = redactRawConfig(changes[i].OldConfig); err != nil {
+			return nil, &errors.HTTPError{err, "Failed to redact service history", 500}
+		}
+		if changes[i].NewConfig, err = redactRawConfig(changes[i].NewConfig); err != nil {
+			return nil, &errors.HTTPError{err, "Failed to redact service history", 500}
+		}
+	}
+	return &struct {
+		ID      string
+		History []types.ServiceChange
+	}{serviceID, changes}, nil
+}
+
+// redactRawConfig redacts a service config in the history as listServices does, so that the
+// history doesn't give away the secrets it hides.
+func redactRawConfig(config json.RawMessage) (json.RawMessage, error) {
+	if config == nil {
+		return nil, nil
+	}
+	var v interface{}
+	if err := json.Unmarshal(config, &v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(redactConfig("", v))
+}
+
+func (h *serviceHistoryHandler) rollback(req *http.Request, serviceID string) (interface{}, *errors.HTTPError) {
+	var body struct {
+		Version int64
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		return nil, &errors.HTTPError{err, "Error parsing request JSON", 400}
+	}
+	if body.Version <= 0 {
+		return nil, &errors.HTTPError{nil, `Must supply a "Version"`, 400}
+	}
+	change, err := h.db.LoadServiceChange(serviceID, body.Version)
+	if err == sql.ErrNoRows {
+		return nil, &errors.HTTPError{err, "Version not found", 404}
+	} else if err != nil {
+		return nil, &errors.HTTPError{err, "Failed to load service history", 500}
+	}
+	if change.NewConfig == nil {
+		return nil, &errors.HTTPError{nil, "Version " + strconv.FormatInt(change.Version, 10) + " deleted the service: roll back to the one before it", 400}
+	}
+	log.WithFields(log.Fields{
+		"service_id": serviceID,
+		"version":    change.Version,
+	}).Print("Incoming roll back service request")
+
+	webhookKey, err := h.db.LoadWebhookKey(serviceID)
+	if err != nil {
+		return nil, &errors.HTTPError{err, "Error loading webhook key", 500}
+	}
+	service, err := types.CreateService(serviceID, change.Type, change.UserID, webhookKey, change.NewConfig)
+	if err != nil {
+		return nil, &errors.HTTPError{err, "Error parsing config JSON", 400}
+	}
+	actor := adminActor(req) + ", rolling back to version " + strconv.FormatInt(change.Version, 10)
+	oldService, httpErr := h.services.configureService(service, actor)
+	if httpErr != nil {
+		return nil, httpErr
+	}
+	return &struct {
+		ID        string
+		Type      string
+		OldConfig types.Service
+		NewConfig types.Service
+	}{service.ServiceID(), service.ServiceType(), oldService, service}, nil
+}
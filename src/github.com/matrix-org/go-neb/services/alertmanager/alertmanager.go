@@ -0,0 +1,373 @@
+package services
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/batch"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/plugin"
+	"github.com/matrix-org/go-neb/secrets"
+	"github.com/matrix-org/go-neb/server"
+	"github.com/matrix-org/go-neb/silence"
+	"github.com/matrix-org/go-neb/status"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/go-neb/util"
+	"html"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxBodySize is the largest webhook request Alertmanager is expected to send.
+const maxBodySize = 1024 * 1024
+
+// severityColours are the colours alerts are shown in, by their severity label. Resolved alerts
+// are resolvedColour, and alerts of other severities are left uncoloured.
+var severityColours = map[string]string{
+	"critical": "#d9534f",
+	"error":    "#d9534f",
+	"page":     "#d9534f",
+	"warning":  "#f0ad4e",
+	"info":     "#5bc0de",
+}
+
+const resolvedColour = "#5cb85c"
+
+// alertmanagerService posts a message to rooms when Prometheus' Alertmanager sends a webhook
+// about a group of alerts firing or resolving. Each room is sent the alerts which match its
+// matchers.
+type alertmanagerService struct {
+	id                 string
+	serviceUserID      string
+	webhookEndpointURL string
+	// Token must be sent with every request, as "Authorization: Bearer <token>" or a ?token=
+	// query parameter.
+	Token secrets.Secret
+	// AllowedIPs are the IP addresses and CIDR ranges Alertmanager may send webhook requests
+	// from. Optional: requests are allowed from anywhere.
+	AllowedIPs []string
+	// BatchWindow is how long to hold back messages for a receiver, e.g. "30s", so that alert
+	// groups sent to it in a burst are sent as one message. Optional: messages are sent as they
+	// arrive.
+	BatchWindow string
+	// AlertIfQuietFor is how long to go without a webhook from Alertmanager before alerting the
+	// operators that it is probably broken, e.g. "1h" with an always firing watchdog alert.
+	// Optional: they are never alerted.
+	AlertIfQuietFor string
+	Rooms           map[string]alertmanagerRoom // room_id => room
+}
+
+// alertmanagerRoom is which alerts a room is sent.
+type alertmanagerRoom struct {
+	// Receivers are the Alertmanager receivers whose alerts the room is sent. Optional: it is
+	// sent every receiver's.
+	Receivers []string
+	// Matchers are label matchers, e.g. `severity="critical"` or `team=~"db|infra"`, which an
+	// alert must match all of for the room to be sent it. Optional: it is sent every alert.
+	Matchers []string
+}
+
+// alertmanagerPayload is Alertmanager's webhook payload.
+type alertmanagerPayload struct {
+	Version           string            `json:"version"`
+	GroupKey          string            `json:"groupKey"`
+	Status            string            `json:"status"`
+	Receiver          string            `json:"receiver"`
+	GroupLabels       map[string]string `json:"groupLabels"`
+	CommonLabels      map[string]string `json:"commonLabels"`
+	CommonAnnotations map[string]string `json:"commonAnnotations"`
+	ExternalURL       string            `json:"externalURL"`
+	Alerts            []alert           `json:"alerts"`
+}
+
+type alert struct {
+	Status       string            `json:"status"` // "firing" or "resolved"
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations"`
+	StartsAt     string            `json:"startsAt"`
+	EndsAt       string            `json:"endsAt"`
+	GeneratorURL string            `json:"generatorURL"`
+	Fingerprint  string            `json:"fingerprint"`
+}
+
+func (s *alertmanagerService) ServiceUserID() string { return s.serviceUserID }
+func (s *alertmanagerService) ServiceID() string     { return s.id }
+func (s *alertmanagerService) ServiceType() string   { return "alertmanager" }
+func (s *alertmanagerService) Plugin(cli *matrix.Client, roomID string) plugin.Plugin {
+	return plugin.Plugin{}
+}
+func (s *alertmanagerService) WebhookAllowedIPs() []string { return s.AllowedIPs }
+func (s *alertmanagerService) QuietPeriod() time.Duration {
+	d, _ := status.ParseQuietPeriod(s.AlertIfQuietFor) // ValidateConfig checks it parses
+	return d
+}
+
+// OnReceiveWebhook sends a message about the group's alerts to each room which any of them are
+// for.
+func (s *alertmanagerService) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli *matrix.Client) {
+	logger := server.RequestLogger(req)
+	if !s.authorised(req) {
+		w.WriteHeader(401)
+		return
+	}
+	if req.Method != "POST" {
+		w.WriteHeader(405)
+		return
+	}
+	var p alertmanagerPayload
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxBodySize)).Decode(&p); err != nil {
+		logger.WithError(err).Print("Failed to decode Alertmanager webhook")
+		w.WriteHeader(400)
+		return
+	}
+	logger = logger.WithFields(log.Fields{
+		"receiver":  p.Receiver,
+		"group_key": p.GroupKey,
+		"status":    p.Status,
+	})
+
+	var msgs []batch.Message
+	for _, roomID := range util.SortedKeys(s.Rooms) {
+		alerts := unsilenced(roomID, s.alertsFor(roomID, p))
+		if len(alerts) == 0 {
+			continue
+		}
+		logger.WithField("room_id", roomID).Print("Sending alerts to room")
+		msgs = append(msgs, batch.Message{roomID, p.Receiver, alertMessage(p, alerts)})
+	}
+	if len(msgs) == 0 {
+		status.Filtered(s.id)
+		w.WriteHeader(200)
+		return
+	}
+	status.Forwarded(s.id)
+	window, _ := batch.ParseWindow(s.BatchWindow) // ValidateConfig checks it parses
+	sendErrs := batch.SendAll(cli, s.id, window, msgs)
+	for roomID, e := range sendErrs {
+		logger.WithError(e).WithField("room_id", roomID).Print("Failed to send notification to room.")
+	}
+	if len(sendErrs) > 0 {
+		// So that the request is dead-lettered, to be replayed once the rooms are fixed.
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(200)
+}
+
+// authorised returns true if the request carries the service's token, or is a replay.
+func (s *alertmanagerService) authorised(req *http.Request) bool {
+	if server.IsReplay(req) {
+		return true
+	}
+	token := req.URL.Query().Get("token")
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	want := s.Token.Value()
+	return want != "" && subtle.ConstantTimeCompare([]byte(token), []byte(want)) == 1
+}
+
+// alertsFor returns the payload's alerts which the room is sent, or nil if it isn't sent the
+// payload's receiver.
+func (s *alertmanagerService) alertsFor(roomID string, p alertmanagerPayload) []alert {
+	room := s.Rooms[roomID]
+	if len(room.Receivers) > 0 {
+		found := false
+		for _, r := range room.Receivers {
+			if r == p.Receiver {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil
+		}
+	}
+	matchers, _ := parseMatchers(room.Matchers) // ValidateConfig checks they parse
+	var alerts []alert
+	for _, a := range p.Alerts {
+		if matchesAll(matchers, a.Labels) {
+			alerts = append(alerts, a)
+		}
+	}
+	return alerts
+}
+
+// unsilenced returns the alerts which no silence in the room matches, by alert name or by a label
+// as "name=value", e.g. "severity=warning".
+func unsilenced(roomID string, alerts []alert) []alert {
+	if len(alerts) == 0 {
+		return nil
+	}
+	silences := silence.Load(roomID)
+	if len(silences) == 0 {
+		return alerts
+	}
+	var kept []alert
+	for _, a := range alerts {
+		subjects := []string{a.Labels["alertname"]}
+		for name, value := range a.Labels {
+			subjects = append(subjects, name+"="+value)
+		}
+		if !silences.Matches(subjects...) {
+			kept = append(kept, a)
+		}
+	}
+	return kept
+}
+
+// alertMessage writes a message about the alerts, headed by how many are firing and resolved and
+// the receiver they were sent to, with a line for each alert coloured by its severity.
+func alertMessage(p alertmanagerPayload, alerts []alert) matrix.HTMLMessage {
+	var firing, resolved int
+	for _, a := range alerts {
+		if a.Status == "resolved" {
+			resolved++
+		} else {
+			firing++
+		}
+	}
+	var counts []string
+	if firing > 0 {
+		counts = append(counts, fmt.Sprintf("FIRING:%d", firing))
+	}
+	if resolved > 0 {
+		counts = append(counts, fmt.Sprintf("RESOLVED:%d", resolved))
+	}
+	header := fmt.Sprintf("[%s] %s", strings.Join(counts, ", "), p.Receiver)
+	if groupLabels := labelString(p.GroupLabels); groupLabels != "" {
+		header += " (" + groupLabels + ")"
+	}
+	bodies := []string{header}
+	htmls := []string{"<b>" + html.EscapeString(header) + "</b>"}
+	for _, a := range alerts {
+		label, colour := alertLabel(a)
+		name := a.Labels["alertname"]
+		summary := a.Annotations["summary"]
+		if summary == "" {
+			summary = a.Annotations["description"]
+		}
+		body := fmt.Sprintf("[%s] %s", label, name)
+		htmlBody := "<b>" + html.EscapeString(name) + "</b>"
+		if colour != "" {
+			htmlBody = fmt.Sprintf(`<font color="%s">[%s]</font> %s`, colour, html.EscapeString(label), htmlBody)
+		} else {
+			htmlBody = fmt.Sprintf("[%s] %s", html.EscapeString(label), htmlBody)
+		}
+		if summary != "" {
+			body += ": " + summary
+			htmlBody += ": " + html.EscapeString(summary)
+		}
+		if a.GeneratorURL != "" {
+			body += " - " + a.GeneratorURL
+			htmlBody += fmt.Sprintf(` (<a href="%s">source</a>)`, html.EscapeString(a.GeneratorURL))
+		}
+		bodies = append(bodies, body)
+		htmls = append(htmls, htmlBody)
+	}
+	return matrix.HTMLMessage{
+		Body:          strings.Join(bodies, "\n"),
+		MsgType:       "m.notice",
+		Format:        "org.matrix.custom.html",
+		FormattedBody: strings.Join(htmls, "<br>"),
+	}
+}
+
+// alertLabel returns what an alert's line is labelled with, its severity or "resolved", and the
+// colour it is shown in, which is "" for unknown severities.
+func alertLabel(a alert) (string, string) {
+	if a.Status == "resolved" {
+		return "resolved", resolvedColour
+	}
+	severity := strings.ToLower(a.Labels["severity"])
+	if severity == "" {
+		return "firing", ""
+	}
+	return severity, severityColours[severity]
+}
+
+// labelString writes labels as "name=value" pairs, sorted by name.
+func labelString(labels map[string]string) string {
+	names := util.SortedKeys(labels)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + "=" + labels[name]
+	}
+	return strings.Join(pairs, ", ")
+}
+
+// ValidateConfig checks that the token is given, that the allowed IPs, batch window and quiet
+// period parse, and that every room ID is well formed and its matchers parse.
+func (s *alertmanagerService) ValidateConfig() []types.ConfigError {
+	var errs []types.ConfigError
+	if s.Token.Value() == "" {
+		errs = append(errs, types.ConfigError{Field: "Token", Message: "is required"})
+	}
+	if _, err := server.ParseAllowlist(s.AllowedIPs); err != nil {
+		errs = append(errs, types.ConfigError{Field: "AllowedIPs", Message: "does not parse: " + err.Error()})
+	}
+	if _, err := batch.ParseWindow(s.BatchWindow); err != nil {
+		errs = append(errs, types.ConfigError{Field: "BatchWindow", Message: "is not a valid window: " + err.Error()})
+	}
+	if _, err := status.ParseQuietPeriod(s.AlertIfQuietFor); err != nil {
+		errs = append(errs, types.ConfigError{Field: "AlertIfQuietFor", Message: "is not a valid period: " + err.Error()})
+	}
+	if len(s.Rooms) == 0 {
+		errs = append(errs, types.ConfigError{Field: "Rooms", Message: "must list at least one room"})
+	}
+	for _, roomID := range util.SortedKeys(s.Rooms) {
+		if !types.IsRoomID(roomID) {
+			errs = append(errs, types.ConfigError{Field: fmt.Sprintf("Rooms[%s]", roomID), Message: "is not a room ID"})
+		}
+		for i, m := range s.Rooms[roomID].Matchers {
+			if _, err := parseMatcher(m); err != nil {
+				errs = append(errs, types.ConfigError{
+					Field:   fmt.Sprintf("Rooms[%s].Matchers[%d]", roomID, i),
+					Message: "does not parse: " + err.Error(),
+				})
+			}
+		}
+	}
+	return errs
+}
+
+// Register joins the rooms messages are posted to.
+func (s *alertmanagerService) Register(oldService types.Service, client *matrix.Client) error {
+	for _, roomID := range util.SortedKeys(s.Rooms) {
+		if _, err := client.JoinRoom(roomID, "", ""); err != nil {
+			return err
+		}
+	}
+	log.WithFields(log.Fields{
+		"service_id": s.id,
+		"url":        s.webhookEndpointURL,
+	}).Info("Registered Alertmanager webhook: add the URL to a webhook_configs receiver in Alertmanager's config")
+	return nil
+}
+
+// PlanRegister works out which rooms Register would join. Alertmanager is configured by hand, so
+// the plan notes where it must send webhooks.
+func (s *alertmanagerService) PlanRegister(oldService types.Service, client *matrix.Client) (*types.RegisterPlan, error) {
+	plan := &types.RegisterPlan{JoinRooms: types.PlanJoinRooms(client, util.SortedKeys(s.Rooms))}
+	plan.Notes = []string{"Alertmanager must be told to send webhooks to " + s.webhookEndpointURL + " in a receiver's webhook_configs"}
+	return plan, nil
+}
+
+// CheckRegistered checks that the service's client is still in each room alerts are sent to.
+func (s *alertmanagerService) CheckRegistered(client *matrix.Client) ([]string, error) {
+	return types.CheckJoinedRooms(client, util.SortedKeys(s.Rooms)), nil
+}
+
+func (s *alertmanagerService) PostRegister(oldService types.Service) {}
+
+func init() {
+	types.RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) types.Service {
+		return &alertmanagerService{
+			id:                 serviceID,
+			serviceUserID:      serviceUserID,
+			webhookEndpointURL: webhookEndpointURL,
+		}
+	})
+}
@@ -0,0 +1,95 @@
+package services
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+const exampleGroup = `{
+  "version": "4",
+  "groupKey": "{}:{alertname=\"DiskFull\"}",
+  "status": "firing",
+  "receiver": "ops",
+  "groupLabels": {"alertname": "DiskFull"},
+  "alerts": [
+    {
+      "status": "firing",
+      "labels": {"alertname": "DiskFull", "severity": "critical", "team": "infra"},
+      "annotations": {"summary": "/ is 99% full"},
+      "generatorURL": "http://prometheus/graph?g0.expr=disk"
+    },
+    {
+      "status": "resolved",
+      "labels": {"alertname": "DiskFull", "severity": "warning", "team": "db"},
+      "annotations": {"description": "<b>/data</b> has space again"}
+    }
+  ]
+}`
+
+var matchertests = []struct {
+	matcher string
+	labels  map[string]string
+	want    bool
+}{
+	{`severity="critical"`, map[string]string{"severity": "critical"}, true},
+	{`severity=critical`, map[string]string{"severity": "warning"}, false},
+	{`severity!="critical"`, map[string]string{}, true},
+	{`team=~"db|infra"`, map[string]string{"team": "infra"}, true},
+	{`team=~"db|infra"`, map[string]string{"team": "infrastructure"}, false},
+	{`team!~"db.*"`, map[string]string{"team": "dba"}, false},
+}
+
+func TestMatchers(t *testing.T) {
+	for _, test := range matchertests {
+		m, err := parseMatcher(test.matcher)
+		if err != nil {
+			t.Errorf("parseMatcher(%q) => %s", test.matcher, err)
+			continue
+		}
+		if got := m.matches(test.labels); got != test.want {
+			t.Errorf("%q matches %v => want %t got %t", test.matcher, test.labels, test.want, got)
+		}
+	}
+	for _, bad := range []string{"severity", `="x"`, `team=~"("`} {
+		if _, err := parseMatcher(bad); err == nil {
+			t.Errorf("parseMatcher(%q) => want an error", bad)
+		}
+	}
+}
+
+func TestAlertsFor(t *testing.T) {
+	var p alertmanagerPayload
+	if err := json.Unmarshal([]byte(exampleGroup), &p); err != nil {
+		t.Fatal(err)
+	}
+	s := &alertmanagerService{Rooms: map[string]alertmanagerRoom{
+		"!all:x":   {},
+		"!infra:x": {Matchers: []string{`team="infra"`}},
+		"!dev:x":   {Receivers: []string{"dev"}},
+	}}
+	for roomID, want := range map[string]int{"!all:x": 2, "!infra:x": 1, "!dev:x": 0} {
+		if got := len(s.alertsFor(roomID, p)); got != want {
+			t.Errorf("alertsFor(%s) => want %d alerts got %d", roomID, want, got)
+		}
+	}
+}
+
+func TestAlertMessage(t *testing.T) {
+	var p alertmanagerPayload
+	if err := json.Unmarshal([]byte(exampleGroup), &p); err != nil {
+		t.Fatal(err)
+	}
+	msg := alertMessage(p, p.Alerts)
+	wantBody := "[FIRING:1, RESOLVED:1] ops (alertname=DiskFull)\n" +
+		"[critical] DiskFull: / is 99% full - http://prometheus/graph?g0.expr=disk\n" +
+		"[resolved] DiskFull: <b>/data</b> has space again"
+	if msg.Body != wantBody {
+		t.Errorf("alertMessage body => want %q got %q", wantBody, msg.Body)
+	}
+	wantHTML := "<b>[FIRING:1, RESOLVED:1] ops (alertname=DiskFull)</b><br>" +
+		`<font color="#d9534f">[critical]</font> <b>DiskFull</b>: / is 99% full (<a href="http://prometheus/graph?g0.expr=disk">source</a>)<br>` +
+		`<font color="#5cb85c">[resolved]</font> <b>DiskFull</b>: &lt;b&gt;/data&lt;/b&gt; has space again`
+	if msg.FormattedBody != wantHTML {
+		t.Errorf("alertMessage HTML => want %q got %q", wantHTML, msg.FormattedBody)
+	}
+}
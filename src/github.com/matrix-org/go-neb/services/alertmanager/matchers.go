@@ -0,0 +1,87 @@
+package services
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// A labelMatcher matches alerts by the value of one of their labels, as Alertmanager's own
+// routes do.
+type labelMatcher struct {
+	name  string
+	op    string // "=", "!=", "=~" or "!~"
+	value string
+	re    *regexp.Regexp // for "=~" and "!~"
+}
+
+// parseMatcher parses a matcher of the form `name="value"`, e.g. `severity="critical"` or
+// `team=~"db|infra"`. The value may be left unquoted. Regular expressions must match the whole
+// value.
+func parseMatcher(s string) (*labelMatcher, error) {
+	i := strings.IndexAny(s, "=!")
+	if i <= 0 {
+		return nil, fmt.Errorf("%q is not of the form name=\"value\"", s)
+	}
+	m := &labelMatcher{name: strings.TrimSpace(s[:i])}
+	rest := s[i:]
+	for _, op := range []string{"=~", "!~", "!=", "="} {
+		if strings.HasPrefix(rest, op) {
+			m.op = op
+			break
+		}
+	}
+	if m.op == "" || m.name == "" {
+		return nil, fmt.Errorf("%q is not of the form name=\"value\"", s)
+	}
+	m.value = strings.TrimSpace(rest[len(m.op):])
+	if len(m.value) >= 2 && strings.HasPrefix(m.value, `"`) && strings.HasSuffix(m.value, `"`) {
+		m.value = m.value[1 : len(m.value)-1]
+	}
+	if m.op == "=~" || m.op == "!~" {
+		re, err := regexp.Compile("^(?:" + m.value + ")$")
+		if err != nil {
+			return nil, err
+		}
+		m.re = re
+	}
+	return m, nil
+}
+
+// matches returns true if the labels match. A missing label has the empty value.
+func (m *labelMatcher) matches(labels map[string]string) bool {
+	v := labels[m.name]
+	switch m.op {
+	case "=":
+		return v == m.value
+	case "!=":
+		return v != m.value
+	case "=~":
+		return m.re.MatchString(v)
+	default: // "!~"
+		return !m.re.MatchString(v)
+	}
+}
+
+// parseMatchers parses each of the matchers.
+func parseMatchers(strs []string) ([]*labelMatcher, error) {
+	matchers := make([]*labelMatcher, len(strs))
+	for i, s := range strs {
+		m, err := parseMatcher(s)
+		if err != nil {
+			return nil, err
+		}
+		matchers[i] = m
+	}
+	return matchers, nil
+}
+
+// matchesAll returns true if the labels match every one of the matchers.
+func matchesAll(matchers []*labelMatcher, labels map[string]string) bool {
+	for _, m := range matchers {
+		if !m.matches(labels) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,580 @@
+package services
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/batch"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/plugin"
+	"github.com/matrix-org/go-neb/secrets"
+	"github.com/matrix-org/go-neb/server"
+	"github.com/matrix-org/go-neb/services/bitbucket/client"
+	"github.com/matrix-org/go-neb/services/bitbucket/webhook"
+	"github.com/matrix-org/go-neb/silence"
+	"github.com/matrix-org/go-neb/status"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/go-neb/util"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// bitbucketRealm is a realm which holds Bitbucket tokens.
+type bitbucketRealm interface {
+	BitbucketClient(userID string, scopes ...string) (*client.Client, error)
+}
+
+// bitbucketWebhookService sends notices about Bitbucket Cloud repositories to rooms. If it is given
+// a realm and a user, it creates a webhook on each repository in Rooms as that user, and deletes it
+// once no room wants the repository. Otherwise each repository's admins add the service's webhook
+// URL themselves.
+type bitbucketWebhookService struct {
+	id                 string
+	serviceUserID      string
+	webhookEndpointURL string
+	// ClientUserID is the user whose Bitbucket session creates the webhooks. They must be an admin
+	// of every repository. Optional, with RealmID: webhooks are added by hand.
+	ClientUserID string
+	RealmID      string
+	// Secret, if set, is what Bitbucket is told to sign webhooks with, and requests which aren't
+	// signed with it are rejected.
+	Secret secrets.Secret
+	// AllowedIPs are the IP addresses and CIDR ranges Bitbucket may send webhook requests from.
+	// Optional: requests are allowed from anywhere.
+	AllowedIPs []string
+	// BatchWindow is how long to hold back notifications about a pull request, issue or branch,
+	// e.g. "30s", so that a burst of events about it is sent as one message. Optional: events
+	// are sent as they arrive.
+	BatchWindow string
+	// DigestWindow is how long to hold back notifications for the room's digest, e.g. "5m", so
+	// that a busy repository's events are sent as one message along with other services'
+	// held back notifications. Optional: notifications aren't held back for a digest.
+	DigestWindow string
+	// AlertIfQuietFor is how long to go without a webhook from Bitbucket before alerting the
+	// operators that it is probably broken, e.g. "24h". Optional: they are never alerted.
+	AlertIfQuietFor string
+	Rooms           map[string]struct { // room_id => {}
+		Repos map[string]struct { // workspace/repo => { events: ["repo:push","pullrequest:*"] }
+			Events []string
+		}
+	}
+}
+
+func (s *bitbucketWebhookService) ServiceUserID() string { return s.serviceUserID }
+func (s *bitbucketWebhookService) ServiceID() string     { return s.id }
+func (s *bitbucketWebhookService) ServiceType() string   { return "bitbucket-webhook" }
+func (s *bitbucketWebhookService) Plugin(cli *matrix.Client, roomID string) plugin.Plugin {
+	return plugin.Plugin{}
+}
+func (s *bitbucketWebhookService) WebhookAllowedIPs() []string { return s.AllowedIPs }
+func (s *bitbucketWebhookService) QuietPeriod() time.Duration {
+	d, _ := status.ParseQuietPeriod(s.AlertIfQuietFor) // ValidateConfig checks it parses
+	return d
+}
+
+// managesHooks returns true if the service creates and deletes its webhooks itself.
+func (s *bitbucketWebhookService) managesHooks() bool {
+	return s.RealmID != "" && s.ClientUserID != ""
+}
+
+// OnReceiveWebhook sends a notice of the event to each room which wants it. If no room wants the
+// repository any more, and the service manages its webhooks, the webhook is deleted.
+func (s *bitbucketWebhookService) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli *matrix.Client) {
+	ev, httpErr := webhook.OnReceiveRequest(req, s.Secret.Value())
+	if httpErr != nil {
+		if httpErr.Code == 200 {
+			// e.g. a comment being edited, which rooms aren't told about
+			status.Filtered(s.id)
+		}
+		w.WriteHeader(httpErr.Code)
+		return
+	}
+	logger := server.RequestLogger(req).WithFields(log.Fields{
+		"event": ev.Type,
+		"repo":  ev.Repo,
+	})
+	sendErrs, repoExistsInConfig, forwarded := s.notifyRooms(cli, ev, logger)
+
+	if forwarded {
+		status.Forwarded(s.id)
+	} else {
+		status.Filtered(s.id)
+	}
+
+	if !repoExistsInConfig && s.managesHooks() {
+		if err := s.deleteHook(ev.Repo); err != nil {
+			logger.WithError(err).Print("Failed to delete webhook")
+		} else {
+			logger.Info("Deleted webhook")
+		}
+	}
+
+	if len(sendErrs) > 0 {
+		// So that the event is dead-lettered, to be replayed once the rooms are fixed.
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(200)
+}
+
+// notifyRooms sends a notice of the event to each room which wants it. Returns the errors sending
+// to each room, whether any room has the event's repository in its config, even if it doesn't
+// want the event, and whether any room was notified.
+func (s *bitbucketWebhookService) notifyRooms(cli *matrix.Client, ev *webhook.Event, logger *log.Entry) (map[string]error, bool, bool) {
+	repoExistsInConfig := false
+	forwarded := false
+	var msgs []batch.Message
+	window, _ := batch.ParseWindow(s.BatchWindow)              // ValidateConfig checks it parses
+	digestWindow, _ := batch.ParseDigestWindow(s.DigestWindow) // ValidateConfig checks it parses
+
+	for roomID, roomConfig := range s.Rooms {
+		for ownerRepo, repoConfig := range roomConfig.Repos {
+			if !strings.EqualFold(ev.Repo, ownerRepo) {
+				continue
+			}
+			repoExistsInConfig = true // even if we don't notify for it.
+			if !matchesAny(repoConfig.Events, ev.Type) {
+				continue
+			}
+			if silence.Silenced(roomID, ev.Repo) {
+				logger.WithField("room_id", roomID).Print("Not notifying room of silenced event")
+				continue
+			}
+			forwarded = true
+			logger.WithFields(log.Fields{
+				"msg":     ev.Message,
+				"room_id": roomID,
+			}).Print("Sending notification to room")
+			if digestWindow > 0 {
+				batch.Digest(cli, s.id, roomID, digestWindow, *ev.Message)
+			} else {
+				msgs = append(msgs, batch.Message{roomID, ev.Key, *ev.Message})
+			}
+		}
+	}
+	sendErrs := batch.SendAll(cli, s.id, window, msgs)
+	for roomID, e := range sendErrs {
+		logger.WithError(e).WithField("room_id", roomID).Print("Failed to send notification to room.")
+	}
+	return sendErrs, repoExistsInConfig, forwarded
+}
+
+// matchesAny returns true if any of the patterns matches the event key.
+func matchesAny(patterns []string, eventKey string) bool {
+	for _, p := range patterns {
+		if webhook.Matches(p, eventKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateConfig checks that RealmID and ClientUserID are given together, that the allowed IPs,
+// batch window and quiet period parse, and that every room ID, repo and event in Rooms is well
+// formed.
+func (s *bitbucketWebhookService) ValidateConfig() []types.ConfigError {
+	var errs []types.ConfigError
+	if s.RealmID != "" && s.ClientUserID == "" {
+		errs = append(errs, types.ConfigError{Field: "ClientUserID", Message: "is required with RealmID"})
+	}
+	if s.ClientUserID != "" && s.RealmID == "" {
+		errs = append(errs, types.ConfigError{Field: "RealmID", Message: "is required with ClientUserID"})
+	}
+	if _, err := server.ParseAllowlist(s.AllowedIPs); err != nil {
+		errs = append(errs, types.ConfigError{Field: "AllowedIPs", Message: "does not parse: " + err.Error()})
+	}
+	errs = append(errs, s.validateWindows()...)
+	return append(errs, s.validateRooms()...)
+}
+
+// validateWindows checks that the batch and digest windows and the quiet period parse.
+func (s *bitbucketWebhookService) validateWindows() []types.ConfigError {
+	var errs []types.ConfigError
+	if _, err := batch.ParseWindow(s.BatchWindow); err != nil {
+		errs = append(errs, types.ConfigError{Field: "BatchWindow", Message: "is not a valid window: " + err.Error()})
+	}
+	if _, err := batch.ParseDigestWindow(s.DigestWindow); err != nil {
+		errs = append(errs, types.ConfigError{Field: "DigestWindow", Message: "is not a valid window: " + err.Error()})
+	}
+	if _, err := status.ParseQuietPeriod(s.AlertIfQuietFor); err != nil {
+		errs = append(errs, types.ConfigError{Field: "AlertIfQuietFor", Message: "is not a valid period: " + err.Error()})
+	}
+	return errs
+}
+
+// validateRooms checks that every room ID, repo and event in Rooms is well formed.
+func (s *bitbucketWebhookService) validateRooms() []types.ConfigError {
+	var errs []types.ConfigError
+	for _, roomID := range util.SortedKeys(s.Rooms) {
+		roomField := fmt.Sprintf("Rooms[%s]", roomID)
+		if !types.IsRoomID(roomID) {
+			errs = append(errs, types.ConfigError{Field: roomField, Message: "is not a room ID"})
+		}
+		roomConfig := s.Rooms[roomID]
+		for _, ownerRepo := range util.SortedKeys(roomConfig.Repos) {
+			repoField := fmt.Sprintf("%s.Repos[%s]", roomField, ownerRepo)
+			if !isRepoName(ownerRepo) {
+				errs = append(errs, types.ConfigError{Field: repoField, Message: "must be of the form 'workspace/repo'"})
+			}
+			errs = append(errs, validateEvents(repoField, roomConfig.Repos[ownerRepo].Events)...)
+		}
+	}
+	return errs
+}
+
+// validateEvents checks that the events of the repo with the given field are known events or
+// categories.
+func validateEvents(repoField string, events []string) []types.ConfigError {
+	var errs []types.ConfigError
+	for i, ev := range events {
+		if !webhook.ValidPattern(ev) {
+			errs = append(errs, types.ConfigError{
+				Field:   fmt.Sprintf("%s.Events[%d]", repoField, i),
+				Message: fmt.Sprintf("is not repo:*, pullrequest:*, issue:* or one of %s", strings.Join(webhook.Events, ", ")),
+			})
+		}
+	}
+	return errs
+}
+
+// isRepoName returns true if the repo is the full name of a repository, e.g. "workspace/repo".
+func isRepoName(repo string) bool {
+	segs := strings.Split(repo, "/")
+	return len(segs) == 2 && segs[0] != "" && segs[1] != ""
+}
+
+// Register creates webhooks on the repos which have been added since the old service, if the
+// service manages its webhooks, and joins the rooms. As for the gitlab-webhook service, hooks on
+// removed repos are deleted by PostRegister.
+func (s *bitbucketWebhookService) Register(oldService types.Service, client *matrix.Client) error {
+	if s.managesHooks() {
+		cli, newRepos, _, err := s.checkRegister(oldService)
+		if err != nil {
+			return err
+		}
+		for _, r := range newRepos {
+			logger := log.WithField("repo", r)
+			if err := s.createHook(cli, r); err != nil {
+				logger.WithError(err).Error("Failed to create webhook")
+				return err
+			}
+			logger.Info("Created webhook")
+		}
+	} else {
+		log.WithFields(log.Fields{
+			"service_id": s.id,
+			"url":        s.webhookEndpointURL,
+		}).Info("Registered Bitbucket webhook: add the URL to the webhooks of each repository")
+	}
+	for roomID := range s.Rooms {
+		if _, err := client.JoinRoom(roomID, "", ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PlanRegister works out which hooks Register would create and PostRegister would delete, and
+// which rooms would be joined.
+func (s *bitbucketWebhookService) PlanRegister(oldService types.Service, client *matrix.Client) (*types.RegisterPlan, error) {
+	plan := &types.RegisterPlan{}
+	if s.managesHooks() {
+		_, newRepos, removedRepos, err := s.checkRegister(oldService)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range newRepos {
+			plan.CreateHooks = append(plan.CreateHooks, hookName(r))
+		}
+		for _, r := range removedRepos {
+			plan.DeleteHooks = append(plan.DeleteHooks, hookName(r))
+		}
+		if len(s.repoList()) == 0 {
+			plan.Notes = append(plan.Notes, "The service would be deleted as it would have no webhooks")
+		}
+	} else {
+		plan.Notes = append(plan.Notes, "Each repository must be given a webhook to "+s.webhookEndpointURL+" in its settings")
+	}
+	plan.JoinRooms = types.PlanJoinRooms(client, util.SortedKeys(s.Rooms))
+	return plan, nil
+}
+
+// CheckRegistered checks that the service still has a webhook on each repo, which is sent the
+// events rooms want from it, if it manages its webhooks, and that its client is still in each room.
+func (s *bitbucketWebhookService) CheckRegistered(client *matrix.Client) ([]string, error) {
+	var problems []string
+	if s.managesHooks() {
+		cli, _, _, err := s.checkRegister(nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range s.repoList() {
+			hook, findErr := findHookWithURL(cli, r, s.webhookEndpointURL)
+			if findErr != nil {
+				problems = append(problems, fmt.Sprintf("Failed to list webhooks on %s: %s", hookName(r), findErr))
+			} else if hook == nil {
+				problems = append(problems, fmt.Sprintf("No webhook on %s", hookName(r)))
+			} else if missing := missingEvents(hook, s.repoEvents(r)); len(missing) > 0 {
+				problems = append(problems, fmt.Sprintf("The webhook on %s is not sent %s events", hookName(r), strings.Join(missing, ", ")))
+			}
+		}
+	}
+	problems = append(problems, types.CheckJoinedRooms(client, util.SortedKeys(s.Rooms))...)
+	return problems, nil
+}
+
+// checkRegister returns a Bitbucket client for ClientUserID, along with the repos which have been
+// added and removed since the old service.
+func (s *bitbucketWebhookService) checkRegister(oldService types.Service) (cli *client.Client, newRepos, removedRepos []string, err error) {
+	if cli, err = s.bitbucketClient(); err != nil {
+		return
+	}
+	var oldRepos []string
+	if old, ok := oldService.(*bitbucketWebhookService); ok && old.managesHooks() {
+		oldRepos = old.repoList()
+	}
+	repos := s.repoList()
+	newRepos, removedRepos = util.Difference(repos, oldRepos)
+	if len(repos) == 0 && len(removedRepos) == 0 {
+		err = fmt.Errorf("No webhooks specified.")
+	}
+	return
+}
+
+// PostRegister deletes the webhooks on repos which were removed since the old service, if the
+// service manages its webhooks. If no repos are left, the service is deleted.
+func (s *bitbucketWebhookService) PostRegister(oldService types.Service) {
+	if !s.managesHooks() {
+		return
+	}
+	var oldRepos []string
+	if old, ok := oldService.(*bitbucketWebhookService); ok && old.managesHooks() {
+		oldRepos = old.repoList()
+	}
+	repos := s.repoList()
+	_, removedRepos := util.Difference(repos, oldRepos)
+	for _, r := range removedRepos {
+		if err := s.deleteHook(r); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"repo":       r,
+			}).Warn("Failed to remove webhook")
+		}
+	}
+	// This is safe because this is still within the critical section for this service.
+	if len(repos) == 0 {
+		logger := log.WithFields(log.Fields{
+			"service_type": s.ServiceType(),
+			"service_id":   s.ServiceID(),
+		})
+		logger.Info("Removing service as no webhooks are registered.")
+		if err := database.GetServiceDB().DeleteService(s.ServiceID(), "Go-NEB, as no webhooks are registered"); err != nil {
+			logger.WithError(err).Error("Failed to delete service")
+		}
+	}
+}
+
+// Deregister deletes the service's webhook on each repo, if the service manages its webhooks.
+func (s *bitbucketWebhookService) Deregister(client *matrix.Client) ([]string, error) {
+	if !s.managesHooks() {
+		return nil, nil
+	}
+	var removed, failed []string
+	for _, r := range s.repoList() {
+		if err := s.deleteHook(r); err != nil {
+			failed = append(failed, hookName(r)+": "+err.Error())
+			continue
+		}
+		removed = append(removed, "Deleted webhook on "+hookName(r))
+	}
+	if len(failed) > 0 {
+		return removed, fmt.Errorf("Failed to delete webhooks: %s", strings.Join(failed, "; "))
+	}
+	return removed, nil
+}
+
+// RotateWebhook points the webhook on each repo which was sent to the old endpoint URL at the
+// current one, if the service manages its webhooks. Repos which have no webhook at the old URL are
+// given a new one. Webhooks which were added by hand must be moved by hand.
+func (s *bitbucketWebhookService) RotateWebhook(oldEndpointURL string) error {
+	if !s.managesHooks() {
+		return nil
+	}
+	cli, err := s.bitbucketClient()
+	if err != nil {
+		return err
+	}
+	for _, r := range s.repoList() {
+		hook, err := findHookWithURL(cli, r, oldEndpointURL)
+		if err != nil {
+			return err
+		}
+		if hook == nil {
+			if err = s.createHook(cli, r); err != nil {
+				return err
+			}
+			log.WithField("repo", r).Info("Created webhook")
+			continue
+		}
+		if err = cli.EditHook(r, s.hookConfig(hook.UUID)); err != nil {
+			return err
+		}
+		log.WithField("repo", r).Info("Moved webhook to new endpoint URL")
+	}
+	return nil
+}
+
+// createHook creates this service's webhook on the repo, sent every event in webhook.Events. If the
+// repo already has one it is updated instead.
+func (s *bitbucketWebhookService) createHook(cli *client.Client, repo string) error {
+	hook, err := findHookWithURL(cli, repo, s.webhookEndpointURL)
+	if err != nil {
+		return err
+	}
+	if hook != nil {
+		log.WithField("repo", repo).Print("Hook already exists")
+		return cli.EditHook(repo, s.hookConfig(hook.UUID))
+	}
+	_, err = cli.AddHook(repo, s.hookConfig(""))
+	return err
+}
+
+// hookConfig returns the settings of this service's webhooks. Hooks are sent every event, since
+// they are filtered when they are received.
+func (s *bitbucketWebhookService) hookConfig(uuid string) *client.Hook {
+	return &client.Hook{
+		UUID:        uuid,
+		URL:         s.webhookEndpointURL,
+		Description: "Go-NEB",
+		Active:      true,
+		Events:      webhook.Events,
+		Secret:      s.Secret.Value(),
+	}
+}
+
+func (s *bitbucketWebhookService) deleteHook(repo string) error {
+	logger := log.WithFields(log.Fields{
+		"endpoint": s.webhookEndpointURL,
+		"repo":     repo,
+	})
+	logger.Info("Removing hook")
+	cli, err := s.bitbucketClient()
+	if err != nil {
+		return err
+	}
+	hook, err := findHookWithURL(cli, repo, s.webhookEndpointURL)
+	if err != nil {
+		return err
+	}
+	if hook == nil {
+		return fmt.Errorf("Failed to find hook with endpoint: %s", s.webhookEndpointURL)
+	}
+	return cli.DeleteHook(repo, hook.UUID)
+}
+
+// findHookWithURL returns the webhook on the repo which is sent to the endpoint URL, or nil if
+// there isn't one.
+func findHookWithURL(cli *client.Client, repo, endpointURL string) (*client.Hook, error) {
+	hooks, err := cli.ListHooks(repo)
+	if err != nil {
+		return nil, err
+	}
+	for i := range hooks {
+		if hooks[i].URL == endpointURL {
+			return &hooks[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// missingEvents returns the wanted events which the hook isn't sent.
+func missingEvents(hook *client.Hook, wanted []string) []string {
+	var missing []string
+	for _, ev := range wanted {
+		sent := false
+		for _, hookEv := range hook.Events {
+			if hookEv == ev {
+				sent = true
+				break
+			}
+		}
+		if !sent {
+			missing = append(missing, ev)
+		}
+	}
+	return missing
+}
+
+// bitbucketClient returns a Bitbucket client for ClientUserID. Their least privileged session with
+// the "webhook" scope is used, or their default session if none is known to have it.
+func (s *bitbucketWebhookService) bitbucketClient() (*client.Client, error) {
+	r, err := database.GetServiceDB().LoadAuthRealm(s.RealmID)
+	if err != nil {
+		return nil, err
+	}
+	realm, ok := r.(bitbucketRealm)
+	if !ok {
+		return nil, fmt.Errorf("Realm is of type '%s', not 'bitbucket'", r.Type())
+	}
+	cli, err := realm.BitbucketClient(s.ClientUserID, "webhook")
+	if err != nil {
+		cli, err = realm.BitbucketClient(s.ClientUserID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("User %s does not have a Bitbucket session with realm %s: %s", s.ClientUserID, s.RealmID, err)
+	}
+	return cli, nil
+}
+
+// hookName names the webhook on the repo in plans and problems, e.g. "bitbucket.org/workspace/repo".
+func hookName(repo string) string {
+	u := client.RepoURL(repo)
+	return u[strings.Index(u, "://")+3:]
+}
+
+// repoEvents returns the events any room wants from the repo, with categories expanded, sorted.
+func (s *bitbucketWebhookService) repoEvents(repo string) []string {
+	var events []string
+	for _, ev := range webhook.Events {
+		for _, roomConfig := range s.Rooms {
+			if matchesAny(roomConfig.Repos[repo].Events, ev) {
+				events = append(events, ev)
+				break
+			}
+		}
+	}
+	sort.Strings(events)
+	return events
+}
+
+// repoList returns the repos any room wants, sorted.
+func (s *bitbucketWebhookService) repoList() []string {
+	seen := make(map[string]bool)
+	var repos []string
+	for _, roomConfig := range s.Rooms {
+		for repo := range roomConfig.Repos {
+			if !isRepoName(repo) {
+				log.WithField("repo", repo).Error("Bad workspace/repo key in config")
+				continue
+			}
+			if !seen[repo] {
+				seen[repo] = true
+				repos = append(repos, repo)
+			}
+		}
+	}
+	sort.Strings(repos)
+	return repos
+}
+
+func init() {
+	types.RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) types.Service {
+		return &bitbucketWebhookService{
+			id:                 serviceID,
+			serviceUserID:      serviceUserID,
+			webhookEndpointURL: webhookEndpointURL,
+		}
+	})
+}
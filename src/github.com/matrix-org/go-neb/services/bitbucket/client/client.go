@@ -0,0 +1,227 @@
+// Package client performs requests against the Bitbucket Cloud 2.0 API.
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/matrix-org/go-neb/httpclient"
+	"github.com/matrix-org/go-neb/ops"
+	"github.com/matrix-org/go-neb/tokens"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultAPIURL is the base URL of the Bitbucket Cloud API.
+const DefaultAPIURL = "https://api.bitbucket.org/2.0"
+
+// WebURL is the base URL of Bitbucket Cloud's web pages.
+const WebURL = "https://bitbucket.org"
+
+// A Client performs Bitbucket API requests, optionally as a user.
+type Client struct {
+	apiURL     string // e.g. "https://api.bitbucket.org/2.0", with no trailing slash
+	token      string // the OAuth2 access token to authenticate with, if any
+	httpClient *http.Client
+	onStatus   func(code int) // called with the status code of each response
+}
+
+// An Error is a non-2xx response from the Bitbucket API.
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("Bitbucket API error: %d: %s", e.Code, e.Message)
+}
+
+// Repository represents a Bitbucket repository with only the keys the end-user is likely to want.
+type Repository struct {
+	FullName    string `json:"full_name"` // e.g. "workspace/repo-slug"
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	IsPrivate   bool   `json:"is_private"`
+}
+
+// New returns a Client for the Bitbucket API at apiURL. If token is empty, the client is not
+// authenticated and can only see public repositories.
+func New(apiURL, token string) *Client {
+	return &Client{
+		apiURL:     strings.TrimSuffix(apiURL, "/"),
+		token:      token,
+		httpClient: httpclient.New(30 * time.Second),
+	}
+}
+
+// NewForUser returns a Client which performs Bitbucket API requests with the token of the given
+// user's auth session. If Bitbucket rejects the token, e.g. because the user revoked the
+// consumer's access, an operational alert is raised as the user needs to authenticate again, and
+// the session is removed if Bitbucket keeps rejecting it.
+func NewForUser(apiURL, token, realmID, userID string) *Client {
+	c := New(apiURL, token)
+	if token != "" {
+		c.onStatus = func(code int) {
+			if code != 401 {
+				tokens.Accepted(realmID, userID, token)
+				return
+			}
+			ops.Alert("Bitbucket rejected the token of %s in realm %s: they need to authenticate again", userID, realmID)
+			tokens.Rejected(realmID, userID, token)
+		}
+	}
+	return c
+}
+
+// Do performs an API request, e.g. Do("GET", "/repositories?role=admin", nil, &page). The path is
+// relative to the API URL and may include a query string, or be an absolute URL such as a page's
+// "next" link. If body is not nil it is sent as JSON. If v is not nil the response body is decoded
+// into it.
+func (c *Client) Do(method, path string, body, v interface{}) error {
+	req, err := c.newRequest(method, path, body)
+	if err != nil {
+		return err
+	}
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if c.onStatus != nil {
+		c.onStatus(res.StatusCode)
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return responseError(res)
+	}
+	if v != nil {
+		return json.NewDecoder(res.Body).Decode(v)
+	}
+	return nil
+}
+
+// newRequest returns an API request with the body, if it isn't nil, as JSON.
+func (c *Client) newRequest(method, path string, body interface{}) (*http.Request, error) {
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+	u := path
+	if !strings.HasPrefix(path, "https://") && !strings.HasPrefix(path, "http://") {
+		u = c.apiURL + path
+	}
+	req, err := http.NewRequest(method, u, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return req, nil
+}
+
+// responseError returns an Error with the message in the body of an unsuccessful response.
+func responseError(res *http.Response) *Error {
+	var errBody struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	b, _ := ioutil.ReadAll(io.LimitReader(res.Body, 64*1024))
+	msg := string(b)
+	if json.Unmarshal(b, &errBody) == nil && errBody.Error.Message != "" {
+		msg = errBody.Error.Message
+	}
+	return &Error{res.StatusCode, msg}
+}
+
+// RepoURL returns the URL of the repository's page, e.g. "https://bitbucket.org/workspace/repo".
+func RepoURL(repo string) string {
+	return WebURL + "/" + repo
+}
+
+// ListRepositories returns every repository the user is an admin of, i.e. can add webhooks to.
+func (c *Client) ListRepositories() ([]Repository, error) {
+	var repos []Repository
+	next := "/repositories?" + url.Values{"role": {"admin"}, "pagelen": {"100"}}.Encode()
+	for next != "" {
+		var page struct {
+			Values []Repository `json:"values"`
+			Next   string       `json:"next"`
+		}
+		if err := c.Do("GET", next, nil, &page); err != nil {
+			return nil, err
+		}
+		repos = append(repos, page.Values...)
+		next = page.Next
+	}
+	return repos, nil
+}
+
+// A Hook is a repository webhook. Secret is only ever sent: Bitbucket doesn't return it.
+type Hook struct {
+	UUID        string   `json:"uuid,omitempty"`
+	URL         string   `json:"url"`
+	Description string   `json:"description"`
+	Active      bool     `json:"active"`
+	Events      []string `json:"events"`
+	Secret      string   `json:"secret,omitempty"`
+}
+
+// repoPath returns the API path of a repository, given its full name, e.g. "workspace/repo".
+func repoPath(repo string) string {
+	return "/repositories/" + repo
+}
+
+// hookPath returns the API path of the repository's webhook with the given UUID, which Bitbucket
+// wraps in braces.
+func hookPath(repo, uuid string) string {
+	return repoPath(repo) + "/hooks/" + url.QueryEscape(uuid)
+}
+
+// ListHooks returns the webhooks on the repository.
+func (c *Client) ListHooks(repo string) ([]Hook, error) {
+	var hooks []Hook
+	next := repoPath(repo) + "/hooks?pagelen=100"
+	for next != "" {
+		var page struct {
+			Values []Hook `json:"values"`
+			Next   string `json:"next"`
+		}
+		if err := c.Do("GET", next, nil, &page); err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, page.Values...)
+		next = page.Next
+	}
+	return hooks, nil
+}
+
+// AddHook creates a webhook on the repository, returning it with its UUID.
+func (c *Client) AddHook(repo string, hook *Hook) (*Hook, error) {
+	var created Hook
+	if err := c.Do("POST", repoPath(repo)+"/hooks", hook, &created); err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+// EditHook replaces the settings of the repository's webhook with the hook's UUID.
+func (c *Client) EditHook(repo string, hook *Hook) error {
+	return c.Do("PUT", hookPath(repo, hook.UUID), hook, nil)
+}
+
+// DeleteHook deletes the repository's webhook with the given UUID.
+func (c *Client) DeleteHook(repo, uuid string) error {
+	return c.Do("DELETE", hookPath(repo, uuid), nil, nil)
+}
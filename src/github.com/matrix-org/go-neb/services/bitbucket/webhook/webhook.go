@@ -0,0 +1,396 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/errors"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/signatures"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// An Event is a Bitbucket Cloud webhook event, parsed.
+type Event struct {
+	Type string // The event's X-Event-Key, e.g. "repo:push".
+	Repo string // The full name of the repository, e.g. "workspace/repo".
+	// Key is what the event is about, e.g. "workspace/repo#12" for a pull request,
+	// "workspace/repo/issues/3" for an issue and "workspace/repo@main" for a push, so that events
+	// about the same thing can be batched.
+	Key     string
+	Message *matrix.HTMLMessage
+}
+
+// Events are the Bitbucket event keys which can be sent to rooms, and which webhooks are created
+// with.
+var Events = []string{
+	"repo:push",
+	"pullrequest:created",
+	"pullrequest:updated",
+	"pullrequest:approved",
+	"pullrequest:unapproved",
+	"pullrequest:changes_request_created",
+	"pullrequest:fulfilled",
+	"pullrequest:rejected",
+	"pullrequest:comment_created",
+	"issue:created",
+	"issue:updated",
+	"issue:comment_created",
+}
+
+// Matches returns true if the event key is matched by the pattern, which is either an event key or
+// a category of them, e.g. "pullrequest:*".
+func Matches(pattern, eventKey string) bool {
+	if strings.HasSuffix(pattern, ":*") {
+		return strings.HasPrefix(eventKey, strings.TrimSuffix(pattern, "*"))
+	}
+	return pattern == eventKey
+}
+
+// ValidPattern returns true if the pattern matches at least one of Events.
+func ValidPattern(pattern string) bool {
+	for _, ev := range Events {
+		if Matches(pattern, ev) {
+			return true
+		}
+	}
+	return false
+}
+
+type user struct {
+	DisplayName string `json:"display_name"`
+	Nickname    string `json:"nickname"`
+}
+
+// name returns the name the user is best known by.
+func (u user) name() string {
+	if u.Nickname != "" {
+		return u.Nickname
+	}
+	return u.DisplayName
+}
+
+// links holds the link to a Bitbucket object's web page.
+type links struct {
+	HTML struct {
+		Href string `json:"href"`
+	} `json:"html"`
+}
+
+type repository struct {
+	FullName string `json:"full_name"`
+}
+
+type ref struct {
+	Type string `json:"type"` // "branch" or "tag"
+	Name string `json:"name"`
+}
+
+type pushEvent struct {
+	Actor      user       `json:"actor"`
+	Repository repository `json:"repository"`
+	Push       struct {
+		Changes []pushChange `json:"changes"`
+	} `json:"push"`
+}
+
+// pushChange is a branch or tag changed by a push.
+type pushChange struct {
+	New     *ref `json:"new"`
+	Old     *ref `json:"old"`
+	Closed  bool `json:"closed"`
+	Commits []struct {
+		Message string `json:"message"`
+		Author  struct {
+			Raw  string `json:"raw"` // e.g. "Name <email>"
+			User *user  `json:"user"`
+		} `json:"author"`
+		Links links `json:"links"`
+	} `json:"commits"`
+	Truncated bool  `json:"truncated"`
+	Links     links `json:"links"`
+}
+
+// name returns the name of the branch or tag.
+func (c *pushChange) name() string {
+	if c.New != nil {
+		return c.New.Name
+	} else if c.Old != nil {
+		return c.Old.Name
+	}
+	return ""
+}
+
+type pullRequestEvent struct {
+	Actor       user       `json:"actor"`
+	Repository  repository `json:"repository"`
+	PullRequest struct {
+		ID    int    `json:"id"`
+		Title string `json:"title"`
+		State string `json:"state"` // OPEN, MERGED, DECLINED or SUPERSEDED
+		Links links  `json:"links"`
+	} `json:"pullrequest"`
+	Comment *comment `json:"comment"`
+}
+
+type issueEvent struct {
+	Actor      user       `json:"actor"`
+	Repository repository `json:"repository"`
+	Issue      struct {
+		ID    int    `json:"id"`
+		Title string `json:"title"`
+		State string `json:"state"` // e.g. new, open, resolved or closed
+		Links links  `json:"links"`
+	} `json:"issue"`
+	Comment *comment `json:"comment"`
+}
+
+type comment struct {
+	Links links `json:"links"`
+}
+
+// OnReceiveRequest processes incoming Bitbucket webhook requests and returns the event, with a
+// matrix message to send. The secret, if supplied, must have signed the request, or an error is
+// returned.
+func OnReceiveRequest(r *http.Request, secret string) (*Event, *errors.HTTPError) {
+	content, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.WithError(err).Print("Failed to read Bitbucket webhook body")
+		return nil, &errors.HTTPError{nil, "Failed to parse body", 400}
+	}
+	if secret != "" {
+		if err = signatures.Bitbucket.Verify(r.Header, content, secret); err != nil {
+			log.WithError(err).Print("Received Bitbucket event which failed signature check.")
+			return nil, &errors.HTTPError{nil, "Bad signature", 403}
+		}
+	}
+	eventKey := r.Header.Get("X-Event-Key")
+	if eventKey == "" {
+		return nil, &errors.HTTPError{nil, "Missing X-Event-Key header", 400}
+	}
+	log.WithFields(log.Fields{
+		"event_key": eventKey,
+		"hook_uuid": r.Header.Get("X-Hook-UUID"),
+	}).Print("Received Bitbucket event")
+
+	ev, err := parseBitbucketEvent(eventKey, content)
+	if err != nil {
+		log.WithError(err).Print("Failed to parse Bitbucket event")
+		return nil, &errors.HTTPError{nil, "Failed to parse Bitbucket event", 400}
+	}
+	if ev == nil {
+		// e.g. a comment being edited, or an event which was turned on for the hook in
+		// Bitbucket's UI.
+		return nil, &errors.HTTPError{nil, "ignored", 200}
+	}
+	return ev, nil
+}
+
+// parseBitbucketEvent parses the JSON of an event with the given key. Returns nil if rooms aren't
+// told about the event.
+func parseBitbucketEvent(eventKey string, data []byte) (*Event, error) {
+	if !ValidPattern(eventKey) {
+		return nil, nil
+	}
+	var htmlStr, repo, key string
+	var err error
+	category := strings.SplitN(eventKey, ":", 2)[0]
+	action := strings.TrimPrefix(eventKey, category+":")
+	switch category {
+	case "repo":
+		repo, key, htmlStr, err = parsePushEvent(data)
+	case "pullrequest":
+		repo, key, htmlStr, err = parsePullRequestEvent(action, data)
+	case "issue":
+		repo, key, htmlStr, err = parseIssueEvent(action, data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if repo == "" {
+		return nil, fmt.Errorf("%s event has no repository", eventKey)
+	}
+	if htmlStr == "" {
+		return nil, nil
+	}
+	msg := matrix.GetHTMLMessage("m.notice", htmlStr)
+	return &Event{Type: eventKey, Repo: repo, Key: key, Message: &msg}, nil
+}
+
+// parsePushEvent parses a repo:push event, returning its repository, what it is about and its
+// HTML message.
+func parsePushEvent(data []byte) (repo, key, htmlStr string, err error) {
+	var ev pushEvent
+	if err = json.Unmarshal(data, &ev); err != nil {
+		return
+	}
+	key, htmlStr = pushKeyAndHTML(ev)
+	return ev.Repository.FullName, key, htmlStr, nil
+}
+
+// parsePullRequestEvent parses a pullrequest:* event with the given action, returning its
+// repository, what it is about and its HTML message.
+func parsePullRequestEvent(action string, data []byte) (repo, key, htmlStr string, err error) {
+	var ev pullRequestEvent
+	if err = json.Unmarshal(data, &ev); err != nil {
+		return
+	}
+	repo = ev.Repository.FullName
+	pr := ev.PullRequest
+	htmlStr = issuableHTMLMessage(repo, ev.Actor, pullRequestActions[action], fmt.Sprintf("pull request #%d", pr.ID),
+		pr.Title, strings.ToLower(pr.State), commentOrURL(ev.Comment, pr.Links.HTML.Href))
+	return repo, fmt.Sprintf("%s#%d", repo, pr.ID), htmlStr, nil
+}
+
+// parseIssueEvent parses an issue:* event with the given action, returning its repository, what
+// it is about and its HTML message.
+func parseIssueEvent(action string, data []byte) (repo, key, htmlStr string, err error) {
+	var ev issueEvent
+	if err = json.Unmarshal(data, &ev); err != nil {
+		return
+	}
+	repo = ev.Repository.FullName
+	issue := ev.Issue
+	htmlStr = issuableHTMLMessage(repo, ev.Actor, issueActions[action], fmt.Sprintf("issue #%d", issue.ID),
+		issue.Title, issue.State, commentOrURL(ev.Comment, issue.Links.HTML.Href))
+	return repo, fmt.Sprintf("%s/issues/%d", repo, issue.ID), htmlStr, nil
+}
+
+// commentOrURL returns the URL of the comment the event is about, if there is one, or url.
+func commentOrURL(c *comment, url string) string {
+	if c != nil && c.Links.HTML.Href != "" {
+		return c.Links.HTML.Href
+	}
+	return url
+}
+
+// pushKeyAndHTML describes each branch or tag the push changed, on a line of its own.
+func pushKeyAndHTML(p pushEvent) (key, htmlStr string) {
+	repo := p.Repository.FullName
+	key = repo
+	if len(p.Push.Changes) == 1 {
+		key = repo + "@" + p.Push.Changes[0].name()
+	}
+	var lines []string
+	for i := range p.Push.Changes {
+		lines = append(lines, changeHTML(repo, p.Actor.name(), &p.Push.Changes[i]))
+	}
+	return key, strings.Join(lines, "<br>")
+}
+
+// changeHTML describes the change to a branch or tag of the repo pushed by the actor.
+func changeHTML(repo, actor string, c *pushChange) string {
+	name := c.name()
+	if c.Closed || c.New == nil {
+		return fmt.Sprintf(
+			`[<u>%s</u>] %s <font color="red"><b>deleted</font> %s</b>`,
+			html.EscapeString(repo),
+			html.EscapeString(actor),
+			html.EscapeString(name),
+		)
+	}
+	if len(c.Commits) == 0 {
+		// e.g. a new branch or tag pointing at an existing commit
+		return fmt.Sprintf(
+			"[<u>%s</u>] %s pushed to <b>%s</b>",
+			html.EscapeString(repo),
+			html.EscapeString(actor),
+			html.EscapeString(name),
+		)
+	}
+	// Commits are newest first.
+	head := c.Commits[0]
+	if len(c.Commits) == 1 && !c.Truncated {
+		return fmt.Sprintf(
+			`[<u>%s</u>] %s pushed to <b>%s</b>: %s - %s`,
+			html.EscapeString(repo),
+			html.EscapeString(actor),
+			html.EscapeString(name),
+			html.EscapeString(firstLine(head.Message)),
+			html.EscapeString(head.Links.HTML.Href),
+		)
+	}
+	var cList []string
+	for i := len(c.Commits) - 1; i >= 0; i-- {
+		commit := c.Commits[i]
+		cList = append(cList, fmt.Sprintf(
+			`%s: %s`,
+			html.EscapeString(authorName(commit.Author.Raw, commit.Author.User)),
+			html.EscapeString(firstLine(commit.Message)),
+		))
+	}
+	// Bitbucket sends at most 5 commits, without the real count.
+	count := fmt.Sprintf("%d", len(c.Commits))
+	if c.Truncated {
+		count += "+"
+	}
+	link := c.Links.HTML.Href
+	if link == "" {
+		link = head.Links.HTML.Href
+	}
+	return fmt.Sprintf(
+		`[<u>%s</u>] %s pushed %s commits to <b>%s</b>: %s<br>%s`,
+		html.EscapeString(repo),
+		html.EscapeString(actor),
+		count,
+		html.EscapeString(name),
+		html.EscapeString(link),
+		strings.Join(cList, "<br>"),
+	)
+}
+
+// authorName returns the name of a commit's author: their Bitbucket user's if the commit's email
+// is linked to one, or the name in its raw "Name <email>" form.
+func authorName(raw string, u *user) string {
+	if u != nil && u.name() != "" {
+		return u.name()
+	}
+	if i := strings.Index(raw, " <"); i >= 0 {
+		return raw[:i]
+	}
+	return raw
+}
+
+// pullRequestActions are how the pullrequest:* events are described. Events which aren't listed
+// aren't sent to rooms.
+var pullRequestActions = map[string]string{
+	"created":                 "opened",
+	"updated":                 "updated",
+	"approved":                "approved",
+	"unapproved":              "unapproved",
+	"changes_request_created": "requested changes to",
+	"fulfilled":               "merged",
+	"rejected":                "declined",
+	"comment_created":         "commented on",
+}
+
+// issueActions are how the issue:* events are described. Events which aren't listed aren't sent
+// to rooms.
+var issueActions = map[string]string{
+	"created":         "opened",
+	"updated":         "updated",
+	"comment_created": "commented on",
+}
+
+func issuableHTMLMessage(repo string, actor user, action, what, title, state, url string) string {
+	if action == "" {
+		return ""
+	}
+	return fmt.Sprintf(
+		"[<u>%s</u>] %s %s <b>%s</b>: %s [%s] - %s",
+		html.EscapeString(repo),
+		html.EscapeString(actor.name()),
+		html.EscapeString(action),
+		what,
+		html.EscapeString(title),
+		html.EscapeString(state),
+		html.EscapeString(url),
+	)
+}
+
+func firstLine(s string) string {
+	return strings.TrimSpace(strings.SplitN(s, "\n", 2)[0])
+}
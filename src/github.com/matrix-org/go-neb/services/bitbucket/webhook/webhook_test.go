@@ -0,0 +1,158 @@
+package webhook
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+var bbtests = []struct {
+	eventKey string
+	jsonBody string
+	outHTML  string
+	outRepo  string
+	outKey   string
+}{
+	{"repo:push",
+		`{
+		  "actor": {"display_name": "Alice Example", "nickname": "alice"},
+		  "repository": {"full_name": "team/widget"},
+		  "push": {"changes": [{
+		    "new": {"type": "branch", "name": "main"},
+		    "old": {"type": "branch", "name": "main"},
+		    "closed": false,
+		    "truncated": true,
+		    "links": {"html": {"href": "https://bitbucket.org/team/widget/branches/compare/b2..a1"}},
+		    "commits": [
+		      {"message": "Fix the frobnicator\n\nIt was broken", "author": {"raw": "Alice Example <alice@example.com>", "user": {"display_name": "Alice Example", "nickname": "alice"}}, "links": {"html": {"href": "https://bitbucket.org/team/widget/commits/b2"}}},
+		      {"message": "Add a frobnicator", "author": {"raw": "Bob <bob@example.com>"}, "links": {"html": {"href": "https://bitbucket.org/team/widget/commits/a1"}}}
+		    ]
+		  }]}
+		}`,
+		`[<u>team/widget</u>] alice pushed 2+ commits to <b>main</b>: https://bitbucket.org/team/widget/branches/compare/b2..a1<br>Bob: Add a frobnicator<br>alice: Fix the frobnicator`,
+		"team/widget",
+		"team/widget@main",
+	},
+	{"repo:push",
+		`{
+		  "actor": {"display_name": "Alice Example"},
+		  "repository": {"full_name": "team/widget"},
+		  "push": {"changes": [
+		    {"new": null, "old": {"type": "branch", "name": "old-feature"}, "closed": true, "commits": []},
+		    {"new": {"type": "tag", "name": "v1.0"}, "old": null, "commits": []}
+		  ]}
+		}`,
+		`[<u>team/widget</u>] Alice Example <font color="red"><b>deleted</font> old-feature</b><br>[<u>team/widget</u>] Alice Example pushed to <b>v1.0</b>`,
+		"team/widget",
+		"team/widget",
+	},
+	{"pullrequest:fulfilled",
+		`{
+		  "actor": {"nickname": "carol"},
+		  "repository": {"full_name": "team/widget"},
+		  "pullrequest": {"id": 12, "title": "Faster <frobs>", "state": "MERGED", "links": {"html": {"href": "https://bitbucket.org/team/widget/pull-requests/12"}}}
+		}`,
+		`[<u>team/widget</u>] carol merged <b>pull request #12</b>: Faster &lt;frobs&gt; [merged] - https://bitbucket.org/team/widget/pull-requests/12`,
+		"team/widget",
+		"team/widget#12",
+	},
+	{"pullrequest:comment_created",
+		`{
+		  "actor": {"nickname": "dave"},
+		  "repository": {"full_name": "team/widget"},
+		  "pullrequest": {"id": 12, "title": "Faster frobs", "state": "OPEN", "links": {"html": {"href": "https://bitbucket.org/team/widget/pull-requests/12"}}},
+		  "comment": {"links": {"html": {"href": "https://bitbucket.org/team/widget/pull-requests/12/_/diff#comment-99"}}}
+		}`,
+		`[<u>team/widget</u>] dave commented on <b>pull request #12</b>: Faster frobs [open] - https://bitbucket.org/team/widget/pull-requests/12/_/diff#comment-99`,
+		"team/widget",
+		"team/widget#12",
+	},
+	{"issue:created",
+		`{
+		  "actor": {"nickname": "erin"},
+		  "repository": {"full_name": "team/widget"},
+		  "issue": {"id": 3, "title": "Frobs are slow", "state": "new", "links": {"html": {"href": "https://bitbucket.org/team/widget/issues/3"}}}
+		}`,
+		`[<u>team/widget</u>] erin opened <b>issue #3</b>: Frobs are slow [new] - https://bitbucket.org/team/widget/issues/3`,
+		"team/widget",
+		"team/widget/issues/3",
+	},
+}
+
+func TestParseBitbucketEvent(t *testing.T) {
+	for _, bb := range bbtests {
+		ev, err := parseBitbucketEvent(bb.eventKey, []byte(bb.jsonBody))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ev == nil {
+			t.Fatalf("parseBitbucketEvent(%s) => Event is nil", bb.eventKey)
+		}
+		if ev.Message.FormattedBody != bb.outHTML {
+			t.Fatalf("parseBitbucketEvent(%s) => HTML output does not match. Got:\n%s\n\nExpected:\n%s", bb.eventKey,
+				ev.Message.FormattedBody, bb.outHTML)
+		}
+		if ev.Repo != bb.outRepo {
+			t.Fatalf("parseBitbucketEvent(%s) => Repo: Want %s got %s", bb.eventKey, bb.outRepo, ev.Repo)
+		}
+		if ev.Key != bb.outKey {
+			t.Fatalf("parseBitbucketEvent(%s) => Key: Want %s got %s", bb.eventKey, bb.outKey, ev.Key)
+		}
+	}
+}
+
+func TestParseBitbucketEventIgnored(t *testing.T) {
+	body := `{"repository":{"full_name":"a/b"}}`
+	for _, key := range []string{"pullrequest:comment_deleted", "repo:fork", "issue:comment_updated"} {
+		if ev, err := parseBitbucketEvent(key, []byte(body)); ev != nil || err != nil {
+			t.Errorf("parseBitbucketEvent(%s) => Want nil, nil got %v, %v", key, ev, err)
+		}
+	}
+}
+
+func TestMatches(t *testing.T) {
+	for _, tc := range []struct {
+		pattern  string
+		eventKey string
+		want     bool
+	}{
+		{"repo:push", "repo:push", true},
+		{"pullrequest:*", "pullrequest:fulfilled", true},
+		{"pullrequest:*", "repo:push", false},
+		{"issue:*", "issue:comment_created", true},
+		{"pull*", "pullrequest:created", false},
+	} {
+		if got := Matches(tc.pattern, tc.eventKey); got != tc.want {
+			t.Errorf("Matches(%s, %s) => Want %v got %v", tc.pattern, tc.eventKey, tc.want, got)
+		}
+	}
+	if ValidPattern("repo:*") != true || ValidPattern("wiki:*") != false || ValidPattern("repo:fork") != false {
+		t.Error("ValidPattern => Want repo:* to be valid and wiki:* and repo:fork not to be")
+	}
+}
+
+func TestOnReceiveRequestSignature(t *testing.T) {
+	body := `{"repository":{"full_name":"a/b"},"issue":{"id":1}}`
+	// The HMAC-SHA256 of the body with the secret "secret"
+	sig := "sha256=5d2c6fe886d5db67e4f5b004c4aad4a92061512bfb03ad75b13b6301abd23395"
+	for _, tc := range []struct {
+		sig      string
+		wantCode int
+	}{
+		{sig, 0},
+		{"sha256=" + strings.Repeat("0", 64), 403},
+		{"", 403},
+	} {
+		req, _ := http.NewRequest("POST", "/", strings.NewReader(body))
+		req.Header.Set("X-Event-Key", "issue:created")
+		if tc.sig != "" {
+			req.Header.Set("X-Hub-Signature", tc.sig)
+		}
+		_, httpErr := OnReceiveRequest(req, "secret")
+		if tc.wantCode == 0 && httpErr != nil {
+			t.Errorf("OnReceiveRequest with signature %q => %d %s", tc.sig, httpErr.Code, httpErr.Message)
+		} else if tc.wantCode != 0 && (httpErr == nil || httpErr.Code != tc.wantCode) {
+			t.Errorf("OnReceiveRequest with signature %q => Want HTTP %d got %v", tc.sig, tc.wantCode, httpErr)
+		}
+	}
+}
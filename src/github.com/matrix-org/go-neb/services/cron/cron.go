@@ -0,0 +1,234 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/plugin"
+	"github.com/matrix-org/go-neb/scheduler"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/go-neb/util"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// maxLateness is how late an announcement may be posted, e.g. because Go-NEB was down when it was
+// due. Later ones are skipped, as a standup reminder in the afternoon does more harm than good.
+const maxLateness = 10 * time.Minute
+
+// An announcement is a message posted into a room on a schedule.
+type announcement struct {
+	// Schedule is a cron expression saying when to post the message, e.g. "30 9 * * mon-fri".
+	Schedule string
+	// Template is a Go text/template which renders the message. It is given the time the
+	// announcement is due, as .Time, and the room's ID, as .RoomID. If it renders nothing but
+	// whitespace, nothing is posted.
+	Template string
+}
+
+// templateData is what announcement templates are rendered with.
+type templateData struct {
+	Time   time.Time
+	RoomID string
+}
+
+// A cronJob is the data of a scheduled job which posts an announcement. The schedule and template
+// are kept so that jobs for announcements which have since been changed are recognised.
+type cronJob struct {
+	RoomID   string
+	Index    int // of the announcement in the room's Announcements
+	Schedule string
+	Template string
+	TimeMs   int64 // when the announcement is due, in milliseconds since the Unix epoch
+}
+
+type cronService struct {
+	id            string
+	serviceUserID string
+	// TimeZone is the IANA name of the time zone schedules are in, e.g. "Europe/London".
+	// Optional: UTC if not given.
+	TimeZone string
+	// Rooms maps room IDs to the announcements posted into them.
+	Rooms map[string]struct {
+		Announcements []announcement
+	}
+}
+
+func (s *cronService) ServiceUserID() string { return s.serviceUserID }
+func (s *cronService) ServiceID() string     { return s.id }
+func (s *cronService) ServiceType() string   { return "cron" }
+func (s *cronService) Plugin(cli *matrix.Client, roomID string) plugin.Plugin {
+	return plugin.Plugin{}
+}
+func (s *cronService) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli *matrix.Client) {
+	w.WriteHeader(200) // Do nothing
+}
+
+// ValidateConfig checks that the time zone is known, and that each announcement's schedule and
+// template parse.
+func (s *cronService) ValidateConfig() []types.ConfigError {
+	var errs []types.ConfigError
+	if _, err := time.LoadLocation(s.TimeZone); err != nil {
+		errs = append(errs, types.ConfigError{Field: "TimeZone", Message: "is not a known time zone: " + err.Error()})
+	}
+	if len(s.Rooms) == 0 {
+		errs = append(errs, types.ConfigError{Field: "Rooms", Message: "must have at least one room"})
+	}
+	for _, roomID := range util.SortedKeys(s.Rooms) {
+		field := fmt.Sprintf("Rooms[%s]", roomID)
+		if !types.IsRoomID(roomID) {
+			errs = append(errs, types.ConfigError{Field: field, Message: "is not a room ID"})
+		}
+		for i, a := range s.Rooms[roomID].Announcements {
+			aField := fmt.Sprintf("%s.Announcements[%d]", field, i)
+			if _, err := scheduler.ParseCron(a.Schedule); err != nil {
+				errs = append(errs, types.ConfigError{Field: aField + ".Schedule", Message: "does not parse: " + err.Error()})
+			}
+			if a.Template == "" {
+				errs = append(errs, types.ConfigError{Field: aField + ".Template", Message: "is required"})
+			} else if _, err := template.New("").Parse(a.Template); err != nil {
+				errs = append(errs, types.ConfigError{Field: aField + ".Template", Message: "does not parse: " + err.Error()})
+			}
+		}
+	}
+	return errs
+}
+
+// Register joins the rooms announcements are posted into.
+func (s *cronService) Register(oldService types.Service, client *matrix.Client) error {
+	for _, roomID := range util.SortedKeys(s.Rooms) {
+		if _, err := client.JoinRoom(roomID, "", ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PlanRegister works out which of the rooms announcements are posted into Register would join.
+func (s *cronService) PlanRegister(oldService types.Service, client *matrix.Client) (*types.RegisterPlan, error) {
+	plan := &types.RegisterPlan{JoinRooms: types.PlanJoinRooms(client, util.SortedKeys(s.Rooms))}
+	return plan, nil
+}
+
+// CheckRegistered checks that the service's client is still in each room announcements are posted
+// into.
+func (s *cronService) CheckRegistered(client *matrix.Client) ([]string, error) {
+	return types.CheckJoinedRooms(client, util.SortedKeys(s.Rooms)), nil
+}
+
+// PostRegister replaces the jobs scheduled for the old config with ones for each announcement's
+// next post.
+func (s *cronService) PostRegister(oldService types.Service) {
+	if err := scheduler.CancelService(s.id); err != nil {
+		log.WithError(err).WithField("service_id", s.id).Error("Failed to cancel old announcements")
+	}
+	now := time.Now()
+	for _, roomID := range util.SortedKeys(s.Rooms) {
+		for i, a := range s.Rooms[roomID].Announcements {
+			if err := s.scheduleNext(roomID, i, a, now); err != nil {
+				log.WithError(err).WithFields(log.Fields{
+					"service_id": s.id,
+					"room_id":    roomID,
+					"schedule":   a.Schedule,
+				}).Error("Failed to schedule announcement")
+			}
+		}
+	}
+}
+
+func (s *cronService) location() *time.Location {
+	loc, err := time.LoadLocation(s.TimeZone)
+	if err != nil {
+		return time.UTC // ValidateConfig stops this happening
+	}
+	return loc
+}
+
+// scheduleNext schedules the first post of the announcement after the given time. The job's ID
+// says which post it is, so that scheduling it again replaces it rather than posting twice.
+func (s *cronService) scheduleNext(roomID string, index int, a announcement, after time.Time) error {
+	c, err := scheduler.ParseCron(a.Schedule)
+	if err != nil {
+		return err
+	}
+	next := c.Next(after.In(s.location()))
+	if next.IsZero() {
+		return fmt.Errorf("schedule %q never matches", a.Schedule)
+	}
+	nextMs := next.UnixNano() / int64(time.Millisecond)
+	jobID := fmt.Sprintf("%s/%s/%d/%d", s.id, roomID, index, nextMs)
+	_, err = scheduler.ScheduleWithID(jobID, s.id, next, cronJob{
+		RoomID:   roomID,
+		Index:    index,
+		Schedule: a.Schedule,
+		Template: a.Template,
+		TimeMs:   nextMs,
+	})
+	return err
+}
+
+// RunJob schedules the announcement's next post, then posts it, unless the announcement has been
+// changed or the post is too late.
+func (s *cronService) RunJob(cli *matrix.Client, job types.ScheduledJob) error {
+	var j cronJob
+	if err := json.Unmarshal(job.Data, &j); err != nil {
+		return err
+	}
+	logger := log.WithFields(log.Fields{
+		"service_id": s.id,
+		"room_id":    j.RoomID,
+		"schedule":   j.Schedule,
+	})
+	announcements := s.Rooms[j.RoomID].Announcements
+	if j.Index >= len(announcements) || announcements[j.Index] != (announcement{j.Schedule, j.Template}) {
+		logger.Info("Dropping post of an announcement which has been changed")
+		return nil
+	}
+	now := time.Now()
+	if err := s.scheduleNext(j.RoomID, j.Index, announcements[j.Index], now); err != nil {
+		return err
+	}
+	due := time.Unix(0, j.TimeMs*int64(time.Millisecond)).In(s.location())
+	if now.Sub(due) > maxLateness {
+		logger.WithField("due", due).Warn("Skipping announcement which is too late to post")
+		return nil
+	}
+	text, err := render(j.Template, templateData{Time: due, RoomID: j.RoomID})
+	if err != nil {
+		return err
+	}
+	if text == "" {
+		return nil
+	}
+	_, err = cli.SendMessageEvent(j.RoomID, "m.room.message", &matrix.TextMessage{"m.notice", text})
+	return err
+}
+
+// render renders the template, returning "" if it renders nothing but whitespace.
+func render(text string, data templateData) (string, error) {
+	tmpl, err := template.New("").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err = tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(buf.String()) == "" {
+		return "", nil
+	}
+	return buf.String(), nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) types.Service {
+		return &cronService{
+			id:            serviceID,
+			serviceUserID: serviceUserID,
+		}
+	})
+}
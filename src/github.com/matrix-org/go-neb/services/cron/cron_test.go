@@ -0,0 +1,60 @@
+package services
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateConfig(t *testing.T) {
+	var s cronService
+	err := json.Unmarshal([]byte(`{
+		"TimeZone": "Nowhere/Special",
+		"Rooms": {
+			"!standup:localhost": {"Announcements": [
+				{"Schedule": "30 9 * * mon-fri", "Template": "Standup time!"},
+				{"Schedule": "30 25 * * *", "Template": "{{.Time"},
+				{"Schedule": "@daily"}
+			]},
+			"general": {"Announcements": []}
+		}
+	}`), &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields []string
+	for _, e := range s.ValidateConfig() {
+		fields = append(fields, e.Field)
+	}
+	want := []string{
+		"TimeZone",
+		"Rooms[!standup:localhost].Announcements[1].Schedule",
+		"Rooms[!standup:localhost].Announcements[1].Template",
+		"Rooms[!standup:localhost].Announcements[2].Template",
+		"Rooms[general]",
+	}
+	if strings.Join(fields, " ") != strings.Join(want, " ") {
+		t.Errorf("ValidateConfig => Want errors for %v got %v", want, fields)
+	}
+}
+
+func TestRender(t *testing.T) {
+	due := time.Date(2026, 10, 16, 9, 30, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		template string
+		want     string
+	}{
+		{"Standup in 5 minutes", "Standup in 5 minutes"},
+		{`Maintenance window opens at {{.Time.Format "15:04"}} ({{.Time.Weekday}})`, "Maintenance window opens at 09:30 (Friday)"},
+		{`{{if eq .Time.Day 1}}Pay day!{{end}}`, ""},
+	} {
+		got, err := render(tc.template, templateData{Time: due, RoomID: "!r:localhost"})
+		if err != nil {
+			t.Fatalf("render(%q) => %s", tc.template, err)
+		}
+		if got != tc.want {
+			t.Errorf("render(%q) => Want %q got %q", tc.template, tc.want, got)
+		}
+	}
+}
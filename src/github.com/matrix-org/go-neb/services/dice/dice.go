@@ -0,0 +1,270 @@
+package services
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/plugin"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/go-neb/util"
+	"math/big"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxDice     = 100
+	maxSides    = 1000
+	maxConstant = 1000000
+)
+
+// termRegex matches a term of a roll with its sign, e.g. "+3d6", "-d4" or "+2".
+var termRegex = regexp.MustCompile(`([+-])(?:(\d*)[dD](\d+)|(\d+))`)
+
+// rollDie returns a random number from 1 to sides. It is a variable so that tests can load the dice.
+var rollDie = func(sides int) int {
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(sides)))
+	if err != nil {
+		// crypto/rand never fails on supported platforms.
+		panic(err)
+	}
+	return int(n.Int64()) + 1
+}
+
+// A term of a roll is a number of dice with the same number of sides, or a constant.
+type term struct {
+	negative bool
+	dice     int // 0 for a constant
+	sides    int
+	constant int
+}
+
+// A roll is a sum of terms, e.g. "3d6+2".
+type roll []term
+
+// A result is the outcome of making a roll once.
+type result struct {
+	total int
+	// parts are each term's dice, e.g. "[4, 1, 6]", or constant, with its sign.
+	parts []string
+}
+
+// modes of rolling: how many times the roll is made, and which total is kept.
+const (
+	normal = iota
+	advantage
+	disadvantage
+)
+
+var modeKeywords = map[string]int{
+	"adv":          advantage,
+	"advantage":    advantage,
+	"dis":          disadvantage,
+	"disadvantage": disadvantage,
+}
+
+type diceService struct {
+	id            string
+	serviceUserID string
+	// Output is "compact", which shows just the total of a roll, or "verbose", which shows each
+	// die as well. Optional: "verbose" if not given.
+	Output string
+	// RoomOutput is the output to use in some rooms, instead of Output, e.g. {"!foo:bar": "compact"}.
+	RoomOutput map[string]string
+	// CommandPrefixes are what commands start with in each room, e.g. {"!foo:bar": "?"}, so that
+	// several bots in a room can be told apart. Optional: in other rooms commands start with "!".
+	CommandPrefixes map[string]string
+}
+
+func (s *diceService) ServiceUserID() string { return s.serviceUserID }
+func (s *diceService) ServiceID() string     { return s.id }
+func (s *diceService) ServiceType() string   { return "dice" }
+func (s *diceService) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli *matrix.Client) {
+	w.WriteHeader(200) // Do nothing
+}
+func (s *diceService) ValidateConfig() []types.ConfigError {
+	errs := types.ValidateCommandPrefixes(s.CommandPrefixes)
+	if s.Output != "" && s.Output != "compact" && s.Output != "verbose" {
+		errs = append(errs, types.ConfigError{Field: "Output", Message: `must be "compact" or "verbose"`})
+	}
+	for _, roomID := range util.SortedKeys(s.RoomOutput) {
+		field := fmt.Sprintf("RoomOutput[%s]", roomID)
+		if !types.IsRoomID(roomID) {
+			errs = append(errs, types.ConfigError{Field: field, Message: "is not a room ID"})
+		}
+		if output := s.RoomOutput[roomID]; output != "compact" && output != "verbose" {
+			errs = append(errs, types.ConfigError{Field: field, Message: `must be "compact" or "verbose"`})
+		}
+	}
+	return errs
+}
+func (s *diceService) Register(oldService types.Service, client *matrix.Client) error { return nil }
+func (s *diceService) PostRegister(oldService types.Service)                          {}
+
+func (s *diceService) Plugin(client *matrix.Client, roomID string) plugin.Plugin {
+	return plugin.Plugin{
+		Prefix: s.CommandPrefixes[roomID],
+		Commands: []plugin.Command{
+			plugin.Command{
+				Path:      []string{"roll"},
+				Arguments: []string{"dice", "[adv|dis]"},
+				Help:      "Roll dice, e.g. 3d6+2, or d20+5 adv to roll twice and keep the higher total",
+				Command: func(roomID, userID string, args []string) (interface{}, error) {
+					return s.cmdRoll(roomID, userID, args)
+				},
+			},
+		},
+	}
+}
+
+// verbose returns true if rolls in the room show each die.
+func (s *diceService) verbose(roomID string) bool {
+	if output := s.RoomOutput[roomID]; output != "" {
+		return output == "verbose"
+	}
+	return s.Output != "compact"
+}
+
+func (s *diceService) cmdRoll(roomID, userID string, args []string) (interface{}, error) {
+	mode := normal
+	if len(args) > 0 {
+		if m, ok := modeKeywords[strings.ToLower(args[len(args)-1])]; ok {
+			mode = m
+			args = args[:len(args)-1]
+		}
+	}
+	if len(args) == 0 {
+		return nil, errors.New("Usage: !roll <dice> [adv|dis], e.g. !roll 3d6+2 or !roll d20+5 adv")
+	}
+	// Spaces are allowed between terms, e.g. "3d6 + 2".
+	spec := strings.Join(args, "")
+	r, err := parseRoll(spec)
+	if err != nil {
+		return nil, err
+	}
+	return &matrix.TextMessage{"m.notice", fmt.Sprintf("%s rolled %s", userID, describe(spec, r, mode, s.verbose(roomID)))}, nil
+}
+
+// parseRoll parses a sum of dice and constants, e.g. "3d6+2", "d20-1" or "2d8+1d6".
+func parseRoll(spec string) (roll, error) {
+	s := spec
+	if !strings.HasPrefix(s, "+") && !strings.HasPrefix(s, "-") {
+		s = "+" + s
+	}
+	var r roll
+	dice := 0
+	for len(s) > 0 {
+		m := termRegex.FindStringSubmatchIndex(s)
+		if m == nil || m[0] != 0 {
+			return nil, fmt.Errorf("Can't read the dice %q: give them like 3d6+2", spec)
+		}
+		t, err := parseTerm(termRegex.FindStringSubmatch(s))
+		if err != nil {
+			return nil, err
+		}
+		if dice += t.dice; dice > maxDice {
+			return nil, fmt.Errorf("Can't roll more than %d dice at once", maxDice)
+		}
+		r = append(r, t)
+		s = s[m[1]:]
+	}
+	return r, nil
+}
+
+// parseTerm parses the submatches of termRegex for a term, e.g. "+3d6" or "-2".
+func parseTerm(groups []string) (term, error) {
+	t := term{negative: groups[1] == "-"}
+	if groups[4] != "" {
+		t.constant, _ = strconv.Atoi(groups[4])
+		if len(groups[4]) > 7 || t.constant > maxConstant {
+			return t, fmt.Errorf("Constants can be at most %d", maxConstant)
+		}
+		return t, nil
+	}
+	t.dice = 1
+	if groups[2] != "" {
+		t.dice, _ = strconv.Atoi(groups[2])
+	}
+	t.sides, _ = strconv.Atoi(groups[3])
+	if len(groups[3]) > 4 || t.sides < 2 || t.sides > maxSides {
+		return t, fmt.Errorf("Dice can have from 2 to %d sides", maxSides)
+	}
+	if len(groups[2]) > 3 || t.dice < 1 {
+		return t, fmt.Errorf("Can't roll %q: roll at least one die", groups[0][1:])
+	}
+	return t, nil
+}
+
+// roll makes the roll once.
+func (r roll) roll() result {
+	var res result
+	for i, t := range r {
+		value := 0
+		var part string
+		if t.dice == 0 {
+			value = t.constant
+			part = strconv.Itoa(t.constant)
+		} else {
+			rolls := make([]string, t.dice)
+			for j := range rolls {
+				n := rollDie(t.sides)
+				value += n
+				rolls[j] = strconv.Itoa(n)
+			}
+			part = "[" + strings.Join(rolls, ", ") + "]"
+		}
+		switch {
+		case t.negative && i == 0:
+			part = "-" + part
+		case t.negative:
+			part = "- " + part
+		case i > 0:
+			part = "+ " + part
+		}
+		if t.negative {
+			value = -value
+		}
+		res.total += value
+		res.parts = append(res.parts, part)
+	}
+	return res
+}
+
+// describe makes the roll, twice if the mode is advantage or disadvantage, and describes the
+// outcome. If verbose, each die is shown as well as the total.
+func describe(spec string, r roll, mode int, verbose bool) string {
+	first := r.roll()
+	if mode == normal {
+		if verbose && (len(r) > 1 || r[0].dice > 1) {
+			return fmt.Sprintf("%s: %s = %d", spec, strings.Join(first.parts, " "), first.total)
+		}
+		return fmt.Sprintf("%s: %d", spec, first.total)
+	}
+	second := r.roll()
+	kept, how := first.total, "advantage"
+	if mode == advantage && second.total > kept || mode == disadvantage && second.total < kept {
+		kept = second.total
+	}
+	if mode == disadvantage {
+		how = "disadvantage"
+	}
+	if verbose {
+		return fmt.Sprintf(
+			"%s with %s: %s = %d, %s = %d, keeping %d", spec, how,
+			strings.Join(first.parts, " "), first.total, strings.Join(second.parts, " "), second.total, kept,
+		)
+	}
+	return fmt.Sprintf("%s with %s: %d", spec, how, kept)
+}
+
+func init() {
+	types.RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) types.Service {
+		return &diceService{
+			id:            serviceID,
+			serviceUserID: serviceUserID,
+		}
+	})
+}
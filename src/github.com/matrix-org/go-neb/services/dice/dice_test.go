@@ -0,0 +1,97 @@
+package services
+
+import (
+	"github.com/matrix-org/go-neb/matrix"
+	"testing"
+)
+
+// loadDice makes the dice roll the given numbers, in turn, until the returned function is called.
+func loadDice(numbers ...int) func() {
+	i := 0
+	old := rollDie
+	rollDie = func(sides int) int {
+		n := numbers[i%len(numbers)]
+		i++
+		return n
+	}
+	return func() { rollDie = old }
+}
+
+func TestParseRoll(t *testing.T) {
+	valid := map[string]roll{
+		"d20":      {{dice: 1, sides: 20}},
+		"3d6+2":    {{dice: 3, sides: 6}, {constant: 2}},
+		"2D8-1d4":  {{dice: 2, sides: 8}, {negative: true, dice: 1, sides: 4}},
+		"-1+d100":  {{negative: true, constant: 1}, {dice: 1, sides: 100}},
+		"100d1000": {{dice: 100, sides: 1000}},
+	}
+	for spec, want := range valid {
+		got, err := parseRoll(spec)
+		if err != nil {
+			t.Errorf("parseRoll(%q) => want %+v, got error %s", spec, want, err)
+			continue
+		}
+		if len(got) != len(want) {
+			t.Errorf("parseRoll(%q) => want %+v, got %+v", spec, want, got)
+			continue
+		}
+		for i := range got {
+			if got[i] != want[i] {
+				t.Errorf("parseRoll(%q) => want %+v, got %+v", spec, want, got)
+				break
+			}
+		}
+	}
+	for _, spec := range []string{"", "d", "3d", "d1", "d1001", "0d6", "101d6", "60d6+50d6", "3d6+", "3d6x2", "2+99999999", "d20 adv"} {
+		if r, err := parseRoll(spec); err == nil {
+			t.Errorf("parseRoll(%q) => want an error, got %+v", spec, r)
+		}
+	}
+}
+
+func TestCmdRoll(t *testing.T) {
+	s := diceService{RoomOutput: map[string]string{"!compact:x": "compact"}}
+	tests := []struct {
+		roomID string
+		args   []string
+		dice   []int
+		want   string
+	}{
+		{"!r:x", []string{"3d6+2"}, []int{4, 1, 6}, "@u:x rolled 3d6+2: [4, 1, 6] + 2 = 13"},
+		{"!r:x", []string{"d20"}, []int{17}, "@u:x rolled d20: 17"},
+		{"!r:x", []string{"-1", "+", "2d4"}, []int{1, 1}, "@u:x rolled -1+2d4: -1 + [1, 1] = 1"},
+		{"!r:x", []string{"d20+5", "ADV"}, []int{3, 18}, "@u:x rolled d20+5 with advantage: [3] + 5 = 8, [18] + 5 = 23, keeping 23"},
+		{"!r:x", []string{"d20", "dis"}, []int{3, 18}, "@u:x rolled d20 with disadvantage: [3] = 3, [18] = 18, keeping 3"},
+		{"!compact:x", []string{"3d6+2"}, []int{4, 1, 6}, "@u:x rolled 3d6+2: 13"},
+		{"!compact:x", []string{"d20", "adv"}, []int{3, 18}, "@u:x rolled d20 with advantage: 18"},
+	}
+	for _, test := range tests {
+		unload := loadDice(test.dice...)
+		content, err := s.cmdRoll(test.roomID, "@u:x", test.args)
+		unload()
+		if err != nil {
+			t.Errorf("cmdRoll(%v) => want %q, got error %s", test.args, test.want, err)
+			continue
+		}
+		if msg := content.(*matrix.TextMessage); msg.Body != test.want {
+			t.Errorf("cmdRoll(%v) => want %q, got %q", test.args, test.want, msg.Body)
+		}
+	}
+	if _, err := s.cmdRoll("!r:x", "@u:x", []string{"adv"}); err == nil {
+		t.Error("cmdRoll with no dice => want an error, got nil")
+	}
+}
+
+func TestRollDie(t *testing.T) {
+	seen := make(map[int]bool)
+	for i := 0; i < 1000; i++ {
+		n := rollDie(6)
+		if n < 1 || n > 6 {
+			t.Fatalf("rollDie(6) => want 1 to 6, got %d", n)
+		}
+		seen[n] = true
+	}
+	if len(seen) != 6 {
+		t.Errorf("rollDie(6) 1000 times => want every side, got %v", seen)
+	}
+}
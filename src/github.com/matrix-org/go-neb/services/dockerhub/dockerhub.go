@@ -0,0 +1,408 @@
+package services
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/batch"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/plugin"
+	"github.com/matrix-org/go-neb/secrets"
+	"github.com/matrix-org/go-neb/server"
+	"github.com/matrix-org/go-neb/status"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/go-neb/util"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// maxBodySize is the largest webhook request a registry is expected to send.
+const maxBodySize = 1024 * 1024
+
+// errNotPush is returned by parsePush for webhooks about something other than a push, e.g. Harbor
+// scanning an image, which rooms aren't told about.
+var errNotPush = errors.New("not a push")
+
+// dockerhubService posts a message to rooms when an image is pushed to a container registry: Docker
+// Hub, Harbor or Quay. Each room is sent the pushes to the repositories and tags it wants.
+type dockerhubService struct {
+	id                 string
+	serviceUserID      string
+	webhookEndpointURL string
+	// Token must be sent with every request, as "Authorization: Bearer <token>" or a ?token=
+	// query parameter. Docker Hub and Quay can't send headers, so are given the query parameter.
+	Token secrets.Secret
+	// AllowedIPs are the IP addresses and CIDR ranges the registry may send webhook requests
+	// from. Optional: requests are allowed from anywhere.
+	AllowedIPs []string
+	// BatchWindow is how long to hold back messages about a repository, e.g. "30s", so that
+	// several tags pushed at once are sent as one message. Optional: messages are sent as they
+	// arrive.
+	BatchWindow string
+	// AlertIfQuietFor is how long to go without a webhook before alerting the operators that it
+	// is probably broken, e.g. "168h". Optional: they are never alerted.
+	AlertIfQuietFor string
+	Rooms           map[string]dockerhubRoom // room_id => room
+}
+
+// dockerhubRoom is which pushes a room is sent.
+type dockerhubRoom struct {
+	// Repos are globs which a repository must match for the room to be sent pushes to it, e.g.
+	// "myorg/*". Optional: it is sent pushes to every repository.
+	Repos []string
+	// Tags are globs which a tag must match for the room to be sent it, e.g. "v*" or "latest".
+	// Optional: it is sent every tag.
+	Tags []string
+}
+
+// A push is an image being pushed to a registry, with one or more tags.
+type push struct {
+	Registry string // "Docker Hub", "Harbor" or "Quay"
+	Repo     string // e.g. "myorg/app"
+	Tags     []string
+	Pusher   string // Optional: Quay doesn't say who pushed
+	Image    string // what to pull the image as, without a tag, e.g. "quay.io/myorg/app"
+	URL      string // the repository's page, if the registry gives one
+}
+
+// dockerHubPayload is Docker Hub's webhook payload.
+type dockerHubPayload struct {
+	PushData struct {
+		Pusher string `json:"pusher"`
+		Tag    string `json:"tag"`
+	} `json:"push_data"`
+	Repository struct {
+		RepoName string `json:"repo_name"`
+		RepoURL  string `json:"repo_url"`
+	} `json:"repository"`
+}
+
+// harborPayload is Harbor's webhook payload, in its default format.
+type harborPayload struct {
+	Type      string `json:"type"`
+	Operator  string `json:"operator"`
+	EventData struct {
+		Resources []struct {
+			Tag         string `json:"tag"`
+			ResourceURL string `json:"resource_url"` // e.g. "harbor.example.com/myorg/app:v1"
+		} `json:"resources"`
+		Repository struct {
+			RepoFullName string `json:"repo_full_name"`
+		} `json:"repository"`
+	} `json:"event_data"`
+}
+
+// quayPayload is Quay's repository push notification payload.
+type quayPayload struct {
+	Repository  string   `json:"repository"`
+	DockerURL   string   `json:"docker_url"`
+	Homepage    string   `json:"homepage"`
+	UpdatedTags []string `json:"updated_tags"`
+}
+
+func (s *dockerhubService) ServiceUserID() string { return s.serviceUserID }
+func (s *dockerhubService) ServiceID() string     { return s.id }
+func (s *dockerhubService) ServiceType() string   { return "dockerhub" }
+func (s *dockerhubService) Plugin(cli *matrix.Client, roomID string) plugin.Plugin {
+	return plugin.Plugin{}
+}
+func (s *dockerhubService) WebhookAllowedIPs() []string { return s.AllowedIPs }
+func (s *dockerhubService) QuietPeriod() time.Duration {
+	d, _ := status.ParseQuietPeriod(s.AlertIfQuietFor) // ValidateConfig checks it parses
+	return d
+}
+
+// OnReceiveWebhook sends a message about the push to each room which wants any of its tags.
+func (s *dockerhubService) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli *matrix.Client) {
+	logger := server.RequestLogger(req)
+	if !s.authorised(req) {
+		w.WriteHeader(401)
+		return
+	}
+	if req.Method != "POST" {
+		w.WriteHeader(405)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxBodySize))
+	if err != nil {
+		logger.WithError(err).Print("Failed to read registry webhook")
+		w.WriteHeader(400)
+		return
+	}
+	p, err := parsePush(body)
+	if err == errNotPush {
+		status.Filtered(s.id)
+		w.WriteHeader(200)
+		return
+	}
+	if err != nil {
+		logger.WithError(err).Print("Failed to decode registry webhook")
+		w.WriteHeader(400)
+		return
+	}
+	logger = logger.WithFields(log.Fields{
+		"registry": p.Registry,
+		"repo":     p.Repo,
+		"tags":     p.Tags,
+	})
+
+	var msgs []batch.Message
+	for _, roomID := range util.SortedKeys(s.Rooms) {
+		tags := s.tagsFor(roomID, p)
+		if len(tags) == 0 {
+			continue
+		}
+		logger.WithField("room_id", roomID).Print("Sending push to room")
+		msgs = append(msgs, batch.Message{roomID, p.Repo, pushMessage(p, tags)})
+	}
+	if len(msgs) == 0 {
+		status.Filtered(s.id)
+		w.WriteHeader(200)
+		return
+	}
+	status.Forwarded(s.id)
+	window, _ := batch.ParseWindow(s.BatchWindow) // ValidateConfig checks it parses
+	sendErrs := batch.SendAll(cli, s.id, window, msgs)
+	for roomID, e := range sendErrs {
+		logger.WithError(e).WithField("room_id", roomID).Print("Failed to send notification to room.")
+	}
+	if len(sendErrs) > 0 {
+		// So that the request is dead-lettered, to be replayed once the rooms are fixed.
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(200)
+}
+
+// authorised returns true if the request carries the service's token, or is a replay.
+func (s *dockerhubService) authorised(req *http.Request) bool {
+	if server.IsReplay(req) {
+		return true
+	}
+	token := req.URL.Query().Get("token")
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	want := s.Token.Value()
+	return want != "" && subtle.ConstantTimeCompare([]byte(token), []byte(want)) == 1
+}
+
+// parsePush reads a push from a Docker Hub, Harbor or Quay webhook, telling them apart by their
+// fields. It returns errNotPush for Harbor webhooks about anything else.
+func parsePush(body []byte) (*push, error) {
+	var probe struct {
+		PushData    json.RawMessage `json:"push_data"`
+		EventData   json.RawMessage `json:"event_data"`
+		UpdatedTags json.RawMessage `json:"updated_tags"`
+	}
+	if err := json.Unmarshal(body, &probe); err != nil {
+		return nil, err
+	}
+	switch {
+	case probe.PushData != nil:
+		var p dockerHubPayload
+		if err := json.Unmarshal(body, &p); err != nil {
+			return nil, err
+		}
+		return &push{
+			Registry: "Docker Hub",
+			Repo:     p.Repository.RepoName,
+			Tags:     []string{p.PushData.Tag},
+			Pusher:   p.PushData.Pusher,
+			Image:    p.Repository.RepoName,
+			URL:      p.Repository.RepoURL,
+		}, nil
+	case probe.EventData != nil:
+		var p harborPayload
+		if err := json.Unmarshal(body, &p); err != nil {
+			return nil, err
+		}
+		if p.Type != "PUSH_ARTIFACT" {
+			return nil, errNotPush
+		}
+		h := &push{Registry: "Harbor", Repo: p.EventData.Repository.RepoFullName, Pusher: p.Operator}
+		for _, r := range p.EventData.Resources {
+			if r.Tag == "" {
+				continue // pushed by digest
+			}
+			h.Tags = append(h.Tags, r.Tag)
+			h.Image = strings.TrimSuffix(r.ResourceURL, ":"+r.Tag)
+		}
+		if len(h.Tags) == 0 {
+			return nil, errNotPush
+		}
+		return h, nil
+	case probe.UpdatedTags != nil:
+		var p quayPayload
+		if err := json.Unmarshal(body, &p); err != nil {
+			return nil, err
+		}
+		return &push{
+			Registry: "Quay",
+			Repo:     p.Repository,
+			Tags:     p.UpdatedTags,
+			Image:    p.DockerURL,
+			URL:      p.Homepage,
+		}, nil
+	}
+	return nil, errors.New("not a Docker Hub, Harbor or Quay webhook")
+}
+
+// tagsFor returns the push's tags which the room is sent, or nil if it isn't sent pushes to the
+// repository.
+func (s *dockerhubService) tagsFor(roomID string, p *push) []string {
+	room := s.Rooms[roomID]
+	if !matchesAny(room.Repos, strings.ToLower(p.Repo)) {
+		return nil
+	}
+	var tags []string
+	for _, tag := range p.Tags {
+		if matchesAny(room.Tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// matchesAny returns true if the name matches one of the globs, or if there are none. Globs are
+// matched as by path.Match, so "*" doesn't match a "/": "myorg/*" matches "myorg/app" but not
+// "myorg/app/worker". Repository globs are matched in lower case, as repository names are.
+func matchesAny(globs []string, name string) bool {
+	if len(globs) == 0 {
+		return true
+	}
+	for _, glob := range globs {
+		if ok, _ := path.Match(glob, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// pushMessage writes a message about the tags being pushed, with the image to pull them as.
+func pushMessage(p *push, tags []string) matrix.HTMLMessage {
+	who := p.Pusher
+	if who == "" {
+		who = "Someone"
+	}
+	noun := "tag"
+	if len(tags) > 1 {
+		noun = "tags"
+	}
+	body := fmt.Sprintf("[%s] %s pushed %s %s to %s", p.Registry, who, noun, strings.Join(tags, ", "), p.Repo)
+	repoHTML := html.EscapeString(p.Repo)
+	if p.URL != "" {
+		body += " - " + p.URL
+		repoHTML = fmt.Sprintf(`<a href="%s">%s</a>`, html.EscapeString(p.URL), repoHTML)
+	}
+	codes := make([]string, len(tags))
+	for i, tag := range tags {
+		codes[i] = "<code>" + html.EscapeString(tag) + "</code>"
+	}
+	htmlBody := fmt.Sprintf(
+		"<b>[%s]</b> %s pushed %s %s to %s", html.EscapeString(p.Registry), html.EscapeString(who), noun,
+		strings.Join(codes, ", "), repoHTML,
+	)
+	if p.Image != "" {
+		body += "\ndocker pull " + p.Image + ":" + tags[0]
+		htmlBody += "<br><code>docker pull " + html.EscapeString(p.Image+":"+tags[0]) + "</code>"
+	}
+	return matrix.HTMLMessage{
+		Body:          body,
+		MsgType:       "m.notice",
+		Format:        "org.matrix.custom.html",
+		FormattedBody: htmlBody,
+	}
+}
+
+// ValidateConfig checks that the token is given, that the allowed IPs, batch window and quiet
+// period parse, and that every room ID is well formed and its globs parse.
+func (s *dockerhubService) ValidateConfig() []types.ConfigError {
+	var errs []types.ConfigError
+	if s.Token.Value() == "" {
+		errs = append(errs, types.ConfigError{Field: "Token", Message: "is required"})
+	}
+	if _, err := server.ParseAllowlist(s.AllowedIPs); err != nil {
+		errs = append(errs, types.ConfigError{Field: "AllowedIPs", Message: "does not parse: " + err.Error()})
+	}
+	if _, err := batch.ParseWindow(s.BatchWindow); err != nil {
+		errs = append(errs, types.ConfigError{Field: "BatchWindow", Message: "is not a valid window: " + err.Error()})
+	}
+	if _, err := status.ParseQuietPeriod(s.AlertIfQuietFor); err != nil {
+		errs = append(errs, types.ConfigError{Field: "AlertIfQuietFor", Message: "is not a valid period: " + err.Error()})
+	}
+	if len(s.Rooms) == 0 {
+		errs = append(errs, types.ConfigError{Field: "Rooms", Message: "must list at least one room"})
+	}
+	return append(errs, s.validateRooms()...)
+}
+
+// validateRooms checks that every room ID in Rooms is well formed and that its globs parse.
+func (s *dockerhubService) validateRooms() []types.ConfigError {
+	var errs []types.ConfigError
+	for _, roomID := range util.SortedKeys(s.Rooms) {
+		roomField := fmt.Sprintf("Rooms[%s]", roomID)
+		if !types.IsRoomID(roomID) {
+			errs = append(errs, types.ConfigError{Field: roomField, Message: "is not a room ID"})
+		}
+		room := s.Rooms[roomID]
+		for i, glob := range room.Repos {
+			if _, err := path.Match(glob, ""); err != nil {
+				errs = append(errs, types.ConfigError{Field: fmt.Sprintf("%s.Repos[%d]", roomField, i), Message: "is not a valid glob: " + err.Error()})
+			} else if glob != strings.ToLower(glob) {
+				errs = append(errs, types.ConfigError{Field: fmt.Sprintf("%s.Repos[%d]", roomField, i), Message: "must be in lower case"})
+			}
+		}
+		for i, glob := range room.Tags {
+			if _, err := path.Match(glob, ""); err != nil {
+				errs = append(errs, types.ConfigError{Field: fmt.Sprintf("%s.Tags[%d]", roomField, i), Message: "is not a valid glob: " + err.Error()})
+			}
+		}
+	}
+	return errs
+}
+
+// Register joins the rooms messages are posted to.
+func (s *dockerhubService) Register(oldService types.Service, client *matrix.Client) error {
+	for _, roomID := range util.SortedKeys(s.Rooms) {
+		if _, err := client.JoinRoom(roomID, "", ""); err != nil {
+			return err
+		}
+	}
+	log.WithFields(log.Fields{
+		"service_id": s.id,
+		"url":        s.webhookEndpointURL,
+	}).Info("Registered container registry webhook: add the URL, with ?token=<token>, to the webhooks of each repository")
+	return nil
+}
+
+// PlanRegister works out which rooms Register would join, and notes the webhook URL each
+// repository needs.
+func (s *dockerhubService) PlanRegister(oldService types.Service, client *matrix.Client) (*types.RegisterPlan, error) {
+	plan := &types.RegisterPlan{JoinRooms: types.PlanJoinRooms(client, util.SortedKeys(s.Rooms))}
+	plan.Notes = []string{"Each repository must be given a webhook to " + s.webhookEndpointURL + "?token=<token> in the registry"}
+	return plan, nil
+}
+
+// CheckRegistered checks that the service's client is still in each room pushes are posted to.
+func (s *dockerhubService) CheckRegistered(client *matrix.Client) ([]string, error) {
+	return types.CheckJoinedRooms(client, util.SortedKeys(s.Rooms)), nil
+}
+
+func (s *dockerhubService) PostRegister(oldService types.Service) {}
+
+func init() {
+	types.RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) types.Service {
+		return &dockerhubService{
+			id:                 serviceID,
+			serviceUserID:      serviceUserID,
+			webhookEndpointURL: webhookEndpointURL,
+		}
+	})
+}
@@ -0,0 +1,105 @@
+package services
+
+import (
+	"reflect"
+	"testing"
+)
+
+const dockerHubPush = `{
+  "callback_url": "https://registry.hub.docker.com/u/myorg/app/hook/abc/",
+  "push_data": {"pushed_at": 1417566161, "pusher": "alice", "tag": "v1.2"},
+  "repository": {"repo_name": "myorg/app", "repo_url": "https://hub.docker.com/r/myorg/app", "namespace": "myorg", "name": "app"}
+}`
+
+const harborPush = `{
+  "type": "PUSH_ARTIFACT",
+  "occur_at": 1680502375,
+  "operator": "bob",
+  "event_data": {
+    "resources": [
+      {"digest": "sha256:abc", "tag": "latest", "resource_url": "harbor.example.com/myorg/app:latest"},
+      {"digest": "sha256:abc", "tag": "v1.2", "resource_url": "harbor.example.com/myorg/app:v1.2"}
+    ],
+    "repository": {"name": "app", "namespace": "myorg", "repo_full_name": "myorg/app", "repo_type": "private"}
+  }
+}`
+
+const quayPush = `{
+  "repository": "myorg/app",
+  "namespace": "myorg",
+  "name": "app",
+  "docker_url": "quay.io/myorg/app",
+  "homepage": "https://quay.io/repository/myorg/app",
+  "updated_tags": ["latest", "v1.2"]
+}`
+
+func TestParsePush(t *testing.T) {
+	tests := []struct {
+		body string
+		want *push
+	}{
+		{dockerHubPush, &push{"Docker Hub", "myorg/app", []string{"v1.2"}, "alice", "myorg/app", "https://hub.docker.com/r/myorg/app"}},
+		{harborPush, &push{"Harbor", "myorg/app", []string{"latest", "v1.2"}, "bob", "harbor.example.com/myorg/app", ""}},
+		{quayPush, &push{"Quay", "myorg/app", []string{"latest", "v1.2"}, "", "quay.io/myorg/app", "https://quay.io/repository/myorg/app"}},
+	}
+	for _, test := range tests {
+		got, err := parsePush([]byte(test.body))
+		if err != nil {
+			t.Errorf("parsePush(%s) => %s", test.body, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parsePush(%s) => want %+v got %+v", test.body, test.want, got)
+		}
+	}
+	if _, err := parsePush([]byte(`{"type": "SCANNING_COMPLETED", "event_data": {}}`)); err != errNotPush {
+		t.Errorf("parsePush(Harbor scan) => want errNotPush got %v", err)
+	}
+	for _, bad := range []string{`{"foo": "bar"}`, `not json`} {
+		if _, err := parsePush([]byte(bad)); err == nil || err == errNotPush {
+			t.Errorf("parsePush(%s) => want an error got %v", bad, err)
+		}
+	}
+}
+
+func TestTagsFor(t *testing.T) {
+	s := &dockerhubService{Rooms: map[string]dockerhubRoom{
+		"!all:x":      {},
+		"!releases:x": {Repos: []string{"myorg/*"}, Tags: []string{"v*"}},
+		"!other:x":    {Repos: []string{"otherorg/*", "myorg"}},
+	}}
+	p := &push{Repo: "MyOrg/app", Tags: []string{"latest", "v1.2"}}
+	for roomID, want := range map[string][]string{
+		"!all:x":      {"latest", "v1.2"},
+		"!releases:x": {"v1.2"},
+		"!other:x":    nil,
+	} {
+		if got := s.tagsFor(roomID, p); !reflect.DeepEqual(got, want) {
+			t.Errorf("tagsFor(%s) => want %v got %v", roomID, want, got)
+		}
+	}
+}
+
+func TestPushMessage(t *testing.T) {
+	p, err := parsePush([]byte(dockerHubPush))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := pushMessage(p, p.Tags)
+	wantBody := "[Docker Hub] alice pushed tag v1.2 to myorg/app - https://hub.docker.com/r/myorg/app\ndocker pull myorg/app:v1.2"
+	if msg.Body != wantBody {
+		t.Errorf("pushMessage body => want %q got %q", wantBody, msg.Body)
+	}
+	wantHTML := `<b>[Docker Hub]</b> alice pushed tag <code>v1.2</code> to <a href="https://hub.docker.com/r/myorg/app">myorg/app</a>` +
+		"<br><code>docker pull myorg/app:v1.2</code>"
+	if msg.FormattedBody != wantHTML {
+		t.Errorf("pushMessage HTML => want %q got %q", wantHTML, msg.FormattedBody)
+	}
+
+	p, _ = parsePush([]byte(quayPush))
+	msg = pushMessage(p, p.Tags)
+	wantBody = "[Quay] Someone pushed tags latest, v1.2 to myorg/app - https://quay.io/repository/myorg/app\ndocker pull quay.io/myorg/app:latest"
+	if msg.Body != wantBody {
+		t.Errorf("pushMessage body => want %q got %q", wantBody, msg.Body)
+	}
+}
@@ -11,6 +11,9 @@ import (
 type echoService struct {
 	id            string
 	serviceUserID string
+	// CommandPrefixes are what commands start with in each room, e.g. {"!foo:bar": "?"}, so that
+	// several bots in a room can be told apart. Optional: in other rooms commands start with "!".
+	CommandPrefixes map[string]string
 }
 
 func (e *echoService) ServiceUserID() string                                          { return e.serviceUserID }
@@ -18,11 +21,17 @@ func (e *echoService) ServiceID() string
 func (e *echoService) ServiceType() string                                            { return "echo" }
 func (e *echoService) Register(oldService types.Service, client *matrix.Client) error { return nil }
 func (e *echoService) PostRegister(oldService types.Service)                          {}
+func (e *echoService) ValidateConfig() []types.ConfigError {
+	return types.ValidateCommandPrefixes(e.CommandPrefixes)
+}
 func (e *echoService) Plugin(cli *matrix.Client, roomID string) plugin.Plugin {
 	return plugin.Plugin{
+		Prefix: e.CommandPrefixes[roomID],
 		Commands: []plugin.Command{
 			plugin.Command{
-				Path: []string{"echo"},
+				Path:      []string{"echo"},
+				Arguments: []string{"text"},
+				Help:      "Repeat the text",
 				Command: func(roomID, userID string, args []string) (interface{}, error) {
 					return &matrix.TextMessage{"m.notice", strings.Join(args, " ")}, nil
 				},
@@ -0,0 +1,543 @@
+package services
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/plugin"
+	"github.com/matrix-org/go-neb/secrets"
+	"github.com/matrix-org/go-neb/server"
+	"github.com/matrix-org/go-neb/streams"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/go-neb/util"
+	"golang.org/x/net/context"
+	"html"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxEmailSize is the largest email, with its attachments, which is received.
+const maxEmailSize = 25 * 1024 * 1024
+
+// maxAttachments is how many of an email's attachments are uploaded.
+const maxAttachments = 10
+
+// maxTextLength is how many characters of an email's text are sent. Longer text is cut short.
+const maxTextLength = 4000
+
+// maxFetches is how many unread emails are fetched from the mailbox each time it is polled.
+const maxFetches = 50
+
+// maxSendAttempts is how many times an unread email which fails to send is fetched again before it
+// is given up on and marked read, so that emails which always fail don't hold up newer ones.
+const maxSendAttempts = 5
+
+// sendFailures counts the failed attempts to send each unread email, keyed by service ID, mailbox
+// and UID.
+var sendFailures = struct {
+	sync.Mutex
+	counts map[string]int
+}{counts: make(map[string]int)}
+
+// defaultPollInterval and minPollInterval are how often the mailbox is polled by default, and at
+// most.
+const (
+	defaultPollInterval = time.Minute
+	minPollInterval     = 30 * time.Second
+)
+
+// sentEmailTTL is how long a sent email's Message-ID is remembered, so that it isn't sent again if
+// it is delivered twice.
+const sentEmailTTL = 30 * 24 * time.Hour
+
+// markMutex is held whilst an email is checked and marked as sent, so that an email delivered
+// twice at once is only sent once.
+var markMutex sync.Mutex
+
+// emailService sends emails into rooms. It either receives them itself, by SMTP, or fetches unread
+// ones from an IMAP mailbox. Each room is sent the emails to its plus-addresses, e.g.
+// "alerts+ops@example.com", or with subjects it wants.
+type emailService struct {
+	id            string
+	serviceUserID string
+	// ListenAddress is the address to receive emails by SMTP on, e.g. ":2525". Point the MX record
+	// of a domain, or a forwarding rule, at it. Either this or IMAPAddress is required.
+	ListenAddress string
+	// Domains are the domains emails may be sent to over SMTP, e.g. ["alerts.example.com"].
+	// Required with ListenAddress: emails to other domains are refused.
+	Domains []string
+	// TLSCertFile and TLSKeyFile are the PEM files of the certificate and key SMTP clients may
+	// encrypt emails with, using STARTTLS. Optional: emails are received in plaintext.
+	TLSCertFile string
+	TLSKeyFile  string
+	// AllowedIPs are the IP addresses and CIDR ranges which may send emails over SMTP. Optional:
+	// emails are received from anywhere.
+	AllowedIPs []string
+	// IMAPAddress is the IMAP server to fetch emails from, e.g. "imap.example.com:993".
+	IMAPAddress  string
+	IMAPUsername string
+	IMAPPassword secrets.Secret
+	// IMAPMailbox is the mailbox to fetch unread emails from. Optional: "INBOX".
+	IMAPMailbox string
+	// IMAPPlaintext connects to the IMAP server without TLS, e.g. to one on localhost. Optional.
+	IMAPPlaintext bool
+	// PollInterval is how often the mailbox is checked for unread emails, e.g. "5m". Optional:
+	// "1m".
+	PollInterval string
+	Rooms        map[string]emailRoom // room_id => room
+}
+
+// emailRoom is which emails a room is sent. A room which wants neither tags nor subjects is sent
+// every email.
+type emailRoom struct {
+	// Tags are the plus-address tags the room is sent the emails of, e.g. "ops" for emails to
+	// "alerts+ops@example.com". Optional: emails to any address.
+	Tags []string
+	// Subject is a regular expression which the subjects of the emails the room is sent must match,
+	// e.g. "(?i)outage". Optional: emails with any subject.
+	Subject string
+}
+
+func (s *emailService) ServiceUserID() string { return s.serviceUserID }
+func (s *emailService) ServiceID() string     { return s.id }
+func (s *emailService) ServiceType() string   { return "email" }
+func (s *emailService) Plugin(cli *matrix.Client, roomID string) plugin.Plugin {
+	return plugin.Plugin{}
+}
+func (s *emailService) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli *matrix.Client) {
+	w.WriteHeader(200) // Do nothing
+}
+
+// PostRegister starts receiving or fetching emails, or restarts with the new config.
+func (s *emailService) PostRegister(oldService types.Service) {
+	streams.Wake()
+}
+
+// Stream receives emails by SMTP, or polls the IMAP mailbox for them, until it is stopped.
+func (s *emailService) Stream(ctx context.Context, cli *matrix.Client) error {
+	if err := database.GetServiceDB().DeleteMirroredPostsBefore(s.id, time.Now().Add(-sentEmailTTL)); err != nil {
+		log.WithError(err).WithField("service_id", s.id).Warn("Failed to forget old emails")
+	}
+	if s.ListenAddress != "" {
+		return s.listen(ctx, cli)
+	}
+	interval := defaultPollInterval
+	if s.PollInterval != "" {
+		interval, _ = time.ParseDuration(s.PollInterval) // ValidateConfig checks it parses
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := s.poll(cli); err != nil {
+			log.WithError(err).WithField("service_id", s.id).Warn("Failed to fetch emails")
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// listen receives emails by SMTP until the context is cancelled.
+func (s *emailService) listen(ctx context.Context, cli *matrix.Client) error {
+	allowed, _ := server.ParseAllowlist(s.AllowedIPs) // ValidateConfig checks it parses
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "go-neb"
+	}
+	var tlsConfig *tls.Config
+	if s.TLSCertFile != "" {
+		cert, certErr := server.LoadCertificate(s.TLSCertFile, s.TLSKeyFile)
+		if certErr != nil {
+			return certErr
+		}
+		tlsConfig = &tls.Config{GetCertificate: cert.GetCertificate}
+	}
+	l, err := net.Listen("tcp", s.ListenAddress)
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"service_id": s.id,
+		"address":    l.Addr().String(),
+	}).Info("Receiving emails by SMTP")
+	srv := &smtpServer{
+		hostname:        hostname,
+		maxSize:         maxEmailSize,
+		maxConns:        maxConnections,
+		allowed:         allowed,
+		tlsConfig:       tlsConfig,
+		acceptRecipient: s.acceptRecipient,
+		deliver: func(from string, to []string, data []byte) error {
+			e, err := parseEmail(data)
+			if err != nil {
+				// Trying again won't help.
+				log.WithError(err).WithFields(log.Fields{
+					"service_id": s.id,
+					"from":       from,
+				}).Warn("Dropping email which doesn't parse")
+				return nil
+			}
+			e.To = to
+			return s.send(cli, e)
+		},
+	}
+	return srv.serve(ctx, l)
+}
+
+// acceptRecipient returns true if emails to the address may be received: those to the Domains.
+func (s *emailService) acceptRecipient(addr string) bool {
+	domain := addr[strings.LastIndex(addr, "@")+1:]
+	for _, d := range s.Domains {
+		if strings.EqualFold(d, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// poll fetches the unread emails in the mailbox, sends them, and marks them read. Emails which
+// fail to send are left unread, to be tried again next time, until they have failed
+// maxSendAttempts times.
+func (s *emailService) poll(cli *matrix.Client) error {
+	c, err := dialIMAP(s.IMAPAddress, s.IMAPPlaintext)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if err = c.login(s.IMAPUsername, s.IMAPPassword.Value()); err != nil {
+		return err
+	}
+	if err = c.selectMailbox(s.mailbox()); err != nil {
+		return err
+	}
+	uids, err := c.searchUnseen()
+	if err != nil {
+		return err
+	}
+	for i, uid := range uids {
+		if i == maxFetches {
+			break
+		}
+		logger := log.WithFields(log.Fields{
+			"service_id": s.id,
+			"uid":        uid,
+		})
+		raw, err := c.fetch(uid)
+		if err != nil {
+			return err
+		}
+		key := fmt.Sprintf("%s %s %d", s.id, s.mailbox(), uid)
+		var e *email
+		if e, err = parseEmail(raw); err != nil {
+			logger.WithError(err).Warn("Skipping email which doesn't parse")
+		} else if err = s.send(cli, e); err != nil {
+			sendFailures.Lock()
+			sendFailures.counts[key]++
+			attempts := sendFailures.counts[key]
+			sendFailures.Unlock()
+			if attempts < maxSendAttempts {
+				logger.WithError(err).Warn("Failed to send email, leaving it unread")
+				continue
+			}
+			logger.WithError(err).WithField("attempts", attempts).Error("Failed to send email too many times, marking it read")
+		}
+		sendFailures.Lock()
+		delete(sendFailures.counts, key)
+		sendFailures.Unlock()
+		if err = c.markSeen(uid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// send sends the email, and its attachments, into each room which wants it and hasn't been sent it.
+// Returns the last error sending it, if any. Rooms it failed to be sent into forget it, so that it
+// is sent when it is tried again.
+func (s *emailService) send(cli *matrix.Client, e *email) error {
+	roomIDs := s.roomsFor(e)
+	logger := log.WithFields(log.Fields{
+		"service_id": s.id,
+		"message_id": e.MessageID,
+	})
+	if len(roomIDs) == 0 {
+		logger.Print("No room wants email")
+		return nil
+	}
+	msg := emailMessage(e)
+	var lastErr error
+	for _, roomID := range roomIDs {
+		if e.MessageID != "" {
+			markMutex.Lock()
+			marked, err := database.GetServiceDB().MarkPostMirrored(s.id, roomID, e.MessageID)
+			markMutex.Unlock()
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			if !marked {
+				continue
+			}
+		}
+		if _, err := cli.SendMessageEvent(roomID, "m.room.message", msg); err != nil {
+			lastErr = err
+			if e.MessageID != "" {
+				if err = database.GetServiceDB().ForgetMirroredPost(s.id, roomID, e.MessageID); err != nil {
+					logger.WithError(err).Error("Failed to forget unsent email")
+				}
+			}
+			continue
+		}
+		for _, a := range e.Attachments {
+			if err := sendAttachment(cli, roomID, a); err != nil {
+				logger.WithError(err).WithField("filename", a.Filename).Warn("Failed to send attachment")
+			}
+		}
+	}
+	return lastErr
+}
+
+// sendAttachment uploads the attachment to the content repository and sends it into the room, as an
+// image if it is one.
+func sendAttachment(cli *matrix.Client, roomID string, a attachment) error {
+	mxc, err := cli.UploadToContentRepo(bytes.NewReader(a.Data), a.ContentType, int64(len(a.Data)))
+	if err != nil {
+		return err
+	}
+	var msg interface{}
+	if strings.HasPrefix(a.ContentType, "image/") {
+		msg = matrix.ImageMessage{
+			MsgType: "m.image",
+			Body:    a.Filename,
+			URL:     mxc,
+			Info:    matrix.ImageInfo{Mimetype: a.ContentType, Size: uint(len(a.Data))},
+		}
+	} else {
+		msg = matrix.FileMessage{
+			MsgType: "m.file",
+			Body:    a.Filename,
+			URL:     mxc,
+			Info:    matrix.FileInfo{Mimetype: a.ContentType, Size: uint(len(a.Data))},
+		}
+	}
+	_, err = cli.SendMessageEvent(roomID, "m.room.message", msg)
+	return err
+}
+
+// roomsFor returns the rooms which want the email, sorted.
+func (s *emailService) roomsFor(e *email) []string {
+	tags := make(map[string]bool)
+	for _, addr := range e.To {
+		if tag := plusTag(addr); tag != "" {
+			tags[tag] = true
+		}
+	}
+	var roomIDs []string
+	for _, roomID := range util.SortedKeys(s.Rooms) {
+		room := s.Rooms[roomID]
+		if len(room.Tags) > 0 {
+			found := false
+			for _, tag := range room.Tags {
+				found = found || tags[strings.ToLower(tag)]
+			}
+			if !found {
+				continue
+			}
+		}
+		if room.Subject != "" {
+			re, err := regexp.Compile(room.Subject)
+			if err != nil || !re.MatchString(e.Subject) {
+				continue // ValidateConfig checks it compiles
+			}
+		}
+		roomIDs = append(roomIDs, roomID)
+	}
+	return roomIDs
+}
+
+// plusTag returns the lower-cased tag of a plus-address, e.g. "ops" for "alerts+ops@example.com",
+// or "" if it has none.
+func plusTag(addr string) string {
+	local := addr
+	if i := strings.LastIndex(addr, "@"); i >= 0 {
+		local = addr[:i]
+	}
+	i := strings.Index(local, "+")
+	if i < 0 {
+		return ""
+	}
+	return strings.ToLower(local[i+1:])
+}
+
+// emailMessage writes a message with the email's subject, who it is from, and its text, cut short
+// if it is long.
+func emailMessage(e *email) matrix.HTMLMessage {
+	subject := e.Subject
+	if subject == "" {
+		subject = "(no subject)"
+	}
+	text := e.Text
+	if runes := []rune(text); len(runes) > maxTextLength {
+		text = string(runes[:maxTextLength]) + "… (cut short)"
+	}
+	body := fmt.Sprintf("%s\nFrom: %s", subject, e.From)
+	htmlBody := fmt.Sprintf("<b>%s</b><br>From: %s", html.EscapeString(subject), html.EscapeString(e.From))
+	if text != "" {
+		body += "\n\n" + text
+		htmlBody += "<br><br>" + strings.Replace(html.EscapeString(text), "\n", "<br>", -1)
+	}
+	return matrix.HTMLMessage{
+		Body:          body,
+		MsgType:       "m.notice",
+		Format:        "org.matrix.custom.html",
+		FormattedBody: htmlBody,
+	}
+}
+
+func (s *emailService) mailbox() string {
+	if s.IMAPMailbox == "" {
+		return "INBOX"
+	}
+	return s.IMAPMailbox
+}
+
+// ValidateConfig checks that emails are either received by SMTP or fetched by IMAP, with what that
+// needs, and that every room ID, tag and subject is well formed.
+func (s *emailService) ValidateConfig() []types.ConfigError {
+	var errs []types.ConfigError
+	switch {
+	case s.ListenAddress == "" && s.IMAPAddress == "":
+		errs = append(errs, types.ConfigError{Field: "ListenAddress", Message: "or IMAPAddress is required"})
+	case s.ListenAddress != "" && s.IMAPAddress != "":
+		errs = append(errs, types.ConfigError{Field: "IMAPAddress", Message: "can't be given with ListenAddress"})
+	case s.ListenAddress != "":
+		errs = append(errs, s.validateSMTP()...)
+	default:
+		errs = append(errs, s.validateIMAP()...)
+	}
+	errs = append(errs, s.validatePollInterval()...)
+	if _, err := server.ParseAllowlist(s.AllowedIPs); err != nil {
+		errs = append(errs, types.ConfigError{Field: "AllowedIPs", Message: "does not parse: " + err.Error()})
+	}
+	errs = append(errs, s.validateDomains()...)
+	return append(errs, s.validateRooms()...)
+}
+
+// validateSMTP checks that what receiving emails by SMTP needs is given.
+func (s *emailService) validateSMTP() []types.ConfigError {
+	var errs []types.ConfigError
+	if _, _, err := net.SplitHostPort(s.ListenAddress); err != nil {
+		errs = append(errs, types.ConfigError{Field: "ListenAddress", Message: "is not a host:port address: " + err.Error()})
+	}
+	if len(s.Domains) == 0 {
+		errs = append(errs, types.ConfigError{Field: "Domains", Message: "is required with ListenAddress"})
+	}
+	if (s.TLSCertFile == "") != (s.TLSKeyFile == "") {
+		errs = append(errs, types.ConfigError{Field: "TLSKeyFile", Message: "and TLSCertFile must be given together"})
+	}
+	return errs
+}
+
+// validateIMAP checks that what fetching emails by IMAP needs is given.
+func (s *emailService) validateIMAP() []types.ConfigError {
+	var errs []types.ConfigError
+	if _, _, err := net.SplitHostPort(s.IMAPAddress); err != nil {
+		errs = append(errs, types.ConfigError{Field: "IMAPAddress", Message: "is not a host:port address: " + err.Error()})
+	}
+	if s.IMAPUsername == "" {
+		errs = append(errs, types.ConfigError{Field: "IMAPUsername", Message: "is required"})
+	}
+	if s.IMAPPassword.Value() == "" {
+		errs = append(errs, types.ConfigError{Field: "IMAPPassword", Message: "is required"})
+	}
+	return errs
+}
+
+// validatePollInterval checks that the poll interval, if given, parses and isn't too short.
+func (s *emailService) validatePollInterval() []types.ConfigError {
+	if s.PollInterval == "" {
+		return nil
+	}
+	if d, err := time.ParseDuration(s.PollInterval); err != nil {
+		return []types.ConfigError{{Field: "PollInterval", Message: "is not a valid duration: " + err.Error()}}
+	} else if d < minPollInterval {
+		return []types.ConfigError{{Field: "PollInterval", Message: fmt.Sprintf("must be at least %s", minPollInterval)}}
+	}
+	return nil
+}
+
+// validateDomains checks that every domain in Domains is a domain, not an address.
+func (s *emailService) validateDomains() []types.ConfigError {
+	var errs []types.ConfigError
+	for i, domain := range s.Domains {
+		if domain == "" || strings.Contains(domain, "@") {
+			errs = append(errs, types.ConfigError{Field: fmt.Sprintf("Domains[%d]", i), Message: "is not a domain"})
+		}
+	}
+	return errs
+}
+
+// validateRooms checks that there is a room, and that every room ID, tag and subject in Rooms is
+// well formed.
+func (s *emailService) validateRooms() []types.ConfigError {
+	var errs []types.ConfigError
+	if len(s.Rooms) == 0 {
+		errs = append(errs, types.ConfigError{Field: "Rooms", Message: "must list at least one room"})
+	}
+	for _, roomID := range util.SortedKeys(s.Rooms) {
+		roomField := fmt.Sprintf("Rooms[%s]", roomID)
+		room := s.Rooms[roomID]
+		if !types.IsRoomID(roomID) {
+			errs = append(errs, types.ConfigError{Field: roomField, Message: "is not a room ID"})
+		}
+		for i, tag := range room.Tags {
+			if tag == "" || strings.ContainsAny(tag, "@+ ") {
+				errs = append(errs, types.ConfigError{Field: fmt.Sprintf("%s.Tags[%d]", roomField, i), Message: "is not a plus-address tag"})
+			}
+		}
+		if _, err := regexp.Compile(room.Subject); err != nil {
+			errs = append(errs, types.ConfigError{Field: roomField + ".Subject", Message: "does not compile: " + err.Error()})
+		}
+	}
+	return errs
+}
+
+// Register joins the rooms emails are sent into.
+func (s *emailService) Register(oldService types.Service, client *matrix.Client) error {
+	for _, roomID := range util.SortedKeys(s.Rooms) {
+		if _, err := client.JoinRoom(roomID, "", ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PlanRegister works out which of the rooms emails are sent into Register would join.
+func (s *emailService) PlanRegister(oldService types.Service, client *matrix.Client) (*types.RegisterPlan, error) {
+	plan := &types.RegisterPlan{JoinRooms: types.PlanJoinRooms(client, util.SortedKeys(s.Rooms))}
+	return plan, nil
+}
+
+// CheckRegistered checks that the service's client is still in each room emails are sent into.
+func (s *emailService) CheckRegistered(client *matrix.Client) ([]string, error) {
+	return types.CheckJoinedRooms(client, util.SortedKeys(s.Rooms)), nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) types.Service {
+		return &emailService{
+			id:            serviceID,
+			serviceUserID: serviceUserID,
+		}
+	})
+}
@@ -0,0 +1,472 @@
+package services
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/secrets"
+	"golang.org/x/net/context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const multipartEmail = "Message-ID: <abc123@example.com>\r\n" +
+	"From: =?utf-8?q?Caf=C3=A9?= <cafe@example.com>\r\n" +
+	"To: alerts+ops@example.com\r\n" +
+	"Cc: someone@example.com\r\n" +
+	"Subject: =?utf-8?b?T3V0YWdlIOKAlCBkYg==?=\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=outer\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/alternative; boundary=inner\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"The database is d=C3=A9graded.\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/html; charset=utf-8\r\n" +
+	"\r\n" +
+	"<p>The database is <b>degraded</b>.</p>\r\n" +
+	"--inner--\r\n" +
+	"--outer\r\n" +
+	"Content-Type: image/png\r\n" +
+	"Content-Disposition: attachment; filename=graph.png\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"iVBORw0K\r\n" +
+	"--outer--\r\n"
+
+func TestParseEmail(t *testing.T) {
+	e, err := parseEmail([]byte(multipartEmail))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.MessageID != "abc123@example.com" || e.From != "Café <cafe@example.com>" || e.Subject != "Outage — db" {
+		t.Errorf("parseEmail headers => got %+v", e)
+	}
+	if want := []string{"alerts+ops@example.com", "someone@example.com"}; !reflect.DeepEqual(e.To, want) {
+		t.Errorf("parseEmail To => want %v got %v", want, e.To)
+	}
+	if want := "The database is dégraded."; e.Text != want {
+		t.Errorf("parseEmail Text => want %q got %q", want, e.Text)
+	}
+	if len(e.Attachments) != 1 || e.Attachments[0].Filename != "graph.png" ||
+		e.Attachments[0].ContentType != "image/png" || string(e.Attachments[0].Data) != "\x89PNG\r\n" {
+		t.Errorf("parseEmail Attachments => got %+v", e.Attachments)
+	}
+}
+
+func TestParseEmailHTMLOnly(t *testing.T) {
+	e, err := parseEmail([]byte("Subject: Hi\r\nContent-Type: text/html; charset=iso-8859-1\r\n\r\n<p>Caf\xe9 <b>open</b></p>\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Text != "Café open" || len(e.Attachments) != 0 {
+		t.Errorf("parseEmail of HTML => want its text, got %+v", e)
+	}
+}
+
+func TestPlusTag(t *testing.T) {
+	for addr, want := range map[string]string{
+		"alerts+Ops@example.com": "ops",
+		"alerts@example.com":     "",
+		"a+b+c@example.com":      "b+c",
+		"alerts+ci":              "ci",
+	} {
+		if got := plusTag(addr); got != want {
+			t.Errorf("plusTag(%q) => want %q got %q", addr, want, got)
+		}
+	}
+}
+
+func TestRoomsFor(t *testing.T) {
+	s := emailService{Rooms: map[string]emailRoom{
+		"!all:x":     {},
+		"!ops:x":     {Tags: []string{"OPS", "oncall"}},
+		"!outage:x":  {Subject: "(?i)outage"},
+		"!ci:x":      {Tags: []string{"ci"}},
+		"!ciFail:x":  {Tags: []string{"ci"}, Subject: "failed"},
+		"!opsDown:x": {Tags: []string{"ops"}, Subject: "down"},
+	}}
+	for _, test := range []struct {
+		to      string
+		subject string
+		want    []string
+	}{
+		{"alerts+ops@example.com", "Outage", []string{"!all:x", "!ops:x", "!outage:x"}},
+		{"alerts+ci@example.com", "Build failed", []string{"!all:x", "!ci:x", "!ciFail:x"}},
+		{"alerts@example.com", "Hello", []string{"!all:x"}},
+	} {
+		got := s.roomsFor(&email{To: []string{test.to}, Subject: test.subject})
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("roomsFor(%s, %q) => want %v got %v", test.to, test.subject, test.want, got)
+		}
+	}
+}
+
+func TestEmailMessage(t *testing.T) {
+	msg := emailMessage(&email{From: "Bob <bob@example.com>", Subject: "Disk <full>", Text: "Line 1\nLine 2"})
+	if want := "Disk <full>\nFrom: Bob <bob@example.com>\n\nLine 1\nLine 2"; msg.Body != want {
+		t.Errorf("emailMessage body => want %q got %q", want, msg.Body)
+	}
+	if want := "<b>Disk &lt;full&gt;</b><br>From: Bob &lt;bob@example.com&gt;<br><br>Line 1<br>Line 2"; msg.FormattedBody != want {
+		t.Errorf("emailMessage HTML => want %q got %q", want, msg.FormattedBody)
+	}
+	msg = emailMessage(&email{Text: strings.Repeat("é", maxTextLength+1)})
+	if !strings.HasPrefix(msg.Body, "(no subject)") || !strings.HasSuffix(msg.Body, "é… (cut short)") {
+		t.Errorf("emailMessage of long text => want it cut short, got %q", msg.Body[len(msg.Body)-20:])
+	}
+}
+
+func TestSMTPServer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	type delivery struct {
+		from string
+		to   []string
+		data string
+	}
+	delivered := make(chan delivery, 1)
+	s := emailService{Domains: []string{"example.com"}}
+	srv := &smtpServer{
+		hostname:        "test",
+		maxSize:         1024,
+		maxConns:        10,
+		acceptRecipient: s.acceptRecipient,
+		deliver: func(from string, to []string, data []byte) error {
+			delivered <- delivery{from, to, string(data)}
+			return nil
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go srv.serve(ctx, l)
+
+	err = smtp.SendMail(l.Addr().String(), nil, "bob@example.org", []string{"alerts+ops@Example.com"},
+		[]byte("Subject: Hi\r\n\r\n.Dotted line\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := <-delivered
+	want := delivery{"bob@example.org", []string{"alerts+ops@Example.com"}, "Subject: Hi\n\n.Dotted line\n"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("SMTP delivery => want %+v got %+v", want, got)
+	}
+
+	err = smtp.SendMail(l.Addr().String(), nil, "bob@example.org", []string{"alerts@example.net"}, []byte("Hi\r\n"))
+	if err == nil || !strings.HasPrefix(err.Error(), "550") {
+		t.Errorf("SMTP to another domain => want 550, got %v", err)
+	}
+	err = smtp.SendMail(l.Addr().String(), nil, "bob@example.org", []string{"alerts@example.com"},
+		[]byte(strings.Repeat("x", 2000)))
+	if err == nil || !strings.HasPrefix(err.Error(), "552") {
+		t.Errorf("SMTP of a large email => want 552, got %v", err)
+	}
+}
+
+func TestSMTPServerConnectionLimit(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &smtpServer{hostname: "test", maxSize: 1024, maxConns: 1}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go srv.serve(ctx, l)
+
+	var greetings []string
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		greetings = append(greetings, line)
+	}
+	if !strings.HasPrefix(greetings[0], "220") || !strings.HasPrefix(greetings[1], "421") {
+		t.Errorf("Connecting twice with a limit of 1 => want 220 then 421, got %q", greetings)
+	}
+}
+
+func TestSMTPServerStartTLS(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	certSrv := httptest.NewTLSServer(nil)
+	defer certSrv.Close()
+	delivered := make(chan string, 1)
+	s := emailService{Domains: []string{"example.com"}}
+	srv := &smtpServer{
+		hostname:        "test",
+		maxSize:         1024,
+		maxConns:        10,
+		tlsConfig:       certSrv.TLS,
+		acceptRecipient: s.acceptRecipient,
+		deliver: func(from string, to []string, data []byte) error {
+			delivered <- string(data)
+			return nil
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go srv.serve(ctx, l)
+
+	c, err := smtp.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); !ok {
+		t.Fatal("EHLO => want STARTTLS offered")
+	}
+	if err = c.StartTLS(&tls.Config{InsecureSkipVerify: true}); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		t.Error("EHLO over TLS => want STARTTLS not offered again")
+	}
+	if err = c.Mail("bob@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Rcpt("alerts@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(w, "Subject: Hi\r\n\r\nHello\r\n")
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-delivered; got != "Subject: Hi\n\nHello\n" {
+		t.Errorf("SMTP delivery over TLS => want the email, got %q", got)
+	}
+}
+
+func TestAcceptRecipient(t *testing.T) {
+	s := emailService{Domains: []string{"example.com"}}
+	if !s.acceptRecipient("a+b@EXAMPLE.com") || s.acceptRecipient("a@example.net") {
+		t.Error("acceptRecipient => want only addresses at example.com accepted")
+	}
+	s.Domains = nil
+	if s.acceptRecipient("a@example.com") {
+		t.Error("acceptRecipient with no Domains => want every address refused")
+	}
+}
+
+func TestPollGivesUpOnFailingEmails(t *testing.T) {
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(403)
+		w.Write([]byte(`{"errcode":"M_FORBIDDEN","error":"Not in room"}`))
+	}))
+	defer hs.Close()
+	hsURL, _ := url.Parse(hs.URL)
+	cli := matrix.NewClient(hsURL, "token", "@neb:x")
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	body := "Subject: Hi\r\n\r\nHello\r\n"
+	stored := make(chan bool, maxSendAttempts)
+	go func() {
+		for {
+			conn, acceptErr := l.Accept()
+			if acceptErr != nil {
+				return
+			}
+			fmt.Fprint(conn, "* OK IMAP ready\r\n")
+			r := bufio.NewReader(conn)
+			markedSeen := false
+			for {
+				line, readErr := r.ReadString('\n')
+				if readErr != nil {
+					break
+				}
+				fields := strings.SplitN(strings.TrimSpace(line), " ", 2)
+				tag, cmd := fields[0], fields[1]
+				switch {
+				case cmd == "UID SEARCH UNSEEN":
+					fmt.Fprint(conn, "* SEARCH 7\r\n")
+				case cmd == "UID FETCH 7 BODY.PEEK[]":
+					fmt.Fprintf(conn, "* 1 FETCH (UID 7 BODY[] {%d}\r\n%s)\r\n", len(body), body)
+				case strings.HasPrefix(cmd, "UID STORE 7"):
+					markedSeen = true
+				}
+				fmt.Fprintf(conn, "%s OK Done\r\n", tag)
+			}
+			conn.Close()
+			stored <- markedSeen
+		}
+	}()
+
+	s := emailService{
+		id:            "email",
+		IMAPAddress:   l.Addr().String(),
+		IMAPPlaintext: true,
+		IMAPUsername:  "neb",
+		IMAPPassword:  secrets.New("pw"),
+		Rooms:         map[string]emailRoom{"!r:x": {}},
+	}
+	for i := 1; i <= maxSendAttempts; i++ {
+		if err = s.poll(cli); err != nil {
+			t.Fatal(err)
+		}
+		if markedSeen := <-stored; markedSeen != (i == maxSendAttempts) {
+			t.Errorf("poll %d of an email which fails to send => want marked read %t, got %t", i, i == maxSendAttempts, markedSeen)
+		}
+	}
+}
+
+func TestParsePath(t *testing.T) {
+	for _, test := range []struct {
+		arg  string
+		addr string
+		ok   bool
+	}{
+		{"FROM:<bob@example.com> SIZE=10", "bob@example.com", true},
+		{"from: <bob@example.com>", "bob@example.com", true},
+		{"FROM:<>", "", true},
+		{"FROM:bob@example.com", "", false},
+		{"TO:<bob@example.com>", "", false},
+	} {
+		addr, ok := parsePath(test.arg, "FROM:")
+		if addr != test.addr || ok != test.ok {
+			t.Errorf("parsePath(%q) => want %q, %v got %q, %v", test.arg, test.addr, test.ok, addr, ok)
+		}
+	}
+}
+
+// serveIMAP plays an IMAP server with one unread email, with the body, to the client on the
+// connection until it disconnects. Returns the commands the client sent.
+func serveIMAP(conn net.Conn, body string) []string {
+	defer conn.Close()
+	var commands []string
+	fmt.Fprint(conn, "* OK IMAP ready\r\n")
+	r := bufio.NewReader(conn)
+	for {
+		line, readErr := r.ReadString('\n')
+		if readErr != nil {
+			return commands
+		}
+		fields := strings.SplitN(strings.TrimSpace(line), " ", 2)
+		tag, cmd := fields[0], fields[1]
+		commands = append(commands, cmd)
+		switch {
+		case strings.HasPrefix(cmd, "LOGIN") && cmd != `LOGIN "neb" "p\"w"`:
+			fmt.Fprintf(conn, "%s NO Bad password\r\n", tag)
+			continue
+		case cmd == "UID SEARCH UNSEEN":
+			fmt.Fprint(conn, "* SEARCH 4 7\r\n")
+		case cmd == "UID FETCH 7 BODY.PEEK[]":
+			fmt.Fprintf(conn, "* 2 FETCH (UID 7 BODY[] {%d}\r\n%s)\r\n", len(body), body)
+		}
+		fmt.Fprintf(conn, "%s OK Done\r\n", tag)
+	}
+}
+
+// useIMAPConn logs in to the IMAP server at the address, fetches the unread email, which must
+// have the body, and marks it as seen.
+func useIMAPConn(t *testing.T, addr, body string) {
+	c, err := dialIMAP(addr, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.login("neb", "wrong"); err == nil || err.Error() != "IMAP LOGIN failed: NO Bad password" {
+		t.Errorf("login with a bad password => want an error, got %v", err)
+	}
+	if err = c.login("neb", `p"w`); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.selectMailbox("INBOX"); err != nil {
+		t.Fatal(err)
+	}
+	uids, err := c.searchUnseen()
+	if err != nil || !reflect.DeepEqual(uids, []uint32{4, 7}) {
+		t.Errorf("searchUnseen => want [4 7], got %v, %v", uids, err)
+	}
+	raw, err := c.fetch(7)
+	if err != nil || string(raw) != body {
+		t.Errorf("fetch => want %q, got %q, %v", body, raw, err)
+	}
+	if err = c.markSeen(7); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+func TestIMAPConn(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	body := "Subject: Hi\r\n\r\nHello\r\n"
+	var commands []string
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, acceptErr := l.Accept()
+		if acceptErr != nil {
+			return
+		}
+		commands = serveIMAP(conn, body)
+	}()
+
+	useIMAPConn(t, l.Addr().String(), body)
+	<-done
+	want := []string{`LOGIN "neb" "wrong"`, `LOGIN "neb" "p\"w"`, `SELECT "INBOX"`, "UID SEARCH UNSEEN",
+		"UID FETCH 7 BODY.PEEK[]", `UID STORE 7 +FLAGS.SILENT (\Seen)`, "LOGOUT"}
+	if !reflect.DeepEqual(commands, want) {
+		t.Errorf("IMAP commands => want %q got %q", want, commands)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	var s emailService
+	if err := json.Unmarshal([]byte(`{
+		"IMAPAddress": "imap.example.com",
+		"IMAPUsername": "neb",
+		"PollInterval": "10s",
+		"Rooms": {"nope": {"Tags": ["ops", "a@b"]}, "!r:x": {"Subject": "("}}
+	}`), &s); err != nil {
+		t.Fatal(err)
+	}
+	var fields []string
+	for _, e := range s.ValidateConfig() {
+		fields = append(fields, e.Field)
+	}
+	want := "IMAPAddress IMAPPassword PollInterval Rooms[!r:x].Subject Rooms[nope] Rooms[nope].Tags[1]"
+	if got := strings.Join(fields, " "); got != want {
+		t.Errorf("ValidateConfig fields => want %q got %q", want, got)
+	}
+	s = emailService{ListenAddress: ":2525", Rooms: map[string]emailRoom{"!r:x": {}}}
+	if errs := s.ValidateConfig(); len(errs) != 1 || errs[0].Field != "Domains" {
+		t.Errorf("ValidateConfig of an SMTP config without Domains => want a Domains error, got %+v", errs)
+	}
+	s.Domains = []string{"example.com"}
+	if errs := s.ValidateConfig(); len(errs) != 0 {
+		t.Errorf("ValidateConfig of an SMTP config => want no errors, got %+v", errs)
+	}
+	s.IMAPAddress = "imap.example.com:993"
+	if errs := s.ValidateConfig(); len(errs) != 1 || errs[0].Field != "IMAPAddress" {
+		t.Errorf("ValidateConfig with both => want an IMAPAddress error, got %+v", errs)
+	}
+}
@@ -0,0 +1,186 @@
+package services
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// imapTimeout is how long the IMAP server may take to respond to each command.
+const imapTimeout = time.Minute
+
+// literalRegex matches the length of a literal which ends a line of an IMAP response, e.g. "{1234}".
+var literalRegex = regexp.MustCompile(`\{(\d+)\}$`)
+
+// imapConn is a connection to an IMAP server. It knows only the few commands needed to fetch
+// unread emails and mark them read.
+type imapConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	tag  int
+}
+
+// An imapResponse is an untagged response line, with the literals it contained.
+type imapResponse struct {
+	Line     string
+	Literals [][]byte
+}
+
+// dialIMAP connects to the IMAP server at the address, e.g. "imap.example.com:993", using implicit
+// TLS unless plaintext is true.
+func dialIMAP(addr string, plaintext bool) (*imapConn, error) {
+	dialer := &net.Dialer{Timeout: imapTimeout}
+	var conn net.Conn
+	var err error
+	if plaintext {
+		conn, err = dialer.Dial("tcp", addr)
+	} else {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &imapConn{conn: conn, r: bufio.NewReader(conn)}
+	conn.SetDeadline(time.Now().Add(imapTimeout))
+	greeting, err := c.readLine()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !strings.HasPrefix(greeting, "* OK") && !strings.HasPrefix(greeting, "* PREAUTH") {
+		conn.Close()
+		return nil, fmt.Errorf("Unexpected IMAP greeting: %s", greeting)
+	}
+	return c, nil
+}
+
+// Close logs out and closes the connection.
+func (c *imapConn) Close() error {
+	c.command("LOGOUT")
+	return c.conn.Close()
+}
+
+// login logs in with a username and password.
+func (c *imapConn) login(username, password string) error {
+	_, err := c.command("LOGIN " + quote(username) + " " + quote(password))
+	return err
+}
+
+// selectMailbox opens the mailbox, e.g. "INBOX".
+func (c *imapConn) selectMailbox(mailbox string) error {
+	_, err := c.command("SELECT " + quote(mailbox))
+	return err
+}
+
+// searchUnseen returns the UIDs of the unread emails in the mailbox.
+func (c *imapConn) searchUnseen() ([]uint32, error) {
+	responses, err := c.command("UID SEARCH UNSEEN")
+	if err != nil {
+		return nil, err
+	}
+	var uids []uint32
+	for _, res := range responses {
+		if !strings.HasPrefix(res.Line, "* SEARCH") {
+			continue
+		}
+		for _, field := range strings.Fields(strings.TrimPrefix(res.Line, "* SEARCH")) {
+			if uid, err := strconv.ParseUint(field, 10, 32); err == nil {
+				uids = append(uids, uint32(uid))
+			}
+		}
+	}
+	return uids, nil
+}
+
+// fetch returns the whole of the email with the UID, without marking it read.
+func (c *imapConn) fetch(uid uint32) ([]byte, error) {
+	responses, err := c.command(fmt.Sprintf("UID FETCH %d BODY.PEEK[]", uid))
+	if err != nil {
+		return nil, err
+	}
+	for _, res := range responses {
+		if strings.Contains(res.Line, " FETCH ") && len(res.Literals) > 0 {
+			return res.Literals[0], nil
+		}
+	}
+	return nil, fmt.Errorf("The IMAP server did not return email %d", uid)
+}
+
+// markSeen marks the email with the UID as read.
+func (c *imapConn) markSeen(uid uint32) error {
+	_, err := c.command(fmt.Sprintf(`UID STORE %d +FLAGS.SILENT (\Seen)`, uid))
+	return err
+}
+
+// command sends the command and returns the untagged responses to it. Returns an error if the
+// server doesn't respond OK.
+func (c *imapConn) command(cmd string) ([]imapResponse, error) {
+	c.tag++
+	tag := fmt.Sprintf("a%d", c.tag)
+	c.conn.SetDeadline(time.Now().Add(imapTimeout))
+	if _, err := io.WriteString(c.conn, tag+" "+cmd+"\r\n"); err != nil {
+		return nil, err
+	}
+	var responses []imapResponse
+	for {
+		res, err := c.readResponse()
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(res.Line, tag+" ") {
+			responses = append(responses, *res)
+			continue
+		}
+		status := strings.TrimPrefix(res.Line, tag+" ")
+		if !strings.HasPrefix(status, "OK") {
+			// Don't echo the command, which may hold a password.
+			return nil, fmt.Errorf("IMAP %s failed: %s", strings.SplitN(cmd, " ", 2)[0], status)
+		}
+		return responses, nil
+	}
+}
+
+// readResponse reads a response line, and the literals it holds, which the line continues after.
+func (c *imapConn) readResponse() (*imapResponse, error) {
+	res := &imapResponse{}
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return nil, err
+		}
+		res.Line += line
+		m := literalRegex.FindStringSubmatch(line)
+		if m == nil {
+			return res, nil
+		}
+		n, err := strconv.Atoi(m[1])
+		if err != nil || n > maxEmailSize {
+			return nil, errors.New("IMAP literal is too large")
+		}
+		literal := make([]byte, n)
+		if _, err = io.ReadFull(c.r, literal); err != nil {
+			return nil, err
+		}
+		res.Literals = append(res.Literals, literal)
+	}
+}
+
+func (c *imapConn) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// quote makes the string an IMAP quoted string.
+func quote(s string) string {
+	return `"` + strings.Replace(strings.Replace(s, `\`, `\\`, -1), `"`, `\"`, -1) + `"`
+}
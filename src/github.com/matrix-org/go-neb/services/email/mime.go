@@ -0,0 +1,201 @@
+package services
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/matrix-org/go-neb/matrix"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// maxParts is how many MIME parts an email may have, so that a deeply nested email can't be used
+// to make Go-NEB do lots of work.
+const maxParts = 100
+
+// An email, as it is sent into rooms.
+type email struct {
+	MessageID string
+	From      string
+	Subject   string
+	// To are the addresses the email was sent to: the SMTP recipients, or the addressees in its
+	// headers if it was fetched from a mailbox.
+	To          []string
+	Text        string
+	Attachments []attachment
+}
+
+type attachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+var headerDecoder = &mime.WordDecoder{CharsetReader: charsetReader}
+
+// parseEmail reads an email in RFC 5322 format. Its text is taken from its first text/plain part,
+// or else its first text/html part with the tags stripped. Other parts with a filename, or which
+// aren't text, are attachments, up to maxAttachments of them.
+func parseEmail(raw []byte) (*email, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	e := &email{
+		MessageID: strings.Trim(strings.TrimSpace(msg.Header.Get("Message-Id")), "<>"),
+		From:      decodeHeader(msg.Header.Get("From")),
+		Subject:   decodeHeader(msg.Header.Get("Subject")),
+	}
+	for _, field := range []string{"To", "Cc", "Delivered-To", "X-Original-To"} {
+		if msg.Header.Get(field) == "" {
+			continue
+		}
+		addrs, addrErr := msg.Header.AddressList(field)
+		if addrErr != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			e.To = append(e.To, addr.Address)
+		}
+	}
+	p := &partWalker{email: e}
+	if err = p.walk(textproto.MIMEHeader(msg.Header), msg.Body, 0); err != nil {
+		return nil, err
+	}
+	if p.text != "" {
+		e.Text = p.text
+	} else if p.html != "" {
+		e.Text = matrix.HTMLToText(p.html)
+	}
+	e.Text = strings.TrimSpace(strings.Replace(e.Text, "\r\n", "\n", -1))
+	return e, nil
+}
+
+// partWalker walks an email's MIME parts, collecting its text and attachments.
+type partWalker struct {
+	email *email
+	text  string
+	html  string
+	parts int
+}
+
+func (p *partWalker) walk(header textproto.MIMEHeader, body io.Reader, depth int) error {
+	if p.parts++; p.parts > maxParts || depth > 10 {
+		return errors.New("The email has too many parts")
+	}
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		return p.walkMultipart(multipart.NewReader(body, params["boundary"]), depth)
+	}
+	data, err := ioutil.ReadAll(decodeTransfer(header.Get("Content-Transfer-Encoding"), body))
+	if err != nil {
+		return fmt.Errorf("Failed to decode part: %s", err)
+	}
+	disposition, dispParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	filename := dispParams["filename"]
+	if filename == "" {
+		filename = params["name"]
+	}
+	filename = decodeHeader(filename)
+	isText := mediaType == "text/plain" || mediaType == "text/html"
+	if isText && disposition != "attachment" && filename == "" {
+		p.addText(mediaType, toUTF8(params["charset"], data))
+		return nil
+	}
+	p.addAttachment(filename, mediaType, data)
+	return nil
+}
+
+// walkMultipart walks each part of a multipart part at the depth.
+func (p *partWalker) walkMultipart(mr *multipart.Reader, depth int) error {
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = p.walk(part.Header, part, depth+1); err != nil {
+			return err
+		}
+	}
+}
+
+// addText keeps the email's first plain text and first HTML.
+func (p *partWalker) addText(mediaType, text string) {
+	if mediaType == "text/plain" && p.text == "" {
+		p.text = text
+	} else if mediaType == "text/html" && p.html == "" {
+		p.html = text
+	}
+}
+
+// addAttachment adds a non-empty attachment to the email, unless it has as many as are uploaded.
+func (p *partWalker) addAttachment(filename, mediaType string, data []byte) {
+	if len(p.email.Attachments) >= maxAttachments || len(data) == 0 {
+		return
+	}
+	if filename == "" {
+		filename = "attachment"
+	}
+	p.email.Attachments = append(p.email.Attachments, attachment{filename, mediaType, data})
+}
+
+// decodeTransfer decodes a part's content transfer encoding. Parts of multipart emails with the
+// quoted-printable encoding have already been decoded by the multipart reader.
+func decodeTransfer(encoding string, body io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		return quotedprintable.NewReader(body)
+	}
+	return body
+}
+
+// decodeHeader decodes RFC 2047 encoded words in the header, e.g. "=?utf-8?q?caf=C3=A9?=".
+func decodeHeader(s string) string {
+	decoded, err := headerDecoder.DecodeHeader(s)
+	if err != nil {
+		return s
+	}
+	return decoded
+}
+
+// charsetReader converts the charsets which aren't UTF-8 but are common in headers.
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	data, err := ioutil.ReadAll(input)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(charset) {
+	case "iso-8859-1", "latin1", "windows-1252", "us-ascii":
+		return strings.NewReader(toUTF8(charset, data)), nil
+	}
+	return nil, fmt.Errorf("Unsupported charset %s", charset)
+}
+
+// toUTF8 converts text in the charset to UTF-8. Latin-1 is converted, and anything else is assumed
+// to be UTF-8 already.
+func toUTF8(charset string, data []byte) string {
+	switch strings.ToLower(charset) {
+	case "iso-8859-1", "latin1", "windows-1252":
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+		}
+		return string(runes)
+	}
+	return string(data)
+}
@@ -0,0 +1,272 @@
+package services
+
+import (
+	"crypto/tls"
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/server"
+	"golang.org/x/net/context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// commandTimeout is how long an SMTP client may take to send each command, or an email's data.
+const commandTimeout = 5 * time.Minute
+
+// sessionTimeout is how long an SMTP client may stay connected, however quickly it sends commands.
+const sessionTimeout = 30 * time.Minute
+
+// maxRecipients is how many recipients an email may have, as RFC 5321 requires servers to allow.
+const maxRecipients = 100
+
+// maxConnections is how many SMTP clients may be connected at once. Others are told to try again
+// later.
+const maxConnections = 100
+
+// smtpServer receives emails by SMTP. It doesn't relay them anywhere or support authentication:
+// it only takes emails to hand to deliver.
+type smtpServer struct {
+	hostname string
+	maxSize  int64
+	maxConns int
+	allowed  *server.Allowlist
+	// tlsConfig, if set, is offered to clients with STARTTLS.
+	tlsConfig *tls.Config
+	// acceptRecipient returns true if emails to the address are wanted.
+	acceptRecipient func(addr string) bool
+	// deliver handles a received email. If it returns an error, the client is told to try again
+	// later.
+	deliver func(from string, to []string, data []byte) error
+}
+
+// serve accepts connections on the listener until the context is cancelled.
+func (s *smtpServer) serve(ctx context.Context, l net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	conns := make(chan struct{}, s.maxConns)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		select {
+		case conns <- struct{}{}:
+			go func() {
+				defer func() { <-conns }()
+				s.handle(conn)
+			}()
+		default:
+			conn.SetDeadline(time.Now().Add(time.Second))
+			textproto.NewConn(conn).PrintfLine("421 %s Too many connections, try again later", s.hostname)
+			conn.Close()
+		}
+	}
+}
+
+// smtpSession is the state of a connection to an SMTP client.
+type smtpSession struct {
+	*smtpServer
+	conn   net.Conn
+	tp     *textproto.Conn
+	logger *log.Entry
+	// The envelope of the email being received.
+	from          string
+	to            []string
+	inTransaction bool
+}
+
+// smtpCommands handles each SMTP command, given its argument. Each returns false if the
+// connection should be closed.
+var smtpCommands = map[string]func(c *smtpSession, arg string) bool{
+	"HELO":     (*smtpSession).helo,
+	"EHLO":     (*smtpSession).ehlo,
+	"STARTTLS": (*smtpSession).startTLS,
+	"MAIL":     (*smtpSession).mail,
+	"RCPT":     (*smtpSession).rcpt,
+	"DATA":     (*smtpSession).data,
+	"RSET":     (*smtpSession).rset,
+	"NOOP":     (*smtpSession).noop,
+	"VRFY":     (*smtpSession).vrfy,
+	"QUIT":     (*smtpSession).quit,
+}
+
+// handle speaks SMTP to the client until it quits, or has been connected for sessionTimeout.
+func (s *smtpServer) handle(conn net.Conn) {
+	c := &smtpSession{
+		smtpServer: s,
+		conn:       conn,
+		tp:         textproto.NewConn(conn),
+		logger:     log.WithField("remote_addr", conn.RemoteAddr().String()),
+	}
+	defer func() { c.conn.Close() }()
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	if !s.allowed.Allows(host) {
+		c.logger.Print("Refused SMTP connection from an address which isn't allowed")
+		c.tp.PrintfLine("554 %s Not allowed", s.hostname)
+		return
+	}
+	c.tp.PrintfLine("220 %s ESMTP Go-NEB", s.hostname)
+	sessionEnd := time.Now().Add(sessionTimeout)
+	for {
+		deadline := time.Now().Add(commandTimeout)
+		if deadline.After(sessionEnd) {
+			deadline = sessionEnd
+		}
+		c.conn.SetDeadline(deadline)
+		line, err := c.tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			verb, arg = line[:i], strings.TrimSpace(line[i+1:])
+		}
+		command, ok := smtpCommands[strings.ToUpper(verb)]
+		if !ok {
+			c.tp.PrintfLine("502 Command not implemented")
+			continue
+		}
+		if !command(c, arg) {
+			return
+		}
+	}
+}
+
+// reset forgets the email being received.
+func (c *smtpSession) reset() {
+	c.from, c.to, c.inTransaction = "", nil, false
+}
+
+func (c *smtpSession) helo(arg string) bool {
+	c.reset()
+	c.tp.PrintfLine("250 %s", c.hostname)
+	return true
+}
+
+func (c *smtpSession) ehlo(arg string) bool {
+	c.reset()
+	c.tp.PrintfLine("250-%s", c.hostname)
+	c.tp.PrintfLine("250-SIZE %d", c.maxSize)
+	if _, isTLS := c.conn.(*tls.Conn); c.tlsConfig != nil && !isTLS {
+		c.tp.PrintfLine("250-STARTTLS")
+	}
+	c.tp.PrintfLine("250 8BITMIME")
+	return true
+}
+
+func (c *smtpSession) startTLS(arg string) bool {
+	if _, isTLS := c.conn.(*tls.Conn); c.tlsConfig == nil || isTLS {
+		c.tp.PrintfLine("502 Command not implemented")
+		return true
+	}
+	c.tp.PrintfLine("220 Ready to start TLS")
+	tlsConn := tls.Server(c.conn, c.tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		c.logger.WithError(err).Print("SMTP TLS handshake failed")
+		return false
+	}
+	// The client starts again, forgetting everything said before TLS.
+	c.conn = tlsConn
+	c.tp = textproto.NewConn(tlsConn)
+	c.reset()
+	return true
+}
+
+func (c *smtpSession) mail(arg string) bool {
+	addr, ok := parsePath(arg, "FROM:")
+	if !ok {
+		c.tp.PrintfLine("501 Syntax: MAIL FROM:<address>")
+		return true
+	}
+	c.reset()
+	c.from, c.inTransaction = addr, true
+	c.tp.PrintfLine("250 OK")
+	return true
+}
+
+func (c *smtpSession) rcpt(arg string) bool {
+	addr, ok := parsePath(arg, "TO:")
+	switch {
+	case !c.inTransaction:
+		c.tp.PrintfLine("503 MAIL first")
+	case !ok || addr == "":
+		c.tp.PrintfLine("501 Syntax: RCPT TO:<address>")
+	case len(c.to) >= maxRecipients:
+		c.tp.PrintfLine("452 Too many recipients")
+	case !c.acceptRecipient(addr):
+		c.tp.PrintfLine("550 No such mailbox")
+	default:
+		c.to = append(c.to, addr)
+		c.tp.PrintfLine("250 OK")
+	}
+	return true
+}
+
+func (c *smtpSession) data(arg string) bool {
+	if len(c.to) == 0 {
+		c.tp.PrintfLine("503 RCPT first")
+		return true
+	}
+	c.tp.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+	dr := c.tp.DotReader()
+	data, err := ioutil.ReadAll(io.LimitReader(dr, c.maxSize+1))
+	if err != nil {
+		return false
+	}
+	defer c.reset()
+	if int64(len(data)) > c.maxSize {
+		io.Copy(ioutil.Discard, dr)
+		c.tp.PrintfLine("552 Message exceeds the maximum size")
+		return true
+	}
+	if err = c.deliver(c.from, c.to, data); err != nil {
+		c.logger.WithError(err).Warn("Failed to deliver email")
+		c.tp.PrintfLine("451 Failed to deliver the message, try again later")
+	} else {
+		c.tp.PrintfLine("250 OK")
+	}
+	return true
+}
+
+func (c *smtpSession) rset(arg string) bool {
+	c.reset()
+	c.tp.PrintfLine("250 OK")
+	return true
+}
+
+func (c *smtpSession) noop(arg string) bool {
+	c.tp.PrintfLine("250 OK")
+	return true
+}
+
+func (c *smtpSession) vrfy(arg string) bool {
+	c.tp.PrintfLine("252 Cannot verify addresses")
+	return true
+}
+
+func (c *smtpSession) quit(arg string) bool {
+	c.tp.PrintfLine("221 %s Bye", c.hostname)
+	return false
+}
+
+// parsePath parses the address from the argument of a MAIL or RCPT command, e.g.
+// "FROM:<alice@example.com> SIZE=1024". The null path, "<>", is an empty address.
+func parsePath(arg, prefix string) (string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", false
+	}
+	arg = strings.TrimSpace(arg[len(prefix):])
+	end := strings.IndexByte(arg, '>')
+	if !strings.HasPrefix(arg, "<") || end < 0 {
+		return "", false
+	}
+	return arg[1:end], true
+}
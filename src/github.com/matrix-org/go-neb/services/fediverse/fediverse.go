@@ -0,0 +1,396 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/plugin"
+	"github.com/matrix-org/go-neb/secrets"
+	"github.com/matrix-org/go-neb/streams"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/go-neb/util"
+	"golang.org/x/net/context"
+	"html"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mirroredPostTTL is how long a mirrored post is remembered, so that it isn't mirrored again when
+// it arrives on another stream or after a reconnection.
+const mirroredPostTTL = 30 * 24 * time.Hour
+
+// maxAttachments is how many of a post's attachments are uploaded. Mastodon allows 4.
+const maxAttachments = 4
+
+var (
+	accountRegex = regexp.MustCompile(`^@?[A-Za-z0-9_.\-]+(@[A-Za-z0-9.\-]+)?$`)
+	hashtagRegex = regexp.MustCompile(`^#?[\pL\pN_]+$`)
+)
+
+// attachmentMsgTypes are the msgtypes attachments of each type are sent as. Others are linked to.
+var attachmentMsgTypes = map[string]string{
+	"image": "m.image",
+	"gifv":  "m.video",
+	"video": "m.video",
+	"audio": "m.audio",
+}
+
+// mirrorMutex is held whilst a post is checked and marked as mirrored, so that a post arriving on
+// two streams at once is only mirrored once.
+var mirrorMutex sync.Mutex
+
+// A feed is what is mirrored into a room.
+type feed struct {
+	// Accounts are the accounts whose posts are mirrored, e.g. "Gargron@mastodon.social", or just
+	// "Gargron" for accounts on InstanceURL.
+	Accounts []string
+	// Hashtags are the hashtags whose posts are mirrored, e.g. "matrix".
+	Hashtags []string
+}
+
+type fediverseService struct {
+	id            string
+	serviceUserID string
+	// InstanceURL is the Mastodon server whose streaming API posts are read from, e.g.
+	// "https://mastodon.social".
+	InstanceURL string
+	// AccessToken is a token for an account on the instance, with the "read" and "write:follows"
+	// scopes. The account follows the Accounts, so that their posts are streamed to it. Required if
+	// any room has Accounts, or if the instance doesn't stream hashtags without one.
+	AccessToken secrets.Secret
+	// Rooms maps room IDs to the feeds mirrored into them.
+	Rooms map[string]feed
+}
+
+func (s *fediverseService) ServiceUserID() string { return s.serviceUserID }
+func (s *fediverseService) ServiceID() string     { return s.id }
+func (s *fediverseService) ServiceType() string   { return "fediverse" }
+func (s *fediverseService) Plugin(cli *matrix.Client, roomID string) plugin.Plugin {
+	return plugin.Plugin{}
+}
+func (s *fediverseService) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli *matrix.Client) {
+	w.WriteHeader(200) // Do nothing
+}
+
+// ValidateConfig checks that the instance URL is an http or https URL, and that each room has
+// valid accounts or hashtags to mirror.
+func (s *fediverseService) ValidateConfig() []types.ConfigError {
+	var errs []types.ConfigError
+	if !types.IsHTTPURL(s.InstanceURL) {
+		errs = append(errs, types.ConfigError{Field: "InstanceURL", Message: "must be an http or https URL"})
+	}
+	if len(s.Rooms) == 0 {
+		errs = append(errs, types.ConfigError{Field: "Rooms", Message: "must have at least one room"})
+	}
+	if len(s.accounts()) > 0 && s.AccessToken.Value() == "" {
+		errs = append(errs, types.ConfigError{Field: "AccessToken", Message: "is required to follow accounts"})
+	}
+	return append(errs, s.validateRooms()...)
+}
+
+// validateRooms checks that every room ID in Rooms is well formed, and that each room has valid
+// accounts or hashtags to mirror.
+func (s *fediverseService) validateRooms() []types.ConfigError {
+	var errs []types.ConfigError
+	for _, roomID := range util.SortedKeys(s.Rooms) {
+		field := fmt.Sprintf("Rooms[%s]", roomID)
+		f := s.Rooms[roomID]
+		if !types.IsRoomID(roomID) {
+			errs = append(errs, types.ConfigError{Field: field, Message: "is not a room ID"})
+		}
+		if len(f.Accounts) == 0 && len(f.Hashtags) == 0 {
+			errs = append(errs, types.ConfigError{Field: field, Message: "must have Accounts or Hashtags"})
+		}
+		for i, acct := range f.Accounts {
+			if !accountRegex.MatchString(acct) {
+				errs = append(errs, types.ConfigError{Field: fmt.Sprintf("%s.Accounts[%d]", field, i), Message: "is not an account, e.g. user@example.com"})
+			}
+		}
+		for i, tag := range f.Hashtags {
+			if !hashtagRegex.MatchString(tag) {
+				errs = append(errs, types.ConfigError{Field: fmt.Sprintf("%s.Hashtags[%d]", field, i), Message: "is not a hashtag"})
+			}
+		}
+	}
+	return errs
+}
+
+// accounts returns the accounts followed in any room, normalised, sorted and without duplicates.
+func (s *fediverseService) accounts() []string {
+	return s.collect(func(f feed) []string { return f.Accounts }, s.normaliseAccount)
+}
+
+// hashtags returns the hashtags followed in any room, normalised, sorted and without duplicates.
+func (s *fediverseService) hashtags() []string {
+	return s.collect(func(f feed) []string { return f.Hashtags }, normaliseHashtag)
+}
+
+func (s *fediverseService) collect(field func(f feed) []string, normalise func(string) string) []string {
+	seen := make(map[string]bool)
+	var values []string
+	for _, f := range s.Rooms {
+		for _, v := range field(f) {
+			if v = normalise(v); !seen[v] {
+				seen[v] = true
+				values = append(values, v)
+			}
+		}
+	}
+	sort.Strings(values)
+	return values
+}
+
+// normaliseAccount returns the account as "user@domain", in lower case, including the domain of
+// accounts on the instance.
+func (s *fediverseService) normaliseAccount(acct string) string {
+	acct = strings.ToLower(strings.TrimPrefix(acct, "@"))
+	if !strings.Contains(acct, "@") {
+		if u, err := url.Parse(s.InstanceURL); err == nil {
+			acct += "@" + strings.ToLower(u.Host)
+		}
+	}
+	return acct
+}
+
+func normaliseHashtag(tag string) string {
+	return strings.ToLower(strings.TrimPrefix(tag, "#"))
+}
+
+// Register joins the rooms and follows the accounts, so that their posts are streamed.
+func (s *fediverseService) Register(oldService types.Service, client *matrix.Client) error {
+	for _, roomID := range util.SortedKeys(s.Rooms) {
+		if _, err := client.JoinRoom(roomID, "", ""); err != nil {
+			return err
+		}
+	}
+	ctx := context.Background()
+	for _, acct := range s.accounts() {
+		a, err := s.lookupAccount(ctx, acct)
+		if err != nil {
+			return fmt.Errorf("Failed to find account %s: %s", acct, err)
+		}
+		if err = s.follow(ctx, a.ID); err != nil {
+			return fmt.Errorf("Failed to follow account %s: %s", acct, err)
+		}
+	}
+	return nil
+}
+
+// PlanRegister works out which rooms Register would join and which accounts it would follow. It
+// only reads from the instance.
+func (s *fediverseService) PlanRegister(oldService types.Service, client *matrix.Client) (*types.RegisterPlan, error) {
+	plan := &types.RegisterPlan{JoinRooms: types.PlanJoinRooms(client, util.SortedKeys(s.Rooms))}
+	ctx := context.Background()
+	for _, acct := range s.accounts() {
+		following, err := s.following(ctx, acct)
+		if err != nil {
+			return nil, err
+		}
+		if !following {
+			plan.Notes = append(plan.Notes, "The service's account would follow "+acct)
+		}
+	}
+	return plan, nil
+}
+
+// CheckRegistered checks that the service's client is still in each room, and that the service's
+// account still follows each account, as posts by accounts it doesn't follow aren't streamed.
+func (s *fediverseService) CheckRegistered(client *matrix.Client) ([]string, error) {
+	problems := types.CheckJoinedRooms(client, util.SortedKeys(s.Rooms))
+	ctx := context.Background()
+	for _, acct := range s.accounts() {
+		following, err := s.following(ctx, acct)
+		if err != nil {
+			problems = append(problems, err.Error())
+		} else if !following {
+			problems = append(problems, "The service's account doesn't follow "+acct)
+		}
+	}
+	return problems, nil
+}
+
+// following returns true if the service's account follows the account, e.g. "user@example.com".
+func (s *fediverseService) following(ctx context.Context, acct string) (bool, error) {
+	a, err := s.lookupAccount(ctx, acct)
+	if err != nil {
+		return false, fmt.Errorf("Failed to find account %s: %s", acct, err)
+	}
+	following, err := s.isFollowing(ctx, a.ID)
+	if err != nil {
+		return false, fmt.Errorf("Failed to check whether account %s is followed: %s", acct, err)
+	}
+	return following, nil
+}
+
+// PostRegister starts the service's streams, or restarts them with the new config.
+func (s *fediverseService) PostRegister(oldService types.Service) {
+	streams.Wake()
+}
+
+// Stream reads posts from the home timeline of the service's account, if any accounts are followed,
+// and from the stream of each hashtag, and mirrors them. It returns when any of them fails.
+func (s *fediverseService) Stream(ctx context.Context, cli *matrix.Client) error {
+	if err := database.GetServiceDB().DeleteMirroredPostsBefore(s.id, time.Now().Add(-mirroredPostTTL)); err != nil {
+		log.WithError(err).WithField("service_id", s.id).Warn("Failed to forget old mirrored posts")
+	}
+	var paths []string
+	if len(s.accounts()) > 0 {
+		paths = append(paths, "/api/v1/streaming/user")
+	}
+	for _, tag := range s.hashtags() {
+		paths = append(paths, "/api/v1/streaming/hashtag?tag="+url.QueryEscape(tag))
+	}
+	if len(paths) == 0 {
+		return errors.New("No accounts or hashtags to follow")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errs := make(chan error, len(paths))
+	for _, path := range paths {
+		go func(path string) {
+			errs <- s.readStream(ctx, path, func(st *status) {
+				s.mirror(cli, st)
+			})
+		}(path)
+	}
+	// The first stream to stop stops the others, and all are started again.
+	err := <-errs
+	cancel()
+	for i := 1; i < len(paths); i++ {
+		<-errs
+	}
+	return err
+}
+
+// roomsFor returns the rooms the post should be mirrored into: those following its author or one
+// of its hashtags. Posts which aren't public, and boosts, aren't mirrored.
+func (s *fediverseService) roomsFor(st *status) []string {
+	if st.Reblog != nil || (st.Visibility != "public" && st.Visibility != "unlisted") {
+		return nil
+	}
+	author := s.normaliseAccount(st.Account.Acct)
+	tags := make(map[string]bool)
+	for _, tag := range st.Tags {
+		tags[normaliseHashtag(tag.Name)] = true
+	}
+	var roomIDs []string
+	for _, roomID := range util.SortedKeys(s.Rooms) {
+		f := s.Rooms[roomID]
+		matches := false
+		for _, acct := range f.Accounts {
+			matches = matches || s.normaliseAccount(acct) == author
+		}
+		for _, tag := range f.Hashtags {
+			matches = matches || tags[normaliseHashtag(tag)]
+		}
+		if matches {
+			roomIDs = append(roomIDs, roomID)
+		}
+	}
+	return roomIDs
+}
+
+// mirror sends the post, and its attachments, into each room it should be mirrored into which it
+// hasn't been already.
+func (s *fediverseService) mirror(cli *matrix.Client, st *status) {
+	for _, roomID := range s.roomsFor(st) {
+		logger := log.WithFields(log.Fields{
+			"service_id": s.id,
+			"room_id":    roomID,
+			"post":       st.URI,
+		})
+		mirrorMutex.Lock()
+		marked, err := database.GetServiceDB().MarkPostMirrored(s.id, roomID, st.URI)
+		mirrorMutex.Unlock()
+		if err != nil {
+			logger.WithError(err).Error("Failed to mark post as mirrored")
+			continue
+		}
+		if !marked {
+			continue
+		}
+		if _, err = cli.SendMessageEvent(roomID, "m.room.message", matrix.GetHTMLMessage("m.notice", render(st))); err != nil {
+			logger.WithError(err).Warn("Failed to mirror post")
+			continue
+		}
+		for i, a := range st.MediaAttachments {
+			if i == maxAttachments {
+				break
+			}
+			if err = s.sendAttachment(cli, roomID, a); err != nil {
+				logger.WithError(err).WithField("attachment", a.URL).Warn("Failed to mirror attachment")
+			}
+		}
+	}
+}
+
+// sendAttachment uploads the attachment to the content repository and sends it into the room.
+func (s *fediverseService) sendAttachment(cli *matrix.Client, roomID string, a attachment) error {
+	msgType, ok := attachmentMsgTypes[a.Type]
+	if !ok {
+		return nil // render links to it
+	}
+	mxc, err := cli.UploadLink(a.URL)
+	if err != nil {
+		return err
+	}
+	body := a.Description
+	if body == "" {
+		body = a.Type
+	}
+	var msg interface{}
+	if msgType == "m.image" {
+		msg = matrix.ImageMessage{
+			MsgType: msgType,
+			Body:    body,
+			URL:     mxc,
+			Info:    matrix.ImageInfo{Width: a.Meta.Original.Width, Height: a.Meta.Original.Height},
+		}
+	} else {
+		msg = matrix.FileMessage{MsgType: msgType, Body: body, URL: mxc}
+	}
+	_, err = cli.SendMessageEvent(roomID, "m.room.message", msg)
+	return err
+}
+
+// render formats the post as HTML, with its author and a link to it. A post with a content warning
+// is hidden behind a spoiler.
+func render(st *status) string {
+	name := st.Account.DisplayName
+	if name == "" {
+		name = st.Account.Acct
+	}
+	text := fmt.Sprintf(
+		`<a href="%s">%s</a> (@%s) <a href="%s">posted</a>:<br>`,
+		html.EscapeString(st.Account.URL), html.EscapeString(name), html.EscapeString(st.Account.Acct), html.EscapeString(st.URL),
+	)
+	content := sanitise(st.Content)
+	for _, a := range st.MediaAttachments {
+		if _, ok := attachmentMsgTypes[a.Type]; !ok {
+			content += fmt.Sprintf(`<br><a href="%s">Attachment</a>`, html.EscapeString(a.URL))
+		}
+	}
+	if st.SpoilerText != "" {
+		return text + fmt.Sprintf(
+			`<b>CW: %s</b><br><span data-mx-spoiler="%s">%s</span>`,
+			html.EscapeString(st.SpoilerText), html.EscapeString(st.SpoilerText), content,
+		)
+	}
+	return text + content
+}
+
+func init() {
+	types.RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) types.Service {
+		return &fediverseService{
+			id:            serviceID,
+			serviceUserID: serviceUserID,
+		}
+	})
+}
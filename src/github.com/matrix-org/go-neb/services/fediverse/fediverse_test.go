@@ -0,0 +1,191 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/secrets"
+	"golang.org/x/net/context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSanitise(t *testing.T) {
+	tests := map[string]string{
+		`<p>Hello <a href="https://example.com/@u" class="u-url mention">@<span>u</span></a></p><p>Bye</p>`: `Hello <a href="https://example.com/@u">@u</a><br><br>Bye`,
+		`<p>one<br />two</p>`: `one<br>two`,
+		`<script>alert(1)</script><img src=x onerror="alert(1)">`: `alert(1)`,
+		`<a href="javascript:alert(1)">click</a>`:                 `<a>click</a>`,
+		`&lt;b&gt; stays escaped`:                                 `&lt;b&gt; stays escaped`,
+	}
+	for content, want := range tests {
+		if got := sanitise(content); got != want {
+			t.Errorf("sanitise(%q) => want %q, got %q", content, want, got)
+		}
+	}
+}
+
+func TestRoomsFor(t *testing.T) {
+	var s fediverseService
+	err := json.Unmarshal([]byte(`{
+		"InstanceURL": "https://Example.com",
+		"Rooms": {
+			"!people:x": {"Accounts": ["@Alice", "bob@other.example"]},
+			"!tags:x": {"Hashtags": ["#Matrix"]},
+			"!both:x": {"Accounts": ["alice@example.com"], "Hashtags": ["golang"]}
+		}
+	}`), &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	post := func(acct, visibility string, tags ...string) *status {
+		st := &status{Visibility: visibility, Account: account{Acct: acct}}
+		for _, tag := range tags {
+			st.Tags = append(st.Tags, struct {
+				Name string `json:"name"`
+			}{tag})
+		}
+		return st
+	}
+	tests := []struct {
+		st   *status
+		want []string
+	}{
+		{post("alice", "public"), []string{"!both:x", "!people:x"}},
+		{post("Bob@other.example", "unlisted"), []string{"!people:x"}},
+		{post("carol@other.example", "public", "matrix"), []string{"!tags:x"}},
+		{post("carol@other.example", "public", "GoLang", "matrix"), []string{"!both:x", "!tags:x"}},
+		{post("alice", "private"), nil},
+		{post("alice", "direct", "matrix"), nil},
+		{post("carol@other.example", "public"), nil},
+		{&status{Visibility: "public", Account: account{Acct: "alice"}, Reblog: &status{}}, nil},
+	}
+	for _, test := range tests {
+		if got := s.roomsFor(test.st); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("roomsFor(%s, %s, %v) => want %v, got %v", test.st.Account.Acct, test.st.Visibility, test.st.Tags, test.want, got)
+		}
+	}
+	if want := []string{"alice@example.com", "bob@other.example"}; !reflect.DeepEqual(s.accounts(), want) {
+		t.Errorf("accounts => want %v, got %v", want, s.accounts())
+	}
+	if want := []string{"golang", "matrix"}; !reflect.DeepEqual(s.hashtags(), want) {
+		t.Errorf("hashtags => want %v, got %v", want, s.hashtags())
+	}
+	if errs := s.ValidateConfig(); len(errs) != 1 || errs[0].Field != "AccessToken" {
+		t.Errorf("ValidateConfig with accounts and no token => want an AccessToken error, got %v", errs)
+	}
+}
+
+func TestRender(t *testing.T) {
+	st := &status{
+		URL:         "https://example.com/@alice/1",
+		SpoilerText: "food",
+		Content:     "<p>Cake &amp; tea</p>",
+		Account:     account{Acct: "alice", DisplayName: "Alice <3", URL: "https://example.com/@alice"},
+		MediaAttachments: []attachment{
+			{Type: "image", URL: "https://example.com/cake.png"},
+			{Type: "unknown", URL: "https://example.com/cake.blend"},
+		},
+	}
+	want := `<a href="https://example.com/@alice">Alice &lt;3</a> (@alice) <a href="https://example.com/@alice/1">posted</a>:<br>` +
+		`<b>CW: food</b><br><span data-mx-spoiler="food">Cake &amp; tea<br><a href="https://example.com/cake.blend">Attachment</a></span>`
+	if got := render(st); got != want {
+		t.Errorf("render => want %q, got %q", want, got)
+	}
+}
+
+func TestReadStream(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/api/v1/streaming/hashtag" || req.URL.Query().Get("tag") != "matrix" ||
+			req.URL.Query().Get("access_token") != "token" {
+			w.WriteHeader(401)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, ":)\n\n")
+		fmt.Fprint(w, "event: update\ndata: {\"id\": \"1\",\ndata: \"uri\": \"https://example.com/1\"}\n\n")
+		fmt.Fprint(w, "event: delete\ndata: 1\n\n")
+		fmt.Fprint(w, ":thump\n")
+		fmt.Fprint(w, "event: update\ndata: {\"id\": \"2\", \"uri\": \"https://example.com/2\"}\n\n")
+	}))
+	defer srv.Close()
+
+	var s fediverseService
+	if err := json.Unmarshal([]byte(`{"InstanceURL":"`+srv.URL+`","AccessToken":"token"}`), &s); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := s.readStream(ctx, "/api/v1/streaming/hashtag?tag=matrix", func(st *status) {
+		got = append(got, st.URI)
+	})
+	if err == nil || !strings.Contains(err.Error(), "closed") {
+		t.Errorf("readStream of a stream which ends => want a closed error, got %v", err)
+	}
+	if want := []string{"https://example.com/1", "https://example.com/2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("readStream => want posts %v, got %v", want, got)
+	}
+
+	s.AccessToken = secrets.Secret{}
+	if err = s.readStream(ctx, "/api/v1/streaming/hashtag?tag=matrix", nil); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("readStream without a token => want an HTTP 401 error, got %v", err)
+	}
+}
+
+func TestPlanRegisterHasNoSideEffects(t *testing.T) {
+	var posted []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			posted = append(posted, req.URL.Path)
+		}
+		switch req.URL.Path {
+		case "/_matrix/client/r0/joined_rooms":
+			fmt.Fprint(w, `{"joined_rooms":["!joined:x"]}`)
+		case "/api/v1/accounts/lookup":
+			fmt.Fprintf(w, `{"id":%q}`, req.URL.Query().Get("acct"))
+		case "/api/v1/accounts/relationships":
+			fmt.Fprintf(w, `[{"following":%t}]`, req.URL.Query().Get("id[]") == "followed@example.com")
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer srv.Close()
+	hsURL, _ := url.Parse(srv.URL)
+	cli := matrix.NewClient(hsURL, "token", "@neb:x")
+
+	s := fediverseService{
+		InstanceURL: srv.URL,
+		AccessToken: secrets.New("token"),
+		Rooms: map[string]feed{
+			"!joined:x": {Accounts: []string{"followed@example.com"}},
+			"!new:x":    {Accounts: []string{"new@example.com"}},
+		},
+	}
+	plan, err := s.PlanRegister(nil, cli)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"!new:x"}; !reflect.DeepEqual(plan.JoinRooms, want) {
+		t.Errorf("PlanRegister => want rooms %v joined, got %v", want, plan.JoinRooms)
+	}
+	if want := []string{"The service's account would follow new@example.com"}; !reflect.DeepEqual(plan.Notes, want) {
+		t.Errorf("PlanRegister => want notes %v, got %v", want, plan.Notes)
+	}
+	problems, err := s.CheckRegistered(cli)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"@neb:x is not in room !new:x", "The service's account doesn't follow new@example.com"}
+	if !reflect.DeepEqual(problems, want) {
+		t.Errorf("CheckRegistered => want problems %v, got %v", want, problems)
+	}
+	if len(posted) != 0 {
+		t.Errorf("PlanRegister and CheckRegistered => want no changes made, got requests to %v", posted)
+	}
+}
@@ -0,0 +1,249 @@
+package services
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/matrix-org/go-neb/httpclient"
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// idleTimeout is how long a stream may go without sending anything before it is assumed to have
+// died. Mastodon sends a heartbeat every 15 seconds.
+const idleTimeout = time.Minute
+
+// maxEventSize is the largest server-sent event a stream may send, which holds a post as JSON.
+const maxEventSize = 1024 * 1024
+
+// streamClient has no timeout, as streams stay open, but idleTimeout stops ones which go quiet.
+var streamClient = httpclient.New(0)
+
+var (
+	tagRegex  = regexp.MustCompile(`<(/?)([a-zA-Z0-9]+)([^>]*)>`)
+	hrefRegex = regexp.MustCompile(`\bhref="(https?://[^"]*)"`)
+)
+
+type account struct {
+	ID          string `json:"id"`
+	Acct        string `json:"acct"` // "user" for local accounts, "user@domain" for remote ones
+	DisplayName string `json:"display_name"`
+	URL         string `json:"url"`
+}
+
+type attachment struct {
+	Type        string `json:"type"` // "image", "gifv", "video", "audio" or "unknown"
+	URL         string `json:"url"`
+	Description string `json:"description"`
+	Meta        struct {
+		Original struct {
+			Width  uint `json:"width"`
+			Height uint `json:"height"`
+		} `json:"original"`
+	} `json:"meta"`
+}
+
+type status struct {
+	ID               string       `json:"id"`
+	URI              string       `json:"uri"` // unique across the fediverse
+	URL              string       `json:"url"`
+	Visibility       string       `json:"visibility"`
+	SpoilerText      string       `json:"spoiler_text"`
+	Content          string       `json:"content"` // HTML
+	Account          account      `json:"account"`
+	Reblog           *status      `json:"reblog"`
+	MediaAttachments []attachment `json:"media_attachments"`
+	Tags             []struct {
+		Name string `json:"name"`
+	} `json:"tags"`
+}
+
+// lookupAccount finds the account with the given address, e.g. "user@example.com".
+func (s *fediverseService) lookupAccount(ctx context.Context, acct string) (*account, error) {
+	var a account
+	err := s.api(ctx, "GET", "/api/v1/accounts/lookup?acct="+url.QueryEscape(acct), &a)
+	return &a, err
+}
+
+// isFollowing returns true if the service's account follows the account, or has asked to and is
+// waiting for it to accept.
+func (s *fediverseService) isFollowing(ctx context.Context, accountID string) (bool, error) {
+	var rels []struct {
+		Following bool `json:"following"`
+		Requested bool `json:"requested"`
+	}
+	if err := s.api(ctx, "GET", "/api/v1/accounts/relationships?id[]="+url.QueryEscape(accountID), &rels); err != nil {
+		return false, err
+	}
+	return len(rels) > 0 && (rels[0].Following || rels[0].Requested), nil
+}
+
+// follow makes the service's account follow the account, so that its posts are streamed.
+func (s *fediverseService) follow(ctx context.Context, accountID string) error {
+	return s.api(ctx, "POST", "/api/v1/accounts/"+url.QueryEscape(accountID)+"/follow", nil)
+}
+
+// api calls the instance's API, decoding the JSON it responds with into result, if it isn't nil.
+func (s *fediverseService) api(ctx context.Context, method, path string, result interface{}) error {
+	req, err := http.NewRequest(method, strings.TrimSuffix(s.InstanceURL, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+	if token := s.AccessToken.Value(); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := ctxhttp.Do(ctx, httpclient.Default, req)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != 200 {
+		var errRes struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(res.Body).Decode(&errRes)
+		if errRes.Error != "" {
+			return fmt.Errorf("%s %s returned HTTP %d: %s", method, req.URL.Path, res.StatusCode, errRes.Error)
+		}
+		return fmt.Errorf("%s %s returned HTTP %d", method, req.URL.Path, res.StatusCode)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(result)
+}
+
+// readStream reads posts from one of the instance's streams, e.g. "/api/v1/streaming/user", and
+// passes each to onUpdate, until the context is cancelled or the stream fails.
+func (s *fediverseService) readStream(ctx context.Context, path string, onUpdate func(st *status)) error {
+	req, err := s.streamRequest(path)
+	if err != nil {
+		return err
+	}
+
+	reqCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var idle int32
+	watchdog := time.AfterFunc(idleTimeout, func() {
+		atomic.StoreInt32(&idle, 1)
+		cancel()
+	})
+	defer watchdog.Stop()
+
+	res, err := ctxhttp.Do(reqCtx, streamClient, req)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		if atomic.LoadInt32(&idle) == 1 {
+			return fmt.Errorf("%s didn't respond for %s", path, idleTimeout)
+		}
+		return err
+	}
+	if res.StatusCode != 200 {
+		return fmt.Errorf("GET %s returned HTTP %d", path, res.StatusCode)
+	}
+
+	err = readEvents(res.Body, watchdog, onUpdate)
+	if atomic.LoadInt32(&idle) == 1 {
+		return fmt.Errorf("%s sent nothing for %s", path, idleTimeout)
+	}
+	if err != nil {
+		return err
+	}
+	return errors.New(path + " was closed by the server")
+}
+
+// streamRequest returns a request for one of the instance's streams, with the access token if
+// there is one.
+func (s *fediverseService) streamRequest(path string) (*http.Request, error) {
+	u, err := url.Parse(strings.TrimSuffix(s.InstanceURL, "/") + path)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if token := s.AccessToken.Value(); token != "" {
+		// Instances may serve streams from another host, which the header isn't sent on to if
+		// the request is redirected, so send the token in the query too.
+		q := req.URL.Query()
+		q.Set("access_token", token)
+		req.URL.RawQuery = q.Encode()
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req, nil
+}
+
+// readEvents reads server-sent events from the body of a stream, passing each post to onUpdate,
+// until the body ends. The watchdog is reset whenever a line is read.
+func readEvents(body io.Reader, watchdog *time.Timer, onUpdate func(st *status)) error {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), maxEventSize)
+	var event string
+	var data []string
+	for scanner.Scan() {
+		watchdog.Reset(idleTimeout)
+		line := scanner.Text()
+		switch {
+		case line == "":
+			// A blank line ends an event.
+			if event == "update" && len(data) > 0 {
+				var st status
+				if err := json.Unmarshal([]byte(strings.Join(data, "\n")), &st); err == nil {
+					onUpdate(&st)
+				}
+			}
+			event, data = "", nil
+		case strings.HasPrefix(line, ":"):
+			// A comment, which Mastodon sends as a heartbeat.
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	return scanner.Err()
+}
+
+// sanitise reduces the HTML of a post to its text, links and line breaks. Mastodon sanitises posts,
+// but they may come from any server, so only markup which can't do harm is kept.
+func sanitise(content string) string {
+	text := tagRegex.ReplaceAllStringFunc(content, func(tag string) string {
+		m := tagRegex.FindStringSubmatch(tag)
+		closing := m[1] == "/"
+		switch strings.ToLower(m[2]) {
+		case "br":
+			return "<br>"
+		case "p":
+			if closing {
+				return "<br><br>"
+			}
+		case "a":
+			if closing {
+				return "</a>"
+			}
+			if href := hrefRegex.FindStringSubmatch(m[3]); href != nil {
+				return `<a href="` + href[1] + `">`
+			}
+			return "<a>"
+		}
+		return ""
+	})
+	for strings.HasSuffix(text, "<br>") {
+		text = strings.TrimSuffix(text, "<br>")
+	}
+	return text
+}
@@ -4,9 +4,13 @@ import (
 	"encoding/json"
 	"errors"
 	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/httpclient"
 	"github.com/matrix-org/go-neb/matrix"
 	"github.com/matrix-org/go-neb/plugin"
+	"github.com/matrix-org/go-neb/secrets"
 	"github.com/matrix-org/go-neb/types"
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -33,7 +37,10 @@ type giphySearch struct {
 type giphyService struct {
 	id            string
 	serviceUserID string
-	APIKey        string // beta key is dc6zaTOxFJmzC
+	APIKey        secrets.Secret // beta key is dc6zaTOxFJmzC
+	// CommandPrefixes are what commands start with in each room, e.g. {"!foo:bar": "?"}, so that
+	// several bots in a room can be told apart. Optional: in other rooms commands start with "!".
+	CommandPrefixes map[string]string
 }
 
 func (s *giphyService) ServiceUserID() string { return s.serviceUserID }
@@ -41,25 +48,35 @@ func (s *giphyService) ServiceID() string     { return s.id }
 func (s *giphyService) ServiceType() string   { return "giphy" }
 func (s *giphyService) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli *matrix.Client) {
 }
+func (s *giphyService) ValidateConfig() []types.ConfigError {
+	errs := types.ValidateCommandPrefixes(s.CommandPrefixes)
+	if s.APIKey.Value() == "" {
+		errs = append(errs, types.ConfigError{Field: "APIKey", Message: "is required"})
+	}
+	return errs
+}
 func (s *giphyService) Register(oldService types.Service, client *matrix.Client) error { return nil }
 func (s *giphyService) PostRegister(oldService types.Service)                          {}
 
 func (s *giphyService) Plugin(client *matrix.Client, roomID string) plugin.Plugin {
 	return plugin.Plugin{
+		Prefix: s.CommandPrefixes[roomID],
 		Commands: []plugin.Command{
 			plugin.Command{
-				Path: []string{"giphy"},
-				Command: func(roomID, userID string, args []string) (interface{}, error) {
-					return s.cmdGiphy(client, roomID, userID, args)
+				Path:      []string{"giphy"},
+				Arguments: []string{"query"},
+				Help:      "Respond with the GIF Giphy finds for the query",
+				ContextCommand: func(ctx context.Context, roomID, userID string, args []string) (interface{}, error) {
+					return s.cmdGiphy(ctx, client, roomID, userID, args)
 				},
 			},
 		},
 	}
 }
-func (s *giphyService) cmdGiphy(client *matrix.Client, roomID, userID string, args []string) (interface{}, error) {
+func (s *giphyService) cmdGiphy(ctx context.Context, client *matrix.Client, roomID, userID string, args []string) (interface{}, error) {
 	// only 1 arg which is the text to search for.
 	query := strings.Join(args, " ")
-	gifResult, err := s.searchGiphy(query)
+	gifResult, err := s.searchGiphy(ctx, query)
 	if err != nil {
 		return nil, err
 	}
@@ -82,7 +99,7 @@ func (s *giphyService) cmdGiphy(client *matrix.Client, roomID, userID string, ar
 }
 
 // searchGiphy returns info about a gif
-func (s *giphyService) searchGiphy(query string) (*result, error) {
+func (s *giphyService) searchGiphy(ctx context.Context, query string) (*result, error) {
 	log.Info("Searching giphy for ", query)
 	u, err := url.Parse("http://api.giphy.com/v1/gifs/search")
 	if err != nil {
@@ -90,9 +107,9 @@ func (s *giphyService) searchGiphy(query string) (*result, error) {
 	}
 	q := u.Query()
 	q.Set("q", query)
-	q.Set("api_key", s.APIKey)
+	q.Set("api_key", s.APIKey.Value())
 	u.RawQuery = q.Encode()
-	res, err := http.Get(u.String())
+	res, err := ctxhttp.Get(ctx, httpclient.Default, u.String())
 	if res != nil {
 		defer res.Body.Close()
 	}
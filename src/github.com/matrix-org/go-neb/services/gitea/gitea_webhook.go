@@ -0,0 +1,237 @@
+package services
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/batch"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/plugin"
+	"github.com/matrix-org/go-neb/secrets"
+	"github.com/matrix-org/go-neb/server"
+	"github.com/matrix-org/go-neb/services/gitea/webhook"
+	"github.com/matrix-org/go-neb/silence"
+	"github.com/matrix-org/go-neb/status"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/go-neb/util"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// giteaWebhookService sends notices about Gitea or Forgejo repositories to rooms. Gitea has no
+// realm to create webhooks with, so each repository's admins add the service's webhook URL, and
+// its Secret, in the repository's settings.
+type giteaWebhookService struct {
+	id                 string
+	serviceUserID      string
+	webhookEndpointURL string
+	// Secret is what Gitea is told to sign webhooks with. Requests which aren't signed with it
+	// are rejected.
+	Secret secrets.Secret
+	// AllowedIPs are the IP addresses and CIDR ranges Gitea may send webhook requests from.
+	// Optional: requests are allowed from anywhere.
+	AllowedIPs []string
+	// BatchWindow is how long to hold back notifications about an issue, pull request or branch,
+	// e.g. "30s", so that a burst of events about it is sent as one message. Optional: events
+	// are sent as they arrive.
+	BatchWindow string
+	// DigestWindow is how long to hold back notifications for the room's digest, e.g. "5m", so
+	// that a busy repository's events are sent as one message along with other services'
+	// held back notifications. Optional: notifications aren't held back for a digest.
+	DigestWindow string
+	// AlertIfQuietFor is how long to go without a webhook from Gitea before alerting the
+	// operators that it is probably broken, e.g. "24h". Optional: they are never alerted.
+	AlertIfQuietFor string
+	Rooms           map[string]struct { // room_id => {}
+		Repos map[string]struct { // owner/repo => { events: ["push","pull_request"] }
+			Events []string
+		}
+	}
+}
+
+func (s *giteaWebhookService) ServiceUserID() string { return s.serviceUserID }
+func (s *giteaWebhookService) ServiceID() string     { return s.id }
+func (s *giteaWebhookService) ServiceType() string   { return "gitea-webhook" }
+func (s *giteaWebhookService) Plugin(cli *matrix.Client, roomID string) plugin.Plugin {
+	return plugin.Plugin{}
+}
+func (s *giteaWebhookService) WebhookAllowedIPs() []string { return s.AllowedIPs }
+func (s *giteaWebhookService) QuietPeriod() time.Duration {
+	d, _ := status.ParseQuietPeriod(s.AlertIfQuietFor) // ValidateConfig checks it parses
+	return d
+}
+
+// OnReceiveWebhook sends a notice of the event to each room which wants it.
+func (s *giteaWebhookService) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli *matrix.Client) {
+	ev, httpErr := webhook.OnReceiveRequest(req, s.Secret.Value())
+	if httpErr != nil {
+		if httpErr.Code == 200 {
+			// e.g. a comment, which rooms aren't told about
+			status.Filtered(s.id)
+		}
+		w.WriteHeader(httpErr.Code)
+		return
+	}
+	logger := server.RequestLogger(req).WithFields(log.Fields{
+		"event": ev.Type,
+		"repo":  ev.Repo,
+	})
+	forwarded := false
+	var msgs []batch.Message
+	window, _ := batch.ParseWindow(s.BatchWindow)              // ValidateConfig checks it parses
+	digestWindow, _ := batch.ParseDigestWindow(s.DigestWindow) // ValidateConfig checks it parses
+
+	for roomID, roomConfig := range s.Rooms {
+		for ownerRepo, repoConfig := range roomConfig.Repos {
+			if !strings.EqualFold(ev.Repo, ownerRepo) || !contains(repoConfig.Events, ev.Type) {
+				continue
+			}
+			if silence.Silenced(roomID, ev.Repo) {
+				logger.WithField("room_id", roomID).Print("Not notifying room of silenced event")
+				continue
+			}
+			forwarded = true
+			logger.WithFields(log.Fields{
+				"msg":     ev.Message,
+				"room_id": roomID,
+			}).Print("Sending notification to room")
+			if digestWindow > 0 {
+				batch.Digest(cli, s.id, roomID, digestWindow, *ev.Message)
+			} else {
+				msgs = append(msgs, batch.Message{roomID, ev.Key, *ev.Message})
+			}
+		}
+	}
+	sendErrs := batch.SendAll(cli, s.id, window, msgs)
+	for roomID, e := range sendErrs {
+		logger.WithError(e).WithField("room_id", roomID).Print("Failed to send notification to room.")
+	}
+
+	if forwarded {
+		status.Forwarded(s.id)
+	} else {
+		status.Filtered(s.id)
+	}
+
+	if len(sendErrs) > 0 {
+		// So that the event is dead-lettered, to be replayed once the rooms are fixed.
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(200)
+}
+
+// ValidateConfig checks that the secret is given, that the allowed IPs, batch window and quiet
+// period parse, and that every room ID, repo and event type in Rooms is well formed.
+func (s *giteaWebhookService) ValidateConfig() []types.ConfigError {
+	var errs []types.ConfigError
+	if s.Secret.Value() == "" {
+		errs = append(errs, types.ConfigError{Field: "Secret", Message: "is required"})
+	}
+	if _, err := server.ParseAllowlist(s.AllowedIPs); err != nil {
+		errs = append(errs, types.ConfigError{Field: "AllowedIPs", Message: "does not parse: " + err.Error()})
+	}
+	errs = append(errs, s.validateWindows()...)
+	return append(errs, s.validateRooms()...)
+}
+
+// validateWindows checks that the batch and digest windows and the quiet period parse.
+func (s *giteaWebhookService) validateWindows() []types.ConfigError {
+	var errs []types.ConfigError
+	if _, err := batch.ParseWindow(s.BatchWindow); err != nil {
+		errs = append(errs, types.ConfigError{Field: "BatchWindow", Message: "is not a valid window: " + err.Error()})
+	}
+	if _, err := batch.ParseDigestWindow(s.DigestWindow); err != nil {
+		errs = append(errs, types.ConfigError{Field: "DigestWindow", Message: "is not a valid window: " + err.Error()})
+	}
+	if _, err := status.ParseQuietPeriod(s.AlertIfQuietFor); err != nil {
+		errs = append(errs, types.ConfigError{Field: "AlertIfQuietFor", Message: "is not a valid period: " + err.Error()})
+	}
+	return errs
+}
+
+// validateRooms checks that at least one room is given, and that every room ID, repo and event
+// type in Rooms is well formed.
+func (s *giteaWebhookService) validateRooms() []types.ConfigError {
+	var errs []types.ConfigError
+	if len(s.Rooms) == 0 {
+		errs = append(errs, types.ConfigError{Field: "Rooms", Message: "must list at least one room"})
+	}
+	for _, roomID := range util.SortedKeys(s.Rooms) {
+		roomField := fmt.Sprintf("Rooms[%s]", roomID)
+		if !types.IsRoomID(roomID) {
+			errs = append(errs, types.ConfigError{Field: roomField, Message: "is not a room ID"})
+		}
+		roomConfig := s.Rooms[roomID]
+		for _, ownerRepo := range util.SortedKeys(roomConfig.Repos) {
+			repoField := fmt.Sprintf("%s.Repos[%s]", roomField, ownerRepo)
+			if segs := strings.Split(ownerRepo, "/"); len(segs) != 2 || segs[0] == "" || segs[1] == "" {
+				errs = append(errs, types.ConfigError{Field: repoField, Message: "must be of the form 'owner/repo'"})
+			}
+			errs = append(errs, validateEvents(repoField, roomConfig.Repos[ownerRepo].Events)...)
+		}
+	}
+	return errs
+}
+
+// validateEvents checks that the event types of the repo with the given field are known.
+func validateEvents(repoField string, events []string) []types.ConfigError {
+	var errs []types.ConfigError
+	for i, ev := range events {
+		if !contains(webhook.Events, ev) {
+			errs = append(errs, types.ConfigError{
+				Field:   fmt.Sprintf("%s.Events[%d]", repoField, i),
+				Message: fmt.Sprintf("is not one of %s", strings.Join(webhook.Events, ", ")),
+			})
+		}
+	}
+	return errs
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Register joins the rooms notices are sent to.
+func (s *giteaWebhookService) Register(oldService types.Service, client *matrix.Client) error {
+	for _, roomID := range util.SortedKeys(s.Rooms) {
+		if _, err := client.JoinRoom(roomID, "", ""); err != nil {
+			return err
+		}
+	}
+	log.WithFields(log.Fields{
+		"service_id": s.id,
+		"url":        s.webhookEndpointURL,
+	}).Info("Registered Gitea webhook: add the URL, with the secret, to the webhooks of each repository")
+	return nil
+}
+
+// PlanRegister works out which rooms Register would join. Gitea webhooks are made by hand, so the
+// plan notes the URL they need.
+func (s *giteaWebhookService) PlanRegister(oldService types.Service, client *matrix.Client) (*types.RegisterPlan, error) {
+	plan := &types.RegisterPlan{JoinRooms: types.PlanJoinRooms(client, util.SortedKeys(s.Rooms))}
+	plan.Notes = []string{"Each repository must be given a Gitea webhook to " + s.webhookEndpointURL + " in its settings"}
+	return plan, nil
+}
+
+// CheckRegistered checks that the service's client is still in each room events are posted to.
+func (s *giteaWebhookService) CheckRegistered(client *matrix.Client) ([]string, error) {
+	return types.CheckJoinedRooms(client, util.SortedKeys(s.Rooms)), nil
+}
+
+func (s *giteaWebhookService) PostRegister(oldService types.Service) {}
+
+func init() {
+	types.RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) types.Service {
+		return &giteaWebhookService{
+			id:                 serviceID,
+			serviceUserID:      serviceUserID,
+			webhookEndpointURL: webhookEndpointURL,
+		}
+	})
+}
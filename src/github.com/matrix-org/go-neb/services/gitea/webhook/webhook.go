@@ -0,0 +1,300 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/errors"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/signatures"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// An Event is a Gitea or Forgejo webhook event, parsed.
+type Event struct {
+	Type string // The event's X-Gitea-Event header, e.g. "push".
+	Repo string // The full name of the repository, e.g. "owner/repo".
+	// Key is what the event is about, e.g. "owner/repo#12" for an issue or pull request and
+	// "owner/repo@main" for a push or release, so that events about the same thing can be batched.
+	Key     string
+	Message *matrix.HTMLMessage
+}
+
+// Events are the Gitea event types which can be sent to rooms.
+var Events = []string{"push", "issues", "pull_request", "release"}
+
+// deletedSHA is the commit a branch is pushed to when it is deleted.
+const deletedSHA = "0000000000000000000000000000000000000000"
+
+type user struct {
+	Login    string `json:"login"`
+	Username string `json:"username"`
+}
+
+// name returns the user's login name. Older Gitea versions only send username.
+func (u user) name() string {
+	if u.Login != "" {
+		return u.Login
+	}
+	return u.Username
+}
+
+type repository struct {
+	FullName string `json:"full_name"`
+	HTMLURL  string `json:"html_url"`
+}
+
+type pushEvent struct {
+	Ref        string     `json:"ref"`
+	After      string     `json:"after"`
+	CompareURL string     `json:"compare_url"`
+	Pusher     user       `json:"pusher"`
+	Repository repository `json:"repository"`
+	Commits    []struct {
+		Message string `json:"message"`
+		URL     string `json:"url"`
+		Author  struct {
+			Name string `json:"name"`
+		} `json:"author"`
+	} `json:"commits"`
+	TotalCommits int `json:"total_commits"`
+}
+
+// issuable is the part of an issue or pull request which messages are made from.
+type issuable struct {
+	Number  int    `json:"number"`
+	Title   string `json:"title"`
+	State   string `json:"state"`
+	HTMLURL string `json:"html_url"`
+	Merged  bool   `json:"merged"` // pull requests only
+}
+
+type issuesEvent struct {
+	Action     string     `json:"action"`
+	Sender     user       `json:"sender"`
+	Repository repository `json:"repository"`
+	Issue      issuable   `json:"issue"`
+}
+
+type pullRequestEvent struct {
+	Action      string     `json:"action"`
+	Sender      user       `json:"sender"`
+	Repository  repository `json:"repository"`
+	PullRequest issuable   `json:"pull_request"`
+}
+
+type releaseEvent struct {
+	Action     string     `json:"action"`
+	Sender     user       `json:"sender"`
+	Repository repository `json:"repository"`
+	Release    struct {
+		TagName    string `json:"tag_name"`
+		Name       string `json:"name"`
+		HTMLURL    string `json:"html_url"`
+		Prerelease bool   `json:"prerelease"`
+	} `json:"release"`
+}
+
+// OnReceiveRequest processes incoming Gitea and Forgejo webhook requests and returns the event,
+// with a matrix message to send. The request must be signed with the secret, or an error is
+// returned.
+func OnReceiveRequest(r *http.Request, secret string) (*Event, *errors.HTTPError) {
+	content, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.WithError(err).Print("Failed to read Gitea webhook body")
+		return nil, &errors.HTTPError{nil, "Failed to parse body", 400}
+	}
+	if err = signatures.Gitea.Verify(r.Header, content, secret); err != nil {
+		log.WithError(err).Print("Received Gitea event which failed signature check.")
+		return nil, &errors.HTTPError{nil, "Bad signature", 401}
+	}
+	// Forgejo sends both headers, and may stop sending the Gitea one.
+	eventType := r.Header.Get("X-Forgejo-Event")
+	if eventType == "" {
+		eventType = r.Header.Get("X-Gitea-Event")
+	}
+	if eventType == "" {
+		return nil, &errors.HTTPError{nil, "Missing X-Gitea-Event header", 400}
+	}
+	log.WithField("event_type", eventType).Print("Received Gitea event")
+
+	ev, err := parseGiteaEvent(eventType, content)
+	if err != nil {
+		log.WithError(err).Print("Failed to parse Gitea event")
+		return nil, &errors.HTTPError{nil, "Failed to parse Gitea event", 400}
+	}
+	if ev == nil {
+		// e.g. a comment, or an event type which was turned on for the hook in Gitea's UI.
+		return nil, &errors.HTTPError{nil, "ignored", 200}
+	}
+	return ev, nil
+}
+
+// parseGiteaEvent parses the JSON of an event of the given type. Returns nil if rooms aren't told
+// about the event.
+func parseGiteaEvent(eventType string, data []byte) (*Event, error) {
+	var htmlStr, repo, key string
+	switch eventType {
+	case "push":
+		var ev pushEvent
+		if err := json.Unmarshal(data, &ev); err != nil {
+			return nil, err
+		}
+		ref := refName(ev.Ref)
+		repo, key, htmlStr = ev.Repository.FullName, ev.Repository.FullName+"@"+ref, pushHTMLMessage(ev, ref)
+	case "issues":
+		var ev issuesEvent
+		if err := json.Unmarshal(data, &ev); err != nil {
+			return nil, err
+		}
+		repo = ev.Repository.FullName
+		key = fmt.Sprintf("%s#%d", repo, ev.Issue.Number)
+		htmlStr = issuableHTMLMessage(repo, ev.Sender, ev.Action, ev.Issue, fmt.Sprintf("issue #%d", ev.Issue.Number))
+	case "pull_request":
+		var ev pullRequestEvent
+		if err := json.Unmarshal(data, &ev); err != nil {
+			return nil, err
+		}
+		repo = ev.Repository.FullName
+		key = fmt.Sprintf("%s#%d", repo, ev.PullRequest.Number)
+		htmlStr = issuableHTMLMessage(repo, ev.Sender, ev.Action, ev.PullRequest, fmt.Sprintf("pull request #%d", ev.PullRequest.Number))
+	case "release":
+		var ev releaseEvent
+		if err := json.Unmarshal(data, &ev); err != nil {
+			return nil, err
+		}
+		repo, key, htmlStr = ev.Repository.FullName, ev.Repository.FullName+"@"+ev.Release.TagName, releaseHTMLMessage(ev)
+	default:
+		return nil, nil
+	}
+	if repo == "" {
+		return nil, fmt.Errorf("%s event has no repository", eventType)
+	}
+	msg := matrix.GetHTMLMessage("m.notice", htmlStr)
+	return &Event{Type: eventType, Repo: repo, Key: key, Message: &msg}, nil
+}
+
+// refName returns the name of the branch or tag a ref points at, e.g. "main" for "refs/heads/main".
+func refName(ref string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(ref, "refs/heads/"), "refs/tags/")
+}
+
+func pushHTMLMessage(p pushEvent, ref string) string {
+	if p.After == deletedSHA {
+		return fmt.Sprintf(
+			`[<u>%s</u>] %s <font color="red"><b>deleted</font> %s</b>`,
+			html.EscapeString(p.Repository.FullName),
+			html.EscapeString(p.Pusher.name()),
+			html.EscapeString(ref),
+		)
+	}
+	if len(p.Commits) == 0 {
+		// e.g. a new branch or tag pointing at an existing commit
+		return fmt.Sprintf(
+			"[<u>%s</u>] %s pushed to <b>%s</b>",
+			html.EscapeString(p.Repository.FullName),
+			html.EscapeString(p.Pusher.name()),
+			html.EscapeString(ref),
+		)
+	}
+	// Commits are newest first.
+	head := p.Commits[0]
+	if len(p.Commits) == 1 {
+		return fmt.Sprintf(
+			`[<u>%s</u>] %s pushed to <b>%s</b>: %s - %s`,
+			html.EscapeString(p.Repository.FullName),
+			html.EscapeString(p.Pusher.name()),
+			html.EscapeString(ref),
+			html.EscapeString(firstLine(head.Message)),
+			html.EscapeString(head.URL),
+		)
+	}
+	var cList []string
+	for i := len(p.Commits) - 1; i >= 0; i-- {
+		c := p.Commits[i]
+		cList = append(cList, fmt.Sprintf(
+			`%s: %s`,
+			html.EscapeString(c.Author.Name),
+			html.EscapeString(firstLine(c.Message)),
+		))
+	}
+	// Gitea sends a limited number of commits, with the real count alongside.
+	count := p.TotalCommits
+	if count < len(p.Commits) {
+		count = len(p.Commits)
+	}
+	link := p.CompareURL
+	if link == "" {
+		link = head.URL
+	}
+	return fmt.Sprintf(
+		`[<u>%s</u>] %s pushed %d commits to <b>%s</b>: %s<br>%s`,
+		html.EscapeString(p.Repository.FullName),
+		html.EscapeString(p.Pusher.name()),
+		count,
+		html.EscapeString(ref),
+		html.EscapeString(link),
+		strings.Join(cList, "<br>"),
+	)
+}
+
+// issuableActions are how the actions Gitea sends for issues and pull requests are described,
+// where they aren't already the past tense.
+var issuableActions = map[string]string{
+	"synchronized":     "pushed to",
+	"label_updated":    "changed the labels of",
+	"label_cleared":    "removed the labels of",
+	"milestoned":       "set the milestone of",
+	"demilestoned":     "removed the milestone of",
+	"review_requested": "requested a review of",
+}
+
+func issuableHTMLMessage(repo string, sender user, action string, i issuable, what string) string {
+	if a, ok := issuableActions[action]; ok {
+		action = a
+	} else if action == "closed" && i.Merged {
+		action = "merged"
+	}
+	state := i.State
+	if i.Merged {
+		state = "merged"
+	}
+	return fmt.Sprintf(
+		"[<u>%s</u>] %s %s <b>%s</b>: %s [%s] - %s",
+		html.EscapeString(repo),
+		html.EscapeString(sender.name()),
+		html.EscapeString(action),
+		what,
+		html.EscapeString(i.Title),
+		html.EscapeString(state),
+		html.EscapeString(i.HTMLURL),
+	)
+}
+
+func releaseHTMLMessage(p releaseEvent) string {
+	what := "release"
+	if p.Release.Prerelease {
+		what = "pre-release"
+	}
+	name := p.Release.Name
+	if name == "" {
+		name = p.Release.TagName
+	}
+	return fmt.Sprintf(
+		"[<u>%s</u>] %s %s %s <b>%s</b>: %s - %s",
+		html.EscapeString(p.Repository.FullName),
+		html.EscapeString(p.Sender.name()),
+		html.EscapeString(p.Action),
+		what,
+		html.EscapeString(p.Release.TagName),
+		html.EscapeString(name),
+		html.EscapeString(p.Release.HTMLURL),
+	)
+}
+
+func firstLine(s string) string {
+	return strings.TrimSpace(strings.SplitN(s, "\n", 2)[0])
+}
@@ -0,0 +1,161 @@
+package webhook
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+var giteatests = []struct {
+	eventType string
+	jsonBody  string
+	outHTML   string
+	outRepo   string
+	outKey    string
+}{
+	{"push",
+		`{
+		  "ref": "refs/heads/main",
+		  "before": "28e1879d029cb852e4844d9c718537df08844e03",
+		  "after": "bffeb74224043ba2feb48d137756c8a9331c449a",
+		  "compare_url": "http://localhost:3000/gitea/webhooks/compare/28e1879d029cb852e4844d9c718537df08844e03...bffeb74224043ba2feb48d137756c8a9331c449a",
+		  "commits": [
+		    {
+		      "id": "bffeb74224043ba2feb48d137756c8a9331c449a",
+		      "message": "Webhooks Yay!\n\nWith a body",
+		      "url": "http://localhost:3000/gitea/webhooks/commit/bffeb74224043ba2feb48d137756c8a9331c449a",
+		      "author": {"name": "Gitea", "email": "someone@gitea.io", "username": "gitea"}
+		    },
+		    {
+		      "id": "28e1879d029cb852e4844d9c718537df08844e03",
+		      "message": "Add webhooks",
+		      "url": "http://localhost:3000/gitea/webhooks/commit/28e1879d029cb852e4844d9c718537df08844e03",
+		      "author": {"name": "Someone", "email": "someone@example.com", "username": "someone"}
+		    }
+		  ],
+		  "total_commits": 3,
+		  "repository": {"full_name": "gitea/webhooks", "html_url": "http://localhost:3000/gitea/webhooks"},
+		  "pusher": {"login": "gitea", "username": "gitea"},
+		  "sender": {"login": "gitea", "username": "gitea"}
+		}`,
+		`[<u>gitea/webhooks</u>] gitea pushed 3 commits to <b>main</b>: http://localhost:3000/gitea/webhooks/compare/28e1879d029cb852e4844d9c718537df08844e03...bffeb74224043ba2feb48d137756c8a9331c449a<br>Someone: Add webhooks<br>Gitea: Webhooks Yay!`,
+		"gitea/webhooks",
+		"gitea/webhooks@main",
+	},
+	{"push",
+		`{
+		  "ref": "refs/heads/feature/old",
+		  "after": "0000000000000000000000000000000000000000",
+		  "commits": [],
+		  "repository": {"full_name": "org/repo"},
+		  "pusher": {"username": "alice"}
+		}`,
+		`[<u>org/repo</u>] alice <font color="red"><b>deleted</font> feature/old</b>`,
+		"org/repo",
+		"org/repo@feature/old",
+	},
+	{"issues",
+		`{
+		  "action": "opened",
+		  "number": 7,
+		  "issue": {"number": 7, "title": "Crash on <startup>", "state": "open", "html_url": "https://codeberg.org/org/repo/issues/7"},
+		  "repository": {"full_name": "org/repo"},
+		  "sender": {"login": "bob"}
+		}`,
+		`[<u>org/repo</u>] bob opened <b>issue #7</b>: Crash on &lt;startup&gt; [open] - https://codeberg.org/org/repo/issues/7`,
+		"org/repo",
+		"org/repo#7",
+	},
+	{"pull_request",
+		`{
+		  "action": "closed",
+		  "number": 8,
+		  "pull_request": {"number": 8, "title": "Fix the crash", "state": "closed", "merged": true, "html_url": "https://codeberg.org/org/repo/pulls/8"},
+		  "repository": {"full_name": "org/repo"},
+		  "sender": {"login": "carol"}
+		}`,
+		`[<u>org/repo</u>] carol merged <b>pull request #8</b>: Fix the crash [merged] - https://codeberg.org/org/repo/pulls/8`,
+		"org/repo",
+		"org/repo#8",
+	},
+	{"pull_request",
+		`{
+		  "action": "synchronized",
+		  "number": 9,
+		  "pull_request": {"number": 9, "title": "WIP", "state": "open", "html_url": "https://codeberg.org/org/repo/pulls/9"},
+		  "repository": {"full_name": "org/repo"},
+		  "sender": {"login": "carol"}
+		}`,
+		`[<u>org/repo</u>] carol pushed to <b>pull request #9</b>: WIP [open] - https://codeberg.org/org/repo/pulls/9`,
+		"org/repo",
+		"org/repo#9",
+	},
+	{"release",
+		`{
+		  "action": "published",
+		  "release": {"tag_name": "v1.1.0-rc1", "name": "", "prerelease": true, "html_url": "https://codeberg.org/org/repo/releases/tag/v1.1.0-rc1"},
+		  "repository": {"full_name": "org/repo"},
+		  "sender": {"login": "dave"}
+		}`,
+		`[<u>org/repo</u>] dave published pre-release <b>v1.1.0-rc1</b>: v1.1.0-rc1 - https://codeberg.org/org/repo/releases/tag/v1.1.0-rc1`,
+		"org/repo",
+		"org/repo@v1.1.0-rc1",
+	},
+}
+
+func TestParseGiteaEvent(t *testing.T) {
+	for _, gt := range giteatests {
+		ev, err := parseGiteaEvent(gt.eventType, []byte(gt.jsonBody))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ev == nil {
+			t.Fatalf("parseGiteaEvent(%s) => Event is nil", gt.eventType)
+		}
+		if ev.Message.FormattedBody != gt.outHTML {
+			t.Fatalf("parseGiteaEvent(%s) => HTML output does not match. Got:\n%s\n\nExpected:\n%s", gt.eventType,
+				ev.Message.FormattedBody, gt.outHTML)
+		}
+		if ev.Repo != gt.outRepo {
+			t.Fatalf("parseGiteaEvent(%s) => Repo: Want %s got %s", gt.eventType, gt.outRepo, ev.Repo)
+		}
+		if ev.Key != gt.outKey {
+			t.Fatalf("parseGiteaEvent(%s) => Key: Want %s got %s", gt.eventType, gt.outKey, ev.Key)
+		}
+	}
+}
+
+func TestParseGiteaEventIgnored(t *testing.T) {
+	body := `{"action":"created","repository":{"full_name":"a/b"}}`
+	if ev, err := parseGiteaEvent("issue_comment", []byte(body)); ev != nil || err != nil {
+		t.Errorf("parseGiteaEvent(issue_comment) => Want nil, nil got %v, %v", ev, err)
+	}
+}
+
+func TestOnReceiveRequestSignature(t *testing.T) {
+	body := `{"ref":"refs/heads/main","repository":{"full_name":"a/b"}}`
+	// The HMAC-SHA256 of the body with the secret "secret"
+	sig := "f1fcf2f48ad946fd89dc084a31080987d14bdd4ce2b08d9e7cadfbed0fce6e64"
+	for _, tc := range []struct {
+		header   string
+		sig      string
+		wantCode int
+	}{
+		{"X-Gitea-Signature", sig, 0},
+		{"X-Forgejo-Signature", sig, 0},
+		{"X-Gitea-Signature", strings.Repeat("0", 64), 401},
+		{"", "", 401},
+	} {
+		req, _ := http.NewRequest("POST", "/", strings.NewReader(body))
+		req.Header.Set("X-Gitea-Event", "push")
+		if tc.header != "" {
+			req.Header.Set(tc.header, tc.sig)
+		}
+		_, httpErr := OnReceiveRequest(req, "secret")
+		if tc.wantCode == 0 && httpErr != nil {
+			t.Errorf("OnReceiveRequest with %s %q => %d %s", tc.header, tc.sig, httpErr.Code, httpErr.Message)
+		} else if tc.wantCode != 0 && (httpErr == nil || httpErr.Code != tc.wantCode) {
+			t.Errorf("OnReceiveRequest with %s %q => Want HTTP %d got %v", tc.header, tc.sig, tc.wantCode, httpErr)
+		}
+	}
+}
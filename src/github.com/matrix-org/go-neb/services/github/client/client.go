@@ -2,7 +2,11 @@ package client
 
 import (
 	"github.com/google/go-github/github"
+	"github.com/matrix-org/go-neb/httpclient"
+	"github.com/matrix-org/go-neb/ops"
+	"github.com/matrix-org/go-neb/tokens"
 	"golang.org/x/oauth2"
+	"net/http"
 )
 
 // TrimmedRepository represents a cut-down version of github.Repository with only the keys the end-user is
@@ -40,12 +44,61 @@ func TrimRepository(repo *github.Repository) TrimmedRepository {
 // If `token` is empty, a non-authenticated client will be created. This should be
 // used sparingly where possible as you only get 60 requests/hour like that (IP locked).
 func New(token string) *github.Client {
-	var tokenSource oauth2.TokenSource
-	if token != "" {
-		tokenSource = oauth2.StaticTokenSource(
-			&oauth2.Token{AccessToken: token},
-		)
+	return github.NewClient(&http.Client{Transport: tokenTransport(token), Timeout: httpclient.DefaultTimeout})
+}
+
+// tokenTransport returns a transport which authenticates requests with the token, or sends them
+// unauthenticated if it is empty, over the shared transport.
+func tokenTransport(token string) http.RoundTripper {
+	if token == "" {
+		return httpclient.Transport
+	}
+	return &oauth2.Transport{
+		Base:   httpclient.Transport,
+		Source: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token}),
+	}
+}
+
+// NewForUser returns a github Client which performs Github API operations with the token of the
+// given user's auth session. If Github rejects the token, e.g. because the user revoked it, an
+// operational alert is raised as the user needs to authenticate again, and the session is removed if
+// Github keeps rejecting it. If token is empty, this is the same as New("").
+func NewForUser(token, realmID, userID string) *github.Client {
+	if token == "" {
+		return New("")
+	}
+	return github.NewClient(&http.Client{
+		Transport: &rejectedTokenTransport{tokenTransport(token), realmID, userID, token},
+		Timeout:   httpclient.DefaultTimeout,
+	})
+}
+
+// NewForInstallation returns a github Client which performs Github API operations as an
+// installation of a Github App, with the tokens from the source.
+func NewForInstallation(source oauth2.TokenSource) *github.Client {
+	return github.NewClient(&http.Client{
+		Transport: &oauth2.Transport{Base: httpclient.Transport, Source: source},
+		Timeout:   httpclient.DefaultTimeout,
+	})
+}
+
+type rejectedTokenTransport struct {
+	base    http.RoundTripper
+	realmID string
+	userID  string
+	token   string
+}
+
+func (t *rejectedTokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		return res, err
+	}
+	if res.StatusCode == 401 {
+		ops.Alert("Github rejected the token of %s in realm %s: they need to authenticate again", t.userID, t.realmID)
+		tokens.Rejected(t.realmID, t.userID, t.token)
+	} else {
+		tokens.Accepted(t.realmID, t.userID, t.token)
 	}
-	httpCli := oauth2.NewClient(oauth2.NoContext, tokenSource)
-	return github.NewClient(httpCli)
+	return res, err
 }
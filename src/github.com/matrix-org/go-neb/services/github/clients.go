@@ -0,0 +1,118 @@
+package services
+
+import (
+	"container/list"
+	log "github.com/Sirupsen/logrus"
+	"github.com/google/go-github/github"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/services/github/client"
+	"sync"
+)
+
+// maxCachedClients is the most authenticated clients kept. The least recently used is dropped to
+// make room for another.
+const maxCachedClients = 1000
+
+// clientCache keeps the clients made from users' sessions, so that a webhook or command doesn't
+// load the realm and session from the database and make a new client every time. Clients are
+// dropped whenever the user's sessions in the realm change.
+type clientCache struct {
+	mu      sync.Mutex
+	order   *list.List               // of *cachedClient, most recently used first
+	clients map[string]*list.Element // key => element of order
+	max     int
+}
+
+type cachedClient struct {
+	key     string
+	realmID string
+	userID  string
+	cli     *github.Client
+}
+
+var clients = newClientCache(maxCachedClients)
+
+func newClientCache(max int) *clientCache {
+	return &clientCache{
+		order:   list.New(),
+		clients: make(map[string]*list.Element),
+		max:     max,
+	}
+}
+
+func clientKey(realmID, userID, scope string) string {
+	return realmID + "\x00" + userID + "\x00" + scope
+}
+
+func (c *clientCache) get(realmID, userID, scope string) *github.Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.clients[clientKey(realmID, userID, scope)]
+	if !ok {
+		return nil
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*cachedClient).cli
+}
+
+func (c *clientCache) add(realmID, userID, scope string, cli *github.Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := clientKey(realmID, userID, scope)
+	if elem, ok := c.clients[key]; ok {
+		elem.Value.(*cachedClient).cli = cli
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.clients[key] = c.order.PushFront(&cachedClient{key, realmID, userID, cli})
+	for c.order.Len() > c.max {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.clients, oldest.Value.(*cachedClient).key)
+	}
+}
+
+// invalidate drops the clients of the user in the realm, or of every user in it if userID is
+// empty.
+func (c *clientCache) invalidate(realmID, userID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for elem := c.order.Front(); elem != nil; {
+		next := elem.Next()
+		cached := elem.Value.(*cachedClient)
+		if cached.realmID == realmID && (userID == "" || cached.userID == userID) {
+			c.order.Remove(elem)
+			delete(c.clients, cached.key)
+		}
+		elem = next
+	}
+}
+
+// githubClientFor returns a client which uses the user's least privileged session in the realm
+// with the scope. If the user has no such session, it returns an unauthenticated client if
+// allowUnauth is true, or nil if not.
+func githubClientFor(realmID, userID, scope string, allowUnauth bool) *github.Client {
+	if cli := clients.get(realmID, userID, scope); cli != nil {
+		return cli
+	}
+	token, err := getTokenForUser(realmID, userID, scope)
+	if err != nil {
+		log.WithFields(log.Fields{
+			log.ErrorKey: err,
+			"user_id":    userID,
+			"realm_id":   realmID,
+		}).Print("Failed to get token for user")
+	}
+	if token != "" {
+		cli := client.NewForUser(token, realmID, userID)
+		clients.add(realmID, userID, scope, cli)
+		return cli
+	} else if allowUnauth {
+		return client.New("")
+	}
+	return nil
+}
+
+func init() {
+	database.OnAuthSessionChange(clients.invalidate)
+}
@@ -0,0 +1,34 @@
+package services
+
+import (
+	"github.com/google/go-github/github"
+	"testing"
+)
+
+func TestClientCache(t *testing.T) {
+	c := newClientCache(2)
+	alice, bob, carol := &github.Client{}, &github.Client{}, &github.Client{}
+	c.add("realm", "@alice:x", "repo", alice)
+	c.add("realm", "@bob:x", "repo", bob)
+	c.get("realm", "@alice:x", "repo") // so that bob is the least recently used
+	c.add("realm", "@carol:x", "repo", carol)
+
+	if c.get("realm", "@bob:x", "repo") != nil {
+		t.Error("Least recently used client => want it dropped, but it is cached")
+	}
+	if c.get("realm", "@alice:x", "repo") != alice || c.get("realm", "@carol:x", "repo") != carol {
+		t.Error("Recently used clients => want them cached, but they aren't")
+	}
+	if c.get("realm", "@alice:x", "admin:repo_hook") != nil {
+		t.Error("Client for another scope => want none, got the repo scope's")
+	}
+
+	c.invalidate("realm", "@alice:x")
+	if c.get("realm", "@alice:x", "repo") != nil || c.get("realm", "@carol:x", "repo") != carol {
+		t.Error("invalidate(@alice:x) => want only alice's client dropped")
+	}
+	c.invalidate("realm", "")
+	if c.get("realm", "@carol:x", "repo") != nil {
+		t.Error("invalidate of the whole realm => want every client dropped")
+	}
+}
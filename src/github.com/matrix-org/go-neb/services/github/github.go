@@ -2,6 +2,7 @@ package services
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/google/go-github/github"
@@ -9,14 +10,18 @@ import (
 	"github.com/matrix-org/go-neb/matrix"
 	"github.com/matrix-org/go-neb/plugin"
 	"github.com/matrix-org/go-neb/realms/github"
-	"github.com/matrix-org/go-neb/services/github/client"
+	pat "github.com/matrix-org/go-neb/realms/pat"
+	"github.com/matrix-org/go-neb/tokens"
 	"github.com/matrix-org/go-neb/types"
+	"html"
 	"net/http"
 	"regexp"
 	"strconv"
 	"strings"
 )
 
+const createUsage = `Usage: !github create owner/repo "issue title" description`
+
 // Matches alphanumeric then a /, then more alphanumeric then a #, then a number.
 // E.g. owner/repo#11 (issue/PR numbers) - Captured groups for owner/repo/number
 var ownerRepoIssueRegex = regexp.MustCompile(`(([A-z0-9-_]+)/([A-z0-9-_]+))?#([0-9]+)`)
@@ -26,6 +31,9 @@ type githubService struct {
 	id            string
 	serviceUserID string
 	RealmID       string
+	// CommandPrefixes are what commands start with in each room, e.g. {"!foo:bar": "?"}, so that
+	// several bots in a room can be told apart. Optional: in other rooms commands start with "!".
+	CommandPrefixes map[string]string
 }
 
 func (s *githubService) ServiceUserID() string { return s.serviceUserID }
@@ -38,18 +46,22 @@ func (s *githubService) cmdGithubCreate(roomID, userID string, args []string) (i
 		if err != nil {
 			return nil, err
 		}
-		ghRealm, ok := r.(*realms.GithubRealm)
-		if !ok {
-			return nil, fmt.Errorf("Failed to cast realm %s into a GithubRealm", s.RealmID)
+		switch realm := r.(type) {
+		case *realms.GithubRealm:
+			return matrix.StarterLinkMessage{
+				Body: "You need to OAuth with Github before you can create issues.",
+				Link: realm.StarterLink,
+			}, nil
+		case *pat.PATRealm:
+			return matrix.StarterLinkMessage{
+				Body: "You need to send a Github token with !auth " + realm.ID() + " before you can create issues.",
+				Link: realm.StarterLink,
+			}, nil
 		}
-		return matrix.StarterLinkMessage{
-			Body: "You need to OAuth with Github before you can create issues.",
-			Link: ghRealm.StarterLink,
-		}, nil
+		return nil, fmt.Errorf("Failed to cast realm %s into a GithubRealm", s.RealmID)
 	}
 	if len(args) == 0 {
-		return &matrix.TextMessage{"m.notice",
-			`Usage: !github create owner/repo "issue title" "description"`}, nil
+		return &matrix.TextMessage{"m.notice", createUsage}, nil
 	}
 
 	// We expect the args to look like:
@@ -62,14 +74,12 @@ func (s *githubService) cmdGithubCreate(roomID, userID string, args []string) (i
 		// look for a default repo
 		defaultRepo := s.defaultRepo(roomID)
 		if defaultRepo == "" {
-			return &matrix.TextMessage{"m.notice",
-				`Usage: !github create owner/repo "issue title" "description"`}, nil
+			return &matrix.TextMessage{"m.notice", createUsage}, nil
 		}
 		// default repo should pass the regexp
 		ownerRepoGroups = ownerRepoRegex.FindStringSubmatch(defaultRepo)
 		if len(ownerRepoGroups) == 0 {
-			return &matrix.TextMessage{"m.notice",
-				`Malformed default repo. Usage: !github create owner/repo "issue title" "description"`}, nil
+			return &matrix.TextMessage{"m.notice", "Malformed default repo. " + createUsage}, nil
 		}
 
 		// insert the default as the first arg to reuse the same indices
@@ -77,33 +87,76 @@ func (s *githubService) cmdGithubCreate(roomID, userID string, args []string) (i
 		// continue through now that ownerRepoGroups has matching groups
 	}
 
-	var (
-		title *string
-		desc  *string
-	)
-
-	if len(args) == 2 {
-		title = &args[1]
-	} else if len(args) == 3 {
-		title = &args[1]
-		desc = &args[2]
-	} else { // > 3 args is probably a title without quote marks
-		joinedTitle := strings.Join(args[1:], " ")
-		title = &joinedTitle
+	if len(args) < 2 {
+		return &matrix.TextMessage{"m.notice", createUsage}, nil
 	}
 
-	issue, res, err := cli.Issues.Create(ownerRepoGroups[1], ownerRepoGroups[2], &github.IssueRequest{
-		Title: title,
-		Body:  desc,
-	})
+	owner, repo := ownerRepoGroups[1], ownerRepoGroups[2]
+	issue, res, err := cli.Issues.Create(owner, repo, issueRequestFromArgs(args[1:]))
 	if err != nil {
-		log.WithField("err", err).Print("Failed to create issue")
-		return nil, fmt.Errorf("Failed to create issue. HTTP %d", res.StatusCode)
+		log.WithError(err).WithFields(log.Fields{
+			"owner":   owner,
+			"repo":    repo,
+			"user_id": userID,
+		}).Print("Failed to create issue")
+		return nil, createIssueError(s.RealmID, owner, repo, res)
 	}
-
 	return matrix.TextMessage{"m.notice", fmt.Sprintf("Created issue: %s", *issue.HTMLURL)}, nil
 }
 
+// issueRequestFromArgs makes an issue from the arguments of !github create after the repository:
+// the title, then the description, which may be several unquoted words.
+func issueRequestFromArgs(args []string) *github.IssueRequest {
+	req := &github.IssueRequest{Title: &args[0]}
+	if len(args) > 1 {
+		desc := strings.Join(args[1:], " ")
+		req.Body = &desc
+	}
+	return req
+}
+
+// createIssueError explains why Github failed to create an issue, given its response if there was
+// one.
+func createIssueError(realmID, owner, repo string, res *github.Response) error {
+	if res == nil {
+		return errors.New("Failed to create issue: Github could not be reached")
+	}
+	switch res.StatusCode {
+	case 401:
+		return fmt.Errorf("Github rejected your login. Log in again with !auth %s and try again.", realmID)
+	case 403, 404:
+		return fmt.Errorf("Failed to create issue: %s/%s doesn't exist, or you can't create issues in it", owner, repo)
+	case 410:
+		return fmt.Errorf("Failed to create issue: issues are turned off for %s/%s", owner, repo)
+	}
+	return fmt.Errorf("Failed to create issue. HTTP %d", res.StatusCode)
+}
+
+// htmlSummaryForIssue returns the reference, title and state of the issue or pull request, linking
+// to it, e.g. "<a href=...>owner/repo#12</a>: Fix the thing (open pull request)".
+func htmlSummaryForIssue(owner, repo string, i *github.Issue) string {
+	var url, title, state string
+	var number int
+	if i.HTMLURL != nil {
+		url = *i.HTMLURL
+	}
+	if i.Title != nil {
+		title = *i.Title
+	}
+	if i.State != nil {
+		state = *i.State + " "
+	}
+	if i.Number != nil {
+		number = *i.Number
+	}
+	kind := "issue"
+	if i.PullRequestLinks != nil {
+		kind = "pull request"
+	}
+	return fmt.Sprintf(`<a href="%s">%s/%s#%d</a>: %s (%s%s)`, html.EscapeString(url), html.EscapeString(owner),
+		html.EscapeString(repo), number, html.EscapeString(title), html.EscapeString(state), kind)
+}
+
 func (s *githubService) expandIssue(roomID, userID, owner, repo string, issueNum int) interface{} {
 	cli := s.githubClientFor(userID, true)
 
@@ -117,17 +170,17 @@ func (s *githubService) expandIssue(roomID, userID, owner, repo string, issueNum
 		return nil
 	}
 
-	return &matrix.TextMessage{
-		"m.notice",
-		fmt.Sprintf("%s : %s", *i.HTMLURL, *i.Title),
-	}
+	return matrix.GetHTMLMessage("m.notice", htmlSummaryForIssue(owner, repo, i))
 }
 
 func (s *githubService) Plugin(cli *matrix.Client, roomID string) plugin.Plugin {
 	return plugin.Plugin{
+		Prefix: s.CommandPrefixes[roomID],
 		Commands: []plugin.Command{
 			plugin.Command{
-				Path: []string{"github", "create"},
+				Path:      []string{"github", "create"},
+				Arguments: []string{"[owner/repo]", "title", "[description]"},
+				Help:      "Create a Github issue, in the room's default repository if no repository is given",
 				Command: func(roomID, userID string, args []string) (interface{}, error) {
 					return s.cmdGithubCreate(roomID, userID, args)
 				},
@@ -184,6 +237,15 @@ func (s *githubService) OnReceiveWebhook(w http.ResponseWriter, req *http.Reques
 	w.WriteHeader(400)
 }
 
+// ValidateConfig checks that a RealmID is given.
+func (s *githubService) ValidateConfig() []types.ConfigError {
+	errs := types.ValidateCommandPrefixes(s.CommandPrefixes)
+	if s.RealmID == "" {
+		errs = append(errs, types.ConfigError{Field: "RealmID", Message: "is required"})
+	}
+	return errs
+}
+
 // Register will create webhooks for the repos specified in Rooms
 //
 // The hooks made are a delta between the old service and the current configuration. If all webhooks are made,
@@ -204,8 +266,8 @@ func (s *githubService) Register(oldService types.Service, client *matrix.Client
 		return err
 	}
 	// make sure the realm is of the type we expect
-	if realm.Type() != "github" {
-		return fmt.Errorf("Realm is of type '%s', not 'github'", realm.Type())
+	if err = checkRealm(realm); err != nil {
+		return err
 	}
 
 	log.Infof("%+v", s)
@@ -245,45 +307,51 @@ func (s *githubService) defaultRepo(roomID string) string {
 }
 
 func (s *githubService) githubClientFor(userID string, allowUnauth bool) *github.Client {
-	token, err := getTokenForUser(s.RealmID, userID)
-	if err != nil {
-		log.WithFields(log.Fields{
-			log.ErrorKey: err,
-			"user_id":    userID,
-			"realm_id":   s.RealmID,
-		}).Print("Failed to get token for user")
-	}
-	if token != "" {
-		return client.New(token)
-	} else if allowUnauth {
-		return client.New("")
-	} else {
-		return nil
-	}
+	return githubClientFor(s.RealmID, userID, "repo", allowUnauth)
 }
 
-func getTokenForUser(realmID, userID string) (string, error) {
+// getTokenForUser returns the access token of the user's least privileged session which has the
+// given scopes, or of their default session if none of them has, e.g. because it is a fine-grained
+// personal access token, which has no scopes.
+func getTokenForUser(realmID, userID string, scopes ...string) (string, error) {
 	realm, err := database.GetServiceDB().LoadAuthRealm(realmID)
 	if err != nil {
 		return "", err
 	}
-	if realm.Type() != "github" {
-		return "", fmt.Errorf("Bad realm type: %s", realm.Type())
+	if err = checkRealm(realm); err != nil {
+		return "", err
 	}
 
-	// pull out the token (TODO: should the service know how the realm stores this?)
-	session, err := database.GetServiceDB().LoadAuthSessionByUser(realm.ID(), userID)
+	session, err := tokens.FindSession(realm.ID(), userID, scopes...)
+	if err == sql.ErrNoRows {
+		session, err = database.GetServiceDB().LoadAuthSessionByUser(realm.ID(), userID)
+	}
 	if err != nil {
 		return "", err
 	}
-	ghSession, ok := session.(*realms.GithubSession)
+	tokenSession, ok := session.(types.TokenSession)
 	if !ok {
 		return "", fmt.Errorf("Session is not a github session: %s", session.ID())
 	}
-	if ghSession.AccessToken == "" {
+	if !tokenSession.Authenticated() {
 		return "", fmt.Errorf("Github auth session for %s has not been completed.", userID)
 	}
-	return ghSession.AccessToken, nil
+	return tokenSession.Token().AccessToken, nil
+}
+
+// checkRealm returns an error unless the realm holds Github tokens: either a github realm, or a
+// pat realm whose Provider is github.
+func checkRealm(realm types.AuthRealm) error {
+	switch r := realm.(type) {
+	case *realms.GithubRealm:
+		return nil
+	case *pat.PATRealm:
+		if r.Provider == "github" {
+			return nil
+		}
+		return fmt.Errorf("Realm %s holds %s tokens, not github ones", r.ID(), r.Provider)
+	}
+	return fmt.Errorf("Realm is of type '%s', not 'github' or 'pat'", realm.Type())
 }
 
 func init() {
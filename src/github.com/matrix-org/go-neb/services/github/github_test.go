@@ -0,0 +1,155 @@
+package services
+
+import (
+	"encoding/json"
+	"github.com/google/go-github/github"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/secrets"
+	"net/http"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestHTMLSummaryForIssue(t *testing.T) {
+	number := 42
+	url := "https://github.com/matrix-org/go-neb/pull/42"
+	title := "Fix <everything>"
+	state := "open"
+	issue := github.Issue{
+		Number:           &number,
+		HTMLURL:          &url,
+		Title:            &title,
+		State:            &state,
+		PullRequestLinks: &github.PullRequestLinks{},
+	}
+	got := htmlSummaryForIssue("matrix-org", "go-neb", &issue)
+	want := `<a href="https://github.com/matrix-org/go-neb/pull/42">matrix-org/go-neb#42</a>: Fix &lt;everything&gt; (open pull request)`
+	if got != want {
+		t.Errorf("htmlSummaryForIssue => want %q, got %q", want, got)
+	}
+
+	msg := matrix.GetHTMLMessage("m.notice", got)
+	wantBody := "matrix-org/go-neb#42 (https://github.com/matrix-org/go-neb/pull/42): Fix <everything> (open pull request)"
+	if msg.Body != wantBody {
+		t.Errorf("Plain text summary => want %q, got %q", wantBody, msg.Body)
+	}
+}
+
+func TestIssueRequestFromArgs(t *testing.T) {
+	req := issueRequestFromArgs([]string{"Some title", "the", "description"})
+	if req.Title == nil || *req.Title != "Some title" || req.Body == nil || *req.Body != "the description" {
+		t.Errorf("issueRequestFromArgs => want title and description, got %+v", req)
+	}
+	req = issueRequestFromArgs([]string{"Some title"})
+	if req.Title == nil || *req.Title != "Some title" || req.Body != nil {
+		t.Errorf("issueRequestFromArgs without a description => want just the title, got %+v", req)
+	}
+}
+
+func TestCreateIssueError(t *testing.T) {
+	for _, test := range []struct {
+		res  *github.Response
+		want string
+	}{
+		{nil, "Failed to create issue: Github could not be reached"},
+		{&github.Response{Response: &http.Response{StatusCode: 401}}, "Github rejected your login. Log in again with !auth realm and try again."},
+		{&github.Response{Response: &http.Response{StatusCode: 404}}, "Failed to create issue: owner/repo doesn't exist, or you can't create issues in it"},
+		{&github.Response{Response: &http.Response{StatusCode: 500}}, "Failed to create issue. HTTP 500"},
+	} {
+		if got := createIssueError("realm", "owner", "repo", test.res).Error(); got != test.want {
+			t.Errorf("createIssueError(%+v) => want %q, got %q", test.res, test.want, got)
+		}
+	}
+}
+
+func TestWantsCIResult(t *testing.T) {
+	for _, test := range []struct {
+		option, result, previous string
+		want                     bool
+	}{
+		{"", "passed", "passed", true},
+		{"all", "", "", true},
+		{"failures", "failed", "failed", true},
+		{"failures", "passed", "failed", false},
+		{"changes", "passed", "failed", true},
+		{"changes", "failed", "passed", true},
+		{"changes", "failed", "failed", false},
+		{"changes", "", "failed", false},
+		{"changes", "failed", "", true},
+		{"changes", "passed", "", false},
+	} {
+		if got := wantsCIResult(test.option, test.result, test.previous); got != test.want {
+			t.Errorf("wantsCIResult(%q, %q, %q) => want %v got %v", test.option, test.result, test.previous, test.want, got)
+		}
+	}
+}
+
+func TestRecordCIResult(t *testing.T) {
+	s := &githubWebhookService{id: "TestRecordCIResult"}
+	for _, test := range []struct{ branch, result, wantPrevious string }{
+		{"main", "failed", ""},
+		{"main", "", "failed"},
+		{"main", "passed", "failed"},
+		{"dev", "passed", ""},
+		{"main", "passed", "passed"},
+	} {
+		if got := s.recordCIResult("Owner/Repo", "CI", test.branch, test.result); got != test.wantPrevious {
+			t.Errorf("recordCIResult(%s, %q) => want previous %q got %q", test.branch, test.result, test.wantPrevious, got)
+		}
+	}
+}
+
+func TestMatchingRepo(t *testing.T) {
+	ownerRepos := []string{"matrix-org/*", "Matrix-Org/Synapse", "vector-im/riot-web"}
+	for fullName, want := range map[string]string{
+		"matrix-org/synapse":  "Matrix-Org/Synapse",
+		"matrix-org/go-neb":   "matrix-org/*",
+		"MATRIX-ORG/go-neb":   "matrix-org/*",
+		"vector-im/riot-web":  "vector-im/riot-web",
+		"vector-im/riot-ios":  "",
+		"matrix-org-x/go-neb": "",
+	} {
+		if got := matchingRepo(ownerRepos, fullName); got != want {
+			t.Errorf("matchingRepo(%s) => want %q got %q", fullName, want, got)
+		}
+	}
+}
+
+func TestRepoList(t *testing.T) {
+	var s githubWebhookService
+	err := json.Unmarshal([]byte(`{"Rooms": {
+		"!a:x": {"Repos": {"matrix-org/*": {}, "vector-im/riot-web": {}}},
+		"!b:x": {"Repos": {"Matrix-Org/synapse": {}, "vector-im/riot-web": {}}}
+	}}`), &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := s.repoList()
+	sort.Strings(got)
+	if want := []string{"matrix-org/*", "vector-im/riot-web"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("repoList => want %v, with the organization's repos left out, got %v", want, got)
+	}
+}
+
+func TestSecretTokens(t *testing.T) {
+	s := &githubWebhookService{SecretToken: secrets.New("old")}
+	if got := s.secretTokens(); !reflect.DeepEqual(got, []string{"old"}) {
+		t.Errorf("secretTokens => want [old] got %v", got)
+	}
+	old := s.SecretToken
+	s.SecretToken = secrets.New("new")
+	s.retireSecretToken(old)
+	if got := s.secretTokens(); !reflect.DeepEqual(got, []string{"new", "old"}) {
+		t.Errorf("secretTokens whilst rotating => want [new old] got %v", got)
+	}
+	s.PreviousSecretTokenExpires = time.Now().Add(-time.Minute).UnixNano() / 1000000
+	if got := s.secretTokens(); !reflect.DeepEqual(got, []string{"new"}) {
+		t.Errorf("secretTokens after the grace period => want [new] got %v", got)
+	}
+	s.retireSecretToken(secrets.New("new"))
+	if s.PreviousSecretToken.Value() != "old" {
+		t.Errorf("retireSecretToken of the current secret => want the previous secret kept, got %q", s.PreviousSecretToken.Value())
+	}
+}
@@ -4,94 +4,432 @@ import (
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/google/go-github/github"
+	"github.com/matrix-org/go-neb/batch"
 	"github.com/matrix-org/go-neb/database"
 	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/ops"
 	"github.com/matrix-org/go-neb/plugin"
+	githubapp "github.com/matrix-org/go-neb/realms/githubapp"
+	"github.com/matrix-org/go-neb/secrets"
+	"github.com/matrix-org/go-neb/server"
 	"github.com/matrix-org/go-neb/services/github/client"
 	"github.com/matrix-org/go-neb/services/github/webhook"
+	"github.com/matrix-org/go-neb/silence"
+	"github.com/matrix-org/go-neb/status"
 	"github.com/matrix-org/go-neb/types"
 	"github.com/matrix-org/go-neb/util"
 	"net/http"
+	"net/url"
+	"path"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
+// ciResults are the last results, "passed" or "failed", of each service's workflows and check
+// suites on each branch, so that rooms can be told only when they change.
+var ciResults = struct {
+	sync.Mutex
+	m map[string]string // service ID, repo, workflow and branch => result
+}{m: make(map[string]string)}
+
+// secretGracePeriod is how long requests signed with the previous SecretToken are accepted for
+// after it is changed, e.g. so that failed deliveries can still be redelivered.
+const secretGracePeriod = 24 * time.Hour
+
+// orgRepo is the repo which stands for every repo of an organization, as in "matrix-org/*".
+const orgRepo = "*"
+
+// defaultTallyWindow is how long new stars and forks are counted for, unless TallyWindow says
+// otherwise.
+const defaultTallyWindow = time.Hour
+
 type githubWebhookService struct {
 	id                 string
 	serviceUserID      string
 	webhookEndpointURL string
-	ClientUserID       string // optional; required for webhooks
+	ClientUserID       string // required for webhooks, unless RealmID is a github-app realm
 	RealmID            string
-	SecretToken        string
-	Rooms              map[string]struct { // room_id => {}
-		Repos map[string]struct { // owner/repo => { events: ["push","issue","pull_request"] }
-			Events []string
-		}
+	SecretToken        secrets.Secret
+	// PreviousSecretToken is the SecretToken before it was last changed, which requests may still
+	// be signed with until PreviousSecretTokenExpires, in ms since the epoch. Set by Go-NEB.
+	PreviousSecretToken        secrets.Secret
+	PreviousSecretTokenExpires int64
+	// AllowedIPs are the IP addresses and CIDR ranges Github may send webhook requests from, or
+	// "github" for the ranges Github publishes. Optional: requests are allowed from anywhere.
+	AllowedIPs []string
+	// BatchWindow is how long to hold back notifications about an issue, pull request or branch,
+	// e.g. "30s", so that a burst of events about it is sent as one message. Optional: events
+	// are sent as they arrive.
+	BatchWindow string
+	// DigestWindow is how long to hold back notifications for the room's digest, e.g. "5m", so
+	// that a busy repository's events are sent as one message along with other services'
+	// held back notifications. Optional: notifications aren't held back for a digest.
+	DigestWindow string
+	// TallyWindow is how long to count new stars and forks of a repository for before telling
+	// rooms how many there were, e.g. "1h". Optional: "1h".
+	TallyWindow string
+	// TallyThreshold is the fewest new stars or forks in a window worth telling rooms about.
+	// Optional: 1.
+	TallyThreshold int
+	// AlertIfQuietFor is how long to go without a webhook from Github before alerting the
+	// operators that it is probably broken, e.g. "24h". Optional: they are never alerted.
+	AlertIfQuietFor string
+	// MatrixUserIDs maps Github logins to Matrix user IDs, e.g. {"alice": "@alice:example.com"}.
+	// When one of these users is assigned an issue or pull request in a repo in Rooms, or their
+	// review of a pull request is requested, they are sent a direct message. Optional.
+	MatrixUserIDs map[string]string
+	Rooms         map[string]struct { // room_id => {}
+		Repos map[string]githubRepoConfig // owner/repo => { events: ["push","issue","pull_request"] }
 	}
 }
 
+// githubRepoConfig is which events of a repo to notify a room of.
+type githubRepoConfig struct {
+	Events []string
+	// Branches are the branches to notify of pushes to, as globs, e.g. "release/*".
+	// Optional: pushes to every branch are notified.
+	Branches []string
+	// RequiredLabels are labels an issue or pull request must have one of for its events
+	// to be notified. Optional: issues and pull requests are notified whatever their labels.
+	RequiredLabels []string
+	// ExcludedLabels are labels which stop an issue or pull request's events being
+	// notified, whatever its other labels.
+	ExcludedLabels []string
+	// CINotify is which finished workflow runs and check suites to notify: "all",
+	// "failures", or "changes" for those which passed after failing or failed after
+	// passing. Optional: "all".
+	CINotify string
+}
+
 func (s *githubWebhookService) ServiceUserID() string { return s.serviceUserID }
 func (s *githubWebhookService) ServiceID() string     { return s.id }
 func (s *githubWebhookService) ServiceType() string   { return "github-webhook" }
 func (s *githubWebhookService) Plugin(cli *matrix.Client, roomID string) plugin.Plugin {
 	return plugin.Plugin{}
 }
+func (s *githubWebhookService) WebhookAllowedIPs() []string { return s.AllowedIPs }
+func (s *githubWebhookService) QuietPeriod() time.Duration {
+	d, _ := status.ParseQuietPeriod(s.AlertIfQuietFor) // ValidateConfig checks it parses
+	return d
+}
+
+// OnReceiveWebhook sends a notice of the event to each room which wants it. If no room wants the
+// repository any more, its webhook is deleted.
 func (s *githubWebhookService) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli *matrix.Client) {
-	evType, repo, msg, err := webhook.OnReceiveRequest(req, s.SecretToken)
+	ev, err := webhook.OnReceiveRequest(req, s.secretTokens()...)
 	if err != nil {
+		if err.Code == 200 {
+			// e.g. a ping, or an event type which rooms aren't told about
+			status.Filtered(s.id)
+		}
 		w.WriteHeader(err.Code)
 		return
 	}
-	logger := log.WithFields(log.Fields{
-		"event": evType,
-		"repo":  *repo.FullName,
+	logger := server.RequestLogger(req).WithFields(log.Fields{
+		"event": ev.Type,
+		"repo":  *ev.Repo.FullName,
 	})
+	sendErrs, repoExistsInConfig, forwarded := s.notifyRooms(cli, ev, logger)
+	if repoExistsInConfig && s.notifyPing(cli, ev, logger) {
+		forwarded = true
+	}
+
+	if forwarded {
+		status.Forwarded(s.id)
+	} else {
+		status.Filtered(s.id)
+	}
+
+	if !repoExistsInConfig && !s.deleteUnwantedHook(*ev.Repo.FullName, logger) {
+		w.WriteHeader(400)
+		return
+	}
+
+	if len(sendErrs) > 0 {
+		// So that the event is dead-lettered, to be replayed once the rooms are fixed.
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(200)
+}
+
+// notifyRooms sends a notice of the event to each room which wants it. Returns the errors sending
+// to each room, whether any room has the event's repository in its config, even if it doesn't
+// want the event, and whether any room was notified.
+func (s *githubWebhookService) notifyRooms(cli *matrix.Client, ev *webhook.Event, logger *log.Entry) (map[string]error, bool, bool) {
 	repoExistsInConfig := false
+	forwarded := false
+	var msgs []batch.Message
+	window, _ := batch.ParseWindow(s.BatchWindow)                               // ValidateConfig checks it parses
+	digestWindow, _ := batch.ParseDigestWindow(s.DigestWindow)                  // ValidateConfig checks it parses
+	tallyWindow, _ := batch.ParseTallyWindow(s.TallyWindow, defaultTallyWindow) // ValidateConfig checks it parses
+	var ciResult, previousCIResult string
+	if ev.CI != nil {
+		ciResult = ciResultOf(ev.CI.Conclusion)
+		previousCIResult = s.recordCIResult(*ev.Repo.FullName, ev.CI.Name, ev.Branch, ciResult)
+	}
 
 	for roomID, roomConfig := range s.Rooms {
-		for ownerRepo, repoConfig := range roomConfig.Repos {
-			if !strings.EqualFold(*repo.FullName, ownerRepo) {
-				continue
-			}
-			repoExistsInConfig = true // even if we don't notify for it.
-			notifyRoom := false
-			for _, notifyType := range repoConfig.Events {
-				if evType == notifyType {
-					notifyRoom = true
-					break
-				}
-			}
-			if notifyRoom {
-				logger.WithFields(log.Fields{
-					"msg":     msg,
-					"room_id": roomID,
-				}).Print("Sending notification to room")
-				if _, e := cli.SendMessageEvent(roomID, "m.room.message", msg); e != nil {
-					logger.WithError(e).WithField("room_id", roomID).Print(
-						"Failed to send notification to room.")
-				}
-			}
+		var ownerRepos []string
+		for ownerRepo := range roomConfig.Repos {
+			ownerRepos = append(ownerRepos, ownerRepo)
+		}
+		ownerRepo := matchingRepo(ownerRepos, *ev.Repo.FullName)
+		if ownerRepo == "" {
+			continue
+		}
+		repoExistsInConfig = true // even if we don't notify for it.
+		roomLogger := logger.WithField("room_id", roomID)
+		if !wantsEvent(roomConfig.Repos[ownerRepo], ev, ciResult, previousCIResult, roomLogger) {
+			continue
+		}
+		if silence.Silenced(roomID, append([]string{*ev.Repo.FullName}, ev.Labels...)...) {
+			roomLogger.Print("Not notifying room of silenced event")
+			continue
 		}
+		forwarded = true
+		roomLogger.WithField("msg", ev.Message).Print("Sending notification to room")
+		if ev.Tally != nil {
+			tally := *ev.Tally
+			batch.Tally(cli, s.id, roomID, ev.Key, tallyWindow, s.TallyThreshold, func(n int) interface{} {
+				return matrix.GetHTMLMessage("m.notice", tally.HTMLMessage(n, tallyWindow))
+			})
+		} else if digestWindow > 0 {
+			batch.Digest(cli, s.id, roomID, digestWindow, *ev.Message)
+		} else {
+			msgs = append(msgs, batch.Message{roomID, ev.Key, *ev.Message})
+		}
+	}
+	sendErrs := batch.SendAll(cli, s.id, window, msgs)
+	for roomID, e := range sendErrs {
+		logger.WithError(e).WithField("room_id", roomID).Print("Failed to send notification to room.")
 	}
+	return sendErrs, repoExistsInConfig, forwarded
+}
 
-	if !repoExistsInConfig {
-		segs := strings.Split(*repo.FullName, "/")
-		if len(segs) != 2 {
-			logger.Error("Received event with malformed owner/repo.")
-			w.WriteHeader(400)
-			return
+// wantsEvent returns true if a room with the repo config wants to be notified of the event, whose
+// CI result, if any, is ciResult after previousCIResult. Logs why if it doesn't.
+func wantsEvent(repoConfig githubRepoConfig, ev *webhook.Event, ciResult, previousCIResult string, logger *log.Entry) bool {
+	notifyRoom := false
+	for _, notifyType := range repoConfig.Events {
+		if ev.Type == notifyType {
+			notifyRoom = true
+			break
 		}
-		if err := s.deleteHook(segs[0], segs[1]); err != nil {
+	}
+	if !notifyRoom {
+		return false
+	}
+	if (ev.Type == "push" || ev.CI != nil) && !matchesBranch(repoConfig.Branches, ev.Branch) {
+		logger.WithField("branch", ev.Branch).Print("Not notifying room of event on unwanted branch")
+		return false
+	}
+	if ev.CI != nil && !wantsCIResult(repoConfig.CINotify, ciResult, previousCIResult) {
+		logger.WithField("conclusion", ev.CI.Conclusion).Print("Not notifying room of unwanted CI result")
+		return false
+	}
+	if ev.HasLabels && !matchesLabels(repoConfig.RequiredLabels, repoConfig.ExcludedLabels, ev.Labels) {
+		logger.WithField("labels", ev.Labels).Print("Not notifying room of event with unwanted labels")
+		return false
+	}
+	return true
+}
+
+// notifyPing sends a direct message to the Matrix user of the Github user the event asks
+// something of, if they are known. Returns true if they were sent one.
+func (s *githubWebhookService) notifyPing(cli *matrix.Client, ev *webhook.Event, logger *log.Entry) bool {
+	userID := s.matrixUserID(ev.Ping)
+	if userID == "" {
+		return false
+	}
+	// A failure isn't dead-lettered, so that the rooms aren't notified again when it is
+	// replayed.
+	roomID, err := cli.SendDirect(userID, *ev.PingMessage)
+	status.SendResult(s.id, err)
+	if err != nil {
+		logger.WithError(err).WithField("user_id", userID).Print("Failed to send direct notification.")
+		return false
+	}
+	logger.WithFields(log.Fields{
+		"user_id": userID,
+		"room_id": roomID,
+	}).Print("Sent direct notification")
+	return true
+}
+
+// deleteUnwantedHook deletes the webhook of the repository, which no room wants events of any
+// more. Returns false if the repository's name is malformed.
+func (s *githubWebhookService) deleteUnwantedHook(fullName string, logger *log.Entry) bool {
+	segs := strings.Split(fullName, "/")
+	if len(segs) != 2 {
+		logger.Error("Received event with malformed owner/repo.")
+		return false
+	}
+	if err := s.deleteHook(segs[0], segs[1]); err != nil {
+		// It may have come from a webhook on the whole organization.
+		if orgErr := s.deleteHook(segs[0], orgRepo); orgErr != nil {
 			logger.WithError(err).Print("Failed to delete webhook")
 		} else {
-			logger.Info("Deleted webhook")
+			logger.Info("Deleted organization webhook")
 		}
+	} else {
+		logger.Info("Deleted webhook")
 	}
+	return true
+}
 
-	w.WriteHeader(200)
+// secretTokens returns the SecretToken, then the previous one if requests may still be signed
+// with it.
+func (s *githubWebhookService) secretTokens() []string {
+	tokens := []string{s.SecretToken.Value()}
+	if s.PreviousSecretToken.Value() != "" && time.Now().UnixNano()/1000000 < s.PreviousSecretTokenExpires {
+		tokens = append(tokens, s.PreviousSecretToken.Value())
+	}
+	return tokens
+}
+
+// retireSecretToken makes the old SecretToken the previous one, for secretGracePeriod, if it
+// differs from the current one.
+func (s *githubWebhookService) retireSecretToken(old secrets.Secret) {
+	if old.Value() == s.SecretToken.Value() {
+		return
+	}
+	s.PreviousSecretToken = old
+	s.PreviousSecretTokenExpires = time.Now().Add(secretGracePeriod).UnixNano() / 1000000
+}
+
+// matrixUserID returns the Matrix user ID of the Github user, or "" if it isn't known.
+func (s *githubWebhookService) matrixUserID(login string) string {
+	if login == "" {
+		return ""
+	}
+	for l, userID := range s.MatrixUserIDs {
+		// Github logins are case insensitive.
+		if strings.EqualFold(l, login) {
+			return userID
+		}
+	}
+	return ""
+}
+
+// ValidateConfig checks that the required fields are given, that the allowed IPs, windows and
+// quiet period parse, that MatrixUserIDs maps to user IDs, and that every room ID, repo, event type
+// and branch glob in Rooms is well formed.
+func (s *githubWebhookService) ValidateConfig() []types.ConfigError {
+	var errs []types.ConfigError
+	if s.RealmID == "" {
+		errs = append(errs, types.ConfigError{Field: "RealmID", Message: "is required"})
+	}
+	if _, err := server.ParseAllowlist(s.AllowedIPs); err != nil {
+		errs = append(errs, types.ConfigError{Field: "AllowedIPs", Message: "does not parse: " + err.Error()})
+	}
+	errs = append(errs, s.validateWindows()...)
+	errs = append(errs, s.validateMatrixUserIDs()...)
+	return append(errs, s.validateRooms()...)
 }
 
-// Register will create webhooks for the repos specified in Rooms
+// validateWindows checks that the batch, digest and tally windows and the quiet period parse, and
+// that the tally threshold isn't negative.
+func (s *githubWebhookService) validateWindows() []types.ConfigError {
+	var errs []types.ConfigError
+	if _, err := batch.ParseWindow(s.BatchWindow); err != nil {
+		errs = append(errs, types.ConfigError{Field: "BatchWindow", Message: "is not a valid window: " + err.Error()})
+	}
+	if _, err := batch.ParseDigestWindow(s.DigestWindow); err != nil {
+		errs = append(errs, types.ConfigError{Field: "DigestWindow", Message: "is not a valid window: " + err.Error()})
+	}
+	if _, err := batch.ParseTallyWindow(s.TallyWindow, defaultTallyWindow); err != nil {
+		errs = append(errs, types.ConfigError{Field: "TallyWindow", Message: "is not a valid window: " + err.Error()})
+	}
+	if s.TallyThreshold < 0 {
+		errs = append(errs, types.ConfigError{Field: "TallyThreshold", Message: "must not be negative"})
+	}
+	if _, err := status.ParseQuietPeriod(s.AlertIfQuietFor); err != nil {
+		errs = append(errs, types.ConfigError{Field: "AlertIfQuietFor", Message: "is not a valid period: " + err.Error()})
+	}
+	return errs
+}
+
+// validateMatrixUserIDs checks that MatrixUserIDs maps to user IDs.
+func (s *githubWebhookService) validateMatrixUserIDs() []types.ConfigError {
+	var errs []types.ConfigError
+	for _, login := range util.SortedKeys(s.MatrixUserIDs) {
+		if !types.IsUserID(s.MatrixUserIDs[login]) {
+			errs = append(errs, types.ConfigError{Field: fmt.Sprintf("MatrixUserIDs[%s]", login), Message: "is not a user ID"})
+		}
+	}
+	return errs
+}
+
+// validateRooms checks that every room ID, repo, event type and branch glob in Rooms is well
+// formed.
+func (s *githubWebhookService) validateRooms() []types.ConfigError {
+	var errs []types.ConfigError
+	for _, roomID := range util.SortedKeys(s.Rooms) {
+		roomField := fmt.Sprintf("Rooms[%s]", roomID)
+		if !types.IsRoomID(roomID) {
+			errs = append(errs, types.ConfigError{Field: roomField, Message: "is not a room ID"})
+		}
+		roomConfig := s.Rooms[roomID]
+		for _, ownerRepo := range util.SortedKeys(roomConfig.Repos) {
+			repoField := fmt.Sprintf("%s.Repos[%s]", roomField, ownerRepo)
+			if msg := checkOwnerRepo(ownerRepo); msg != "" {
+				errs = append(errs, types.ConfigError{Field: repoField, Message: msg})
+			}
+			errs = append(errs, validateRepoConfig(repoField, roomConfig.Repos[ownerRepo])...)
+		}
+	}
+	return errs
+}
+
+// checkOwnerRepo returns what is wrong with the owner/repo, or "" if it is well formed.
+func checkOwnerRepo(ownerRepo string) string {
+	segs := strings.Split(ownerRepo, "/")
+	if len(segs) != 2 {
+		return "must be of the form owner/repo"
+	} else if segs[0] == "" || segs[1] == "" {
+		return "has an empty owner or repo"
+	} else if segs[1] != orgRepo && strings.Contains(segs[1], "*") {
+		return "must be a repo, or owner/* for every repo of an organization"
+	}
+	return ""
+}
+
+// validateRepoConfig checks that the branch globs, CI notifications and event types of the repo
+// config with the given field are well formed.
+func validateRepoConfig(repoField string, repoConfig githubRepoConfig) []types.ConfigError {
+	var errs []types.ConfigError
+	for i, branch := range repoConfig.Branches {
+		if _, err := path.Match(branch, ""); err != nil {
+			errs = append(errs, types.ConfigError{
+				Field:   fmt.Sprintf("%s.Branches[%d]", repoField, i),
+				Message: "is not a valid glob: " + err.Error(),
+			})
+		}
+	}
+	switch repoConfig.CINotify {
+	case "", "all", "failures", "changes":
+	default:
+		errs = append(errs, types.ConfigError{
+			Field:   repoField + ".CINotify",
+			Message: "must be all, failures or changes",
+		})
+	}
+	for i, ev := range repoConfig.Events {
+		if !isKnownEvent(ev) {
+			errs = append(errs, types.ConfigError{
+				Field:   fmt.Sprintf("%s.Events[%d]", repoField, i),
+				Message: fmt.Sprintf("is not one of %s", strings.Join(webhook.Events, ", ")),
+			})
+		}
+	}
+	return errs
+}
+
+// Register will create webhooks for the repos specified in Rooms, or on an organization for "owner/*"
 //
 // The hooks made are a delta between the old service and the current configuration. If all webhooks are made,
 // Register() succeeds. If any webhook fails to be created, Register() fails. A delta is used to allow clients to incrementally
@@ -102,19 +440,110 @@ func (s *githubWebhookService) OnReceiveWebhook(w http.ResponseWriter, req *http
 // Hooks can get out of sync if a user manually deletes a hook in the Github UI. In this case, toggling the repo configuration will
 // force NEB to recreate the hook.
 func (s *githubWebhookService) Register(oldService types.Service, client *matrix.Client) error {
-	if s.RealmID == "" || s.ClientUserID == "" {
-		return fmt.Errorf("RealmID and ClientUserID is required")
-	}
-	realm, err := s.loadRealm()
+	cli, newRepos, _, err := s.checkRegister(oldService)
 	if err != nil {
 		return err
 	}
+	if old, ok := oldService.(*githubWebhookService); ok {
+		// The new config doesn't know the previous secret, so carry it over.
+		s.PreviousSecretToken, s.PreviousSecretTokenExpires = old.PreviousSecretToken, old.PreviousSecretTokenExpires
+		if old.SecretToken.Value() != s.SecretToken.Value() {
+			// Change the secret of the existing hooks in place.
+			keptRepos, _ := util.Difference(s.repoList(), newRepos)
+			if err = s.updateHookSecrets(cli, keptRepos); err != nil {
+				return err
+			}
+			s.retireSecretToken(old.SecretToken)
+		}
+	}
+	for _, r := range newRepos {
+		logger := log.WithField("repo", r)
+		err := s.createHook(cli, r)
+		if err != nil {
+			logger.WithError(err).Error("Failed to create webhook")
+			return err
+		}
+		logger.Info("Created webhook")
+	}
+
+	if err := s.joinWebhookRooms(client); err != nil {
+		return err
+	}
 
-	// In order to register the GH service as a client, you must have authed with GH.
-	cli := s.githubClientFor(s.ClientUserID, false)
-	if cli == nil {
-		return fmt.Errorf(
-			"User %s does not have a Github auth session with realm %s.", s.ClientUserID, realm.ID())
+	log.Infof("%+v", s)
+
+	return nil
+}
+
+// PlanRegister works out which hooks Register would create and PostRegister would delete, and
+// which rooms would be joined.
+func (s *githubWebhookService) PlanRegister(oldService types.Service, client *matrix.Client) (*types.RegisterPlan, error) {
+	_, newRepos, removedRepos, err := s.checkRegister(oldService)
+	if err != nil {
+		return nil, err
+	}
+	plan := &types.RegisterPlan{}
+	for _, r := range newRepos {
+		plan.CreateHooks = append(plan.CreateHooks, "github.com/"+r)
+	}
+	for _, r := range removedRepos {
+		plan.DeleteHooks = append(plan.DeleteHooks, "github.com/"+r)
+	}
+
+	var roomIDs []string
+	for roomID := range s.Rooms {
+		roomIDs = append(roomIDs, roomID)
+	}
+	plan.JoinRooms = types.PlanJoinRooms(client, roomIDs)
+
+	if old, ok := oldService.(*githubWebhookService); ok && old.SecretToken.Value() != s.SecretToken.Value() {
+		keptRepos, _ := util.Difference(s.repoList(), newRepos)
+		if len(keptRepos) > 0 {
+			plan.Notes = append(plan.Notes, fmt.Sprintf(
+				"The secret of the existing webhooks on %d repos would be changed; the old secret would be accepted for %s",
+				len(keptRepos), secretGracePeriod))
+		}
+	}
+	if len(s.repoList()) == 0 {
+		plan.Notes = append(plan.Notes, "The service would be deleted as it would have no webhooks")
+	}
+	return plan, nil
+}
+
+// CheckRegistered checks that the service still has a webhook on each repo, which is sent the
+// events rooms want from it, and that its client is still in each room.
+func (s *githubWebhookService) CheckRegistered(client *matrix.Client) ([]string, error) {
+	cli, _, _, err := s.checkRegister(nil)
+	if err != nil {
+		return nil, err
+	}
+	var problems []string
+	for _, r := range s.repoList() {
+		segs := strings.Split(r, "/")
+		hook, findErr := s.findHook(cli, segs[0], segs[1])
+		if findErr != nil {
+			problems = append(problems, fmt.Sprintf("Failed to list webhooks on github.com/%s: %s", r, findErr))
+		} else if hook == nil {
+			problems = append(problems, fmt.Sprintf("No webhook on github.com/%s", r))
+		} else if missing := missingEvents(hook, s.repoEvents(r)); len(missing) > 0 {
+			problems = append(problems, fmt.Sprintf("The webhook on github.com/%s is not sent %s events", r, strings.Join(missing, ", ")))
+		}
+	}
+
+	var roomIDs []string
+	for roomID := range s.Rooms {
+		roomIDs = append(roomIDs, roomID)
+	}
+	problems = append(problems, types.CheckJoinedRooms(client, roomIDs)...)
+	return problems, nil
+}
+
+// checkRegister validates the service and returns a Github client to manage webhooks with, along
+// with the repos which have been added and removed since the old service.
+func (s *githubWebhookService) checkRegister(oldService types.Service) (cli *github.Client, newRepos, removedRepos []string, err error) {
+	// In order to register the GH service as a client, you must have authed with GH, or be an app.
+	if cli, err = s.hookClient(); err != nil {
+		return
 	}
 
 	// Fetch the old service list and work out the difference between the two services.
@@ -135,30 +564,14 @@ func (s *githubWebhookService) Register(oldService types.Service, client *matrix
 	reposForWebhooks := s.repoList()
 
 	// Add hooks for the newly added repos but don't remove hooks for the removed repos: we'll clean those out later
-	newRepos, removedRepos := util.Difference(reposForWebhooks, oldRepos)
+	newRepos, removedRepos = util.Difference(reposForWebhooks, oldRepos)
 	if len(reposForWebhooks) == 0 && len(removedRepos) == 0 {
 		// The user didn't specify any webhooks. This may be a bug or it may be
 		// a conscious decision to remove all webhooks for this service. Figure out
 		// which it is by checking if we'd be removing any webhooks.
-		return fmt.Errorf("No webhooks specified.")
+		err = fmt.Errorf("No webhooks specified.")
 	}
-	for _, r := range newRepos {
-		logger := log.WithField("repo", r)
-		err := s.createHook(cli, r)
-		if err != nil {
-			logger.WithError(err).Error("Failed to create webhook")
-			return err
-		}
-		logger.Info("Created webhook")
-	}
-
-	if err := s.joinWebhookRooms(client); err != nil {
-		return err
-	}
-
-	log.Infof("%+v", s)
-
-	return nil
+	return
 }
 
 func (s *githubWebhookService) PostRegister(oldService types.Service) {
@@ -202,12 +615,29 @@ func (s *githubWebhookService) PostRegister(oldService types.Service) {
 			"service_id":   s.ServiceID(),
 		})
 		logger.Info("Removing service as no webhooks are registered.")
-		if err := database.GetServiceDB().DeleteService(s.ServiceID()); err != nil {
+		if err := database.GetServiceDB().DeleteService(s.ServiceID(), "Go-NEB, as no webhooks are registered"); err != nil {
 			logger.WithError(err).Error("Failed to delete service")
 		}
 	}
 }
 
+// Deregister deletes the service's webhook on each repository and organization.
+func (s *githubWebhookService) Deregister(client *matrix.Client) ([]string, error) {
+	var removed, failed []string
+	for _, r := range s.repoList() {
+		segs := strings.Split(r, "/")
+		if err := s.deleteHook(segs[0], segs[1]); err != nil {
+			failed = append(failed, "github.com/"+r+": "+err.Error())
+			continue
+		}
+		removed = append(removed, "Deleted webhook on github.com/"+r)
+	}
+	if len(failed) > 0 {
+		return removed, fmt.Errorf("Failed to delete webhooks: %s", strings.Join(failed, "; "))
+	}
+	return removed, nil
+}
+
 func (s *githubWebhookService) joinWebhookRooms(client *matrix.Client) error {
 	for roomID := range s.Rooms {
 		if _, err := client.JoinRoom(roomID, "", ""); err != nil {
@@ -218,26 +648,153 @@ func (s *githubWebhookService) joinWebhookRooms(client *matrix.Client) error {
 	return nil
 }
 
-// Returns a list of "owner/repos"
+// matchingRepo returns which of a room's configured repos an event from the repo with the given
+// full name is for: the repo itself if it is configured, or else "owner/*". Returns "" if neither
+// is. Github names are compared case insensitively.
+func matchingRepo(ownerRepos []string, fullName string) string {
+	org := ""
+	for _, ownerRepo := range ownerRepos {
+		if strings.EqualFold(ownerRepo, fullName) {
+			return ownerRepo
+		}
+		segs := strings.Split(ownerRepo, "/")
+		if len(segs) == 2 && segs[1] == orgRepo && strings.HasPrefix(strings.ToLower(fullName), strings.ToLower(segs[0])+"/") {
+			org = ownerRepo
+		}
+	}
+	return org
+}
+
+// matchesBranch returns true if the branch matches one of the globs, or if there are none. Globs
+// are matched as by path.Match, so "*" doesn't match a "/": "release/*" matches "release/1.0" but
+// not "release/1.0/hotfix".
+func matchesBranch(globs []string, branch string) bool {
+	if len(globs) == 0 {
+		return true
+	}
+	for _, glob := range globs {
+		if ok, _ := path.Match(glob, branch); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ciResultOf returns whether the conclusion of a workflow run or check suite is "passed" or
+// "failed", or "" if it is neither, e.g. because it was cancelled.
+func ciResultOf(conclusion string) string {
+	switch conclusion {
+	case "success":
+		return "passed"
+	case "failure", "timed_out", "startup_failure":
+		return "failed"
+	}
+	return ""
+}
+
+// recordCIResult records the latest result of the workflow or check suite on the branch, unless it
+// is "", and returns the previous one. Results are only remembered until Go-NEB restarts.
+func (s *githubWebhookService) recordCIResult(ownerRepo, name, branch, result string) string {
+	k := strings.Join([]string{s.id, strings.ToLower(ownerRepo), name, branch}, "\x00")
+	ciResults.Lock()
+	defer ciResults.Unlock()
+	previous := ciResults.m[k]
+	if result != "" {
+		ciResults.m[k] = result
+	}
+	return previous
+}
+
+// wantsCIResult returns true if a room with the CINotify option is notified of a CI result, given
+// the previous result on the branch. Without a previous result, "changes" only notifies failures,
+// so that a restart doesn't notify every passing branch again.
+func wantsCIResult(option, result, previous string) bool {
+	switch option {
+	case "failures":
+		return result == "failed"
+	case "changes":
+		if previous == "" {
+			return result == "failed"
+		}
+		return result != "" && result != previous
+	}
+	return true
+}
+
+// matchesLabels returns true if the labels include one of the required labels, or there are
+// none, and don't include any of the excluded labels. Labels are compared case insensitively, as
+// Github does.
+func matchesLabels(required, excluded, labels []string) bool {
+	hasLabel := func(want string) bool {
+		for _, l := range labels {
+			if strings.EqualFold(l, want) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, l := range excluded {
+		if hasLabel(l) {
+			return false
+		}
+	}
+	if len(required) == 0 {
+		return true
+	}
+	for _, l := range required {
+		if hasLabel(l) {
+			return true
+		}
+	}
+	return false
+}
+
+func isKnownEvent(evType string) bool {
+	for _, ev := range webhook.Events {
+		if ev == evType {
+			return true
+		}
+	}
+	return false
+}
+
+// repoEvents returns the events any room wants from the given "owner/repo", sorted.
+func (s *githubWebhookService) repoEvents(ownerRepo string) []string {
+	seen := make(map[string]bool)
+	var events []string
+	for _, roomConfig := range s.Rooms {
+		for _, ev := range roomConfig.Repos[ownerRepo].Events {
+			if !seen[ev] {
+				seen[ev] = true
+				events = append(events, ev)
+			}
+		}
+	}
+	sort.Strings(events)
+	return events
+}
+
+// Returns a list of "owner/repos" to make webhooks on, where "owner/*" is a webhook on the whole
+// organization. Repos of an organization which has one aren't listed, as it covers them.
 func (s *githubWebhookService) repoList() []string {
 	var repos []string
 	if s.Rooms == nil {
 		return repos
 	}
+	orgs := s.orgs()
+	seen := make(map[string]bool)
 	for _, roomConfig := range s.Rooms {
 		for ownerRepo := range roomConfig.Repos {
 			if strings.Count(ownerRepo, "/") != 1 {
 				log.WithField("repo", ownerRepo).Error("Bad owner/repo key in config")
 				continue
 			}
-			exists := false
-			for _, r := range repos {
-				if r == ownerRepo {
-					exists = true
-					break
-				}
+			segs := strings.Split(ownerRepo, "/")
+			if segs[1] != orgRepo && orgs[strings.ToLower(segs[0])] {
+				continue
 			}
-			if !exists {
+			if !seen[ownerRepo] {
+				seen[ownerRepo] = true
 				repos = append(repos, ownerRepo)
 			}
 		}
@@ -245,25 +802,41 @@ func (s *githubWebhookService) repoList() []string {
 	return repos
 }
 
+// orgs returns the lower cased owners which any room wants a webhook on the whole organization of.
+func (s *githubWebhookService) orgs() map[string]bool {
+	orgs := make(map[string]bool)
+	for _, roomConfig := range s.Rooms {
+		for ownerRepo := range roomConfig.Repos {
+			if segs := strings.Split(ownerRepo, "/"); len(segs) == 2 && segs[1] == orgRepo {
+				orgs[strings.ToLower(segs[0])] = true
+			}
+		}
+	}
+	return orgs
+}
+
 func (s *githubWebhookService) createHook(cli *github.Client, ownerRepo string) error {
 	o := strings.Split(ownerRepo, "/")
 	owner := o[0]
 	repo := o[1]
 	// make a hook for all GH events since we'll filter it when we receive webhook requests
 	name := "web" // https://developer.github.com/v3/repos/hooks/#create-a-hook
-	cfg := map[string]interface{}{
-		"content_type": "json",
-		"url":          s.webhookEndpointURL,
+	hook := &github.Hook{
+		Name:   &name,
+		Config: s.hookConfig(),
+		Events: webhook.Events,
 	}
-	if s.SecretToken != "" {
-		cfg["secret"] = s.SecretToken
+	var created *github.Hook
+	var res *github.Response
+	var err error
+	if repo == orgRepo {
+		created, res, err = cli.Organizations.CreateHook(owner, hook)
+	} else {
+		created, res, err = cli.Repositories.CreateHook(owner, repo, hook)
+	}
+	if err == nil && created != nil && created.ID != nil {
+		s.rememberHook(owner, repo, *created.ID)
 	}
-	events := []string{"push", "pull_request", "issues", "issue_comment", "pull_request_review_comment"}
-	_, res, err := cli.Repositories.CreateHook(owner, repo, &github.Hook{
-		Name:   &name,
-		Config: cfg,
-		Events: events,
-	})
 
 	if res.StatusCode == 422 {
 		errResponse, ok := err.(*github.ErrorResponse)
@@ -273,7 +846,8 @@ func (s *githubWebhookService) createHook(cli *github.Client, ownerRepo string)
 		for _, ghErr := range errResponse.Errors {
 			if strings.Contains(ghErr.Message, "already exists") {
 				log.WithField("repo", ownerRepo).Print("422 : Hook already exists")
-				return nil
+				// It may have been made before Go-NEB knew some of the events.
+				return s.addHookEvents(cli, owner, repo)
 			}
 		}
 		return err
@@ -282,6 +856,135 @@ func (s *githubWebhookService) createHook(cli *github.Client, ownerRepo string)
 	return err
 }
 
+// hookConfig returns the config of this service's webhooks.
+func (s *githubWebhookService) hookConfig() map[string]interface{} {
+	cfg := map[string]interface{}{
+		"content_type": "json",
+		"url":          s.webhookEndpointURL,
+	}
+	if s.SecretToken.Value() != "" {
+		cfg["secret"] = s.SecretToken.Value()
+	}
+	return cfg
+}
+
+// RotateWebhook points the webhook on each repo which was sent to the old endpoint URL at the
+// current one. Repos which have no webhook at the old URL are given a new one.
+func (s *githubWebhookService) RotateWebhook(oldEndpointURL string) error {
+	cli, err := s.hookClient()
+	if err != nil {
+		return err
+	}
+	for _, r := range s.repoList() {
+		segs := strings.Split(r, "/")
+		hook, err := s.findHookAt(cli, segs[0], segs[1], oldEndpointURL)
+		if err != nil {
+			return err
+		}
+		if hook == nil {
+			if err = s.createHook(cli, r); err != nil {
+				return err
+			}
+			log.WithField("repo", r).Info("Created webhook")
+			continue
+		}
+		if err = editHook(cli, segs[0], segs[1], *hook.ID, &github.Hook{Config: s.hookConfig()}); err != nil {
+			return err
+		}
+		log.WithField("repo", r).Info("Moved webhook to new endpoint URL")
+	}
+	return nil
+}
+
+// RotateSecret changes the SecretToken, and the secret of the webhook on each repo, in place. Repos
+// which have no webhook are given a new one. If any webhook can't be changed, those which were are
+// changed back and the SecretToken is left as it was.
+func (s *githubWebhookService) RotateSecret(newSecret string) error {
+	cli, err := s.hookClient()
+	if err != nil {
+		return err
+	}
+	old := s.SecretToken
+	s.SecretToken = secrets.New(newSecret)
+	if err := s.updateHookSecrets(cli, s.repoList()); err != nil {
+		s.SecretToken = old
+		if undoErr := s.updateHookSecrets(cli, s.repoList()); undoErr != nil {
+			log.WithError(undoErr).WithField("service_id", s.id).Error("Failed to change webhook secrets back")
+			ops.Alert("Failed to change the webhook secrets of service %s (github-webhook) back after failing to rotate them: %s",
+				s.id, undoErr)
+		}
+		return err
+	}
+	s.retireSecretToken(old)
+	return nil
+}
+
+// updateHookSecrets sets the config, and so the secret, of the webhook on each repo to this
+// service's. Repos which have no webhook are given a new one.
+func (s *githubWebhookService) updateHookSecrets(cli *github.Client, repos []string) error {
+	for _, r := range repos {
+		segs := strings.Split(r, "/")
+		hook, err := s.findHook(cli, segs[0], segs[1])
+		if err != nil {
+			return err
+		}
+		if hook == nil {
+			if err = s.createHook(cli, r); err != nil {
+				return err
+			}
+			log.WithField("repo", r).Info("Created webhook")
+			continue
+		}
+		if err = editHook(cli, segs[0], segs[1], *hook.ID, &github.Hook{Config: s.hookConfig()}); err != nil {
+			return err
+		}
+		log.WithField("repo", r).Info("Changed webhook secret")
+	}
+	return nil
+}
+
+// missingEvents returns the wanted events which the hook isn't sent.
+func missingEvents(hook *github.Hook, wanted []string) []string {
+	var missing []string
+	for _, ev := range wanted {
+		found := false
+		for _, hookEv := range hook.Events {
+			if hookEv == ev || hookEv == "*" {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, ev)
+		}
+	}
+	return missing
+}
+
+// addHookEvents makes sure that this service's existing webhook on the given repo is sent every
+// event in webhook.Events, along with any others it is already sent, and stores its ID.
+func (s *githubWebhookService) addHookEvents(cli *github.Client, owner, repo string) error {
+	hook, err := s.findHook(cli, owner, repo)
+	if err != nil || hook == nil {
+		return err
+	}
+	s.rememberHook(owner, repo, *hook.ID)
+	missing := missingEvents(hook, webhook.Events)
+	if len(missing) == 0 {
+		return nil
+	}
+	err = editHook(cli, owner, repo, *hook.ID, &github.Hook{
+		Events: append(hook.Events, missing...),
+	})
+	if err == nil {
+		log.WithFields(log.Fields{
+			"repo":   owner + "/" + repo,
+			"events": missing,
+		}).Info("Added events to webhook")
+	}
+	return err
+}
+
 func (s *githubWebhookService) deleteHook(owner, repo string) error {
 	logger := log.WithFields(log.Fields{
 		"endpoint": s.webhookEndpointURL,
@@ -289,19 +992,114 @@ func (s *githubWebhookService) deleteHook(owner, repo string) error {
 	})
 	logger.Info("Removing hook")
 
-	cli := s.githubClientFor(s.ClientUserID, false)
-	if cli == nil {
-		logger.WithField("user_id", s.ClientUserID).Print("Cannot delete webhook: no authenticated client exists for user ID.")
-		return fmt.Errorf("no authenticated client exists for user ID")
+	cli, err := s.hookClient()
+	if err != nil {
+		logger.WithError(err).Print("Cannot delete webhook: no authenticated client")
+		return err
+	}
+
+	hook, err := s.findHook(cli, owner, repo)
+	if err != nil {
+		return err
+	}
+	if hook == nil {
+		return fmt.Errorf("Failed to find hook with endpoint: %s", s.webhookEndpointURL)
+	}
+
+	if repo == orgRepo {
+		_, err = cli.Organizations.DeleteHook(owner, *hook.ID)
+	} else {
+		_, err = cli.Repositories.DeleteHook(owner, repo, *hook.ID)
+	}
+	if err != nil {
+		return err
+	}
+	if err = database.GetServiceDB().DeleteWebhookID(s.id, hookTarget(owner, repo)); err != nil {
+		logger.WithError(err).Warn("Failed to forget webhook ID")
 	}
+	return nil
+}
 
+// editHook edits the webhook on the given repo, or on the owner's organization if the repo is
+// orgRepo.
+func editHook(cli *github.Client, owner, repo string, id int, hook *github.Hook) error {
+	var err error
+	if repo == orgRepo {
+		_, _, err = cli.Organizations.EditHook(owner, id, hook)
+	} else {
+		_, _, err = cli.Repositories.EditHook(owner, repo, id, hook)
+	}
+	return err
+}
+
+// findHook returns this service's webhook on the given repo, or nil if it doesn't have one. It is
+// looked up by the ID stored when it was made, or else, e.g. for webhooks made before IDs were
+// stored, by its endpoint URL.
+func (s *githubWebhookService) findHook(cli *github.Client, owner, repo string) (*github.Hook, error) {
+	return s.findHookAt(cli, owner, repo, s.webhookEndpointURL)
+}
+
+// findHookAt is as findHook, but looks for a webhook sent to the given endpoint URL if there is no
+// stored ID, or the webhook with that ID has been deleted.
+func (s *githubWebhookService) findHookAt(cli *github.Client, owner, repo, endpointURL string) (*github.Hook, error) {
+	hookID, err := database.GetServiceDB().LoadWebhookID(s.id, hookTarget(owner, repo))
+	if err != nil {
+		return nil, err
+	}
+	if id, convErr := strconv.Atoi(hookID); convErr == nil {
+		var hook *github.Hook
+		var res *github.Response
+		if repo == orgRepo {
+			hook, res, err = cli.Organizations.GetHook(owner, id)
+		} else {
+			hook, res, err = cli.Repositories.GetHook(owner, repo, id)
+		}
+		if err == nil {
+			return hook, nil
+		}
+		if res == nil || res.StatusCode != 404 {
+			return nil, err
+		}
+		// It has been deleted on Github.
+	}
+	return findHookWithURL(cli, owner, repo, endpointURL)
+}
+
+// rememberHook stores the ID of this service's webhook on the given repo, so that it can be found
+// by ID rather than by endpoint URL, which other webhooks may share. Failures are logged: the
+// webhook can still be found by URL.
+func (s *githubWebhookService) rememberHook(owner, repo string, id int) {
+	err := database.GetServiceDB().StoreWebhookID(s.id, hookTarget(owner, repo), strconv.Itoa(id))
+	if err != nil {
+		log.WithError(err).WithField("repo", owner+"/"+repo).Warn("Failed to store webhook ID")
+	}
+}
+
+// hookTarget is what the webhook on the given repo, or organization if the repo is orgRepo, is
+// stored as, e.g. "github.com/owner/repo".
+func hookTarget(owner, repo string) string {
+	return "github.com/" + strings.ToLower(owner+"/"+repo)
+}
+
+// findHookWithURL returns the webhook on the given repo, or on the owner's organization if the repo
+// is orgRepo, which is sent to the endpoint URL, or nil if there isn't one.
+func findHookWithURL(cli *github.Client, owner, repo, endpointURL string) (*github.Hook, error) {
+	logger := log.WithFields(log.Fields{
+		"endpoint": endpointURL,
+		"repo":     owner + "/" + repo,
+	})
 	// Get a list of webhooks for this owner/repo and find the one which has the
 	// same endpoint URL which is what github uses to determine equivalence.
-	hooks, _, err := cli.Repositories.ListHooks(owner, repo, nil)
+	var hooks []*github.Hook
+	var err error
+	if repo == orgRepo {
+		hooks, _, err = cli.Organizations.ListHooks(owner, nil)
+	} else {
+		hooks, _, err = cli.Repositories.ListHooks(owner, repo, nil)
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
-	var hook *github.Hook
 	for _, h := range hooks {
 		if h.Config["url"] == nil {
 			logger.Print("Ignoring nil config.url")
@@ -312,17 +1110,11 @@ func (s *githubWebhookService) deleteHook(owner, repo string) error {
 			logger.Print("Ignoring non-string config.url")
 			continue
 		}
-		if hookURL == s.webhookEndpointURL {
-			hook = h
-			break
+		if hookURL == endpointURL {
+			return h, nil
 		}
 	}
-	if hook == nil {
-		return fmt.Errorf("Failed to find hook with endpoint: %s", s.webhookEndpointURL)
-	}
-
-	_, err = cli.Repositories.DeleteHook(owner, repo, *hook.ID)
-	return err
+	return nil, nil
 }
 
 func sameRepos(a *githubWebhookService, b *githubWebhookService) bool {
@@ -357,21 +1149,31 @@ func sameRepos(a *githubWebhookService, b *githubWebhookService) bool {
 }
 
 func (s *githubWebhookService) githubClientFor(userID string, allowUnauth bool) *github.Client {
-	token, err := getTokenForUser(s.RealmID, userID)
+	return githubClientFor(s.RealmID, userID, "admin:repo_hook", allowUnauth)
+}
+
+// hookClient returns a client to manage webhooks with: as the installation of the Github App if
+// RealmID is a github-app realm, or else with ClientUserID's session in the realm.
+func (s *githubWebhookService) hookClient() (*github.Client, error) {
+	realm, err := s.loadRealm()
 	if err != nil {
-		log.WithFields(log.Fields{
-			log.ErrorKey: err,
-			"user_id":    userID,
-			"realm_id":   s.RealmID,
-		}).Print("Failed to get token for user")
-	}
-	if token != "" {
-		return client.New(token)
-	} else if allowUnauth {
-		return client.New("")
-	} else {
-		return nil
+		return nil, err
+	}
+	if app, ok := realm.(*githubapp.GithubAppRealm); ok {
+		cli := client.NewForInstallation(app)
+		if cli.BaseURL, err = url.Parse(app.APIURL + "/"); err != nil {
+			return nil, err
+		}
+		return cli, nil
+	}
+	if s.ClientUserID == "" {
+		return nil, fmt.Errorf("ClientUserID is required unless realm %s is a github-app realm", realm.ID())
 	}
+	cli := s.githubClientFor(s.ClientUserID, false)
+	if cli == nil {
+		return nil, fmt.Errorf("User %s does not have a Github auth session with realm %s.", s.ClientUserID, realm.ID())
+	}
+	return cli, nil
 }
 
 func (s *githubWebhookService) loadRealm() (types.AuthRealm, error) {
@@ -384,8 +1186,11 @@ func (s *githubWebhookService) loadRealm() (types.AuthRealm, error) {
 		return nil, err
 	}
 	// make sure the realm is of the type we expect
-	if realm.Type() != "github" {
-		return nil, fmt.Errorf("Realm is of type '%s', not 'github'", realm.Type())
+	if _, ok := realm.(*githubapp.GithubAppRealm); ok {
+		return realm, nil
+	}
+	if err = checkRealm(realm); err != nil {
+		return nil, err
 	}
 	return realm, nil
 }
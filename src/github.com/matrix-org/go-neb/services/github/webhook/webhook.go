@@ -1,128 +1,701 @@
 package webhook
 
 import (
-	"crypto/hmac"
-	"crypto/sha1"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/google/go-github/github"
 	"github.com/matrix-org/go-neb/errors"
 	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/signatures"
 	"html"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 )
 
-// OnReceiveRequest processes incoming github webhook requests and returns a
-// matrix message to send, along with parsed repo information.
-// The secretToken, if supplied, will be used to verify the request is from
-// Github. If it isn't, an error is returned.
-func OnReceiveRequest(r *http.Request, secretToken string) (string, *github.Repository, *matrix.HTMLMessage, *errors.HTTPError) {
-	// Verify the HMAC signature if NEB was configured with a secret token
-	eventType := r.Header.Get("X-GitHub-Event")
-	signatureSHA1 := r.Header.Get("X-Hub-Signature")
-	content, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		log.WithError(err).Print("Failed to read Github webhook body")
-		return "", nil, nil, &errors.HTTPError{nil, "Failed to parse body", 400}
+// An Event is a Github webhook event, parsed.
+type Event struct {
+	Type   string // The event type, e.g. "push".
+	Repo   *github.Repository
+	Branch string // The branch pushed to, for push events, or which CI ran on, for CI events.
+	// Labels are the names of the labels on the issue or pull request the event is about, if
+	// HasLabels is true. Events about anything else, e.g. pushes, don't have labels.
+	Labels    []string
+	HasLabels bool
+	// Key is what the event is about, e.g. "owner/repo#12" for an issue or pull request and
+	// "owner/repo@master" for a push, so that events about the same thing can be batched. Empty
+	// for events about anything else.
+	Key     string
+	Message *matrix.HTMLMessage
+	// Ping is the Github login of the user the event asks something of: someone assigned an issue
+	// or pull request, or whose review of a pull request was requested. PingMessage tells them so.
+	// Empty for other events.
+	Ping        string
+	PingMessage *matrix.HTMLMessage
+	// CI is how the workflow run or check suite a "workflow_run" or "check_suite" event is about
+	// finished. Nil for other events.
+	CI *CIResult
+	// Tally is set for "star" and "fork" events, which rooms are told about as a count of them
+	// rather than one by one. Nil for other events.
+	Tally *Tally
+}
+
+// A CIResult is how a workflow run or check suite finished.
+type CIResult struct {
+	Name       string // The workflow's name, or that of the app which ran the check suite.
+	Conclusion string // e.g. "success", "failure" or "cancelled".
+}
+
+// A Tally is a new star or fork of a repository.
+type Tally struct {
+	FullName string // The repository's, e.g. "owner/repo".
+	What     string // "star" or "fork".
+	Total    int    // The repository's stars or forks, including this one.
+}
+
+// HTMLMessage describes n new stars or forks in the window, e.g. "5 new stars in the last hour,
+// now 1,234 total".
+func (t *Tally) HTMLMessage(n int, window time.Duration) string {
+	what := t.What
+	if n != 1 {
+		what += "s"
 	}
-	// Verify request if a secret token has been supplied.
-	if secretToken != "" {
-		sigHex := strings.Split(signatureSHA1, "=")[1]
-		var sigBytes []byte
-		sigBytes, err = hex.DecodeString(sigHex)
-		if err != nil {
-			log.WithError(err).WithField("X-Hub-Signature", sigHex).Print(
-				"Failed to decode signature as hex.")
-			return "", nil, nil, &errors.HTTPError{nil, "Failed to decode signature", 400}
+	return fmt.Sprintf(
+		"[<u>%s</u>] %d new %s in the last %s, now %s total",
+		html.EscapeString(t.FullName),
+		n,
+		what,
+		describeWindow(window),
+		formatCount(t.Total),
+	)
+}
+
+// describeWindow describes a window in whole hours or minutes, e.g. "hour" or "30 minutes".
+func describeWindow(d time.Duration) string {
+	if d%time.Hour == 0 {
+		if d == time.Hour {
+			return "hour"
 		}
+		return fmt.Sprintf("%d hours", d/time.Hour)
+	}
+	if d%time.Minute == 0 {
+		if d == time.Minute {
+			return "minute"
+		}
+		return fmt.Sprintf("%d minutes", d/time.Minute)
+	}
+	return d.String()
+}
+
+// formatCount formats n with commas between the thousands, e.g. "1,234".
+func formatCount(n int) string {
+	if n < 0 {
+		return "-" + formatCount(-n)
+	}
+	s := strconv.Itoa(n)
+	for i := len(s) - 3; i > 0; i -= 3 {
+		s = s[:i] + "," + s[i:]
+	}
+	return s
+}
+
+// starEvent is a "star" event. The vendored go-github doesn't have it, so it is picked out directly.
+type starEvent struct {
+	Action string
+	Repo   *github.Repository `json:"repository"`
+	Sender struct {
+		Login string
+	}
+}
+
+// ciEvent is a "workflow_run" or "check_suite" event. The vendored go-github has neither, so they
+// are picked out directly.
+type ciEvent struct {
+	Action      string
+	WorkflowRun *ciRun             `json:"workflow_run"`
+	CheckSuite  *ciRun             `json:"check_suite"`
+	Repo        *github.Repository `json:"repository"`
+}
+
+// ciRun is a workflow run or a check suite.
+type ciRun struct {
+	Name       string // workflow runs only
+	RunNumber  int    `json:"run_number"` // workflow runs only
+	HeadBranch string `json:"head_branch"`
+	HeadSHA    string `json:"head_sha"`
+	Conclusion string
+	HTMLURL    string `json:"html_url"` // workflow runs only
+	Actor      *struct {
+		Login string
+	} // workflow runs only
+	App *struct {
+		Name string
+	} // check suites only
+}
+
+// completed returns the workflow run or check suite, or nil if it hasn't completed.
+func (ev *ciEvent) completed() *ciRun {
+	if ev.Action != "completed" {
+		return nil
+	}
+	if ev.WorkflowRun != nil {
+		return ev.WorkflowRun
+	}
+	return ev.CheckSuite
+}
+
+// name returns the workflow's name, or that of the app which ran the check suite.
+func (r *ciRun) name() string {
+	if r.App != nil {
+		return r.App.Name
+	}
+	return r.Name
+}
 
-		if !checkMAC([]byte(content), sigBytes, []byte(secretToken)) {
-			log.WithFields(log.Fields{
-				"X-Hub-Signature": signatureSHA1,
-			}).Print("Received Github event which failed MAC check.")
-			return "", nil, nil, &errors.HTTPError{nil, "Bad signature", 403}
+// discussionEvent is a "discussion" or "discussion_comment" event. The vendored go-github has
+// neither, so they are picked out directly.
+type discussionEvent struct {
+	Action     string
+	Discussion *struct {
+		Number   int
+		Title    string
+		HTMLURL  string `json:"html_url"`
+		Category struct {
+			Name string
 		}
 	}
+	Comment *struct {
+		HTMLURL string `json:"html_url"`
+	} // discussion comments only
+	Repo   *github.Repository `json:"repository"`
+	Sender struct {
+		Login string
+	}
+}
+
+// OnReceiveRequest processes incoming github webhook requests and returns the
+// event, with a matrix message to send.
+// The first secret token, if supplied, will be used to verify the request is from
+// Github. If it isn't, an error is returned. Requests signed with any of the
+// other tokens, e.g. one being rotated out, are accepted too.
+func OnReceiveRequest(r *http.Request, secretTokens ...string) (*Event, *errors.HTTPError) {
+	eventType := r.Header.Get("X-GitHub-Event")
+	content, httpErr := readBody(r, secretTokens)
+	if httpErr != nil {
+		return nil, httpErr
+	}
 
 	log.WithFields(log.Fields{
 		"event_type": eventType,
-		"signature":  signatureSHA1,
 	}).Print("Received Github event")
 
 	if eventType == "ping" {
 		// Github will send a "ping" event when the webhook is first created. We need
 		// to return a 200 in order for the webhook to be marked as "up" (this doesn't
 		// affect delivery, just the tick/cross status flag).
-		return "", nil, nil, &errors.HTTPError{nil, "pong", 200}
+		return nil, &errors.HTTPError{nil, "pong", 200}
 	}
 
 	htmlStr, repo, err := parseGithubEvent(eventType, content)
 	if err != nil {
 		log.WithError(err).Print("Failed to parse github event")
-		return "", nil, nil, &errors.HTTPError{nil, "Failed to parse github event", 500}
+		return nil, &errors.HTTPError{nil, "Failed to parse github event", 500}
+	}
+	if htmlStr == "" {
+		// e.g. a release being edited, which rooms aren't told about.
+		return nil, &errors.HTTPError{nil, "ignored", 200}
 	}
 
 	msg := matrix.GetHTMLMessage("m.notice", htmlStr)
-	return eventType, repo, &msg, nil
+	ev := &Event{Type: eventType, Repo: repo, Message: &msg}
+	ev.Branch, ev.CI = branchAndCI(eventType, content)
+	ev.Tally = tally(eventType, repo)
+	ev.Labels, ev.HasLabels = labels(eventType, content)
+	ev.Key = eventKey(eventType, content, *repo.FullName, ev.Branch)
+	if login, htmlStr := ping(eventType, content); login != "" {
+		pingMsg := matrix.GetHTMLMessage("m.notice", htmlStr)
+		ev.Ping, ev.PingMessage = login, &pingMsg
+	}
+	return ev, nil
 }
 
-// checkMAC reports whether messageMAC is a valid HMAC tag for message.
-func checkMAC(message, messageMAC, key []byte) bool {
-	mac := hmac.New(sha1.New, key)
-	mac.Write(message)
-	expectedMAC := mac.Sum(nil)
-	return hmac.Equal(messageMAC, expectedMAC)
+// readBody reads the body of the request, verifying it was signed with one of the secret tokens if
+// the first is given.
+func readBody(r *http.Request, secretTokens []string) ([]byte, *errors.HTTPError) {
+	content, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.WithError(err).Print("Failed to read Github webhook body")
+		return nil, &errors.HTTPError{nil, "Failed to parse body", 400}
+	}
+	// Verify request if a secret token has been supplied.
+	if len(secretTokens) > 0 && secretTokens[0] != "" {
+		if err = signatures.VerifyAny(signatures.Github, r.Header, content, secretTokens...); err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"X-Hub-Signature":     r.Header.Get("X-Hub-Signature"),
+				"X-Hub-Signature-256": r.Header.Get("X-Hub-Signature-256"),
+			}).Print("Received Github event which failed signature check.")
+			return nil, &errors.HTTPError{nil, "Bad signature", 403}
+		}
+	}
+	return content, nil
 }
 
-// parseGithubEvent parses a github event type and JSON data and returns an explanatory
-// HTML string and the github repository this event affects, or an error.
-func parseGithubEvent(eventType string, data []byte) (string, *github.Repository, error) {
-	if eventType == "pull_request" {
-		var ev github.PullRequestEvent
-		if err := json.Unmarshal(data, &ev); err != nil {
-			return "", nil, err
-		}
-		return pullRequestHTMLMessage(ev), ev.Repo, nil
-	} else if eventType == "issues" {
-		var ev github.IssuesEvent
-		if err := json.Unmarshal(data, &ev); err != nil {
-			return "", nil, err
+// branchAndCI returns the branch a push or completed CI run is on, and the CI run's result. Returns
+// an empty branch and nil for other events.
+func branchAndCI(eventType string, content []byte) (string, *CIResult) {
+	switch eventType {
+	case "push":
+		var push github.PushEvent
+		if err := json.Unmarshal(content, &push); err == nil && push.Ref != nil {
+			return strings.TrimPrefix(*push.Ref, "refs/heads/"), nil
 		}
-		return issueHTMLMessage(ev), ev.Repo, nil
-	} else if eventType == "push" {
-		var ev github.PushEvent
-		if err := json.Unmarshal(data, &ev); err != nil {
-			return "", nil, err
+	case "workflow_run", "check_suite":
+		var ci ciEvent
+		if err := json.Unmarshal(content, &ci); err == nil && ci.completed() != nil {
+			run := ci.completed()
+			return run.HeadBranch, &CIResult{Name: run.name(), Conclusion: run.Conclusion}
 		}
+	}
+	return "", nil
+}
 
-		// The 'push' event repository format is subtly different from normal, so munge the bits we need.
-		fullName := *ev.Repo.Owner.Name + "/" + *ev.Repo.Name
-		repo := github.Repository{
-			Owner: &github.User{
-				Login: ev.Repo.Owner.Name,
-			},
-			Name:     ev.Repo.Name,
-			FullName: &fullName,
-		}
-		return pushHTMLMessage(ev), &repo, nil
-	} else if eventType == "issue_comment" {
-		var ev github.IssueCommentEvent
-		if err := json.Unmarshal(data, &ev); err != nil {
-			return "", nil, err
-		}
-		return issueCommentHTMLMessage(ev), ev.Repo, nil
-	} else if eventType == "pull_request_review_comment" {
-		var ev github.PullRequestReviewCommentEvent
-		if err := json.Unmarshal(data, &ev); err != nil {
-			return "", nil, err
+// tally returns the repository's count of stars or forks for a star or fork event, or nil for
+// other events.
+func tally(eventType string, repo *github.Repository) *Tally {
+	switch eventType {
+	case "star":
+		// parseGithubEvent checks the repository has a count.
+		return &Tally{FullName: *repo.FullName, What: eventType, Total: *repo.StargazersCount}
+	case "fork":
+		return &Tally{FullName: *repo.FullName, What: eventType, Total: *repo.ForksCount}
+	}
+	return nil
+}
+
+// pingEvent is an issue or pull request event which may ask something of a user. The vendored
+// go-github doesn't have requested reviewers, so they are picked out directly.
+type pingEvent struct {
+	Action            string
+	Assignee          *pingUser
+	RequestedReviewer *pingUser `json:"requested_reviewer"`
+	Sender            pingUser
+	Issue             *pingItem
+	PullRequest       *pingItem `json:"pull_request"`
+	Repository        struct {
+		FullName string `json:"full_name"`
+	}
+}
+
+type pingUser struct {
+	Login string
+}
+
+type pingItem struct {
+	Number  int
+	Title   string
+	HTMLURL string `json:"html_url"`
+}
+
+// request returns the login of the user the event of the given type asks something of, and what
+// it asks of them. Returns an empty login if it doesn't ask anything of anyone.
+func (ev *pingEvent) request(eventType string) (login, what string) {
+	switch {
+	case ev.Action == "assigned" && ev.Assignee != nil:
+		return ev.Assignee.Login, "assigned you"
+	case ev.Action == "review_requested" && eventType == "pull_request" && ev.RequestedReviewer != nil:
+		return ev.RequestedReviewer.Login, "requested your review of"
+	}
+	return "", ""
+}
+
+// item returns the kind of item the event of the given type is about, and the item, which is nil
+// if it isn't about an issue or pull request.
+func (ev *pingEvent) item(eventType string) (string, *pingItem) {
+	switch eventType {
+	case "issues":
+		return "issue", ev.Issue
+	case "pull_request":
+		return "pull request", ev.PullRequest
+	}
+	return "", nil
+}
+
+// ping returns the login of the user the event asks something of, and an HTML message telling them
+// what. Returns an empty login if the event doesn't ask anything of anyone.
+func ping(eventType string, content []byte) (string, string) {
+	var ev pingEvent
+	if err := json.Unmarshal(content, &ev); err != nil {
+		return "", ""
+	}
+	login, what := ev.request(eventType)
+	kind, it := ev.item(eventType)
+	if it == nil || login == "" || login == ev.Sender.Login {
+		// Nobody needs telling what they did themselves.
+		return "", ""
+	}
+	return login, fmt.Sprintf(
+		"[<u>%s</u>] %s %s <b>%s #%d</b>: %s - %s",
+		html.EscapeString(ev.Repository.FullName),
+		html.EscapeString(ev.Sender.Login),
+		what,
+		kind,
+		it.Number,
+		html.EscapeString(it.Title),
+		html.EscapeString(it.HTMLURL),
+	)
+}
+
+// aboutEvent is the parts of an event which say what it is about.
+type aboutEvent struct {
+	Issue *struct {
+		Number int
+	}
+	PullRequest *struct {
+		Number int
+	} `json:"pull_request"`
+	Deployment *struct {
+		ID int
+	}
+	Discussion *struct {
+		Number int
+	}
+	Comment *struct {
+		CommitID string `json:"commit_id"`
+	}
+}
+
+// A keyFunc returns what an event in the repo with the full name is about, or "" if it can't
+// tell.
+type keyFunc func(about *aboutEvent, fullName, branch string) string
+
+// eventKeys returns what each type of event is about. Comments on an issue or pull request are
+// about the same thing as the issue or pull request.
+var eventKeys = map[string]keyFunc{
+	"push":                        branchKey,
+	"workflow_run":                branchKey,
+	"check_suite":                 branchKey,
+	"issues":                      issueKey,
+	"issue_comment":               issueKey,
+	"pull_request":                pullRequestKey,
+	"pull_request_review_comment": pullRequestKey,
+	"discussion":                  discussionKey,
+	"discussion_comment":          discussionKey,
+	"deployment":                  deploymentKey,
+	"deployment_status":           deploymentKey,
+	"commit_comment":              commitKey,
+	"star": func(about *aboutEvent, fullName, branch string) string {
+		return fullName + "/stars"
+	},
+	"fork": func(about *aboutEvent, fullName, branch string) string {
+		return fullName + "/forks"
+	},
+}
+
+// eventKey returns what the event is about, or "" if it can't tell.
+func eventKey(eventType string, content []byte, fullName, branch string) string {
+	key, ok := eventKeys[eventType]
+	if !ok {
+		return ""
+	}
+	var about aboutEvent
+	if err := json.Unmarshal(content, &about); err != nil {
+		return ""
+	}
+	return key(&about, fullName, branch)
+}
+
+func branchKey(about *aboutEvent, fullName, branch string) string {
+	if branch == "" {
+		return ""
+	}
+	return fullName + "@" + branch
+}
+
+func issueKey(about *aboutEvent, fullName, branch string) string {
+	if about.Issue == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s#%d", fullName, about.Issue.Number)
+}
+
+func pullRequestKey(about *aboutEvent, fullName, branch string) string {
+	if about.PullRequest == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s#%d", fullName, about.PullRequest.Number)
+}
+
+func discussionKey(about *aboutEvent, fullName, branch string) string {
+	if about.Discussion == nil {
+		return ""
+	}
+	// Discussions are numbered along with issues and pull requests.
+	return fmt.Sprintf("%s#%d", fullName, about.Discussion.Number)
+}
+
+func deploymentKey(about *aboutEvent, fullName, branch string) string {
+	if about.Deployment == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s/deployments/%d", fullName, about.Deployment.ID)
+}
+
+func commitKey(about *aboutEvent, fullName, branch string) string {
+	if about.Comment == nil || about.Comment.CommitID == "" {
+		return ""
+	}
+	return fullName + "@" + about.Comment.CommitID
+}
+
+// labelledEvent is the labels of the issue, pull request or discussion an event is about. The
+// vendored go-github doesn't have labels on pull requests, so they are picked out directly.
+type labelledEvent struct {
+	Issue *struct {
+		Labels []github.Label
+	}
+	PullRequest *struct {
+		Labels []github.Label
+	} `json:"pull_request"`
+	Discussion *struct {
+		Labels []github.Label
+	}
+}
+
+// labels returns the names of the labels on the issue or pull request an event is about, and
+// false if it isn't about one.
+func labels(eventType string, content []byte) ([]string, bool) {
+	var labelled labelledEvent
+	if err := json.Unmarshal(content, &labelled); err != nil {
+		return nil, false
+	}
+	ls, ok := labelled.labels(eventType)
+	if !ok {
+		return nil, false
+	}
+	var names []string
+	for _, l := range ls {
+		if l.Name != nil {
+			names = append(names, *l.Name)
 		}
-		return prReviewCommentHTMLMessage(ev), ev.Repo, nil
 	}
-	return "", nil, fmt.Errorf("Unrecognized event type")
+	return names, true
+}
+
+// labels returns the labels on what the event of the given type is about, and false if it isn't
+// about an issue, pull request or discussion.
+func (l *labelledEvent) labels(eventType string) ([]github.Label, bool) {
+	switch {
+	case (eventType == "issues" || eventType == "issue_comment") && l.Issue != nil:
+		return l.Issue.Labels, true
+	case (eventType == "pull_request" || eventType == "pull_request_review_comment") && l.PullRequest != nil:
+		return l.PullRequest.Labels, true
+	case (eventType == "discussion" || eventType == "discussion_comment") && l.Discussion != nil:
+		return l.Discussion.Labels, true
+	}
+	return nil, false
+}
+
+// Events are the Github event types which can be sent to rooms.
+var Events = []string{
+	"push", "pull_request", "issues", "issue_comment", "pull_request_review_comment", "release", "create", "delete",
+	"workflow_run", "check_suite", "deployment", "deployment_status", "commit_comment", "discussion",
+	"discussion_comment", "star", "fork",
+}
+
+// maxReleaseNotesLength is the most characters of a release's notes which are included in its
+// notice. Longer notes are cut short: the notice links to the release for the rest.
+const maxReleaseNotesLength = 1000
+
+// An eventParser parses the JSON data of a github event of the given type and returns an
+// explanatory HTML string and the github repository the event affects, or an error.
+type eventParser func(eventType string, data []byte) (string, *github.Repository, error)
+
+// eventParsers are the parsers of each type of github event which rooms can be told about.
+var eventParsers = map[string]eventParser{
+	"pull_request":                parsePullRequestEvent,
+	"issues":                      parseIssuesEvent,
+	"push":                        parsePushEvent,
+	"issue_comment":               parseIssueCommentEvent,
+	"pull_request_review_comment": parsePRReviewCommentEvent,
+	"release":                     parseReleaseEvent,
+	"create":                      parseCreateEvent,
+	"delete":                      parseDeleteEvent,
+	"workflow_run":                parseCIEvent,
+	"check_suite":                 parseCIEvent,
+	"deployment":                  parseDeploymentEvent,
+	"deployment_status":           parseDeploymentStatusEvent,
+	"commit_comment":              parseCommitCommentEvent,
+	"discussion":                  parseDiscussionEvent,
+	"discussion_comment":          parseDiscussionEvent,
+	"star":                        parseStarEvent,
+	"fork":                        parseForkEvent,
+}
+
+// parseGithubEvent parses a github event type and JSON data and returns an explanatory
+// HTML string and the github repository this event affects, or an error.
+func parseGithubEvent(eventType string, data []byte) (string, *github.Repository, error) {
+	parse, ok := eventParsers[eventType]
+	if !ok {
+		return "", nil, fmt.Errorf("Unrecognized event type")
+	}
+	return parse(eventType, data)
+}
+
+func parsePullRequestEvent(eventType string, data []byte) (string, *github.Repository, error) {
+	var ev github.PullRequestEvent
+	if err := json.Unmarshal(data, &ev); err != nil {
+		return "", nil, err
+	}
+	return pullRequestHTMLMessage(ev), ev.Repo, nil
+}
+
+func parseIssuesEvent(eventType string, data []byte) (string, *github.Repository, error) {
+	var ev github.IssuesEvent
+	if err := json.Unmarshal(data, &ev); err != nil {
+		return "", nil, err
+	}
+	return issueHTMLMessage(ev), ev.Repo, nil
+}
+
+func parsePushEvent(eventType string, data []byte) (string, *github.Repository, error) {
+	var ev github.PushEvent
+	if err := json.Unmarshal(data, &ev); err != nil {
+		return "", nil, err
+	}
+
+	// The 'push' event repository format is subtly different from normal, so munge the bits we need.
+	fullName := *ev.Repo.Owner.Name + "/" + *ev.Repo.Name
+	repo := github.Repository{
+		Owner: &github.User{
+			Login: ev.Repo.Owner.Name,
+		},
+		Name:     ev.Repo.Name,
+		FullName: &fullName,
+	}
+	return pushHTMLMessage(ev), &repo, nil
+}
+
+func parseIssueCommentEvent(eventType string, data []byte) (string, *github.Repository, error) {
+	var ev github.IssueCommentEvent
+	if err := json.Unmarshal(data, &ev); err != nil {
+		return "", nil, err
+	}
+	return issueCommentHTMLMessage(ev), ev.Repo, nil
+}
+
+func parsePRReviewCommentEvent(eventType string, data []byte) (string, *github.Repository, error) {
+	var ev github.PullRequestReviewCommentEvent
+	if err := json.Unmarshal(data, &ev); err != nil {
+		return "", nil, err
+	}
+	return prReviewCommentHTMLMessage(ev), ev.Repo, nil
+}
+
+func parseReleaseEvent(eventType string, data []byte) (string, *github.Repository, error) {
+	var ev github.ReleaseEvent
+	if err := json.Unmarshal(data, &ev); err != nil {
+		return "", nil, err
+	}
+	return releaseHTMLMessage(ev), ev.Repo, nil
+}
+
+func parseCreateEvent(eventType string, data []byte) (string, *github.Repository, error) {
+	var ev github.CreateEvent
+	if err := json.Unmarshal(data, &ev); err != nil {
+		return "", nil, err
+	}
+	return createHTMLMessage(ev), ev.Repo, nil
+}
+
+func parseDeleteEvent(eventType string, data []byte) (string, *github.Repository, error) {
+	var ev github.DeleteEvent
+	if err := json.Unmarshal(data, &ev); err != nil {
+		return "", nil, err
+	}
+	return deleteHTMLMessage(ev), ev.Repo, nil
+}
+
+func parseCIEvent(eventType string, data []byte) (string, *github.Repository, error) {
+	var ev ciEvent
+	if err := json.Unmarshal(data, &ev); err != nil {
+		return "", nil, err
+	}
+	if ev.Repo == nil || ev.Repo.FullName == nil {
+		return "", nil, fmt.Errorf("%s event has no repository", eventType)
+	}
+	return ciHTMLMessage(ev), ev.Repo, nil
+}
+
+func parseDeploymentEvent(eventType string, data []byte) (string, *github.Repository, error) {
+	var ev github.DeploymentEvent
+	if err := json.Unmarshal(data, &ev); err != nil {
+		return "", nil, err
+	}
+	return deploymentHTMLMessage(ev), ev.Repo, nil
+}
+
+func parseDeploymentStatusEvent(eventType string, data []byte) (string, *github.Repository, error) {
+	var ev github.DeploymentStatusEvent
+	if err := json.Unmarshal(data, &ev); err != nil {
+		return "", nil, err
+	}
+	return deploymentStatusHTMLMessage(ev), ev.Repo, nil
+}
+
+func parseCommitCommentEvent(eventType string, data []byte) (string, *github.Repository, error) {
+	var ev github.CommitCommentEvent
+	if err := json.Unmarshal(data, &ev); err != nil {
+		return "", nil, err
+	}
+	return commitCommentHTMLMessage(ev), ev.Repo, nil
+}
+
+func parseDiscussionEvent(eventType string, data []byte) (string, *github.Repository, error) {
+	var ev discussionEvent
+	if err := json.Unmarshal(data, &ev); err != nil {
+		return "", nil, err
+	}
+	if ev.Repo == nil || ev.Repo.FullName == nil || ev.Discussion == nil {
+		return "", nil, fmt.Errorf("%s event has no repository or discussion", eventType)
+	}
+	return discussionHTMLMessage(ev), ev.Repo, nil
+}
+
+func parseStarEvent(eventType string, data []byte) (string, *github.Repository, error) {
+	var ev starEvent
+	if err := json.Unmarshal(data, &ev); err != nil {
+		return "", nil, err
+	}
+	if ev.Repo == nil || ev.Repo.FullName == nil || ev.Repo.StargazersCount == nil {
+		return "", nil, fmt.Errorf("star event has no repository or stars")
+	}
+	if ev.Action != "created" {
+		// e.g. an unstar, which rooms aren't told about.
+		return "", ev.Repo, nil
+	}
+	return fmt.Sprintf(
+		"[<u>%s</u>] %s starred the repository",
+		html.EscapeString(*ev.Repo.FullName),
+		html.EscapeString(ev.Sender.Login),
+	), ev.Repo, nil
+}
+
+func parseForkEvent(eventType string, data []byte) (string, *github.Repository, error) {
+	var ev github.ForkEvent
+	if err := json.Unmarshal(data, &ev); err != nil {
+		return "", nil, err
+	}
+	if ev.Repo == nil || ev.Repo.FullName == nil || ev.Repo.ForksCount == nil || ev.Forkee == nil || ev.Forkee.FullName == nil {
+		return "", nil, fmt.Errorf("fork event has no repository or forks")
+	}
+	return fmt.Sprintf(
+		"[<u>%s</u>] forked to %s",
+		html.EscapeString(*ev.Repo.FullName),
+		html.EscapeString(*ev.Forkee.FullName),
+	), ev.Repo, nil
 }
 
 func pullRequestHTMLMessage(p github.PullRequestEvent) string {
@@ -198,6 +771,72 @@ func prReviewCommentHTMLMessage(p github.PullRequestReviewCommentEvent) string {
 	)
 }
 
+// releaseHTMLMessage describes a newly published release, with its notes. Other release actions,
+// e.g. edits, return an empty string.
+func releaseHTMLMessage(p github.ReleaseEvent) string {
+	if p.Action == nil || *p.Action != "published" {
+		return ""
+	}
+	kind := "release"
+	if p.Release.Prerelease != nil && *p.Release.Prerelease {
+		kind = "pre-release"
+	}
+	name := *p.Release.TagName
+	if p.Release.Name != nil && *p.Release.Name != "" && *p.Release.Name != name {
+		name += " (" + *p.Release.Name + ")"
+	}
+	msg := fmt.Sprintf(
+		"[<u>%s</u>] %s published <b>%s %s</b> - %s",
+		html.EscapeString(*p.Repo.FullName),
+		html.EscapeString(*p.Sender.Login),
+		kind,
+		html.EscapeString(name),
+		html.EscapeString(*p.Release.HTMLURL),
+	)
+	if p.Release.Body != nil && strings.TrimSpace(*p.Release.Body) != "" {
+		notes := []rune(strings.TrimSpace(*p.Release.Body))
+		truncated := len(notes) > maxReleaseNotesLength
+		if truncated {
+			notes = notes[:maxReleaseNotesLength]
+		}
+		escaped := html.EscapeString(strings.Replace(string(notes), "\r\n", "\n", -1))
+		if truncated {
+			escaped += "…"
+		}
+		msg += "<br><blockquote>" + strings.Replace(escaped, "\n", "<br>", -1) + "</blockquote>"
+	}
+	return msg
+}
+
+// createHTMLMessage describes a new branch or tag.
+func createHTMLMessage(p github.CreateEvent) string {
+	if *p.RefType == "repository" {
+		return fmt.Sprintf(
+			"[<u>%s</u>] %s created the repository",
+			html.EscapeString(*p.Repo.FullName),
+			html.EscapeString(*p.Sender.Login),
+		)
+	}
+	return fmt.Sprintf(
+		"[<u>%s</u>] %s created <b>%s %s</b>",
+		html.EscapeString(*p.Repo.FullName),
+		html.EscapeString(*p.Sender.Login),
+		html.EscapeString(*p.RefType),
+		html.EscapeString(*p.Ref),
+	)
+}
+
+// deleteHTMLMessage describes a deleted branch or tag.
+func deleteHTMLMessage(p github.DeleteEvent) string {
+	return fmt.Sprintf(
+		`[<u>%s</u>] %s <font color="red">deleted</font> <b>%s %s</b>`,
+		html.EscapeString(*p.Repo.FullName),
+		html.EscapeString(*p.Sender.Login),
+		html.EscapeString(*p.RefType),
+		html.EscapeString(*p.Ref),
+	)
+}
+
 func pushHTMLMessage(p github.PushEvent) string {
 	// /refs/heads/alice/branch-name => alice/branch-name
 	branch := strings.Replace(*p.Ref, "refs/heads/", "", -1)
@@ -247,6 +886,212 @@ func pushHTMLMessage(p github.PushEvent) string {
 	)
 }
 
+// ciConclusions are how to describe the conclusion of a workflow run or check suite, and what colour.
+var ciConclusions = map[string][2]string{
+	"success":         {"passed", "#5cb85c"},
+	"failure":         {"failed", "#d9534f"},
+	"timed_out":       {"timed out", "#d9534f"},
+	"startup_failure": {"failed to start", "#d9534f"},
+	"action_required": {"needs action", "#f0ad4e"},
+	"cancelled":       {"was cancelled", "#777777"},
+	"skipped":         {"was skipped", "#777777"},
+}
+
+// ciHTMLMessage describes how a workflow run or check suite finished, on which branch and commit.
+// Returns "" if it hasn't finished.
+func ciHTMLMessage(ev ciEvent) string {
+	run := ev.completed()
+	if run == nil {
+		// e.g. a workflow run being requested, which rooms aren't told about.
+		return ""
+	}
+	conclusion, ok := ciConclusions[run.Conclusion]
+	if !ok {
+		conclusion = [2]string{strings.Replace(run.Conclusion, "_", " ", -1), "#777777"}
+	}
+	sha := run.HeadSHA
+	if len(sha) > 7 {
+		sha = sha[:7]
+	}
+	what := fmt.Sprintf("<b>%s</b> checks", html.EscapeString(run.name()))
+	link := run.HTMLURL
+	if ev.WorkflowRun != nil {
+		what = fmt.Sprintf("<b>%s</b> #%d", html.EscapeString(run.Name), run.RunNumber)
+	} else if ev.Repo.HTMLURL != nil && run.HeadSHA != "" {
+		link = *ev.Repo.HTMLURL + "/commit/" + run.HeadSHA + "/checks"
+	}
+	where := ""
+	if run.HeadBranch != "" {
+		where = fmt.Sprintf(" on <b>%s</b>", html.EscapeString(run.HeadBranch))
+	}
+	if sha != "" {
+		by := ""
+		if run.Actor != nil && run.Actor.Login != "" {
+			by = " by " + run.Actor.Login
+		}
+		where += fmt.Sprintf(" (%s%s)", html.EscapeString(sha), html.EscapeString(by))
+	}
+	msg := fmt.Sprintf(
+		`[<u>%s</u>] %s <font color="%s">%s</font>%s`,
+		html.EscapeString(*ev.Repo.FullName),
+		what,
+		conclusion[1],
+		conclusion[0],
+		where,
+	)
+	if link != "" {
+		msg += " - " + html.EscapeString(link)
+	}
+	return msg
+}
+
+// commitCommentHTMLMessage describes a new comment on a commit.
+func commitCommentHTMLMessage(p github.CommitCommentEvent) string {
+	if p.Comment == nil || p.Comment.CommitID == nil || p.Comment.User == nil {
+		return ""
+	}
+	sha := *p.Comment.CommitID
+	if len(sha) > 7 {
+		sha = sha[:7]
+	}
+	where := ""
+	if p.Comment.Path != nil && *p.Comment.Path != "" {
+		where = " in " + *p.Comment.Path
+	}
+	msg := fmt.Sprintf(
+		"[<u>%s</u>] %s commented on commit <b>%s</b>%s",
+		html.EscapeString(*p.Repo.FullName),
+		html.EscapeString(*p.Comment.User.Login),
+		html.EscapeString(sha),
+		html.EscapeString(where),
+	)
+	if p.Comment.HTMLURL != nil {
+		msg += " - " + html.EscapeString(*p.Comment.HTMLURL)
+	}
+	return msg
+}
+
+// discussionActions are what the sender of a "discussion" event did, for the actions rooms are told
+// about.
+var discussionActions = map[string]string{
+	"created":  "started",
+	"answered": "marked an answer to",
+	"closed":   "closed",
+	"reopened": "reopened",
+}
+
+// discussionHTMLMessage describes a discussion being started, answered, closed or reopened, or a
+// new comment on it. Returns "" for other actions, e.g. edits.
+func discussionHTMLMessage(p discussionEvent) string {
+	what, link := discussionActions[p.Action], p.Discussion.HTMLURL
+	if p.Comment != nil {
+		what, link = "", p.Comment.HTMLURL
+		if p.Action == "created" {
+			what = "commented on"
+		}
+	}
+	if what == "" {
+		return ""
+	}
+	kind := "discussion"
+	if p.Discussion.Category.Name != "" {
+		kind = p.Discussion.Category.Name + " discussion"
+	}
+	return fmt.Sprintf(
+		"[<u>%s</u>] %s %s <b>%s #%d</b>: %s - %s",
+		html.EscapeString(*p.Repo.FullName),
+		html.EscapeString(p.Sender.Login),
+		what,
+		html.EscapeString(kind),
+		p.Discussion.Number,
+		html.EscapeString(p.Discussion.Title),
+		html.EscapeString(link),
+	)
+}
+
+// deploymentStates are how to describe the state of a deployment, and what colour. Deployments
+// which are "inactive", because a later one to the same environment succeeded, aren't described.
+var deploymentStates = map[string][2]string{
+	"success":     {"succeeded", "#5cb85c"},
+	"failure":     {"failed", "#d9534f"},
+	"error":       {"errored", "#d9534f"},
+	"pending":     {"is pending", "#777777"},
+	"queued":      {"is queued", "#777777"},
+	"in_progress": {"is in progress", "#f0ad4e"},
+}
+
+// deploymentHTMLMessage describes a newly created deployment of a ref to an environment.
+func deploymentHTMLMessage(p github.DeploymentEvent) string {
+	if p.Deployment == nil {
+		return ""
+	}
+	who := "Someone"
+	if p.Sender != nil && p.Sender.Login != nil {
+		who = *p.Sender.Login
+	}
+	return fmt.Sprintf(
+		"[<u>%s</u>] %s is deploying %s%s",
+		html.EscapeString(*p.Repo.FullName),
+		html.EscapeString(who),
+		deploymentHTML(p.Deployment),
+		descriptionHTML(p.Deployment.Description),
+	)
+}
+
+// deploymentStatusHTMLMessage describes a deployment changing state, e.g. succeeding, with where it
+// was deployed to. Returns "" for states rooms aren't told about.
+func deploymentStatusHTMLMessage(p github.DeploymentStatusEvent) string {
+	if p.Deployment == nil || p.DeploymentStatus == nil || p.DeploymentStatus.State == nil {
+		return ""
+	}
+	state, ok := deploymentStates[*p.DeploymentStatus.State]
+	if !ok {
+		return ""
+	}
+	description := p.DeploymentStatus.Description
+	if description == nil || *description == "" {
+		description = p.Deployment.Description
+	}
+	msg := fmt.Sprintf(
+		`[<u>%s</u>] Deployment of %s <font color="%s">%s</font>%s`,
+		html.EscapeString(*p.Repo.FullName),
+		deploymentHTML(p.Deployment),
+		state[1],
+		state[0],
+		descriptionHTML(description),
+	)
+	if p.DeploymentStatus.TargetURL != nil && *p.DeploymentStatus.TargetURL != "" {
+		msg += " - " + html.EscapeString(*p.DeploymentStatus.TargetURL)
+	}
+	return msg
+}
+
+// deploymentHTML describes what a deployment deploys where, e.g. "<b>v1.2</b> (abcdef1) to
+// <b>production</b>".
+func deploymentHTML(d *github.Deployment) string {
+	ref, env := "", "an environment"
+	if d.Ref != nil {
+		ref = *d.Ref
+	}
+	if d.Environment != nil && *d.Environment != "" {
+		env = *d.Environment
+	}
+	desc := fmt.Sprintf("<b>%s</b>", html.EscapeString(ref))
+	if d.SHA != nil && len(*d.SHA) >= 7 && !strings.HasPrefix(*d.SHA, ref) {
+		desc += fmt.Sprintf(" (%s)", html.EscapeString((*d.SHA)[:7]))
+	}
+	return desc + fmt.Sprintf(" to <b>%s</b>", html.EscapeString(env))
+}
+
+// descriptionHTML returns ": " and the description of a deployment or its status, or "" if it has
+// none.
+func descriptionHTML(description *string) string {
+	if description == nil || *description == "" {
+		return ""
+	}
+	return ": " + html.EscapeString(*description)
+}
+
 func nameForAuthor(a *github.CommitAuthor) string {
 	if a == nil {
 		return ""
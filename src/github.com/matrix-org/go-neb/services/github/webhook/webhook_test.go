@@ -1,8 +1,10 @@
 package webhook
 
 import (
+	"net/http"
 	"strings"
 	"testing"
+	"time"
 )
 
 var ghtests = []struct {
@@ -1502,6 +1504,234 @@ var ghtests = []struct {
 		"[<u>matrix-org/synapse</u>] erikjohnston made a line comment on negzi's <b>pull request #860</b> (assignee: None): Fix a bug caused by a change in auth_handler function - https://github.com/matrix-org/synapse/pull/860#discussion_r66413356",
 		"matrix-org/synapse",
 	},
+	{"release",
+		`{
+		  "action": "published",
+		  "release": {
+		    "url": "https://api.github.com/repos/matrix-org/go-neb/releases/1",
+		    "html_url": "https://github.com/matrix-org/go-neb/releases/tag/v0.2.0",
+		    "id": 1,
+		    "tag_name": "v0.2.0",
+		    "target_commitish": "master",
+		    "name": "Go-NEB 0.2.0",
+		    "draft": false,
+		    "prerelease": false,
+		    "body": "Features:\r\n * <b>Webhooks</b> for releases"
+		  },
+		  "repository": {
+		    "id": 2,
+		    "name": "go-neb",
+		    "full_name": "matrix-org/go-neb"
+		  },
+		  "sender": {
+		    "login": "Kegsay",
+		    "id": 3
+		  }
+		}`,
+		`[<u>matrix-org/go-neb</u>] Kegsay published <b>release v0.2.0 (Go-NEB 0.2.0)</b> - https://github.com/matrix-org/go-neb/releases/tag/v0.2.0<br><blockquote>Features:<br> * &lt;b&gt;Webhooks&lt;/b&gt; for releases</blockquote>`,
+		"matrix-org/go-neb",
+	},
+	{"release",
+		`{
+		  "action": "published",
+		  "release": {
+		    "html_url": "https://github.com/matrix-org/go-neb/releases/tag/v0.3.0-rc1",
+		    "tag_name": "v0.3.0-rc1",
+		    "name": "",
+		    "prerelease": true,
+		    "body": ""
+		  },
+		  "repository": {"name": "go-neb", "full_name": "matrix-org/go-neb"},
+		  "sender": {"login": "Kegsay"}
+		}`,
+		`[<u>matrix-org/go-neb</u>] Kegsay published <b>pre-release v0.3.0-rc1</b> - https://github.com/matrix-org/go-neb/releases/tag/v0.3.0-rc1`,
+		"matrix-org/go-neb",
+	},
+	{"release",
+		`{
+		  "action": "edited",
+		  "release": {"html_url": "https://github.com/matrix-org/go-neb/releases/tag/v0.2.0", "tag_name": "v0.2.0"},
+		  "repository": {"name": "go-neb", "full_name": "matrix-org/go-neb"},
+		  "sender": {"login": "Kegsay"}
+		}`,
+		``,
+		"matrix-org/go-neb",
+	},
+	{"create",
+		`{
+		  "ref": "v0.2.0",
+		  "ref_type": "tag",
+		  "master_branch": "master",
+		  "description": "",
+		  "pusher_type": "user",
+		  "repository": {"name": "go-neb", "full_name": "matrix-org/go-neb"},
+		  "sender": {"login": "Kegsay"}
+		}`,
+		`[<u>matrix-org/go-neb</u>] Kegsay created <b>tag v0.2.0</b>`,
+		"matrix-org/go-neb",
+	},
+	{"delete",
+		`{
+		  "ref": "kegan/old-feature",
+		  "ref_type": "branch",
+		  "pusher_type": "user",
+		  "repository": {"name": "go-neb", "full_name": "matrix-org/go-neb"},
+		  "sender": {"login": "Kegsay"}
+		}`,
+		`[<u>matrix-org/go-neb</u>] Kegsay <font color="red">deleted</font> <b>branch kegan/old-feature</b>`,
+		"matrix-org/go-neb",
+	},
+	{"workflow_run",
+		`{
+		  "action": "completed",
+		  "workflow_run": {
+		    "name": "CI",
+		    "run_number": 42,
+		    "head_branch": "main",
+		    "head_sha": "0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c",
+		    "conclusion": "failure",
+		    "html_url": "https://github.com/matrix-org/go-neb/actions/runs/30433642",
+		    "actor": {"login": "Kegsay"}
+		  },
+		  "repository": {"name": "go-neb", "full_name": "matrix-org/go-neb"},
+		  "sender": {"login": "Kegsay"}
+		}`,
+		`[<u>matrix-org/go-neb</u>] <b>CI</b> #42 <font color="#d9534f">failed</font> on <b>main</b> (0d1a26e by Kegsay) - https://github.com/matrix-org/go-neb/actions/runs/30433642`,
+		"matrix-org/go-neb",
+	},
+	{"check_suite",
+		`{
+		  "action": "completed",
+		  "check_suite": {
+		    "head_branch": "release/v1",
+		    "head_sha": "ec26c3e57ca3a959ca5aad62de7213c562f8c821",
+		    "conclusion": "success",
+		    "app": {"name": "Travis CI"}
+		  },
+		  "repository": {"name": "go-neb", "full_name": "matrix-org/go-neb", "html_url": "https://github.com/matrix-org/go-neb"},
+		  "sender": {"login": "Kegsay"}
+		}`,
+		`[<u>matrix-org/go-neb</u>] <b>Travis CI</b> checks <font color="#5cb85c">passed</font> on <b>release/v1</b> (ec26c3e) - https://github.com/matrix-org/go-neb/commit/ec26c3e57ca3a959ca5aad62de7213c562f8c821/checks`,
+		"matrix-org/go-neb",
+	},
+	{"deployment",
+		`{
+		  "deployment": {
+		    "id": 145988746,
+		    "sha": "0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c",
+		    "ref": "main",
+		    "environment": "production",
+		    "description": "Deploy <main>"
+		  },
+		  "repository": {"name": "go-neb", "full_name": "matrix-org/go-neb"},
+		  "sender": {"login": "Kegsay"}
+		}`,
+		`[<u>matrix-org/go-neb</u>] Kegsay is deploying <b>main</b> (0d1a26e) to <b>production</b>: Deploy &lt;main&gt;`,
+		"matrix-org/go-neb",
+	},
+	{"deployment_status",
+		`{
+		  "deployment_status": {
+		    "state": "failure",
+		    "target_url": "https://example.com/deploys/42"
+		  },
+		  "deployment": {
+		    "id": 145988746,
+		    "sha": "0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c",
+		    "ref": "v1.2.0",
+		    "environment": "staging",
+		    "description": "Nightly deploy"
+		  },
+		  "repository": {"name": "go-neb", "full_name": "matrix-org/go-neb"},
+		  "sender": {"login": "Kegsay"}
+		}`,
+		`[<u>matrix-org/go-neb</u>] Deployment of <b>v1.2.0</b> (0d1a26e) to <b>staging</b> <font color="#d9534f">failed</font>: Nightly deploy - https://example.com/deploys/42`,
+		"matrix-org/go-neb",
+	},
+	{"commit_comment",
+		`{
+		  "action": "created",
+		  "comment": {
+		    "html_url": "https://github.com/matrix-org/go-neb/commit/0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c#commitcomment-29970521",
+		    "commit_id": "0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c",
+		    "path": "README.md",
+		    "user": {"login": "Kegsay"},
+		    "body": "Typo here"
+		  },
+		  "repository": {"name": "go-neb", "full_name": "matrix-org/go-neb"},
+		  "sender": {"login": "Kegsay"}
+		}`,
+		`[<u>matrix-org/go-neb</u>] Kegsay commented on commit <b>0d1a26e</b> in README.md - https://github.com/matrix-org/go-neb/commit/0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c#commitcomment-29970521`,
+		"matrix-org/go-neb",
+	},
+	{"discussion",
+		`{
+		  "action": "answered",
+		  "discussion": {
+		    "number": 90,
+		    "title": "How do I <configure> this?",
+		    "html_url": "https://github.com/matrix-org/go-neb/discussions/90",
+		    "category": {"name": "Q&A"}
+		  },
+		  "repository": {"name": "go-neb", "full_name": "matrix-org/go-neb"},
+		  "sender": {"login": "Kegsay"}
+		}`,
+		`[<u>matrix-org/go-neb</u>] Kegsay marked an answer to <b>Q&amp;A discussion #90</b>: How do I &lt;configure&gt; this? - https://github.com/matrix-org/go-neb/discussions/90`,
+		"matrix-org/go-neb",
+	},
+	{"discussion_comment",
+		`{
+		  "action": "created",
+		  "comment": {"html_url": "https://github.com/matrix-org/go-neb/discussions/90#discussioncomment-121"},
+		  "discussion": {
+		    "number": 90,
+		    "title": "Roadmap",
+		    "html_url": "https://github.com/matrix-org/go-neb/discussions/90"
+		  },
+		  "repository": {"name": "go-neb", "full_name": "matrix-org/go-neb"},
+		  "sender": {"login": "Kegsay"}
+		}`,
+		`[<u>matrix-org/go-neb</u>] Kegsay commented on <b>discussion #90</b>: Roadmap - https://github.com/matrix-org/go-neb/discussions/90#discussioncomment-121`,
+		"matrix-org/go-neb",
+	},
+	{"star",
+		`{"action": "created", "repository": {"name": "go-neb", "full_name": "matrix-org/go-neb", "stargazers_count": 1234}, "sender": {"login": "Kegsay"}}`,
+		`[<u>matrix-org/go-neb</u>] Kegsay starred the repository`,
+		"matrix-org/go-neb",
+	},
+	{"fork",
+		`{
+		  "forkee": {"name": "go-neb", "full_name": "Kegsay/go-neb"},
+		  "repository": {"name": "go-neb", "full_name": "matrix-org/go-neb", "forks_count": 210},
+		  "sender": {"login": "Kegsay"}
+		}`,
+		`[<u>matrix-org/go-neb</u>] forked to Kegsay/go-neb`,
+		"matrix-org/go-neb",
+	},
+	// An unstar, which rooms aren't told about
+	{"star",
+		`{"action": "deleted", "repository": {"name": "go-neb", "full_name": "matrix-org/go-neb", "stargazers_count": 1233}, "sender": {"login": "Kegsay"}}`,
+		"",
+		"matrix-org/go-neb",
+	},
+	// An edited discussion, which rooms aren't told about
+	{"discussion",
+		`{"action": "edited", "discussion": {"number": 90}, "repository": {"name": "go-neb", "full_name": "matrix-org/go-neb"}}`,
+		"",
+		"matrix-org/go-neb",
+	},
+	// A deployment superseded by a later one, which rooms aren't told about
+	{"deployment_status",
+		`{"deployment_status": {"state": "inactive"}, "deployment": {"id": 1, "ref": "main"}, "repository": {"name": "go-neb", "full_name": "matrix-org/go-neb"}}`,
+		"",
+		"matrix-org/go-neb",
+	},
+	// A workflow run starting, which rooms aren't told about
+	{"workflow_run",
+		`{"action": "requested", "workflow_run": {"name": "CI"}, "repository": {"name": "go-neb", "full_name": "matrix-org/go-neb"}}`,
+		"",
+		"matrix-org/go-neb",
+	},
 }
 
 func TestParseGithubEvent(t *testing.T) {
@@ -1522,3 +1752,162 @@ func TestParseGithubEvent(t *testing.T) {
 		}
 	}
 }
+
+func TestOnReceiveRequestBranch(t *testing.T) {
+	for _, gh := range ghtests {
+		if gh.eventType != "push" {
+			continue
+		}
+		req, _ := http.NewRequest("POST", "/", strings.NewReader(gh.jsonBody))
+		req.Header.Set("X-GitHub-Event", "push")
+		ev, httpErr := OnReceiveRequest(req, "")
+		if httpErr != nil {
+			t.Fatalf("OnReceiveRequest(push) => %s", httpErr.Message)
+		}
+		if ev.Branch != "develop" {
+			t.Fatalf("OnReceiveRequest(push) => Branch: Want develop got %s", ev.Branch)
+		}
+		if ev.Key != "matrix-org/sytest@develop" {
+			t.Fatalf("OnReceiveRequest(push) => Key: Want matrix-org/sytest@develop got %s", ev.Key)
+		}
+	}
+}
+
+var labeltests = []struct {
+	eventType string
+	jsonBody  string
+	outLabels []string
+	outHas    bool
+}{
+	{"issues", `{"issue":{"labels":[{"name":"bug"},{"name":"P1"}]}}`, []string{"bug", "P1"}, true},
+	{"issue_comment", `{"issue":{"labels":[]}}`, nil, true},
+	{"pull_request", `{"pull_request":{"labels":[{"name":"needs review"}]}}`, []string{"needs review"}, true},
+	{"pull_request_review_comment", `{"pull_request":{}}`, nil, true},
+	{"discussion_comment", `{"discussion":{"labels":[{"name":"question"}]}}`, []string{"question"}, true},
+	{"push", `{"ref":"refs/heads/master"}`, nil, false},
+	{"issues", `{}`, nil, false},
+}
+
+func TestLabels(t *testing.T) {
+	for _, test := range labeltests {
+		outLabels, outHas := labels(test.eventType, []byte(test.jsonBody))
+		if outHas != test.outHas || strings.Join(outLabels, ",") != strings.Join(test.outLabels, ",") {
+			t.Errorf("labels(%s, %s) => Want %v %v got %v %v", test.eventType, test.jsonBody,
+				test.outLabels, test.outHas, outLabels, outHas)
+		}
+	}
+}
+
+var keytests = []struct {
+	eventType string
+	jsonBody  string
+	outKey    string
+}{
+	{"issues", `{"issue":{"number":12}}`, "owner/repo#12"},
+	{"issue_comment", `{"issue":{"number":12}}`, "owner/repo#12"},
+	{"pull_request", `{"number":7,"pull_request":{"number":7}}`, "owner/repo#7"},
+	{"pull_request_review_comment", `{"pull_request":{"number":7}}`, "owner/repo#7"},
+	{"deployment_status", `{"deployment":{"id":145988746},"deployment_status":{"state":"success"}}`, "owner/repo/deployments/145988746"},
+	{"discussion_comment", `{"discussion":{"number":90},"comment":{"id":1}}`, "owner/repo#90"},
+	{"commit_comment", `{"comment":{"commit_id":"0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c"}}`, "owner/repo@0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c"},
+	{"release", `{"release":{}}`, ""},
+}
+
+func TestEventKey(t *testing.T) {
+	for _, test := range keytests {
+		if outKey := eventKey(test.eventType, []byte(test.jsonBody), "owner/repo", ""); outKey != test.outKey {
+			t.Errorf("eventKey(%s, %s) => Want %q got %q", test.eventType, test.jsonBody, test.outKey, outKey)
+		}
+	}
+}
+
+var pingtests = []struct {
+	eventType string
+	jsonBody  string
+	outLogin  string
+	outHTML   string
+}{
+	{"pull_request",
+		`{"action":"review_requested","requested_reviewer":{"login":"bob"},"sender":{"login":"alice"},
+		  "pull_request":{"number":7,"title":"Fix <it>","html_url":"https://github.com/owner/repo/pull/7"},
+		  "repository":{"full_name":"owner/repo"}}`,
+		"bob",
+		`[<u>owner/repo</u>] alice requested your review of <b>pull request #7</b>: Fix &lt;it&gt; - https://github.com/owner/repo/pull/7`},
+	{"issues",
+		`{"action":"assigned","assignee":{"login":"bob"},"sender":{"login":"alice"},
+		  "issue":{"number":12,"title":"Broken","html_url":"https://github.com/owner/repo/issues/12"},
+		  "repository":{"full_name":"owner/repo"}}`,
+		"bob",
+		`[<u>owner/repo</u>] alice assigned you <b>issue #12</b>: Broken - https://github.com/owner/repo/issues/12`},
+	// Assigning yourself
+	{"issues",
+		`{"action":"assigned","assignee":{"login":"alice"},"sender":{"login":"alice"},"issue":{"number":12}}`,
+		"", ""},
+	{"issues", `{"action":"opened","sender":{"login":"alice"},"issue":{"number":12}}`, "", ""},
+	// A team's review requested
+	{"pull_request", `{"action":"review_requested","requested_team":{"name":"t"},"pull_request":{"number":7}}`, "", ""},
+}
+
+func TestPing(t *testing.T) {
+	for _, test := range pingtests {
+		outLogin, outHTML := ping(test.eventType, []byte(test.jsonBody))
+		if outLogin != test.outLogin || outHTML != test.outHTML {
+			t.Errorf("ping(%s, %s) => Want %q %q got %q %q", test.eventType, test.jsonBody,
+				test.outLogin, test.outHTML, outLogin, outHTML)
+		}
+	}
+}
+
+func TestOnReceiveRequestCI(t *testing.T) {
+	for _, gh := range ghtests {
+		if gh.eventType != "workflow_run" && gh.eventType != "check_suite" || gh.outHTML == "" {
+			continue
+		}
+		req, _ := http.NewRequest("POST", "/", strings.NewReader(gh.jsonBody))
+		req.Header.Set("X-GitHub-Event", gh.eventType)
+		ev, httpErr := OnReceiveRequest(req, "")
+		if httpErr != nil {
+			t.Fatalf("OnReceiveRequest(%s) => %s", gh.eventType, httpErr.Message)
+		}
+		if ev.CI == nil || ev.Key != "matrix-org/go-neb@"+ev.Branch {
+			t.Errorf("OnReceiveRequest(%s) => want a CI result keyed by its branch, got %+v", gh.eventType, ev)
+		}
+	}
+	req, _ := http.NewRequest("POST", "/", strings.NewReader(ghtests[len(ghtests)-1].jsonBody))
+	req.Header.Set("X-GitHub-Event", "workflow_run")
+	if _, httpErr := OnReceiveRequest(req, ""); httpErr == nil || httpErr.Code != 200 {
+		t.Errorf("OnReceiveRequest of a requested workflow run => want it ignored, got %v", httpErr)
+	}
+}
+
+func TestTally(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/", strings.NewReader(
+		`{"action": "created", "repository": {"name": "go-neb", "full_name": "matrix-org/go-neb", "stargazers_count": 1234}}`,
+	))
+	req.Header.Set("X-GitHub-Event", "star")
+	ev, httpErr := OnReceiveRequest(req, "")
+	if httpErr != nil {
+		t.Fatalf("OnReceiveRequest(star) => %s", httpErr.Message)
+	}
+	if ev.Tally == nil || ev.Key != "matrix-org/go-neb/stars" {
+		t.Fatalf("OnReceiveRequest(star) => want a tally keyed by the repo's stars, got %+v", ev)
+	}
+	for _, test := range []struct {
+		n      int
+		window time.Duration
+		want   string
+	}{
+		{5, time.Hour, "[<u>matrix-org/go-neb</u>] 5 new stars in the last hour, now 1,234 total"},
+		{1, 6 * time.Hour, "[<u>matrix-org/go-neb</u>] 1 new star in the last 6 hours, now 1,234 total"},
+		{2, 30 * time.Minute, "[<u>matrix-org/go-neb</u>] 2 new stars in the last 30 minutes, now 1,234 total"},
+	} {
+		if got := ev.Tally.HTMLMessage(test.n, test.window); got != test.want {
+			t.Errorf("Tally.HTMLMessage(%d, %s) => want %q got %q", test.n, test.window, test.want, got)
+		}
+	}
+	for n, want := range map[int]string{0: "0", 999: "999", 1000: "1,000", 1234567: "1,234,567", -1234: "-1,234"} {
+		if got := formatCount(n); got != want {
+			t.Errorf("formatCount(%d) => want %q got %q", n, want, got)
+		}
+	}
+}
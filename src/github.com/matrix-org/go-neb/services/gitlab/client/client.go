@@ -0,0 +1,225 @@
+// Package client performs requests against the GitLab v4 API, on gitlab.com or a self-hosted
+// GitLab installation.
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/matrix-org/go-neb/httpclient"
+	"github.com/matrix-org/go-neb/ops"
+	"github.com/matrix-org/go-neb/tokens"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultBaseURL is the base URL of gitlab.com.
+const DefaultBaseURL = "https://gitlab.com"
+
+// A Client performs GitLab API requests, optionally as a user.
+type Client struct {
+	baseURL    string // e.g. "https://gitlab.com", with no trailing slash
+	token      string // the OAuth2 access token to authenticate with, if any
+	httpClient *http.Client
+	onStatus   func(code int) // called with the status code of each response
+}
+
+// An Error is a non-2xx response from the GitLab API.
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("GitLab API error: %d: %s", e.Code, e.Message)
+}
+
+// Project represents a GitLab project with only the keys the end-user is likely to want.
+type Project struct {
+	ID                int    `json:"id"`
+	Name              string `json:"name"`
+	Description       string `json:"description"`
+	PathWithNamespace string `json:"path_with_namespace"` // e.g. "group/subgroup/project"
+	Visibility        string `json:"visibility"`
+	WebURL            string `json:"web_url"`
+}
+
+// New returns a Client for the GitLab installation at baseURL. If token is empty, the client
+// is not authenticated and can only see public projects.
+func New(baseURL, token string) *Client {
+	return &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		token:      token,
+		httpClient: httpclient.New(30 * time.Second),
+	}
+}
+
+// NewForUser returns a Client which performs GitLab API requests with the token of the given
+// user's auth session. If GitLab rejects the token, e.g. because the user revoked it, an
+// operational alert is raised as the user needs to authenticate again, and the session is removed
+// if GitLab keeps rejecting it.
+func NewForUser(baseURL, token, realmID, userID string) *Client {
+	c := New(baseURL, token)
+	if token != "" {
+		c.onStatus = func(code int) {
+			if code != 401 {
+				tokens.Accepted(realmID, userID, token)
+				return
+			}
+			ops.Alert("GitLab rejected the token of %s in realm %s: they need to authenticate again", userID, realmID)
+			tokens.Rejected(realmID, userID, token)
+		}
+	}
+	return c
+}
+
+// Do performs an API request, e.g. Do("GET", "/projects", nil, &projects). The path is relative
+// to /api/v4 and may include a query string. If body is not nil it is sent as JSON. If v is not
+// nil the response body is decoded into it. Returns the response, whose body has been closed,
+// so that callers can read headers such as the pagination ones.
+func (c *Client) Do(method, path string, body, v interface{}) (*http.Response, error) {
+	req, err := c.newRequest(method, path, body)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if c.onStatus != nil {
+		c.onStatus(res.StatusCode)
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return res, responseError(res)
+	}
+	if v != nil {
+		if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+// newRequest returns an API request with the body, if it isn't nil, as JSON.
+func (c *Client) newRequest(method, path string, body interface{}) (*http.Request, error) {
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, c.baseURL+"/api/v4"+path, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return req, nil
+}
+
+// responseError returns an Error with the message in the body of an unsuccessful response.
+func responseError(res *http.Response) *Error {
+	var errBody struct {
+		Message interface{} `json:"message"` // either a string or an object of field errors
+		Error   string      `json:"error"`
+	}
+	b, _ := ioutil.ReadAll(io.LimitReader(res.Body, 64*1024))
+	msg := string(b)
+	if json.Unmarshal(b, &errBody) == nil {
+		if errBody.Message != nil {
+			msg = fmt.Sprint(errBody.Message)
+		} else if errBody.Error != "" {
+			msg = errBody.Error
+		}
+	}
+	return &Error{res.StatusCode, msg}
+}
+
+// ProjectURL returns the URL of the project's page, e.g. "https://gitlab.com/group/project".
+func (c *Client) ProjectURL(project string) string {
+	return c.baseURL + "/" + project
+}
+
+// ListProjects returns every project the user is a member of.
+func (c *Client) ListProjects() ([]Project, error) {
+	var projects []Project
+	page := "1"
+	for page != "" {
+		q := url.Values{"membership": {"true"}, "per_page": {"100"}, "page": {page}}
+		var ps []Project
+		res, err := c.Do("GET", "/projects?"+q.Encode(), nil, &ps)
+		if err != nil {
+			return nil, err
+		}
+		projects = append(projects, ps...)
+		page = res.Header.Get("X-Next-Page")
+	}
+	return projects, nil
+}
+
+// A Hook is a project webhook. Token is only ever sent: GitLab doesn't return it.
+type Hook struct {
+	ID                    int    `json:"id,omitempty"`
+	URL                   string `json:"url"`
+	Token                 string `json:"token,omitempty"`
+	PushEvents            bool   `json:"push_events"`
+	MergeRequestsEvents   bool   `json:"merge_requests_events"`
+	IssuesEvents          bool   `json:"issues_events"`
+	PipelineEvents        bool   `json:"pipeline_events"`
+	EnableSSLVerification bool   `json:"enable_ssl_verification"`
+}
+
+// projectPath returns the API path of a project, given its ID or its path with namespace, e.g.
+// "group/project".
+func projectPath(project string) string {
+	return "/projects/" + url.QueryEscape(project)
+}
+
+// ListHooks returns the webhooks on the project.
+func (c *Client) ListHooks(project string) ([]Hook, error) {
+	var hooks []Hook
+	page := "1"
+	for page != "" {
+		q := url.Values{"per_page": {"100"}, "page": {page}}
+		var hs []Hook
+		res, err := c.Do("GET", projectPath(project)+"/hooks?"+q.Encode(), nil, &hs)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, hs...)
+		page = res.Header.Get("X-Next-Page")
+	}
+	return hooks, nil
+}
+
+// AddHook creates a webhook on the project, returning it with its ID.
+func (c *Client) AddHook(project string, hook *Hook) (*Hook, error) {
+	var created Hook
+	if _, err := c.Do("POST", projectPath(project)+"/hooks", hook, &created); err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+// EditHook replaces the settings of the project's webhook with the hook's ID.
+func (c *Client) EditHook(project string, hook *Hook) error {
+	_, err := c.Do("PUT", fmt.Sprintf("%s/hooks/%d", projectPath(project), hook.ID), hook, nil)
+	return err
+}
+
+// DeleteHook deletes the project's webhook with the given ID.
+func (c *Client) DeleteHook(project string, hookID int) error {
+	_, err := c.Do("DELETE", fmt.Sprintf("%s/hooks/%d", projectPath(project), hookID), nil, nil)
+	return err
+}
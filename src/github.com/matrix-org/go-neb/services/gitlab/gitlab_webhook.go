@@ -0,0 +1,574 @@
+package services
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/batch"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/plugin"
+	"github.com/matrix-org/go-neb/secrets"
+	"github.com/matrix-org/go-neb/server"
+	"github.com/matrix-org/go-neb/services/gitlab/client"
+	"github.com/matrix-org/go-neb/services/gitlab/webhook"
+	"github.com/matrix-org/go-neb/silence"
+	"github.com/matrix-org/go-neb/status"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/go-neb/util"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// gitlabRealm is a realm which holds GitLab tokens: a gitlab realm, or a pat realm whose Provider
+// is gitlab.
+type gitlabRealm interface {
+	GitlabClient(userID string, scopes ...string) (*client.Client, error)
+}
+
+// gitlabWebhookService sends notices about GitLab projects to rooms. It creates a webhook on each
+// project in Rooms, as ClientUserID, and deletes it once no room wants the project.
+type gitlabWebhookService struct {
+	id                 string
+	serviceUserID      string
+	webhookEndpointURL string
+	// ClientUserID is the user whose GitLab session creates the webhooks. They must be able to
+	// manage the webhooks of every project, i.e. be a maintainer of it.
+	ClientUserID string
+	RealmID      string
+	// SecretToken, if set, is given to GitLab when creating webhooks, and requests which don't
+	// carry it in X-Gitlab-Token are rejected.
+	SecretToken secrets.Secret
+	// AllowedIPs are the IP addresses and CIDR ranges GitLab may send webhook requests from.
+	// Optional: requests are allowed from anywhere.
+	AllowedIPs []string
+	// BatchWindow is how long to hold back notifications about a merge request, issue or branch,
+	// e.g. "30s", so that a burst of events about it is sent as one message. Optional: events
+	// are sent as they arrive.
+	BatchWindow string
+	// DigestWindow is how long to hold back notifications for the room's digest, e.g. "5m", so
+	// that a busy project's events are sent as one message along with other services'
+	// held back notifications. Optional: notifications aren't held back for a digest.
+	DigestWindow string
+	// AlertIfQuietFor is how long to go without a webhook from GitLab before alerting the
+	// operators that it is probably broken, e.g. "24h". Optional: they are never alerted.
+	AlertIfQuietFor string
+	Rooms           map[string]struct { // room_id => {}
+		Projects map[string]struct { // group/project => { events: ["push","merge_request"] }
+			Events []string
+		}
+	}
+}
+
+func (s *gitlabWebhookService) ServiceUserID() string { return s.serviceUserID }
+func (s *gitlabWebhookService) ServiceID() string     { return s.id }
+func (s *gitlabWebhookService) ServiceType() string   { return "gitlab-webhook" }
+func (s *gitlabWebhookService) Plugin(cli *matrix.Client, roomID string) plugin.Plugin {
+	return plugin.Plugin{}
+}
+func (s *gitlabWebhookService) WebhookAllowedIPs() []string { return s.AllowedIPs }
+func (s *gitlabWebhookService) QuietPeriod() time.Duration {
+	d, _ := status.ParseQuietPeriod(s.AlertIfQuietFor) // ValidateConfig checks it parses
+	return d
+}
+
+// OnReceiveWebhook sends a notice of the event to each room which wants it. If no room wants the
+// project any more, its webhook is deleted.
+func (s *gitlabWebhookService) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli *matrix.Client) {
+	secretToken := s.SecretToken.Value()
+	if server.IsReplay(req) {
+		// X-Gitlab-Token isn't stored with deliveries. The admin API authenticates replays instead.
+		secretToken = ""
+	}
+	ev, httpErr := webhook.OnReceiveRequest(req, secretToken)
+	if httpErr != nil {
+		if httpErr.Code == 200 {
+			// e.g. a pipeline starting, which rooms aren't told about
+			status.Filtered(s.id)
+		}
+		w.WriteHeader(httpErr.Code)
+		return
+	}
+	logger := server.RequestLogger(req).WithFields(log.Fields{
+		"event":   ev.Type,
+		"project": ev.Project,
+	})
+	sendErrs, projectExistsInConfig, forwarded := s.notifyRooms(cli, ev, logger)
+
+	if forwarded {
+		status.Forwarded(s.id)
+	} else {
+		status.Filtered(s.id)
+	}
+
+	if !projectExistsInConfig {
+		if err := s.deleteHook(ev.Project); err != nil {
+			logger.WithError(err).Print("Failed to delete webhook")
+		} else {
+			logger.Info("Deleted webhook")
+		}
+	}
+
+	if len(sendErrs) > 0 {
+		// So that the event is dead-lettered, to be replayed once the rooms are fixed.
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(200)
+}
+
+// notifyRooms sends a notice of the event to each room which wants it. Returns the errors sending
+// to each room, whether any room has the event's project in its config, even if it doesn't want
+// the event, and whether any room was notified.
+func (s *gitlabWebhookService) notifyRooms(cli *matrix.Client, ev *webhook.Event, logger *log.Entry) (map[string]error, bool, bool) {
+	projectExistsInConfig := false
+	forwarded := false
+	var msgs []batch.Message
+	window, _ := batch.ParseWindow(s.BatchWindow)              // ValidateConfig checks it parses
+	digestWindow, _ := batch.ParseDigestWindow(s.DigestWindow) // ValidateConfig checks it parses
+
+	for roomID, roomConfig := range s.Rooms {
+		for project, projectConfig := range roomConfig.Projects {
+			if !strings.EqualFold(ev.Project, project) {
+				continue
+			}
+			projectExistsInConfig = true // even if we don't notify for it.
+			if !contains(projectConfig.Events, ev.Type) {
+				continue
+			}
+			if silence.Silenced(roomID, ev.Project) {
+				logger.WithField("room_id", roomID).Print("Not notifying room of silenced event")
+				continue
+			}
+			forwarded = true
+			logger.WithFields(log.Fields{
+				"msg":     ev.Message,
+				"room_id": roomID,
+			}).Print("Sending notification to room")
+			if digestWindow > 0 {
+				batch.Digest(cli, s.id, roomID, digestWindow, *ev.Message)
+			} else {
+				msgs = append(msgs, batch.Message{roomID, ev.Key, *ev.Message})
+			}
+		}
+	}
+	sendErrs := batch.SendAll(cli, s.id, window, msgs)
+	for roomID, e := range sendErrs {
+		logger.WithError(e).WithField("room_id", roomID).Print("Failed to send notification to room.")
+	}
+	return sendErrs, projectExistsInConfig, forwarded
+}
+
+// ValidateConfig checks that the required fields are given, that the allowed IPs, batch window and
+// quiet period parse, and that every room ID, project and event type in Rooms is well formed.
+func (s *gitlabWebhookService) ValidateConfig() []types.ConfigError {
+	var errs []types.ConfigError
+	if s.RealmID == "" {
+		errs = append(errs, types.ConfigError{Field: "RealmID", Message: "is required"})
+	}
+	if s.ClientUserID == "" {
+		errs = append(errs, types.ConfigError{Field: "ClientUserID", Message: "is required"})
+	}
+	if _, err := server.ParseAllowlist(s.AllowedIPs); err != nil {
+		errs = append(errs, types.ConfigError{Field: "AllowedIPs", Message: "does not parse: " + err.Error()})
+	}
+	errs = append(errs, s.validateWindows()...)
+	return append(errs, s.validateRooms()...)
+}
+
+// validateWindows checks that the batch and digest windows and the quiet period parse.
+func (s *gitlabWebhookService) validateWindows() []types.ConfigError {
+	var errs []types.ConfigError
+	if _, err := batch.ParseWindow(s.BatchWindow); err != nil {
+		errs = append(errs, types.ConfigError{Field: "BatchWindow", Message: "is not a valid window: " + err.Error()})
+	}
+	if _, err := batch.ParseDigestWindow(s.DigestWindow); err != nil {
+		errs = append(errs, types.ConfigError{Field: "DigestWindow", Message: "is not a valid window: " + err.Error()})
+	}
+	if _, err := status.ParseQuietPeriod(s.AlertIfQuietFor); err != nil {
+		errs = append(errs, types.ConfigError{Field: "AlertIfQuietFor", Message: "is not a valid period: " + err.Error()})
+	}
+	return errs
+}
+
+// validateRooms checks that every room ID, project path and event type in Rooms is well formed.
+func (s *gitlabWebhookService) validateRooms() []types.ConfigError {
+	var errs []types.ConfigError
+	for _, roomID := range util.SortedKeys(s.Rooms) {
+		roomField := fmt.Sprintf("Rooms[%s]", roomID)
+		if !types.IsRoomID(roomID) {
+			errs = append(errs, types.ConfigError{Field: roomField, Message: "is not a room ID"})
+		}
+		roomConfig := s.Rooms[roomID]
+		for _, project := range util.SortedKeys(roomConfig.Projects) {
+			projectField := fmt.Sprintf("%s.Projects[%s]", roomField, project)
+			if !isProjectPath(project) {
+				errs = append(errs, types.ConfigError{Field: projectField, Message: "must be of the form group/project"})
+			}
+			errs = append(errs, validateEvents(projectField, roomConfig.Projects[project].Events)...)
+		}
+	}
+	return errs
+}
+
+// validateEvents checks that the event types of the project with the given field are known.
+func validateEvents(projectField string, events []string) []types.ConfigError {
+	var errs []types.ConfigError
+	for i, ev := range events {
+		if !contains(webhook.Events, ev) {
+			errs = append(errs, types.ConfigError{
+				Field:   fmt.Sprintf("%s.Events[%d]", projectField, i),
+				Message: fmt.Sprintf("is not one of %s", strings.Join(webhook.Events, ", ")),
+			})
+		}
+	}
+	return errs
+}
+
+// isProjectPath returns true if the project is a path with a namespace, e.g. "group/project" or
+// "group/subgroup/project".
+func isProjectPath(project string) bool {
+	segs := strings.Split(project, "/")
+	if len(segs) < 2 {
+		return false
+	}
+	for _, seg := range segs {
+		if seg == "" {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Register creates webhooks on the projects which have been added since the old service, and
+// joins the rooms. As for the github-webhook service, hooks on removed projects are deleted by
+// PostRegister, and toggling a project in the config recreates a hook which was deleted in GitLab.
+func (s *gitlabWebhookService) Register(oldService types.Service, client *matrix.Client) error {
+	cli, newProjects, _, err := s.checkRegister(oldService)
+	if err != nil {
+		return err
+	}
+	for _, p := range newProjects {
+		logger := log.WithField("project", p)
+		if err := s.createHook(cli, p); err != nil {
+			logger.WithError(err).Error("Failed to create webhook")
+			return err
+		}
+		logger.Info("Created webhook")
+	}
+	for roomID := range s.Rooms {
+		if _, err := client.JoinRoom(roomID, "", ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PlanRegister works out which hooks Register would create and PostRegister would delete, and
+// which rooms would be joined.
+func (s *gitlabWebhookService) PlanRegister(oldService types.Service, client *matrix.Client) (*types.RegisterPlan, error) {
+	cli, newProjects, removedProjects, err := s.checkRegister(oldService)
+	if err != nil {
+		return nil, err
+	}
+	plan := &types.RegisterPlan{}
+	for _, p := range newProjects {
+		plan.CreateHooks = append(plan.CreateHooks, hookName(cli, p))
+	}
+	for _, p := range removedProjects {
+		plan.DeleteHooks = append(plan.DeleteHooks, hookName(cli, p))
+	}
+	plan.JoinRooms = types.PlanJoinRooms(client, util.SortedKeys(s.Rooms))
+	if len(s.projectList()) == 0 {
+		plan.Notes = append(plan.Notes, "The service would be deleted as it would have no webhooks")
+	}
+	return plan, nil
+}
+
+// CheckRegistered checks that the service still has a webhook on each project, which is sent the
+// events rooms want from it, and that its client is still in each room.
+func (s *gitlabWebhookService) CheckRegistered(client *matrix.Client) ([]string, error) {
+	cli, _, _, err := s.checkRegister(nil)
+	if err != nil {
+		return nil, err
+	}
+	var problems []string
+	for _, p := range s.projectList() {
+		hook, findErr := findHookWithURL(cli, p, s.webhookEndpointURL)
+		if findErr != nil {
+			problems = append(problems, fmt.Sprintf("Failed to list webhooks on %s: %s", hookName(cli, p), findErr))
+		} else if hook == nil {
+			problems = append(problems, fmt.Sprintf("No webhook on %s", hookName(cli, p)))
+		} else if missing := missingEvents(hook, s.projectEvents(p)); len(missing) > 0 {
+			problems = append(problems, fmt.Sprintf("The webhook on %s is not sent %s events", hookName(cli, p), strings.Join(missing, ", ")))
+		}
+	}
+	problems = append(problems, types.CheckJoinedRooms(client, util.SortedKeys(s.Rooms))...)
+	return problems, nil
+}
+
+// checkRegister validates the service and returns a GitLab client for ClientUserID, along with the
+// projects which have been added and removed since the old service.
+func (s *gitlabWebhookService) checkRegister(oldService types.Service) (cli *client.Client, newProjects, removedProjects []string, err error) {
+	if s.RealmID == "" || s.ClientUserID == "" {
+		err = fmt.Errorf("RealmID and ClientUserID is required")
+		return
+	}
+	if cli, err = s.gitlabClient(); err != nil {
+		return
+	}
+	var oldProjects []string
+	if old, ok := oldService.(*gitlabWebhookService); ok {
+		oldProjects = old.projectList()
+	}
+	projects := s.projectList()
+	newProjects, removedProjects = util.Difference(projects, oldProjects)
+	if len(projects) == 0 && len(removedProjects) == 0 {
+		err = fmt.Errorf("No webhooks specified.")
+	}
+	return
+}
+
+// PostRegister deletes the webhooks on projects which were removed since the old service. If no
+// projects are left, the service is deleted.
+func (s *gitlabWebhookService) PostRegister(oldService types.Service) {
+	var oldProjects []string
+	if old, ok := oldService.(*gitlabWebhookService); ok {
+		oldProjects = old.projectList()
+	}
+	projects := s.projectList()
+	_, removedProjects := util.Difference(projects, oldProjects)
+	for _, p := range removedProjects {
+		if err := s.deleteHook(p); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"project":    p,
+			}).Warn("Failed to remove webhook")
+		}
+	}
+	// This is safe because this is still within the critical section for this service.
+	if len(projects) == 0 {
+		logger := log.WithFields(log.Fields{
+			"service_type": s.ServiceType(),
+			"service_id":   s.ServiceID(),
+		})
+		logger.Info("Removing service as no webhooks are registered.")
+		if err := database.GetServiceDB().DeleteService(s.ServiceID(), "Go-NEB, as no webhooks are registered"); err != nil {
+			logger.WithError(err).Error("Failed to delete service")
+		}
+	}
+}
+
+// Deregister deletes the service's webhook on each project.
+func (s *gitlabWebhookService) Deregister(client *matrix.Client) ([]string, error) {
+	cli, err := s.gitlabClient()
+	if err != nil {
+		return nil, err
+	}
+	var removed, failed []string
+	for _, p := range s.projectList() {
+		if err := s.deleteHook(p); err != nil {
+			failed = append(failed, hookName(cli, p)+": "+err.Error())
+			continue
+		}
+		removed = append(removed, "Deleted webhook on "+hookName(cli, p))
+	}
+	if len(failed) > 0 {
+		return removed, fmt.Errorf("Failed to delete webhooks: %s", strings.Join(failed, "; "))
+	}
+	return removed, nil
+}
+
+// RotateWebhook points the webhook on each project which was sent to the old endpoint URL at the
+// current one. Projects which have no webhook at the old URL are given a new one.
+func (s *gitlabWebhookService) RotateWebhook(oldEndpointURL string) error {
+	cli, err := s.gitlabClient()
+	if err != nil {
+		return err
+	}
+	for _, p := range s.projectList() {
+		hook, err := findHookWithURL(cli, p, oldEndpointURL)
+		if err != nil {
+			return err
+		}
+		if hook == nil {
+			if err = s.createHook(cli, p); err != nil {
+				return err
+			}
+			log.WithField("project", p).Info("Created webhook")
+			continue
+		}
+		if err = cli.EditHook(p, s.hookConfig(hook.ID)); err != nil {
+			return err
+		}
+		log.WithField("project", p).Info("Moved webhook to new endpoint URL")
+	}
+	return nil
+}
+
+// createHook creates this service's webhook on the project, sent every event in webhook.Events.
+// If the project already has one, e.g. because it was made before Go-NEB knew some of the events,
+// it is updated instead.
+func (s *gitlabWebhookService) createHook(cli *client.Client, project string) error {
+	hook, err := findHookWithURL(cli, project, s.webhookEndpointURL)
+	if err != nil {
+		return err
+	}
+	if hook != nil {
+		log.WithField("project", project).Print("Hook already exists")
+		return cli.EditHook(project, s.hookConfig(hook.ID))
+	}
+	_, err = cli.AddHook(project, s.hookConfig(0))
+	return err
+}
+
+// hookConfig returns the settings of this service's webhooks. Hooks are sent every event, since
+// they are filtered when they are received.
+func (s *gitlabWebhookService) hookConfig(id int) *client.Hook {
+	return &client.Hook{
+		ID:                    id,
+		URL:                   s.webhookEndpointURL,
+		Token:                 s.SecretToken.Value(),
+		PushEvents:            true,
+		MergeRequestsEvents:   true,
+		IssuesEvents:          true,
+		PipelineEvents:        true,
+		EnableSSLVerification: true,
+	}
+}
+
+func (s *gitlabWebhookService) deleteHook(project string) error {
+	logger := log.WithFields(log.Fields{
+		"endpoint": s.webhookEndpointURL,
+		"project":  project,
+	})
+	logger.Info("Removing hook")
+	cli, err := s.gitlabClient()
+	if err != nil {
+		return err
+	}
+	hook, err := findHookWithURL(cli, project, s.webhookEndpointURL)
+	if err != nil {
+		return err
+	}
+	if hook == nil {
+		return fmt.Errorf("Failed to find hook with endpoint: %s", s.webhookEndpointURL)
+	}
+	return cli.DeleteHook(project, hook.ID)
+}
+
+// findHookWithURL returns the webhook on the project which is sent to the endpoint URL, or nil if
+// there isn't one.
+func findHookWithURL(cli *client.Client, project, endpointURL string) (*client.Hook, error) {
+	hooks, err := cli.ListHooks(project)
+	if err != nil {
+		return nil, err
+	}
+	for i := range hooks {
+		if hooks[i].URL == endpointURL {
+			return &hooks[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// missingEvents returns the wanted events which the hook isn't sent.
+func missingEvents(hook *client.Hook, wanted []string) []string {
+	sent := map[string]bool{
+		"push":          hook.PushEvents,
+		"merge_request": hook.MergeRequestsEvents,
+		"issue":         hook.IssuesEvents,
+		"pipeline":      hook.PipelineEvents,
+	}
+	var missing []string
+	for _, ev := range wanted {
+		if !sent[ev] {
+			missing = append(missing, ev)
+		}
+	}
+	return missing
+}
+
+// gitlabClient returns a GitLab client for ClientUserID. Their least privileged session with the
+// "api" scope is used, or their default session if none is known to have it.
+func (s *gitlabWebhookService) gitlabClient() (*client.Client, error) {
+	r, err := database.GetServiceDB().LoadAuthRealm(s.RealmID)
+	if err != nil {
+		return nil, err
+	}
+	realm, ok := r.(gitlabRealm)
+	if !ok {
+		return nil, fmt.Errorf("Realm is of type '%s', not 'gitlab' or 'pat'", r.Type())
+	}
+	cli, err := realm.GitlabClient(s.ClientUserID, "api")
+	if err != nil {
+		// e.g. a personal access token from a GitLab version which doesn't report its scopes
+		cli, err = realm.GitlabClient(s.ClientUserID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("User %s does not have a GitLab session with realm %s: %s", s.ClientUserID, s.RealmID, err)
+	}
+	return cli, nil
+}
+
+// hookName names the webhook on the project in plans and problems, e.g. "gitlab.com/group/project".
+func hookName(cli *client.Client, project string) string {
+	u := cli.ProjectURL(project)
+	return u[strings.Index(u, "://")+3:]
+}
+
+// projectEvents returns the events any room wants from the project, sorted.
+func (s *gitlabWebhookService) projectEvents(project string) []string {
+	seen := make(map[string]bool)
+	var events []string
+	for _, roomConfig := range s.Rooms {
+		for _, ev := range roomConfig.Projects[project].Events {
+			if !seen[ev] {
+				seen[ev] = true
+				events = append(events, ev)
+			}
+		}
+	}
+	sort.Strings(events)
+	return events
+}
+
+// projectList returns the projects any room wants, sorted.
+func (s *gitlabWebhookService) projectList() []string {
+	seen := make(map[string]bool)
+	var projects []string
+	for _, roomConfig := range s.Rooms {
+		for project := range roomConfig.Projects {
+			if !isProjectPath(project) {
+				log.WithField("project", project).Error("Bad group/project key in config")
+				continue
+			}
+			if !seen[project] {
+				seen[project] = true
+				projects = append(projects, project)
+			}
+		}
+	}
+	sort.Strings(projects)
+	return projects
+}
+
+func init() {
+	types.RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) types.Service {
+		return &gitlabWebhookService{
+			id:                 serviceID,
+			serviceUserID:      serviceUserID,
+			webhookEndpointURL: webhookEndpointURL,
+		}
+	})
+}
@@ -0,0 +1,286 @@
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/errors"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/signatures"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// An Event is a GitLab webhook event, parsed.
+type Event struct {
+	Type    string // The event's object_kind, e.g. "push".
+	Project string // The path of the project, with its namespace, e.g. "group/project".
+	// Key is what the event is about, e.g. "group/project!12" for a merge request and
+	// "group/project@master" for a push or pipeline, so that events about the same thing can be
+	// batched.
+	Key     string
+	Message *matrix.HTMLMessage
+}
+
+// Events are the GitLab event types which can be sent to rooms.
+var Events = []string{"push", "merge_request", "issue", "pipeline"}
+
+// deletedSHA is the commit a branch is pushed to when it is deleted.
+const deletedSHA = "0000000000000000000000000000000000000000"
+
+type user struct {
+	Username string `json:"username"`
+}
+
+type project struct {
+	PathWithNamespace string `json:"path_with_namespace"`
+	WebURL            string `json:"web_url"`
+}
+
+type pushEvent struct {
+	Ref          string  `json:"ref"`
+	After        string  `json:"after"`
+	UserUsername string  `json:"user_username"`
+	Project      project `json:"project"`
+	Commits      []struct {
+		Message string `json:"message"`
+		URL     string `json:"url"`
+		Author  struct {
+			Name string `json:"name"`
+		} `json:"author"`
+	} `json:"commits"`
+	TotalCommitsCount int `json:"total_commits_count"`
+}
+
+// issuableEvent is a merge request or issue event.
+type issuableEvent struct {
+	User             user    `json:"user"`
+	Project          project `json:"project"`
+	ObjectAttributes struct {
+		IID    int    `json:"iid"`
+		Title  string `json:"title"`
+		State  string `json:"state"`
+		Action string `json:"action"`
+		URL    string `json:"url"`
+	} `json:"object_attributes"`
+}
+
+type pipelineEvent struct {
+	User             user    `json:"user"`
+	Project          project `json:"project"`
+	ObjectAttributes struct {
+		ID       int    `json:"id"`
+		Ref      string `json:"ref"`
+		Tag      bool   `json:"tag"`
+		Status   string `json:"status"`
+		Duration int    `json:"duration"` // in seconds
+	} `json:"object_attributes"`
+}
+
+// OnReceiveRequest processes incoming GitLab webhook requests and returns the event, with a
+// matrix message to send. The secretToken, if supplied, must be the request's X-Gitlab-Token, or
+// an error is returned.
+func OnReceiveRequest(r *http.Request, secretToken string) (*Event, *errors.HTTPError) {
+	content, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.WithError(err).Print("Failed to read GitLab webhook body")
+		return nil, &errors.HTTPError{nil, "Failed to parse body", 400}
+	}
+	if secretToken != "" {
+		if err = signatures.Gitlab.Verify(r.Header, content, secretToken); err != nil {
+			log.WithError(err).Print("Received GitLab event which failed token check.")
+			return nil, &errors.HTTPError{nil, "Bad token", 403}
+		}
+	}
+	var kind struct {
+		ObjectKind string `json:"object_kind"`
+	}
+	if err = json.Unmarshal(content, &kind); err != nil {
+		log.WithError(err).Print("Failed to parse GitLab event")
+		return nil, &errors.HTTPError{nil, "Failed to parse GitLab event", 400}
+	}
+	log.WithFields(log.Fields{
+		"event_type":  r.Header.Get("X-Gitlab-Event"),
+		"object_kind": kind.ObjectKind,
+	}).Print("Received GitLab event")
+
+	ev, err := parseGitlabEvent(kind.ObjectKind, content)
+	if err != nil {
+		log.WithError(err).Print("Failed to parse GitLab event")
+		return nil, &errors.HTTPError{nil, "Failed to parse GitLab event", 400}
+	}
+	if ev == nil {
+		// e.g. a pipeline starting, which rooms aren't told about, or an event type which was
+		// turned on for the hook in GitLab's UI.
+		return nil, &errors.HTTPError{nil, "ignored", 200}
+	}
+	return ev, nil
+}
+
+// parseGitlabEvent parses the JSON of an event with the given object_kind. Returns nil if rooms
+// aren't told about the event.
+func parseGitlabEvent(kind string, data []byte) (*Event, error) {
+	var htmlStr, proj, key string
+	switch kind {
+	case "push":
+		var ev pushEvent
+		if err := json.Unmarshal(data, &ev); err != nil {
+			return nil, err
+		}
+		branch := strings.TrimPrefix(ev.Ref, "refs/heads/")
+		proj, key, htmlStr = ev.Project.PathWithNamespace, ev.Project.PathWithNamespace+"@"+branch, pushHTMLMessage(ev, branch)
+	case "merge_request":
+		var ev issuableEvent
+		if err := json.Unmarshal(data, &ev); err != nil {
+			return nil, err
+		}
+		proj = ev.Project.PathWithNamespace
+		key = fmt.Sprintf("%s!%d", proj, ev.ObjectAttributes.IID)
+		htmlStr = issuableHTMLMessage(ev, fmt.Sprintf("merge request !%d", ev.ObjectAttributes.IID))
+	case "issue":
+		var ev issuableEvent
+		if err := json.Unmarshal(data, &ev); err != nil {
+			return nil, err
+		}
+		proj = ev.Project.PathWithNamespace
+		key = fmt.Sprintf("%s#%d", proj, ev.ObjectAttributes.IID)
+		htmlStr = issuableHTMLMessage(ev, fmt.Sprintf("issue #%d", ev.ObjectAttributes.IID))
+	case "pipeline":
+		var ev pipelineEvent
+		if err := json.Unmarshal(data, &ev); err != nil {
+			return nil, err
+		}
+		proj, key, htmlStr = ev.Project.PathWithNamespace, ev.Project.PathWithNamespace+"@"+ev.ObjectAttributes.Ref, pipelineHTMLMessage(ev)
+	default:
+		return nil, nil
+	}
+	if proj == "" {
+		return nil, fmt.Errorf("%s event has no project", kind)
+	}
+	if htmlStr == "" {
+		return nil, nil
+	}
+	msg := matrix.GetHTMLMessage("m.notice", htmlStr)
+	return &Event{Type: kind, Project: proj, Key: key, Message: &msg}, nil
+}
+
+func pushHTMLMessage(p pushEvent, branch string) string {
+	if p.After == deletedSHA {
+		return fmt.Sprintf(
+			`[<u>%s</u>] %s <font color="red"><b>deleted</font> %s</b>`,
+			html.EscapeString(p.Project.PathWithNamespace),
+			html.EscapeString(p.UserUsername),
+			html.EscapeString(branch),
+		)
+	}
+	if len(p.Commits) == 0 {
+		// e.g. a new branch pointing at an existing commit
+		return fmt.Sprintf(
+			"[<u>%s</u>] %s pushed to <b>%s</b>",
+			html.EscapeString(p.Project.PathWithNamespace),
+			html.EscapeString(p.UserUsername),
+			html.EscapeString(branch),
+		)
+	}
+	// Commits are oldest first. GitLab sends at most 20 of them, with the real count alongside.
+	last := p.Commits[len(p.Commits)-1]
+	if len(p.Commits) == 1 {
+		return fmt.Sprintf(
+			`[<u>%s</u>] %s pushed to <b>%s</b>: %s - %s`,
+			html.EscapeString(p.Project.PathWithNamespace),
+			html.EscapeString(p.UserUsername),
+			html.EscapeString(branch),
+			html.EscapeString(firstLine(last.Message)),
+			html.EscapeString(last.URL),
+		)
+	}
+	var cList []string
+	for _, c := range p.Commits {
+		cList = append(cList, fmt.Sprintf(
+			`%s: %s`,
+			html.EscapeString(c.Author.Name),
+			html.EscapeString(firstLine(c.Message)),
+		))
+	}
+	count := p.TotalCommitsCount
+	if count < len(p.Commits) {
+		count = len(p.Commits)
+	}
+	return fmt.Sprintf(
+		`[<u>%s</u>] %s pushed %d commits to <b>%s</b>: %s<br>%s`,
+		html.EscapeString(p.Project.PathWithNamespace),
+		html.EscapeString(p.UserUsername),
+		count,
+		html.EscapeString(branch),
+		html.EscapeString(last.URL),
+		strings.Join(cList, "<br>"),
+	)
+}
+
+// issuableActions are the past tense of the actions GitLab sends for merge requests and issues.
+var issuableActions = map[string]string{
+	"open":       "opened",
+	"close":      "closed",
+	"reopen":     "reopened",
+	"update":     "updated",
+	"merge":      "merged",
+	"approved":   "approved",
+	"unapproved": "unapproved",
+}
+
+func issuableHTMLMessage(p issuableEvent, what string) string {
+	action, ok := issuableActions[p.ObjectAttributes.Action]
+	if !ok {
+		action = p.ObjectAttributes.Action
+	}
+	return fmt.Sprintf(
+		"[<u>%s</u>] %s %s <b>%s</b>: %s [%s] - %s",
+		html.EscapeString(p.Project.PathWithNamespace),
+		html.EscapeString(p.User.Username),
+		html.EscapeString(action),
+		what,
+		html.EscapeString(p.ObjectAttributes.Title),
+		html.EscapeString(p.ObjectAttributes.State),
+		html.EscapeString(p.ObjectAttributes.URL),
+	)
+}
+
+// pipelineStatuses are how the statuses of finished pipelines are described. Pipelines are sent
+// for every status change, but rooms are only told when they finish.
+var pipelineStatuses = map[string]string{
+	"success":  `<font color="green">passed</font>`,
+	"failed":   `<font color="red">failed</font>`,
+	"canceled": "was canceled",
+}
+
+func pipelineHTMLMessage(p pipelineEvent) string {
+	status, ok := pipelineStatuses[p.ObjectAttributes.Status]
+	if !ok {
+		return ""
+	}
+	kind := "branch"
+	if p.ObjectAttributes.Tag {
+		kind = "tag"
+	}
+	var took string
+	if p.ObjectAttributes.Duration > 0 {
+		took = fmt.Sprintf(" in %s", time.Duration(p.ObjectAttributes.Duration)*time.Second)
+	}
+	return fmt.Sprintf(
+		"[<u>%s</u>] Pipeline #%d for %s <b>%s</b> %s%s - %s",
+		html.EscapeString(p.Project.PathWithNamespace),
+		p.ObjectAttributes.ID,
+		kind,
+		html.EscapeString(p.ObjectAttributes.Ref),
+		status,
+		took,
+		html.EscapeString(fmt.Sprintf("%s/-/pipelines/%d", p.Project.WebURL, p.ObjectAttributes.ID)),
+	)
+}
+
+func firstLine(s string) string {
+	return strings.TrimSpace(strings.SplitN(s, "\n", 2)[0])
+}
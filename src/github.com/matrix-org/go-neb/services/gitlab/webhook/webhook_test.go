@@ -0,0 +1,168 @@
+package webhook
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+var gltests = []struct {
+	kind       string
+	jsonBody   string
+	outHTML    string
+	outProject string
+	outKey     string
+}{
+	{"push",
+		`{
+		  "object_kind": "push",
+		  "before": "95790bf891e76fee5e1747ab589903a6a1f80f22",
+		  "after": "da1560886d4f094c3e6c9ef40349f7d38b5d27d7",
+		  "ref": "refs/heads/master",
+		  "user_name": "John Smith",
+		  "user_username": "jsmith",
+		  "project": {
+		    "name": "Diaspora",
+		    "path_with_namespace": "mike/diaspora",
+		    "web_url": "http://example.com/mike/diaspora"
+		  },
+		  "commits": [
+		    {
+		      "id": "b6568db1bc1dcd7f8b4d5a946b0b91f9dacd7327",
+		      "message": "Update Catalan translation to e38cb41.\n\nSee merge request !1",
+		      "url": "http://example.com/mike/diaspora/commit/b6568db1bc1dcd7f8b4d5a946b0b91f9dacd7327",
+		      "author": {"name": "Jordi Mallach", "email": "jordi@softcatala.org"}
+		    },
+		    {
+		      "id": "da1560886d4f094c3e6c9ef40349f7d38b5d27d7",
+		      "message": "fixed readme",
+		      "url": "http://example.com/mike/diaspora/commit/da1560886d4f094c3e6c9ef40349f7d38b5d27d7",
+		      "author": {"name": "GitLab dev user", "email": "gitlabdev@dv6700.(none)"}
+		    }
+		  ],
+		  "total_commits_count": 4
+		}`,
+		`[<u>mike/diaspora</u>] jsmith pushed 4 commits to <b>master</b>: http://example.com/mike/diaspora/commit/da1560886d4f094c3e6c9ef40349f7d38b5d27d7<br>Jordi Mallach: Update Catalan translation to e38cb41.<br>GitLab dev user: fixed readme`,
+		"mike/diaspora",
+		"mike/diaspora@master",
+	},
+	{"push",
+		`{
+		  "object_kind": "push",
+		  "after": "0000000000000000000000000000000000000000",
+		  "ref": "refs/heads/feature/old",
+		  "user_username": "jsmith",
+		  "project": {"path_with_namespace": "group/sub/project"},
+		  "commits": []
+		}`,
+		`[<u>group/sub/project</u>] jsmith <font color="red"><b>deleted</font> feature/old</b>`,
+		"group/sub/project",
+		"group/sub/project@feature/old",
+	},
+	{"merge_request",
+		`{
+		  "object_kind": "merge_request",
+		  "user": {"name": "Administrator", "username": "root"},
+		  "project": {"path_with_namespace": "gitlabhq/gitlab-test", "web_url": "http://example.com/gitlabhq/gitlab-test"},
+		  "object_attributes": {
+		    "id": 99,
+		    "iid": 1,
+		    "target_branch": "master",
+		    "source_branch": "ms-viewport",
+		    "title": "MS-Viewport <meta>",
+		    "state": "opened",
+		    "action": "open",
+		    "url": "http://example.com/diaspora/merge_requests/1"
+		  },
+		  "labels": [{"title": "API"}]
+		}`,
+		`[<u>gitlabhq/gitlab-test</u>] root opened <b>merge request !1</b>: MS-Viewport &lt;meta&gt; [opened] - http://example.com/diaspora/merge_requests/1`,
+		"gitlabhq/gitlab-test",
+		"gitlabhq/gitlab-test!1",
+	},
+	{"issue",
+		`{
+		  "object_kind": "issue",
+		  "user": {"name": "Administrator", "username": "root"},
+		  "project": {"path_with_namespace": "gitlabhq/gitlab-test"},
+		  "object_attributes": {
+		    "id": 301,
+		    "iid": 23,
+		    "title": "New API: create/update/delete file",
+		    "state": "closed",
+		    "action": "close",
+		    "url": "http://example.com/diaspora/issues/23"
+		  }
+		}`,
+		`[<u>gitlabhq/gitlab-test</u>] root closed <b>issue #23</b>: New API: create/update/delete file [closed] - http://example.com/diaspora/issues/23`,
+		"gitlabhq/gitlab-test",
+		"gitlabhq/gitlab-test#23",
+	},
+	{"pipeline",
+		`{
+		  "object_kind": "pipeline",
+		  "object_attributes": {
+		    "id": 31,
+		    "ref": "master",
+		    "tag": false,
+		    "status": "failed",
+		    "duration": 125
+		  },
+		  "user": {"name": "Administrator", "username": "root"},
+		  "project": {"path_with_namespace": "gitlab-org/gitlab-test", "web_url": "https://example.com/gitlab-org/gitlab-test"}
+		}`,
+		`[<u>gitlab-org/gitlab-test</u>] Pipeline #31 for branch <b>master</b> <font color="red">failed</font> in 2m5s - https://example.com/gitlab-org/gitlab-test/-/pipelines/31`,
+		"gitlab-org/gitlab-test",
+		"gitlab-org/gitlab-test@master",
+	},
+}
+
+func TestParseGitlabEvent(t *testing.T) {
+	for _, gl := range gltests {
+		ev, err := parseGitlabEvent(gl.kind, []byte(gl.jsonBody))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ev == nil {
+			t.Fatalf("parseGitlabEvent(%s) => Event is nil", gl.kind)
+		}
+		if ev.Message.FormattedBody != gl.outHTML {
+			t.Fatalf("parseGitlabEvent(%s) => HTML output does not match. Got:\n%s\n\nExpected:\n%s", gl.kind,
+				ev.Message.FormattedBody, gl.outHTML)
+		}
+		if ev.Project != gl.outProject {
+			t.Fatalf("parseGitlabEvent(%s) => Project: Want %s got %s", gl.kind, gl.outProject, ev.Project)
+		}
+		if ev.Key != gl.outKey {
+			t.Fatalf("parseGitlabEvent(%s) => Key: Want %s got %s", gl.kind, gl.outKey, ev.Key)
+		}
+	}
+}
+
+func TestParseGitlabEventIgnored(t *testing.T) {
+	for kind, body := range map[string]string{
+		"pipeline": `{"object_kind":"pipeline","object_attributes":{"id":1,"status":"running"},"project":{"path_with_namespace":"a/b"}}`,
+		"note":     `{"object_kind":"note","project":{"path_with_namespace":"a/b"}}`,
+	} {
+		if ev, err := parseGitlabEvent(kind, []byte(body)); ev != nil || err != nil {
+			t.Errorf("parseGitlabEvent(%s) => Want nil, nil got %v, %v", kind, ev, err)
+		}
+	}
+}
+
+func TestOnReceiveRequestToken(t *testing.T) {
+	body := `{"object_kind":"issue","project":{"path_with_namespace":"a/b"},"object_attributes":{"iid":1,"action":"open"}}`
+	for token, wantCode := range map[string]int{"s3cret": 0, "wrong": 403, "": 403} {
+		req, _ := http.NewRequest("POST", "/", strings.NewReader(body))
+		req.Header.Set("X-Gitlab-Event", "Issue Hook")
+		if token != "" {
+			req.Header.Set("X-Gitlab-Token", token)
+		}
+		_, httpErr := OnReceiveRequest(req, "s3cret")
+		if wantCode == 0 && httpErr != nil {
+			t.Errorf("OnReceiveRequest with token %q => %d %s", token, httpErr.Code, httpErr.Message)
+		} else if wantCode != 0 && (httpErr == nil || httpErr.Code != wantCode) {
+			t.Errorf("OnReceiveRequest with token %q => Want HTTP %d got %v", token, wantCode, httpErr)
+		}
+	}
+}
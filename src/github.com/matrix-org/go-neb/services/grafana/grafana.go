@@ -0,0 +1,354 @@
+package services
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/batch"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/plugin"
+	"github.com/matrix-org/go-neb/secrets"
+	"github.com/matrix-org/go-neb/server"
+	"github.com/matrix-org/go-neb/status"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/go-neb/util"
+	"html"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxBodySize is the largest webhook request Grafana is expected to send.
+const maxBodySize = 1024 * 1024
+
+// stateColours are the colours alert states are shown in. Other states are left uncoloured.
+var stateColours = map[string]string{
+	"alerting": "#d9534f",
+	"firing":   "#d9534f",
+	"no_data":  "#f0ad4e",
+	"pending":  "#f0ad4e",
+	"ok":       "#5cb85c",
+	"resolved": "#5cb85c",
+}
+
+// grafanaService posts a message to rooms when a Grafana webhook contact point, or a legacy
+// webhook notification channel, sends an alert's state changing.
+type grafanaService struct {
+	id                 string
+	serviceUserID      string
+	webhookEndpointURL string
+	// Token must be sent with every request, as "Authorization: Bearer <token>", as the password
+	// of HTTP basic authentication, or as a ?token= query parameter.
+	Token secrets.Secret
+	// AllowedIPs are the IP addresses and CIDR ranges Grafana may send webhook requests from.
+	// Optional: requests are allowed from anywhere.
+	AllowedIPs []string
+	// BatchWindow is how long to hold back messages about an alert group or rule, e.g. "30s", so
+	// that a flapping alert is sent as one message. Optional: messages are sent as they arrive.
+	BatchWindow string
+	// AlertIfQuietFor is how long to go without a webhook from Grafana before alerting the
+	// operators that it is probably broken, e.g. "1h" with an always firing alert. Optional: they
+	// are never alerted.
+	AlertIfQuietFor string
+	// Rooms are the IDs of the rooms to post messages to.
+	Rooms []string
+}
+
+// grafanaPayload is Grafana's webhook payload. Unified alerting, in Grafana 8 and later, sends
+// Alertmanager's payload with some additions. Legacy alerting sends one rule's state.
+type grafanaPayload struct {
+	// Unified alerting
+	GroupKey    string            `json:"groupKey"`
+	GroupLabels map[string]string `json:"groupLabels"`
+	Alerts      []grafanaAlert    `json:"alerts"`
+	// Legacy alerting
+	RuleID      int64  `json:"ruleId"`
+	RuleName    string `json:"ruleName"`
+	RuleURL     string `json:"ruleUrl"`
+	State       string `json:"state"` // "ok", "alerting", "no_data", "pending" or "paused"
+	Message     string `json:"message"`
+	ImageURL    string `json:"imageUrl"`
+	EvalMatches []struct {
+		Metric string      `json:"metric"`
+		Value  json.Number `json:"value"`
+	} `json:"evalMatches"`
+}
+
+type grafanaAlert struct {
+	Status       string            `json:"status"` // "firing" or "resolved"
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations"`
+	GeneratorURL string            `json:"generatorURL"`
+	DashboardURL string            `json:"dashboardURL"`
+	PanelURL     string            `json:"panelURL"`
+	ImageURL     string            `json:"imageURL"`
+}
+
+func (s *grafanaService) ServiceUserID() string { return s.serviceUserID }
+func (s *grafanaService) ServiceID() string     { return s.id }
+func (s *grafanaService) ServiceType() string   { return "grafana" }
+func (s *grafanaService) Plugin(cli *matrix.Client, roomID string) plugin.Plugin {
+	return plugin.Plugin{}
+}
+func (s *grafanaService) WebhookAllowedIPs() []string { return s.AllowedIPs }
+func (s *grafanaService) QuietPeriod() time.Duration {
+	d, _ := status.ParseQuietPeriod(s.AlertIfQuietFor) // ValidateConfig checks it parses
+	return d
+}
+
+// OnReceiveWebhook sends a message about the alerts to each room.
+func (s *grafanaService) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli *matrix.Client) {
+	logger := server.RequestLogger(req)
+	if !s.authorised(req) {
+		w.WriteHeader(401)
+		return
+	}
+	if req.Method != "POST" {
+		w.WriteHeader(405)
+		return
+	}
+	var p grafanaPayload
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxBodySize)).Decode(&p); err != nil {
+		logger.WithError(err).Print("Failed to decode Grafana webhook")
+		w.WriteHeader(400)
+		return
+	}
+	var key string
+	var msg matrix.HTMLMessage
+	switch {
+	case len(p.Alerts) > 0:
+		key = p.GroupKey
+		msg = unifiedMessage(p)
+	case p.RuleName != "":
+		key = fmt.Sprintf("rule %d", p.RuleID)
+		msg = legacyMessage(p)
+	default:
+		// e.g. Grafana testing the contact point with no alerts
+		logger.Print("Grafana webhook has no alerts")
+		status.Filtered(s.id)
+		w.WriteHeader(200)
+		return
+	}
+	logger = logger.WithField("key", key)
+
+	msgs := make([]batch.Message, len(s.Rooms))
+	for i, roomID := range s.Rooms {
+		logger.WithField("room_id", roomID).Print("Sending alerts to room")
+		msgs[i] = batch.Message{roomID, key, msg}
+	}
+	status.Forwarded(s.id)
+	window, _ := batch.ParseWindow(s.BatchWindow) // ValidateConfig checks it parses
+	sendErrs := batch.SendAll(cli, s.id, window, msgs)
+	for roomID, e := range sendErrs {
+		logger.WithError(e).WithField("room_id", roomID).Print("Failed to send notification to room.")
+	}
+	if len(sendErrs) > 0 {
+		// So that the request is dead-lettered, to be replayed once the rooms are fixed.
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(200)
+}
+
+// authorised returns true if the request carries the service's token. Legacy notification
+// channels can only send it with basic authentication, whose username is ignored. Replays, which
+// the token isn't stored with, are authorised too.
+func (s *grafanaService) authorised(req *http.Request) bool {
+	if server.IsReplay(req) {
+		return true
+	}
+	token := req.URL.Query().Get("token")
+	if _, password, ok := req.BasicAuth(); ok {
+		token = password
+	} else if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	want := s.Token.Value()
+	return want != "" && subtle.ConstantTimeCompare([]byte(token), []byte(want)) == 1
+}
+
+// unifiedMessage writes a message about a unified alerting notification, headed by how many
+// alerts are firing and resolved and the group's labels, with a line for each alert.
+func unifiedMessage(p grafanaPayload) matrix.HTMLMessage {
+	var firing, resolved int
+	for _, a := range p.Alerts {
+		if a.Status == "resolved" {
+			resolved++
+		} else {
+			firing++
+		}
+	}
+	var counts []string
+	if firing > 0 {
+		counts = append(counts, fmt.Sprintf("FIRING:%d", firing))
+	}
+	if resolved > 0 {
+		counts = append(counts, fmt.Sprintf("RESOLVED:%d", resolved))
+	}
+	header := fmt.Sprintf("[%s]", strings.Join(counts, ", "))
+	if groupLabels := labelString(p.GroupLabels); groupLabels != "" {
+		header += " " + groupLabels
+	}
+	bodies := []string{header}
+	htmls := []string{"<b>" + html.EscapeString(header) + "</b>"}
+	for _, a := range p.Alerts {
+		state := "firing"
+		if a.Status == "resolved" {
+			state = "resolved"
+		}
+		summary := a.Annotations["summary"]
+		if summary == "" {
+			summary = a.Annotations["description"]
+		}
+		source := a.PanelURL
+		if source == "" {
+			source = a.DashboardURL
+		}
+		if source == "" {
+			source = a.GeneratorURL
+		}
+		body, htmlBody := alertLine(state, a.Labels["alertname"], "", summary)
+		body, htmlBody = addLinks(body, htmlBody, source, a.ImageURL)
+		bodies = append(bodies, body)
+		htmls = append(htmls, htmlBody)
+	}
+	return matrix.HTMLMessage{
+		Body:          strings.Join(bodies, "\n"),
+		MsgType:       "m.notice",
+		Format:        "org.matrix.custom.html",
+		FormattedBody: strings.Join(htmls, "<br>"),
+	}
+}
+
+// legacyMessage writes a message about a legacy alert rule's state, with the values which made it
+// fire.
+func legacyMessage(p grafanaPayload) matrix.HTMLMessage {
+	var matches []string
+	for _, m := range p.EvalMatches {
+		matches = append(matches, fmt.Sprintf("%s=%s", m.Metric, m.Value))
+	}
+	body, htmlBody := alertLine(p.State, p.RuleName, p.RuleURL, p.Message)
+	if len(matches) > 0 {
+		body += " (" + strings.Join(matches, ", ") + ")"
+		htmlBody += " (" + html.EscapeString(strings.Join(matches, ", ")) + ")"
+	}
+	body, htmlBody = addLinks(body, htmlBody, p.RuleURL, p.ImageURL)
+	return matrix.HTMLMessage{
+		Body:          body,
+		MsgType:       "m.notice",
+		Format:        "org.matrix.custom.html",
+		FormattedBody: htmlBody,
+	}
+}
+
+// alertLine writes an alert's state, coloured, its name, linked to if there is a URL, and its
+// summary.
+func alertLine(state, name, url, summary string) (string, string) {
+	body := fmt.Sprintf("[%s] %s", state, name)
+	nameHTML := html.EscapeString(name)
+	if url != "" {
+		nameHTML = fmt.Sprintf(`<a href="%s">%s</a>`, html.EscapeString(url), nameHTML)
+	}
+	htmlBody := fmt.Sprintf("[%s] <b>%s</b>", html.EscapeString(state), nameHTML)
+	if colour := stateColours[state]; colour != "" {
+		htmlBody = fmt.Sprintf(`<font color="%s">[%s]</font> <b>%s</b>`, colour, html.EscapeString(state), nameHTML)
+	}
+	if summary != "" {
+		body += ": " + summary
+		htmlBody += ": " + html.EscapeString(summary)
+	}
+	return body, htmlBody
+}
+
+// addLinks adds links to the alert's source, to the plain text body only if the HTML already
+// links to it, and to its panel's image.
+func addLinks(body, htmlBody, source, image string) (string, string) {
+	if source != "" {
+		body += " - " + source
+		if !strings.Contains(htmlBody, `href="`+html.EscapeString(source)+`"`) {
+			htmlBody += fmt.Sprintf(` (<a href="%s">source</a>)`, html.EscapeString(source))
+		}
+	}
+	if image != "" {
+		body += " - image: " + image
+		htmlBody += fmt.Sprintf(` (<a href="%s">panel image</a>)`, html.EscapeString(image))
+	}
+	return body, htmlBody
+}
+
+// labelString writes labels as "name=value" pairs, sorted by name.
+func labelString(labels map[string]string) string {
+	names := util.SortedKeys(labels)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + "=" + labels[name]
+	}
+	return strings.Join(pairs, ", ")
+}
+
+// ValidateConfig checks that the token is given, that the allowed IPs, batch window and quiet
+// period parse, and that there is at least one room and every room ID is well formed.
+func (s *grafanaService) ValidateConfig() []types.ConfigError {
+	var errs []types.ConfigError
+	if s.Token.Value() == "" {
+		errs = append(errs, types.ConfigError{Field: "Token", Message: "is required"})
+	}
+	if _, err := server.ParseAllowlist(s.AllowedIPs); err != nil {
+		errs = append(errs, types.ConfigError{Field: "AllowedIPs", Message: "does not parse: " + err.Error()})
+	}
+	if _, err := batch.ParseWindow(s.BatchWindow); err != nil {
+		errs = append(errs, types.ConfigError{Field: "BatchWindow", Message: "is not a valid window: " + err.Error()})
+	}
+	if _, err := status.ParseQuietPeriod(s.AlertIfQuietFor); err != nil {
+		errs = append(errs, types.ConfigError{Field: "AlertIfQuietFor", Message: "is not a valid period: " + err.Error()})
+	}
+	if len(s.Rooms) == 0 {
+		errs = append(errs, types.ConfigError{Field: "Rooms", Message: "must list at least one room"})
+	}
+	for i, roomID := range s.Rooms {
+		if !types.IsRoomID(roomID) {
+			errs = append(errs, types.ConfigError{Field: fmt.Sprintf("Rooms[%d]", i), Message: "is not a room ID"})
+		}
+	}
+	return errs
+}
+
+// Register joins the rooms messages are posted to.
+func (s *grafanaService) Register(oldService types.Service, client *matrix.Client) error {
+	for _, roomID := range s.Rooms {
+		if _, err := client.JoinRoom(roomID, "", ""); err != nil {
+			return err
+		}
+	}
+	log.WithFields(log.Fields{
+		"service_id": s.id,
+		"url":        s.webhookEndpointURL,
+	}).Info("Registered Grafana webhook: add the URL to a webhook contact point in Grafana")
+	return nil
+}
+
+// PlanRegister works out which rooms Register would join, and notes the contact point Grafana
+// needs.
+func (s *grafanaService) PlanRegister(oldService types.Service, client *matrix.Client) (*types.RegisterPlan, error) {
+	plan := &types.RegisterPlan{JoinRooms: types.PlanJoinRooms(client, s.Rooms)}
+	plan.Notes = []string{"Grafana must be given a webhook contact point to " + s.webhookEndpointURL}
+	return plan, nil
+}
+
+// CheckRegistered checks that the service's client is still in each room alerts are posted to.
+func (s *grafanaService) CheckRegistered(client *matrix.Client) ([]string, error) {
+	return types.CheckJoinedRooms(client, s.Rooms), nil
+}
+
+func (s *grafanaService) PostRegister(oldService types.Service) {}
+
+func init() {
+	types.RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) types.Service {
+		return &grafanaService{
+			id:                 serviceID,
+			serviceUserID:      serviceUserID,
+			webhookEndpointURL: webhookEndpointURL,
+		}
+	})
+}
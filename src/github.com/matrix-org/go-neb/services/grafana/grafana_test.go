@@ -0,0 +1,115 @@
+package services
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+const unifiedAlert = `{
+  "receiver": "matrix",
+  "status": "firing",
+  "orgId": 1,
+  "alerts": [
+    {
+      "status": "firing",
+      "labels": {"alertname": "High memory usage", "team": "blue"},
+      "annotations": {"summary": "Memory is <90%> used"},
+      "generatorURL": "https://grafana.example.com/alerting/1afz29v7z/edit",
+      "panelURL": "https://grafana.example.com/d/abc?viewPanel=2",
+      "imageURL": "https://grafana.example.com/public/img/attachments/a.png"
+    },
+    {
+      "status": "resolved",
+      "labels": {"alertname": "Disk full"},
+      "annotations": {"description": "Disk has space again"},
+      "generatorURL": "https://grafana.example.com/alerting/2/edit"
+    }
+  ],
+  "groupLabels": {"team": "blue"},
+  "groupKey": "{}:{team=\"blue\"}",
+  "title": "[FIRING:1, RESOLVED:1] (blue)",
+  "state": "alerting"
+}`
+
+const legacyAlert = `{
+  "dashboardId": 1,
+  "evalMatches": [{"value": 100, "metric": "High value", "tags": null}, {"value": 200.5, "metric": "Higher value", "tags": null}],
+  "imageUrl": "https://grafana.example.com/render/panel.png",
+  "message": "Someone is testing the alert notification within Grafana.",
+  "orgId": 0,
+  "panelId": 1,
+  "ruleId": 7,
+  "ruleName": "Test notification",
+  "ruleUrl": "https://grafana.example.com/d/abc?panelId=1",
+  "state": "alerting",
+  "title": "[Alerting] Test notification"
+}`
+
+func TestUnifiedMessage(t *testing.T) {
+	var p grafanaPayload
+	if err := json.Unmarshal([]byte(unifiedAlert), &p); err != nil {
+		t.Fatal(err)
+	}
+	msg := unifiedMessage(p)
+	wantBody := "[FIRING:1, RESOLVED:1] team=blue\n" +
+		"[firing] High memory usage: Memory is <90%> used - https://grafana.example.com/d/abc?viewPanel=2 - image: https://grafana.example.com/public/img/attachments/a.png\n" +
+		"[resolved] Disk full: Disk has space again - https://grafana.example.com/alerting/2/edit"
+	if msg.Body != wantBody {
+		t.Errorf("unifiedMessage body => want %q got %q", wantBody, msg.Body)
+	}
+	wantHTML := "<b>[FIRING:1, RESOLVED:1] team=blue</b><br>" +
+		`<font color="#d9534f">[firing]</font> <b>High memory usage</b>: Memory is &lt;90%&gt; used (<a href="https://grafana.example.com/d/abc?viewPanel=2">source</a>)` +
+		` (<a href="https://grafana.example.com/public/img/attachments/a.png">panel image</a>)<br>` +
+		`<font color="#5cb85c">[resolved]</font> <b>Disk full</b>: Disk has space again (<a href="https://grafana.example.com/alerting/2/edit">source</a>)`
+	if msg.FormattedBody != wantHTML {
+		t.Errorf("unifiedMessage HTML => want %q got %q", wantHTML, msg.FormattedBody)
+	}
+}
+
+func TestLegacyMessage(t *testing.T) {
+	var p grafanaPayload
+	if err := json.Unmarshal([]byte(legacyAlert), &p); err != nil {
+		t.Fatal(err)
+	}
+	msg := legacyMessage(p)
+	wantBody := "[alerting] Test notification: Someone is testing the alert notification within Grafana. (High value=100, Higher value=200.5)" +
+		" - https://grafana.example.com/d/abc?panelId=1 - image: https://grafana.example.com/render/panel.png"
+	if msg.Body != wantBody {
+		t.Errorf("legacyMessage body => want %q got %q", wantBody, msg.Body)
+	}
+	wantHTML := `<font color="#d9534f">[alerting]</font> <b><a href="https://grafana.example.com/d/abc?panelId=1">Test notification</a></b>: ` +
+		"Someone is testing the alert notification within Grafana. (High value=100, Higher value=200.5)" +
+		` (<a href="https://grafana.example.com/render/panel.png">panel image</a>)`
+	if msg.FormattedBody != wantHTML {
+		t.Errorf("legacyMessage HTML => want %q got %q", wantHTML, msg.FormattedBody)
+	}
+}
+
+func TestAuthorised(t *testing.T) {
+	var s grafanaService
+	if err := json.Unmarshal([]byte(`{"Token": "secret"}`), &s); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		url    string
+		header string
+		want   bool
+	}{
+		{"/?token=secret", "", true},
+		{"/", "Bearer secret", true},
+		{"/", "Basic Z3JhZmFuYTpzZWNyZXQ=", true},  // grafana:secret
+		{"/", "Basic Z3JhZmFuYTp3cm9uZw==", false}, // grafana:wrong
+		{"/?token=secret", "Basic Z3JhZmFuYTp3cm9uZw==", false},
+		{"/", "Bearer wrong", false},
+		{"/", "", false},
+	} {
+		req := httptest.NewRequest("POST", test.url, nil)
+		if test.header != "" {
+			req.Header.Set("Authorization", test.header)
+		}
+		if got := s.authorised(req); got != test.want {
+			t.Errorf("authorised(%s, %q) => want %t got %t", test.url, test.header, test.want, got)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/httpclient"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/plugin"
+	"github.com/matrix-org/go-neb/secrets"
+	"github.com/matrix-org/go-neb/types"
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+	"net/http"
+	"strings"
+)
+
+// apiURL is Guggy's text-to-GIF endpoint. It is a variable so that tests can point it elsewhere.
+var apiURL = "https://text2gif.guggy.com/guggify"
+
+type guggyQuery struct {
+	// "gif" or "mp4"
+	Format string `json:"format"`
+	// The text to find a reaction to
+	Sentence string `json:"sentence"`
+}
+
+type guggyGifResult struct {
+	ReqID  string  `json:"reqId"`
+	GIF    string  `json:"gif"`
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+}
+
+type guggyService struct {
+	id            string
+	serviceUserID string
+	APIKey        secrets.Secret
+	// CommandPrefixes are what commands start with in each room, e.g. {"!foo:bar": "?"}, so that
+	// several bots in a room can be told apart. Optional: in other rooms commands start with "!".
+	CommandPrefixes map[string]string
+}
+
+func (s *guggyService) ServiceUserID() string { return s.serviceUserID }
+func (s *guggyService) ServiceID() string     { return s.id }
+func (s *guggyService) ServiceType() string   { return "guggy" }
+func (s *guggyService) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli *matrix.Client) {
+}
+func (s *guggyService) ValidateConfig() []types.ConfigError {
+	errs := types.ValidateCommandPrefixes(s.CommandPrefixes)
+	if s.APIKey.Value() == "" {
+		errs = append(errs, types.ConfigError{Field: "APIKey", Message: "is required"})
+	}
+	return errs
+}
+func (s *guggyService) Register(oldService types.Service, client *matrix.Client) error { return nil }
+func (s *guggyService) PostRegister(oldService types.Service)                          {}
+
+func (s *guggyService) Plugin(client *matrix.Client, roomID string) plugin.Plugin {
+	return plugin.Plugin{
+		Prefix: s.CommandPrefixes[roomID],
+		Commands: []plugin.Command{
+			plugin.Command{
+				Path:      []string{"guggy"},
+				Arguments: []string{"text"},
+				Help:      "Respond to the text with a reaction sticker from Guggy",
+				ContextCommand: func(ctx context.Context, roomID, userID string, args []string) (interface{}, error) {
+					return s.cmdGuggy(ctx, client, roomID, userID, args)
+				},
+			},
+		},
+	}
+}
+
+// cmdGuggy responds with a sticker of the GIF Guggy chooses as a reaction to the text.
+func (s *guggyService) cmdGuggy(ctx context.Context, client *matrix.Client, roomID, userID string, args []string) (interface{}, error) {
+	query := strings.Join(args, " ")
+	if query == "" {
+		return matrix.TextMessage{"m.notice", "Usage: !guggy <text>"}, nil
+	}
+	gifResult, err := s.text2gifGuggy(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	mxc, err := client.UploadLink(gifResult.GIF)
+	if err != nil {
+		return nil, err
+	}
+
+	return matrix.StickerMessage{
+		Body: query,
+		URL:  mxc,
+		Info: matrix.ImageInfo{
+			Height:   uint(gifResult.Height),
+			Width:    uint(gifResult.Width),
+			Mimetype: "image/gif",
+		},
+	}, nil
+}
+
+// text2gifGuggy returns the GIF Guggy chooses for the text.
+func (s *guggyService) text2gifGuggy(ctx context.Context, querySentence string) (*guggyGifResult, error) {
+	log.Info("Transforming to GIF query ", querySentence)
+	body, err := json.Marshal(guggyQuery{Format: "gif", Sentence: querySentence})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", apiURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("apiKey", s.APIKey.Value())
+	res, err := ctxhttp.Do(ctx, httpclient.Default, req)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("Guggy returned HTTP %d", res.StatusCode)
+	}
+	var result guggyGifResult
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	if result.GIF == "" {
+		return nil, errors.New("No results")
+	}
+	return &result, nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) types.Service {
+		return &guggyService{
+			id:            serviceID,
+			serviceUserID: serviceUserID,
+		}
+	})
+}
@@ -0,0 +1,61 @@
+package services
+
+import (
+	"encoding/json"
+	"github.com/matrix-org/go-neb/matrix"
+	"golang.org/x/net/context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestCmdGuggy(t *testing.T) {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/guggify":
+			var q guggyQuery
+			json.NewDecoder(req.Body).Decode(&q)
+			if req.Header.Get("apiKey") != "key" || q.Sentence != "so happy" || q.Format != "gif" {
+				w.WriteHeader(400)
+				return
+			}
+			json.NewEncoder(w).Encode(guggyGifResult{ReqID: "1", GIF: srv.URL + "/happy.gif", Width: 300, Height: 200})
+		case "/happy.gif":
+			w.Header().Set("Content-Type", "image/gif")
+			w.Write([]byte("GIF89a"))
+		case "/_matrix/media/r0/upload":
+			w.Write([]byte(`{"content_uri":"mxc://x/happy"}`))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer srv.Close()
+	apiURL = srv.URL + "/guggify"
+	defer func() { apiURL = "https://text2gif.guggy.com/guggify" }()
+
+	var s guggyService
+	if err := json.Unmarshal([]byte(`{"APIKey":"key"}`), &s); err != nil {
+		t.Fatal(err)
+	}
+	hsURL, _ := url.Parse(srv.URL)
+	cli := matrix.NewClient(hsURL, "token", "@neb:x")
+
+	content, err := s.cmdGuggy(context.Background(), cli, "!r:x", "@u:x", []string{"so", "happy"})
+	if err != nil {
+		t.Fatalf("cmdGuggy => want a sticker, got error %s", err)
+	}
+	want := matrix.StickerMessage{
+		Body: "so happy",
+		URL:  "mxc://x/happy",
+		Info: matrix.ImageInfo{Height: 200, Width: 300, Mimetype: "image/gif"},
+	}
+	if content != want {
+		t.Errorf("cmdGuggy => want %+v, got %+v", want, content)
+	}
+
+	if _, err = s.cmdGuggy(context.Background(), cli, "!r:x", "@u:x", []string{"so", "sad"}); err == nil {
+		t.Error("cmdGuggy rejected by Guggy => want an error, got nil")
+	}
+}
@@ -6,29 +6,51 @@ import (
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/andygrunwald/go-jira"
+	"github.com/matrix-org/go-neb/batch"
 	"github.com/matrix-org/go-neb/database"
 	"github.com/matrix-org/go-neb/matrix"
 	"github.com/matrix-org/go-neb/plugin"
 	"github.com/matrix-org/go-neb/realms/jira"
 	"github.com/matrix-org/go-neb/realms/jira/urls"
+	"github.com/matrix-org/go-neb/server"
 	"github.com/matrix-org/go-neb/services/jira/webhook"
+	"github.com/matrix-org/go-neb/status"
 	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/go-neb/util"
 	"html"
 	"net/http"
 	"regexp"
+	"sort"
 	"strings"
+	"time"
 )
 
 // Matches alphas then a -, then a number. E.g "FOO-123"
 var issueKeyRegex = regexp.MustCompile("([A-z]+)-([0-9]+)")
 var projectKeyRegex = regexp.MustCompile("^[A-z]+$")
+var issueKeyOnlyRegex = regexp.MustCompile("^[A-Za-z]+-[0-9]+$")
+
+// maxCommentLength is how much of a comment is quoted in notifications about it, in characters.
+const maxCommentLength = 300
 
 type jiraService struct {
 	id                 string
 	serviceUserID      string
 	webhookEndpointURL string
 	ClientUserID       string
-	Rooms              map[string]struct { // room_id => {}
+	// AllowedIPs are the IP addresses and CIDR ranges JIRA may send webhook requests from.
+	// Optional: requests are allowed from anywhere.
+	AllowedIPs []string
+	// BatchWindow is how long to hold back notifications about an issue, e.g. "30s", so that a
+	// burst of events about it is sent as one message. Optional: events are sent as they arrive.
+	BatchWindow string
+	// AlertIfQuietFor is how long to go without a webhook from JIRA before alerting the operators
+	// that it is probably broken, e.g. "24h". Optional: they are never alerted.
+	AlertIfQuietFor string
+	// CommandPrefixes are what commands start with in each room, e.g. {"!foo:bar": "?"}, so that
+	// several bots in a room can be told apart. Optional: in other rooms commands start with "!".
+	CommandPrefixes map[string]string
+	Rooms           map[string]struct { // room_id => {}
 		Realms map[string]struct { // realm_id => {}  Determines the JIRA endpoint
 			Projects map[string]struct { // SYN => {}
 				Expand bool
@@ -42,6 +64,71 @@ func (s *jiraService) ServiceUserID() string                 { return s.serviceU
 func (s *jiraService) ServiceID() string                     { return s.id }
 func (s *jiraService) ServiceType() string                   { return "jira" }
 func (s *jiraService) PostRegister(oldService types.Service) {}
+func (s *jiraService) WebhookAllowedIPs() []string           { return s.AllowedIPs }
+func (s *jiraService) QuietPeriod() time.Duration {
+	d, _ := status.ParseQuietPeriod(s.AlertIfQuietFor) // ValidateConfig checks it parses
+	return d
+}
+
+// ValidateConfig checks that every room ID, realm ID and project key in Rooms is well formed, that
+// a ClientUserID is given if any project is tracked, and that the allowed IPs, batch window and
+// quiet period parse.
+func (s *jiraService) ValidateConfig() []types.ConfigError {
+	errs := types.ValidateCommandPrefixes(s.CommandPrefixes)
+	if s.ClientUserID == "" && len(projectsAndRealmsToTrack(s)) > 0 {
+		errs = append(errs, types.ConfigError{Field: "ClientUserID", Message: "is required to track projects"})
+	}
+	if _, err := batch.ParseWindow(s.BatchWindow); err != nil {
+		errs = append(errs, types.ConfigError{Field: "BatchWindow", Message: "is not a valid window: " + err.Error()})
+	}
+	if _, err := status.ParseQuietPeriod(s.AlertIfQuietFor); err != nil {
+		errs = append(errs, types.ConfigError{Field: "AlertIfQuietFor", Message: "is not a valid period: " + err.Error()})
+	}
+	if _, err := server.ParseAllowlist(s.AllowedIPs); err != nil {
+		errs = append(errs, types.ConfigError{Field: "AllowedIPs", Message: "does not parse: " + err.Error()})
+	}
+	return append(errs, s.validateRooms()...)
+}
+
+// validateRooms checks that every room ID, realm ID and project key in Rooms is well formed.
+func (s *jiraService) validateRooms() []types.ConfigError {
+	var errs []types.ConfigError
+	for _, roomID := range util.SortedKeys(s.Rooms) {
+		roomField := fmt.Sprintf("Rooms[%s]", roomID)
+		if !types.IsRoomID(roomID) {
+			errs = append(errs, types.ConfigError{Field: roomField, Message: "is not a room ID"})
+		}
+		for _, realmID := range util.SortedKeys(s.Rooms[roomID].Realms) {
+			realmField := fmt.Sprintf("%s.Realms[%s]", roomField, realmID)
+			if realmID == "" {
+				errs = append(errs, types.ConfigError{Field: realmField, Message: "is not a realm ID"})
+			}
+			var pkeys []string
+			for pkey := range s.Rooms[roomID].Realms[realmID].Projects {
+				pkeys = append(pkeys, pkey)
+			}
+			errs = append(errs, validateProjectKeys(realmField, pkeys)...)
+		}
+	}
+	return errs
+}
+
+// validateProjectKeys checks that the project keys of the realm with the given field are well
+// formed.
+func validateProjectKeys(realmField string, pkeys []string) []types.ConfigError {
+	var errs []types.ConfigError
+	sort.Strings(pkeys)
+	for _, pkey := range pkeys {
+		if !projectKeyRegex.MatchString(pkey) {
+			errs = append(errs, types.ConfigError{
+				Field:   fmt.Sprintf("%s.Projects[%s]", realmField, pkey),
+				Message: "is not a project key, e.g. SYN",
+			})
+		}
+	}
+	return errs
+}
+
 func (s *jiraService) Register(oldService types.Service, client *matrix.Client) error {
 	// We only ever make 1 JIRA webhook which listens for all projects and then filter
 	// on receive. So we simply need to know if we need to make a webhook or not. We
@@ -63,6 +150,62 @@ func (s *jiraService) Register(oldService types.Service, client *matrix.Client)
 	return nil
 }
 
+// RotateWebhook moves the webhook on each JIRA installation to the service's new endpoint URL.
+func (s *jiraService) RotateWebhook(oldEndpointURL string) error {
+	for realmID := range projectsAndRealmsToTrack(s) {
+		realm, err := database.GetServiceDB().LoadAuthRealm(realmID)
+		if err != nil {
+			return err
+		}
+		jrealm, ok := realm.(*realms.JIRARealm)
+		if !ok {
+			return errors.New("Realm ID doesn't map to a JIRA realm")
+		}
+		if err = webhook.MoveHook(jrealm, s.ClientUserID, oldEndpointURL, s.webhookEndpointURL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PlanRegister checks that ClientUserID may track the configured projects, and works out whether a
+// webhook would need to be created on each JIRA installation.
+func (s *jiraService) PlanRegister(oldService types.Service, client *matrix.Client) (*types.RegisterPlan, error) {
+	plan := &types.RegisterPlan{}
+	for realmID, pkeys := range projectsAndRealmsToTrack(s) {
+		realm, err := database.GetServiceDB().LoadAuthRealm(realmID)
+		if err != nil {
+			return nil, err
+		}
+		jrealm, ok := realm.(*realms.JIRARealm)
+		if !ok {
+			return nil, errors.New("Realm ID doesn't map to a JIRA realm")
+		}
+
+		create, err := webhook.CheckHook(jrealm, pkeys, s.ClientUserID, s.webhookEndpointURL)
+		if err != nil {
+			return nil, err
+		}
+		if create {
+			plan.CreateHooks = append(plan.CreateHooks, jrealm.JIRAEndpoint)
+		}
+	}
+	return plan, nil
+}
+
+// CheckRegistered checks that each JIRA installation still has a webhook for Go-NEB.
+func (s *jiraService) CheckRegistered(client *matrix.Client) ([]string, error) {
+	plan, err := s.PlanRegister(nil, client)
+	if err != nil {
+		return nil, err
+	}
+	var problems []string
+	for _, endpoint := range plan.CreateHooks {
+		problems = append(problems, "No webhook on "+endpoint)
+	}
+	return problems, nil
+}
+
 func (s *jiraService) cmdJiraCreate(roomID, userID string, args []string) (interface{}, error) {
 	// E.g jira create PROJ "Issue title" "Issue desc"
 	if len(args) <= 1 {
@@ -112,7 +255,7 @@ func (s *jiraService) cmdJiraCreate(roomID, userID string, args []string) (inter
 			return matrix.StarterLinkMessage{
 				Body: fmt.Sprintf(
 					"You need to OAuth with JIRA on %s before you can create issues.",
-					r.JIRAEndpoint,
+					r.Endpoint,
 				),
 				Link: r.StarterLink,
 			}, nil
@@ -135,7 +278,7 @@ func (s *jiraService) cmdJiraCreate(roomID, userID string, args []string) (inter
 
 	return &matrix.TextMessage{
 		"m.notice",
-		fmt.Sprintf("Created issue: %sbrowse/%s", r.JIRAEndpoint, i.Key),
+		fmt.Sprintf("Created issue: %sbrowse/%s", r.Endpoint, i.Key),
 	}, nil
 }
 
@@ -154,7 +297,7 @@ func (s *jiraService) expandIssue(roomID, userID string, issueKeyGroups []string
 		return nil
 	}
 
-	r, err := database.GetServiceDB().LoadAuthRealm(realmID)
+	jrealm, err := loadJIRARealm(realmID)
 	if err != nil {
 		logger.WithFields(log.Fields{
 			"realm_id":   realmID,
@@ -162,21 +305,7 @@ func (s *jiraService) expandIssue(roomID, userID string, issueKeyGroups []string
 		}).Print("Failed to load realm")
 		return nil
 	}
-	jrealm, ok := r.(*realms.JIRARealm)
-	if !ok {
-		logger.WithField("realm_id", realmID).Print(
-			"Realm cannot be typecast to JIRARealm",
-		)
-	}
-	logger.WithFields(log.Fields{
-		"room_id": roomID,
-		"user_id": s.ClientUserID,
-	}).Print("Expanding issue")
-
-	// Use the person who *provisioned* the service to check for project keys
-	// rather than the person who mentioned the issue key, as it is unlikely
-	// some random who mentioned the issue will have the intended auth.
-	cli, err := jrealm.JIRAClient(s.ClientUserID, false)
+	cli, clientUserID, err := s.clientFor(jrealm, userID)
 	if err != nil {
 		logger.WithFields(log.Fields{
 			log.ErrorKey: err,
@@ -184,6 +313,10 @@ func (s *jiraService) expandIssue(roomID, userID string, issueKeyGroups []string
 		}).Print("Failed to retrieve client")
 		return nil
 	}
+	logger.WithFields(log.Fields{
+		"room_id": roomID,
+		"user_id": clientUserID,
+	}).Print("Expanding issue")
 
 	issue, _, err := cli.Issue.Get(issueKey)
 	if err != nil {
@@ -194,16 +327,91 @@ func (s *jiraService) expandIssue(roomID, userID string, issueKeyGroups []string
 		"m.notice",
 		fmt.Sprintf(
 			"%sbrowse/%s : %s",
-			jrealm.JIRAEndpoint, issueKey, htmlSummaryForIssue(issue),
+			jrealm.Endpoint, issueKey, htmlSummaryForIssue(issue),
 		),
 	)
 }
 
+// clientFor returns a client which acts as the user if they have authenticated with the realm, so
+// that they only see issues they are allowed to. Otherwise it acts as the person who *provisioned*
+// the service, as it is unlikely some random who mentioned the issue will have the intended auth.
+// Also returns the ID of the user it acts as.
+func (s *jiraService) clientFor(jrealm *jiraRealm, userID string) (*jira.Client, string, error) {
+	cli, err := jrealm.JIRAClient(userID, false)
+	if err == nil {
+		return cli, userID, nil
+	}
+	cli, err = jrealm.JIRAClient(s.ClientUserID, false)
+	return cli, s.ClientUserID, err
+}
+
+func (s *jiraService) cmdJiraShow(roomID, userID string, args []string) (interface{}, error) {
+	// E.g jira SYN-123
+	if len(args) != 1 || !issueKeyOnlyRegex.MatchString(args[0]) {
+		return nil, errors.New("Usage: !jira ISSUE-123")
+	}
+	issueKey := strings.ToUpper(args[0])
+	pkey := strings.Split(issueKey, "-")[0]
+	logger := log.WithFields(log.Fields{
+		"issue_key": issueKey,
+		"room_id":   roomID,
+		"user_id":   userID,
+	})
+
+	var jrealm *jiraRealm
+	var err error
+	if realmID := s.realmIDForRoomProject(roomID, pkey); realmID != "" {
+		jrealm, err = loadJIRARealm(realmID)
+	} else {
+		jrealm, err = s.projectToRealm(userID, pkey)
+	}
+	if err != nil {
+		logger.WithError(err).Print("Failed to map project key to realm")
+		return nil, errors.New("Failed to map project key to a JIRA endpoint.")
+	}
+	if jrealm == nil {
+		return nil, errors.New("No known project exists with that project key.")
+	}
+	cli, _, err := s.clientFor(jrealm, userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return matrix.StarterLinkMessage{
+				Body: fmt.Sprintf(
+					"You need to log in to JIRA on %s before you can look up issues.",
+					jrealm.Endpoint,
+				),
+				Link: jrealm.StarterLink,
+			}, nil
+		}
+		return nil, err
+	}
+	issue, res, err := cli.Issue.Get(issueKey)
+	if err != nil {
+		if res != nil && res.StatusCode == 404 {
+			return nil, fmt.Errorf("%s does not exist, or you can't see it.", issueKey)
+		}
+		logger.WithError(err).Print("Failed to GET issue")
+		return nil, errors.New("Failed to fetch issue")
+	}
+	return matrix.GetHTMLMessage("m.notice", htmlDetailsForIssue(issue, jrealm.Endpoint)), nil
+}
+
 func (s *jiraService) Plugin(cli *matrix.Client, roomID string) plugin.Plugin {
 	return plugin.Plugin{
+		Prefix: s.CommandPrefixes[roomID],
 		Commands: []plugin.Command{
 			plugin.Command{
-				Path: []string{"jira", "create"},
+				Path:      []string{"jira"},
+				Arguments: []string{"issue"},
+				Help:      "Show a JIRA issue, e.g. ABC-123",
+				Command: func(roomID, userID string, args []string) (interface{}, error) {
+					return s.cmdJiraShow(roomID, userID, args)
+				},
+			},
+			plugin.Command{
+				Path:      []string{"jira", "create"},
+				Arguments: []string{"project", "title", "[description]"},
+				Help:      "Create a JIRA issue in the project, e.g. ABC",
 				Command: func(roomID, userID string, args []string) (interface{}, error) {
 					return s.cmdJiraCreate(roomID, userID, args)
 				},
@@ -221,46 +429,61 @@ func (s *jiraService) Plugin(cli *matrix.Client, roomID string) plugin.Plugin {
 }
 
 func (s *jiraService) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli *matrix.Client) {
+	logger := server.RequestLogger(req)
 	eventProjectKey, event, httpErr := webhook.OnReceiveRequest(req)
 	if httpErr != nil {
-		log.WithError(httpErr).Print("Failed to handle JIRA webhook")
+		logger.WithError(httpErr).Print("Failed to handle JIRA webhook")
 		w.WriteHeader(500)
 		return
 	}
 	// grab base jira url
 	jurl, err := urls.ParseJIRAURL(event.Issue.Self)
 	if err != nil {
-		log.WithError(err).Print("Failed to parse base JIRA URL")
+		logger.WithError(err).Print("Failed to parse base JIRA URL")
 		w.WriteHeader(500)
 		return
 	}
 	// work out the HTML to send
 	htmlText := htmlForEvent(event, jurl.Base)
 	if htmlText == "" {
-		log.WithField("project", eventProjectKey).Print("Unable to process event for project")
+		logger.WithField("project", eventProjectKey).Print("Unable to process event for project")
+		status.Filtered(s.id)
 		w.WriteHeader(200)
 		return
 	}
 	// send message into each configured room
+	forwarded := false
+	var msgs []batch.Message
+	window, _ := batch.ParseWindow(s.BatchWindow) // ValidateConfig checks it parses
 	for roomID, roomConfig := range s.Rooms {
 		for _, realmConfig := range roomConfig.Realms {
 			for pkey, projectConfig := range realmConfig.Projects {
 				if pkey != eventProjectKey || !projectConfig.Track {
 					continue
 				}
-				_, msgErr := cli.SendMessageEvent(
-					roomID, "m.room.message", matrix.GetHTMLMessage("m.notice", htmlText),
-				)
-				if msgErr != nil {
-					log.WithFields(log.Fields{
-						log.ErrorKey: msgErr,
-						"project":    pkey,
-						"room_id":    roomID,
-					}).Print("Failed to send notice into room")
-				}
+				forwarded = true
+				msgs = append(msgs, batch.Message{roomID, event.Issue.Key, matrix.GetHTMLMessage("m.notice", htmlText)})
 			}
 		}
 	}
+	sendErrs := batch.SendAll(cli, s.id, window, msgs)
+	for roomID, msgErr := range sendErrs {
+		logger.WithFields(log.Fields{
+			log.ErrorKey: msgErr,
+			"project":    eventProjectKey,
+			"room_id":    roomID,
+		}).Print("Failed to send notice into room")
+	}
+	if forwarded {
+		status.Forwarded(s.id)
+	} else {
+		status.Filtered(s.id)
+	}
+	if len(sendErrs) > 0 {
+		// So that the event is dead-lettered, to be replayed once the rooms are fixed.
+		w.WriteHeader(500)
+		return
+	}
 	w.WriteHeader(200)
 }
 
@@ -276,7 +499,18 @@ func (s *jiraService) realmIDForProject(roomID, projectKey string) string {
 	return ""
 }
 
-func (s *jiraService) projectToRealm(userID, pkey string) (*realms.JIRARealm, error) {
+// realmIDForRoomProject returns the ID of the realm the room's config has the project in, whether
+// or not it is expanded or tracked, or "" if it hasn't.
+func (s *jiraService) realmIDForRoomProject(roomID, projectKey string) string {
+	for r, realmConfig := range s.Rooms[roomID].Realms {
+		if _, ok := realmConfig.Projects[projectKey]; ok {
+			return r
+		}
+	}
+	return ""
+}
+
+func (s *jiraService) projectToRealm(userID, pkey string) (*jiraRealm, error) {
 	// We don't know which JIRA installation this project maps to, so:
 	//  - Get all known JIRA realms and f.e query their endpoints with the
 	//    given user ID's credentials (so if it is a private project they
@@ -293,19 +527,22 @@ func (s *jiraService) projectToRealm(userID, pkey string) (*realms.JIRARealm, er
 		logger.WithError(err).Print("Failed to load jira auth realms")
 		return nil, err
 	}
+	patRealms, err := database.GetServiceDB().LoadAuthRealmsByType("pat")
+	if err != nil {
+		logger.WithError(err).Print("Failed to load pat auth realms")
+		return nil, err
+	}
+	knownRealms = append(knownRealms, patRealms...)
 	// typecast and move ones which the user has authed with to the front of the queue
-	var queue []*realms.JIRARealm
-	var unauthRealms []*realms.JIRARealm
+	var queue []*jiraRealm
+	var unauthRealms []*jiraRealm
 	for _, r := range knownRealms {
-		jrealm, ok := r.(*realms.JIRARealm)
-		if !ok {
-			logger.WithField("realm_id", r.ID()).Print(
-				"Failed to type-cast 'jira' type realm into JIRARealm",
-			)
-			continue
+		jrealm, err := asJIRARealm(r)
+		if err != nil {
+			continue // e.g. a pat realm for Github tokens
 		}
 
-		_, err := database.GetServiceDB().LoadAuthSessionByUser(r.ID(), userID)
+		_, err = database.GetServiceDB().LoadAuthSessionByUser(r.ID(), userID)
 		if err != nil {
 			if err == sql.ErrNoRows {
 				unauthRealms = append(unauthRealms, jrealm)
@@ -323,7 +560,7 @@ func (s *jiraService) projectToRealm(userID, pkey string) (*realms.JIRARealm, er
 	queue = append(queue, unauthRealms...)
 
 	for _, jr := range queue {
-		exists, err := jr.ProjectKeyExists(userID, pkey)
+		exists, err := jr.projectKeyExists(userID, pkey)
 		if err != nil {
 			logger.WithError(err).WithField("realm_id", jr.ID()).Print(
 				"Failed to check if project key exists on this realm.",
@@ -358,6 +595,32 @@ func projectsAndRealmsToTrack(s *jiraService) map[string][]string {
 func htmlSummaryForIssue(issue *jira.Issue) string {
 	// form a summary of the issue being affected e.g:
 	//   "Flibble Wibble [P1, In Progress]"
+	if issue.Fields == nil {
+		return ""
+	}
+	var details []string
+	if issue.Fields.Priority != nil {
+		details = append(details, html.EscapeString(issue.Fields.Priority.Name))
+	}
+	if status := htmlStatusForIssue(issue); status != "" {
+		details = append(details, status)
+	}
+	if len(details) == 0 {
+		return html.EscapeString(issue.Fields.Summary)
+	}
+	return fmt.Sprintf(
+		"%s [%s]",
+		html.EscapeString(issue.Fields.Summary),
+		strings.Join(details, ", "),
+	)
+}
+
+// htmlStatusForIssue returns the issue's status and its resolution, if it has one, e.g.
+// "Closed (Fixed)".
+func htmlStatusForIssue(issue *jira.Issue) string {
+	if issue.Fields.Status == nil {
+		return ""
+	}
 	status := html.EscapeString(issue.Fields.Status.Name)
 	if issue.Fields.Resolution != nil {
 		status = fmt.Sprintf(
@@ -365,19 +628,61 @@ func htmlSummaryForIssue(issue *jira.Issue) string {
 			status, html.EscapeString(issue.Fields.Resolution.Name),
 		)
 	}
+	return status
+}
+
+// htmlDetailsForIssue describes an issue for !jira: its key and summary, then its type, priority,
+// status, assignee and reporter, then its URL.
+func htmlDetailsForIssue(issue *jira.Issue, jiraBaseURL string) string {
+	issueURL := html.EscapeString(jiraBaseURL + "browse/" + issue.Key)
+	if issue.Fields == nil {
+		return fmt.Sprintf("<b>%s</b><br>%s", html.EscapeString(issue.Key), issueURL)
+	}
+	var details []string
+	if issue.Fields.Type.Name != "" {
+		details = append(details, html.EscapeString(issue.Fields.Type.Name))
+	}
+	if issue.Fields.Priority != nil {
+		details = append(details, html.EscapeString(issue.Fields.Priority.Name))
+	}
+	if status := htmlStatusForIssue(issue); status != "" {
+		details = append(details, status)
+	}
+	if issue.Fields.Assignee != nil {
+		details = append(details, "assigned to "+html.EscapeString(userName(issue.Fields.Assignee)))
+	} else {
+		details = append(details, "unassigned")
+	}
+	if issue.Fields.Reporter != nil {
+		details = append(details, "reported by "+html.EscapeString(userName(issue.Fields.Reporter)))
+	}
 	return fmt.Sprintf(
-		"%s [%s, %s]",
+		"<b>%s</b>: %s<br>%s<br>%s",
+		html.EscapeString(issue.Key),
 		html.EscapeString(issue.Fields.Summary),
-		html.EscapeString(issue.Fields.Priority.Name),
-		status,
+		strings.Join(details, ", "),
+		issueURL,
 	)
 }
 
+// userName returns the user's display name, or their username if they have none.
+func userName(u *jira.User) string {
+	if u.DisplayName != "" {
+		return u.DisplayName
+	}
+	return u.Name
+}
+
 // htmlForEvent formats a webhook event as HTML. Returns an empty string if there is nothing to send/cannot
 // be parsed.
 func htmlForEvent(whe *webhook.Event, jiraBaseURL string) string {
 	action := ""
-	if whe.WebhookEvent == "jira:issue_updated" {
+	user := whe.User.Name
+	if whe.Comment != nil && (whe.WebhookEvent == "comment_created" || whe.IssueEventTypeName == "issue_commented") {
+		// JIRA Cloud sends comment_created, and JIRA Server an issue_updated event with the comment.
+		action = "commented on"
+		user = whe.Comment.Author.Name
+	} else if whe.WebhookEvent == "jira:issue_updated" {
 		action = "updated"
 	} else if whe.WebhookEvent == "jira:issue_deleted" {
 		action = "deleted"
@@ -389,13 +694,26 @@ func htmlForEvent(whe *webhook.Event, jiraBaseURL string) string {
 
 	summaryHTML := htmlSummaryForIssue(&whe.Issue)
 
-	return fmt.Sprintf("%s %s <b>%s</b> - %s %s",
-		html.EscapeString(whe.User.Name),
+	text := fmt.Sprintf("%s %s <b>%s</b> - %s %s",
+		html.EscapeString(user),
 		html.EscapeString(action),
 		html.EscapeString(whe.Issue.Key),
 		summaryHTML,
 		html.EscapeString(jiraBaseURL+"browse/"+whe.Issue.Key),
 	)
+	if action == "commented on" {
+		text += "<br><blockquote>" + html.EscapeString(truncate(whe.Comment.Body, maxCommentLength)) + "</blockquote>"
+	}
+	return text
+}
+
+// truncate shortens s to at most n runes, ending it with an ellipsis if it was cut.
+func truncate(s string, n int) string {
+	runes := []rune(strings.TrimSpace(s))
+	if len(runes) <= n {
+		return string(runes)
+	}
+	return string(runes[:n-1]) + "…"
 }
 
 func init() {
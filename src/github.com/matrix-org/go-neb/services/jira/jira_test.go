@@ -0,0 +1,47 @@
+package services
+
+import (
+	"encoding/json"
+	"github.com/matrix-org/go-neb/services/jira/webhook"
+	"testing"
+)
+
+var eventtests = []struct {
+	event string
+	want  string
+}{
+	{
+		`{"webhookEvent": "jira:issue_created", "user": {"name": "alice"},
+		  "issue": {"key": "SYN-1", "fields": {"summary": "It <broke>", "priority": {"name": "P1"}, "status": {"name": "Open"}}}}`,
+		`alice created <b>SYN-1</b> - It &lt;broke&gt; [P1, Open] https://jira/browse/SYN-1`,
+	},
+	{
+		// JIRA Cloud
+		`{"webhookEvent": "comment_created", "comment": {"author": {"name": "bob"}, "body": "Fixed in 1.2"},
+		  "issue": {"key": "SYN-1", "fields": {"summary": "It broke", "status": {"name": "Done"}}}}`,
+		`bob commented on <b>SYN-1</b> - It broke [Done] https://jira/browse/SYN-1<br><blockquote>Fixed in 1.2</blockquote>`,
+	},
+	{
+		// JIRA Server
+		`{"webhookEvent": "jira:issue_updated", "issue_event_type_name": "issue_commented", "user": {"name": "carol"},
+		  "comment": {"author": {"name": "carol"}, "body": "Me too"},
+		  "issue": {"key": "SYN-2", "fields": {"summary": "Slow"}}}`,
+		`carol commented on <b>SYN-2</b> - Slow https://jira/browse/SYN-2<br><blockquote>Me too</blockquote>`,
+	},
+	{
+		`{"webhookEvent": "worklog_updated", "issue": {"key": "SYN-1"}}`,
+		``,
+	},
+}
+
+func TestHTMLForEvent(t *testing.T) {
+	for _, test := range eventtests {
+		var e webhook.Event
+		if err := json.Unmarshal([]byte(test.event), &e); err != nil {
+			t.Fatal(err)
+		}
+		if got := htmlForEvent(&e, "https://jira/"); got != test.want {
+			t.Errorf("htmlForEvent(%s) => want %q got %q", e.WebhookEvent, test.want, got)
+		}
+	}
+}
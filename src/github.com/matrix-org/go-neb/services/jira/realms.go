@@ -0,0 +1,69 @@
+package services
+
+import (
+	"fmt"
+	"github.com/andygrunwald/go-jira"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/realms/jira"
+	pat "github.com/matrix-org/go-neb/realms/pat"
+	"github.com/matrix-org/go-neb/types"
+)
+
+// jiraRealm is a realm the service can get JIRA clients from: a jira realm, or a pat realm whose
+// Provider is jira.
+type jiraRealm struct {
+	types.AuthRealm
+	// Endpoint is the URL of the JIRA installation, with a trailing slash.
+	Endpoint    string
+	StarterLink string
+	// JIRAClient returns a client which acts as the user, or an unauthenticated one if the user
+	// has no session and allowUnauth is true.
+	JIRAClient func(userID string, allowUnauth bool) (*jira.Client, error)
+}
+
+// asJIRARealm returns the realm as a jiraRealm, or an error if it doesn't hold JIRA credentials.
+func asJIRARealm(realm types.AuthRealm) (*jiraRealm, error) {
+	switch r := realm.(type) {
+	case *realms.JIRARealm:
+		return &jiraRealm{r, r.JIRAEndpoint, r.StarterLink, r.JIRAClient}, nil
+	case *pat.PATRealm:
+		if r.Provider == "jira" {
+			return &jiraRealm{r, r.BaseURL + "/", r.StarterLink, r.JIRAClient}, nil
+		}
+		return nil, fmt.Errorf("Realm %s holds %s tokens, not jira ones", r.ID(), r.Provider)
+	}
+	return nil, fmt.Errorf("Realm is of type '%s', not 'jira' or 'pat'", realm.Type())
+}
+
+// loadJIRARealm loads the realm with the ID as a jiraRealm.
+func loadJIRARealm(realmID string) (*jiraRealm, error) {
+	realm, err := database.GetServiceDB().LoadAuthRealm(realmID)
+	if err != nil {
+		return nil, err
+	}
+	return asJIRARealm(realm)
+}
+
+// projectKeyExists returns true if the project exists on the realm's JIRA installation, as far as
+// the user can see, or as far as anyone can if they have no session.
+func (r *jiraRealm) projectKeyExists(userID, projectKey string) (bool, error) {
+	if jr, ok := r.AuthRealm.(*realms.JIRARealm); ok {
+		return jr.ProjectKeyExists(userID, projectKey)
+	}
+	cli, err := r.JIRAClient(userID, true)
+	if err != nil {
+		return false, err
+	}
+	req, err := cli.NewRequest("GET", "rest/api/2/project/"+projectKey, nil)
+	if err != nil {
+		return false, err
+	}
+	res, err := cli.Do(req, nil)
+	if res != nil && res.StatusCode == 404 {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
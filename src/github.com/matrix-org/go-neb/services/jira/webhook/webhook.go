@@ -19,7 +19,8 @@ type jiraWebhook struct {
 	Filter  string   `json:"jqlFilter"`
 	Exclude bool     `json:"excludeIssueDetails"`
 	// These fields are populated on GET
-	Enabled bool `json:"enabled"`
+	Enabled bool   `json:"enabled"`
+	Self    string `json:"self,omitempty"`
 }
 
 // Event represents an incoming JIRA webhook event
@@ -28,10 +29,25 @@ type Event struct {
 	Timestamp    int64      `json:"timestamp"`
 	User         jira.User  `json:"user"`
 	Issue        jira.Issue `json:"issue"`
+	// IssueEventTypeName says what happened to the issue in jira:issue_updated events, e.g.
+	// "issue_commented".
+	IssueEventTypeName string `json:"issue_event_type_name"`
+	// Comment is set for events about comments.
+	Comment *jira.Comment `json:"comment"`
 }
 
 // RegisterHook checks to see if this user is allowed to track the given projects and then tracks them.
 func RegisterHook(jrealm *realms.JIRARealm, projects []string, userID, webhookEndpointURL string) error {
+	create, err := CheckHook(jrealm, projects, userID, webhookEndpointURL)
+	if err != nil || !create {
+		return err
+	}
+	return createWebhook(jrealm, webhookEndpointURL, userID)
+}
+
+// CheckHook checks to see if this user is allowed to track the given projects. Returns true if a
+// webhook needs to be created on the remote JIRA installation to track them.
+func CheckHook(jrealm *realms.JIRARealm, projects []string, userID, webhookEndpointURL string) (bool, error) {
 	// Tracking means that a webhook may need to be created on the remote JIRA installation.
 	// We need to make sure that the user has permission to do this. If they don't, it may still be okay if
 	// there is an existing webhook set up for this installation by someone else, *PROVIDED* that the projects
@@ -42,7 +58,7 @@ func RegisterHook(jrealm *realms.JIRARealm, projects []string, userID, webhookEn
 	//  - Try to GET /webhooks. If this succeeds:
 	//      * The user is an admin (only admins can GET webhooks)
 	//      * If there is a NEB webhook already then return success.
-	//      * Else create the webhook and then return success (if creation fails then fail).
+	//      * Else a webhook needs to be created: return true.
 	//  - Else:
 	//      * The user is NOT an admin.
 	//      * Are ALL the projects in the config public? If yes:
@@ -62,13 +78,13 @@ func RegisterHook(jrealm *realms.JIRARealm, projects []string, userID, webhookEn
 	cli, err := jrealm.JIRAClient(userID, false)
 	if err != nil {
 		logger.WithError(err).Print("No JIRA client exists")
-		return err // no OAuth token on this JIRA endpoint
+		return false, err // no OAuth token on this JIRA endpoint
 	}
 	wh, httpErr := getWebhook(cli, webhookEndpointURL)
 	if httpErr != nil {
 		if httpErr.Code != 403 {
 			logger.WithError(httpErr).Print("Failed to GET webhook")
-			return httpErr
+			return false, httpErr
 		}
 		// User is not a JIRA admin (cannot GET webhooks)
 		// The only way this is going to end well for this request is if all the projects
@@ -76,7 +92,7 @@ func RegisterHook(jrealm *realms.JIRARealm, projects []string, userID, webhookEn
 		httpErr = checkProjectsArePublic(jrealm, projects, userID)
 		if httpErr != nil {
 			logger.WithError(httpErr).Print("Failed to assert that all projects are public")
-			return httpErr
+			return false, httpErr
 		}
 
 		// All projects that wish to be tracked are public, but the user cannot create
@@ -84,18 +100,60 @@ func RegisterHook(jrealm *realms.JIRARealm, projects []string, userID, webhookEn
 		// JIRA endpoint.
 		if !jrealm.HasWebhook {
 			logger.Print("No webhook exists for this realm.")
-			return fmt.Errorf("Not authorised to create webhook: not an admin.")
+			return false, fmt.Errorf("Not authorised to create webhook: not an admin.")
 		}
-		return nil
+		return false, nil
 	}
 
 	// The user is probably an admin (can query webhooks endpoint)
 
 	if wh != nil {
 		logger.Print("Webhook already exists")
-		return nil // we already have a NEB webhook :D
+		return false, nil // we already have a NEB webhook :D
 	}
-	return createWebhook(jrealm, webhookEndpointURL, userID)
+	return true, nil
+}
+
+// MoveHook points Go-NEB's webhook on the JIRA installation which is sent to oldEndpointURL at
+// newEndpointURL instead, creating one if there isn't one. Only JIRA admins can do this.
+func MoveHook(jrealm *realms.JIRARealm, userID, oldEndpointURL, newEndpointURL string) error {
+	cli, err := jrealm.JIRAClient(userID, false)
+	if err != nil {
+		return err
+	}
+	wh, httpErr := getWebhook(cli, oldEndpointURL)
+	if httpErr != nil {
+		if httpErr.Code == 403 {
+			return fmt.Errorf("Not authorised to move webhook on %s: not an admin.", jrealm.JIRAEndpoint)
+		}
+		return httpErr
+	}
+	if wh == nil {
+		if wh, httpErr = getWebhook(cli, newEndpointURL); httpErr != nil {
+			return httpErr
+		}
+		if wh != nil {
+			return nil // already moved
+		}
+		return createWebhook(jrealm, newEndpointURL, userID)
+	}
+	wh.URL = newEndpointURL
+	req, err := cli.NewRequest("PUT", wh.Self, wh)
+	if err != nil {
+		return err
+	}
+	res, err := cli.Do(req, nil)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("Updating webhook returned HTTP %d", res.StatusCode)
+	}
+	log.WithFields(log.Fields{
+		"realm_id": jrealm.ID(),
+		"jira_url": jrealm.JIRAEndpoint,
+	}).Print("Moved webhook to new endpoint URL")
+	return nil
 }
 
 // OnReceiveRequest is called when JIRA hits NEB with an update.
@@ -126,7 +184,7 @@ func createWebhook(jrealm *realms.JIRARealm, webhookEndpointURL, userID string)
 	req, err := cli.NewRequest("POST", "rest/webhooks/1.0/webhook", jiraWebhook{
 		Name:    "Go-NEB",
 		URL:     webhookEndpointURL,
-		Events:  []string{"jira:issue_created", "jira:issue_deleted", "jira:issue_updated"},
+		Events:  []string{"jira:issue_created", "jira:issue_deleted", "jira:issue_updated", "comment_created"},
 		Filter:  "",
 		Exclude: false,
 	})
@@ -0,0 +1,150 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/plugin"
+	"github.com/matrix-org/go-neb/types"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// topLimit is how many names !karma top lists.
+const topLimit = 10
+
+// karmaRegex matches "name++" and "name--", where the name may be a user ID, e.g.
+// "@alice:example.org++". The last group is what follows the "++" or "--": the match is ignored
+// unless it is empty, so that e.g. "a++b" and "c+++" aren't karma.
+var karmaRegex = regexp.MustCompile(`@?([\pL\pN_](?:[\pL\pN_.\-]*[\pL\pN_])?)(?::[\w.\-]+)?(\+\+|--)([\pL\pN_+\-]?)`)
+
+type karmaService struct {
+	id            string
+	serviceUserID string
+	// CommandPrefixes are what commands start with in each room, e.g. {"!foo:bar": "?"}, so that
+	// several bots in a room can be told apart. Optional: in other rooms commands start with "!".
+	CommandPrefixes map[string]string
+}
+
+func (s *karmaService) ServiceUserID() string { return s.serviceUserID }
+func (s *karmaService) ServiceID() string     { return s.id }
+func (s *karmaService) ServiceType() string   { return "karma" }
+func (s *karmaService) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli *matrix.Client) {
+	w.WriteHeader(200) // Do nothing
+}
+func (s *karmaService) ValidateConfig() []types.ConfigError {
+	return types.ValidateCommandPrefixes(s.CommandPrefixes)
+}
+func (s *karmaService) Register(oldService types.Service, client *matrix.Client) error { return nil }
+func (s *karmaService) PostRegister(oldService types.Service)                          {}
+
+func (s *karmaService) Plugin(client *matrix.Client, roomID string) plugin.Plugin {
+	return plugin.Plugin{
+		Prefix: s.CommandPrefixes[roomID],
+		Commands: []plugin.Command{
+			plugin.Command{
+				Path:      []string{"karma"},
+				Arguments: []string{"[name]"},
+				Help:      "Show the karma of the name, or your own, in this room",
+				Command: func(roomID, userID string, args []string) (interface{}, error) {
+					return s.cmdKarma(roomID, userID, args)
+				},
+			},
+			plugin.Command{
+				Path: []string{"karma", "top"},
+				Help: "List the names with the most karma in this room",
+				Command: func(roomID, userID string, args []string) (interface{}, error) {
+					return s.cmdKarmaTop(roomID)
+				},
+			},
+		},
+		Expansions: []plugin.Expansion{
+			plugin.Expansion{
+				Regexp: karmaRegex,
+				Expand: func(roomID, userID string, matchingGroups []string) interface{} {
+					s.expandKarma(roomID, userID, matchingGroups)
+					return nil // karma is counted silently
+				},
+			},
+		},
+	}
+}
+
+func (s *karmaService) cmdKarma(roomID, userID string, args []string) (interface{}, error) {
+	name := normaliseName(userID)
+	if len(args) > 0 {
+		name = normaliseName(strings.Join(args, " "))
+	}
+	score, err := database.GetServiceDB().LoadKarma(s.id, roomID, name)
+	if err == sql.ErrNoRows {
+		return &matrix.TextMessage{"m.notice", fmt.Sprintf("%s has no karma", name)}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &matrix.TextMessage{"m.notice", fmt.Sprintf("%s has %d karma", name, score)}, nil
+}
+
+func (s *karmaService) cmdKarmaTop(roomID string) (interface{}, error) {
+	scores, err := database.GetServiceDB().LoadTopKarma(s.id, roomID, topLimit)
+	if err != nil {
+		return nil, err
+	}
+	if len(scores) == 0 {
+		return &matrix.TextMessage{"m.notice", "Nobody has any karma in this room yet"}, nil
+	}
+	lines := []string{"Karma in this room:"}
+	for i, score := range scores {
+		lines = append(lines, fmt.Sprintf("%d. %s: %d", i+1, score.Name, score.Score))
+	}
+	return &matrix.TextMessage{"m.notice", strings.Join(lines, "\n")}, nil
+}
+
+// expandKarma adds or takes away a point of karma for the name matched by karmaRegex. Users can't
+// change their own karma.
+func (s *karmaService) expandKarma(roomID, userID string, matchingGroups []string) {
+	if len(matchingGroups) != 4 || matchingGroups[3] != "" {
+		return
+	}
+	name := strings.ToLower(matchingGroups[1])
+	logger := log.WithFields(log.Fields{
+		"room_id": roomID,
+		"user_id": userID,
+		"name":    name,
+	})
+	if name == normaliseName(userID) {
+		logger.Info("Ignoring karma given to oneself")
+		return
+	}
+	delta := 1
+	if matchingGroups[2] == "--" {
+		delta = -1
+	}
+	score, err := database.GetServiceDB().AddKarma(s.id, roomID, name, delta)
+	if err != nil {
+		logger.WithError(err).Error("Failed to store karma")
+		return
+	}
+	logger.WithField("score", score).Info("Stored karma")
+}
+
+// normaliseName returns the name karma is stored under for a name or user ID, e.g. "alice" for
+// "@Alice:example.org".
+func normaliseName(name string) string {
+	name = strings.TrimPrefix(strings.TrimSpace(name), "@")
+	if i := strings.Index(name, ":"); i > 0 {
+		name = name[:i]
+	}
+	return strings.ToLower(name)
+}
+
+func init() {
+	types.RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) types.Service {
+		return &karmaService{
+			id:            serviceID,
+			serviceUserID: serviceUserID,
+		}
+	})
+}
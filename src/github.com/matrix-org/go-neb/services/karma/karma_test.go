@@ -0,0 +1,46 @@
+package services
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestKarmaRegex(t *testing.T) {
+	for _, tc := range []struct {
+		body string
+		want []string // "name++" or "name--" for each match which counts
+	}{
+		{"alice++", []string{"alice++"}},
+		{"thanks Bob++ and carol--!", []string{"bob++", "carol--"}},
+		{"@dave:example.org++ for the fix", []string{"dave++"}},
+		{"erin.smith++, frank_2--.", []string{"erin.smith++", "frank_2--"}},
+		{"a++b c+++ d---", nil},
+		{"run it with --verbose", nil},
+		{"no karma here", nil},
+		{"zoë++", []string{"zoë++"}},
+	} {
+		var got []string
+		for _, groups := range karmaRegex.FindAllStringSubmatch(tc.body, -1) {
+			if groups[3] == "" {
+				got = append(got, normaliseName(groups[1])+groups[2])
+			}
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("karmaRegex on %q => Want %v got %v", tc.body, tc.want, got)
+		}
+	}
+}
+
+func TestNormaliseName(t *testing.T) {
+	for in, want := range map[string]string{
+		"alice":                "alice",
+		"@Alice:example.org":   "alice",
+		" Bob ":                "bob",
+		"carol:matrix.org":     "carol",
+		"@dave:localhost:8448": "dave",
+	} {
+		if got := normaliseName(in); got != want {
+			t.Errorf("normaliseName(%q) => Want %q got %q", in, want, got)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package services
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/httpclient"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/plugin"
+	"github.com/matrix-org/go-neb/secrets"
+	"github.com/matrix-org/go-neb/signatures"
+	"github.com/matrix-org/go-neb/status"
+	"github.com/matrix-org/go-neb/types"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+const (
+	// deliveryAttempts is how many times a message is sent before giving up on it.
+	deliveryAttempts = 5
+	// firstRetryDelay is how long to wait before sending a message again. It doubles with each
+	// attempt, so a message is given up on after about 15 seconds.
+	firstRetryDelay = time.Second
+	// maxInFlight is the most messages being sent, across every service, at once. Messages
+	// received while this many are being sent, e.g. because an endpoint is down, are dropped
+	// rather than piling up.
+	maxInFlight = 100
+)
+
+// Signer signs the body of each request with the service's Secret, in the same way as Github
+// signs its webhooks.
+var Signer = signatures.HMAC{Header: "X-Neb-Signature-256", Prefix: "sha256=", Hash: sha256.New}
+
+var (
+	httpClient = httpclient.New(10 * time.Second)
+	inFlight   = make(chan struct{}, maxInFlight)
+)
+
+// outgoingWebhookService sends the messages in its rooms to an HTTP endpoint, as JSON. It is the
+// inverse of the webhook service, for systems which act on what is said in Matrix.
+type outgoingWebhookService struct {
+	id            string
+	serviceUserID string
+	// URL is where messages are POSTed to.
+	URL string
+	// Secret, if set, signs each request's body with HMAC-SHA256 in the X-Neb-Signature-256
+	// header, as "sha256=<hex>".
+	Secret secrets.Secret
+	// Rooms are the IDs of the rooms to send messages from.
+	Rooms []string
+	// Senders are the user IDs whose messages are sent. Optional: messages from everyone are sent.
+	Senders []string
+	// Pattern is a regular expression which a message's body must match for it to be sent.
+	// Optional: every message is sent.
+	Pattern string
+}
+
+// payload is the JSON body of each request.
+type payload struct {
+	ServiceID string                 `json:"service_id"`
+	RoomID    string                 `json:"room_id"`
+	EventID   string                 `json:"event_id"`
+	Sender    string                 `json:"sender"`
+	Timestamp int                    `json:"origin_server_ts"`
+	MsgType   string                 `json:"msgtype"`
+	Body      string                 `json:"body"`
+	Content   map[string]interface{} `json:"content"`
+}
+
+func (s *outgoingWebhookService) ServiceUserID() string { return s.serviceUserID }
+func (s *outgoingWebhookService) ServiceID() string     { return s.id }
+func (s *outgoingWebhookService) ServiceType() string   { return "outgoing-webhook" }
+func (s *outgoingWebhookService) Plugin(cli *matrix.Client, roomID string) plugin.Plugin {
+	return plugin.Plugin{}
+}
+func (s *outgoingWebhookService) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli *matrix.Client) {
+	w.WriteHeader(404)
+}
+
+// OnMessageEvent sends the message to the URL in the background, if it is from one of the rooms
+// and passes the filters. The service's own messages are never sent.
+func (s *outgoingWebhookService) OnMessageEvent(cli *matrix.Client, event *matrix.Event) {
+	if event.Sender == cli.UserID || !s.wants(event) {
+		return
+	}
+	body, _ := event.Body()
+	msgType, _ := event.MessageType()
+	content, err := json.Marshal(payload{
+		ServiceID: s.id,
+		RoomID:    event.RoomID,
+		EventID:   event.ID,
+		Sender:    event.Sender,
+		Timestamp: event.Timestamp,
+		MsgType:   msgType,
+		Body:      body,
+		Content:   event.Content,
+	})
+	if err != nil {
+		log.WithError(err).WithField("event_id", event.ID).Error("Failed to marshal outgoing webhook payload")
+		return
+	}
+	select {
+	case inFlight <- struct{}{}:
+	default:
+		log.WithFields(log.Fields{
+			"service_id": s.id,
+			"event_id":   event.ID,
+		}).Warn("Dropping outgoing webhook: too many are being sent")
+		status.Failed(s.id, fmt.Errorf("Dropped message %s: too many outgoing webhooks are being sent", event.ID))
+		return
+	}
+	go func() {
+		defer func() { <-inFlight }()
+		s.deliver(event.ID, content)
+	}()
+}
+
+// wants returns true if the event is a message from one of the rooms which passes the filters.
+func (s *outgoingWebhookService) wants(event *matrix.Event) bool {
+	body, ok := event.Body()
+	if !ok {
+		return false
+	}
+	if !contains(s.Rooms, event.RoomID) {
+		return false
+	}
+	if len(s.Senders) > 0 && !contains(s.Senders, event.Sender) {
+		return false
+	}
+	if s.Pattern != "" {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil || !re.MatchString(body) {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// deliver POSTs the payload to the URL, retrying with backoff if it can't be reached or responds
+// with HTTP 429 or a server error.
+func (s *outgoingWebhookService) deliver(eventID string, content []byte) {
+	logger := log.WithFields(log.Fields{
+		"service_id": s.id,
+		"event_id":   eventID,
+	})
+	delay := firstRetryDelay
+	var err error
+	for attempt := 1; attempt <= deliveryAttempts; attempt++ {
+		var retry bool
+		if retry, err = s.send(eventID, content); err == nil {
+			status.Sent(s.id)
+			return
+		}
+		if !retry || attempt == deliveryAttempts {
+			break
+		}
+		logger.WithError(err).WithField("attempt", attempt).Print("Failed to send outgoing webhook, retrying")
+		time.Sleep(delay)
+		delay *= 2
+	}
+	logger.WithError(err).Warn("Failed to send outgoing webhook")
+	status.Failed(s.id, err)
+}
+
+// send makes a single request. Returns whether it is worth trying again if it fails.
+func (s *outgoingWebhookService) send(eventID string, content []byte) (retry bool, err error) {
+	req, err := http.NewRequest("POST", s.URL, bytes.NewReader(content))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Go-NEB")
+	// Receivers can use this to ignore a message they have already handled, if a retry is sent
+	// after a response was lost.
+	req.Header.Set("X-Neb-Event-ID", eventID)
+	if secret := s.Secret.Value(); secret != "" {
+		req.Header.Set(Signer.Header, Signer.Sign(content, secret))
+	}
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return false, nil
+	}
+	return res.StatusCode == 429 || res.StatusCode >= 500, fmt.Errorf("%s returned HTTP %d", s.URL, res.StatusCode)
+}
+
+// ValidateConfig checks that the URL is an http(s) URL, that the pattern compiles, and that every
+// room and sender ID is well formed.
+func (s *outgoingWebhookService) ValidateConfig() []types.ConfigError {
+	var errs []types.ConfigError
+	if !types.IsHTTPURL(s.URL) {
+		errs = append(errs, types.ConfigError{Field: "URL", Message: "must be an http or https URL"})
+	}
+	if _, err := regexp.Compile(s.Pattern); err != nil {
+		errs = append(errs, types.ConfigError{Field: "Pattern", Message: "does not compile: " + err.Error()})
+	}
+	if len(s.Rooms) == 0 {
+		errs = append(errs, types.ConfigError{Field: "Rooms", Message: "must list at least one room"})
+	}
+	for i, roomID := range s.Rooms {
+		if !types.IsRoomID(roomID) {
+			errs = append(errs, types.ConfigError{Field: fmt.Sprintf("Rooms[%d]", i), Message: "is not a room ID"})
+		}
+	}
+	for i, userID := range s.Senders {
+		if !types.IsUserID(userID) {
+			errs = append(errs, types.ConfigError{Field: fmt.Sprintf("Senders[%d]", i), Message: "is not a user ID"})
+		}
+	}
+	return errs
+}
+
+// Register joins the rooms messages are sent from.
+func (s *outgoingWebhookService) Register(oldService types.Service, client *matrix.Client) error {
+	for _, roomID := range s.Rooms {
+		if _, err := client.JoinRoom(roomID, "", ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PlanRegister works out which of the rooms messages are forwarded from Register would join.
+func (s *outgoingWebhookService) PlanRegister(oldService types.Service, client *matrix.Client) (*types.RegisterPlan, error) {
+	plan := &types.RegisterPlan{JoinRooms: types.PlanJoinRooms(client, s.Rooms)}
+	return plan, nil
+}
+
+// CheckRegistered checks that the service's client is still in the rooms messages are forwarded
+// from, as it can't see messages in rooms it has left.
+func (s *outgoingWebhookService) CheckRegistered(client *matrix.Client) ([]string, error) {
+	return types.CheckJoinedRooms(client, s.Rooms), nil
+}
+
+func (s *outgoingWebhookService) PostRegister(oldService types.Service) {}
+
+func init() {
+	types.RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) types.Service {
+		return &outgoingWebhookService{
+			id:            serviceID,
+			serviceUserID: serviceUserID,
+		}
+	})
+}
@@ -0,0 +1,407 @@
+package services
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/batch"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/plugin"
+	"github.com/matrix-org/go-neb/realms/pagerduty"
+	"github.com/matrix-org/go-neb/secrets"
+	"github.com/matrix-org/go-neb/server"
+	"github.com/matrix-org/go-neb/signatures"
+	"github.com/matrix-org/go-neb/status"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/go-neb/util"
+	"golang.org/x/net/context"
+	"html"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// maxBodySize is the largest webhook request PagerDuty is expected to send.
+const maxBodySize = 1024 * 1024
+
+// incidentIDRegex matches PagerDuty object IDs, e.g. "PGR0VU2".
+var incidentIDRegex = regexp.MustCompile(`^[A-Z0-9]+$`)
+
+// incidentURLRegex finds the incident ID in the URL of an incident, e.g.
+// "https://acme.pagerduty.com/incidents/PGR0VU2".
+var incidentURLRegex = regexp.MustCompile(`/incidents/([A-Z0-9]+)/?$`)
+
+// eventColours are the colours incidents are shown in, by event type.
+var eventColours = map[string]string{
+	"incident.triggered":    "#d9534f",
+	"incident.acknowledged": "#f0ad4e",
+	"incident.resolved":     "#5cb85c",
+}
+
+const ackUsage = `Usage: !pd ack <incident ID>`
+const resolveUsage = `Usage: !pd resolve <incident ID>`
+
+// pagerdutyService posts a message to rooms when a PagerDuty V3 webhook subscription says an
+// incident was triggered, acknowledged or resolved, and lets users acknowledge and resolve
+// incidents with "!pd ack <id>" and "!pd resolve <id>". Commands are made with the user's own
+// PagerDuty API token, which they submit to a "pagerduty" realm with "!auth <realm ID>".
+type pagerdutyService struct {
+	id                 string
+	serviceUserID      string
+	webhookEndpointURL string
+	// Secret is the webhook subscription's signing secret, which PagerDuty shows when the
+	// subscription is made. Requests which aren't signed with it are rejected.
+	Secret secrets.Secret
+	// RealmID is the ID of the "pagerduty" realm users submit their API tokens to.
+	RealmID string
+	// AllowedIPs are the IP addresses and CIDR ranges PagerDuty may send webhook requests from.
+	// Optional: requests are allowed from anywhere.
+	AllowedIPs []string
+	// AlertIfQuietFor is how long to go without a webhook from PagerDuty before alerting the
+	// operators that it is probably broken, e.g. "168h". Optional: they are never alerted.
+	AlertIfQuietFor string
+	Rooms           map[string]pagerdutyRoom // room_id => room
+	// CommandPrefixes are what commands start with in each room, e.g. {"!foo:bar": "?"}, so that
+	// several bots in a room can be told apart. Optional: in other rooms commands start with "!".
+	CommandPrefixes map[string]string
+}
+
+// pagerdutyRoom is which incidents a room is sent.
+type pagerdutyRoom struct {
+	// Services are the IDs or names of the PagerDuty services whose incidents the room is sent.
+	// Optional: it is sent every service's.
+	Services []string
+}
+
+// pagerdutyPayload is the payload of a V3 webhook.
+type pagerdutyPayload struct {
+	Event struct {
+		EventType string `json:"event_type"`
+		Agent     *struct {
+			Summary string `json:"summary"`
+		} `json:"agent"`
+		Data struct {
+			ID             string `json:"id"`
+			IncidentNumber int    `json:"number"`
+			Title          string `json:"title"`
+			Urgency        string `json:"urgency"`
+			HTMLURL        string `json:"html_url"`
+			Service        struct {
+				ID      string `json:"id"`
+				Summary string `json:"summary"`
+			} `json:"service"`
+			Assignees []struct {
+				Summary string `json:"summary"`
+			} `json:"assignees"`
+			Priority *struct {
+				Summary string `json:"summary"`
+			} `json:"priority"`
+		} `json:"data"`
+	} `json:"event"`
+}
+
+func (s *pagerdutyService) ServiceUserID() string       { return s.serviceUserID }
+func (s *pagerdutyService) ServiceID() string           { return s.id }
+func (s *pagerdutyService) ServiceType() string         { return "pagerduty" }
+func (s *pagerdutyService) WebhookAllowedIPs() []string { return s.AllowedIPs }
+func (s *pagerdutyService) QuietPeriod() time.Duration {
+	d, _ := status.ParseQuietPeriod(s.AlertIfQuietFor) // ValidateConfig checks it parses
+	return d
+}
+
+// Plugin returns the "!pd ack" and "!pd resolve" commands.
+func (s *pagerdutyService) Plugin(cli *matrix.Client, roomID string) plugin.Plugin {
+	return plugin.Plugin{
+		Prefix: s.CommandPrefixes[roomID],
+		Commands: []plugin.Command{
+			plugin.Command{
+				Path: []string{"pd", "ack"},
+				ContextCommand: func(ctx context.Context, roomID, userID string, args []string) (interface{}, error) {
+					return s.cmdUpdate(ctx, userID, args, "acknowledged", ackUsage)
+				},
+			},
+			plugin.Command{
+				Path: []string{"pd", "resolve"},
+				ContextCommand: func(ctx context.Context, roomID, userID string, args []string) (interface{}, error) {
+					return s.cmdUpdate(ctx, userID, args, "resolved", resolveUsage)
+				},
+			},
+		},
+	}
+}
+
+// cmdUpdate sets the status of the incident in args as the user.
+func (s *pagerdutyService) cmdUpdate(ctx context.Context, userID string, args []string, newStatus, usage string) (interface{}, error) {
+	if len(args) != 1 {
+		return &matrix.TextMessage{"m.notice", usage}, nil
+	}
+	incidentID := parseIncidentID(args[0])
+	if incidentID == "" {
+		return &matrix.TextMessage{"m.notice", fmt.Sprintf("%q is not a PagerDuty incident ID. %s", args[0], usage)}, nil
+	}
+	realm, err := s.realm()
+	if err != nil {
+		return nil, err
+	}
+	incident, err := realm.UpdateIncident(ctx, userID, incidentID, newStatus)
+	if err == sql.ErrNoRows {
+		return matrix.StarterLinkMessage{
+			Body: "You need to send a PagerDuty API token with !auth " + realm.ID() + " before you can update incidents.",
+			Link: realm.StarterLink,
+		}, nil
+	}
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"service_id":  s.id,
+			"user_id":     userID,
+			"incident_id": incidentID,
+		}).Print("Failed to update PagerDuty incident")
+		return nil, fmt.Errorf("Failed to update incident %s: %s", incidentID, err)
+	}
+	return &matrix.TextMessage{"m.notice", fmt.Sprintf("Incident #%d %s is now %s.", incident.IncidentNumber, incident.Title, incident.Status)}, nil
+}
+
+// parseIncidentID returns the incident ID which s is, or which s is the URL of. Returns "" if it is
+// neither.
+func parseIncidentID(s string) string {
+	if incidentIDRegex.MatchString(s) {
+		return s
+	}
+	if m := incidentURLRegex.FindStringSubmatch(s); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// realm returns the realm users submit their tokens to.
+func (s *pagerdutyService) realm() (*realms.PagerDutyRealm, error) {
+	r, err := database.GetServiceDB().LoadAuthRealm(s.RealmID)
+	if err != nil {
+		return nil, err
+	}
+	realm, ok := r.(*realms.PagerDutyRealm)
+	if !ok {
+		return nil, fmt.Errorf("Realm is of type '%s', not 'pagerduty'", r.Type())
+	}
+	return realm, nil
+}
+
+// OnReceiveWebhook sends a message about the incident to each room which wants its service's
+// incidents.
+func (s *pagerdutyService) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli *matrix.Client) {
+	logger := server.RequestLogger(req)
+	body, err := signatures.ReadAndVerify(req, signatures.PagerDuty{}, s.Secret.Value(), maxBodySize)
+	if err != nil {
+		logger.WithError(err).Print("PagerDuty webhook failed signature check")
+		w.WriteHeader(401)
+		return
+	}
+	if req.Method != "POST" {
+		w.WriteHeader(405)
+		return
+	}
+	var p pagerdutyPayload
+	if err = json.Unmarshal(body, &p); err != nil {
+		logger.WithError(err).Print("Failed to decode PagerDuty webhook")
+		w.WriteHeader(400)
+		return
+	}
+	if eventColours[p.Event.EventType] == "" || p.Event.Data.ID == "" {
+		// e.g. a "pagey.ping", or an incident being reassigned or annotated
+		status.Filtered(s.id)
+		w.WriteHeader(200)
+		return
+	}
+	logger = logger.WithFields(log.Fields{
+		"incident_id": p.Event.Data.ID,
+		"event_type":  p.Event.EventType,
+	})
+
+	var msgs []batch.Message
+	for _, roomID := range util.SortedKeys(s.Rooms) {
+		if !s.wants(roomID, &p) {
+			continue
+		}
+		logger.WithField("room_id", roomID).Print("Sending incident to room")
+		msgs = append(msgs, batch.Message{roomID, "", incidentMessage(&p, s.commandPrefix(roomID))})
+	}
+	if len(msgs) == 0 {
+		status.Filtered(s.id)
+		w.WriteHeader(200)
+		return
+	}
+	status.Forwarded(s.id)
+	sendErrs := batch.SendAll(cli, s.id, 0, msgs)
+	for roomID, e := range sendErrs {
+		logger.WithError(e).WithField("room_id", roomID).Print("Failed to send notification to room.")
+	}
+	if len(sendErrs) > 0 {
+		// So that the request is dead-lettered, to be replayed once the rooms are fixed.
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(200)
+}
+
+// wants returns true if the room is sent incidents of the payload's service.
+func (s *pagerdutyService) wants(roomID string, p *pagerdutyPayload) bool {
+	services := s.Rooms[roomID].Services
+	if len(services) == 0 {
+		return true
+	}
+	svc := p.Event.Data.Service
+	for _, want := range services {
+		if want == svc.ID || strings.EqualFold(want, svc.Summary) {
+			return true
+		}
+	}
+	return false
+}
+
+// commandPrefix returns what commands start with in the room.
+func (s *pagerdutyService) commandPrefix(roomID string) string {
+	if prefix := s.CommandPrefixes[roomID]; prefix != "" {
+		return prefix
+	}
+	return "!"
+}
+
+// incidentMessage writes a message about the incident: its service, what happened to it and who did
+// it, coloured, its title and a link to it, and then its urgency, priority and assignees. Triggered
+// incidents say how to acknowledge them, with commands starting with the prefix.
+func incidentMessage(p *pagerdutyPayload, prefix string) matrix.HTMLMessage {
+	ev := p.Event
+	d := ev.Data
+	what := strings.TrimPrefix(ev.EventType, "incident.")
+	if ev.Agent != nil && ev.Agent.Summary != "" && what != "triggered" {
+		what += " by " + ev.Agent.Summary
+	}
+	incident := fmt.Sprintf("Incident #%d", d.IncidentNumber)
+	body := fmt.Sprintf("[%s] %s %s: %s", d.Service.Summary, incident, what, d.Title)
+	titleHTML := html.EscapeString(d.Title)
+	if d.HTMLURL != "" {
+		body += " - " + d.HTMLURL
+		titleHTML = fmt.Sprintf(`<a href="%s">%s</a>`, html.EscapeString(d.HTMLURL), titleHTML)
+	}
+	htmlBody := fmt.Sprintf(
+		`<b>[%s]</b> <font color="%s">%s %s</font>: %s`,
+		html.EscapeString(d.Service.Summary), eventColours[ev.EventType], incident, html.EscapeString(what), titleHTML,
+	)
+
+	details := incidentDetails(p)
+	if len(details) > 0 {
+		body += "\n" + strings.Join(details, ", ")
+		htmlBody += "<br>" + html.EscapeString(strings.Join(details, ", "))
+	}
+	if ev.EventType == "incident.triggered" {
+		ack := fmt.Sprintf("%spd ack %s", prefix, d.ID)
+		body += "\nAcknowledge with " + ack
+		htmlBody += "<br>Acknowledge with <code>" + html.EscapeString(ack) + "</code>"
+	}
+	return matrix.HTMLMessage{
+		Body:          body,
+		MsgType:       "m.notice",
+		Format:        "org.matrix.custom.html",
+		FormattedBody: htmlBody,
+	}
+}
+
+// incidentDetails returns the incident's urgency, priority and, unless it is resolved, assignees.
+func incidentDetails(p *pagerdutyPayload) []string {
+	d := p.Event.Data
+	var details []string
+	if d.Urgency != "" {
+		details = append(details, d.Urgency+" urgency")
+	}
+	if d.Priority != nil && d.Priority.Summary != "" {
+		details = append(details, "priority "+d.Priority.Summary)
+	}
+	if len(d.Assignees) > 0 && p.Event.EventType != "incident.resolved" {
+		var names []string
+		for _, a := range d.Assignees {
+			names = append(names, a.Summary)
+		}
+		details = append(details, "assigned to "+strings.Join(names, ", "))
+	}
+	return details
+}
+
+// ValidateConfig checks that the secret and realm are given, that the allowed IPs and quiet period
+// parse, and that every room ID and command prefix is well formed.
+func (s *pagerdutyService) ValidateConfig() []types.ConfigError {
+	var errs []types.ConfigError
+	if s.Secret.Value() == "" {
+		errs = append(errs, types.ConfigError{Field: "Secret", Message: "is required"})
+	}
+	if s.RealmID == "" {
+		errs = append(errs, types.ConfigError{Field: "RealmID", Message: "is required"})
+	}
+	if _, err := server.ParseAllowlist(s.AllowedIPs); err != nil {
+		errs = append(errs, types.ConfigError{Field: "AllowedIPs", Message: "does not parse: " + err.Error()})
+	}
+	if _, err := status.ParseQuietPeriod(s.AlertIfQuietFor); err != nil {
+		errs = append(errs, types.ConfigError{Field: "AlertIfQuietFor", Message: "is not a valid period: " + err.Error()})
+	}
+	if len(s.Rooms) == 0 {
+		errs = append(errs, types.ConfigError{Field: "Rooms", Message: "must list at least one room"})
+	}
+	for _, roomID := range util.SortedKeys(s.Rooms) {
+		if !types.IsRoomID(roomID) {
+			errs = append(errs, types.ConfigError{Field: fmt.Sprintf("Rooms[%s]", roomID), Message: "is not a room ID"})
+		}
+	}
+	return append(errs, types.ValidateCommandPrefixes(s.CommandPrefixes)...)
+}
+
+// Register checks that the realm is a "pagerduty" realm, and joins the rooms messages are posted to.
+func (s *pagerdutyService) Register(oldService types.Service, client *matrix.Client) error {
+	if _, err := s.realm(); err != nil {
+		return err
+	}
+	for _, roomID := range util.SortedKeys(s.Rooms) {
+		if _, err := client.JoinRoom(roomID, "", ""); err != nil {
+			return err
+		}
+	}
+	log.WithFields(log.Fields{
+		"service_id": s.id,
+		"url":        s.webhookEndpointURL,
+	}).Info("Registered PagerDuty webhook: subscribe it to incident.triggered, incident.acknowledged and incident.resolved")
+	return nil
+}
+
+// PlanRegister checks the realm and works out which rooms Register would join. The webhook
+// subscription is made in PagerDuty by hand.
+func (s *pagerdutyService) PlanRegister(oldService types.Service, client *matrix.Client) (*types.RegisterPlan, error) {
+	if _, err := s.realm(); err != nil {
+		return nil, err
+	}
+	plan := &types.RegisterPlan{JoinRooms: types.PlanJoinRooms(client, util.SortedKeys(s.Rooms))}
+	plan.Notes = []string{"A PagerDuty V3 webhook subscription must be given the webhook URL " + s.webhookEndpointURL}
+	return plan, nil
+}
+
+// CheckRegistered checks that the realm is still there and that the service's client is still in
+// each room.
+func (s *pagerdutyService) CheckRegistered(client *matrix.Client) ([]string, error) {
+	var problems []string
+	if _, err := s.realm(); err != nil {
+		problems = append(problems, fmt.Sprintf("Realm %s can't be used: %s", s.RealmID, err))
+	}
+	return append(problems, types.CheckJoinedRooms(client, util.SortedKeys(s.Rooms))...), nil
+}
+
+func (s *pagerdutyService) PostRegister(oldService types.Service) {}
+
+func init() {
+	types.RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) types.Service {
+		return &pagerdutyService{
+			id:                 serviceID,
+			serviceUserID:      serviceUserID,
+			webhookEndpointURL: webhookEndpointURL,
+		}
+	})
+}
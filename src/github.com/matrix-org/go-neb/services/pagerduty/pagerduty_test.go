@@ -0,0 +1,167 @@
+package services
+
+import (
+	"encoding/json"
+	"github.com/matrix-org/go-neb/signatures"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// incidentTriggered is PagerDuty's documented example of a V3 webhook.
+const incidentTriggered = `{
+  "event": {
+    "id": "5ac64822-4adc-4fda-ade0-410becf0de4f",
+    "event_type": "incident.triggered",
+    "resource_type": "incident",
+    "occurred_at": "2020-10-02T18:45:22.169Z",
+    "agent": {
+      "html_url": "https://acme.pagerduty.com/users/PLH1HKV",
+      "id": "PLH1HKV",
+      "self": "https://api.pagerduty.com/users/PLH1HKV",
+      "summary": "Tenex Engineer",
+      "type": "user_reference"
+    },
+    "data": {
+      "id": "PGR0VU2",
+      "type": "incident",
+      "self": "https://api.pagerduty.com/incidents/PGR0VU2",
+      "html_url": "https://acme.pagerduty.com/incidents/PGR0VU2",
+      "number": 2,
+      "status": "triggered",
+      "incident_key": "d3640fbd41094207a1c11e58e46b1662",
+      "created_at": "2020-04-09T15:16:27Z",
+      "title": "A little <bump> in the road",
+      "service": {
+        "html_url": "https://acme.pagerduty.com/services/PF9KMXH",
+        "id": "PF9KMXH",
+        "self": "https://api.pagerduty.com/services/PF9KMXH",
+        "summary": "API Service",
+        "type": "service_reference"
+      },
+      "assignees": [
+        {
+          "html_url": "https://acme.pagerduty.com/users/PTUXL6G",
+          "id": "PTUXL6G",
+          "self": "https://api.pagerduty.com/users/PTUXL6G",
+          "summary": "User 123",
+          "type": "user_reference"
+        }
+      ],
+      "priority": {
+        "html_url": "https://acme.pagerduty.com/account/incident_priorities",
+        "id": "PSO75BM",
+        "self": "https://api.pagerduty.com/priorities/PSO75BM",
+        "summary": "P1",
+        "type": "priority"
+      },
+      "urgency": "high"
+    }
+  }
+}`
+
+func parse(t *testing.T, body string) *pagerdutyPayload {
+	var p pagerdutyPayload
+	if err := json.Unmarshal([]byte(body), &p); err != nil {
+		t.Fatal(err)
+	}
+	return &p
+}
+
+func TestIncidentMessage(t *testing.T) {
+	msg := incidentMessage(parse(t, incidentTriggered), "?")
+	wantBody := "[API Service] Incident #2 triggered: A little <bump> in the road - https://acme.pagerduty.com/incidents/PGR0VU2\n" +
+		"high urgency, priority P1, assigned to User 123\n" +
+		"Acknowledge with ?pd ack PGR0VU2"
+	if msg.Body != wantBody {
+		t.Errorf("incidentMessage body => want %q got %q", wantBody, msg.Body)
+	}
+	wantHTML := `<b>[API Service]</b> <font color="#d9534f">Incident #2 triggered</font>: ` +
+		`<a href="https://acme.pagerduty.com/incidents/PGR0VU2">A little &lt;bump&gt; in the road</a>` +
+		`<br>high urgency, priority P1, assigned to User 123<br>Acknowledge with <code>?pd ack PGR0VU2</code>`
+	if msg.FormattedBody != wantHTML {
+		t.Errorf("incidentMessage HTML => want %q got %q", wantHTML, msg.FormattedBody)
+	}
+
+	resolved := strings.Replace(incidentTriggered, `"incident.triggered"`, `"incident.resolved"`, 1)
+	msg = incidentMessage(parse(t, resolved), "!")
+	wantBody = "[API Service] Incident #2 resolved by Tenex Engineer: A little <bump> in the road - https://acme.pagerduty.com/incidents/PGR0VU2\n" +
+		"high urgency, priority P1"
+	if msg.Body != wantBody {
+		t.Errorf("incidentMessage body => want %q got %q", wantBody, msg.Body)
+	}
+}
+
+func TestWants(t *testing.T) {
+	s := &pagerdutyService{Rooms: map[string]pagerdutyRoom{
+		"!all:x":   {},
+		"!id:x":    {Services: []string{"PF9KMXH"}},
+		"!name:x":  {Services: []string{"api service"}},
+		"!other:x": {Services: []string{"PXXXXXX", "Web Service"}},
+	}}
+	p := parse(t, incidentTriggered)
+	for roomID, want := range map[string]bool{"!all:x": true, "!id:x": true, "!name:x": true, "!other:x": false} {
+		if got := s.wants(roomID, p); got != want {
+			t.Errorf("wants(%s) => want %v got %v", roomID, want, got)
+		}
+	}
+}
+
+func TestParseIncidentID(t *testing.T) {
+	for in, want := range map[string]string{
+		"PGR0VU2": "PGR0VU2",
+		"https://acme.pagerduty.com/incidents/PGR0VU2":  "PGR0VU2",
+		"https://acme.pagerduty.com/incidents/PGR0VU2/": "PGR0VU2",
+		"pgr0vu2":     "",
+		"../users/me": "",
+		"PGR0VU2?x=1": "",
+	} {
+		if got := parseIncidentID(in); got != want {
+			t.Errorf("parseIncidentID(%q) => want %q got %q", in, want, got)
+		}
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	var s pagerdutyService
+	if err := json.Unmarshal([]byte(`{"Rooms": {"not-a-room": {}}, "CommandPrefixes": {"bad": "?"}}`), &s); err != nil {
+		t.Fatal(err)
+	}
+	var fields []string
+	for _, e := range s.ValidateConfig() {
+		fields = append(fields, e.Field)
+	}
+	want := "Secret RealmID Rooms[not-a-room] CommandPrefixes[bad]"
+	if got := strings.Join(fields, " "); got != want {
+		t.Errorf("ValidateConfig fields => want %q got %q", want, got)
+	}
+}
+
+func TestOnReceiveWebhookFiltered(t *testing.T) {
+	var s pagerdutyService
+	if err := json.Unmarshal([]byte(`{"Secret": "secret", "Rooms": {"!r:x": {"Services": ["Web Service"]}}}`), &s); err != nil {
+		t.Fatal(err)
+	}
+	ping := `{"event": {"event_type": "pagey.ping", "data": {"message": "Hello from your friend Pagey!"}}}`
+	for _, test := range []struct {
+		body      string
+		signature string
+		want      int
+	}{
+		{incidentTriggered, signatures.PagerDuty{}.Sign([]byte(incidentTriggered), "secret"), 200}, // another service's
+		{ping, signatures.PagerDuty{}.Sign([]byte(ping), "secret"), 200},
+		{"not json", signatures.PagerDuty{}.Sign([]byte("not json"), "secret"), 400},
+		{incidentTriggered, signatures.PagerDuty{}.Sign([]byte(incidentTriggered), "wrong"), 401},
+		{incidentTriggered, "", 401},
+	} {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(test.body))
+		if test.signature != "" {
+			req.Header.Set("X-PagerDuty-Signature", test.signature)
+		}
+		w := httptest.NewRecorder()
+		s.OnReceiveWebhook(w, req, nil)
+		if w.Code != test.want {
+			t.Errorf("OnReceiveWebhook with signature %q => want HTTP %d got %d", test.signature, test.want, w.Code)
+		}
+	}
+}
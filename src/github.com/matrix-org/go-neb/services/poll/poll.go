@@ -0,0 +1,298 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/plugin"
+	"github.com/matrix-org/go-neb/types"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// voteKeys are the reactions which vote for each option, in order: the keycap digits, then 🔟.
+var voteKeys = []string{
+	"1️⃣", "2️⃣", "3️⃣", "4️⃣", "5️⃣",
+	"6️⃣", "7️⃣", "8️⃣", "9️⃣", "🔟",
+}
+
+// pollsMutex is held whilst a poll is loaded, changed and stored, so that votes cast at the same
+// time aren't lost.
+var pollsMutex sync.Mutex
+
+type pollService struct {
+	id            string
+	serviceUserID string
+	// CommandPrefixes are what commands start with in each room, e.g. {"!foo:bar": "?"}, so that
+	// several bots in a room can be told apart. Optional: in other rooms commands start with "!".
+	CommandPrefixes map[string]string
+}
+
+func (s *pollService) ServiceUserID() string { return s.serviceUserID }
+func (s *pollService) ServiceID() string     { return s.id }
+func (s *pollService) ServiceType() string   { return "poll" }
+func (s *pollService) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli *matrix.Client) {
+	w.WriteHeader(200) // Do nothing
+}
+func (s *pollService) ValidateConfig() []types.ConfigError {
+	return types.ValidateCommandPrefixes(s.CommandPrefixes)
+}
+func (s *pollService) Register(oldService types.Service, client *matrix.Client) error { return nil }
+func (s *pollService) PostRegister(oldService types.Service)                          {}
+
+func (s *pollService) Plugin(client *matrix.Client, roomID string) plugin.Plugin {
+	return plugin.Plugin{
+		Prefix: s.CommandPrefixes[roomID],
+		Commands: []plugin.Command{
+			plugin.Command{
+				Path:      []string{"poll"},
+				Arguments: []string{"[question]", "[option...]"},
+				Help:      "Ask the room a question, with up to 10 options to vote for, or show how the open poll stands",
+				Command: func(roomID, userID string, args []string) (interface{}, error) {
+					return s.cmdPoll(client, roomID, args)
+				},
+			},
+			plugin.Command{
+				Path: []string{"poll", "close"},
+				Help: "Close the open poll and show its results",
+				Command: func(roomID, userID string, args []string) (interface{}, error) {
+					return s.cmdPollClose(roomID)
+				},
+			},
+		},
+	}
+}
+
+func (s *pollService) prefix(roomID string) string {
+	if prefix := s.CommandPrefixes[roomID]; prefix != "" {
+		return prefix
+	}
+	return plugin.DefaultPrefix
+}
+
+func (s *pollService) cmdPoll(cli *matrix.Client, roomID string, args []string) (interface{}, error) {
+	poll, content, err := s.startPoll(cli, roomID, args)
+	if err != nil || content != nil {
+		return content, err
+	}
+	// Offer the reactions to vote with, so that voting is a single click.
+	for i := range poll.Options {
+		if _, err = cli.SendReaction(roomID, poll.EventID, voteKeys[i]); err != nil {
+			log.WithError(err).WithField("room_id", roomID).Warn("Failed to add a vote reaction to a poll")
+			break
+		}
+	}
+	return nil, nil
+}
+
+// startPoll posts and stores a new poll, or returns how the open poll stands if no question is
+// given.
+func (s *pollService) startPoll(cli *matrix.Client, roomID string, args []string) (*types.Poll, interface{}, error) {
+	pollsMutex.Lock()
+	defer pollsMutex.Unlock()
+	poll, err := database.GetServiceDB().LoadPoll(s.id, roomID)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, nil, err
+	}
+	open := err == nil
+	if len(args) == 0 {
+		if !open {
+			return nil, nil, fmt.Errorf(`There is no poll open in this room. Start one with %spoll "Question" "Option A" "Option B"`, s.prefix(roomID))
+		}
+		return nil, &matrix.TextMessage{"m.notice", describe(poll, "Poll: "+poll.Question)}, nil
+	}
+	if open {
+		return nil, nil, fmt.Errorf("There is already a poll open in this room. Close it with %spoll close first", s.prefix(roomID))
+	}
+	if len(args) < 3 {
+		return nil, nil, fmt.Errorf(`A poll needs a question and at least 2 options, e.g. %spoll "Lunch?" "Pizza" "Sushi"`, s.prefix(roomID))
+	}
+	if len(args) > len(voteKeys)+1 {
+		return nil, nil, fmt.Errorf("A poll can have at most %d options", len(voteKeys))
+	}
+	poll = types.Poll{
+		ServiceID: s.id,
+		RoomID:    roomID,
+		Question:  args[0],
+		Options:   args[1:],
+	}
+	lines := []string{"Poll: " + poll.Question}
+	for i, option := range poll.Options {
+		lines = append(lines, fmt.Sprintf("%d. %s", i+1, option))
+	}
+	lines = append(lines, "Vote by reacting with the number of your choice, or by replying with it.")
+	poll.EventID, err = cli.SendMessageEvent(roomID, "m.room.message", &matrix.TextMessage{"m.notice", strings.Join(lines, "\n")})
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = database.GetServiceDB().StorePoll(poll); err != nil {
+		return nil, nil, err
+	}
+	return &poll, nil, nil
+}
+
+func (s *pollService) cmdPollClose(roomID string) (interface{}, error) {
+	pollsMutex.Lock()
+	defer pollsMutex.Unlock()
+	db := database.GetServiceDB()
+	poll, err := db.LoadPoll(s.id, roomID)
+	if err == sql.ErrNoRows {
+		return nil, errors.New("There is no poll open in this room")
+	} else if err != nil {
+		return nil, err
+	}
+	if err = db.DeletePoll(s.id, roomID); err != nil {
+		return nil, err
+	}
+	return &matrix.TextMessage{"m.notice", describe(poll, "Results of the poll: "+poll.Question)}, nil
+}
+
+// OnMessageEvent counts replies which are just the number of an option as votes for it.
+func (s *pollService) OnMessageEvent(cli *matrix.Client, event *matrix.Event) {
+	if event.Sender == cli.UserID {
+		return
+	}
+	if msgtype, ok := event.MessageType(); !ok || msgtype != "m.text" {
+		return
+	}
+	body, _ := event.Body()
+	n, err := strconv.Atoi(strings.TrimSpace(body))
+	if err != nil || n < 1 || n > len(voteKeys) {
+		return
+	}
+	s.vote(event.RoomID, event.Sender, n-1, "", "")
+}
+
+// OnReactionEvent counts reactions to an open poll with the number of an option as votes for it,
+// and withdraws the vote if the reaction is redacted.
+func (s *pollService) OnReactionEvent(cli *matrix.Client, event *matrix.Event) {
+	if event.Sender == cli.UserID {
+		return
+	}
+	if event.Type == "m.room.redaction" {
+		s.withdraw(event.RoomID, event.RedactedEventID())
+		return
+	}
+	rel, ok := event.Relation()
+	if !ok || rel.RelType != "m.annotation" {
+		return
+	}
+	option := optionForKey(rel.Key)
+	if option < 0 {
+		return
+	}
+	s.vote(event.RoomID, event.Sender, option, rel.EventID, event.ID)
+}
+
+// vote records the user's vote for the option of the poll open in the room, replacing any vote they
+// cast before. If they voted by reacting, reactedToID is the ID of the event they reacted to, which
+// must be the poll's, and reactionID is the ID of their reaction.
+func (s *pollService) vote(roomID, userID string, option int, reactedToID, reactionID string) {
+	pollsMutex.Lock()
+	defer pollsMutex.Unlock()
+	db := database.GetServiceDB()
+	poll, err := db.LoadPoll(s.id, roomID)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.WithError(err).WithField("room_id", roomID).Error("Failed to load poll")
+		}
+		return
+	}
+	if option >= len(poll.Options) || (reactedToID != "" && reactedToID != poll.EventID) {
+		return
+	}
+	if poll.Votes == nil {
+		poll.Votes = make(map[string]int)
+	}
+	if poll.VoteReactions == nil {
+		poll.VoteReactions = make(map[string]string)
+	}
+	poll.Votes[userID] = option
+	if reactionID != "" {
+		poll.VoteReactions[userID] = reactionID
+	} else {
+		delete(poll.VoteReactions, userID)
+	}
+	if err = db.StorePoll(poll); err != nil {
+		log.WithError(err).WithField("room_id", roomID).Error("Failed to store vote")
+	}
+}
+
+// withdraw withdraws the vote which was cast with the reaction, if it is still counted.
+func (s *pollService) withdraw(roomID, reactionID string) {
+	pollsMutex.Lock()
+	defer pollsMutex.Unlock()
+	db := database.GetServiceDB()
+	poll, err := db.LoadPoll(s.id, roomID)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.WithError(err).WithField("room_id", roomID).Error("Failed to load poll")
+		}
+		return
+	}
+	for userID, id := range poll.VoteReactions {
+		if id != reactionID {
+			continue
+		}
+		delete(poll.Votes, userID)
+		delete(poll.VoteReactions, userID)
+		if err = db.StorePoll(poll); err != nil {
+			log.WithError(err).WithField("room_id", roomID).Error("Failed to store withdrawn vote")
+		}
+		return
+	}
+}
+
+// optionForKey returns the index of the option a reaction votes for, or -1 if it isn't a vote.
+func optionForKey(key string) int {
+	for i, voteKey := range voteKeys {
+		if key == voteKey {
+			return i
+		}
+	}
+	if n, err := strconv.Atoi(key); err == nil && n >= 1 && n <= len(voteKeys) {
+		return n - 1
+	}
+	return -1
+}
+
+// describe lists the poll's options with the votes cast for each, under the title.
+func describe(poll types.Poll, title string) string {
+	counts := make([]int, len(poll.Options))
+	for _, option := range poll.Votes {
+		if option < len(counts) {
+			counts[option]++
+		}
+	}
+	lines := []string{title}
+	for i, option := range poll.Options {
+		line := fmt.Sprintf("%d. %s: %s", i+1, option, plural(counts[i], "vote"))
+		if len(poll.Votes) > 0 {
+			line += fmt.Sprintf(" (%d%%)", counts[i]*100/len(poll.Votes))
+		}
+		lines = append(lines, line)
+	}
+	lines = append(lines, plural(len(poll.Votes), "vote")+" in total")
+	return strings.Join(lines, "\n")
+}
+
+func plural(n int, noun string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, noun)
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
+
+func init() {
+	types.RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) types.Service {
+		return &pollService{
+			id:            serviceID,
+			serviceUserID: serviceUserID,
+		}
+	})
+}
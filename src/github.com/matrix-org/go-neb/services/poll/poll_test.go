@@ -0,0 +1,41 @@
+package services
+
+import (
+	"github.com/matrix-org/go-neb/types"
+	"testing"
+)
+
+func TestOptionForKey(t *testing.T) {
+	for key, want := range map[string]int{
+		"1️⃣": 0,
+		"9️⃣": 8,
+		"🔟":   9,
+		"2":   1,
+		"10":  9,
+		"11":  -1,
+		"0":   -1,
+		"👍":   -1,
+		"":    -1,
+	} {
+		if got := optionForKey(key); got != want {
+			t.Errorf("optionForKey(%q) => Want %d got %d", key, want, got)
+		}
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	poll := types.Poll{
+		Question: "Lunch?",
+		Options:  []string{"Pizza", "Sushi", "Salad"},
+		Votes:    map[string]int{"@a:x": 0, "@b:x": 1, "@c:x": 0},
+	}
+	want := "Results of the poll: Lunch?\n1. Pizza: 2 votes (66%)\n2. Sushi: 1 vote (33%)\n3. Salad: 0 votes (0%)\n3 votes in total"
+	if got := describe(poll, "Results of the poll: Lunch?"); got != want {
+		t.Errorf("describe => Want:\n%s\ngot:\n%s", want, got)
+	}
+	poll.Votes = nil
+	want = "Poll: Lunch?\n1. Pizza: 0 votes\n2. Sushi: 0 votes\n3. Salad: 0 votes\n0 votes in total"
+	if got := describe(poll, "Poll: Lunch?"); got != want {
+		t.Errorf("describe with no votes => Want:\n%s\ngot:\n%s", want, got)
+	}
+}
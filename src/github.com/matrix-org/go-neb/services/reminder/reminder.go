@@ -0,0 +1,156 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/plugin"
+	"github.com/matrix-org/go-neb/scheduler"
+	"github.com/matrix-org/go-neb/types"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxDays is the furthest ahead, in days, a reminder can be set.
+const maxDays = 366
+
+// daysRegex matches the days at the start of a delay such as "2d12h", which time.ParseDuration
+// doesn't understand.
+var daysRegex = regexp.MustCompile(`^(\d+)d`)
+
+// A reminder is the data of a scheduled job which sends a reminder.
+type reminder struct {
+	RoomID string
+	UserID string
+	Text   string
+	// Direct is true if the reminder is sent to the user in a direct room, rather than into RoomID.
+	Direct bool
+}
+
+type reminderService struct {
+	id            string
+	serviceUserID string
+	// CommandPrefixes are what commands start with in each room, e.g. {"!foo:bar": "?"}, so that
+	// several bots in a room can be told apart. Optional: in other rooms commands start with "!".
+	CommandPrefixes map[string]string
+}
+
+func (s *reminderService) ServiceUserID() string { return s.serviceUserID }
+func (s *reminderService) ServiceID() string     { return s.id }
+func (s *reminderService) ServiceType() string   { return "reminder" }
+func (s *reminderService) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli *matrix.Client) {
+	w.WriteHeader(200) // Do nothing
+}
+func (s *reminderService) ValidateConfig() []types.ConfigError {
+	return types.ValidateCommandPrefixes(s.CommandPrefixes)
+}
+func (s *reminderService) Register(oldService types.Service, client *matrix.Client) error { return nil }
+func (s *reminderService) PostRegister(oldService types.Service)                          {}
+
+func (s *reminderService) Plugin(client *matrix.Client, roomID string) plugin.Plugin {
+	return plugin.Plugin{
+		Prefix: s.CommandPrefixes[roomID],
+		Commands: []plugin.Command{
+			plugin.Command{
+				Path:      []string{"remind"},
+				Arguments: []string{"delay", "text"},
+				Help:      "Remind you of the text in this room after the delay, e.g. 2h30m or 1d",
+				Command: func(roomID, userID string, args []string) (interface{}, error) {
+					return s.cmdRemind(roomID, userID, args, false)
+				},
+			},
+			plugin.Command{
+				Path:      []string{"remind", "dm"},
+				Arguments: []string{"delay", "text"},
+				Help:      "Remind you of the text in a direct message after the delay",
+				Command: func(roomID, userID string, args []string) (interface{}, error) {
+					return s.cmdRemind(roomID, userID, args, true)
+				},
+			},
+		},
+	}
+}
+
+func (s *reminderService) cmdRemind(roomID, userID string, args []string, direct bool) (interface{}, error) {
+	if len(args) < 2 {
+		return nil, errors.New("Usage: !remind [dm] <delay> <text>, e.g. !remind 2h30m take the pizza out")
+	}
+	delay, err := parseDelay(args[0])
+	if err != nil {
+		return nil, err
+	}
+	due := time.Now().Add(delay)
+	_, err = scheduler.Schedule(s.id, due, reminder{
+		RoomID: roomID,
+		UserID: userID,
+		Text:   strings.Join(args[1:], " "),
+		Direct: direct,
+	})
+	if err != nil {
+		return nil, err
+	}
+	where := "here"
+	if direct {
+		where = "in a direct message"
+	}
+	return &matrix.TextMessage{"m.notice", fmt.Sprintf(
+		"OK, I'll remind you %s at %s", where, due.UTC().Format("2006-01-02 15:04 MST"),
+	)}, nil
+}
+
+// RunJob sends a reminder.
+func (s *reminderService) RunJob(cli *matrix.Client, job types.ScheduledJob) error {
+	var r reminder
+	if err := json.Unmarshal(job.Data, &r); err != nil {
+		return err
+	}
+	if r.Direct {
+		_, err := cli.SendDirect(r.UserID, &matrix.TextMessage{"m.notice", "Reminder: " + r.Text})
+		return err
+	}
+	_, err := cli.SendMessageEvent(r.RoomID, "m.room.message", &matrix.TextMessage{
+		"m.notice", fmt.Sprintf("%s: reminder: %s", r.UserID, r.Text),
+	})
+	return err
+}
+
+// parseDelay parses how long to wait before sending a reminder, e.g. "90s", "2h30m" or "1d12h".
+func parseDelay(s string) (time.Duration, error) {
+	given := s
+	var delay time.Duration
+	if m := daysRegex.FindStringSubmatch(s); m != nil {
+		days, err := strconv.Atoi(m[1])
+		if err != nil || days > maxDays {
+			return 0, fmt.Errorf("Reminders can't be set more than %d days ahead", maxDays)
+		}
+		delay = time.Duration(days) * 24 * time.Hour
+		s = s[len(m[0]):]
+	}
+	if s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return 0, fmt.Errorf("Bad delay %q: give it like 2h30m or 1d", given)
+		}
+		delay += d
+	}
+	if delay <= 0 {
+		return 0, errors.New("The delay must be in the future")
+	}
+	if delay > maxDays*24*time.Hour {
+		return 0, fmt.Errorf("Reminders can't be set more than %d days ahead", maxDays)
+	}
+	return delay, nil
+}
+
+func init() {
+	types.RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) types.Service {
+		return &reminderService{
+			id:            serviceID,
+			serviceUserID: serviceUserID,
+		}
+	})
+}
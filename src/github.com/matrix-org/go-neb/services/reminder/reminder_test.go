@@ -0,0 +1,37 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDelay(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"90s", 90 * time.Second, false},
+		{"2h30m", 2*time.Hour + 30*time.Minute, false},
+		{"1d", 24 * time.Hour, false},
+		{"1d12h", 36 * time.Hour, false},
+		{"366d", 366 * 24 * time.Hour, false},
+		{"367d", 0, true},
+		{"9999999999999999999d", 0, true},
+		{"-5m", 0, true},
+		{"0s", 0, true},
+		{"soon", 0, true},
+		{"1dx", 0, true},
+	} {
+		got, err := parseDelay(tc.in)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("parseDelay(%q) => Want an error got %s", tc.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("parseDelay(%q) => Want %s got %s, %v", tc.in, tc.want, got, err)
+		}
+	}
+}
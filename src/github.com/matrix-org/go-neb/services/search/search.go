@@ -0,0 +1,290 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/matrix-org/go-neb/httpclient"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/plugin"
+	"github.com/matrix-org/go-neb/types"
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+	"html"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// wikipediaURL returns the base URL of the Wikipedia in the language. It is a variable so that
+// tests can point it elsewhere.
+var wikipediaURL = func(language string) string {
+	return "https://" + language + ".wikipedia.org"
+}
+
+// ddgURL is DuckDuckGo's Instant Answer API. It is a variable so that tests can point it elsewhere.
+var ddgURL = "https://api.duckduckgo.com/"
+
+// defaultMaxLength is how many characters of a summary are shown if MaxLength isn't given.
+const defaultMaxLength = 400
+
+// maxRelatedTopics is how many related topics are listed when DuckDuckGo has no summary.
+const maxRelatedTopics = 3
+
+// languageRegex matches the language codes of Wikipedias, e.g. "en", "simple" or "zh-yue".
+var languageRegex = regexp.MustCompile(`^[a-z]{2,3}(-[a-z]+)*$|^simple$`)
+
+type wikiSummary struct {
+	Type        string `json:"type"`
+	Title       string `json:"title"`
+	Extract     string `json:"extract"`
+	ContentURLs struct {
+		Desktop struct {
+			Page string `json:"page"`
+		} `json:"desktop"`
+	} `json:"content_urls"`
+}
+
+type ddgTopic struct {
+	Text     string `json:"Text"`
+	FirstURL string `json:"FirstURL"`
+}
+
+type ddgResult struct {
+	Heading        string     `json:"Heading"`
+	Answer         string     `json:"Answer"`
+	AbstractText   string     `json:"AbstractText"`
+	AbstractSource string     `json:"AbstractSource"`
+	AbstractURL    string     `json:"AbstractURL"`
+	Definition     string     `json:"Definition"`
+	DefinitionURL  string     `json:"DefinitionURL"`
+	Redirect       string     `json:"Redirect"`
+	RelatedTopics  []ddgTopic `json:"RelatedTopics"` // groups of topics have no FirstURL, and are skipped
+}
+
+type searchService struct {
+	id            string
+	serviceUserID string
+	// WikipediaLanguage is the language code of the Wikipedia !wiki looks things up in, e.g. "de".
+	// Optional: "en" if not given.
+	WikipediaLanguage string
+	// MaxLength is how many characters of a summary are shown, so that long ones don't flood the
+	// room. Optional: 400 if not given.
+	MaxLength int
+	// CommandPrefixes are what commands start with in each room, e.g. {"!foo:bar": "?"}, so that
+	// several bots in a room can be told apart. Optional: in other rooms commands start with "!".
+	CommandPrefixes map[string]string
+}
+
+func (s *searchService) ServiceUserID() string { return s.serviceUserID }
+func (s *searchService) ServiceID() string     { return s.id }
+func (s *searchService) ServiceType() string   { return "search" }
+func (s *searchService) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli *matrix.Client) {
+	w.WriteHeader(200) // Do nothing
+}
+func (s *searchService) ValidateConfig() []types.ConfigError {
+	errs := types.ValidateCommandPrefixes(s.CommandPrefixes)
+	if s.WikipediaLanguage != "" && !languageRegex.MatchString(s.WikipediaLanguage) {
+		errs = append(errs, types.ConfigError{Field: "WikipediaLanguage", Message: `must be a language code, e.g. "en"`})
+	}
+	if s.MaxLength < 0 {
+		errs = append(errs, types.ConfigError{Field: "MaxLength", Message: "must not be negative"})
+	}
+	return errs
+}
+func (s *searchService) Register(oldService types.Service, client *matrix.Client) error { return nil }
+func (s *searchService) PostRegister(oldService types.Service)                          {}
+
+func (s *searchService) Plugin(client *matrix.Client, roomID string) plugin.Plugin {
+	return plugin.Plugin{
+		Prefix: s.CommandPrefixes[roomID],
+		Commands: []plugin.Command{
+			plugin.Command{
+				Path:      []string{"wiki"},
+				Arguments: []string{"term"},
+				Help:      "Respond with the summary of the Wikipedia article about the term",
+				ContextCommand: func(ctx context.Context, roomID, userID string, args []string) (interface{}, error) {
+					return s.cmdWiki(ctx, args)
+				},
+			},
+			plugin.Command{
+				Path:      []string{"ddg"},
+				Arguments: []string{"query"},
+				Help:      "Respond with DuckDuckGo's instant answer to the query",
+				ContextCommand: func(ctx context.Context, roomID, userID string, args []string) (interface{}, error) {
+					return s.cmdDDG(ctx, args)
+				},
+			},
+		},
+	}
+}
+
+func (s *searchService) maxLength() int {
+	if s.MaxLength > 0 {
+		return s.MaxLength
+	}
+	return defaultMaxLength
+}
+
+// cmdWiki finds the Wikipedia article which best matches the term, and responds with its summary.
+func (s *searchService) cmdWiki(ctx context.Context, args []string) (interface{}, error) {
+	term := strings.Join(args, " ")
+	if term == "" {
+		return matrix.TextMessage{"m.notice", "Usage: !wiki <term>"}, nil
+	}
+	language := s.WikipediaLanguage
+	if language == "" {
+		language = "en"
+	}
+	base := wikipediaURL(language)
+
+	// The summary API only takes exact titles, so look the term up first.
+	q := url.Values{}
+	q.Set("action", "opensearch")
+	q.Set("format", "json")
+	q.Set("namespace", "0")
+	q.Set("limit", "1")
+	q.Set("redirects", "resolve")
+	q.Set("search", term)
+	// [term, [titles], [descriptions], [URLs]]
+	var found []json.RawMessage
+	if err := getJSON(ctx, base+"/w/api.php?"+q.Encode(), &found); err != nil {
+		return nil, err
+	}
+	var titles []string
+	if len(found) > 1 {
+		json.Unmarshal(found[1], &titles)
+	}
+	if len(titles) == 0 {
+		return matrix.TextMessage{"m.notice", fmt.Sprintf("Wikipedia has no article about %q", term)}, nil
+	}
+
+	var summary wikiSummary
+	title := strings.Replace(titles[0], " ", "_", -1)
+	if err := getJSON(ctx, base+"/api/rest_v1/page/summary/"+url.QueryEscape(title), &summary); err != nil {
+		return nil, err
+	}
+	titleHTML := link(summary.ContentURLs.Desktop.Page, summary.Title)
+	if summary.Type == "disambiguation" {
+		return matrix.GetHTMLMessage("m.notice", fmt.Sprintf("<b>%s</b> may refer to several things", titleHTML)), nil
+	}
+	return matrix.GetHTMLMessage("m.notice", fmt.Sprintf(
+		"<b>%s</b>: %s", titleHTML, html.EscapeString(truncate(summary.Extract, s.maxLength())),
+	)), nil
+}
+
+// cmdDDG responds with DuckDuckGo's instant answer to the query: a direct answer, a summary, a
+// definition or related topics, whichever it has first.
+func (s *searchService) cmdDDG(ctx context.Context, args []string) (interface{}, error) {
+	query := strings.Join(args, " ")
+	if query == "" {
+		return matrix.TextMessage{"m.notice", "Usage: !ddg <query>"}, nil
+	}
+	q := url.Values{}
+	q.Set("q", query)
+	q.Set("format", "json")
+	q.Set("no_html", "1")
+	q.Set("no_redirect", "1")
+	q.Set("skip_disambig", "1")
+	var res ddgResult
+	if err := getJSON(ctx, ddgURL+"?"+q.Encode(), &res); err != nil {
+		return nil, err
+	}
+	return matrix.GetHTMLMessage("m.notice", describeDDG(res, query, s.maxLength())), nil
+}
+
+// describeDDG formats DuckDuckGo's instant answer to the query as HTML.
+func describeDDG(res ddgResult, query string, maxLength int) string {
+	switch {
+	case res.Answer != "":
+		return "<b>Answer:</b> " + html.EscapeString(truncate(res.Answer, maxLength))
+	case res.AbstractText != "":
+		text := fmt.Sprintf("<b>%s</b>: %s", link(res.AbstractURL, res.Heading), html.EscapeString(truncate(res.AbstractText, maxLength)))
+		if res.AbstractSource != "" {
+			text += " (" + html.EscapeString(res.AbstractSource) + ")"
+		}
+		return text
+	case res.Definition != "":
+		return fmt.Sprintf("<b>%s</b>: %s", link(res.DefinitionURL, res.Heading), html.EscapeString(truncate(res.Definition, maxLength)))
+	case res.Redirect != "":
+		return link(res.Redirect, res.Redirect)
+	}
+	var items []string
+	for _, topic := range res.RelatedTopics {
+		if len(items) == maxRelatedTopics {
+			break
+		}
+		if topic.FirstURL != "" {
+			items = append(items, "<li>"+link(topic.FirstURL, truncate(topic.Text, maxLength/maxRelatedTopics))+"</li>")
+		}
+	}
+	if len(items) > 0 {
+		heading := res.Heading
+		if heading == "" {
+			heading = query
+		}
+		return fmt.Sprintf("<b>%s</b> may refer to:<ul>%s</ul>", html.EscapeString(heading), strings.Join(items, ""))
+	}
+	return fmt.Sprintf(
+		"DuckDuckGo has no instant answer for %s. %s",
+		html.EscapeString(fmt.Sprintf("%q", query)), link("https://duckduckgo.com/?q="+url.QueryEscape(query), "Search for it"),
+	)
+}
+
+// getJSON fetches the URL and decodes the JSON it responds with into result.
+func getJSON(ctx context.Context, u string, result interface{}) error {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	// Wikipedia asks API clients to say who they are.
+	req.Header.Set("User-Agent", "Go-NEB (https://github.com/matrix-org/go-neb)")
+	res, err := ctxhttp.Do(ctx, httpclient.Default, req)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != 200 {
+		return fmt.Errorf("%s returned HTTP %d", req.URL.Host, res.StatusCode)
+	}
+	return json.NewDecoder(res.Body).Decode(result)
+}
+
+// link returns an HTML link to the URL with the text, or just the text if there is no URL.
+func link(u, text string) string {
+	if u == "" {
+		return html.EscapeString(text)
+	}
+	return fmt.Sprintf(`<a href="%s">%s</a>`, html.EscapeString(u), html.EscapeString(text))
+}
+
+// truncate shortens s to at most n runes, cutting it at the end of a word and ending it with an
+// ellipsis if it was cut.
+func truncate(s string, n int) string {
+	runes := []rune(strings.TrimSpace(s))
+	if len(runes) <= n {
+		return string(runes)
+	}
+	cut := n - 1
+	for i := cut; i > n/2; i-- {
+		if unicode.IsSpace(runes[i]) {
+			cut = i
+			break
+		}
+	}
+	return strings.TrimRightFunc(string(runes[:cut]), func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsPunct(r)
+	}) + "…"
+}
+
+func init() {
+	types.RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) types.Service {
+		return &searchService{
+			id:            serviceID,
+			serviceUserID: serviceUserID,
+		}
+	})
+}
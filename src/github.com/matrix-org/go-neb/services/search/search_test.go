@@ -0,0 +1,101 @@
+package services
+
+import (
+	"encoding/json"
+	"github.com/matrix-org/go-neb/matrix"
+	"golang.org/x/net/context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"short enough", 20, "short enough"},
+		{"  trimmed  ", 7, "trimmed"},
+		{"cut at the end of a word", 13, "cut at the…"},
+		{"cut before punctuation, too", 24, "cut before punctuation…"},
+		{"averyveryverylongword", 10, "averyvery…"},
+		{"naïve café owners", 12, "naïve café…"},
+	}
+	for _, test := range tests {
+		if got := truncate(test.s, test.n); got != test.want {
+			t.Errorf("truncate(%q, %d) => want %q, got %q", test.s, test.n, test.want, got)
+		}
+	}
+}
+
+func TestDescribeDDG(t *testing.T) {
+	tests := []struct {
+		res  ddgResult
+		want string
+	}{
+		{ddgResult{Answer: "42"}, "<b>Answer:</b> 42"},
+		{
+			ddgResult{Heading: "Go", AbstractText: "Go is a <language>.", AbstractSource: "Wikipedia", AbstractURL: "https://en.wikipedia.org/wiki/Go"},
+			`<b><a href="https://en.wikipedia.org/wiki/Go">Go</a></b>: Go is a &lt;language&gt;. (Wikipedia)`,
+		},
+		{ddgResult{Heading: "Go", Definition: "go: to move"}, "<b>Go</b>: go: to move"},
+		{
+			ddgResult{RelatedTopics: []ddgTopic{{Text: "Go, a game"}, {Text: "Go, a language", FirstURL: "https://ddg/lang"}}},
+			`<b>go &amp; stop</b> may refer to:<ul><li><a href="https://ddg/lang">Go, a language</a></li></ul>`,
+		},
+		{
+			ddgResult{},
+			`DuckDuckGo has no instant answer for &#34;go &amp; stop&#34;. <a href="https://duckduckgo.com/?q=go+%26+stop">Search for it</a>`,
+		},
+	}
+	for _, test := range tests {
+		if got := describeDDG(test.res, "go & stop", 100); got != test.want {
+			t.Errorf("describeDDG(%+v) => want %q, got %q", test.res, test.want, got)
+		}
+	}
+}
+
+func TestCmdWiki(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/de/w/api.php":
+			if req.URL.Query().Get("search") == "ac dc" {
+				w.Write([]byte(`["ac dc", ["AC/DC"], [""], ["https://de.wikipedia.org/wiki/AC/DC"]]`))
+			} else {
+				w.Write([]byte(`["nothing", [], [], []]`))
+			}
+		case "/de/api/rest_v1/page/summary/AC/DC":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"type":    "standard",
+				"title":   "AC/DC",
+				"extract": "AC/DC ist eine australische Hard-Rock-Band, die 1973 gegründet wurde.",
+				"content_urls": map[string]interface{}{
+					"desktop": map[string]string{"page": "https://de.wikipedia.org/wiki/AC/DC"},
+				},
+			})
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer srv.Close()
+	oldURL := wikipediaURL
+	wikipediaURL = func(language string) string { return srv.URL + "/" + language }
+	defer func() { wikipediaURL = oldURL }()
+
+	s := searchService{WikipediaLanguage: "de", MaxLength: 40}
+	content, err := s.cmdWiki(context.Background(), []string{"ac", "dc"})
+	if err != nil {
+		t.Fatalf("cmdWiki => want a summary, got error %s", err)
+	}
+	want := matrix.GetHTMLMessage("m.notice", `<b><a href="https://de.wikipedia.org/wiki/AC/DC">AC/DC</a></b>: AC/DC ist eine australische…`)
+	if content != want {
+		t.Errorf("cmdWiki => want %+v, got %+v", want, content)
+	}
+
+	content, err = s.cmdWiki(context.Background(), []string{"nothing"})
+	if msg, ok := content.(matrix.TextMessage); err != nil || !ok || !strings.Contains(msg.Body, "no article") {
+		t.Errorf("cmdWiki of an unknown term => want no article, got %+v, %v", content, err)
+	}
+}
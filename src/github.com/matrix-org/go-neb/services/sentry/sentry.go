@@ -0,0 +1,485 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/batch"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/plugin"
+	"github.com/matrix-org/go-neb/secrets"
+	"github.com/matrix-org/go-neb/server"
+	"github.com/matrix-org/go-neb/signatures"
+	"github.com/matrix-org/go-neb/status"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/go-neb/util"
+	"html"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxBodySize is the largest webhook request Sentry is expected to send. Events include their
+// stack traces, so can be large.
+const maxBodySize = 5 * 1024 * 1024
+
+// defaultRepeatWindow is how long repeats of an issue are not sent for, if RepeatWindow isn't given.
+const defaultRepeatWindow = 5 * time.Minute
+
+// maxRepeatWindow is the longest RepeatWindow may be, as sent issues are remembered in memory.
+const maxRepeatWindow = 24 * time.Hour
+
+// levels are Sentry's levels, most severe first.
+var levels = []string{"fatal", "error", "warning", "info", "debug"}
+
+// levelColours are the colours levels are shown in. Debug events are left uncoloured.
+var levelColours = map[string]string{
+	"fatal":   "#d9534f",
+	"error":   "#d9534f",
+	"warning": "#f0ad4e",
+	"info":    "#5bc0de",
+}
+
+// projectURLRegex finds a project's slug in the API URL of one of its events, e.g.
+// "https://sentry.io/api/0/projects/my-org/my-project/events/abc/".
+var projectURLRegex = regexp.MustCompile(`/projects/[^/]+/([^/]+)/events/`)
+
+// now is the current time, replaced in tests.
+var now = time.Now
+
+// recentIssues holds when each issue sent into a room may next be sent again, keyed by service ID,
+// room ID and issue ID, so that rapid repeats aren't sent.
+var (
+	recentIssues   = make(map[string]time.Time)
+	recentIssuesMu sync.Mutex
+)
+
+// sentryService posts a message to rooms when a Sentry integration sends a webhook about an issue
+// alert firing, a new issue, or an issue regressing. Each room is sent the issues in the projects
+// and at the levels it wants.
+type sentryService struct {
+	id                 string
+	serviceUserID      string
+	webhookEndpointURL string
+	// ClientSecret is the client secret of the Sentry integration which sends the webhooks, which
+	// it signs them with. Requests which aren't signed with it are rejected.
+	ClientSecret secrets.Secret
+	// AllowedIPs are the IP addresses and CIDR ranges Sentry may send webhook requests from.
+	// Optional: requests are allowed from anywhere.
+	AllowedIPs []string
+	// RepeatWindow is how long after an issue is sent into a room further webhooks about it aren't,
+	// e.g. "10m", so that an issue which fires several alerts at once is only sent once. "0s" sends
+	// every webhook. Optional: "5m" if not given.
+	RepeatWindow string
+	// AlertIfQuietFor is how long to go without a webhook from Sentry before alerting the
+	// operators that it is probably broken, e.g. "168h". Optional: they are never alerted.
+	AlertIfQuietFor string
+	Rooms           map[string]sentryRoom // room_id => room
+}
+
+// sentryRoom is which issues a room is sent.
+type sentryRoom struct {
+	// Projects are the slugs or IDs of the projects whose issues the room is sent. Optional: it is
+	// sent every project's.
+	Projects []string
+	// Levels are the levels of issues the room is sent, e.g. ["fatal", "error"]. Optional: it is
+	// sent issues of every level.
+	Levels []string
+}
+
+// sentryID is an ID which Sentry sends as either a number or a string, depending on the payload.
+type sentryID string
+
+func (id *sentryID) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*id = sentryID(s)
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return err
+	}
+	*id = sentryID(n)
+	return nil
+}
+
+// sentryPayload is the payload of a Sentry integration's webhooks about issue alerts, which have
+// the resource "event_alert", and issues, which have the resource "issue".
+type sentryPayload struct {
+	Action string `json:"action"`
+	Data   struct {
+		TriggeredRule string `json:"triggered_rule"`
+		Event         *struct {
+			IssueID sentryID `json:"issue_id"`
+			Project sentryID `json:"project"`
+			Level   string   `json:"level"`
+			Culprit string   `json:"culprit"`
+			Title   string   `json:"title"`
+			URL     string   `json:"url"`
+			WebURL  string   `json:"web_url"`
+		} `json:"event"`
+		Issue *struct {
+			ID        sentryID `json:"id"`
+			Title     string   `json:"title"`
+			Culprit   string   `json:"culprit"`
+			Level     string   `json:"level"`
+			Substatus string   `json:"substatus"`
+			WebURL    string   `json:"web_url"`
+			Permalink string   `json:"permalink"`
+			Project   struct {
+				ID   sentryID `json:"id"`
+				Slug string   `json:"slug"`
+			} `json:"project"`
+		} `json:"issue"`
+	} `json:"data"`
+}
+
+// An issue is what a webhook is about, whichever resource it is for.
+type issue struct {
+	Kind        string // "New issue", "Regression", or "Alert" with the rule's name
+	ID          string
+	ProjectID   string
+	ProjectSlug string // Optional: event alerts may not say
+	Level       string
+	Title       string
+	Culprit     string
+	URL         string
+}
+
+func (s *sentryService) ServiceUserID() string { return s.serviceUserID }
+func (s *sentryService) ServiceID() string     { return s.id }
+func (s *sentryService) ServiceType() string   { return "sentry" }
+func (s *sentryService) Plugin(cli *matrix.Client, roomID string) plugin.Plugin {
+	return plugin.Plugin{}
+}
+func (s *sentryService) WebhookAllowedIPs() []string { return s.AllowedIPs }
+func (s *sentryService) QuietPeriod() time.Duration {
+	d, _ := status.ParseQuietPeriod(s.AlertIfQuietFor) // ValidateConfig checks it parses
+	return d
+}
+
+// OnReceiveWebhook sends a message about the issue to each room which wants it and hasn't been sent
+// it within the repeat window.
+func (s *sentryService) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli *matrix.Client) {
+	logger := server.RequestLogger(req)
+	body, err := signatures.ReadAndVerify(req, signatures.Sentry, s.ClientSecret.Value(), maxBodySize)
+	if err != nil {
+		logger.WithError(err).Print("Sentry webhook failed signature check")
+		w.WriteHeader(401)
+		return
+	}
+	if req.Method != "POST" {
+		w.WriteHeader(405)
+		return
+	}
+	var p sentryPayload
+	if err = json.Unmarshal(body, &p); err != nil {
+		logger.WithError(err).Print("Failed to decode Sentry webhook")
+		w.WriteHeader(400)
+		return
+	}
+	is := parseIssue(req.Header.Get("Sentry-Hook-Resource"), p)
+	if is == nil {
+		// e.g. an issue being resolved, or the integration being installed
+		status.Filtered(s.id)
+		w.WriteHeader(200)
+		return
+	}
+	logger = logger.WithFields(log.Fields{
+		"issue_id": is.ID,
+		"project":  is.project(),
+		"kind":     is.Kind,
+	})
+
+	var msgs []batch.Message
+	var keys []string
+	for _, roomID := range util.SortedKeys(s.Rooms) {
+		if !s.wants(roomID, is) {
+			continue
+		}
+		key := s.id + "\x00" + roomID + "\x00" + is.ID
+		if !firstInWindow(key, s.repeatWindow()) {
+			logger.WithField("room_id", roomID).Print("Not sending repeat of issue to room")
+			continue
+		}
+		logger.WithField("room_id", roomID).Print("Sending issue to room")
+		msgs = append(msgs, batch.Message{roomID, "", issueMessage(is)})
+		keys = append(keys, key)
+	}
+	if len(msgs) == 0 {
+		status.Filtered(s.id)
+		w.WriteHeader(200)
+		return
+	}
+	status.Forwarded(s.id)
+	sendErrs := batch.SendAll(cli, s.id, 0, msgs)
+	for i, m := range msgs {
+		if e := sendErrs[m.RoomID]; e != nil {
+			logger.WithError(e).WithField("room_id", m.RoomID).Print("Failed to send notification to room.")
+			// So that a replay of the request isn't taken for a repeat.
+			forget(keys[i])
+		}
+	}
+	if len(sendErrs) > 0 {
+		// So that the request is dead-lettered, to be replayed once the rooms are fixed.
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(200)
+}
+
+// parseIssue returns the issue a webhook for the resource is about, or nil if rooms aren't told
+// about it.
+func parseIssue(resource string, p sentryPayload) *issue {
+	switch {
+	case resource == "event_alert" && p.Action == "triggered" && p.Data.Event != nil:
+		return parseAlert(p)
+	case resource == "issue" && p.Data.Issue != nil:
+		return parseIssueChange(p)
+	}
+	return nil
+}
+
+// parseAlert returns the issue of the event an alert rule was triggered by.
+func parseAlert(p sentryPayload) *issue {
+	ev := p.Data.Event
+	is := &issue{
+		Kind:      "Alert",
+		ID:        string(ev.IssueID),
+		ProjectID: string(ev.Project),
+		Level:     ev.Level,
+		Title:     ev.Title,
+		Culprit:   ev.Culprit,
+		URL:       ev.WebURL,
+	}
+	if p.Data.TriggeredRule != "" {
+		is.Kind = fmt.Sprintf("Alert %q", p.Data.TriggeredRule)
+	}
+	if m := projectURLRegex.FindStringSubmatch(ev.URL); m != nil {
+		is.ProjectSlug = m[1]
+	}
+	return is
+}
+
+// parseIssueChange returns the issue which was created or regressed, or nil if it was changed in
+// some other way.
+func parseIssueChange(p sentryPayload) *issue {
+	iss := p.Data.Issue
+	is := &issue{
+		ID:          string(iss.ID),
+		ProjectID:   string(iss.Project.ID),
+		ProjectSlug: iss.Project.Slug,
+		Level:       iss.Level,
+		Title:       iss.Title,
+		Culprit:     iss.Culprit,
+		URL:         iss.WebURL,
+	}
+	if is.URL == "" {
+		is.URL = iss.Permalink
+	}
+	switch {
+	case p.Action == "created":
+		is.Kind = "New issue"
+	case p.Action == "unresolved" && (iss.Substatus == "regressed" || iss.Substatus == ""):
+		// Older Sentry doesn't send the substatus, and mostly unresolves issues by regression.
+		is.Kind = "Regression"
+	default:
+		return nil
+	}
+	return is
+}
+
+// project returns the issue's project's slug, or its ID if the webhook didn't say.
+func (is *issue) project() string {
+	if is.ProjectSlug != "" {
+		return is.ProjectSlug
+	}
+	return is.ProjectID
+}
+
+// wants returns true if the room is sent issues of the issue's project and level.
+func (s *sentryService) wants(roomID string, is *issue) bool {
+	room := s.Rooms[roomID]
+	if len(room.Projects) > 0 {
+		found := false
+		for _, p := range room.Projects {
+			found = found || p == is.ProjectID || (is.ProjectSlug != "" && p == is.ProjectSlug)
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(room.Levels) > 0 {
+		found := false
+		for _, l := range room.Levels {
+			found = found || strings.EqualFold(l, is.Level)
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// repeatWindow returns how long repeats of an issue aren't sent for.
+func (s *sentryService) repeatWindow() time.Duration {
+	if s.RepeatWindow == "" {
+		return defaultRepeatWindow
+	}
+	d, _ := time.ParseDuration(s.RepeatWindow) // ValidateConfig checks it parses
+	return d
+}
+
+// firstInWindow returns true if the key hasn't been seen within the window, and remembers that it
+// has now. Keys whose windows have passed are forgotten.
+func firstInWindow(key string, window time.Duration) bool {
+	if window <= 0 {
+		return true
+	}
+	t := now()
+	recentIssuesMu.Lock()
+	defer recentIssuesMu.Unlock()
+	for k, until := range recentIssues {
+		if !t.Before(until) {
+			delete(recentIssues, k)
+		}
+	}
+	if _, ok := recentIssues[key]; ok {
+		return false
+	}
+	recentIssues[key] = t.Add(window)
+	return true
+}
+
+// forget forgets that the key was seen.
+func forget(key string) {
+	recentIssuesMu.Lock()
+	delete(recentIssues, key)
+	recentIssuesMu.Unlock()
+}
+
+// issueMessage writes a message about the issue: its project, why it was sent, its title and a link
+// to it, then its level, coloured, and culprit.
+func issueMessage(is *issue) matrix.HTMLMessage {
+	level := strings.ToLower(is.Level)
+	if level == "" {
+		level = "error"
+	}
+	body := fmt.Sprintf("[%s] %s: %s\n[%s]", is.project(), is.Kind, is.Title, level)
+	titleHTML := html.EscapeString(is.Title)
+	if is.URL != "" {
+		titleHTML = fmt.Sprintf(`<a href="%s">%s</a>`, html.EscapeString(is.URL), titleHTML)
+	}
+	levelHTML := "[" + html.EscapeString(level) + "]"
+	if colour := levelColours[level]; colour != "" {
+		levelHTML = fmt.Sprintf(`<font color="%s">%s</font>`, colour, levelHTML)
+	}
+	htmlBody := fmt.Sprintf(
+		"<b>[%s]</b> %s: %s<br>%s", html.EscapeString(is.project()), html.EscapeString(is.Kind), titleHTML, levelHTML,
+	)
+	if is.Culprit != "" {
+		body += " in " + is.Culprit
+		htmlBody += " in <code>" + html.EscapeString(is.Culprit) + "</code>"
+	}
+	if is.URL != "" {
+		body += " - " + is.URL
+	}
+	return matrix.HTMLMessage{
+		Body:          body,
+		MsgType:       "m.notice",
+		Format:        "org.matrix.custom.html",
+		FormattedBody: htmlBody,
+	}
+}
+
+// ValidateConfig checks that the client secret is given, that the allowed IPs, repeat window and
+// quiet period parse, and that every room ID and level is well formed.
+func (s *sentryService) ValidateConfig() []types.ConfigError {
+	var errs []types.ConfigError
+	if s.ClientSecret.Value() == "" {
+		errs = append(errs, types.ConfigError{Field: "ClientSecret", Message: "is required"})
+	}
+	if _, err := server.ParseAllowlist(s.AllowedIPs); err != nil {
+		errs = append(errs, types.ConfigError{Field: "AllowedIPs", Message: "does not parse: " + err.Error()})
+	}
+	if s.RepeatWindow != "" {
+		if d, err := time.ParseDuration(s.RepeatWindow); err != nil {
+			errs = append(errs, types.ConfigError{Field: "RepeatWindow", Message: "is not a valid duration: " + err.Error()})
+		} else if d < 0 || d > maxRepeatWindow {
+			errs = append(errs, types.ConfigError{Field: "RepeatWindow", Message: fmt.Sprintf("must be between 0s and %s", maxRepeatWindow)})
+		}
+	}
+	if _, err := status.ParseQuietPeriod(s.AlertIfQuietFor); err != nil {
+		errs = append(errs, types.ConfigError{Field: "AlertIfQuietFor", Message: "is not a valid period: " + err.Error()})
+	}
+	if len(s.Rooms) == 0 {
+		errs = append(errs, types.ConfigError{Field: "Rooms", Message: "must list at least one room"})
+	}
+	return append(errs, s.validateRooms()...)
+}
+
+// validateRooms checks that every room ID and level in Rooms is well formed.
+func (s *sentryService) validateRooms() []types.ConfigError {
+	var errs []types.ConfigError
+	for _, roomID := range util.SortedKeys(s.Rooms) {
+		roomField := fmt.Sprintf("Rooms[%s]", roomID)
+		if !types.IsRoomID(roomID) {
+			errs = append(errs, types.ConfigError{Field: roomField, Message: "is not a room ID"})
+		}
+		for i, level := range s.Rooms[roomID].Levels {
+			known := false
+			for _, l := range levels {
+				known = known || strings.EqualFold(level, l)
+			}
+			if !known {
+				errs = append(errs, types.ConfigError{
+					Field:   fmt.Sprintf("%s.Levels[%d]", roomField, i),
+					Message: "is not one of " + strings.Join(levels, ", "),
+				})
+			}
+		}
+	}
+	return errs
+}
+
+// Register joins the rooms messages are posted to.
+func (s *sentryService) Register(oldService types.Service, client *matrix.Client) error {
+	for _, roomID := range util.SortedKeys(s.Rooms) {
+		if _, err := client.JoinRoom(roomID, "", ""); err != nil {
+			return err
+		}
+	}
+	log.WithFields(log.Fields{
+		"service_id": s.id,
+		"url":        s.webhookEndpointURL,
+	}).Info("Registered Sentry webhook: make it the webhook URL of a Sentry internal integration")
+	return nil
+}
+
+// PlanRegister works out which rooms Register would join, and notes the webhook URL the Sentry
+// integration needs.
+func (s *sentryService) PlanRegister(oldService types.Service, client *matrix.Client) (*types.RegisterPlan, error) {
+	plan := &types.RegisterPlan{JoinRooms: types.PlanJoinRooms(client, util.SortedKeys(s.Rooms))}
+	plan.Notes = []string{"A Sentry internal integration must be given the webhook URL " + s.webhookEndpointURL}
+	return plan, nil
+}
+
+// CheckRegistered checks that the service's client is still in each room issues are posted to.
+func (s *sentryService) CheckRegistered(client *matrix.Client) ([]string, error) {
+	return types.CheckJoinedRooms(client, util.SortedKeys(s.Rooms)), nil
+}
+
+func (s *sentryService) PostRegister(oldService types.Service) {}
+
+func init() {
+	types.RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) types.Service {
+		return &sentryService{
+			id:                 serviceID,
+			serviceUserID:      serviceUserID,
+			webhookEndpointURL: webhookEndpointURL,
+		}
+	})
+}
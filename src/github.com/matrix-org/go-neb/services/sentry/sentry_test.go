@@ -0,0 +1,172 @@
+package services
+
+import (
+	"encoding/json"
+	"github.com/matrix-org/go-neb/signatures"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const eventAlert = `{
+  "action": "triggered",
+  "data": {
+    "event": {
+      "culprit": "?(runner)",
+      "event_id": "bad2f2a6b4da4d5fa3fb8bbd6b1a9e55",
+      "issue_id": "1170820242",
+      "level": "error",
+      "project": 1,
+      "title": "ReferenceError: blooopy is not defined",
+      "url": "https://sentry.io/api/0/projects/test-org/front-end/events/bad2f2a6b4da4d5fa3fb8bbd6b1a9e55/",
+      "web_url": "https://sentry.io/organizations/test-org/issues/1170820242/events/bad2f2a6b4da4d5fa3fb8bbd6b1a9e55/"
+    },
+    "triggered_rule": "Very Important Alert Rule!"
+  },
+  "installation": {"uuid": "a8e5d37a-696c-4c54-adb5-b3f28d64c7de"}
+}`
+
+const issueCreated = `{
+  "action": "created",
+  "data": {
+    "issue": {
+      "id": "1170820242",
+      "title": "Error: <unknown>",
+      "culprit": "",
+      "level": "warning",
+      "status": "unresolved",
+      "project": {"id": "2", "name": "Back End", "slug": "back-end"},
+      "web_url": "https://sentry.io/organizations/test-org/issues/1170820242/"
+    }
+  }
+}`
+
+func parse(t *testing.T, resource, body string) *issue {
+	var p sentryPayload
+	if err := json.Unmarshal([]byte(body), &p); err != nil {
+		t.Fatal(err)
+	}
+	return parseIssue(resource, p)
+}
+
+func TestParseIssue(t *testing.T) {
+	want := &issue{
+		Kind:        `Alert "Very Important Alert Rule!"`,
+		ID:          "1170820242",
+		ProjectID:   "1",
+		ProjectSlug: "front-end",
+		Level:       "error",
+		Title:       "ReferenceError: blooopy is not defined",
+		Culprit:     "?(runner)",
+		URL:         "https://sentry.io/organizations/test-org/issues/1170820242/events/bad2f2a6b4da4d5fa3fb8bbd6b1a9e55/",
+	}
+	if got := parse(t, "event_alert", eventAlert); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseIssue(event_alert) => want %+v got %+v", want, got)
+	}
+	want = &issue{
+		Kind:        "New issue",
+		ID:          "1170820242",
+		ProjectID:   "2",
+		ProjectSlug: "back-end",
+		Level:       "warning",
+		Title:       "Error: <unknown>",
+		URL:         "https://sentry.io/organizations/test-org/issues/1170820242/",
+	}
+	if got := parse(t, "issue", issueCreated); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseIssue(issue created) => want %+v got %+v", want, got)
+	}
+	regressed := strings.Replace(issueCreated, `"action": "created"`, `"action": "unresolved"`, 1)
+	if got := parse(t, "issue", regressed); got == nil || got.Kind != "Regression" {
+		t.Errorf("parseIssue(issue unresolved) => want a regression got %+v", got)
+	}
+	resolved := strings.Replace(issueCreated, `"action": "created"`, `"action": "resolved"`, 1)
+	if got := parse(t, "issue", resolved); got != nil {
+		t.Errorf("parseIssue(issue resolved) => want nil got %+v", got)
+	}
+	if got := parse(t, "installation", eventAlert); got != nil {
+		t.Errorf("parseIssue(installation) => want nil got %+v", got)
+	}
+}
+
+func TestWants(t *testing.T) {
+	s := &sentryService{Rooms: map[string]sentryRoom{
+		"!all:x":      {},
+		"!frontend:x": {Projects: []string{"front-end"}, Levels: []string{"fatal", "Error"}},
+		"!byid:x":     {Projects: []string{"1"}, Levels: []string{"warning"}},
+	}}
+	is := parse(t, "event_alert", eventAlert)
+	for roomID, want := range map[string]bool{"!all:x": true, "!frontend:x": true, "!byid:x": false} {
+		if got := s.wants(roomID, is); got != want {
+			t.Errorf("wants(%s) => want %t got %t", roomID, want, got)
+		}
+	}
+}
+
+func TestFirstInWindow(t *testing.T) {
+	t0 := time.Now()
+	defer func() { now = time.Now }()
+	for i, test := range []struct {
+		key    string
+		after  time.Duration
+		window time.Duration
+		want   bool
+	}{
+		{"a", 0, time.Minute, true},
+		{"a", 30 * time.Second, time.Minute, false},
+		{"b", 30 * time.Second, time.Minute, true},
+		{"a", time.Minute, time.Minute, true},
+		{"a", time.Minute, 0, true},
+	} {
+		now = func() time.Time { return t0.Add(test.after) }
+		if got := firstInWindow(test.key, test.window); got != test.want {
+			t.Errorf("%d: firstInWindow(%s) after %s => want %t got %t", i, test.key, test.after, test.want, got)
+		}
+	}
+	forget("a")
+	if !firstInWindow("a", time.Minute) {
+		t.Errorf("firstInWindow after forget => want true got false")
+	}
+}
+
+func TestIssueMessage(t *testing.T) {
+	msg := issueMessage(parse(t, "event_alert", eventAlert))
+	wantBody := `[front-end] Alert "Very Important Alert Rule!": ReferenceError: blooopy is not defined` + "\n" +
+		"[error] in ?(runner) - https://sentry.io/organizations/test-org/issues/1170820242/events/bad2f2a6b4da4d5fa3fb8bbd6b1a9e55/"
+	if msg.Body != wantBody {
+		t.Errorf("issueMessage body => want %q got %q", wantBody, msg.Body)
+	}
+	msg = issueMessage(parse(t, "issue", issueCreated))
+	wantHTML := `<b>[back-end]</b> New issue: <a href="https://sentry.io/organizations/test-org/issues/1170820242/">Error: &lt;unknown&gt;</a>` +
+		`<br><font color="#f0ad4e">[warning]</font>`
+	if msg.FormattedBody != wantHTML {
+		t.Errorf("issueMessage HTML => want %q got %q", wantHTML, msg.FormattedBody)
+	}
+}
+
+func TestOnReceiveWebhookFiltered(t *testing.T) {
+	var s sentryService
+	if err := json.Unmarshal([]byte(`{"ClientSecret": "secret", "Rooms": {"!r:x": {"Levels": ["fatal"]}}}`), &s); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		signature string
+		want      int
+	}{
+		{signatures.Sentry.Sign([]byte(eventAlert), "secret"), 200}, // an error, which the room isn't sent
+		{signatures.Sentry.Sign([]byte(eventAlert), "wrong"), 401},
+		{"", 401},
+	} {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(eventAlert))
+		req.Header.Set("Sentry-Hook-Resource", "event_alert")
+		if test.signature != "" {
+			req.Header.Set("Sentry-Hook-Signature", test.signature)
+		}
+		w := httptest.NewRecorder()
+		s.OnReceiveWebhook(w, req, nil)
+		if w.Code != test.want {
+			t.Errorf("OnReceiveWebhook with signature %q => want HTTP %d got %d", test.signature, test.want, w.Code)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/matrix-org/go-neb/httpclient"
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pageInfo is a status page, as its API and webhooks describe it.
+type pageInfo struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type incident struct {
+	ID              string           `json:"id"`
+	Name            string           `json:"name"`
+	Status          string           `json:"status"` // "investigating", "identified", "monitoring", "resolved" or "postmortem"
+	Impact          string           `json:"impact"` // "none", "minor", "major" or "critical"
+	Shortlink       string           `json:"shortlink"`
+	IncidentUpdates []incidentUpdate `json:"incident_updates"`
+	Components      []struct {
+		Name string `json:"name"`
+	} `json:"components"`
+}
+
+type incidentUpdate struct {
+	ID        string    `json:"id"`
+	Status    string    `json:"status"`
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// pageIDs caches the IDs of status pages, keyed by their URL, so that each is only looked up once.
+var (
+	pageIDs   = make(map[string]string)
+	pageIDsMu sync.Mutex
+)
+
+// updates returns the incident's updates, oldest first. Statuspage lists them newest first.
+func (inc *incident) updates() []incidentUpdate {
+	var updates []incidentUpdate
+	for i := len(inc.IncidentUpdates) - 1; i >= 0; i-- {
+		updates = append(updates, inc.IncidentUpdates[i])
+	}
+	return updates
+}
+
+// fetchIncidents returns the page's recent incidents from its public API.
+func fetchIncidents(ctx context.Context, pageURL string) (*pageInfo, []incident, error) {
+	var res struct {
+		Page      pageInfo   `json:"page"`
+		Incidents []incident `json:"incidents"`
+	}
+	if err := getJSON(ctx, pageURL+"/api/v2/incidents.json", &res); err != nil {
+		return nil, nil, err
+	}
+	rememberPageID(pageURL, res.Page.ID)
+	return &res.Page, res.Incidents, nil
+}
+
+// lookupPageID returns the ID of the page at the URL, from its public API.
+func lookupPageID(ctx context.Context, pageURL string) (string, error) {
+	pageIDsMu.Lock()
+	id, ok := pageIDs[pageURL]
+	pageIDsMu.Unlock()
+	if ok {
+		return id, nil
+	}
+	var res struct {
+		Page pageInfo `json:"page"`
+	}
+	if err := getJSON(ctx, pageURL+"/api/v2/status.json", &res); err != nil {
+		return "", err
+	}
+	rememberPageID(pageURL, res.Page.ID)
+	return res.Page.ID, nil
+}
+
+func rememberPageID(pageURL, id string) {
+	if id == "" {
+		return
+	}
+	pageIDsMu.Lock()
+	pageIDs[pageURL] = id
+	pageIDsMu.Unlock()
+}
+
+// getJSON fetches the URL and decodes the JSON it responds with into result.
+func getJSON(ctx context.Context, u string, result interface{}) error {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	res, err := ctxhttp.Do(ctx, httpclient.Default, req)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != 200 {
+		return fmt.Errorf("%s returned HTTP %d", strings.SplitN(u, "?", 2)[0], res.StatusCode)
+	}
+	return json.NewDecoder(res.Body).Decode(result)
+}
@@ -0,0 +1,465 @@
+package services
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/plugin"
+	"github.com/matrix-org/go-neb/secrets"
+	"github.com/matrix-org/go-neb/server"
+	"github.com/matrix-org/go-neb/status"
+	"github.com/matrix-org/go-neb/streams"
+	"github.com/matrix-org/go-neb/types"
+	"golang.org/x/net/context"
+	"html"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxBodySize is the largest webhook request a status page is expected to send.
+const maxBodySize = 1024 * 1024
+
+// minPollInterval is the shortest PollInterval may be, so that status pages aren't hammered.
+const minPollInterval = time.Minute
+
+// maxUpdateAge is how old an incident update found by polling may be and still be sent, so that a
+// new service doesn't send a page's history, but updates made whilst Go-NEB restarted are sent.
+const maxUpdateAge = time.Hour
+
+// sentUpdateTTL is how long a sent incident update is remembered, so that it isn't sent again when
+// both a webhook and polling find it.
+const sentUpdateTTL = 30 * 24 * time.Hour
+
+// impactColours are the colours incidents are shown in, by impact, until they are resolved.
+var impactColours = map[string]string{
+	"critical": "#d9534f",
+	"major":    "#e67e22",
+	"minor":    "#f0ad4e",
+}
+
+// resolvedColour is the colour resolved incidents are shown in.
+const resolvedColour = "#5cb85c"
+
+// markMutex is held whilst an update is checked and marked as sent, so that an update found by a
+// webhook and by polling at once is only sent once.
+var markMutex sync.Mutex
+
+// statuspageService posts a message to rooms when an incident on an Atlassian Statuspage status
+// page, e.g. a third party's, is created, updated or resolved. It hears about incidents from the
+// page's subscriber webhooks, by polling the page's public API, or both.
+type statuspageService struct {
+	id                 string
+	serviceUserID      string
+	webhookEndpointURL string
+	// Token must be sent with every webhook request, as a ?token= query parameter, since status
+	// pages don't sign their webhooks. Optional if PollInterval is given: webhooks are rejected.
+	Token secrets.Secret
+	// AllowedIPs are the IP addresses and CIDR ranges webhooks may be sent from. Optional: requests
+	// are allowed from anywhere.
+	AllowedIPs []string
+	// PollInterval is how often each page's API is polled for incident updates, e.g. "5m".
+	// Optional: pages aren't polled, and incidents are only heard about from webhooks.
+	PollInterval string
+	Pages        []statusPage
+}
+
+// A statusPage is a status page whose incidents are sent into rooms.
+type statusPage struct {
+	// URL is the page's address, e.g. "https://www.githubstatus.com".
+	URL string
+	// ID is the page's ID, which its webhooks carry. Optional: it is looked up from the page's API.
+	ID string
+	// Name is what messages call the page. Optional: the host of URL.
+	Name string
+	// Rooms are the IDs of the rooms the page's incidents are sent into.
+	Rooms []string
+}
+
+// webhookPayload is the payload of a status page's subscriber webhook. Webhooks about components
+// have no incident.
+type webhookPayload struct {
+	Page     pageInfo  `json:"page"`
+	Incident *incident `json:"incident"`
+}
+
+func (s *statuspageService) ServiceUserID() string { return s.serviceUserID }
+func (s *statuspageService) ServiceID() string     { return s.id }
+func (s *statuspageService) ServiceType() string   { return "statuspage" }
+func (s *statuspageService) Plugin(cli *matrix.Client, roomID string) plugin.Plugin {
+	return plugin.Plugin{}
+}
+func (s *statuspageService) WebhookAllowedIPs() []string { return s.AllowedIPs }
+
+// OnReceiveWebhook sends the incident's latest update into the rooms of each page the webhook is
+// from.
+func (s *statuspageService) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli *matrix.Client) {
+	logger := server.RequestLogger(req)
+	if !s.authorised(req) {
+		logger.Print("Statuspage webhook has the wrong token")
+		w.WriteHeader(401)
+		return
+	}
+	if req.Method != "POST" {
+		w.WriteHeader(405)
+		return
+	}
+	var p webhookPayload
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxBodySize)).Decode(&p); err != nil {
+		logger.WithError(err).Print("Failed to decode Statuspage webhook")
+		w.WriteHeader(400)
+		return
+	}
+	if p.Incident == nil || len(p.Incident.IncidentUpdates) == 0 {
+		// e.g. a component changing status
+		status.Filtered(s.id)
+		w.WriteHeader(200)
+		return
+	}
+	pages := s.pagesWithID(context.Background(), p.Page.ID)
+	if len(pages) == 0 {
+		logger.WithField("page_id", p.Page.ID).Warn("Statuspage webhook is from a page which isn't configured")
+		status.Filtered(s.id)
+		w.WriteHeader(200)
+		return
+	}
+	updates := p.Incident.updates()
+	update := updates[len(updates)-1]
+	logger = logger.WithFields(log.Fields{
+		"incident_id": p.Incident.ID,
+		"update_id":   update.ID,
+	})
+	sent := 0
+	var sendErr error
+	for _, page := range pages {
+		n, err := s.send(cli, page, p.Incident, update, len(updates) == 1)
+		sent += n
+		if err != nil {
+			sendErr = err
+		}
+	}
+	if sendErr != nil {
+		logger.WithError(sendErr).Print("Failed to send incident update to a room")
+		// So that the request is dead-lettered, to be replayed once the rooms are fixed.
+		w.WriteHeader(500)
+		return
+	}
+	if sent == 0 {
+		// Polling found it first.
+		status.Filtered(s.id)
+	} else {
+		status.Forwarded(s.id)
+	}
+	w.WriteHeader(200)
+}
+
+// authorised returns true if the request carries the service's token, or is a replay.
+func (s *statuspageService) authorised(req *http.Request) bool {
+	if server.IsReplay(req) {
+		return true
+	}
+	want := s.Token.Value()
+	return want != "" && subtle.ConstantTimeCompare([]byte(req.URL.Query().Get("token")), []byte(want)) == 1
+}
+
+// pagesWithID returns the pages with the given ID, looking up the IDs of those which don't say.
+func (s *statuspageService) pagesWithID(ctx context.Context, id string) []statusPage {
+	var pages []statusPage
+	for _, page := range s.Pages {
+		pageID := page.ID
+		if pageID == "" {
+			var err error
+			if pageID, err = lookupPageID(ctx, page.url()); err != nil {
+				log.WithError(err).WithFields(log.Fields{
+					"service_id": s.id,
+					"page":       page.URL,
+				}).Warn("Failed to look up status page's ID")
+				continue
+			}
+		}
+		if pageID == id {
+			pages = append(pages, page)
+		}
+	}
+	return pages
+}
+
+// PostRegister starts polling, or restarts it with the new config.
+func (s *statuspageService) PostRegister(oldService types.Service) {
+	streams.Wake()
+}
+
+// Stream polls each page's API every PollInterval, and sends the incident updates it hasn't yet.
+// If PollInterval isn't given, it waits to be stopped.
+func (s *statuspageService) Stream(ctx context.Context, cli *matrix.Client) error {
+	if s.PollInterval == "" {
+		<-ctx.Done()
+		return nil
+	}
+	if err := database.GetServiceDB().DeleteMirroredPostsBefore(s.id, time.Now().Add(-sentUpdateTTL)); err != nil {
+		log.WithError(err).WithField("service_id", s.id).Warn("Failed to forget old incident updates")
+	}
+	interval, _ := time.ParseDuration(s.PollInterval) // ValidateConfig checks it parses
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, page := range s.Pages {
+			s.poll(ctx, cli, page)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// poll sends the page's recent incident updates which haven't been sent yet.
+func (s *statuspageService) poll(ctx context.Context, cli *matrix.Client, page statusPage) {
+	logger := log.WithFields(log.Fields{
+		"service_id": s.id,
+		"page":       page.URL,
+	})
+	_, incidents, err := fetchIncidents(ctx, page.url())
+	if err != nil {
+		logger.WithError(err).Warn("Failed to poll status page")
+		return
+	}
+	since := time.Now().Add(-maxUpdateAge)
+	// Oldest first, so that each incident is announced before it is resolved.
+	for i := len(incidents) - 1; i >= 0; i-- {
+		inc := &incidents[i]
+		for j, update := range inc.updates() {
+			if update.CreatedAt.Before(since) {
+				continue
+			}
+			if _, err = s.send(cli, page, inc, update, j == 0); err != nil {
+				logger.WithError(err).WithField("update_id", update.ID).Warn("Failed to send incident update to a room")
+			}
+		}
+	}
+}
+
+// send sends the incident update into each of the page's rooms which it hasn't been sent into yet.
+// Returns how many rooms it was sent into, and the last error sending it, if any. Rooms it failed
+// to be sent into forget it, so that it is sent again later.
+func (s *statuspageService) send(cli *matrix.Client, page statusPage, inc *incident, update incidentUpdate, first bool) (int, error) {
+	msg := updateMessage(page.name(), inc, update, first)
+	sent := 0
+	var lastErr error
+	for _, roomID := range page.Rooms {
+		markMutex.Lock()
+		marked, err := database.GetServiceDB().MarkPostMirrored(s.id, roomID, update.ID)
+		markMutex.Unlock()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if !marked {
+			continue
+		}
+		if _, err = cli.SendMessageEvent(roomID, "m.room.message", msg); err != nil {
+			lastErr = err
+			if err = database.GetServiceDB().ForgetMirroredPost(s.id, roomID, update.ID); err != nil {
+				log.WithError(err).WithField("service_id", s.id).Error("Failed to forget unsent incident update")
+			}
+			continue
+		}
+		sent++
+	}
+	return sent, lastErr
+}
+
+// updateMessage writes a message about the incident update: the page, whether the incident is new,
+// updated or resolved, coloured by its impact, its name and a link to it, then the update's status
+// and text, and the affected components.
+func updateMessage(pageName string, inc *incident, update incidentUpdate, first bool) matrix.HTMLMessage {
+	kind, colour := updateKind(inc, update, first)
+	body := fmt.Sprintf("[%s] %s: %s", pageName, kind, inc.Name)
+	kindHTML := html.EscapeString(kind)
+	if colour != "" {
+		kindHTML = fmt.Sprintf(`<font color="%s">%s</font>`, colour, kindHTML)
+	}
+	nameHTML := html.EscapeString(inc.Name)
+	if inc.Shortlink != "" {
+		nameHTML = fmt.Sprintf(`<a href="%s">%s</a>`, html.EscapeString(inc.Shortlink), nameHTML)
+	}
+	htmlBody := fmt.Sprintf("<b>[%s]</b> %s: %s", html.EscapeString(pageName), kindHTML, nameHTML)
+	if inc.Impact != "" && inc.Impact != "none" {
+		body += " (" + inc.Impact + " impact)"
+		htmlBody += " (" + html.EscapeString(inc.Impact) + " impact)"
+	}
+	if inc.Shortlink != "" {
+		body += " - " + inc.Shortlink
+	}
+
+	detailsBody, detailsHTML := updateDetails(inc, update)
+	body += detailsBody
+	htmlBody += detailsHTML
+	return matrix.HTMLMessage{
+		Body:          body,
+		MsgType:       "m.notice",
+		Format:        "org.matrix.custom.html",
+		FormattedBody: htmlBody,
+	}
+}
+
+// updateKind returns whether the incident update is for a new, updated or resolved incident, and
+// the colour to show that in.
+func updateKind(inc *incident, update incidentUpdate, first bool) (string, string) {
+	switch {
+	case update.Status == "resolved" || update.Status == "postmortem":
+		return "Incident resolved", resolvedColour
+	case first:
+		return "New incident", impactColours[inc.Impact]
+	}
+	return "Incident updated", impactColours[inc.Impact]
+}
+
+// updateDetails writes the lines of a message about the incident update after the first: the
+// update's status and text, and the affected components. Returns them as text and HTML.
+func updateDetails(inc *incident, update incidentUpdate) (string, string) {
+	updateStatus := update.Status
+	if updateStatus != "" {
+		updateStatus = strings.ToUpper(updateStatus[:1]) + updateStatus[1:]
+	}
+	text := strings.TrimSpace(update.Body)
+	body := "\n" + updateStatus
+	htmlBody := "<br><b>" + html.EscapeString(updateStatus) + "</b>"
+	if text != "" {
+		body += ": " + text
+		htmlBody += ": " + strings.Replace(html.EscapeString(text), "\n", "<br>", -1)
+	}
+	if len(inc.Components) > 0 {
+		var names []string
+		for _, c := range inc.Components {
+			names = append(names, c.Name)
+		}
+		affects := "Affects " + strings.Join(names, ", ")
+		body += "\n" + affects
+		htmlBody += "<br>" + html.EscapeString(affects)
+	}
+	return body, htmlBody
+}
+
+// url returns the page's URL without a trailing slash.
+func (p statusPage) url() string {
+	return strings.TrimSuffix(p.URL, "/")
+}
+
+// name returns what messages call the page.
+func (p statusPage) name() string {
+	if p.Name != "" {
+		return p.Name
+	}
+	if u, err := url.Parse(p.URL); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return p.URL
+}
+
+// ValidateConfig checks that webhooks or polling can be used, that the allowed IPs and poll
+// interval parse, and that every page has a URL and well formed room IDs.
+func (s *statuspageService) ValidateConfig() []types.ConfigError {
+	var errs []types.ConfigError
+	if s.Token.Value() == "" && s.PollInterval == "" {
+		errs = append(errs, types.ConfigError{Field: "Token", Message: "is required unless PollInterval is given"})
+	}
+	if _, err := server.ParseAllowlist(s.AllowedIPs); err != nil {
+		errs = append(errs, types.ConfigError{Field: "AllowedIPs", Message: "does not parse: " + err.Error()})
+	}
+	if s.PollInterval != "" {
+		if d, err := time.ParseDuration(s.PollInterval); err != nil {
+			errs = append(errs, types.ConfigError{Field: "PollInterval", Message: "is not a valid duration: " + err.Error()})
+		} else if d < minPollInterval {
+			errs = append(errs, types.ConfigError{Field: "PollInterval", Message: fmt.Sprintf("must be at least %s", minPollInterval)})
+		}
+	}
+	if len(s.Pages) == 0 {
+		errs = append(errs, types.ConfigError{Field: "Pages", Message: "must list at least one page"})
+	}
+	return append(errs, s.validatePages()...)
+}
+
+// validatePages checks that every page has an http or https URL and well formed room IDs.
+func (s *statuspageService) validatePages() []types.ConfigError {
+	var errs []types.ConfigError
+	for i, page := range s.Pages {
+		field := fmt.Sprintf("Pages[%d]", i)
+		if !types.IsHTTPURL(page.URL) {
+			errs = append(errs, types.ConfigError{Field: field + ".URL", Message: "must be an http[s]:// URL"})
+		}
+		if len(page.Rooms) == 0 {
+			errs = append(errs, types.ConfigError{Field: field + ".Rooms", Message: "must list at least one room"})
+		}
+		for j, roomID := range page.Rooms {
+			if !types.IsRoomID(roomID) {
+				errs = append(errs, types.ConfigError{Field: fmt.Sprintf("%s.Rooms[%d]", field, j), Message: "is not a room ID"})
+			}
+		}
+	}
+	return errs
+}
+
+// Register joins the rooms messages are posted to.
+func (s *statuspageService) Register(oldService types.Service, client *matrix.Client) error {
+	for _, roomID := range s.roomIDs() {
+		if _, err := client.JoinRoom(roomID, "", ""); err != nil {
+			return err
+		}
+	}
+	if s.Token.Value() != "" {
+		log.WithFields(log.Fields{
+			"service_id": s.id,
+			"url":        s.webhookEndpointURL,
+		}).Info("Registered Statuspage webhook: subscribe to each page's updates by webhook with the URL and ?token=<token>")
+	}
+	return nil
+}
+
+// PlanRegister works out which rooms Register would join, and notes the URL pages must be
+// subscribed with if a token is needed.
+func (s *statuspageService) PlanRegister(oldService types.Service, client *matrix.Client) (*types.RegisterPlan, error) {
+	plan := &types.RegisterPlan{JoinRooms: types.PlanJoinRooms(client, s.roomIDs())}
+	if s.Token.Value() != "" {
+		plan.Notes = []string{"Each page must be subscribed to by webhook with the URL " + s.webhookEndpointURL + "?token=<token>"}
+	}
+	return plan, nil
+}
+
+// CheckRegistered checks that the service's client is still in each room incidents are posted to.
+func (s *statuspageService) CheckRegistered(client *matrix.Client) ([]string, error) {
+	return types.CheckJoinedRooms(client, s.roomIDs()), nil
+}
+
+// roomIDs returns the IDs of every page's rooms, sorted, without duplicates.
+func (s *statuspageService) roomIDs() []string {
+	seen := make(map[string]bool)
+	var roomIDs []string
+	for _, page := range s.Pages {
+		for _, roomID := range page.Rooms {
+			if !seen[roomID] {
+				seen[roomID] = true
+				roomIDs = append(roomIDs, roomID)
+			}
+		}
+	}
+	sort.Strings(roomIDs)
+	return roomIDs
+}
+
+func init() {
+	types.RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) types.Service {
+		return &statuspageService{
+			id:                 serviceID,
+			serviceUserID:      serviceUserID,
+			webhookEndpointURL: webhookEndpointURL,
+		}
+	})
+}
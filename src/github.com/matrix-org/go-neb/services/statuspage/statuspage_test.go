@@ -0,0 +1,193 @@
+package services
+
+import (
+	"encoding/json"
+	"golang.org/x/net/context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// incidentUpdated is Statuspage's documented example of an incident webhook.
+const incidentUpdated = `{
+  "meta": {
+    "unsubscribe": "http://statustest.flyingkleinbrothers.com:5000/?unsubscribe=j0vqr9kl3513",
+    "documentation": "https://doers.statuspage.io/customer-notifications/webhooks/"
+  },
+  "page": {
+    "id": "j2mfxwj97wnj",
+    "status_indicator": "major",
+    "status_description": "Partial System Outage"
+  },
+  "incident": {
+    "name": "Virginia Is Down",
+    "status": "identified",
+    "created_at": "2013-05-29T15:08:51-06:00",
+    "updated_at": "2013-05-29T16:30:35-06:00",
+    "shortlink": "http://j.mp/18zyDQx",
+    "id": "lbkhbwn21v5q",
+    "impact": "major",
+    "incident_updates": [
+      {
+        "body": "A postmortem analysis is underway.\nWe will post it here.",
+        "created_at": "2013-05-29T16:30:35-06:00",
+        "id": "drfcwbnpxnr6",
+        "incident_id": "lbkhbwn21v5q",
+        "status": "identified"
+      },
+      {
+        "body": "We're investigating an outage with our Virginia data center.",
+        "created_at": "2013-05-29T15:08:51-06:00",
+        "id": "2rryghr4qgrh",
+        "incident_id": "lbkhbwn21v5q",
+        "status": "investigating"
+      }
+    ],
+    "components": [
+      {"id": "0l2p9nhqnxpd", "name": "Virginia Data Center", "status": "major_outage"}
+    ]
+  }
+}`
+
+func parseIncident(t *testing.T, body string) *incident {
+	var p webhookPayload
+	if err := json.Unmarshal([]byte(body), &p); err != nil {
+		t.Fatal(err)
+	}
+	return p.Incident
+}
+
+func TestUpdates(t *testing.T) {
+	updates := parseIncident(t, incidentUpdated).updates()
+	if len(updates) != 2 || updates[0].ID != "2rryghr4qgrh" || updates[1].ID != "drfcwbnpxnr6" {
+		t.Errorf("updates => want oldest first, got %+v", updates)
+	}
+}
+
+func TestUpdateMessage(t *testing.T) {
+	inc := parseIncident(t, incidentUpdated)
+	updates := inc.updates()
+	msg := updateMessage("Example", inc, updates[1], false)
+	wantBody := "[Example] Incident updated: Virginia Is Down (major impact) - http://j.mp/18zyDQx\n" +
+		"Identified: A postmortem analysis is underway.\nWe will post it here.\n" +
+		"Affects Virginia Data Center"
+	if msg.Body != wantBody {
+		t.Errorf("updateMessage body => want %q got %q", wantBody, msg.Body)
+	}
+	wantHTML := `<b>[Example]</b> <font color="#e67e22">Incident updated</font>: <a href="http://j.mp/18zyDQx">Virginia Is Down</a> (major impact)` +
+		`<br><b>Identified</b>: A postmortem analysis is underway.<br>We will post it here.<br>Affects Virginia Data Center`
+	if msg.FormattedBody != wantHTML {
+		t.Errorf("updateMessage HTML => want %q got %q", wantHTML, msg.FormattedBody)
+	}
+
+	msg = updateMessage("Example", inc, updates[0], true)
+	if !strings.HasPrefix(msg.Body, "[Example] New incident: ") {
+		t.Errorf("updateMessage of first update => want a new incident, got %q", msg.Body)
+	}
+	updates[1].Status = "resolved"
+	msg = updateMessage("Example", inc, updates[1], false)
+	if !strings.Contains(msg.FormattedBody, `<font color="#5cb85c">Incident resolved</font>`) {
+		t.Errorf("updateMessage of resolution => want it resolved, got %q", msg.FormattedBody)
+	}
+}
+
+func TestPageName(t *testing.T) {
+	for _, test := range []struct {
+		page statusPage
+		want string
+	}{
+		{statusPage{URL: "https://www.githubstatus.com/"}, "www.githubstatus.com"},
+		{statusPage{URL: "https://www.githubstatus.com", Name: "GitHub"}, "GitHub"},
+	} {
+		if got := test.page.name(); got != test.want {
+			t.Errorf("name of %+v => want %q got %q", test.page, test.want, got)
+		}
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	var s statuspageService
+	if err := json.Unmarshal([]byte(`{
+		"PollInterval": "10s",
+		"Pages": [{"URL": "www.githubstatus.com", "Rooms": ["!r:x", "nope"]}, {"URL": "https://status.example.com"}]
+	}`), &s); err != nil {
+		t.Fatal(err)
+	}
+	var fields []string
+	for _, e := range s.ValidateConfig() {
+		fields = append(fields, e.Field)
+	}
+	want := "PollInterval Pages[0].URL Pages[0].Rooms[1] Pages[1].Rooms"
+	if got := strings.Join(fields, " "); got != want {
+		t.Errorf("ValidateConfig fields => want %q got %q", want, got)
+	}
+	s = statuspageService{Pages: []statusPage{{URL: "https://status.example.com", Rooms: []string{"!r:x"}}}}
+	if errs := s.ValidateConfig(); len(errs) != 1 || errs[0].Field != "Token" {
+		t.Errorf("ValidateConfig without Token or PollInterval => want a Token error, got %+v", errs)
+	}
+}
+
+func TestFetchIncidents(t *testing.T) {
+	res, err := json.Marshal(map[string]interface{}{
+		"page":      pageInfo{ID: "j2mfxwj97wnj", Name: "Example"},
+		"incidents": []*incident{parseIncident(t, incidentUpdated)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		if req.URL.Path != "/api/v2/incidents.json" {
+			w.WriteHeader(404)
+			return
+		}
+		w.Write(res)
+	}))
+	defer srv.Close()
+
+	page, incidents, err := fetchIncidents(context.Background(), srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.ID != "j2mfxwj97wnj" || len(incidents) != 1 || len(incidents[0].IncidentUpdates) != 2 {
+		t.Errorf("fetchIncidents => got page %+v and incidents %+v", page, incidents)
+	}
+	// The ID is remembered, so it isn't looked up.
+	if id, lookupErr := lookupPageID(context.Background(), srv.URL); lookupErr != nil || id != "j2mfxwj97wnj" || requests != 1 {
+		t.Errorf("lookupPageID => want the remembered ID, got %q, %v after %d requests", id, lookupErr, requests)
+	}
+	if _, err = lookupPageID(context.Background(), srv.URL+"/other"); err == nil {
+		t.Errorf("lookupPageID of a missing page => want an error")
+	}
+}
+
+func TestOnReceiveWebhookFiltered(t *testing.T) {
+	var s statuspageService
+	if err := json.Unmarshal([]byte(`{
+		"Token": "secret",
+		"Pages": [{"URL": "https://status.example.com", "ID": "anotherpage", "Rooms": ["!r:x"]}]
+	}`), &s); err != nil {
+		t.Fatal(err)
+	}
+	component := `{"page": {"id": "anotherpage"}, "component_update": {"new_status": "operational"}}`
+	for _, test := range []struct {
+		body  string
+		token string
+		want  int
+	}{
+		{incidentUpdated, "secret", 200}, // another page's
+		{component, "secret", 200},
+		{"not json", "secret", 400},
+		{incidentUpdated, "wrong", 401},
+		{incidentUpdated, "", 401},
+	} {
+		req := httptest.NewRequest("POST", "/?token="+test.token, strings.NewReader(test.body))
+		w := httptest.NewRecorder()
+		s.OnReceiveWebhook(w, req, nil)
+		if w.Code != test.want {
+			t.Errorf("OnReceiveWebhook with token %q => want HTTP %d got %d", test.token, test.want, w.Code)
+		}
+	}
+}
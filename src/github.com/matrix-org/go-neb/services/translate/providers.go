@@ -0,0 +1,130 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/matrix-org/go-neb/httpclient"
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// deepLFreeURL and deepLProURL are the bases of DeepL's APIs, for keys on the free plan, which end
+// in ":fx", and for the others. They are variables so that tests can point them elsewhere.
+var (
+	deepLFreeURL = "https://api-free.deepl.com"
+	deepLProURL  = "https://api.deepl.com"
+)
+
+// A translator translates text with a translation API.
+type translator interface {
+	// Translate translates the text into the target language, returning the translation and the
+	// language the text is in, as a lower case code such as "de".
+	Translate(ctx context.Context, text, target string) (translation, source string, err error)
+}
+
+type deepL struct {
+	baseURL string
+	apiKey  string
+}
+
+type deepLResponse struct {
+	Translations []struct {
+		DetectedSourceLanguage string `json:"detected_source_language"`
+		Text                   string `json:"text"`
+	} `json:"translations"`
+}
+
+func (d *deepL) Translate(ctx context.Context, text, target string) (string, string, error) {
+	form := url.Values{}
+	form.Set("text", text)
+	form.Set("target_lang", strings.ToUpper(target))
+	req, err := http.NewRequest("POST", d.baseURL+"/v2/translate", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "DeepL-Auth-Key "+d.apiKey)
+	var res deepLResponse
+	if err = do(ctx, "DeepL", req, &res); err != nil {
+		return "", "", err
+	}
+	if len(res.Translations) == 0 {
+		return "", "", errors.New("DeepL returned no translation")
+	}
+	return res.Translations[0].Text, strings.ToLower(res.Translations[0].DetectedSourceLanguage), nil
+}
+
+type libreTranslate struct {
+	baseURL string
+	apiKey  string
+}
+
+type libreTranslateRequest struct {
+	Q      string `json:"q"`
+	Source string `json:"source"`
+	Target string `json:"target"`
+	Format string `json:"format"`
+	APIKey string `json:"api_key,omitempty"`
+}
+
+type libreTranslateResponse struct {
+	TranslatedText   string `json:"translatedText"`
+	DetectedLanguage struct {
+		Language string `json:"language"`
+	} `json:"detectedLanguage"`
+}
+
+func (l *libreTranslate) Translate(ctx context.Context, text, target string) (string, string, error) {
+	body, err := json.Marshal(libreTranslateRequest{
+		Q:      text,
+		Source: "auto",
+		Target: strings.ToLower(target),
+		Format: "text",
+		APIKey: l.apiKey,
+	})
+	if err != nil {
+		return "", "", err
+	}
+	req, err := http.NewRequest("POST", l.baseURL+"/translate", bytes.NewReader(body))
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	var res libreTranslateResponse
+	if err = do(ctx, "LibreTranslate", req, &res); err != nil {
+		return "", "", err
+	}
+	return res.TranslatedText, strings.ToLower(res.DetectedLanguage.Language), nil
+}
+
+// do sends the request to the provider and decodes the JSON it responds with into result. If the
+// provider responds with an error, the error includes the provider's message.
+func do(ctx context.Context, provider string, req *http.Request, result interface{}) error {
+	res, err := ctxhttp.Do(ctx, httpclient.Default, req)
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != 200 {
+		// DeepL says what went wrong in "message", LibreTranslate in "error".
+		var errRes struct {
+			Message string `json:"message"`
+			Error   string `json:"error"`
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		json.Unmarshal(body, &errRes)
+		if msg := errRes.Message + errRes.Error; msg != "" {
+			return fmt.Errorf("%s returned HTTP %d: %s", provider, res.StatusCode, msg)
+		}
+		return fmt.Errorf("%s returned HTTP %d", provider, res.StatusCode)
+	}
+	return json.NewDecoder(res.Body).Decode(result)
+}
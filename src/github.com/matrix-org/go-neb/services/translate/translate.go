@@ -0,0 +1,205 @@
+package services
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/plugin"
+	"github.com/matrix-org/go-neb/secrets"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/go-neb/util"
+	"golang.org/x/net/context"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// languageRegex matches language codes, e.g. "de", or "en-gb" for DeepL's regional variants.
+var languageRegex = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z]{2,4})?$`)
+
+// inFlight limits how many messages are being auto-translated at once, across all services, so that
+// a busy room can't start an unbounded number of requests.
+var inFlight = make(chan struct{}, 16)
+
+type translateService struct {
+	id            string
+	serviceUserID string
+	// Provider is the translation API to use: "deepl" or "libretranslate".
+	Provider string
+	// APIKey is the key to use the provider's API with. Required for DeepL. Optional for
+	// LibreTranslate, as servers may not need one.
+	APIKey secrets.Secret
+	// URL is the base URL of the provider's API. Required for LibreTranslate, e.g.
+	// "https://libretranslate.example.com". Optional for DeepL: its free or pro API, to suit the key.
+	URL string
+	// AutoTranslate maps room IDs to a language to translate every message in the room into, e.g.
+	// {"!foo:bar": "en"}. Messages already in that language aren't translated. Optional.
+	AutoTranslate map[string]string
+	// CommandPrefixes are what commands start with in each room, e.g. {"!foo:bar": "?"}, so that
+	// several bots in a room can be told apart. Optional: in other rooms commands start with "!".
+	CommandPrefixes map[string]string
+}
+
+func (s *translateService) ServiceUserID() string { return s.serviceUserID }
+func (s *translateService) ServiceID() string     { return s.id }
+func (s *translateService) ServiceType() string   { return "translate" }
+func (s *translateService) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli *matrix.Client) {
+	w.WriteHeader(200) // Do nothing
+}
+func (s *translateService) ValidateConfig() []types.ConfigError {
+	errs := types.ValidateCommandPrefixes(s.CommandPrefixes)
+	switch s.Provider {
+	case "deepl":
+		if s.APIKey.Value() == "" {
+			errs = append(errs, types.ConfigError{Field: "APIKey", Message: "is required for DeepL"})
+		}
+	case "libretranslate":
+		if s.URL == "" {
+			errs = append(errs, types.ConfigError{Field: "URL", Message: "is required for LibreTranslate"})
+		}
+	default:
+		errs = append(errs, types.ConfigError{Field: "Provider", Message: `must be "deepl" or "libretranslate"`})
+	}
+	if s.URL != "" && !types.IsHTTPURL(s.URL) {
+		errs = append(errs, types.ConfigError{Field: "URL", Message: "must be an http or https URL"})
+	}
+	for _, roomID := range util.SortedKeys(s.AutoTranslate) {
+		field := fmt.Sprintf("AutoTranslate[%s]", roomID)
+		if !types.IsRoomID(roomID) {
+			errs = append(errs, types.ConfigError{Field: field, Message: "is not a room ID"})
+		}
+		if !languageRegex.MatchString(s.AutoTranslate[roomID]) {
+			errs = append(errs, types.ConfigError{Field: field, Message: `must be a language code, e.g. "en"`})
+		}
+	}
+	return errs
+}
+func (s *translateService) Register(oldService types.Service, client *matrix.Client) error {
+	return nil
+}
+func (s *translateService) PostRegister(oldService types.Service) {}
+
+func (s *translateService) Plugin(client *matrix.Client, roomID string) plugin.Plugin {
+	return plugin.Plugin{
+		Prefix: s.CommandPrefixes[roomID],
+		Commands: []plugin.Command{
+			plugin.Command{
+				Path:      []string{"translate"},
+				Arguments: []string{"language", "text"},
+				Help:      "Translate the text into the language, e.g. de for German",
+				ContextCommand: func(ctx context.Context, roomID, userID string, args []string) (interface{}, error) {
+					return s.cmdTranslate(ctx, args)
+				},
+			},
+		},
+	}
+}
+
+// translator returns a translator for the configured provider.
+func (s *translateService) translator() translator {
+	baseURL := strings.TrimSuffix(s.URL, "/")
+	if s.Provider == "libretranslate" {
+		return &libreTranslate{baseURL, s.APIKey.Value()}
+	}
+	if baseURL == "" {
+		baseURL = deepLProURL
+		if strings.HasSuffix(s.APIKey.Value(), ":fx") {
+			baseURL = deepLFreeURL
+		}
+	}
+	return &deepL{baseURL, s.APIKey.Value()}
+}
+
+func (s *translateService) cmdTranslate(ctx context.Context, args []string) (interface{}, error) {
+	if len(args) < 2 || !languageRegex.MatchString(args[0]) {
+		return matrix.TextMessage{"m.notice", "Usage: !translate <language> <text>, e.g. !translate de good morning"}, nil
+	}
+	target := strings.ToLower(args[0])
+	translation, source, err := s.translator().Translate(ctx, strings.Join(args[1:], " "), target)
+	if err != nil {
+		return nil, err
+	}
+	return matrix.TextMessage{"m.notice", fmt.Sprintf("(%s → %s) %s", source, target, translation)}, nil
+}
+
+// OnMessageEvent translates messages in the rooms with AutoTranslate into the room's language, in
+// the background. Commands, notices and the service's own messages aren't translated.
+func (s *translateService) OnMessageEvent(cli *matrix.Client, event *matrix.Event) {
+	body, target, ok := s.toTranslate(cli, event)
+	if !ok {
+		return
+	}
+	logger := log.WithFields(log.Fields{
+		"service_id": s.id,
+		"event_id":   event.ID,
+		"room_id":    event.RoomID,
+	})
+	select {
+	case inFlight <- struct{}{}:
+	default:
+		logger.Warn("Not auto-translating message: too many are being translated")
+		return
+	}
+	go func() {
+		defer func() { <-inFlight }()
+		s.autoTranslate(cli, event, body, target, logger)
+	}()
+}
+
+// toTranslate returns the body of the message and the language to translate it into, or false if
+// the message isn't auto-translated.
+func (s *translateService) toTranslate(cli *matrix.Client, event *matrix.Event) (string, string, bool) {
+	target, ok := s.AutoTranslate[event.RoomID]
+	if !ok || event.Sender == cli.UserID {
+		return "", "", false
+	}
+	if msgtype, _ := event.MessageType(); msgtype != "m.text" {
+		return "", "", false
+	}
+	body, _ := event.Body()
+	body = strings.TrimSpace(body)
+	if body == "" || strings.HasPrefix(body, plugin.DefaultPrefix) {
+		return "", "", false
+	}
+	if prefix := s.CommandPrefixes[event.RoomID]; prefix != "" && strings.HasPrefix(body, prefix) {
+		return "", "", false
+	}
+	return body, target, true
+}
+
+// autoTranslate translates the body of the message into the target language and sends the
+// translation to the message's room, unless it was already in that language.
+func (s *translateService) autoTranslate(cli *matrix.Client, event *matrix.Event, body, target string, logger *log.Entry) {
+	translation, source, err := s.translator().Translate(context.Background(), body, target)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to auto-translate message")
+		return
+	}
+	if sameLanguage(source, target) || translation == body {
+		return
+	}
+	_, err = cli.SendMessageEvent(event.RoomID, "m.room.message", &matrix.TextMessage{
+		"m.notice", fmt.Sprintf("%s (%s): %s", event.Sender, source, translation),
+	})
+	if err != nil {
+		logger.WithError(err).Warn("Failed to send auto-translated message")
+	}
+}
+
+// sameLanguage returns true if the language codes are for the same language, ignoring regional
+// variants, e.g. "en" and "en-gb".
+func sameLanguage(a, b string) bool {
+	base := func(lang string) string {
+		return strings.ToLower(strings.SplitN(lang, "-", 2)[0])
+	}
+	return base(a) == base(b)
+}
+
+func init() {
+	types.RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) types.Service {
+		return &translateService{
+			id:            serviceID,
+			serviceUserID: serviceUserID,
+		}
+	})
+}
@@ -0,0 +1,121 @@
+package services
+
+import (
+	"encoding/json"
+	"github.com/matrix-org/go-neb/matrix"
+	"golang.org/x/net/context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDeepL(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v2/translate" || req.Header.Get("Authorization") != "DeepL-Auth-Key key:fx" {
+			w.WriteHeader(403)
+			w.Write([]byte(`{"message":"Wrong endpoint"}`))
+			return
+		}
+		if req.FormValue("target_lang") != "EN-GB" {
+			w.WriteHeader(400)
+			w.Write([]byte(`{"message":"Value for 'target_lang' not supported."}`))
+			return
+		}
+		w.Write([]byte(`{"translations":[{"detected_source_language":"DE","text":"Good morning"}]}`))
+	}))
+	defer srv.Close()
+	deepLFreeURL = srv.URL
+	defer func() { deepLFreeURL = "https://api-free.deepl.com" }()
+
+	var s translateService
+	if err := json.Unmarshal([]byte(`{"Provider":"deepl","APIKey":"key:fx"}`), &s); err != nil {
+		t.Fatal(err)
+	}
+	content, err := s.cmdTranslate(context.Background(), []string{"en-GB", "Guten", "Morgen"})
+	if err != nil {
+		t.Fatalf("cmdTranslate => want a translation, got error %s", err)
+	}
+	want := matrix.TextMessage{"m.notice", "(de → en-gb) Good morning"}
+	if content != want {
+		t.Errorf("cmdTranslate => want %+v, got %+v", want, content)
+	}
+
+	_, err = s.cmdTranslate(context.Background(), []string{"xx", "Guten", "Morgen"})
+	if want := "DeepL returned HTTP 400: Value for 'target_lang' not supported."; err == nil || err.Error() != want {
+		t.Errorf("cmdTranslate into an unsupported language => want error %q, got %v", want, err)
+	}
+}
+
+func TestLibreTranslate(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var body libreTranslateRequest
+		json.NewDecoder(req.Body).Decode(&body)
+		if req.URL.Path != "/translate" || body.Source != "auto" || body.Target != "fr" || body.APIKey != "" {
+			w.WriteHeader(400)
+			w.Write([]byte(`{"error":"Bad request"}`))
+			return
+		}
+		w.Write([]byte(`{"translatedText":"bonjour","detectedLanguage":{"confidence":90,"language":"en"}}`))
+	}))
+	defer srv.Close()
+
+	s := translateService{Provider: "libretranslate", URL: srv.URL + "/"}
+	translation, source, err := s.translator().Translate(context.Background(), "hello", "FR")
+	if err != nil || translation != "bonjour" || source != "en" {
+		t.Errorf("Translate => want bonjour from en, got %q from %q, error %v", translation, source, err)
+	}
+	_, _, err = s.translator().Translate(context.Background(), "hello", "de")
+	if want := "LibreTranslate returned HTTP 400: Bad request"; err == nil || err.Error() != want {
+		t.Errorf("Translate of a bad request => want error %q, got %v", want, err)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		config string
+		fields []string
+	}{
+		{`{"Provider":"deepl","APIKey":"key"}`, nil},
+		{`{"Provider":"deepl"}`, []string{"APIKey"}},
+		{`{"Provider":"libretranslate","URL":"https://lt.example.com","AutoTranslate":{"!a:x":"en"}}`, nil},
+		{`{"Provider":"libretranslate"}`, []string{"URL"}},
+		{`{"Provider":"google","URL":"lt.example.com"}`, []string{"Provider", "URL"}},
+		{`{"Provider":"deepl","APIKey":"key","AutoTranslate":{"a:x":"en","!b:x":"english"}}`, []string{"AutoTranslate[!b:x]", "AutoTranslate[a:x]"}},
+	}
+	for _, test := range tests {
+		var s translateService
+		if err := json.Unmarshal([]byte(test.config), &s); err != nil {
+			t.Fatal(err)
+		}
+		var fields []string
+		for _, err := range s.ValidateConfig() {
+			fields = append(fields, err.Field)
+		}
+		if len(fields) != len(test.fields) {
+			t.Errorf("ValidateConfig(%s) => want errors for %v, got %v", test.config, test.fields, fields)
+			continue
+		}
+		for i := range fields {
+			if fields[i] != test.fields[i] {
+				t.Errorf("ValidateConfig(%s) => want errors for %v, got %v", test.config, test.fields, fields)
+				break
+			}
+		}
+	}
+}
+
+func TestSameLanguage(t *testing.T) {
+	for _, test := range []struct {
+		a, b string
+		want bool
+	}{
+		{"en", "en", true},
+		{"en", "EN-GB", true},
+		{"pt-br", "pt-pt", true},
+		{"de", "en", false},
+	} {
+		if got := sameLanguage(test.a, test.b); got != test.want {
+			t.Errorf("sameLanguage(%q, %q) => want %v, got %v", test.a, test.b, test.want, got)
+		}
+	}
+}
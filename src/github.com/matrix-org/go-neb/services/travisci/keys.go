@@ -0,0 +1,65 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/matrix-org/go-neb/httpclient"
+	"strings"
+	"sync"
+	"time"
+)
+
+// keyMaxAge is how long Travis' public key is cached for before it is fetched again.
+const keyMaxAge = time.Hour
+
+// travisConfig is the part of the response of Travis' /config endpoint with the public key which
+// webhooks are signed with.
+type travisConfig struct {
+	Config struct {
+		Notifications struct {
+			Webhook struct {
+				PublicKey string `json:"public_key"`
+			} `json:"webhook"`
+		} `json:"notifications"`
+	} `json:"config"`
+}
+
+type cachedKey struct {
+	key     string
+	fetched time.Time
+}
+
+var (
+	keysMu     sync.Mutex
+	keys       = make(map[string]cachedKey) // API URL => key
+	httpClient = httpclient.New(10 * time.Second)
+)
+
+// publicKey returns the PEM encoded key which the Travis API at apiURL signs webhooks with. It is
+// fetched from the API unless it was fetched within maxAge.
+func publicKey(apiURL string, maxAge time.Duration) (string, error) {
+	keysMu.Lock()
+	defer keysMu.Unlock()
+	if cached, ok := keys[apiURL]; ok && time.Since(cached.fetched) < maxAge {
+		return cached.key, nil
+	}
+	res, err := httpClient.Get(strings.TrimSuffix(apiURL, "/") + "/config")
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return "", fmt.Errorf("Fetching Travis' public key returned HTTP %d", res.StatusCode)
+	}
+	var cfg travisConfig
+	if err = json.NewDecoder(res.Body).Decode(&cfg); err != nil {
+		return "", err
+	}
+	key := cfg.Config.Notifications.Webhook.PublicKey
+	if key == "" {
+		return "", errors.New("Travis' config has no webhook public key")
+	}
+	keys[apiURL] = cachedKey{key, time.Now()}
+	return key, nil
+}
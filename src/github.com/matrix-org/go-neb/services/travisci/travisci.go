@@ -0,0 +1,396 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/batch"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/plugin"
+	"github.com/matrix-org/go-neb/server"
+	"github.com/matrix-org/go-neb/signatures"
+	"github.com/matrix-org/go-neb/status"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/go-neb/util"
+	"html"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultTemplate is how build messages are written if a repository has no Template.
+const DefaultTemplate = "%{repository}#%{build_number} (%{branch} - %{commit} : %{author}): %{message} - %{build_url}"
+
+// defaultAPIURL is the Travis API which publishes the key webhooks are signed with.
+const defaultAPIURL = "https://api.travis-ci.com"
+
+// maxBodySize is the largest webhook request Travis is expected to send.
+const maxBodySize = 1024 * 1024
+
+// refetchKeyAfter is how old Travis' cached public key must be for it to be fetched again when a
+// webhook's signature doesn't match it, in case Travis has changed its key.
+const refetchKeyAfter = time.Minute
+
+// travisCIService posts a message to rooms when Travis CI sends a webhook about a build of one of
+// their repositories. Travis is told to send them by adding the service's webhook URL to the
+// repository's .travis.yml.
+type travisCIService struct {
+	id                 string
+	serviceUserID      string
+	webhookEndpointURL string
+	// APIURL is the Travis API which publishes the key webhooks are signed with, e.g.
+	// "https://api.travis-ci.org" or an enterprise installation's. Optional: defaults to
+	// travis-ci.com's.
+	APIURL string
+	// AllowedIPs are the IP addresses and CIDR ranges Travis may send webhook requests from.
+	// Optional: requests are allowed from anywhere.
+	AllowedIPs []string
+	// BatchWindow is how long to hold back messages about builds of a branch, e.g. "30s", so that
+	// a burst of them is sent as one message. Optional: messages are sent as they arrive.
+	BatchWindow string
+	// DigestWindow is how long to hold back messages about passed builds for the room's digest,
+	// e.g. "5m", so that they are sent as one message along with other services' held back
+	// notifications. Other builds are sent as usual. Optional: messages aren't held back for a digest.
+	DigestWindow string
+	// AlertIfQuietFor is how long to go without a webhook from Travis before alerting the
+	// operators that it is probably broken, e.g. "24h". Optional: they are never alerted.
+	AlertIfQuietFor string
+	Rooms           map[string]struct { // room_id => {}
+		Repos map[string]struct { // owner/repo => {}
+			// Template is how build messages are written, with %{...} variables as in Travis'
+			// own notifications. Optional: defaults to DefaultTemplate.
+			Template string
+		}
+	}
+}
+
+// travisPayload is the part of a Travis webhook's payload which messages are made from.
+type travisPayload struct {
+	ID                int64  `json:"id"`
+	Number            string `json:"number"`
+	State             string `json:"state"`
+	StatusMessage     string `json:"status_message"`
+	Duration          int64  `json:"duration"` // in seconds
+	BuildURL          string `json:"build_url"`
+	Commit            string `json:"commit"`
+	Branch            string `json:"branch"`
+	Message           string `json:"message"` // the commit message
+	CompareURL        string `json:"compare_url"`
+	AuthorName        string `json:"author_name"`
+	Type              string `json:"type"`
+	PullRequestNumber int64  `json:"pull_request_number"`
+	Repository        struct {
+		Name      string `json:"name"`
+		OwnerName string `json:"owner_name"`
+	} `json:"repository"`
+}
+
+// statusMessages are the sentences %{message} is for each of Travis' status messages.
+var statusMessages = map[string]string{
+	"Pending":       "The build is pending.",
+	"Passed":        "The build passed.",
+	"Fixed":         "The build was fixed.",
+	"Broken":        "The build was broken.",
+	"Failed":        "The build failed.",
+	"Still Failing": "The build is still failing.",
+	"Canceled":      "The build was canceled.",
+	"Errored":       "The build has errored.",
+}
+
+// statusColours are the colours %{message} and %{result} are shown in for each of Travis' status
+// messages. Others are left uncoloured.
+var statusColours = map[string]string{
+	"Passed":        "#5cb85c",
+	"Fixed":         "#5cb85c",
+	"Broken":        "#d9534f",
+	"Failed":        "#d9534f",
+	"Still Failing": "#d9534f",
+	"Errored":       "#d9534f",
+}
+
+func (s *travisCIService) ServiceUserID() string { return s.serviceUserID }
+func (s *travisCIService) ServiceID() string     { return s.id }
+func (s *travisCIService) ServiceType() string   { return "travis-ci" }
+func (s *travisCIService) Plugin(cli *matrix.Client, roomID string) plugin.Plugin {
+	return plugin.Plugin{}
+}
+func (s *travisCIService) WebhookAllowedIPs() []string { return s.AllowedIPs }
+func (s *travisCIService) QuietPeriod() time.Duration {
+	d, _ := status.ParseQuietPeriod(s.AlertIfQuietFor) // ValidateConfig checks it parses
+	return d
+}
+
+// OnReceiveWebhook checks the webhook's signature, then sends a message about the build to each
+// room which wants to hear about its repository.
+func (s *travisCIService) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli *matrix.Client) {
+	logger := server.RequestLogger(req)
+	p, code := s.readPayload(req, logger)
+	if code != 0 {
+		w.WriteHeader(code)
+		return
+	}
+	slug := p.Repository.OwnerName + "/" + p.Repository.Name
+	logger = logger.WithFields(log.Fields{
+		"repo":         slug,
+		"build_number": p.Number,
+		"status":       p.StatusMessage,
+	})
+
+	sendErrs, forwarded := s.notifyRooms(cli, p, slug, logger)
+	if forwarded {
+		status.Forwarded(s.id)
+	} else {
+		status.Filtered(s.id)
+	}
+	if len(sendErrs) > 0 {
+		// So that the request is dead-lettered, to be replayed once the rooms are fixed.
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(200)
+}
+
+// readPayload verifies the request's signature and parses its payload. Returns the HTTP status
+// code to respond with if it can't, or 0.
+func (s *travisCIService) readPayload(req *http.Request, logger *log.Entry) (travisPayload, int) {
+	var p travisPayload
+	body, err := s.readAndVerify(req)
+	if err == signatures.ErrMissing || err == signatures.ErrMismatch {
+		logger.WithError(err).Print("Received Travis webhook which failed signature check")
+		return p, 401
+	} else if err != nil {
+		// e.g. Travis' API is down, so the key can't be fetched. Fail, so that the request is
+		// dead-lettered to be replayed later.
+		logger.WithError(err).Print("Failed to verify Travis webhook")
+		status.Failed(s.id, err)
+		return p, 500
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return p, 400
+	}
+	if err = json.Unmarshal([]byte(form.Get("payload")), &p); err != nil {
+		logger.WithError(err).Print("Failed to parse Travis webhook payload")
+		return p, 400
+	}
+	return p, 0
+}
+
+// notifyRooms sends a notice of the build of the repo with the given slug to each room which
+// wants it. Returns the errors sending to each room, and whether any room wants it.
+func (s *travisCIService) notifyRooms(cli *matrix.Client, p travisPayload, slug string, logger *log.Entry) (map[string]error, bool) {
+	forwarded := false
+	var msgs []batch.Message
+	window, _ := batch.ParseWindow(s.BatchWindow)              // ValidateConfig checks it parses
+	digestWindow, _ := batch.ParseDigestWindow(s.DigestWindow) // ValidateConfig checks it parses
+	for roomID, roomConfig := range s.Rooms {
+		for ownerRepo, repoConfig := range roomConfig.Repos {
+			if !strings.EqualFold(ownerRepo, slug) {
+				continue
+			}
+			forwarded = true
+			msg := buildMessage(repoConfig.Template, p)
+			logger.WithField("room_id", roomID).Print("Sending notification to room")
+			if digestWindow > 0 && p.StatusMessage == "Passed" {
+				batch.Digest(cli, s.id, roomID, digestWindow, msg)
+			} else {
+				msgs = append(msgs, batch.Message{roomID, slug + "@" + p.Branch, msg})
+			}
+		}
+	}
+	sendErrs := batch.SendAll(cli, s.id, window, msgs)
+	for roomID, e := range sendErrs {
+		logger.WithError(e).WithField("room_id", roomID).Print("Failed to send notification to room.")
+	}
+	return sendErrs, forwarded
+}
+
+// buildMessage renders the notice of the build with the template, or DefaultTemplate if it is "".
+func buildMessage(tmpl string, p travisPayload) matrix.HTMLMessage {
+	if tmpl == "" {
+		tmpl = DefaultTemplate
+	}
+	return matrix.HTMLMessage{
+		Body:          outputForTemplate(tmpl, p),
+		MsgType:       "m.notice",
+		Format:        "org.matrix.custom.html",
+		FormattedBody: htmlForTemplate(tmpl, p),
+	}
+}
+
+// readAndVerify reads the request body and checks its signature with Travis' public key. If the
+// signature doesn't match, the key is fetched again in case Travis has changed it.
+func (s *travisCIService) readAndVerify(req *http.Request) ([]byte, error) {
+	key, err := publicKey(s.apiURL(), keyMaxAge)
+	if err != nil {
+		return nil, err
+	}
+	body, err := signatures.ReadAndVerify(req, signatures.Travis{}, key, maxBodySize)
+	if err != signatures.ErrMismatch {
+		return body, err
+	}
+	if key, err = publicKey(s.apiURL(), refetchKeyAfter); err != nil {
+		return nil, err
+	}
+	return signatures.ReadAndVerify(req, signatures.Travis{}, key, maxBodySize)
+}
+
+func (s *travisCIService) apiURL() string {
+	if s.APIURL == "" {
+		return defaultAPIURL
+	}
+	return s.APIURL
+}
+
+// outputForTemplate fills in the %{...} variables of the template from the payload. Unknown
+// variables are left as they are.
+func outputForTemplate(tmpl string, p travisPayload) string {
+	return strings.NewReplacer(templateVars(p)...).Replace(tmpl)
+}
+
+// htmlForTemplate is outputForTemplate as HTML: the repository is in bold, the build's status is
+// coloured by its result, and URLs are links.
+func htmlForTemplate(tmpl string, p travisPayload) string {
+	vars := templateVars(p)
+	for i := 0; i < len(vars); i += 2 {
+		value := html.EscapeString(vars[i+1])
+		switch vars[i] {
+		case "%{repository}", "%{repository_slug}", "%{repository_name}":
+			value = "<b>" + value + "</b>"
+		case "%{message}", "%{result}":
+			if colour, ok := statusColours[p.StatusMessage]; ok {
+				value = fmt.Sprintf(`<font color="%s">%s</font>`, colour, value)
+			}
+		case "%{build_url}", "%{compare_url}":
+			if value != "" {
+				value = fmt.Sprintf(`<a href="%s">%s</a>`, value, value)
+			}
+		}
+		vars[i+1] = value
+	}
+	return strings.NewReplacer(vars...).Replace(html.EscapeString(tmpl))
+}
+
+// templateVars returns the %{...} variables and their values for the payload, in pairs as
+// strings.NewReplacer takes them.
+func templateVars(p travisPayload) []string {
+	commit := p.Commit
+	if len(commit) > 7 {
+		commit = commit[:7]
+	}
+	message, ok := statusMessages[p.StatusMessage]
+	if !ok {
+		message = p.StatusMessage
+	}
+	slug := p.Repository.OwnerName + "/" + p.Repository.Name
+	return []string{
+		"%{repository}", slug,
+		"%{repository_slug}", slug,
+		"%{repository_name}", p.Repository.Name,
+		"%{build_number}", p.Number,
+		"%{build_id}", fmt.Sprintf("%d", p.ID),
+		"%{branch}", p.Branch,
+		"%{commit}", commit,
+		"%{author}", p.AuthorName,
+		"%{commit_message}", p.Message,
+		"%{commit_subject}", strings.TrimSpace(strings.SplitN(p.Message, "\n", 2)[0]),
+		"%{result}", p.State,
+		"%{message}", message,
+		"%{duration}", (time.Duration(p.Duration) * time.Second).String(),
+		"%{pull_request_number}", fmt.Sprintf("%d", p.PullRequestNumber),
+		"%{compare_url}", p.CompareURL,
+		"%{build_url}", p.BuildURL,
+	}
+}
+
+// ValidateConfig checks that the API URL, allowed IPs, batch window and quiet period parse, and
+// that every room ID and repo in Rooms is well formed.
+func (s *travisCIService) ValidateConfig() []types.ConfigError {
+	var errs []types.ConfigError
+	if s.APIURL != "" && !types.IsHTTPURL(s.APIURL) {
+		errs = append(errs, types.ConfigError{Field: "APIURL", Message: "is not an http or https URL"})
+	}
+	if _, err := server.ParseAllowlist(s.AllowedIPs); err != nil {
+		errs = append(errs, types.ConfigError{Field: "AllowedIPs", Message: "does not parse: " + err.Error()})
+	}
+	errs = append(errs, s.validateWindows()...)
+	return append(errs, s.validateRooms()...)
+}
+
+// validateWindows checks that the batch and digest windows and the quiet period parse.
+func (s *travisCIService) validateWindows() []types.ConfigError {
+	var errs []types.ConfigError
+	if _, err := batch.ParseWindow(s.BatchWindow); err != nil {
+		errs = append(errs, types.ConfigError{Field: "BatchWindow", Message: "is not a valid window: " + err.Error()})
+	}
+	if _, err := batch.ParseDigestWindow(s.DigestWindow); err != nil {
+		errs = append(errs, types.ConfigError{Field: "DigestWindow", Message: "is not a valid window: " + err.Error()})
+	}
+	if _, err := status.ParseQuietPeriod(s.AlertIfQuietFor); err != nil {
+		errs = append(errs, types.ConfigError{Field: "AlertIfQuietFor", Message: "is not a valid period: " + err.Error()})
+	}
+	return errs
+}
+
+// validateRooms checks that at least one room is given, and that every room ID and repo in Rooms
+// is well formed.
+func (s *travisCIService) validateRooms() []types.ConfigError {
+	var errs []types.ConfigError
+	if len(s.Rooms) == 0 {
+		errs = append(errs, types.ConfigError{Field: "Rooms", Message: "must list at least one room"})
+	}
+	for _, roomID := range util.SortedKeys(s.Rooms) {
+		if !types.IsRoomID(roomID) {
+			errs = append(errs, types.ConfigError{Field: fmt.Sprintf("Rooms[%s]", roomID), Message: "is not a room ID"})
+		}
+		for _, ownerRepo := range util.SortedKeys(s.Rooms[roomID].Repos) {
+			if segs := strings.Split(ownerRepo, "/"); len(segs) != 2 || segs[0] == "" || segs[1] == "" {
+				errs = append(errs, types.ConfigError{
+					Field:   fmt.Sprintf("Rooms[%s].Repos[%s]", roomID, ownerRepo),
+					Message: "must be of the form 'owner/repo'",
+				})
+			}
+		}
+	}
+	return errs
+}
+
+// Register joins the rooms messages are posted to.
+func (s *travisCIService) Register(oldService types.Service, client *matrix.Client) error {
+	for _, roomID := range util.SortedKeys(s.Rooms) {
+		if _, err := client.JoinRoom(roomID, "", ""); err != nil {
+			return err
+		}
+	}
+	log.WithFields(log.Fields{
+		"service_id": s.id,
+		"url":        s.webhookEndpointURL,
+	}).Info("Registered Travis CI webhook: add the URL to the notifications of each repository's .travis.yml")
+	return nil
+}
+
+// PlanRegister works out which rooms Register would join, and notes that each repository must
+// send its notifications to the service.
+func (s *travisCIService) PlanRegister(oldService types.Service, client *matrix.Client) (*types.RegisterPlan, error) {
+	plan := &types.RegisterPlan{JoinRooms: types.PlanJoinRooms(client, util.SortedKeys(s.Rooms))}
+	plan.Notes = []string{"Travis must be told to send webhooks to " + s.webhookEndpointURL + " in each repository's .travis.yml"}
+	return plan, nil
+}
+
+// CheckRegistered checks that the service's client is still in each room builds are posted to.
+func (s *travisCIService) CheckRegistered(client *matrix.Client) ([]string, error) {
+	return types.CheckJoinedRooms(client, util.SortedKeys(s.Rooms)), nil
+}
+
+func (s *travisCIService) PostRegister(oldService types.Service) {}
+
+func init() {
+	types.RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) types.Service {
+		return &travisCIService{
+			id:                 serviceID,
+			serviceUserID:      serviceUserID,
+			webhookEndpointURL: webhookEndpointURL,
+		}
+	})
+}
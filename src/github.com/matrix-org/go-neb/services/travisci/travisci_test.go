@@ -0,0 +1,59 @@
+package services
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+const exampleBuild = `{
+  "id": 1,
+  "number": "12",
+  "state": "failed",
+  "status_message": "Still Failing",
+  "duration": 94,
+  "build_url": "https://travis-ci.com/owner/repo/builds/1",
+  "commit": "62aae5f70ceee39123ef",
+  "branch": "master",
+  "message": "Fix the thing\n\nIt was broken.",
+  "compare_url": "https://github.com/owner/repo/compare/master...develop",
+  "author_name": "Alice",
+  "type": "push",
+  "repository": {"name": "repo", "owner_name": "owner"}
+}`
+
+var templatetests = []struct {
+	tmpl string
+	want string
+}{
+	{DefaultTemplate, "owner/repo#12 (master - 62aae5f : Alice): The build is still failing. - https://travis-ci.com/owner/repo/builds/1"},
+	{"%{repository_name} %{result} in %{duration}: %{commit_subject} %{unknown}", "repo failed in 1m34s: Fix the thing %{unknown}"},
+}
+
+func TestOutputForTemplate(t *testing.T) {
+	var p travisPayload
+	if err := json.Unmarshal([]byte(exampleBuild), &p); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range templatetests {
+		if got := outputForTemplate(test.tmpl, p); got != test.want {
+			t.Errorf("outputForTemplate(%q) => want %q got %q", test.tmpl, test.want, got)
+		}
+	}
+}
+
+func TestHTMLForTemplate(t *testing.T) {
+	var p travisPayload
+	if err := json.Unmarshal([]byte(exampleBuild), &p); err != nil {
+		t.Fatal(err)
+	}
+	p.AuthorName = "Alice <alice@example.com>"
+	want := `<b>owner/repo</b>#12 (master - 62aae5f : Alice &lt;alice@example.com&gt;): ` +
+		`<font color="#d9534f">The build is still failing.</font> - ` +
+		`<a href="https://travis-ci.com/owner/repo/builds/1">https://travis-ci.com/owner/repo/builds/1</a>`
+	if got := htmlForTemplate(DefaultTemplate, p); got != want {
+		t.Errorf("htmlForTemplate(DefaultTemplate) => want %q got %q", want, got)
+	}
+	if got := htmlForTemplate("<%{result}>", p); got != `&lt;<font color="#d9534f">failed</font>&gt;` {
+		t.Errorf("htmlForTemplate(<%%{result}>) => want the template escaped, got %q", got)
+	}
+}
@@ -0,0 +1,286 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/httpclient"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/plugin"
+	"github.com/matrix-org/go-neb/secrets"
+	"github.com/matrix-org/go-neb/types"
+	"github.com/matrix-org/go-neb/util"
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// apiURL is the base URL of OpenWeatherMap's API. It is a variable so that tests can point it
+// elsewhere.
+var apiURL = "https://api.openweathermap.org/data/2.5"
+
+// forecastDays is how many days after today the forecast covers.
+const forecastDays = 3
+
+// unitLabels are the temperature and wind speed units of each of OpenWeatherMap's unit systems.
+var unitLabels = map[string]struct{ temp, speed string }{
+	"metric":   {"°C", "m/s"},
+	"imperial": {"°F", "mph"},
+}
+
+type owmCondition struct {
+	Description string `json:"description"`
+}
+
+type owmCurrent struct {
+	Name    string         `json:"name"`
+	Weather []owmCondition `json:"weather"`
+	Main    struct {
+		Temp      float64 `json:"temp"`
+		FeelsLike float64 `json:"feels_like"`
+		Humidity  int     `json:"humidity"`
+	} `json:"main"`
+	Wind struct {
+		Speed float64 `json:"speed"`
+	} `json:"wind"`
+	Sys struct {
+		Country string `json:"country"`
+	} `json:"sys"`
+}
+
+type owmForecast struct {
+	List []struct {
+		Dt      int64          `json:"dt"`
+		Weather []owmCondition `json:"weather"`
+		Main    struct {
+			TempMin float64 `json:"temp_min"`
+			TempMax float64 `json:"temp_max"`
+		} `json:"main"`
+	} `json:"list"`
+	City struct {
+		// Timezone is the location's offset from UTC, in seconds.
+		Timezone int `json:"timezone"`
+	} `json:"city"`
+}
+
+// A day is the forecast for one day at the location.
+type day struct {
+	date             time.Time
+	tempMin, tempMax float64
+	// description is of the weather nearest midday.
+	description string
+	fromMidday  time.Duration
+	forecasts   int // how many of OpenWeatherMap's forecasts cover the day
+}
+
+type weatherService struct {
+	id            string
+	serviceUserID string
+	// APIKey is the OpenWeatherMap API key to look the weather up with.
+	APIKey secrets.Secret
+	// Units is "metric" or "imperial". Optional: "metric" if not given.
+	Units string
+	// RoomUnits are the units to use in some rooms, instead of Units, e.g. {"!foo:bar": "imperial"}.
+	RoomUnits map[string]string
+	// CommandPrefixes are what commands start with in each room, e.g. {"!foo:bar": "?"}, so that
+	// several bots in a room can be told apart. Optional: in other rooms commands start with "!".
+	CommandPrefixes map[string]string
+}
+
+func (s *weatherService) ServiceUserID() string { return s.serviceUserID }
+func (s *weatherService) ServiceID() string     { return s.id }
+func (s *weatherService) ServiceType() string   { return "weather" }
+func (s *weatherService) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli *matrix.Client) {
+	w.WriteHeader(200) // Do nothing
+}
+func (s *weatherService) ValidateConfig() []types.ConfigError {
+	errs := types.ValidateCommandPrefixes(s.CommandPrefixes)
+	if s.APIKey.Value() == "" {
+		errs = append(errs, types.ConfigError{Field: "APIKey", Message: "is required"})
+	}
+	if _, ok := unitLabels[s.Units]; s.Units != "" && !ok {
+		errs = append(errs, types.ConfigError{Field: "Units", Message: `must be "metric" or "imperial"`})
+	}
+	for _, roomID := range util.SortedKeys(s.RoomUnits) {
+		field := fmt.Sprintf("RoomUnits[%s]", roomID)
+		if !types.IsRoomID(roomID) {
+			errs = append(errs, types.ConfigError{Field: field, Message: "is not a room ID"})
+		}
+		if _, ok := unitLabels[s.RoomUnits[roomID]]; !ok {
+			errs = append(errs, types.ConfigError{Field: field, Message: `must be "metric" or "imperial"`})
+		}
+	}
+	return errs
+}
+func (s *weatherService) Register(oldService types.Service, client *matrix.Client) error { return nil }
+func (s *weatherService) PostRegister(oldService types.Service)                          {}
+
+func (s *weatherService) Plugin(client *matrix.Client, roomID string) plugin.Plugin {
+	return plugin.Plugin{
+		Prefix: s.CommandPrefixes[roomID],
+		Commands: []plugin.Command{
+			plugin.Command{
+				Path:      []string{"weather"},
+				Arguments: []string{"location"},
+				Help:      "Show the weather now and the forecast for the next few days at the location, e.g. London,GB",
+				ContextCommand: func(ctx context.Context, roomID, userID string, args []string) (interface{}, error) {
+					return s.cmdWeather(ctx, roomID, args)
+				},
+			},
+		},
+	}
+}
+
+// units returns the units to use in the room.
+func (s *weatherService) units(roomID string) string {
+	if units := s.RoomUnits[roomID]; units != "" {
+		return units
+	}
+	if s.Units != "" {
+		return s.Units
+	}
+	return "metric"
+}
+
+func (s *weatherService) cmdWeather(ctx context.Context, roomID string, args []string) (interface{}, error) {
+	location := strings.Join(args, " ")
+	if location == "" {
+		return matrix.TextMessage{"m.notice", "Usage: !weather <location>, e.g. !weather London,GB"}, nil
+	}
+	units := s.units(roomID)
+	var current owmCurrent
+	if err := s.get(ctx, "/weather", location, units, &current); err != nil {
+		return nil, err
+	}
+	var forecast owmForecast
+	if err := s.get(ctx, "/forecast", location, units, &forecast); err != nil {
+		// The current weather is still worth showing.
+		log.WithError(err).WithField("location", location).Warn("Failed to fetch weather forecast")
+	}
+	return matrix.TextMessage{"m.notice", describe(current, forecast, units, time.Now())}, nil
+}
+
+// get fetches the location's weather from the OpenWeatherMap endpoint into result.
+func (s *weatherService) get(ctx context.Context, endpoint, location, units string, result interface{}) error {
+	u, err := url.Parse(apiURL + endpoint)
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	q.Set("q", location)
+	q.Set("units", units)
+	q.Set("appid", s.APIKey.Value())
+	u.RawQuery = q.Encode()
+	res, err := ctxhttp.Get(ctx, httpclient.Default, u.String())
+	if res != nil {
+		defer res.Body.Close()
+	}
+	if err != nil {
+		return err
+	}
+	switch {
+	case res.StatusCode == 404:
+		return fmt.Errorf("Couldn't find %q: try adding the country, e.g. Paris,FR", location)
+	case res.StatusCode == 401:
+		return errors.New("OpenWeatherMap rejected the API key")
+	case res.StatusCode != 200:
+		return fmt.Errorf("OpenWeatherMap returned HTTP %d", res.StatusCode)
+	}
+	return json.NewDecoder(res.Body).Decode(result)
+}
+
+// describe describes the weather now, and the forecast for the days after now's, at the location.
+func describe(current owmCurrent, forecast owmForecast, units string, now time.Time) string {
+	labels := unitLabels[units]
+	place := current.Name
+	if current.Sys.Country != "" {
+		place += ", " + current.Sys.Country
+	}
+	var conditions []string
+	for _, c := range current.Weather {
+		conditions = append(conditions, c.Description)
+	}
+	lines := []string{fmt.Sprintf(
+		"Weather in %s: %s, %s%s (feels like %s%s), humidity %d%%, wind %s %s",
+		place, strings.Join(conditions, ", "),
+		round(current.Main.Temp), labels.temp, round(current.Main.FeelsLike), labels.temp,
+		current.Main.Humidity, round(current.Wind.Speed), labels.speed,
+	)}
+	for _, d := range forecastByDay(forecast, now) {
+		lines = append(lines, fmt.Sprintf(
+			"%s: %s to %s%s, %s",
+			d.date.Format("Mon"), round(d.tempMin), round(d.tempMax), labels.temp, d.description,
+		))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// forecastByDay sums up the forecast for each of the forecastDays after today, in the location's
+// time zone. OpenWeatherMap forecasts every 3 hours, so the last day may be partly covered.
+func forecastByDay(forecast owmForecast, now time.Time) []day {
+	loc := time.FixedZone("", forecast.City.Timezone)
+	year, month, date := now.In(loc).Date()
+	today := time.Date(year, month, date, 0, 0, 0, 0, loc)
+	var days []day
+	for _, f := range forecast.List {
+		t := time.Unix(f.Dt, 0).In(loc)
+		i := int(t.Sub(today)/(24*time.Hour)) - 1
+		if i < 0 || i >= forecastDays {
+			continue
+		}
+		for len(days) <= i {
+			days = append(days, day{date: today.AddDate(0, 0, len(days)+1)})
+		}
+		days[i].add(t, f.Main.TempMin, f.Main.TempMax, f.Weather)
+	}
+	// Days with no forecast, which OpenWeatherMap shouldn't leave, are dropped.
+	var covered []day
+	for _, d := range days {
+		if d.forecasts > 0 {
+			covered = append(covered, d)
+		}
+	}
+	return covered
+}
+
+// add adds OpenWeatherMap's forecast for the time t to the day's.
+func (d *day) add(t time.Time, tempMin, tempMax float64, weather []owmCondition) {
+	fromMidday := t.Sub(d.date.Add(12 * time.Hour))
+	if fromMidday < 0 {
+		fromMidday = -fromMidday
+	}
+	if d.forecasts == 0 || tempMin < d.tempMin {
+		d.tempMin = tempMin
+	}
+	if d.forecasts == 0 || tempMax > d.tempMax {
+		d.tempMax = tempMax
+	}
+	if len(weather) > 0 && (d.description == "" || fromMidday < d.fromMidday) {
+		d.description = weather[0].Description
+		d.fromMidday = fromMidday
+	}
+	d.forecasts++
+}
+
+// round formats the value as a whole number.
+func round(v float64) string {
+	r := math.Floor(v + 0.5)
+	if r == 0 {
+		return "0" // not "-0"
+	}
+	return fmt.Sprintf("%.0f", r)
+}
+
+func init() {
+	types.RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) types.Service {
+		return &weatherService{
+			id:            serviceID,
+			serviceUserID: serviceUserID,
+		}
+	})
+}
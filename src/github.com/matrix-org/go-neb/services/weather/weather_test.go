@@ -0,0 +1,118 @@
+package services
+
+import (
+	"encoding/json"
+	"github.com/matrix-org/go-neb/matrix"
+	"golang.org/x/net/context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// A forecast for London in summer, an hour ahead of UTC, fetched at 2016-07-04 15:00 local time.
+const forecastJSON = `{
+	"list": [
+		{"dt": 1467644400, "main": {"temp_min": 20.2, "temp_max": 21}, "weather": [{"description": "sunny"}]},
+		{"dt": 1467676800, "main": {"temp_min": 12.4, "temp_max": 13}, "weather": [{"description": "clear sky"}]},
+		{"dt": 1467709200, "main": {"temp_min": 17, "temp_max": 18.6}, "weather": [{"description": "light rain"}]},
+		{"dt": 1467720000, "main": {"temp_min": 18, "temp_max": 19.5}, "weather": [{"description": "overcast clouds"}]},
+		{"dt": 1467784800, "main": {"temp_min": 15, "temp_max": 22}, "weather": [{"description": "broken clouds"}]},
+		{"dt": 1468022400, "main": {"temp_min": 10, "temp_max": 11}, "weather": [{"description": "snow"}]}
+	],
+	"city": {"timezone": 3600}
+}`
+
+const currentJSON = `{
+	"name": "London",
+	"weather": [{"description": "scattered clouds"}],
+	"main": {"temp": 19.6, "feels_like": 19.2, "humidity": 64},
+	"wind": {"speed": 4.1},
+	"sys": {"country": "GB"}
+}`
+
+func TestDescribe(t *testing.T) {
+	var current owmCurrent
+	var forecast owmForecast
+	if err := json.Unmarshal([]byte(currentJSON), &current); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(forecastJSON), &forecast); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2016, 7, 4, 14, 0, 0, 0, time.UTC)
+	want := "Weather in London, GB: scattered clouds, 20°C (feels like 19°C), humidity 64%, wind 4 m/s\n" +
+		"Tue: 12 to 20°C, overcast clouds\n" +
+		"Wed: 15 to 22°C, broken clouds"
+	if got := describe(current, forecast, "metric", now); got != want {
+		t.Errorf("describe => want %q, got %q", want, got)
+	}
+
+	want = "Weather in London, GB: scattered clouds, 20°F (feels like 19°F), humidity 64%, wind 4 mph"
+	if got := describe(current, owmForecast{}, "imperial", now); got != want {
+		t.Errorf("describe without a forecast => want %q, got %q", want, got)
+	}
+}
+
+func TestRound(t *testing.T) {
+	for v, want := range map[float64]string{0.4: "0", -0.4: "0", 2.5: "3", -2.6: "-3", 21.49: "21"} {
+		if got := round(v); got != want {
+			t.Errorf("round(%v) => want %q, got %q", v, want, got)
+		}
+	}
+}
+
+func TestUnits(t *testing.T) {
+	s := weatherService{RoomUnits: map[string]string{"!us:x": "imperial"}}
+	if got := s.units("!uk:x"); got != "metric" {
+		t.Errorf("units with no config => want metric, got %s", got)
+	}
+	s.Units = "imperial"
+	s.RoomUnits["!uk:x"] = "metric"
+	if got := s.units("!uk:x"); got != "metric" {
+		t.Errorf("units of a room with its own units => want metric, got %s", got)
+	}
+	if got := s.units("!other:x"); got != "imperial" {
+		t.Errorf("units of another room => want imperial, got %s", got)
+	}
+}
+
+func TestCmdWeather(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		q := req.URL.Query()
+		if q.Get("appid") != "key" {
+			w.WriteHeader(401)
+			return
+		}
+		if q.Get("q") != "London,GB" || q.Get("units") != "imperial" {
+			w.WriteHeader(404)
+			return
+		}
+		switch req.URL.Path {
+		case "/weather":
+			w.Write([]byte(currentJSON))
+		default:
+			w.WriteHeader(500)
+		}
+	}))
+	defer srv.Close()
+	apiURL = srv.URL
+	defer func() { apiURL = "https://api.openweathermap.org/data/2.5" }()
+
+	var s weatherService
+	if err := json.Unmarshal([]byte(`{"APIKey":"key","RoomUnits":{"!us:x":"imperial"}}`), &s); err != nil {
+		t.Fatal(err)
+	}
+	content, err := s.cmdWeather(context.Background(), "!us:x", []string{"London,GB"})
+	if err != nil {
+		t.Fatalf("cmdWeather => want the weather, got error %s", err)
+	}
+	// The forecast fails, but the current weather is still shown.
+	want := matrix.TextMessage{"m.notice", "Weather in London, GB: scattered clouds, 20°F (feels like 19°F), humidity 64%, wind 4 mph"}
+	if content != want {
+		t.Errorf("cmdWeather => want %+v, got %+v", want, content)
+	}
+	if _, err = s.cmdWeather(context.Background(), "!uk:x", []string{"London,GB"}); err == nil {
+		t.Error("cmdWeather of an unknown location => want an error, got nil")
+	}
+}
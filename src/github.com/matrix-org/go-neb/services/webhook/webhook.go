@@ -0,0 +1,480 @@
+package services
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/batch"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/plugin"
+	"github.com/matrix-org/go-neb/secrets"
+	"github.com/matrix-org/go-neb/server"
+	"github.com/matrix-org/go-neb/signatures"
+	"github.com/matrix-org/go-neb/status"
+	"github.com/matrix-org/go-neb/types"
+	htmltemplate "html/template"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// maxBodySize is the largest JSON body a webhook request can have.
+const maxBodySize = 1024 * 1024
+
+// webhookService posts a message to rooms for every JSON request made to its endpoint, rendered
+// from the request body with a template. It is for systems which don't have a service of their own.
+type webhookService struct {
+	id                 string
+	serviceUserID      string
+	webhookEndpointURL string
+	// Token must be sent with every request, as "Authorization: Bearer <token>", an
+	// X-Webhook-Token header or a ?token= query parameter. If Signature is set, it is instead the
+	// secret requests are signed with.
+	Token secrets.Secret
+	// Signature is the scheme requests are signed with, for senders which sign them rather than
+	// send a token: "github", "gitlab", "gitea", "bitbucket", "sentry", "pagerduty", "stripe" or
+	// "slack".
+	Signature string
+	// Template is a Go text/template which renders the message from the request's JSON body.
+	// Messages which render to nothing but whitespace are not sent.
+	Template string
+	// HTMLTemplate is a Go html/template which renders the message's HTML from the request's
+	// JSON body. Optional: messages are plain text. If it is set, Template renders the plain text
+	// body, or the HTML is stripped of tags to make it if Template is empty.
+	HTMLTemplate string
+	// AllowedIPs are the IP addresses and CIDR ranges requests may come from. Optional: requests
+	// are allowed from anywhere.
+	AllowedIPs []string
+	// MsgType is "m.notice" (the default) or "m.text".
+	MsgType string
+	// BatchKey is a Go text/template which renders what a request is about from its JSON body,
+	// e.g. "{{.groupKey}}". Messages about the same thing are held back for BatchWindow, e.g.
+	// "30s", and sent as one message. Optional: messages are sent as they arrive, as are those
+	// whose key renders to nothing.
+	BatchKey    string
+	BatchWindow string
+	// AlertIfQuietFor is how long to go without a request before alerting the operators that
+	// the sender is probably broken, e.g. "24h". Optional: they are never alerted.
+	AlertIfQuietFor string
+	// Rooms are the IDs of the rooms to post messages to.
+	Rooms []string
+	// RoomTemplates are the templates for rooms which get a different message to the others,
+	// keyed by room ID. Each room must also be in Rooms.
+	RoomTemplates map[string]webhookTemplates
+}
+
+// webhookTemplates are the templates a room's messages are rendered with.
+type webhookTemplates struct {
+	Template     string
+	HTMLTemplate string
+}
+
+func (s *webhookService) ServiceUserID() string { return s.serviceUserID }
+func (s *webhookService) ServiceID() string     { return s.id }
+func (s *webhookService) ServiceType() string   { return "webhook" }
+func (s *webhookService) Plugin(cli *matrix.Client, roomID string) plugin.Plugin {
+	return plugin.Plugin{}
+}
+func (s *webhookService) WebhookAllowedIPs() []string { return s.AllowedIPs }
+func (s *webhookService) QuietPeriod() time.Duration {
+	d, _ := status.ParseQuietPeriod(s.AlertIfQuietFor) // ValidateConfig checks it parses
+	return d
+}
+
+// OnReceiveWebhook renders the request body with the template and posts the result to every room.
+func (s *webhookService) OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli *matrix.Client) {
+	logger := server.RequestLogger(req)
+	body, code := s.readBody(w, req, logger)
+	if code != 0 {
+		w.WriteHeader(code)
+		return
+	}
+	msgs, err := s.renderAll(body, logger)
+	if err != nil {
+		status.Failed(s.id, err)
+		w.WriteHeader(400)
+		return
+	}
+	if len(msgs) == 0 {
+		logger.Print("Template rendered no message")
+		status.Filtered(s.id)
+		w.WriteHeader(200)
+		return
+	}
+	status.Forwarded(s.id)
+	if sendErrs := s.sendAll(cli, body, msgs, logger); len(sendErrs) > 0 {
+		// So that the request is dead-lettered, to be replayed once the rooms are fixed.
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(200)
+}
+
+// readBody checks the request is an authorised POST and decodes its JSON body. Returns the HTTP
+// status code to respond with if it isn't, or 0.
+func (s *webhookService) readBody(w http.ResponseWriter, req *http.Request, logger *log.Entry) (interface{}, int) {
+	var reader io.Reader
+	// Token schemes send the secret itself in a header, which isn't stored with deliveries, so
+	// replays of them are authorised like any other replay.
+	_, tokenScheme := signatures.Named(s.Signature).(signatures.Token)
+	if s.Signature != "" && !(tokenScheme && server.IsReplay(req)) {
+		content, err := signatures.ReadAndVerify(req, signatures.Named(s.Signature), s.Token.Value(), maxBodySize)
+		if err != nil {
+			logger.WithError(err).Print("Webhook request failed signature check")
+			return nil, 401
+		}
+		reader = bytes.NewReader(content)
+	} else if !s.authorised(req) {
+		return nil, 401
+	} else {
+		reader = http.MaxBytesReader(w, req.Body, maxBodySize)
+	}
+	if req.Method != "POST" {
+		return nil, 405
+	}
+	var body interface{}
+	dec := json.NewDecoder(reader)
+	dec.UseNumber() // so that numbers are shown as they were sent, rather than as floats
+	if err := dec.Decode(&body); err != nil {
+		logger.WithError(err).Print("Failed to decode webhook body")
+		return nil, 400
+	}
+	return body, 0
+}
+
+// renderAll renders every room's message from the body, by room ID, before any is sent, so that a
+// template which fails on the body doesn't leave some rooms told and others not. Rooms whose
+// templates render to nothing are left out.
+func (s *webhookService) renderAll(body interface{}, logger *log.Entry) (map[string]interface{}, error) {
+	msgs := make(map[string]interface{})
+	for _, roomID := range s.Rooms {
+		msg, err := s.render(s.templatesFor(roomID), body)
+		if err != nil {
+			logger.WithError(err).WithField("room_id", roomID).Print("Failed to render webhook message")
+			return nil, err
+		}
+		if msg != nil {
+			msgs[roomID] = msg
+		}
+	}
+	return msgs, nil
+}
+
+// sendAll sends the rendered messages to their rooms, batched by the body's batch key. Returns the
+// errors sending to each room.
+func (s *webhookService) sendAll(cli *matrix.Client, body interface{}, msgs map[string]interface{}, logger *log.Entry) map[string]error {
+	key, err := s.batchKey(body)
+	if err != nil {
+		// The message is still worth sending, just not batching.
+		logger.WithError(err).Print("Failed to render batch key")
+	}
+	window, _ := batch.ParseWindow(s.BatchWindow) // ValidateConfig checks it parses
+	var sends []batch.Message
+	for _, roomID := range s.Rooms {
+		if msg, ok := msgs[roomID]; ok {
+			sends = append(sends, batch.Message{roomID, key, msg})
+		}
+	}
+	sendErrs := batch.SendAll(cli, s.id, window, sends)
+	for roomID, e := range sendErrs {
+		logger.WithError(e).WithField("room_id", roomID).Print("Failed to send notification to room.")
+	}
+	return sendErrs
+}
+
+// authorised returns true if the request carries the service's token, or is a replay of a stored
+// delivery, which the token isn't stored with.
+func (s *webhookService) authorised(req *http.Request) bool {
+	if server.IsReplay(req) {
+		return true
+	}
+	token := req.Header.Get("X-Webhook-Token")
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if token == "" {
+		token = req.URL.Query().Get("token")
+	}
+	want := s.Token.Value()
+	return want != "" && subtle.ConstantTimeCompare([]byte(token), []byte(want)) == 1
+}
+
+func (s *webhookService) msgType() string {
+	if s.MsgType == "" {
+		return "m.notice"
+	}
+	return s.MsgType
+}
+
+// templatesFor returns the templates a room's messages are rendered with.
+func (s *webhookService) templatesFor(roomID string) webhookTemplates {
+	if t, ok := s.RoomTemplates[roomID]; ok {
+		return t
+	}
+	return webhookTemplates{s.Template, s.HTMLTemplate}
+}
+
+// render renders a message from the request body, or returns nil if it renders to nothing but
+// whitespace. The message is a matrix.HTMLMessage if there is an HTML template, or a
+// matrix.TextMessage if not.
+func (s *webhookService) render(t webhookTemplates, body interface{}) (interface{}, error) {
+	var text string
+	if t.Template != "" {
+		tmpl, err := template.New(s.id).Funcs(templateFuncs).Parse(t.Template)
+		if err != nil {
+			// ValidateConfig should have caught this.
+			return nil, err
+		}
+		var buf bytes.Buffer
+		if err = tmpl.Execute(&buf, body); err != nil {
+			return nil, err
+		}
+		text = strings.TrimSpace(buf.String())
+	}
+	if t.HTMLTemplate == "" {
+		if text == "" {
+			return nil, nil
+		}
+		return matrix.TextMessage{s.msgType(), text}, nil
+	}
+	tmpl, err := htmltemplate.New(s.id + "-html").Funcs(htmltemplate.FuncMap(templateFuncs)).Parse(t.HTMLTemplate)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err = tmpl.Execute(&buf, body); err != nil {
+		return nil, err
+	}
+	htmlText := strings.TrimSpace(buf.String())
+	if htmlText == "" {
+		return nil, nil
+	}
+	msg := matrix.GetHTMLMessage(s.msgType(), htmlText)
+	if text != "" {
+		msg.Body = text
+	}
+	return msg, nil
+}
+
+// batchKey renders the batch key from the request body, or returns "" if there is no BatchKey.
+func (s *webhookService) batchKey(body interface{}) (string, error) {
+	if s.BatchKey == "" {
+		return "", nil
+	}
+	tmpl, err := template.New(s.id + "-batch").Funcs(templateFuncs).Parse(s.BatchKey)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err = tmpl.Execute(&buf, body); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// templateFuncs are the helpers templates can use on top of the built in ones:
+//
+//	{{get . "alerts.0.labels.severity"}}  the value at a dotted path of keys and list indexes
+//	{{json .data}}                         a value as JSON
+//	{{default "none" .assignee}}           the value, or the default if it is empty or missing
+//	{{join ", " .tags}}                    the items of a list, separated
+var templateFuncs = template.FuncMap{
+	"get":     getPath,
+	"json":    toJSON,
+	"default": defaultValue,
+	"join":    join,
+}
+
+// getPath returns the value at a dotted path in decoded JSON, e.g. "items.0.name", or nil if there
+// is nothing there.
+func getPath(v interface{}, path string) interface{} {
+	if path == "" {
+		return v
+	}
+	for _, key := range strings.Split(path, ".") {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			v = node[key]
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil
+			}
+			v = node[i]
+		default:
+			return nil
+		}
+	}
+	return v
+}
+
+func toJSON(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+func defaultValue(def, v interface{}) interface{} {
+	switch val := v.(type) {
+	case nil:
+		return def
+	case string:
+		if val == "" {
+			return def
+		}
+	case []interface{}:
+		if len(val) == 0 {
+			return def
+		}
+	case map[string]interface{}:
+		if len(val) == 0 {
+			return def
+		}
+	}
+	return v
+}
+
+func join(sep string, v interface{}) string {
+	list, ok := v.([]interface{})
+	if !ok {
+		if v == nil {
+			return ""
+		}
+		return fmt.Sprint(v)
+	}
+	strs := make([]string, len(list))
+	for i, item := range list {
+		strs[i] = fmt.Sprint(item)
+	}
+	return strings.Join(strs, sep)
+}
+
+// ValidateConfig checks that the token and a template are given, that the templates, batch
+// window and quiet period parse, that the signature scheme is known, that the allowed IPs parse,
+// that every room ID is well formed, and that every room with its own templates is one of the
+// rooms.
+func (s *webhookService) ValidateConfig() []types.ConfigError {
+	var errs []types.ConfigError
+	if s.Token.Value() == "" {
+		errs = append(errs, types.ConfigError{Field: "Token", Message: "is required"})
+	}
+	if s.Signature != "" && signatures.Named(s.Signature) == nil {
+		errs = append(errs, types.ConfigError{Field: "Signature", Message: "must be one of " + strings.Join(signatures.Names(), ", ")})
+	}
+	if _, err := server.ParseAllowlist(s.AllowedIPs); err != nil {
+		errs = append(errs, types.ConfigError{Field: "AllowedIPs", Message: "does not parse: " + err.Error()})
+	}
+	if s.Template == "" && s.HTMLTemplate == "" {
+		errs = append(errs, types.ConfigError{Field: "Template", Message: "is required unless HTMLTemplate is given"})
+	}
+	errs = append(errs, validateTemplates("", webhookTemplates{s.Template, s.HTMLTemplate})...)
+	errs = append(errs, s.validateRoomTemplates()...)
+	errs = append(errs, s.validateBatching()...)
+	if s.MsgType != "" && s.MsgType != "m.notice" && s.MsgType != "m.text" {
+		errs = append(errs, types.ConfigError{Field: "MsgType", Message: `must be "m.notice" or "m.text"`})
+	}
+	return append(errs, s.validateRooms()...)
+}
+
+// validateRoomTemplates checks that every room with its own templates is one of the rooms, and
+// that its templates parse.
+func (s *webhookService) validateRoomTemplates() []types.ConfigError {
+	var errs []types.ConfigError
+	rooms := make(map[string]bool)
+	for _, roomID := range s.Rooms {
+		rooms[roomID] = true
+	}
+	for roomID, t := range s.RoomTemplates {
+		field := fmt.Sprintf("RoomTemplates[%s]", roomID)
+		if !rooms[roomID] {
+			errs = append(errs, types.ConfigError{Field: field, Message: "is not one of Rooms"})
+		}
+		if t.Template == "" && t.HTMLTemplate == "" {
+			errs = append(errs, types.ConfigError{Field: field + ".Template", Message: "is required unless HTMLTemplate is given"})
+		}
+		errs = append(errs, validateTemplates(field+".", t)...)
+	}
+	return errs
+}
+
+// validateBatching checks that the batch key, batch window and quiet period parse.
+func (s *webhookService) validateBatching() []types.ConfigError {
+	var errs []types.ConfigError
+	if _, err := template.New("").Funcs(templateFuncs).Parse(s.BatchKey); err != nil {
+		errs = append(errs, types.ConfigError{Field: "BatchKey", Message: "does not parse: " + err.Error()})
+	}
+	if _, err := batch.ParseWindow(s.BatchWindow); err != nil {
+		errs = append(errs, types.ConfigError{Field: "BatchWindow", Message: "is not a valid window: " + err.Error()})
+	}
+	if _, err := status.ParseQuietPeriod(s.AlertIfQuietFor); err != nil {
+		errs = append(errs, types.ConfigError{Field: "AlertIfQuietFor", Message: "is not a valid period: " + err.Error()})
+	}
+	return errs
+}
+
+// validateRooms checks that at least one room is given, and that every room ID is well formed.
+func (s *webhookService) validateRooms() []types.ConfigError {
+	var errs []types.ConfigError
+	if len(s.Rooms) == 0 {
+		errs = append(errs, types.ConfigError{Field: "Rooms", Message: "must list at least one room"})
+	}
+	for i, roomID := range s.Rooms {
+		if !types.IsRoomID(roomID) {
+			errs = append(errs, types.ConfigError{Field: fmt.Sprintf("Rooms[%d]", i), Message: "is not a room ID"})
+		}
+	}
+	return errs
+}
+
+// validateTemplates checks that the templates parse, prefixing the fields of errors with prefix.
+func validateTemplates(prefix string, t webhookTemplates) []types.ConfigError {
+	var errs []types.ConfigError
+	if _, err := template.New("").Funcs(templateFuncs).Parse(t.Template); err != nil {
+		errs = append(errs, types.ConfigError{Field: prefix + "Template", Message: "does not parse: " + err.Error()})
+	}
+	if _, err := htmltemplate.New("").Funcs(htmltemplate.FuncMap(templateFuncs)).Parse(t.HTMLTemplate); err != nil {
+		errs = append(errs, types.ConfigError{Field: prefix + "HTMLTemplate", Message: "does not parse: " + err.Error()})
+	}
+	return errs
+}
+
+// Register joins the rooms messages are posted to.
+func (s *webhookService) Register(oldService types.Service, client *matrix.Client) error {
+	for _, roomID := range s.Rooms {
+		if _, err := client.JoinRoom(roomID, "", ""); err != nil {
+			return err
+		}
+	}
+	log.WithFields(log.Fields{
+		"service_id": s.id,
+		"url":        s.webhookEndpointURL,
+	}).Info("Registered webhook")
+	return nil
+}
+
+// PlanRegister works out which of the rooms messages are posted to Register would join.
+func (s *webhookService) PlanRegister(oldService types.Service, client *matrix.Client) (*types.RegisterPlan, error) {
+	plan := &types.RegisterPlan{JoinRooms: types.PlanJoinRooms(client, s.Rooms)}
+	return plan, nil
+}
+
+// CheckRegistered checks that the service's client is still in the rooms messages are posted to.
+func (s *webhookService) CheckRegistered(client *matrix.Client) ([]string, error) {
+	return types.CheckJoinedRooms(client, s.Rooms), nil
+}
+
+func (s *webhookService) PostRegister(oldService types.Service) {}
+
+func init() {
+	types.RegisterService(func(serviceID, serviceUserID, webhookEndpointURL string) types.Service {
+		return &webhookService{
+			id:                 serviceID,
+			serviceUserID:      serviceUserID,
+			webhookEndpointURL: webhookEndpointURL,
+		}
+	})
+}
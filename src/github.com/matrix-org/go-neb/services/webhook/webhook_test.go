@@ -0,0 +1,64 @@
+package services
+
+import (
+	"github.com/matrix-org/go-neb/secrets"
+	"github.com/matrix-org/go-neb/server"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var authtests = []struct {
+	url       string
+	header    string
+	value     string
+	replay    bool
+	wantAuthd bool
+}{
+	{"/hook", "X-Webhook-Token", "s3cret", false, true},
+	{"/hook", "Authorization", "Bearer s3cret", false, true},
+	{"/hook?token=s3cret", "", "", false, true},
+	{"/hook", "", "", false, false},
+	{"/hook", "X-Webhook-Token", "wrong", false, false},
+	{"/hook", "Authorization", "Bearer wrong", false, false},
+	{"/hook", "Authorization", "s3cret", false, false},
+	{"/hook?token=wrong", "", "", false, false},
+	{"/hook?token=s3cret", "Authorization", "Bearer wrong", false, false},
+	{"/hook", "", "", true, true},
+}
+
+func TestAuthorised(t *testing.T) {
+	s := &webhookService{Token: secrets.New("s3cret")}
+	for _, test := range authtests {
+		req := httptest.NewRequest("POST", test.url, nil)
+		if test.header != "" {
+			req.Header.Set(test.header, test.value)
+		}
+		if test.replay {
+			req = server.MarkReplay(req)
+		}
+		if got := s.authorised(req); got != test.wantAuthd {
+			t.Errorf("authorised(%s with %s: %q, replay %t) => want %t got %t", test.url, test.header, test.value, test.replay, test.wantAuthd, got)
+		}
+	}
+	noToken := &webhookService{}
+	if noToken.authorised(httptest.NewRequest("POST", "/hook?token=", nil)) {
+		t.Errorf("authorised with no Token configured => want false got true")
+	}
+}
+
+func TestReplayOfTokenScheme(t *testing.T) {
+	s := &webhookService{Token: secrets.New("s3cret"), Signature: "gitlab", Template: "{{.a}}"}
+	for _, replay := range []bool{false, true} {
+		// X-Gitlab-Token isn't stored with deliveries, so replays don't have it.
+		req := httptest.NewRequest("POST", "/hook", strings.NewReader(`{"a":1}`))
+		if replay {
+			req = server.MarkReplay(req)
+		}
+		w := httptest.NewRecorder()
+		s.OnReceiveWebhook(w, req, nil)
+		if want := map[bool]int{false: 401, true: 200}[replay]; w.Code != want {
+			t.Errorf("OnReceiveWebhook without X-Gitlab-Token, replay %t => want HTTP %d got %d", replay, want, w.Code)
+		}
+	}
+}
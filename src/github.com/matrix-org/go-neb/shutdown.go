@@ -0,0 +1,110 @@
+package main
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/batch"
+	"github.com/matrix-org/go-neb/clients"
+	"github.com/matrix-org/go-neb/server"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// gracefulShutdown stops Go-NEB on SIGTERM or SIGINT without dropping work: it stops accepting
+// new connections, lets in-flight webhook requests finish, sends the messages held back for
+// batching and waits for the events which the matrix clients have already received to be
+// processed. If this takes longer than the timeout,
+// Go-NEB exits anyway.
+type gracefulShutdown struct {
+	listener net.Listener
+	others   []net.Listener // closed along with listener, e.g. the admin listener
+	webhooks *server.Drainer
+	clients  *clients.Clients
+	timeout  time.Duration
+	stopping chan struct{} // closed when shutdown starts
+	stopped  chan struct{} // closed when shutdown has finished
+}
+
+func newGracefulShutdown(listener net.Listener, webhooks *server.Drainer, clients *clients.Clients, timeout time.Duration) *gracefulShutdown {
+	return &gracefulShutdown{
+		listener: listener,
+		webhooks: webhooks,
+		clients:  clients,
+		timeout:  timeout,
+		stopping: make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+}
+
+// serve serves HTTP requests on the listener with the given server until a shutdown signal is
+// received, then returns nil once shutdown has finished. Returns an error if serving fails for
+// any other reason.
+func (g *gracefulShutdown) serve(srv *http.Server) error {
+	go g.waitForSignal()
+	err := srv.Serve(g.listener)
+	select {
+	case <-g.stopping:
+		<-g.stopped
+		return nil
+	default:
+		return err
+	}
+}
+
+// serveAlso serves HTTP requests on another listener, such as the admin listener, with the given
+// server in the background. The listener stops accepting new connections when shutdown starts,
+// like the main one. It is served over TLS if the server has a TLS config. Must be called before
+// serve.
+func (g *gracefulShutdown) serveAlso(listener net.Listener, srv *http.Server, name string) {
+	g.others = append(g.others, listener)
+	go func() {
+		var err error
+		if srv.TLSConfig != nil {
+			err = srv.ServeTLS(listener, "", "")
+		} else {
+			err = srv.Serve(listener)
+		}
+		select {
+		case <-g.stopping:
+		default:
+			log.WithError(err).Panicf("Failed to serve %s", name)
+		}
+	}()
+}
+
+func (g *gracefulShutdown) waitForSignal() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-sigs
+	log.WithFields(log.Fields{
+		"signal":  sig,
+		"timeout": g.timeout,
+	}).Info("Shutting down")
+
+	close(g.stopping)
+	// Stop accepting new connections. Requests on existing keep-alive connections are rejected by
+	// the Drainer.
+	for _, listener := range append([]net.Listener{g.listener}, g.others...) {
+		if err := listener.Close(); err != nil {
+			log.WithError(err).Warn("Failed to close listener")
+		}
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		g.webhooks.Drain()
+		batch.Flush()
+		g.clients.Stop()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		log.Info("Finished in-flight work")
+	case <-time.After(g.timeout):
+		log.Warn("Timed out waiting for in-flight work to finish")
+	}
+	close(g.stopped)
+}
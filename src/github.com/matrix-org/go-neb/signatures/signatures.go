@@ -0,0 +1,412 @@
+// Package signatures verifies that incoming webhook requests were sent by whoever holds a shared
+// secret, using the schemes of the common webhook senders:
+//
+//	Github    X-Hub-Signature-256: sha256=<hex HMAC-SHA256 of the body>, or the older SHA1 header
+//	Gitlab    X-Gitlab-Token: <the secret itself>
+//	Gitea     X-Gitea-Signature: <hex HMAC-SHA256 of the body>, or X-Forgejo-Signature from Forgejo
+//	Bitbucket X-Hub-Signature: sha256=<hex HMAC-SHA256 of the body>
+//	Sentry    Sentry-Hook-Signature: <hex HMAC-SHA256 of the body>, with the integration's client secret
+//	PagerDuty X-PagerDuty-Signature: v1=<hex HMAC-SHA256 of the body>, with one v1 signature for
+//	          each of the subscription's current secrets
+//	Stripe    Stripe-Signature: t=<timestamp>,v1=<hex HMAC-SHA256 of "timestamp.body">
+//	Slack     X-Slack-Signature: v0=<hex HMAC-SHA256 of "v0:timestamp:body">, with the timestamp in
+//	          X-Slack-Request-Timestamp
+//	Travis    Signature: <base64 RSA signature of the SHA1 of the payload form field>, which is
+//	          checked with Travis CI's public key rather than a shared secret
+//
+// Signatures are compared in constant time, and timestamped schemes reject requests from outside
+// their Tolerance so that captured requests can't be replayed later. Other HMAC schemes can be
+// described with HMAC.
+package signatures
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultTolerance is how far a timestamped request's timestamp may be from the current time, if
+// the scheme doesn't set its own Tolerance. It is what Stripe and Slack recommend.
+const DefaultTolerance = 5 * time.Minute
+
+// Errors returned by Verify. Callers can tell a missing signature, which usually means the sender
+// was not configured with a secret, apart from a wrong one.
+var (
+	ErrMissing  = errors.New("The request is not signed")
+	ErrMismatch = errors.New("The request's signature does not match")
+	ErrExpired  = errors.New("The request's timestamp is too far from the current time")
+)
+
+// now is the current time, replaced in tests.
+var now = time.Now
+
+// A Verifier checks a webhook request's signature against a shared secret.
+type Verifier interface {
+	// Verify returns nil if the request with the given headers and body was signed with the
+	// secret, or ErrMissing, ErrMismatch or ErrExpired.
+	Verify(header http.Header, body []byte, secret string) error
+}
+
+// HMAC verifies a header holding the HMAC of the body, after an optional prefix, e.g.
+// "sha256=<hex>".
+type HMAC struct {
+	Header string
+	Prefix string
+	Hash   func() hash.Hash
+	Base64 bool // true if the HMAC is base64 encoded rather than hex encoded
+}
+
+// Verify checks the HMAC of the body.
+func (h HMAC) Verify(header http.Header, body []byte, secret string) error {
+	sig := header.Get(h.Header)
+	if sig == "" {
+		return ErrMissing
+	}
+	if !strings.HasPrefix(sig, h.Prefix) {
+		return ErrMismatch
+	}
+	given, err := h.decode(strings.TrimPrefix(sig, h.Prefix))
+	if err != nil {
+		return ErrMismatch
+	}
+	if !hmac.Equal(given, mac(h.Hash, secret, body)) {
+		return ErrMismatch
+	}
+	return nil
+}
+
+// Sign returns the header value which signs the body with the secret, e.g. for outgoing webhooks.
+func (h HMAC) Sign(body []byte, secret string) string {
+	sum := mac(h.Hash, secret, body)
+	if h.Base64 {
+		return h.Prefix + base64.StdEncoding.EncodeToString(sum)
+	}
+	return h.Prefix + hex.EncodeToString(sum)
+}
+
+func (h HMAC) decode(s string) ([]byte, error) {
+	if h.Base64 {
+		return base64.StdEncoding.DecodeString(s)
+	}
+	return hex.DecodeString(s)
+}
+
+func mac(h func() hash.Hash, secret string, message []byte) []byte {
+	m := hmac.New(h, []byte(secret))
+	m.Write(message)
+	return m.Sum(nil)
+}
+
+// Token verifies a header which holds the secret itself.
+type Token struct {
+	Header string
+}
+
+// Verify compares the header with the secret.
+func (t Token) Verify(header http.Header, body []byte, secret string) error {
+	given := header.Get(t.Header)
+	if given == "" {
+		return ErrMissing
+	}
+	if subtle.ConstantTimeCompare([]byte(given), []byte(secret)) != 1 {
+		return ErrMismatch
+	}
+	return nil
+}
+
+// FirstPresent verifies the request with the first of the verifiers whose signature it has, e.g.
+// a newer header in preference to an older one.
+type FirstPresent []Verifier
+
+// Verify uses the first verifier which doesn't return ErrMissing.
+func (f FirstPresent) Verify(header http.Header, body []byte, secret string) error {
+	for _, v := range f {
+		if err := v.Verify(header, body, secret); err != ErrMissing {
+			return err
+		}
+	}
+	return ErrMissing
+}
+
+// Travis verifies Travis CI's Signature header, which holds the RSA (PKCS #1 v1.5) signature of the
+// SHA1 of the form encoded body's payload field. The secret is Travis' public key, PEM encoded, as
+// its API's /config endpoint publishes it.
+type Travis struct{}
+
+// Verify checks the signature with the public key. Returns an error other than ErrMissing or
+// ErrMismatch if the key can't be parsed.
+func (Travis) Verify(header http.Header, body []byte, secret string) error {
+	sig := header.Get("Signature")
+	if sig == "" {
+		return ErrMissing
+	}
+	given, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		return ErrMismatch
+	}
+	key, err := parseRSAPublicKey(secret)
+	if err != nil {
+		return err
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return ErrMismatch
+	}
+	hashed := sha1.Sum([]byte(form.Get("payload")))
+	if rsa.VerifyPKCS1v15(key, crypto.SHA1, hashed[:], given) != nil {
+		return ErrMismatch
+	}
+	return nil
+}
+
+func parseRSAPublicKey(pemKey string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(pemKey))
+	if block == nil {
+		return nil, errors.New("The public key is not PEM encoded")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("The public key is not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+// Stripe verifies the Stripe-Signature header, which holds a timestamp and one or more v1
+// signatures, one for each of the endpoint's current secrets.
+type Stripe struct {
+	Tolerance time.Duration // Defaults to DefaultTolerance.
+}
+
+// Verify checks the timestamp and that one of the v1 signatures matches.
+func (s Stripe) Verify(header http.Header, body []byte, secret string) error {
+	sig := header.Get("Stripe-Signature")
+	if sig == "" {
+		return ErrMissing
+	}
+	var timestamp string
+	var sigs [][]byte
+	for _, part := range strings.Split(sig, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			timestamp = kv[1]
+		case "v1":
+			if b, err := hex.DecodeString(kv[1]); err == nil {
+				sigs = append(sigs, b)
+			}
+		}
+	}
+	if timestamp == "" || len(sigs) == 0 {
+		return ErrMismatch
+	}
+	if err := checkTimestamp(timestamp, s.Tolerance); err != nil {
+		return err
+	}
+	want := mac(sha256.New, secret, signedPayload(timestamp+".", body))
+	for _, given := range sigs {
+		if hmac.Equal(given, want) {
+			return nil
+		}
+	}
+	return ErrMismatch
+}
+
+// Sign returns a Stripe-Signature header value which signs the body with the secret at the given
+// time.
+func (s Stripe) Sign(body []byte, secret string, t time.Time) string {
+	timestamp := strconv.FormatInt(t.Unix(), 10)
+	return "t=" + timestamp + ",v1=" + hex.EncodeToString(mac(sha256.New, secret, signedPayload(timestamp+".", body)))
+}
+
+// Slack verifies the X-Slack-Signature header, which signs the body along with the time in
+// X-Slack-Request-Timestamp.
+type Slack struct {
+	Tolerance time.Duration // Defaults to DefaultTolerance.
+}
+
+// Verify checks the timestamp and the signature.
+func (s Slack) Verify(header http.Header, body []byte, secret string) error {
+	sig := header.Get("X-Slack-Signature")
+	if sig == "" {
+		return ErrMissing
+	}
+	timestamp := header.Get("X-Slack-Request-Timestamp")
+	if timestamp == "" || !strings.HasPrefix(sig, "v0=") {
+		return ErrMismatch
+	}
+	if err := checkTimestamp(timestamp, s.Tolerance); err != nil {
+		return err
+	}
+	given, err := hex.DecodeString(strings.TrimPrefix(sig, "v0="))
+	if err != nil {
+		return ErrMismatch
+	}
+	if !hmac.Equal(given, mac(sha256.New, secret, signedPayload("v0:"+timestamp+":", body))) {
+		return ErrMismatch
+	}
+	return nil
+}
+
+// Sign returns the X-Slack-Signature and X-Slack-Request-Timestamp header values which sign the
+// body with the secret at the given time.
+func (s Slack) Sign(body []byte, secret string, t time.Time) (signature, timestamp string) {
+	timestamp = strconv.FormatInt(t.Unix(), 10)
+	return "v0=" + hex.EncodeToString(mac(sha256.New, secret, signedPayload("v0:"+timestamp+":", body))), timestamp
+}
+
+// PagerDuty verifies the X-PagerDuty-Signature header of V3 webhooks, which holds a v1 signature for
+// each of the subscription's current secrets, separated by commas, while a secret is rotated.
+type PagerDuty struct{}
+
+// Verify checks that one of the v1 signatures matches.
+func (PagerDuty) Verify(header http.Header, body []byte, secret string) error {
+	sig := header.Get("X-PagerDuty-Signature")
+	if sig == "" {
+		return ErrMissing
+	}
+	want := mac(sha256.New, secret, body)
+	for _, part := range strings.Split(sig, ",") {
+		part = strings.TrimSpace(part)
+		if !strings.HasPrefix(part, "v1=") {
+			continue
+		}
+		given, err := hex.DecodeString(strings.TrimPrefix(part, "v1="))
+		if err == nil && hmac.Equal(given, want) {
+			return nil
+		}
+	}
+	return ErrMismatch
+}
+
+// Sign returns an X-PagerDuty-Signature header value which signs the body with the secret.
+func (PagerDuty) Sign(body []byte, secret string) string {
+	return "v1=" + hex.EncodeToString(mac(sha256.New, secret, body))
+}
+
+func signedPayload(prefix string, body []byte) []byte {
+	return append([]byte(prefix), body...)
+}
+
+// checkTimestamp returns ErrExpired unless the Unix timestamp is within tolerance of now.
+func checkTimestamp(timestamp string, tolerance time.Duration) error {
+	secs, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrMismatch
+	}
+	if tolerance == 0 {
+		tolerance = DefaultTolerance
+	}
+	diff := now().Sub(time.Unix(secs, 0))
+	if diff > tolerance || diff < -tolerance {
+		return ErrExpired
+	}
+	return nil
+}
+
+// The schemes of the common webhook senders.
+var (
+	GithubSHA256 = HMAC{Header: "X-Hub-Signature-256", Prefix: "sha256=", Hash: sha256.New}
+	GithubSHA1   = HMAC{Header: "X-Hub-Signature", Prefix: "sha1=", Hash: sha1.New}
+	// Github prefers the SHA256 signature, which Github Enterprise Server before 3.0 doesn't send.
+	Github = FirstPresent{GithubSHA256, GithubSHA1}
+	Gitlab = Token{Header: "X-Gitlab-Token"}
+	// Gitea signs requests with X-Gitea-Signature. Forgejo, its fork, sends the same signature in
+	// X-Forgejo-Signature as well, and may stop sending the Gitea header.
+	Gitea = FirstPresent{
+		HMAC{Header: "X-Forgejo-Signature", Hash: sha256.New},
+		HMAC{Header: "X-Gitea-Signature", Hash: sha256.New},
+	}
+	// Bitbucket Cloud uses Github's older header, with a SHA256 signature.
+	Bitbucket = HMAC{Header: "X-Hub-Signature", Prefix: "sha256=", Hash: sha256.New}
+	Sentry    = HMAC{Header: "Sentry-Hook-Signature", Hash: sha256.New}
+)
+
+var named = map[string]Verifier{
+	"github":    Github,
+	"gitlab":    Gitlab,
+	"gitea":     Gitea,
+	"bitbucket": Bitbucket,
+	"sentry":    Sentry,
+	"pagerduty": PagerDuty{},
+	"stripe":    Stripe{},
+	"slack":     Slack{},
+}
+
+// Named returns the scheme with the given name: "github", "gitlab", "gitea", "bitbucket", "sentry",
+// "pagerduty", "stripe" or "slack". Returns nil if there is none.
+func Named(name string) Verifier {
+	return named[name]
+}
+
+// Names returns the sorted names which Named knows.
+func Names() []string {
+	var names []string
+	for name := range named {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// VerifyAny returns nil if the request was signed with any of the secrets, e.g. with a new secret
+// or, whilst it is being rotated out, with the old one. Empty secrets are skipped. Otherwise it
+// returns the error for the first secret.
+func VerifyAny(v Verifier, header http.Header, body []byte, secrets ...string) error {
+	var firstErr error
+	for _, secret := range secrets {
+		if secret == "" {
+			continue
+		}
+		err := v.Verify(header, body, secret)
+		if err == nil {
+			return nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// ReadAndVerify reads up to maxBody bytes of the request body and verifies it with the secret.
+// The body is returned, and also put back in the request so that it can be read again. Returns
+// an error if the body is larger, can't be read, or isn't signed with the secret.
+func ReadAndVerify(req *http.Request, v Verifier, secret string, maxBody int64) ([]byte, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxBody+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > maxBody {
+		return nil, errors.New("The request body is too large")
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err = v.Verify(req.Header, body, secret); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
@@ -0,0 +1,184 @@
+package signatures
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+const slackBody = "token=xyzz0WbapA4vBCDEFasx0q6G&team_id=T1DC2JH3J&team_domain=testteamnow&channel_id=G8PSS9T3V&channel_name=foobar&user_id=U2CERLKJA&user_name=roadrunner&command=%2Fwebhook-collect&text=&response_url=https%3A%2F%2Fhooks.slack.com%2Fcommands%2FT1DC2JH3J%2F397700885554%2F96rGlfmibIGlgcZRskXaIFfN&trigger_id=398738663015.47445629121.803a0bc887a14d10d2c447fce8b6703c"
+
+var verifytests = []struct {
+	name     string
+	verifier Verifier
+	header   map[string]string
+	body     string
+	secret   string
+	now      int64
+	want     error
+}{
+	// Github's documented example
+	{"github sha256", Github, map[string]string{
+		"X-Hub-Signature-256": "sha256=757107ea0eb2509fc211221cce984b8a37570b6d7586c22c46f4379c8b043e17",
+		"X-Hub-Signature":     "sha1=0000000000000000000000000000000000000000",
+	}, "Hello, World!", "It's a Secret to Everybody", 0, nil},
+	{"github sha1 fallback", Github, map[string]string{
+		"X-Hub-Signature": GithubSHA1.Sign([]byte("Hello, World!"), "It's a Secret to Everybody"),
+	}, "Hello, World!", "It's a Secret to Everybody", 0, nil},
+	{"github wrong secret", Github, map[string]string{
+		"X-Hub-Signature-256": "sha256=757107ea0eb2509fc211221cce984b8a37570b6d7586c22c46f4379c8b043e17",
+	}, "Hello, World!", "another secret", 0, ErrMismatch},
+	{"github not hex", Github, map[string]string{"X-Hub-Signature": "sha1=zz"}, "{}", "secret", 0, ErrMismatch},
+	{"github no prefix", Github, map[string]string{"X-Hub-Signature-256": "757107ea"}, "{}", "secret", 0, ErrMismatch},
+	{"github missing", Github, map[string]string{}, "{}", "secret", 0, ErrMissing},
+	{"gitlab", Gitlab, map[string]string{"X-Gitlab-Token": "secret"}, "{}", "secret", 0, nil},
+	{"gitlab wrong token", Gitlab, map[string]string{"X-Gitlab-Token": "secreT"}, "{}", "secret", 0, ErrMismatch},
+	{"gitlab missing", Gitlab, map[string]string{}, "{}", "secret", 0, ErrMissing},
+	{"gitea", Gitea, map[string]string{
+		"X-Gitea-Signature": "d8f89f0618acd61fe621aa4e64078c0e2bca15d0b578b7f3eb734f55883c5320",
+	}, `{"ref":"refs/heads/main"}`, "secret", 0, nil},
+	{"gitea wrong secret", Gitea, map[string]string{
+		"X-Gitea-Signature": "d8f89f0618acd61fe621aa4e64078c0e2bca15d0b578b7f3eb734f55883c5320",
+	}, `{"ref":"refs/heads/main"}`, "another secret", 0, ErrMismatch},
+	{"forgejo", Gitea, map[string]string{
+		"X-Forgejo-Signature": "d8f89f0618acd61fe621aa4e64078c0e2bca15d0b578b7f3eb734f55883c5320",
+		"X-Gitea-Signature":   "0000000000000000000000000000000000000000000000000000000000000000",
+	}, `{"ref":"refs/heads/main"}`, "secret", 0, nil},
+	{"gitea missing", Gitea, map[string]string{}, "{}", "secret", 0, ErrMissing},
+	{"bitbucket", Bitbucket, map[string]string{
+		"X-Hub-Signature": "sha256=d8f89f0618acd61fe621aa4e64078c0e2bca15d0b578b7f3eb734f55883c5320",
+	}, `{"ref":"refs/heads/main"}`, "secret", 0, nil},
+	{"bitbucket sha1", Bitbucket, map[string]string{
+		"X-Hub-Signature": GithubSHA1.Sign([]byte("{}"), "secret"),
+	}, "{}", "secret", 0, ErrMismatch},
+	{"sentry", Sentry, map[string]string{
+		"Sentry-Hook-Signature": "9ef853e39b68507c1b0881e68dbcbf2163d6c09a23a977b2310ef3dfa0892135",
+	}, `{"action":"triggered"}`, "secret", 0, nil},
+	{"sentry missing", Sentry, map[string]string{}, "{}", "secret", 0, ErrMissing},
+	{"pagerduty", PagerDuty{}, map[string]string{
+		"X-PagerDuty-Signature": "v1=9ef853e39b68507c1b0881e68dbcbf2163d6c09a23a977b2310ef3dfa0892135",
+	}, `{"action":"triggered"}`, "secret", 0, nil},
+	{"pagerduty rotating secret", PagerDuty{}, map[string]string{
+		"X-PagerDuty-Signature": "v1=00ff, " + PagerDuty{}.Sign([]byte("{}"), "secret") + ",v2=abc",
+	}, "{}", "secret", 0, nil},
+	{"pagerduty wrong secret", PagerDuty{}, map[string]string{
+		"X-PagerDuty-Signature": "v1=9ef853e39b68507c1b0881e68dbcbf2163d6c09a23a977b2310ef3dfa0892135",
+	}, `{"action":"triggered"}`, "another secret", 0, ErrMismatch},
+	{"pagerduty missing", PagerDuty{}, map[string]string{}, "{}", "secret", 0, ErrMissing},
+	// Slack's documented example
+	{"slack", Slack{}, map[string]string{
+		"X-Slack-Signature":         "v0=a2114d57b48eac39b9ad189dd8316235a7b4a8d21a10bd27519666489c69b503",
+		"X-Slack-Request-Timestamp": "1531420618",
+	}, slackBody, "8f742231b10e8888abcd99yyyzzz85a5", 1531420618 + 60, nil},
+	{"slack replayed", Slack{}, map[string]string{
+		"X-Slack-Signature":         "v0=a2114d57b48eac39b9ad189dd8316235a7b4a8d21a10bd27519666489c69b503",
+		"X-Slack-Request-Timestamp": "1531420618",
+	}, slackBody, "8f742231b10e8888abcd99yyyzzz85a5", 1531420618 + 301, ErrExpired},
+	{"slack tolerance", Slack{Tolerance: time.Hour}, map[string]string{
+		"X-Slack-Signature":         "v0=a2114d57b48eac39b9ad189dd8316235a7b4a8d21a10bd27519666489c69b503",
+		"X-Slack-Request-Timestamp": "1531420618",
+	}, slackBody, "8f742231b10e8888abcd99yyyzzz85a5", 1531420618 + 301, nil},
+	{"slack tampered timestamp", Slack{}, map[string]string{
+		"X-Slack-Signature":         "v0=a2114d57b48eac39b9ad189dd8316235a7b4a8d21a10bd27519666489c69b503",
+		"X-Slack-Request-Timestamp": "1531420619",
+	}, slackBody, "8f742231b10e8888abcd99yyyzzz85a5", 1531420618, ErrMismatch},
+	{"slack no timestamp", Slack{}, map[string]string{
+		"X-Slack-Signature": "v0=a2114d57b48eac39b9ad189dd8316235a7b4a8d21a10bd27519666489c69b503",
+	}, slackBody, "8f742231b10e8888abcd99yyyzzz85a5", 1531420618, ErrMismatch},
+	{"stripe", Stripe{}, map[string]string{
+		"Stripe-Signature": Stripe{}.Sign([]byte(`{"id":"evt_1"}`), "whsec_test", time.Unix(1600000000, 0)),
+	}, `{"id":"evt_1"}`, "whsec_test", 1600000000 - 10, nil},
+	{"stripe second secret", Stripe{}, map[string]string{
+		"Stripe-Signature": "t=1600000000,v1=00ff," + Stripe{}.Sign([]byte(`{"id":"evt_1"}`), "whsec_test", time.Unix(1600000000, 0))[len("t=1600000000,"):] + ",v0=abc",
+	}, `{"id":"evt_1"}`, "whsec_test", 1600000000, nil},
+	{"stripe replayed", Stripe{}, map[string]string{
+		"Stripe-Signature": Stripe{}.Sign([]byte(`{"id":"evt_1"}`), "whsec_test", time.Unix(1600000000, 0)),
+	}, `{"id":"evt_1"}`, "whsec_test", 1600000000 + 3600, ErrExpired},
+	{"stripe tampered body", Stripe{}, map[string]string{
+		"Stripe-Signature": Stripe{}.Sign([]byte(`{"id":"evt_1"}`), "whsec_test", time.Unix(1600000000, 0)),
+	}, `{"id":"evt_2"}`, "whsec_test", 1600000000, ErrMismatch},
+	{"stripe no v1", Stripe{}, map[string]string{"Stripe-Signature": "t=1600000000,v0=abc"}, "{}", "whsec_test", 1600000000, ErrMismatch},
+}
+
+func TestVerify(t *testing.T) {
+	defer func() { now = time.Now }()
+	for _, test := range verifytests {
+		at := time.Unix(test.now, 0)
+		now = func() time.Time { return at }
+		header := make(http.Header)
+		for k, v := range test.header {
+			header.Set(k, v)
+		}
+		if err := test.verifier.Verify(header, []byte(test.body), test.secret); err != test.want {
+			t.Errorf("%s: Verify => want %v got %v", test.name, test.want, err)
+		}
+	}
+}
+
+func TestVerifyTravis(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	payload := `{"id":1,"status":0}`
+	hashed := sha1.Sum([]byte(payload))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA1, hashed[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := []byte(url.Values{"payload": {payload}}.Encode())
+	tampered := []byte(url.Values{"payload": {`{"id":1,"status":1}`}}.Encode())
+
+	for _, test := range []struct {
+		name   string
+		sig    string
+		body   []byte
+		secret string
+		want   error
+	}{
+		{"valid", base64.StdEncoding.EncodeToString(sig), body, publicKey, nil},
+		{"tampered payload", base64.StdEncoding.EncodeToString(sig), tampered, publicKey, ErrMismatch},
+		{"not base64", "!!", body, publicKey, ErrMismatch},
+		{"missing", "", body, publicKey, ErrMissing},
+	} {
+		header := make(http.Header)
+		if test.sig != "" {
+			header.Set("Signature", test.sig)
+		}
+		if err := (Travis{}).Verify(header, test.body, test.secret); err != test.want {
+			t.Errorf("%s: Verify => want %v got %v", test.name, test.want, err)
+		}
+	}
+	header := http.Header{"Signature": {base64.StdEncoding.EncodeToString(sig)}}
+	if err := (Travis{}).Verify(header, body, "not a key"); err == nil || err == ErrMismatch {
+		t.Errorf("bad public key: Verify => want a key error got %v", err)
+	}
+}
+
+func TestVerifyAny(t *testing.T) {
+	body := []byte(`{"zen":"Keep it logically awesome."}`)
+	header := make(http.Header)
+	header.Set("X-Hub-Signature-256", GithubSHA256.Sign(body, "old"))
+	if err := VerifyAny(Github, header, body, "new", "", "old"); err != nil {
+		t.Errorf("VerifyAny with the old secret => want nil got %v", err)
+	}
+	if err := VerifyAny(Github, header, body, "new", "other"); err != ErrMismatch {
+		t.Errorf("VerifyAny without the secret => want %v got %v", ErrMismatch, err)
+	}
+	if err := VerifyAny(Github, make(http.Header), body, "new", "old"); err != ErrMissing {
+		t.Errorf("VerifyAny of an unsigned request => want %v got %v", ErrMissing, err)
+	}
+}
@@ -0,0 +1,183 @@
+// Package silence lets rooms stop notifications about something, e.g. a repository or an alert,
+// for a while with the !silence command. Services opt in by checking Silenced before notifying a
+// room, with the things the notification is about.
+package silence
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/plugin"
+	"github.com/matrix-org/go-neb/types"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxDuration is the longest a silence may last.
+const MaxDuration = 30 * 24 * time.Hour
+
+// minDuration is the shortest a silence may last.
+const minDuration = time.Minute
+
+// Commands returns the commands to silence notifications in a room, list its silences, and lift
+// them.
+func Commands() []plugin.Command {
+	return []plugin.Command{
+		plugin.Command{
+			Path:      []string{"silence"},
+			Arguments: []string{"repo|alertname|label", "duration"},
+			Help:      "Silence notifications about a repo, alert or label in this room for a while, e.g. 2h or 1d",
+			Command: func(roomID, userID string, args []string) (interface{}, error) {
+				return cmdSilence(roomID, userID, args, time.Now())
+			},
+		},
+		plugin.Command{
+			Path: []string{"silences"},
+			Help: "List the notifications silenced in this room",
+			Command: func(roomID, userID string, args []string) (interface{}, error) {
+				return cmdSilences(roomID)
+			},
+		},
+		plugin.Command{
+			Path:      []string{"unsilence"},
+			Arguments: []string{"repo|alertname|label"},
+			Help:      "Lift a silence in this room",
+			Command: func(roomID, userID string, args []string) (interface{}, error) {
+				return cmdUnsilence(roomID, args)
+			},
+		},
+	}
+}
+
+// Silenced returns true if a silence in the room matches any of the things a notification is
+// about, e.g. its repository and labels. Silences match case-insensitively, and may be globs, e.g.
+// "matrix-org/*". If the silences can't be loaded, nothing is silenced.
+func Silenced(roomID string, subjects ...string) bool {
+	if len(subjects) == 0 {
+		return false
+	}
+	return Load(roomID).Matches(subjects...)
+}
+
+// A Set is the silences in a room, loaded once to check several notifications against.
+type Set []types.Silence
+
+// Load loads the silences in the room. If they can't be loaded, the error is logged and the set is
+// empty.
+func Load(roomID string) Set {
+	silences, err := database.GetServiceDB().LoadSilences(roomID)
+	if err != nil {
+		log.WithError(err).WithField("room_id", roomID).Error("Failed to load silences")
+	}
+	return Set(silences)
+}
+
+// Matches returns true if any of the silences match any of the subjects, as for Silenced.
+func (set Set) Matches(subjects ...string) bool {
+	for _, s := range set {
+		for _, subject := range subjects {
+			if matches(s.Matcher, subject) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matches returns true if the lower-cased matcher matches the subject.
+func matches(matcher, subject string) bool {
+	subject = strings.ToLower(subject)
+	if matcher == subject {
+		return true
+	}
+	ok, err := path.Match(matcher, subject)
+	return err == nil && ok
+}
+
+func cmdSilence(roomID, userID string, args []string, now time.Time) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, errors.New("Usage: !silence <repo|alertname|label> <duration>, e.g. !silence matrix-org/go-neb 2h")
+	}
+	matcher := strings.ToLower(args[0])
+	if _, err := path.Match(matcher, ""); err != nil {
+		return nil, fmt.Errorf("%s is not a valid pattern", args[0])
+	}
+	d, err := parseDuration(args[1])
+	if err != nil {
+		return nil, fmt.Errorf("Bad duration %s: %s", args[1], err)
+	}
+	expires := now.Add(d)
+	err = database.GetServiceDB().StoreSilence(types.Silence{
+		RoomID:    roomID,
+		Matcher:   matcher,
+		CreatedBy: userID,
+		CreatedMs: now.UnixNano() / 1000000,
+		ExpiresMs: expires.UnixNano() / 1000000,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &matrix.TextMessage{"m.notice",
+		fmt.Sprintf("Silenced notifications about %s in this room until %s.", matcher, formatTime(expires))}, nil
+}
+
+func cmdSilences(roomID string) (interface{}, error) {
+	silences, err := database.GetServiceDB().LoadSilences(roomID)
+	if err != nil {
+		return nil, err
+	}
+	if len(silences) == 0 {
+		return &matrix.TextMessage{"m.notice", "No notifications are silenced in this room."}, nil
+	}
+	lines := []string{"Silenced in this room:"}
+	for _, s := range silences {
+		expires := time.Unix(0, s.ExpiresMs*1000000)
+		lines = append(lines, fmt.Sprintf(" - %s until %s, by %s", s.Matcher, formatTime(expires), s.CreatedBy))
+	}
+	return &matrix.TextMessage{"m.notice", strings.Join(lines, "\n")}, nil
+}
+
+func cmdUnsilence(roomID string, args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Usage: !unsilence <repo|alertname|label>")
+	}
+	matcher := strings.ToLower(args[0])
+	deleted, err := database.GetServiceDB().DeleteSilence(roomID, matcher)
+	if err != nil {
+		return nil, err
+	}
+	if !deleted {
+		return nil, fmt.Errorf("%s is not silenced in this room. See !silences", matcher)
+	}
+	return &matrix.TextMessage{"m.notice", fmt.Sprintf("Notifications about %s are no longer silenced.", matcher)}, nil
+}
+
+// parseDuration parses how long a silence lasts, e.g. "90m", "2h" or "1d", between a minute and
+// MaxDuration.
+func parseDuration(s string) (time.Duration, error) {
+	var d time.Duration
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, errors.New("must be a number of days, e.g. 1d, or a duration, e.g. 2h")
+		}
+		d = time.Duration(days) * 24 * time.Hour
+	} else {
+		var err error
+		if d, err = time.ParseDuration(s); err != nil {
+			return 0, errors.New("must be a duration, e.g. 2h, or a number of days, e.g. 1d")
+		}
+	}
+	if d < minDuration || d > MaxDuration {
+		return 0, errors.New("must be between 1m and 30d")
+	}
+	return d, nil
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04 MST")
+}
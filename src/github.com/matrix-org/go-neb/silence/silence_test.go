@@ -0,0 +1,60 @@
+package silence
+
+import (
+	"github.com/matrix-org/go-neb/types"
+	"testing"
+	"time"
+)
+
+func TestMatches(t *testing.T) {
+	for _, test := range []struct {
+		matcher string
+		subject string
+		want    bool
+	}{
+		{"matrix-org/go-neb", "Matrix-Org/Go-NEB", true},
+		{"matrix-org/*", "matrix-org/synapse", true},
+		{"matrix-org/*", "vector-im/riot-web", false},
+		{"severity=warning", "severity=warning", true},
+		{"highcpu", "HighCPU", true},
+		{"highcpu", "HighCPUAgain", false},
+	} {
+		if got := matches(test.matcher, test.subject); got != test.want {
+			t.Errorf("matches(%q, %q) => want %v got %v", test.matcher, test.subject, test.want, got)
+		}
+	}
+}
+
+func TestSetMatches(t *testing.T) {
+	set := Set{types.Silence{Matcher: "bug"}, types.Silence{Matcher: "org/*"}}
+	if !set.Matches("other/repo", "Bug") {
+		t.Errorf("Matches of a silenced label => want true")
+	}
+	if set.Matches("other/repo", "feature") {
+		t.Errorf("Matches of nothing silenced => want false")
+	}
+	if Silenced("!r:x") {
+		t.Errorf("Silenced with nothing to match => want false")
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	for s, want := range map[string]time.Duration{"90m": 90 * time.Minute, "2h": 2 * time.Hour, "1d": 24 * time.Hour, "30d": MaxDuration} {
+		if got, err := parseDuration(s); err != nil || got != want {
+			t.Errorf("parseDuration(%q) => want %s got %s, %v", s, want, got, err)
+		}
+	}
+	for _, s := range []string{"soon", "30s", "31d", "xd", "-1h"} {
+		if _, err := parseDuration(s); err == nil {
+			t.Errorf("parseDuration(%q) => want error", s)
+		}
+	}
+}
+
+func TestCmdSilenceUsage(t *testing.T) {
+	for _, args := range [][]string{nil, {"repo"}, {"[", "1h"}, {"repo", "forever"}} {
+		if _, err := cmdSilence("!r:x", "@u:x", args, time.Now()); err == nil {
+			t.Errorf("cmdSilence(%q) => want error", args)
+		}
+	}
+}
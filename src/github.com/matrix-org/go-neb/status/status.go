@@ -0,0 +1,155 @@
+// Package status records recent activity for each service, so that operators can tell a broken
+// integration apart from one which simply has nothing to say. Activity is held in memory and is
+// reset when Go-NEB restarts.
+package status
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// MinQuietPeriod is the shortest time a service can be set to go without webhooks before the
+// operators are alerted.
+const MinQuietPeriod = 10 * time.Minute
+
+// ServiceStatus is the recent activity of a single service. Times are in milliseconds since the
+// Unix epoch, and are 0 if the thing has not happened since Go-NEB started.
+//
+// A webhook request is received, then verified if it passes the service's signature or token
+// check, then either filtered out, because no room wants to hear about it, or forwarded to rooms.
+type ServiceStatus struct {
+	LastReceivedMs  int64  // The last time a webhook (or poll result) was received.
+	LastVerifiedMs  int64  // The last time a webhook passed the service's signature or token check.
+	LastFilteredMs  int64  // The last time a verified webhook was not forwarded to any room.
+	LastForwardedMs int64  // The last time a verified webhook was forwarded to rooms.
+	LastSentMs      int64  // The last time a message was successfully sent into a room.
+	LastErrorMs     int64  // The last time something went wrong.
+	LastError       string // What went wrong.
+	ReceivedCount   int64  // The number of webhooks (or poll results) received.
+	VerifiedCount   int64  // The number of webhooks which passed the signature or token check.
+	FilteredCount   int64  // The number of verified webhooks not forwarded to any room.
+	ForwardedCount  int64  // The number of verified webhooks forwarded to rooms.
+	SentCount       int64  // The number of messages successfully sent into rooms.
+	ErrorCount      int64  // The number of things which went wrong.
+}
+
+var (
+	mu       sync.Mutex
+	statuses = make(map[string]*ServiceStatus) // service_id => status
+)
+
+func update(serviceID string, fn func(s *ServiceStatus, now int64)) {
+	mu.Lock()
+	defer mu.Unlock()
+	s := statuses[serviceID]
+	if s == nil {
+		s = &ServiceStatus{}
+		statuses[serviceID] = s
+	}
+	fn(s, time.Now().UnixNano()/1000000)
+}
+
+// Received records that the service received a webhook or polled for new data.
+func Received(serviceID string) {
+	update(serviceID, func(s *ServiceStatus, now int64) {
+		s.LastReceivedMs = now
+		s.ReceivedCount++
+	})
+}
+
+// Verified records that a webhook the service received passed its signature or token check.
+func Verified(serviceID string) {
+	update(serviceID, func(s *ServiceStatus, now int64) {
+		s.LastVerifiedMs = now
+		s.VerifiedCount++
+	})
+}
+
+// Filtered records that the service didn't forward a verified webhook to any room, e.g. because
+// no room wants events of its type.
+func Filtered(serviceID string) {
+	update(serviceID, func(s *ServiceStatus, now int64) {
+		s.LastFilteredMs = now
+		s.FilteredCount++
+	})
+}
+
+// Forwarded records that the service forwarded a verified webhook to at least one room, whether
+// or not sending the message succeeded.
+func Forwarded(serviceID string) {
+	update(serviceID, func(s *ServiceStatus, now int64) {
+		s.LastForwardedMs = now
+		s.ForwardedCount++
+	})
+}
+
+// Sent records that the service sent a message into a room.
+func Sent(serviceID string) {
+	update(serviceID, func(s *ServiceStatus, now int64) {
+		s.LastSentMs = now
+		s.SentCount++
+	})
+}
+
+// Failed records that the service encountered an error.
+func Failed(serviceID string, err error) {
+	update(serviceID, func(s *ServiceStatus, now int64) {
+		s.LastErrorMs = now
+		s.LastError = err.Error()
+		s.ErrorCount++
+	})
+}
+
+// SendResult records the result of sending a message into a room: Sent if err is nil, else Failed.
+func SendResult(serviceID string, err error) {
+	if err != nil {
+		Failed(serviceID, err)
+	} else {
+		Sent(serviceID)
+	}
+}
+
+// Get returns the status of the given service. A service with no recorded activity has a zero status.
+func Get(serviceID string) ServiceStatus {
+	mu.Lock()
+	defer mu.Unlock()
+	if s := statuses[serviceID]; s != nil {
+		return *s
+	}
+	return ServiceStatus{}
+}
+
+// All returns the status of every service with recorded activity, keyed by service ID.
+func All() map[string]ServiceStatus {
+	mu.Lock()
+	defer mu.Unlock()
+	all := make(map[string]ServiceStatus, len(statuses))
+	for id, s := range statuses {
+		all[id] = *s
+	}
+	return all
+}
+
+// Remove forgets the status of the given service, e.g. because it has been deleted.
+func Remove(serviceID string) {
+	mu.Lock()
+	defer mu.Unlock()
+	delete(statuses, serviceID)
+}
+
+// ParseQuietPeriod parses how long a service may go without a verified webhook before the
+// operators are alerted, e.g. "6h". An empty period is 0, which means they are never alerted.
+func ParseQuietPeriod(period string) (time.Duration, error) {
+	if period == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(period)
+	if err != nil {
+		return 0, err
+	}
+	if d < MinQuietPeriod {
+		return 0, fmt.Errorf("must be at least %s", MinQuietPeriod)
+	}
+	return d, nil
+}
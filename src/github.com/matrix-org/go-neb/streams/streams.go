@@ -0,0 +1,149 @@
+// Package streams keeps a stream running for each service which is a types.Streamer, e.g. to
+// receive posts from a streaming API. Streams are started for new services, restarted when a
+// service's config changes, and stopped when it is deleted.
+package streams
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/matrix"
+	"github.com/matrix-org/go-neb/status"
+	"github.com/matrix-org/go-neb/types"
+	"golang.org/x/net/context"
+	"time"
+)
+
+// checkInterval is how often the services are checked for streams to start or stop, in case one
+// was changed without Wake being called, e.g. by another Go-NEB sharing the database.
+const checkInterval = time.Minute
+
+// minRetryDelay and maxRetryDelay bound how long a stream which stopped waits before starting
+// again. The delay doubles each time the stream stops without having run for maxRetryDelay.
+const (
+	minRetryDelay = 5 * time.Second
+	maxRetryDelay = 5 * time.Minute
+)
+
+// wake is sent to by Wake, so that services are checked straight away.
+var wake = make(chan struct{}, 1)
+
+// A running stream, and the config it was started with.
+type running struct {
+	config []byte
+	cancel context.CancelFunc
+}
+
+// Wake makes the streams of services which have been created, changed or deleted start, restart or
+// stop now, rather than at the next check. Services call it from PostRegister.
+func Wake() {
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
+
+// Start keeps a stream running for each Streamer, in the background, with clients from clientFor.
+func Start(clientFor func(userID string) (*matrix.Client, error)) {
+	go func() {
+		streams := make(map[string]running)
+		ticker := time.NewTicker(checkInterval)
+		defer ticker.Stop()
+		for {
+			check(streams, clientFor)
+			select {
+			case <-ticker.C:
+			case <-wake:
+			}
+		}
+	}()
+}
+
+// check starts the streams which aren't running, restarts those whose service's config has changed,
+// and stops those whose service has been deleted.
+func check(streams map[string]running, clientFor func(userID string) (*matrix.Client, error)) {
+	services, err := database.GetServiceDB().LoadServices()
+	if err != nil {
+		log.WithError(err).Error("Failed to load services to start their streams")
+		return
+	}
+	seen := make(map[string]bool)
+	for _, service := range services {
+		streamer, ok := service.(types.Streamer)
+		if !ok {
+			continue
+		}
+		id := service.ServiceID()
+		seen[id] = true
+		// A service's exported fields are its config, so a change to them means it was reconfigured.
+		config, err := json.Marshal(service)
+		if err != nil {
+			log.WithError(err).WithField("service_id", id).Error("Failed to marshal service to start its stream")
+			continue
+		}
+		config = append(config, service.ServiceUserID()...)
+		if r, ok := streams[id]; ok {
+			if string(r.config) == string(config) {
+				continue
+			}
+			log.WithField("service_id", id).Info("Restarting stream of reconfigured service")
+			r.cancel()
+		}
+		cli, err := clientFor(service.ServiceUserID())
+		if err != nil {
+			log.WithError(err).WithField("service_id", id).Error("Failed to get a client to start a stream")
+			delete(streams, id)
+			continue
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		streams[id] = running{config, cancel}
+		go run(ctx, id, streamer, cli)
+	}
+	for id, r := range streams {
+		if !seen[id] {
+			log.WithField("service_id", id).Info("Stopping stream of deleted service")
+			r.cancel()
+			delete(streams, id)
+		}
+	}
+}
+
+// run runs the stream until the context is cancelled, starting it again whenever it stops.
+func run(ctx context.Context, serviceID string, streamer types.Streamer, cli *matrix.Client) {
+	logger := log.WithField("service_id", serviceID)
+	delay := minRetryDelay
+	for {
+		started := time.Now()
+		err := stream(ctx, streamer, cli)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(started) > maxRetryDelay {
+			delay = minRetryDelay
+		}
+		logger.WithError(err).WithField("retry_in", delay).Warn("Stream stopped")
+		if err != nil {
+			status.Failed(serviceID, err)
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+		if delay *= 2; delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+// stream runs the stream once, recovering if it panics so that it is started again like any other
+// stream which stops.
+func stream(ctx context.Context, streamer types.Streamer, cli *matrix.Client) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Panic: %v", r)
+		}
+	}()
+	return streamer.Stream(ctx, cli)
+}
@@ -0,0 +1,123 @@
+package tokens
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/ops"
+	"github.com/matrix-org/go-neb/types"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reauthInterval is how often a user is asked to log in again because of the same broken token.
+const reauthInterval = 24 * time.Hour
+
+// A Problem is why a user's session in a realm stopped working.
+type Problem struct {
+	Reason   string
+	Since    time.Time
+	token    string    // the access token which stopped working
+	notified time.Time // when the user was last asked to log in again
+}
+
+// A ReauthNotifier asks a user to log in to a realm again, e.g. by sending them a link in a direct
+// message, because of the given problem.
+type ReauthNotifier func(realmID, userID, reason string) error
+
+var problems = struct {
+	sync.Mutex
+	m        map[string]*Problem // sessionKey => problem with the session
+	notifier ReauthNotifier
+}{m: make(map[string]*Problem)}
+
+// sessionKey identifies one of a user's sessions in a realm, by its label.
+func sessionKey(realmID, userID, label string) string {
+	return realmID + " " + userID + " " + label
+}
+
+// SetReauthNotifier sets how users are asked to log in again when their default sessions stop
+// working. Without one, or for labelled sessions, only an operational alert is raised.
+func SetReauthNotifier(notifier ReauthNotifier) {
+	problems.Lock()
+	defer problems.Unlock()
+	problems.notifier = notifier
+}
+
+// SessionProblem returns why the session stopped working, or nil if it is working as far as Go-NEB
+// knows. Problems are forgotten when Go-NEB restarts, or once the user logs in again.
+func SessionProblem(session types.AuthSession) *Problem {
+	problems.Lock()
+	defer problems.Unlock()
+	p, ok := problems.m[sessionKey(session.RealmID(), session.UserID(), types.SessionLabel(session))]
+	if !ok {
+		return nil
+	}
+	if tokenSession, isToken := session.(types.TokenSession); isToken && tokenSession.Token().AccessToken != p.token {
+		return nil
+	}
+	problem := *p
+	return &problem
+}
+
+// resolved records that the session with the given label is working.
+func resolved(realmID, userID, label string) {
+	problems.Lock()
+	defer problems.Unlock()
+	delete(problems.m, sessionKey(realmID, userID, label))
+}
+
+// resolvedToken records that whichever of the user's sessions in the realm holds the given access
+// token is working.
+func resolvedToken(realmID, userID, token string) {
+	problems.Lock()
+	defer problems.Unlock()
+	prefix := sessionKey(realmID, userID, "")
+	for key, p := range problems.m {
+		if strings.HasPrefix(key, prefix) && p.token == token {
+			delete(problems.m, key)
+		}
+	}
+}
+
+// broken records that the session with the given label stopped working with the given access
+// token, raises an operational alert, and asks the user to log in again if it is their default
+// session. Users are asked at most once every reauthInterval for the same token, so that a service
+// which keeps failing doesn't spam them.
+func broken(realmID, userID, label, token, reason string) {
+	key := sessionKey(realmID, userID, label)
+	problems.Lock()
+	p := problems.m[key]
+	if p == nil || p.token != token {
+		// Either the session was working, or the user logged in again and it broke again since.
+		p = &Problem{Reason: reason, Since: time.Now(), token: token}
+		problems.m[key] = p
+	}
+	notifier := problems.notifier
+	if time.Since(p.notified) < reauthInterval {
+		problems.Unlock()
+		return
+	}
+	p.notified = time.Now()
+	problems.Unlock()
+
+	if label != "" {
+		ops.Alert("The session %q of %s in realm %s has stopped working: %s. They need to authenticate again", label, userID, realmID, reason)
+		return
+	}
+	if notifier == nil {
+		ops.Alert("The session of %s in realm %s has stopped working: %s. They need to authenticate again", userID, realmID, reason)
+		return
+	}
+	ops.Alert("The session of %s in realm %s has stopped working: %s. They have been asked to authenticate again", userID, realmID, reason)
+	// Notifying can mean several requests to the homeserver: don't hold up the service which found
+	// the problem.
+	go func() {
+		if err := notifier(realmID, userID, reason); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"user_id":    userID,
+				"realm_id":   realmID,
+			}).Warn("Failed to ask user to authenticate again")
+		}
+	}()
+}
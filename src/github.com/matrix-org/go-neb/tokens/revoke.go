@@ -0,0 +1,156 @@
+package tokens
+
+import (
+	"database/sql"
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/types"
+	"sync"
+	"time"
+)
+
+// A session is removed once upstream has rejected its token rejectThreshold times in a row, over at
+// least rejectPeriod, so that a brief upstream problem doesn't log everyone out.
+const (
+	rejectThreshold = 5
+	rejectPeriod    = 1 * time.Hour
+)
+
+type rejection struct {
+	first time.Time // when it was first rejected since it last worked
+	count int
+}
+
+var rejections = struct {
+	sync.Mutex
+	m map[string]*rejection // realm ID + " " + user ID + " " + access token => its rejections
+}{m: make(map[string]*rejection)}
+
+// Logout removes all of the user's sessions in the given realm. If the realm is a
+// types.RevokingRealm, the sessions' tokens are revoked upstream first. Returns whether they were
+// all revoked upstream, and sql.ErrNoRows if the user has no sessions. Failing to revoke the tokens
+// upstream is logged rather than returned, since the sessions are removed either way.
+func Logout(realmID, userID string) (revoked bool, err error) {
+	db := database.GetServiceDB()
+	realm, err := db.LoadAuthRealm(realmID)
+	if err != nil {
+		return false, err
+	}
+	sessions, err := db.LoadAuthSessionsByUser(realmID, userID)
+	if err != nil {
+		return false, err
+	}
+	if len(sessions) == 0 {
+		return false, sql.ErrNoRows
+	}
+	revoked = revokeSessions(realm, sessions)
+	if err = db.RemoveAuthSession(realmID, userID); err != nil {
+		return revoked, err
+	}
+	log.WithFields(log.Fields{
+		"user_id":  userID,
+		"realm_id": realmID,
+		"revoked":  revoked,
+		"sessions": len(sessions),
+	}).Info("Logged out")
+	return revoked, nil
+}
+
+// LogoutLabel is Logout for only the user's session with the given label.
+func LogoutLabel(realmID, userID, label string) (revoked bool, err error) {
+	db := database.GetServiceDB()
+	realm, err := db.LoadAuthRealm(realmID)
+	if err != nil {
+		return false, err
+	}
+	session, err := db.LoadAuthSessionByLabel(realmID, userID, label)
+	if err != nil {
+		return false, err
+	}
+	revoked = revokeSessions(realm, []types.AuthSession{session})
+	if err = db.RemoveAuthSessionByLabel(realmID, userID, label); err != nil {
+		return revoked, err
+	}
+	log.WithFields(log.Fields{
+		"user_id":  userID,
+		"realm_id": realmID,
+		"label":    label,
+		"revoked":  revoked,
+	}).Info("Logged out")
+	return revoked, nil
+}
+
+// revokeSessions revokes the tokens of the authenticated sessions upstream, if the realm can.
+// Returns whether they were all revoked.
+func revokeSessions(realm types.AuthRealm, sessions []types.AuthSession) bool {
+	revoker, ok := realm.(types.RevokingRealm)
+	if !ok {
+		return false
+	}
+	revoked := true
+	for _, session := range sessions {
+		if !session.Authenticated() {
+			continue
+		}
+		if err := revoker.RevokeSession(session); err != nil {
+			log.WithFields(log.Fields{
+				log.ErrorKey: err,
+				"user_id":    session.UserID(),
+				"realm_id":   session.RealmID(),
+				"label":      types.SessionLabel(session),
+			}).Warn("Failed to revoke session upstream")
+			revoked = false
+		}
+	}
+	return revoked
+}
+
+// Accepted records that upstream accepted the user's access token.
+func Accepted(realmID, userID, token string) {
+	rejections.Lock()
+	delete(rejections.m, realmID+" "+userID+" "+token)
+	rejections.Unlock()
+	resolvedToken(realmID, userID, token)
+}
+
+// Rejected records that upstream rejected the user's access token, e.g. with HTTP 401 because the
+// user revoked it. If it has been rejected persistently, the user's session which holds it is
+// removed, as it will never work again, and an operational alert is raised.
+func Rejected(realmID, userID, token string) {
+	key := realmID + " " + userID + " " + token
+	rejections.Lock()
+	r := rejections.m[key]
+	if r == nil {
+		r = &rejection{first: time.Now()}
+		rejections.m[key] = r
+	}
+	r.count++
+	persistent := r.count >= rejectThreshold && time.Since(r.first) >= rejectPeriod
+	if persistent {
+		delete(rejections.m, key)
+	}
+	rejections.Unlock()
+	if !persistent {
+		return
+	}
+
+	db := database.GetServiceDB()
+	sessions, err := db.LoadAuthSessionsByUser(realmID, userID)
+	if err != nil {
+		log.WithError(err).WithField("realm_id", realmID).Error("Failed to load sessions with a rejected token")
+		return
+	}
+	for _, session := range sessions {
+		// Sessions whose tokens differ have been authenticated again since.
+		tokenSession, ok := session.(types.TokenSession)
+		if !ok || tokenSession.Token().AccessToken != token {
+			continue
+		}
+		label := types.SessionLabel(session)
+		if err = db.RemoveAuthSessionByLabel(realmID, userID, label); err != nil {
+			log.WithError(err).WithField("realm_id", realmID).Error("Failed to remove session with a rejected token")
+			return
+		}
+		broken(realmID, userID, label, token, "its token has been rejected since "+r.first.Format(time.RFC3339)+", so it has been removed")
+	}
+}
@@ -0,0 +1,283 @@
+// Package tokens keeps the OAuth2 access tokens of users' auth sessions fresh, so that services
+// acting as a user keep working after the user's first access token expires.
+//
+// Users can have several sessions in a realm, told apart by their labels (see
+// types.LabelledSession): FindSession picks the least privileged one with the scopes a service
+// needs. GetTokenForUser and Client use the user's default session, and GetTokenForLabel and
+// ClientForLabel the one with the given label.
+//
+// Tokens are refreshed when they are used, via GetTokenForUser or Client, and by a background job
+// started with StartRefresher so that rarely used sessions are refreshed before their refresh
+// tokens lapse too. Refreshed tokens are stored in the user's session: some providers rotate
+// refresh tokens, so the old one stops working once it has been used.
+//
+// Sessions are removed with Logout or LogoutLabel, which also revoke their tokens upstream where
+// possible, or automatically once upstream persistently rejects their tokens.
+//
+// When a session stops working, because its token can't be refreshed or has been rejected for
+// good, an operational alert is raised and the user is asked to log in again with the
+// ReauthNotifier set by SetReauthNotifier. SessionProblem reports why a session stopped working.
+package tokens
+
+import (
+	"database/sql"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"github.com/matrix-org/go-neb/database"
+	"github.com/matrix-org/go-neb/httpclient"
+	"github.com/matrix-org/go-neb/ops"
+	"github.com/matrix-org/go-neb/types"
+	"golang.org/x/oauth2"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// refreshMargin is how long before it expires a token is refreshed, so that it does not expire
+// part way through a service's requests.
+const refreshMargin = 5 * time.Minute
+
+// locks serialises refreshes of the same session, so that a refresh token is only used once.
+var locks = struct {
+	sync.Mutex
+	m map[string]*sync.Mutex // sessionKey => lock
+}{m: make(map[string]*sync.Mutex)}
+
+func lockFor(realmID, userID, label string) *sync.Mutex {
+	locks.Lock()
+	defer locks.Unlock()
+	key := sessionKey(realmID, userID, label)
+	mu, ok := locks.m[key]
+	if !ok {
+		mu = &sync.Mutex{}
+		locks.m[key] = mu
+	}
+	return mu
+}
+
+// GetTokenForUser returns a valid access token for the user's default session in the given realm,
+// refreshing it first if it is about to expire. Returns an error if the realm is not a
+// types.TokenRealm, the user has not authenticated with it, or the token could not be refreshed.
+func GetTokenForUser(realmID, userID string) (*oauth2.Token, error) {
+	return GetTokenForLabel(realmID, userID, "")
+}
+
+// GetTokenForLabel is GetTokenForUser for the user's session with the given label.
+func GetTokenForLabel(realmID, userID, label string) (*oauth2.Token, error) {
+	realm, err := database.GetServiceDB().LoadAuthRealm(realmID)
+	if err != nil {
+		return nil, err
+	}
+	tokenRealm, ok := realm.(types.TokenRealm)
+	if !ok {
+		return nil, errors.New("Realm " + realmID + " does not use OAuth2 tokens")
+	}
+	return getToken(tokenRealm, userID, label, refreshMargin)
+}
+
+// Client returns an HTTP client which authenticates its requests with the access token of the
+// user's default session in the given realm, refreshing it when it is about to expire.
+func Client(realm types.TokenRealm, userID string) *http.Client {
+	return ClientForLabel(realm, userID, "")
+}
+
+// ClientForLabel is Client for the user's session with the given label.
+func ClientForLabel(realm types.TokenRealm, userID, label string) *http.Client {
+	src := &userTokenSource{realm, userID, label}
+	return httpclient.OAuth2(oauth2.ReuseTokenSource(nil, src))
+}
+
+type userTokenSource struct {
+	realm  types.TokenRealm
+	userID string
+	label  string
+}
+
+func (s *userTokenSource) Token() (*oauth2.Token, error) {
+	return getToken(s.realm, s.userID, s.label, refreshMargin)
+}
+
+// FindSession returns the user's least privileged authenticated session in the given realm which
+// has all of the given scopes, i.e. the one with the fewest other scopes. If none are given, any
+// session will do. Sessions which aren't types.ScopedSessions are only returned if no scopes are
+// given. Ties go to the default session, then to the session whose label sorts first. Returns
+// sql.ErrNoRows if the user has no such session.
+func FindSession(realmID, userID string, scopes ...string) (types.AuthSession, error) {
+	sessions, err := database.GetServiceDB().LoadAuthSessionsByUser(realmID, userID)
+	if err != nil {
+		return nil, err
+	}
+	var best types.AuthSession
+	bestScopes := -1
+	for _, session := range sessions {
+		if !session.Authenticated() {
+			continue
+		}
+		var granted []string
+		if scoped, ok := session.(types.ScopedSession); ok {
+			granted = scoped.GrantedScopes()
+		}
+		if !hasScopes(granted, scopes) {
+			continue
+		}
+		// Sessions are in label order, so the first of equally privileged sessions wins.
+		if bestScopes == -1 || len(granted) < bestScopes {
+			best, bestScopes = session, len(granted)
+		}
+	}
+	if best == nil {
+		return nil, sql.ErrNoRows
+	}
+	return best, nil
+}
+
+// hasScopes returns true if all of the wanted scopes are in granted.
+func hasScopes(granted, wanted []string) bool {
+	for _, want := range wanted {
+		found := false
+		for _, got := range granted {
+			if got == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// describeSession names the user's session with the given label, for errors.
+func describeSession(realmID, userID, label string) string {
+	if label == "" {
+		return userID + " in realm " + realmID
+	}
+	return userID + " labelled \"" + label + "\" in realm " + realmID
+}
+
+// loadTokenSession loads the user's authenticated session with the given label.
+func loadTokenSession(realmID, userID, label string) (types.TokenSession, error) {
+	session, err := database.GetServiceDB().LoadAuthSessionByLabel(realmID, userID, label)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.New("No session found for " + describeSession(realmID, userID, label))
+		}
+		return nil, err
+	}
+	tokenSession, ok := session.(types.TokenSession)
+	if !ok {
+		return nil, errors.New("Failed to cast user session to a TokenSession")
+	}
+	if !tokenSession.Authenticated() {
+		return nil, errors.New("No authenticated session found for " + describeSession(realmID, userID, label))
+	}
+	return tokenSession, nil
+}
+
+// getToken returns the token of the user's session with the given label, refreshing it first if
+// it expires within margin.
+func getToken(realm types.TokenRealm, userID, label string, margin time.Duration) (*oauth2.Token, error) {
+	mu := lockFor(realm.ID(), userID, label)
+	mu.Lock()
+	defer mu.Unlock()
+
+	// Load the session with the lock held, in case another goroutine has just refreshed it.
+	tokenSession, err := loadTokenSession(realm.ID(), userID, label)
+	if err != nil {
+		return nil, err
+	}
+	token := tokenSession.Token()
+	if token.Expiry.IsZero() || time.Now().Add(margin).Before(token.Expiry) {
+		resolved(realm.ID(), userID, label)
+		return token, nil
+	}
+	if token.RefreshToken == "" {
+		if token.Valid() {
+			return token, nil
+		}
+		broken(realm.ID(), userID, label, token.AccessToken, "its token has expired and cannot be refreshed")
+		return nil, errors.New("The token of " + describeSession(realm.ID(), userID, label) + " has expired and cannot be refreshed")
+	}
+
+	logger := log.WithFields(log.Fields{
+		"user_id":  userID,
+		"realm_id": realm.ID(),
+		"label":    label,
+	})
+	// Leave out the access token so that the token source refreshes it, rather than returning it
+	// because it has not quite expired yet.
+	refreshed, err := realm.OAuth2Config().TokenSource(httpclient.Context(), &oauth2.Token{
+		RefreshToken: token.RefreshToken,
+	}).Token()
+	if err != nil {
+		if token.Valid() {
+			ops.Alert("Failed to refresh the token of %s: they may need to authenticate again", describeSession(realm.ID(), userID, label))
+			logger.WithError(err).Warn("Failed to refresh token, using the current one until it expires")
+			return token, nil
+		}
+		logger.WithError(err).Warn("Failed to refresh expired token")
+		broken(realm.ID(), userID, label, token.AccessToken, "its token has expired and could not be refreshed")
+		return nil, err
+	}
+	if refreshed.RefreshToken == "" {
+		// Providers which don't rotate refresh tokens don't send them again.
+		refreshed.RefreshToken = token.RefreshToken
+	}
+	tokenSession.SetToken(refreshed)
+	if _, err = database.GetServiceDB().StoreAuthSession(tokenSession); err != nil {
+		// The new token still works for now, but the old refresh token may not next time.
+		logger.WithError(err).Error("Failed to store refreshed token")
+	} else {
+		logger.WithField("expiry", refreshed.Expiry).Info("Refreshed token")
+	}
+	resolved(realm.ID(), userID, label)
+	return refreshed, nil
+}
+
+// StartRefresher starts refreshing, every interval, the tokens which would expire before the next
+// run. Does nothing if interval is 0.
+func StartRefresher(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		for {
+			refreshAll(interval + refreshMargin)
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// refreshAll refreshes every token in every TokenRealm which expires within margin.
+func refreshAll(margin time.Duration) {
+	db := database.GetServiceDB()
+	realms, err := db.LoadAuthRealms()
+	if err != nil {
+		log.WithError(err).Error("Failed to load auth realms to refresh tokens")
+		return
+	}
+	for _, realm := range realms {
+		tokenRealm, ok := realm.(types.TokenRealm)
+		if !ok {
+			continue
+		}
+		sessions, err := db.LoadAuthSessions(realm.ID())
+		if err != nil {
+			log.WithError(err).WithField("realm_id", realm.ID()).Error("Failed to load auth sessions to refresh tokens")
+			continue
+		}
+		for _, session := range sessions {
+			tokenSession, ok := session.(types.TokenSession)
+			if !ok || !tokenSession.Authenticated() {
+				continue
+			}
+			token := tokenSession.Token()
+			if token.RefreshToken == "" || token.Expiry.IsZero() || time.Now().Add(margin).Before(token.Expiry) {
+				continue
+			}
+			// Failures are alerted on by getToken.
+			getToken(tokenRealm, session.UserID(), types.SessionLabel(session), margin)
+		}
+	}
+}
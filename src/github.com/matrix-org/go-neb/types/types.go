@@ -4,11 +4,17 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
 	"github.com/matrix-org/go-neb/matrix"
 	"github.com/matrix-org/go-neb/plugin"
+	"github.com/matrix-org/go-neb/util"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 )
 
 // A ClientConfig is the configuration for a matrix client for a bot to use.
@@ -19,6 +25,8 @@ type ClientConfig struct {
 	Sync          bool   // True to start a sync stream for this user
 	AutoJoinRooms bool   // True to automatically join all rooms for this user
 	DisplayName   string // The display name to set for the matrix client
+	DeviceID      string // The device ID of the access token. Required if Encryption is true.
+	Encryption    bool   // True to encrypt messages sent into encrypted rooms, and decrypt those received from them
 }
 
 // Check that the client has the correct fields.
@@ -29,6 +37,9 @@ func (c *ClientConfig) Check() error {
 	if _, err := url.Parse(c.HomeserverURL); err != nil {
 		return err
 	}
+	if c.Encryption && c.DeviceID == "" {
+		return errors.New(`Must supply a "DeviceID" to enable "Encryption"`)
+	}
 	return nil
 }
 
@@ -40,6 +51,96 @@ type BotOptions struct {
 	Options     map[string]interface{}
 }
 
+// WebhookDelivery is an incoming webhook request which has been stored so that it can be
+// inspected and replayed.
+type WebhookDelivery struct {
+	ID           string
+	ServiceID    string
+	TimeMs       int64 // When the request was received, in milliseconds since the Unix epoch.
+	Method       string
+	URL          string // The request URI, e.g. "/services/hooks/ZWNobw?foo=bar"
+	Header       http.Header
+	Body         string
+	Truncated    bool // True if the Body was too large to store in full. Truncated deliveries cannot be replayed.
+	ResponseCode int  // The HTTP status code the service responded with.
+}
+
+// A DeadLetter is a webhook delivery which a service failed to process, e.g. because it panicked or
+// couldn't send into a room. It is kept until it is replayed successfully or removed.
+type DeadLetter struct {
+	WebhookDelivery
+	Reason        string // Why the last attempt to process the delivery failed.
+	Attempts      int    // The number of times processing the delivery has failed.
+	LastAttemptMs int64  // When processing last failed, in milliseconds since the Unix epoch.
+}
+
+// A KarmaScore is the karma a name has been given in a room, with name++ and name--.
+type KarmaScore struct {
+	Name  string
+	Score int
+}
+
+// A ScheduledJob is something a service has asked package scheduler to do later, e.g. send a
+// reminder. It is stored, so that it is done even if Go-NEB restarts before it is due.
+type ScheduledJob struct {
+	ID        string
+	ServiceID string
+	DueMs     int64           // When the job is next due, in milliseconds since the Unix epoch.
+	Data      json.RawMessage // What the service needs to know to run the job.
+	Attempts  int             // The number of times the job has been started.
+}
+
+// A QueuedMessage is a message which failed to send into a room, waiting for package batch to send
+// it again. It is stored, so that it is sent even if Go-NEB restarts first.
+type QueuedMessage struct {
+	ID         string
+	ServiceIDs []string // The services which sent the message.
+	UserID     string   // Who to send the message as.
+	RoomID     string
+	Content    json.RawMessage // The content of the m.room.message event.
+	Seq        int64           // Orders the messages queued for a room: lower ones are sent first.
+	QueuedMs   int64           // When the message was queued, in milliseconds since the Unix epoch.
+	DueMs      int64           // When to next try sending it, in milliseconds since the Unix epoch.
+	Attempts   int             // The number of times sending it has failed.
+	LastError  string          // Why sending it last failed.
+}
+
+// A Poll is a question put to a room, with the votes cast on it so far.
+type Poll struct {
+	ServiceID string
+	RoomID    string
+	EventID   string // The ID of the event the poll was posted in, which people vote on by reacting to.
+	Question  string
+	Options   []string
+	Votes     map[string]int // User IDs to the index of the option they voted for.
+	// VoteReactions maps the user IDs of those who voted by reacting to the IDs of their reaction
+	// events, so that their vote is withdrawn if the reaction is.
+	VoteReactions map[string]string
+}
+
+// A Silence stops notifications about something, e.g. a repository or an alert, being sent into a
+// room until it expires.
+type Silence struct {
+	RoomID    string
+	Matcher   string // What is silenced, lower-cased, e.g. "matrix-org/go-neb" or "severity=warning".
+	CreatedBy string // The user ID of who silenced it.
+	CreatedMs int64  // When it was silenced, in milliseconds since the Unix epoch.
+	ExpiresMs int64  // When it expires, in milliseconds since the Unix epoch.
+}
+
+// A ServiceChange is a service being created, updated or deleted, as recorded in its history.
+type ServiceChange struct {
+	ServiceID string
+	Version   int64           // Counts the service's changes, from 1.
+	Action    string          // "create", "update" or "delete".
+	Actor     string          // Who made the change, e.g. "admin API from 10.0.0.1" or "config file".
+	Type      string          // The service's type after the change, or before it if it was deleted.
+	UserID    string          // The service's user ID after the change, or before it if it was deleted.
+	OldConfig json.RawMessage `json:",omitempty"` // The config before the change, unless it was created.
+	NewConfig json.RawMessage `json:",omitempty"` // The config after the change, unless it was deleted.
+	TimeMs    int64           // When the change was made, in milliseconds since the Unix epoch.
+}
+
 // A Service is the configuration for a bot service.
 type Service interface {
 	ServiceUserID() string
@@ -47,6 +148,10 @@ type Service interface {
 	ServiceType() string
 	Plugin(cli *matrix.Client, roomID string) plugin.Plugin
 	OnReceiveWebhook(w http.ResponseWriter, req *http.Request, cli *matrix.Client)
+	// ValidateConfig checks the service's config without making any external calls, e.g. that
+	// required fields are set and that keys are well formed. It returns an error for each invalid
+	// field, or nil if the config is valid. Register is only invoked on services with valid config.
+	ValidateConfig() []ConfigError
 	// A lifecycle function which is invoked when the service is being registered. The old service, if one exists, is provided,
 	// along with a Client instance for ServiceUserID(). If this function returns an error, the service will not be registered
 	// or persisted to the database, and the user's request will fail. This can be useful if you depend on external factors
@@ -59,6 +164,185 @@ type Service interface {
 	PostRegister(oldService Service)
 }
 
+// A ConfigError is a problem with a single field of a service's config.
+type ConfigError struct {
+	Field   string // The path to the field, e.g. "Rooms[!foo:bar].Repos[baz]".
+	Message string // What is wrong with it, e.g. "missing '/'".
+}
+
+func (e ConfigError) Error() string {
+	return e.Field + " " + e.Message
+}
+
+// IsRoomID returns true if the given string looks like a matrix room ID, e.g. "!foo:bar".
+func IsRoomID(roomID string) bool {
+	return strings.HasPrefix(roomID, "!") && strings.Contains(roomID, ":")
+}
+
+// IsUserID returns true if the given string looks like a matrix user ID, e.g. "@foo:bar".
+func IsUserID(userID string) bool {
+	return strings.HasPrefix(userID, "@") && strings.Contains(userID, ":")
+}
+
+// IsHTTPURL returns true if the given string is an absolute http or https URL.
+func IsHTTPURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// ValidateCommandPrefixes checks a service's per-room command prefixes, a map of room ID to prefix
+// as given to plugin.Plugin.Prefix, returning an error for each bad entry.
+func ValidateCommandPrefixes(prefixes map[string]string) []ConfigError {
+	roomIDs := util.SortedKeys(prefixes)
+	var errs []ConfigError
+	for _, roomID := range roomIDs {
+		field := "CommandPrefixes[" + roomID + "]"
+		if !IsRoomID(roomID) {
+			errs = append(errs, ConfigError{Field: field, Message: "is not a room ID"})
+		}
+		if err := plugin.ValidatePrefix(prefixes[roomID]); err != nil {
+			errs = append(errs, ConfigError{Field: field, Message: "is not a valid prefix: " + err.Error()})
+		}
+	}
+	return errs
+}
+
+// A RegisterPlan describes the external actions which configuring a service would take.
+type RegisterPlan struct {
+	CreateHooks []string // Webhooks which would be created, e.g. "github.com/owner/repo".
+	DeleteHooks []string // Webhooks which would be deleted.
+	JoinRooms   []string // Rooms the service's client would join.
+	Notes       []string // Anything else which would happen, in words.
+	// CannotPlan is true if the service isn't a RegisterPlanner, so what configuring it would do is
+	// unknown.
+	CannotPlan bool `json:",omitempty"`
+}
+
+// A RegisterPlanner is a Service which can work out what its Register and PostRegister functions
+// would do without doing it. This is used to dry-run configuration changes. Services whose Register
+// function takes external actions (e.g. creating webhooks) must implement it. Register is never
+// called by a dry run: the plans of services which don't implement it only say that they can't be
+// planned.
+type RegisterPlanner interface {
+	// PlanRegister validates the service and returns the actions Register and PostRegister would
+	// take, given the same old service and client. It must not change anything.
+	PlanRegister(oldService Service, client *matrix.Client) (*RegisterPlan, error)
+}
+
+// A RegisterChecker is a Service which can check that what its Register function set up, e.g.
+// webhooks on remote services, is still in place. This is used to find broken services at startup.
+type RegisterChecker interface {
+	// CheckRegistered returns a description of each problem found, e.g. "No webhook on
+	// github.com/owner/repo", or an error if the service is invalid. It must not change anything.
+	// Calling Register with no old service should fix the problems it finds.
+	CheckRegistered(client *matrix.Client) ([]string, error)
+}
+
+// PlanJoinRooms returns which of the rooms the client would have to join, for a RegisterPlan. If the
+// client's rooms can't be listed, every room is returned: joining a room the client is already in
+// does nothing, so the worst case is that the plan lists some rooms which don't need joining.
+func PlanJoinRooms(client *matrix.Client, roomIDs []string) []string {
+	joinedRooms, err := client.JoinedRooms()
+	if err != nil {
+		log.WithError(err).WithField("user_id", client.UserID).Warn("Failed to fetch joined rooms")
+	}
+	notJoined, _ := util.Difference(append([]string(nil), roomIDs...), joinedRooms)
+	return notJoined
+}
+
+// CheckJoinedRooms returns a problem for each of the rooms the client isn't in, for
+// CheckRegistered, or one problem if the client's rooms can't be listed.
+func CheckJoinedRooms(client *matrix.Client, roomIDs []string) []string {
+	joinedRooms, err := client.JoinedRooms()
+	if err != nil {
+		return []string{fmt.Sprintf("Failed to list the rooms %s is in: %s", client.UserID, err)}
+	}
+	var problems []string
+	notJoined, _ := util.Difference(append([]string(nil), roomIDs...), joinedRooms)
+	for _, roomID := range notJoined {
+		problems = append(problems, fmt.Sprintf("%s is not in room %s", client.UserID, roomID))
+	}
+	return problems
+}
+
+// A Deregisterer is a Service whose Register function sets things up on remote systems, e.g.
+// webhooks, which should be removed when the service is deleted.
+type Deregisterer interface {
+	// Deregister removes what Register set up, returning a description of each thing removed, e.g.
+	// "Deleted webhook on github.com/owner/repo". It carries on past failures, returning an error
+	// describing them along with what it did remove. The service is deleted either way.
+	Deregister(client *matrix.Client) ([]string, error)
+}
+
+// A MessageObserver is a Service which is passed every message its client receives, rather than
+// just the commands and expansions of its Plugin, e.g. to forward them elsewhere.
+type MessageObserver interface {
+	// OnMessageEvent is called with each m.room.message event in the rooms the client is in,
+	// including notices and the client's own messages. It must not block.
+	OnMessageEvent(cli *matrix.Client, event *matrix.Event)
+}
+
+// A ReactionObserver is a Service which is passed the reactions its client sees, e.g. to count
+// votes.
+type ReactionObserver interface {
+	// OnReactionEvent is called with each m.reaction event in the rooms the client is in, and with
+	// each m.room.redaction event, which may withdraw one. It is called from the same pool of
+	// workers as commands, so should return quickly.
+	OnReactionEvent(cli *matrix.Client, event *matrix.Event)
+}
+
+// A WebhookRotator is a Service which creates webhooks pointing at its endpoint URL on remote
+// systems. When the endpoint is rotated to a new URL, the webhooks are moved to it.
+type WebhookRotator interface {
+	// RotateWebhook points the webhooks which were sent to oldEndpointURL at the service's
+	// current endpoint URL, creating any which are missing.
+	RotateWebhook(oldEndpointURL string) error
+}
+
+// A SecretRotator is a Service whose webhooks on remote systems sign their requests with a secret
+// it gives them. Its secret can be changed without recreating the webhooks.
+type SecretRotator interface {
+	// RotateSecret changes the service's secret to newSecret, and the secret its remote webhooks
+	// sign requests with. Requests signed with the old secret are still accepted for a while, so
+	// that ones sent before the change, or redelivered, aren't rejected.
+	RotateSecret(newSecret string) error
+}
+
+// A WebhookAllowlister is a Service whose webhook requests must come from certain networks.
+// Requests from anywhere else are rejected with HTTP 403 before the service sees them.
+type WebhookAllowlister interface {
+	// WebhookAllowedIPs returns the IP addresses and CIDR ranges which requests may come from, in
+	// the form server.ParseAllowlist takes, or nothing to allow requests from anywhere.
+	WebhookAllowedIPs() []string
+}
+
+// A QuietAlerter is a Service which expects webhooks regularly, so that going without them for a
+// while means its webhook is probably broken, e.g. deleted on the remote system. The operators are
+// alerted when that happens.
+type QuietAlerter interface {
+	// QuietPeriod returns how long the service may go without a verified webhook before the
+	// operators are alerted, or 0 never to alert.
+	QuietPeriod() time.Duration
+}
+
+// A JobRunner is a Service which schedules jobs with package scheduler, and runs them when they are
+// due.
+type JobRunner interface {
+	// RunJob runs a job the service scheduled, with a Client for ServiceUserID(). If it returns an
+	// error, the job is tried again later, a few times.
+	RunJob(cli *matrix.Client, job ScheduledJob) error
+}
+
+// A Streamer is a Service which receives events over long-lived connections to another server,
+// e.g. a streaming API, rather than as webhooks. Package streams keeps a Stream running for each
+// Streamer.
+type Streamer interface {
+	// Stream receives events, with a Client for ServiceUserID(), until the context is cancelled,
+	// which happens when the service's config changes or it is deleted. If it returns before then,
+	// it is called again after a delay.
+	Stream(ctx context.Context, cli *matrix.Client) error
+}
+
 var baseURL = ""
 
 // BaseURL sets the base URL of NEB to the url given. This URL must be accessible from the
@@ -84,17 +368,35 @@ func RegisterService(factory func(string, string, string) Service) {
 	servicesByType[factory("", "", "").ServiceType()] = factory
 }
 
-// CreateService creates a Service of the given type and serviceID.
-// Returns an error if the Service couldn't be created.
-func CreateService(serviceID, serviceType, serviceUserID string, serviceJSON []byte) (Service, error) {
+// ServiceTypes returns an unconfigured Service of each registered type, keyed by type.
+func ServiceTypes() map[string]Service {
+	services := make(map[string]Service, len(servicesByType))
+	for serviceType, f := range servicesByType {
+		services[serviceType] = f("", "", "")
+	}
+	return services
+}
+
+// WebhookEndpointURL returns the URL which webhook requests for the given service are sent to.
+// The webhook key is the secret path segment the service's endpoint was last rotated to, or ""
+// if it has never been rotated.
+func WebhookEndpointURL(serviceID, webhookKey string) string {
+	u := baseURL + "services/hooks/" + base64.RawURLEncoding.EncodeToString([]byte(serviceID))
+	if webhookKey != "" {
+		u += "/" + webhookKey
+	}
+	return u
+}
+
+// CreateService creates a Service of the given type and serviceID, whose webhook endpoint has the
+// given webhook key. Returns an error if the Service couldn't be created.
+func CreateService(serviceID, serviceType, serviceUserID, webhookKey string, serviceJSON []byte) (Service, error) {
 	f := servicesByType[serviceType]
 	if f == nil {
 		return nil, errors.New("Unknown service type: " + serviceType)
 	}
 
-	base64ServiceID := base64.RawURLEncoding.EncodeToString([]byte(serviceID))
-	webhookEndpointURL := baseURL + "services/hooks/" + base64ServiceID
-	service := f(serviceID, serviceUserID, webhookEndpointURL)
+	service := f(serviceID, serviceUserID, WebhookEndpointURL(serviceID, webhookKey))
 	if err := json.Unmarshal(serviceJSON, service); err != nil {
 		return nil, err
 	}
@@ -120,6 +422,15 @@ func RegisterAuthRealm(factory func(string, string) AuthRealm) {
 	realmsByType[factory("", "").Type()] = factory
 }
 
+// AuthRealmTypes returns an unconfigured AuthRealm of each registered type, keyed by type.
+func AuthRealmTypes() map[string]AuthRealm {
+	realms := make(map[string]AuthRealm, len(realmsByType))
+	for realmType, f := range realmsByType {
+		realms[realmType] = f("", "")
+	}
+	return realms
+}
+
 // CreateAuthRealm creates an AuthRealm of the given type and realm ID.
 // Returns an error if the realm couldn't be created or the JSON cannot be unmarshalled.
 func CreateAuthRealm(realmID, realmType string, realmJSON []byte) (AuthRealm, error) {
@@ -148,3 +459,63 @@ type AuthSession interface {
 	Authenticated() bool
 	Info() interface{}
 }
+
+// A TokenRealm is an AuthRealm whose sessions hold OAuth2 access tokens which expire, along with
+// refresh tokens to get new ones with. Go-NEB refreshes them before they expire: see package tokens.
+type TokenRealm interface {
+	AuthRealm
+	// OAuth2Config returns the config used to refresh tokens.
+	OAuth2Config() *oauth2.Config
+}
+
+// A TokenEntryRealm is an AuthRealm which users authenticate with by submitting a token they have
+// made themselves, e.g. a personal access token, rather than by following a link. The token is
+// given to RequestAuthSession as {"Token": "...", "Username": "..."}, which returns an error if it
+// doesn't work.
+type TokenEntryRealm interface {
+	AuthRealm
+	// TokenHelp tells users which token to make, and where.
+	TokenHelp() string
+}
+
+// A RevokingRealm is an AuthRealm which can revoke a session's tokens upstream, so that they stop
+// working even if they have leaked.
+type RevokingRealm interface {
+	AuthRealm
+	RevokeSession(session AuthSession) error
+}
+
+// A TokenSession is an AuthSession which holds OAuth2 tokens, usually one of a TokenRealm.
+type TokenSession interface {
+	AuthSession
+	// Token returns the session's access token, refresh token and expiry.
+	Token() *oauth2.Token
+	// SetToken replaces the session's tokens with a refreshed one.
+	SetToken(token *oauth2.Token)
+}
+
+// A LabelledSession is an AuthSession which can be one of several that a user has in a realm, e.g.
+// with different scopes or for different upstream accounts. A user has at most one session per
+// label in a realm. The session with the empty label, like any AuthSession which isn't a
+// LabelledSession, is the user's default session.
+type LabelledSession interface {
+	AuthSession
+	// SessionLabel returns the label which tells the session apart from the user's others.
+	SessionLabel() string
+}
+
+// SessionLabel returns the session's label, or the empty label if it isn't a LabelledSession.
+func SessionLabel(session AuthSession) string {
+	if labelled, ok := session.(LabelledSession); ok {
+		return labelled.SessionLabel()
+	}
+	return ""
+}
+
+// A ScopedSession is an AuthSession whose access upstream is limited to the scopes the user
+// granted, so that services can pick the user's least privileged session which does what they need.
+type ScopedSession interface {
+	AuthSession
+	// GrantedScopes returns the scopes the user granted.
+	GrantedScopes() []string
+}
@@ -0,0 +1,679 @@
+package ui
+
+// indexHTML is the whole admin UI. It is deliberately dependency-free so that it can be embedded in
+// the binary. Everything displayed is inserted with textContent so config values cannot inject HTML.
+const indexHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Go-NEB admin</title>
+<style>
+body { font-family: sans-serif; margin: 0; color: #222; }
+header { background: #2a2f3a; color: #fff; padding: 8px 16px; display: flex; align-items: center; }
+header h1 { font-size: 18px; margin: 0 24px 0 0; }
+header a { color: #cde; margin-right: 16px; cursor: pointer; }
+header input { margin-left: auto; }
+main { padding: 16px; }
+table { border-collapse: collapse; margin-bottom: 16px; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; vertical-align: top; }
+pre, textarea { font-family: monospace; font-size: 12px; }
+textarea { width: 100%; height: 320px; }
+textarea.field { width: 40em; height: auto; }
+fieldset { margin-bottom: 12px; }
+label { margin-right: 12px; white-space: nowrap; }
+.error { color: #b00; }
+.muted { color: #888; }
+.plan { white-space: pre-line; }
+button { margin-right: 4px; }
+</style>
+</head>
+<body>
+<header>
+  <h1>Go-NEB</h1>
+  <a data-view="rooms">Rooms</a>
+  <a data-view="services">Services</a>
+  <a data-view="realms">Realms</a>
+  <a data-view="status">Status</a>
+  <a data-view="errors">Errors</a>
+  <a data-view="deadletters">Dead letters</a>
+  <input id="token" type="password" placeholder="Admin token">
+</header>
+<main id="main"></main>
+<script>
+"use strict";
+
+// The github-webhook events which can be selected in the service form.
+var GITHUB_EVENTS = ["push", "pull_request", "issues", "issue_comment", "pull_request_review_comment", "release", "create", "delete"];
+
+// REDACTED is shown by the API instead of a secret. Sent back in its place, it keeps the stored secret.
+var REDACTED = "<redacted>";
+
+var main = document.getElementById("main");
+var tokenInput = document.getElementById("token");
+tokenInput.value = sessionStorage.getItem("neb_admin_token") || "";
+tokenInput.onchange = function() {
+	sessionStorage.setItem("neb_admin_token", tokenInput.value);
+	route();
+};
+
+// The path Go-NEB is served under, e.g. "/neb/" behind a reverse proxy. API paths are relative to it.
+var basePath = location.pathname.replace(/admin\/ui\/?$/, "");
+
+function api(method, path, body) {
+	var opts = { method: method, headers: { "Content-Type": "application/json" }, credentials: "same-origin" };
+	if (tokenInput.value) {
+		opts.headers["Authorization"] = "Bearer " + tokenInput.value;
+	}
+	if (body !== undefined) {
+		opts.body = JSON.stringify(body);
+	}
+	return fetch(basePath + path.replace(/^\//, ""), opts).then(function(res) {
+		return res.text().then(function(text) {
+			var data = null;
+			try { data = text ? JSON.parse(text) : null; } catch (e) {}
+			if (!res.ok) {
+				throw new Error((data && data.message) || ("HTTP " + res.status));
+			}
+			return data;
+		});
+	});
+}
+
+// el creates an element. children may be strings, which are added as text, or elements.
+function el(tag, attrs, children) {
+	var e = document.createElement(tag);
+	Object.keys(attrs || {}).forEach(function(k) {
+		if (k.indexOf("on") === 0) {
+			e[k] = attrs[k];
+		} else {
+			e.setAttribute(k, attrs[k]);
+		}
+	});
+	(children || []).forEach(function(c) {
+		e.appendChild(typeof c === "string" ? document.createTextNode(c) : c);
+	});
+	return e;
+}
+
+function show() {
+	main.innerHTML = "";
+	for (var i = 0; i < arguments.length; i++) {
+		main.appendChild(arguments[i]);
+	}
+}
+
+function showError(err) {
+	main.appendChild(el("p", { "class": "error" }, [String(err.message || err)]));
+}
+
+function table(headings, rows) {
+	var t = el("table", {}, [el("tr", {}, headings.map(function(h) { return el("th", {}, [h]); }))]);
+	rows.forEach(function(r) {
+		t.appendChild(el("tr", {}, r.map(function(c) { return el("td", {}, [c]); })));
+	});
+	return t;
+}
+
+function pretty(v) {
+	return el("pre", {}, [JSON.stringify(v, null, 2)]);
+}
+
+// configTypes returns the fields of each realm and service type's config, fetching them the first time.
+var configTypesPromise = null;
+function configTypes() {
+	if (!configTypesPromise) {
+		configTypesPromise = api("GET", "/admin/configTypes").catch(function(err) {
+			configTypesPromise = null;
+			throw err;
+		});
+	}
+	return configTypesPromise;
+}
+
+function showRooms() {
+	Promise.all([api("GET", "/admin/listRooms"), api("GET", "/admin/configureService")]).then(function(res) {
+		var services = res[1].Services;
+		var nodes = [el("h2", {}, ["Rooms"])];
+		res[0].Clients.forEach(function(c) {
+			nodes.push(el("h3", {}, [c.UserID]));
+			if (c.Error) {
+				nodes.push(el("p", { "class": "error" }, ["Failed to fetch rooms: " + c.Error]));
+			}
+			nodes.push(table(["Room", "Services"], c.Rooms.map(function(roomID) {
+				var ids = services.filter(function(s) {
+					return s.UserID === c.UserID && s.Rooms.indexOf(roomID) !== -1;
+				}).map(function(s) { return s.ID + " (" + s.Type + ")"; });
+				return [roomID, ids.length ? ids.join(", ") : el("span", { "class": "muted" }, ["none"])];
+			})));
+		});
+		show.apply(null, nodes);
+	}).catch(showError);
+}
+
+function showServices() {
+	api("GET", "/admin/configureService").then(function(res) {
+		var rows = res.Services.map(function(s) {
+			return [s.ID, s.Type, s.UserID, String(s.Rooms.length),
+				el("span", {}, [
+					el("button", { onclick: function() {
+						api("GET", "/admin/configureService?service_id=" + encodeURIComponent(s.ID)).then(function(res) {
+							editService(res.Services[0]);
+						}).catch(showError);
+					} }, ["Edit"]),
+					el("button", { onclick: function() { showDeliveries(s.ID); } }, ["Deliveries"]),
+					el("button", { onclick: function() {
+						if (confirm("Delete service " + s.ID + "?")) {
+							api("DELETE", "/admin/configureService?service_id=" + encodeURIComponent(s.ID)).then(function(res) {
+								if (res.Problems && res.Problems.length) {
+									alert("Deleted, but failed to clean up:\n" + res.Problems.join("\n"));
+								}
+								showServices();
+							}).catch(showError);
+						}
+					} }, ["Delete"])
+				])];
+		});
+		show(el("h2", {}, ["Services"]),
+			el("button", { onclick: function() { editService(null); } }, ["New service"]),
+			table(["ID", "Type", "User ID", "Rooms", ""], rows));
+	}).catch(showError);
+}
+
+function showDeliveries(serviceID) {
+	var detail = el("div");
+	function showDelivery(id) {
+		api("POST", "/admin/getWebhookDelivery", { ID: id }).then(function(d) {
+			detail.innerHTML = "";
+			detail.appendChild(el("h3", {}, ["Delivery " + d.ID]));
+			detail.appendChild(pretty(d.Header));
+			var body = d.Body;
+			try { body = JSON.stringify(JSON.parse(body), null, 2); } catch (e) {}
+			detail.appendChild(el("pre", {}, [body + (d.Truncated ? "\n[truncated]" : "")]));
+		}).catch(showError);
+	}
+	function replay(id) {
+		api("POST", "/admin/replayWebhookDelivery", { ID: id }).then(function(res) {
+			detail.innerHTML = "";
+			detail.appendChild(el("h3", {}, ["Replayed " + id + " (request ID " + res.RequestID + ")"]));
+			detail.appendChild(el("p", {}, ["Service responded with HTTP " + res.Code]));
+			if (res.Body) {
+				detail.appendChild(el("pre", {}, [res.Body]));
+			}
+		}).catch(showError);
+	}
+	function rotate() {
+		if (!confirm("Move " + serviceID + "'s webhook endpoint to a new URL? Requests to the current URL will be rejected.")) {
+			return;
+		}
+		api("POST", "/admin/rotateWebhook", { ID: serviceID }).then(function(res) {
+			detail.innerHTML = "";
+			detail.appendChild(el("h3", {}, ["New webhook URL"]));
+			detail.appendChild(el("pre", {}, [res.WebhookURL]));
+		}).catch(showError);
+	}
+	api("GET", "/admin/webhookDeliveries?service_id=" + encodeURIComponent(serviceID)).then(function(res) {
+		var rows = res.Deliveries.map(function(d) {
+			return [new Date(d.TimeMs).toLocaleString(), d.Method, String(d.Size) + (d.Truncated ? "+" : ""),
+				String(d.ResponseCode),
+				el("span", {}, [
+					el("button", { onclick: function() { showDelivery(d.ID); } }, ["Show"]),
+					el("button", { onclick: function() { replay(d.ID); } }, ["Replay"])
+				])];
+		});
+		show(el("h2", {}, ["Webhook deliveries for " + serviceID]),
+			el("button", { onclick: function() { showDeliveries(serviceID); } }, ["Refresh"]),
+			el("button", { onclick: rotate }, ["Rotate webhook URL"]),
+			el("button", { onclick: showServices }, ["Back"]),
+			table(["Time", "Method", "Size", "Response", ""], rows),
+			detail);
+	}).catch(showError);
+}
+
+function textInput(value, attrs) {
+	attrs = attrs || {};
+	attrs.type = "text";
+	attrs.size = attrs.size || 40;
+	var i = el("input", attrs);
+	i.value = value || "";
+	return i;
+}
+
+// typeInput is a picker of the given types, or a read-only input if the type can't be changed.
+function typeInput(types, value, isNew) {
+	if (!isNew) {
+		return textInput(value, { readonly: "readonly" });
+	}
+	var sel = el("select", {}, [el("option", { value: "" }, ["(choose a type)"])].concat(
+		Object.keys(types).sort().map(function(t) { return el("option", { value: t }, [t]); })));
+	sel.value = value;
+	return sel;
+}
+
+// configEditor returns the editor for a config of the type with the given fields: a form with an
+// input for each field, or a JSON textarea for types the form doesn't know.
+function configEditor(fields, config) {
+	return fields ? fieldsEditor(fields, config) : jsonEditor(config);
+}
+
+function editService(service) {
+	configTypes().then(function(types) {
+		editServiceForm(types.Services, service);
+	}).catch(showError);
+}
+
+function editServiceForm(types, service) {
+	var isNew = !service;
+	service = service || { ID: "", Type: "", UserID: "", Config: {} };
+	var id = textInput(service.ID, isNew ? {} : { readonly: "readonly" });
+	var type = typeInput(types, service.Type, isNew);
+	var userID = textInput(service.UserID);
+	var editorBox = el("div");
+	var editor;
+	function renderEditor() {
+		editor = type.value === "github-webhook" ? githubWebhookEditor(service.Config) : configEditor(types[type.value], service.Config);
+		editorBox.innerHTML = "";
+		editorBox.appendChild(editor.node);
+	}
+	type.onchange = renderEditor;
+	renderEditor();
+
+	var status = el("p");
+	// body returns the request body for the service being edited, or null if the config is invalid.
+	function body() {
+		try {
+			return { ID: id.value, Type: type.value, UserID: userID.value, Config: editor.value() };
+		} catch (e) {
+			status.className = "error";
+			status.textContent = "Invalid config: " + e.message;
+			return null;
+		}
+	}
+	// submit saves the service or, if dryRun is set, shows what saving it would do.
+	function submit(dryRun) {
+		var b = body();
+		if (!b) {
+			return;
+		}
+		api("POST", "/admin/configureService?redact=true" + (dryRun ? "&dry_run=true" : ""), b).then(function(res) {
+			if (!dryRun) {
+				showServices();
+				return;
+			}
+			var lines = [];
+			[["Create webhook", "CreateHooks"], ["Delete webhook", "DeleteHooks"], ["Join room", "JoinRooms"]].forEach(function(a) {
+				(res.Plan[a[1]] || []).forEach(function(x) { lines.push(a[0] + " " + x); });
+			});
+			lines = lines.concat(res.Plan.Notes || []);
+			status.className = "plan";
+			status.textContent = lines.length ? lines.join("\n") : "No external actions would be taken.";
+		}).catch(function(err) {
+			status.className = "error";
+			status.textContent = err.message;
+		});
+	}
+	// validate shows the problems with the config, if any, without contacting anything.
+	function validate() {
+		var b = body();
+		if (!b) {
+			return;
+		}
+		api("POST", "/admin/validateService", b).then(function(res) {
+			status.className = res.Valid ? "plan" : "error plan";
+			status.textContent = res.Valid ? "No problems found." : res.Errors.map(function(e) {
+				return e.Field + " " + e.Message;
+			}).join("\n");
+		}).catch(function(err) {
+			status.className = "error";
+			status.textContent = err.message;
+		});
+	}
+	show(el("h2", {}, [isNew ? "New service" : "Edit service " + service.ID]),
+		el("p", {}, [el("label", {}, ["ID ", id]), el("label", {}, ["Type ", type]), el("label", {}, ["User ID ", userID])]),
+		editorBox,
+		el("button", { onclick: function() { submit(false); } }, ["Save"]),
+		el("button", { onclick: function() { submit(true); } }, ["Dry run"]),
+		el("button", { onclick: validate }, ["Validate"]),
+		el("button", { onclick: showServices }, ["Cancel"]), status);
+}
+
+function jsonEditor(config) {
+	var ta = el("textarea");
+	ta.value = JSON.stringify(config || {}, null, 2);
+	return { node: ta, value: function() { return JSON.parse(ta.value); } };
+}
+
+// secretInput is a password input for a secret. A secret which is shown redacted is left empty,
+// and sent back redacted unless it is changed, so that the stored secret is kept.
+function secretInput(value, attrs) {
+	attrs = attrs || {};
+	attrs.type = "password";
+	attrs.size = attrs.size || 40;
+	var i = el("input", attrs);
+	var wasRedacted = value === REDACTED;
+	if (wasRedacted) {
+		i.placeholder = "unchanged";
+	} else {
+		i.value = value || "";
+	}
+	return { node: i, value: function() { return i.value || (wasRedacted ? REDACTED : ""); } };
+}
+
+// fieldInput returns an input for a config field described by /admin/configTypes. Its value is
+// undefined if the field is left empty, so that it is left out of the config.
+function fieldInput(field, value) {
+	var i;
+	switch (field.Kind) {
+	case "bool":
+		i = el("input", { type: "checkbox" });
+		i.checked = !!value;
+		return { node: i, value: function() { return i.checked || value !== undefined ? i.checked : undefined; } };
+	case "number":
+		i = el("input", { type: "number", step: "any" });
+		i.value = value === undefined ? "" : String(value);
+		return { node: i, value: function() { return i.value === "" ? undefined : Number(i.value); } };
+	case "list":
+		i = el("textarea", { "class": "field", rows: 3, placeholder: "one per line" });
+		i.value = (value || []).join("\n");
+		return { node: i, value: function() {
+			var items = i.value.split("\n").map(function(v) { return v.trim(); }).filter(Boolean);
+			return items.length ? items : undefined;
+		} };
+	case "json":
+		i = el("textarea", { "class": "field", rows: 6, placeholder: "JSON" });
+		i.value = value === undefined ? "" : JSON.stringify(value, null, 2);
+		return { node: i, value: function() {
+			if (!i.value.trim()) {
+				return undefined;
+			}
+			try {
+				return JSON.parse(i.value);
+			} catch (e) {
+				throw new Error(field.Name + ": " + e.message);
+			}
+		} };
+	}
+	var input = field.Secret ? secretInput(value) : { node: textInput(value) };
+	return { node: input.node, value: function() {
+		var v = input.value ? input.value() : input.node.value;
+		return v === "" ? undefined : v;
+	} };
+}
+
+// fieldsEditor is a form with an input for each of a config's fields. Keys of the config which
+// aren't fields are kept as they are.
+function fieldsEditor(fields, config) {
+	config = config || {};
+	var inputs = fields.map(function(f) { return fieldInput(f, config[f.Name]); });
+	var node = table(["Field", "Value"], fields.map(function(f, i) { return [f.Name, inputs[i].node]; }));
+	return { node: node, value: function() {
+		var out = JSON.parse(JSON.stringify(config));
+		fields.forEach(function(f, i) {
+			var v = inputs[i].value();
+			if (v === undefined) {
+				delete out[f.Name];
+			} else {
+				out[f.Name] = v;
+			}
+		});
+		return out;
+	} };
+}
+
+// githubWebhookEditor is a form for github-webhook services, with a repo and event picker per room.
+// setList sets config[key] to the items of a comma separated string, or deletes it if there are none.
+function setList(config, key, value) {
+	var items = value.split(",").map(function(v) { return v.trim(); }).filter(Boolean);
+	if (items.length) {
+		config[key] = items;
+	} else {
+		delete config[key];
+	}
+}
+
+function githubWebhookEditor(config) {
+	config = config || {};
+	var fields = {};
+	var rooms = Object.keys(config.Rooms || {}).map(function(roomID) {
+		var repos = config.Rooms[roomID].Repos || {};
+		return { id: roomID, repos: Object.keys(repos).map(function(name) {
+			// config keeps any repo settings the form doesn't show.
+			return { name: name, events: (repos[name].Events || []).slice(),
+				branches: (repos[name].Branches || []).join(", "),
+				requiredLabels: (repos[name].RequiredLabels || []).join(", "),
+				excludedLabels: (repos[name].ExcludedLabels || []).join(", "), config: repos[name] };
+		}) };
+	});
+	var node = el("div");
+	function render() {
+		node.innerHTML = "";
+		var top = el("p");
+		["ClientUserID", "RealmID", "SecretToken"].forEach(function(k) {
+			if (!fields[k]) {
+				var i = textInput(config[k], { size: 30 });
+				fields[k] = k === "SecretToken" ? secretInput(config[k], { size: 30 }) : { node: i, value: function() { return i.value; } };
+			}
+			top.appendChild(el("label", {}, [k + " ", fields[k].node]));
+		});
+		node.appendChild(top);
+		rooms.forEach(function(room, ri) {
+			var roomInput = textInput(room.id, { placeholder: "!room:example.com" });
+			roomInput.oninput = function() { room.id = roomInput.value; };
+			var fs = el("fieldset", {}, [el("legend", {}, ["Room ", roomInput, " ",
+				el("button", { onclick: function() { rooms.splice(ri, 1); render(); } }, ["Remove room"])])]);
+			room.repos.forEach(function(repo, pi) {
+				var repoInput = textInput(repo.name, { size: 30, placeholder: "owner/repo" });
+				repoInput.oninput = function() { repo.name = repoInput.value; };
+				var row = el("p", {}, [repoInput, " "]);
+				GITHUB_EVENTS.forEach(function(ev) {
+					var cb = el("input", { type: "checkbox" });
+					cb.checked = repo.events.indexOf(ev) !== -1;
+					cb.onchange = function() {
+						repo.events = repo.events.filter(function(e) { return e !== ev; });
+						if (cb.checked) {
+							repo.events.push(ev);
+						}
+					};
+					row.appendChild(el("label", {}, [cb, ev]));
+				});
+				var branchesInput = textInput(repo.branches, { size: 20, placeholder: "all branches" });
+				branchesInput.oninput = function() { repo.branches = branchesInput.value; };
+				row.appendChild(el("label", {}, ["Push branches ", branchesInput]));
+				var requiredInput = textInput(repo.requiredLabels, { size: 15, placeholder: "any labels" });
+				requiredInput.oninput = function() { repo.requiredLabels = requiredInput.value; };
+				row.appendChild(el("label", {}, ["Required labels ", requiredInput]));
+				var excludedInput = textInput(repo.excludedLabels, { size: 15, placeholder: "none" });
+				excludedInput.oninput = function() { repo.excludedLabels = excludedInput.value; };
+				row.appendChild(el("label", {}, ["Excluded labels ", excludedInput]));
+				row.appendChild(el("button", { onclick: function() { room.repos.splice(pi, 1); render(); } }, ["Remove repo"]));
+				fs.appendChild(row);
+			});
+			fs.appendChild(el("button", { onclick: function() {
+				room.repos.push({ name: "", events: ["push"], branches: "", requiredLabels: "", excludedLabels: "", config: {} });
+				render();
+			} }, ["Add repo"]));
+			node.appendChild(fs);
+		});
+		node.appendChild(el("button", { onclick: function() { rooms.push({ id: "", repos: [] }); render(); } }, ["Add room"]));
+	}
+	render();
+	return { node: node, value: function() {
+		var out = JSON.parse(JSON.stringify(config));
+		Object.keys(fields).forEach(function(k) {
+			if (fields[k].value()) {
+				out[k] = fields[k].value();
+			} else {
+				delete out[k];
+			}
+		});
+		out.Rooms = {};
+		rooms.forEach(function(room) {
+			if (!room.id) {
+				throw new Error("every room needs a room ID");
+			}
+			var repos = {};
+			room.repos.forEach(function(repo) {
+				if (!repo.name) {
+					throw new Error("every repo needs a name");
+				}
+				var repoConfig = JSON.parse(JSON.stringify(repo.config));
+				repoConfig.Events = repo.events;
+				setList(repoConfig, "Branches", repo.branches);
+				setList(repoConfig, "RequiredLabels", repo.requiredLabels);
+				setList(repoConfig, "ExcludedLabels", repo.excludedLabels);
+				repos[repo.name] = repoConfig;
+			});
+			out.Rooms[room.id] = { Repos: repos };
+		});
+		return out;
+	} };
+}
+
+function showRealms() {
+	api("GET", "/admin/configureAuthRealm").then(function(res) {
+		var detail = el("div");
+		var rows = res.Realms.map(function(r) {
+			return [r.ID, r.Type, el("span", {}, [
+				el("button", { onclick: function() {
+					detail.innerHTML = "";
+					detail.appendChild(el("h3", {}, [r.ID]));
+					detail.appendChild(pretty(r.Config));
+				} }, ["Show"]),
+				el("button", { onclick: function() { editRealm(r); } }, ["Edit"]),
+				el("button", { onclick: function() {
+					if (confirm("Delete realm " + r.ID + "?")) {
+						api("POST", "/admin/removeAuthRealm", { ID: r.ID }).then(showRealms).catch(showError);
+					}
+				} }, ["Delete"])
+			])];
+		});
+		show(el("h2", {}, ["Realms"]), el("button", { onclick: function() { editRealm(null); } }, ["New realm"]),
+			table(["ID", "Type", ""], rows), detail);
+	}).catch(showError);
+}
+
+function editRealm(realm) {
+	configTypes().then(function(types) {
+		editRealmForm(types.Realms, realm);
+	}).catch(showError);
+}
+
+function editRealmForm(types, realm) {
+	var isNew = !realm;
+	realm = realm || { ID: "", Type: "", Config: {} };
+	var id = textInput(realm.ID, isNew ? {} : { readonly: "readonly" });
+	var type = typeInput(types, realm.Type, isNew);
+	var editorBox = el("div");
+	var editor;
+	function renderEditor() {
+		editor = configEditor(types[type.value], realm.Config);
+		editorBox.innerHTML = "";
+		editorBox.appendChild(editor.node);
+	}
+	type.onchange = renderEditor;
+	renderEditor();
+	var status = el("p", { "class": "error" });
+	show(el("h2", {}, [isNew ? "New realm" : "Edit realm " + realm.ID]),
+		el("p", {}, [el("label", {}, ["ID ", id]), el("label", {}, ["Type ", type])]),
+		editorBox,
+		el("button", { onclick: function() {
+			var config;
+			try {
+				config = editor.value();
+			} catch (e) {
+				status.textContent = "Invalid config: " + e.message;
+				return;
+			}
+			api("POST", "/admin/configureAuthRealm?redact=true", { ID: id.value, Type: type.value, Config: config })
+				.then(showRealms).catch(function(err) { status.textContent = err.message; });
+		} }, ["Save"]),
+		el("button", { onclick: showRealms }, ["Cancel"]), status);
+}
+
+function showStatus() {
+	function when(ms) {
+		return ms ? new Date(ms).toLocaleString() : el("span", { "class": "muted" }, ["never"]);
+	}
+	api("GET", "/admin/serviceStatus").then(function(res) {
+		var rows = res.Services.map(function(s) {
+			return [s.ID, s.Type, when(s.LastReceivedMs), when(s.LastSentMs), when(s.LastErrorMs),
+				el("span", { "class": "error" }, [s.LastError])];
+		});
+		show(el("h2", {}, ["Service status"]),
+			el("p", { "class": "muted" }, ["Activity since Go-NEB last started."]),
+			el("button", { onclick: showStatus }, ["Refresh"]),
+			table(["ID", "Type", "Last received", "Last sent", "Last error", "Error"], rows));
+	}).catch(showError);
+}
+
+function showErrors() {
+	api("GET", "/admin/recentErrors").then(function(res) {
+		var rows = res.Errors.slice().reverse().map(function(e) {
+			var fields = Object.keys(e.Fields).sort().map(function(k) { return k + "=" + e.Fields[k]; });
+			return [new Date(e.Time).toLocaleString(), e.Level, e.Message, fields.join("\n")];
+		});
+		show(el("h2", {}, ["Recent warnings and errors"]),
+			el("button", { onclick: showErrors }, ["Refresh"]),
+			table(["Time", "Level", "Message", "Fields"], rows));
+	}).catch(showError);
+}
+
+function showDeadLetters() {
+	var detail = el("div");
+	function showLetter(id) {
+		api("POST", "/admin/getDeadLetter", { ID: id }).then(function(l) {
+			detail.innerHTML = "";
+			detail.appendChild(el("h3", {}, ["Dead letter " + l.ID + " for " + l.ServiceID]));
+			detail.appendChild(el("p", { "class": "error" }, [l.Reason]));
+			detail.appendChild(pretty(l.Header));
+			var body = l.Body;
+			try { body = JSON.stringify(JSON.parse(body), null, 2); } catch (e) {}
+			detail.appendChild(el("pre", {}, [body + (l.Truncated ? "\n[truncated]" : "")]));
+		}).catch(showError);
+	}
+	function replay(id) {
+		api("POST", "/admin/replayDeadLetter", { ID: id }).then(function(res) {
+			showDeadLetters();
+			alert(res.Failure ? "Failed again: " + res.Failure : "Replayed: service responded with HTTP " + res.Code);
+		}).catch(showError);
+	}
+	function remove(id) {
+		if (confirm("Remove dead letter " + id + " without replaying it?")) {
+			api("POST", "/admin/removeDeadLetter", { ID: id }).then(showDeadLetters).catch(showError);
+		}
+	}
+	api("GET", "/admin/deadLetters").then(function(res) {
+		var rows = res.DeadLetters.map(function(l) {
+			return [new Date(l.TimeMs).toLocaleString(), l.ServiceID, String(l.Attempts),
+				el("span", { "class": "error" }, [l.Reason]),
+				el("span", {}, [
+					el("button", { onclick: function() { showLetter(l.ID); } }, ["Show"]),
+					el("button", { onclick: function() { replay(l.ID); } }, ["Replay"]),
+					el("button", { onclick: function() { remove(l.ID); } }, ["Remove"])
+				])];
+		});
+		show(el("h2", {}, ["Dead letters"]),
+			el("p", { "class": "muted" }, ["Webhook deliveries which services failed to process."]),
+			el("button", { onclick: showDeadLetters }, ["Refresh"]),
+			table(["Received", "Service", "Attempts", "Reason", ""], rows),
+			detail);
+	}).catch(showError);
+}
+
+var views = {
+	rooms: showRooms, services: showServices, realms: showRealms, status: showStatus, errors: showErrors,
+	deadletters: showDeadLetters
+};
+
+function route() {
+	(views[location.hash.slice(1)] || showServices)();
+}
+
+Array.prototype.forEach.call(document.querySelectorAll("header a"), function(a) {
+	a.onclick = function() { location.hash = a.getAttribute("data-view"); };
+});
+window.onhashchange = route;
+route();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,32 @@
+// Package ui serves the Go-NEB admin web UI: a single page which uses the /admin/* APIs to browse
+// and edit clients, rooms, services and realms.
+//
+// The page itself contains no data, so it is served without the admin token. The UI asks for the
+// token and sends it with every API request it makes. It should be served on the same listener as
+// the admin APIs so that ADMIN_BIND_ADDRESS and mutual TLS apply to both.
+package ui
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Path is the path the UI is served on.
+const Path = "/admin/ui/"
+
+// Handler serves the admin UI.
+func Handler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		w.WriteHeader(405)
+		return
+	}
+	if req.URL.Path != strings.TrimSuffix(Path, "/") && req.URL.Path != Path {
+		http.NotFound(w, req)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	// The UI handles admin credentials so it must not be framed by other sites.
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+	w.Write([]byte(indexHTML))
+}
@@ -1,6 +1,8 @@
 package util
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"sort"
 )
 
@@ -33,3 +35,25 @@ func Difference(a, b []string) (onlyA, onlyB []string) {
 		}
 	}
 }
+
+// RandomString generates a cryptographically secure pseudorandom string with
+// the given number of bytes (length). Returns a hex string of the bytes.
+func RandomString(length int) (string, error) {
+	b := make([]byte, length)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// SortedKeys returns the keys of the map, sorted, e.g. so that a service's rooms are always
+// visited in the same order.
+func SortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}